@@ -0,0 +1,54 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the key affinity scoring used by the consistent balancing:
+// weighted rendezvous hashing, mapping a key to the same entity as long as the
+// candidate set is stable, and moving only the keys of the departed (or to the
+// joined) entities on membership changes.
+
+package balancer
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Computes the weighted rendezvous score of a candidate entity for a key. The
+// candidate with the highest score should be picked, resulting in each being
+// chosen proportionally to its weight. Non-positive weights score lowest.
+func Affinity(key string, candidate []byte, weight int) float64 {
+	if weight <= 0 {
+		return math.Inf(-1)
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write(candidate)
+
+	// Avalanche the hash (FNV mixes the high bits poorly), map it uniformly into
+	// (0, 1) and weight the logarithm
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+
+	unit := (float64(sum>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(unit)
+}
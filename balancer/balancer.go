@@ -16,9 +16,11 @@
 // conditions contained in an individually negotiated signed written agreement
 // between you and the author(s).
 
-// Package balancer implements a capacity based load balancer where each entity
-// periodically reports its actual processing capacity and the balancer issues
-// requests based on those numbers.
+// Package balancer defines the load balancing strategy interface used by the
+// carrier topics, along with the default capacity based load balancer where each
+// entity periodically reports its actual processing capacity and the balancer
+// issues requests based on those numbers. Custom strategies can be plugged in
+// through RegisterStrategy.
 package balancer
 
 import (
@@ -29,22 +31,46 @@ import (
 	"sync"
 )
 
-// The load balancer for a single topic.
-type Balancer struct {
-	members  entitySlice  // Entries to which to balance to
-	capacity int          // Total message capacity of the topic
-	lock     sync.RWMutex // Mutex to allow reentrant balancing
+// Load balancing strategy distributing the messages of a single topic between
+// its registered entities. Implementations must be safe for concurrent use.
+type Balancer interface {
+	// Registers an entity to load balance to.
+	Register(id *big.Int)
+
+	// Unregisters an entity from the possible balancing destinations.
+	Unregister(id *big.Int)
+
+	// Updates an entity's reported processing capacity.
+	Update(id *big.Int, cap int) error
+
+	// Returns an id to which to send the next message to, optionally excluding
+	// ex (nil if none) unless it's the only one available.
+	Balance(ex *big.Int) (*big.Int, error)
+
+	// Returns the total capacity of the entities, optionally excluding ex.
+	Capacity(ex *big.Int) int
 }
 
-// Creates a new - empty - load balancer.
-func New() *Balancer {
-	return &Balancer{
+// The capacity based load balancer for a single topic.
+type capacityBalancer struct {
+	members  entitySlice // Entries to which to balance to
+	capacity int         // Total message capacity of the topic
+
+	zone      string  // Zone of the local node to prefer when balancing
+	tolerance float64 // Headroom difference under which local entities are preferred
+
+	lock sync.RWMutex // Mutex to allow reentrant balancing
+}
+
+// Creates a new - empty - capacity based load balancer.
+func New() Balancer {
+	return &capacityBalancer{
 		members: []*entity{},
 	}
 }
 
 // Registers an entity to load balance to (no duplicate checks are done).
-func (b *Balancer) Register(id *big.Int) {
+func (b *capacityBalancer) Register(id *big.Int) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -54,7 +80,7 @@ func (b *Balancer) Register(id *big.Int) {
 }
 
 // Unregisters an entity from the possible balancing destinations.
-func (b *Balancer) Unregister(id *big.Int) {
+func (b *capacityBalancer) Unregister(id *big.Int) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -76,7 +102,7 @@ func (b *Balancer) Unregister(id *big.Int) {
 }
 
 // Updates an entry's capacity to cap.
-func (b *Balancer) Update(id *big.Int, cap int) error {
+func (b *capacityBalancer) Update(id *big.Int, cap int) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -102,7 +128,7 @@ func (b *Balancer) Update(id *big.Int, cap int) error {
 // Returns an id to which to send the next message to. The optional ex (can be
 // nil) is used to exclude an entity from balancing to (if it's the only one
 // available then this guarantee will be forfeit).
-func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
+func (b *capacityBalancer) Balance(ex *big.Int) (*big.Int, error) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
@@ -110,6 +136,10 @@ func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
 	if b.capacity == 0 {
 		return nil, fmt.Errorf("no capacity to balance")
 	}
+	// Prefer the entities in the local zone if any is available
+	if local := b.localize(ex); local != nil {
+		return pick(local, func(m *entity) float64 { return float64(m.cap) }), nil
+	}
 	// Calculate the available capacity with ex excluded
 	available := b.capacity
 	exclude := -1
@@ -140,7 +170,7 @@ func (b *Balancer) Balance(ex *big.Int) (*big.Int, error) {
 
 // Returns the total capacity that the balancer can handle, optionally with ex
 // excluded from the count.
-func (b *Balancer) Capacity(ex *big.Int) int {
+func (b *capacityBalancer) Capacity(ex *big.Int) int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
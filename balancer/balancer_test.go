@@ -21,7 +21,9 @@ package balancer
 import (
 	"math/big"
 	"math/rand"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestBalancer(t *testing.T) {
@@ -102,3 +104,235 @@ func TestBalancer(t *testing.T) {
 		}
 	}
 }
+
+// Balancer always picking the same entity, irrelevant of capacities.
+type fixedBalancer struct {
+	Balancer
+	id *big.Int
+}
+
+func (b *fixedBalancer) Balance(ex *big.Int) (*big.Int, error) {
+	return b.id, nil
+}
+
+func TestStrategies(t *testing.T) {
+	// Make sure the built in strategy is available
+	if bal, err := NewStrategy(CapacityStrategy); err != nil {
+		t.Fatalf("failed to create capacity balancer: %v.", err)
+	} else if _, ok := bal.(*capacityBalancer); !ok {
+		t.Fatalf("capacity balancer type mismatch: have %T, want %T.", bal, &capacityBalancer{})
+	}
+	// Make sure unknown strategies are rejected
+	if _, err := NewStrategy("fixed"); err != ErrUnknownStrategy {
+		t.Fatalf("unknown strategy error mismatch: have %v, want %v.", err, ErrUnknownStrategy)
+	}
+	// Register a custom strategy and ensure it's used
+	fixed := big.NewInt(314)
+	RegisterStrategy("fixed", func() Balancer { return &fixedBalancer{New(), fixed} })
+
+	bal, err := NewStrategy("fixed")
+	if err != nil {
+		t.Fatalf("failed to create custom balancer: %v.", err)
+	}
+	bal.Register(big.NewInt(1))
+	bal.Register(big.NewInt(2))
+	for i := 0; i < 100; i++ {
+		if id, err := bal.Balance(nil); err != nil || id.Cmp(fixed) != 0 {
+			t.Fatalf("balance mismatch: have %v/%v, want %v/nil.", id, err, fixed)
+		}
+	}
+	if cap := bal.Capacity(nil); cap != 2 {
+		t.Fatalf("capacity mismatch: have %v, want %v.", cap, 2)
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	idle, busy := big.NewInt(1), big.NewInt(2)
+
+	bal := NewLeastLoaded()
+	bal.Register(idle)
+	bal.Register(busy)
+
+	aware := bal.(LoadAware)
+	if err := aware.UpdateLoad(idle, Load{CPU: 0.1, Memory: 0.2}); err != nil {
+		t.Fatalf("failed to update idle load: %v.", err)
+	}
+	if err := aware.UpdateLoad(busy, Load{CPU: 0.9, Memory: 0.5, Queue: 1}); err != nil {
+		t.Fatalf("failed to update busy load: %v.", err)
+	}
+	if err := aware.UpdateLoad(big.NewInt(3), Load{}); err == nil {
+		t.Fatalf("load update of non-registered entity succeeded.")
+	}
+	// Check that the least loaded entity is reported
+	if load := aware.Load(nil); load.Memory != 0.2 {
+		t.Fatalf("least load mismatch: have %v, want %v.", load, Load{CPU: 0.1, Memory: 0.2})
+	}
+	if load := aware.Load(idle); load.Queue != 1 {
+		t.Fatalf("excluded least load mismatch: have %v, want %v.", load, Load{CPU: 0.9, Memory: 0.5, Queue: 1})
+	}
+	// Balance a lot of messages and check the headroom based distribution (16:1)
+	counts := make(map[string]int)
+	for i := 0; i < 17000; i++ {
+		id, err := bal.Balance(nil)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		counts[id.String()]++
+	}
+	if ratio := float64(counts[idle.String()]) / float64(counts[busy.String()]); ratio < 12 || ratio > 20 {
+		t.Fatalf("load distribution mismatch: have %v, want %v.", ratio, 16)
+	}
+	// Check that exclusion still works
+	for i := 0; i < 100; i++ {
+		if id, err := bal.Balance(idle); err != nil || id.Cmp(busy) != 0 {
+			t.Fatalf("excluded balance mismatch: have %v/%v, want %v/nil.", id, err, busy)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	fast, slow := big.NewInt(1), big.NewInt(2)
+
+	bal := NewLatencyAdaptive()
+	bal.Register(fast)
+	bal.Register(slow)
+
+	aware := bal.(LatencyAware)
+	if lat := aware.Latency(nil); lat != 0 {
+		t.Fatalf("unreported latency mismatch: have %v, want %v.", lat, 0)
+	}
+	if err := aware.UpdateLatency(big.NewInt(3), time.Millisecond); err == nil {
+		t.Fatalf("latency update of non-registered entity succeeded.")
+	}
+	// Feed some latency samples and check the moving averages
+	for i := 0; i < 32; i++ {
+		aware.UpdateLatency(fast, time.Millisecond)
+		aware.UpdateLatency(slow, 4*time.Millisecond)
+	}
+	aware.UpdateLatency(fast, 0) // Missing sample, ignored
+	if lat := aware.Latency(nil); lat != time.Millisecond {
+		t.Fatalf("fastest latency mismatch: have %v, want %v.", lat, time.Millisecond)
+	}
+	if lat := aware.Latency(fast); lat < 3900*time.Microsecond || lat > 4*time.Millisecond {
+		t.Fatalf("excluded fastest latency mismatch: have %v, want %v.", lat, 4*time.Millisecond)
+	}
+	// Balance a lot of messages and check the speed based distribution (4:1)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		id, err := bal.Balance(nil)
+		if err != nil {
+			t.Fatalf("failed to balance: %v.", err)
+		}
+		counts[id.String()]++
+	}
+	if ratio := float64(counts[fast.String()]) / float64(counts[slow.String()]); ratio < 3 || ratio > 5 {
+		t.Fatalf("latency distribution mismatch: have %v, want %v.", ratio, 4)
+	}
+	// Speed the slow entity up and ensure it's adapted to
+	for i := 0; i < 32; i++ {
+		aware.UpdateLatency(slow, time.Millisecond)
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		id, _ := bal.Balance(nil)
+		counts[id.String()]++
+	}
+	if ratio := float64(counts[fast.String()]) / float64(counts[slow.String()]); ratio < 0.8 || ratio > 1.25 {
+		t.Fatalf("adapted distribution mismatch: have %v, want %v.", ratio, 1)
+	}
+}
+
+func TestLocality(t *testing.T) {
+	local, near, far := big.NewInt(1), big.NewInt(2), big.NewInt(3)
+
+	for _, strategy := range []string{CapacityStrategy, LeastLoadedStrategy, LatencyStrategy} {
+		bal, _ := NewStrategy(strategy)
+		bal.Register(local)
+		bal.Register(near)
+		bal.Register(far)
+
+		zoned := bal.(LocalityAware)
+		zoned.SetZone("eu", 0.25)
+		zoned.UpdateZone(local, "eu")
+		zoned.UpdateZone(near, "eu")
+		zoned.UpdateZone(far, "us")
+
+		// Check the common zone reports
+		if zone := zoned.Zone(far); zone != "eu" {
+			t.Fatalf("%s: common zone mismatch: have %v, want %v.", strategy, zone, "eu")
+		}
+		if zone := zoned.Zone(nil); zone != "" {
+			t.Fatalf("%s: mixed zone mismatch: have %v, want %v.", strategy, zone, "")
+		}
+		// Ensure same-zone entities are preferred, even with ex excluded
+		for i := 0; i < 1000; i++ {
+			if id, err := bal.Balance(local); err != nil || id.Cmp(near) != 0 {
+				t.Fatalf("%s: local balance mismatch: have %v/%v, want %v/nil.", strategy, id, err, near)
+			}
+		}
+		// Ensure overloaded local entities are bypassed if loads are known
+		if aware, ok := bal.(LoadAware); ok {
+			aware.UpdateLoad(near, Load{CPU: 0.95})
+			remote := 0
+			for i := 0; i < 1000; i++ {
+				if id, _ := bal.Balance(local); id.Cmp(far) == 0 {
+					remote++
+				}
+			}
+			if remote < 900 {
+				t.Fatalf("%s: remote fallback mismatch: have %v, want > %v.", strategy, remote, 900)
+			}
+		}
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	keys := 10000
+
+	// Picks the highest scoring candidate of a key
+	choose := func(key string, ids []*big.Int, weights []int) int {
+		best, score := -1, 0.0
+		for i, id := range ids {
+			if s := Affinity(key, id.Bytes(), weights[i]); best == -1 || s > score {
+				best, score = i, s
+			}
+		}
+		return best
+	}
+	// Generate a handful of candidates, one weighing twice the others
+	ids := make([]*big.Int, 5)
+	weights := []int{2, 1, 1, 1, 1}
+	for i := 0; i < len(ids); i++ {
+		ids[i] = big.NewInt(int64(i + 1))
+	}
+	picks := make([]int, keys)
+	counts := make([]int, len(ids))
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		picks[i] = choose(key, ids, weights)
+		counts[picks[i]]++
+
+		// Ensure the mapping is stable
+		if pick := choose(key, ids, weights); pick != picks[i] {
+			t.Fatalf("key %s: unstable pick: have %v, want %v.", key, pick, picks[i])
+		}
+	}
+	// Ensure the keys are distributed proportionally to the weights
+	for i, count := range counts {
+		want := keys * weights[i] / 6
+		if count < want*8/10 || count > want*12/10 {
+			t.Fatalf("candidate %d: key count mismatch: have %v, want ~%v.", i, count, want)
+		}
+	}
+	// Drop a candidate and ensure only its keys are moved
+	for i := 0; i < keys; i++ {
+		pick := choose(strconv.Itoa(i), ids[:4], weights[:4])
+		if picks[i] != 4 && pick != picks[i] {
+			t.Fatalf("key %d: moved from retained candidate: have %v, want %v.", i, pick, picks[i])
+		}
+	}
+	// Ensure zero weights are never picked if others exist
+	if pick := choose("key", ids[:2], []int{0, 1}); pick != 1 {
+		t.Fatalf("zero weight pick mismatch: have %v, want %v.", pick, 1)
+	}
+}
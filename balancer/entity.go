@@ -28,8 +28,12 @@ import (
 
 // Entity and related information.
 type entity struct {
-	id  *big.Int // Unique identifier of the entity
-	cap int      // Message capacity as reported by entity
+	id   *big.Int // Unique identifier of the entity
+	cap  int      // Message capacity as reported by entity
+	load Load     // Resource usage as reported by entity
+	zone string   // Locality tag as reported by entity
+
+	latency float64 // Moving average of the reported reply latencies (ns, 0 = unknown)
 }
 
 // Entity slice implementing sort.Interface.
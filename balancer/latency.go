@@ -0,0 +1,133 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the reply latency tracking and the latency adaptive
+// balancing strategy consuming it: each entity's reported latencies are folded
+// into an exponentially weighted moving average, and faster entities receive
+// proportionally more messages.
+
+package balancer
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Name of the built in latency adaptive balancing strategy.
+const LatencyStrategy = "latency"
+
+// Weight of a fresh latency sample in the moving average of an entity.
+const latencyDecay = 0.3
+
+// Optional extension of Balancer for strategies consuming reply latency reports.
+type LatencyAware interface {
+	// Folds a reported reply latency of an entity into its moving average. Non
+	// positive latencies are treated as missing samples.
+	UpdateLatency(id *big.Int, latency time.Duration) error
+
+	// Returns the average latency of the fastest entity, optionally excluding
+	// ex, or zero if none reported yet.
+	Latency(ex *big.Int) time.Duration
+}
+
+// Latency adaptive balancer, distributing the messages proportionally to the
+// reported capacities, scaled by the relative speed of the entities.
+type latencyBalancer struct {
+	*capacityBalancer
+}
+
+// Creates a new - empty - latency adaptive balancer.
+func NewLatencyAdaptive() Balancer {
+	return &latencyBalancer{New().(*capacityBalancer)}
+}
+
+// Folds a latency sample into an entry's moving average.
+func (b *latencyBalancer) UpdateLatency(id *big.Int, latency time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	idx := b.members.Search(id)
+	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
+		if latency > 0 {
+			m := b.members[idx]
+			if m.latency == 0 {
+				m.latency = float64(latency)
+			} else {
+				m.latency = latencyDecay*float64(latency) + (1-latencyDecay)*m.latency
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("non-registered entity: %v", id)
+}
+
+// Returns the average latency of the fastest entity, with ex excluded.
+func (b *latencyBalancer) Latency(ex *big.Int) time.Duration {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return time.Duration(fastest(b.members, ex))
+}
+
+// Returns an id to which to send the next message to, picked randomly with a
+// probability proportional to its capacity scaled by its speed relative to the
+// fastest entity. Entities without latency reports are considered fast, so they
+// get probed. The optional ex is excluded, unless it's the only one available.
+func (b *latencyBalancer) Balance(ex *big.Int) (*big.Int, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// Make sure there is actually somebody to balance to
+	if len(b.members) == 0 {
+		return nil, fmt.Errorf("no capacity to balance")
+	}
+	// Collect the candidates, preferring the local zone and excluding ex if possible
+	candidates := b.localize(ex)
+	if candidates == nil {
+		candidates = make([]*entity, 0, len(b.members))
+		for _, m := range b.members {
+			if ex != nil && len(b.members) > 1 && m.id.Cmp(ex) == 0 {
+				continue
+			}
+			candidates = append(candidates, m)
+		}
+	}
+	best := fastest(candidates, nil)
+	return pick(candidates, func(m *entity) float64 {
+		if best == 0 || m.latency == 0 {
+			return float64(m.cap)
+		}
+		return float64(m.cap) * best / m.latency
+	}), nil
+}
+
+// Returns the lowest average latency of the reported entities, ex excluded, or
+// zero if none reported yet.
+func fastest(members []*entity, ex *big.Int) float64 {
+	best := 0.0
+	for _, m := range members {
+		if ex != nil && m.id.Cmp(ex) == 0 {
+			continue
+		}
+		if m.latency > 0 && (best == 0 || m.latency < best) {
+			best = m.latency
+		}
+	}
+	return best
+}
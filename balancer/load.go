@@ -0,0 +1,131 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the resource load reports and the weighted least-loaded
+// balancing strategy consuming them.
+
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Name of the built in weighted least-loaded balancing strategy.
+const LeastLoadedStrategy = "least-loaded"
+
+// Minimal headroom attributed to an entity, even if fully loaded, to keep it in
+// the rotation until fresh reports arrive.
+const minHeadroom = 0.05
+
+// Resource usage report of an entity (or the least loaded one behind it).
+type Load struct {
+	CPU    float32 // Processor utilization in [0, 1]
+	Memory float32 // Memory utilization in [0, 1]
+	Queue  int     // Number of messages waiting to be processed
+}
+
+// Computes the fraction of an entity's capacity considered free: the unused
+// part of its most utilized resource, divided between the queued messages.
+func (l Load) headroom() float64 {
+	used := math.Max(float64(l.CPU), float64(l.Memory))
+	return math.Max(minHeadroom, 1-used) / float64(1+l.Queue)
+}
+
+// Optional extension of Balancer for strategies consuming resource reports.
+type LoadAware interface {
+	// Updates an entity's reported resource usage.
+	UpdateLoad(id *big.Int, load Load) error
+
+	// Returns the load of the least loaded entity, optionally excluding ex.
+	Load(ex *big.Int) Load
+}
+
+// Optional extension of Balancer for strategies consuming the custom application
+// metrics attached to the load reports (summed over the members behind an entity).
+type MetricsAware interface {
+	// Updates an entity's reported custom metrics.
+	UpdateMetrics(id *big.Int, metrics map[string]float64) error
+}
+
+// Weighted least-loaded balancer, distributing the messages proportionally to
+// the reported capacities, scaled by the free resources of the entities.
+type loadBalancer struct {
+	*capacityBalancer
+}
+
+// Creates a new - empty - weighted least-loaded balancer.
+func NewLeastLoaded() Balancer {
+	return &loadBalancer{New().(*capacityBalancer)}
+}
+
+// Updates an entry's resource usage to load.
+func (b *loadBalancer) UpdateLoad(id *big.Int, load Load) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	idx := b.members.Search(id)
+	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
+		b.members[idx].load = load
+		return nil
+	}
+	return fmt.Errorf("non-registered entity: %v", id)
+}
+
+// Returns the load of the entity with the most headroom, with ex excluded.
+func (b *loadBalancer) Load(ex *big.Int) Load {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	best, free := Load{}, -1.0
+	for _, m := range b.members {
+		if ex != nil && m.id.Cmp(ex) == 0 {
+			continue
+		}
+		if room := m.load.headroom(); room > free {
+			best, free = m.load, room
+		}
+	}
+	return best
+}
+
+// Returns an id to which to send the next message to, picked randomly with a
+// probability proportional to its capacity scaled by its headroom. The optional
+// ex is excluded, unless it's the only one available.
+func (b *loadBalancer) Balance(ex *big.Int) (*big.Int, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// Make sure there is actually somebody to balance to
+	if len(b.members) == 0 {
+		return nil, fmt.Errorf("no capacity to balance")
+	}
+	// Collect the candidates, preferring the local zone and excluding ex if possible
+	candidates := b.localize(ex)
+	if candidates == nil {
+		candidates = make([]*entity, 0, len(b.members))
+		for _, m := range b.members {
+			if ex != nil && len(b.members) > 1 && m.id.Cmp(ex) == 0 {
+				continue
+			}
+			candidates = append(candidates, m)
+		}
+	}
+	return pick(candidates, func(m *entity) float64 { return float64(m.cap) * m.load.headroom() }), nil
+}
@@ -0,0 +1,130 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the locality awareness of the built in balancers: entities
+// in the same zone (datacenter, availability zone, etc.) as the local node are
+// preferred, as long as they are not considerably more loaded than the others.
+
+package balancer
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+)
+
+// Optional extension of Balancer for strategies preferring entities in the same
+// zone as the local node.
+type LocalityAware interface {
+	// Sets the zone of the local node and the tolerated headroom difference
+	// (fraction) under which local entities are still preferred.
+	SetZone(zone string, tolerance float64)
+
+	// Updates an entity's reported zone.
+	UpdateZone(id *big.Int, zone string) error
+
+	// Returns the common zone of the entities, optionally excluding ex, or the
+	// empty string if they span multiple zones.
+	Zone(ex *big.Int) string
+}
+
+// Sets the zone of the local node and the tolerance of local preference.
+func (b *capacityBalancer) SetZone(zone string, tolerance float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.zone, b.tolerance = zone, tolerance
+}
+
+// Updates an entry's zone.
+func (b *capacityBalancer) UpdateZone(id *big.Int, zone string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	idx := b.members.Search(id)
+	if idx < len(b.members) && b.members[idx].id.Cmp(id) == 0 {
+		b.members[idx].zone = zone
+		return nil
+	}
+	return fmt.Errorf("non-registered entity: %v", id)
+}
+
+// Returns the common zone of the entities with ex excluded, if any.
+func (b *capacityBalancer) Zone(ex *big.Int) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	zone, found := "", false
+	for _, m := range b.members {
+		if ex != nil && m.id.Cmp(ex) == 0 {
+			continue
+		}
+		if !found {
+			zone, found = m.zone, true
+		} else if m.zone != zone {
+			return ""
+		}
+	}
+	return zone
+}
+
+// Collects the entities in the local zone (ex excluded), if the most free one
+// of them has a headroom within the tolerance of the most free one overall. If
+// no locality preference applies, nil is returned. The read lock must be held.
+func (b *capacityBalancer) localize(ex *big.Int) []*entity {
+	if b.zone == "" {
+		return nil
+	}
+	local := []*entity{}
+	localBest, globalBest := 0.0, 0.0
+	for _, m := range b.members {
+		if ex != nil && m.id.Cmp(ex) == 0 {
+			continue
+		}
+		room := m.load.headroom()
+		if room > globalBest {
+			globalBest = room
+		}
+		if m.zone == b.zone {
+			local = append(local, m)
+			if room > localBest {
+				localBest = room
+			}
+		}
+	}
+	if len(local) == 0 || localBest < globalBest*(1-b.tolerance) {
+		return nil
+	}
+	return local
+}
+
+// Picks an entity randomly with a probability proportional to its weight.
+func pick(members []*entity, weight func(m *entity) float64) *big.Int {
+	total := 0.0
+	for _, m := range members {
+		total += weight(m)
+	}
+	target := rand.Float64() * total
+	for _, m := range members {
+		if target -= weight(m); target < 0 {
+			return m.id
+		}
+	}
+	// Floating point rounding might leave a tiny remainder
+	return members[len(members)-1].id
+}
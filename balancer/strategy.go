@@ -0,0 +1,65 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the registry of the load balancing strategies, allowing
+// deployments to plug in their own without touching the carrier.
+
+package balancer
+
+import (
+	"errors"
+	"sync"
+)
+
+// Name of the built in capacity based balancing strategy.
+const CapacityStrategy = "capacity"
+
+// Returned when a balancer is requested with an unregistered strategy.
+var ErrUnknownStrategy = errors.New("unknown balancing strategy")
+
+// Constructor creating a new, empty balancer of a strategy.
+type Factory func() Balancer
+
+// Registered balancing strategies.
+var strategies = map[string]Factory{
+	CapacityStrategy:    New,
+	LeastLoadedStrategy: NewLeastLoaded,
+	LatencyStrategy:     NewLatencyAdaptive,
+}
+var strategyLock sync.RWMutex
+
+// Registers a balancing strategy under the given name, replacing any previous
+// one with the same name.
+func RegisterStrategy(name string, factory Factory) {
+	strategyLock.Lock()
+	defer strategyLock.Unlock()
+
+	strategies[name] = factory
+}
+
+// Creates a new, empty balancer of the named strategy.
+func NewStrategy(name string) (Balancer, error) {
+	strategyLock.RLock()
+	factory, ok := strategies[name]
+	strategyLock.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownStrategy
+	}
+	return factory(), nil
+}
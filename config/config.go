@@ -23,6 +23,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/md5"
+	"crypto/tls"
 	"math/big"
 	"time"
 )
@@ -113,6 +114,9 @@ var StsGenerator = new(big.Int).SetBytes([]byte{
 	0xaa, 0xa0,
 })
 
+// Whether to run the STS key exchange over the X25519 curve instead of the group.
+var StsX25519 = false
+
 // Symmetric cipher to use for the STS encryption.
 var StsCipher = aes.NewCipher
 
@@ -131,14 +135,42 @@ var HkdfSalt = []byte("iris.proto.session.hkdf.salt")
 // Info value for the HKDF key expansion.
 var HkdfInfo = []byte("iris.proto.session.hkdf.info")
 
+// Info value for the HKDF session binding expansion.
+var HkdfBindInfo = []byte("iris.proto.session.hkdf.binding")
+
+// TLS configuration (certificate, cluster CA) replacing the STS handshake of the
+// sessions (nil = STS).
+var SessionTLS *tls.Config
+
+// Period of reloading the certificate revocation lists of the cluster CA.
+var SessionRevocationPeriod = time.Minute
+
+// Label of the session secret exported from the TLS master secret.
+var SessionTLSLabel = "EXPORTER-iris.proto.session.tls"
+
 // Symmetric cipher to use for session encryption.
 var SessionCipher = aes.NewCipher
 
 // Key size for the session symmetric cipher (bits).
 var SessionCipherBits = 128
 
-// Hash creator for the session HMAC.
-var SessionHash = md5.New
+// Hash type for the session HMAC.
+var SessionHash = crypto.MD5
+
+// AEAD modes of the session links in order of preference, negotiated with the
+// remote node (none shared = CTR cipher and HMAC).
+var SessionAEADs = []string{"aes-gcm", "chacha20-poly1305"}
+
+// Whether to put the AEAD mode fastest on the local CPU first in the preferences
+// (AES-GCM with hardware AES support, ChaCha20-Poly1305 without).
+var SessionAEADAccel = true
+
+// Compression codecs of the session links in order of preference, negotiated with
+// the remote node (none shared = uncompressed).
+var SessionCompression = []string{}
+
+// Minimum payload size worth compressing on the session links (bytes).
+var SessionCompressMin = 512
 
 // Maximum allowed time to complete a session connection.
 var SessionDialTimeout = time.Second
@@ -155,6 +187,33 @@ var SessionLinkTimeout = time.Second
 // Time allowance to gracefully terminate a session link.
 var SessionGraceTimeout = 3 * time.Second
 
+// Bandwidth cap of the data link of a single session (bytes/sec, 0 = unlimited).
+var SessionBandwidth = 0
+
+// Bandwidth cap of the data links of all sessions together (bytes/sec, 0 = unlimited).
+var SessionGlobalBandwidth = 0
+
+// Lifetime of the session link keys before rotating them in-band (0 = unlimited).
+var SessionRekeyPeriod = time.Duration(0)
+
+// Volume sent with the session link keys before rotating them in-band (bytes, 0 = unlimited).
+var SessionRekeyBytes = 0
+
+// Lifetime of the tickets resuming recent sessions without a full handshake (0 = disabled).
+var SessionTicketLifetime = 10 * time.Minute
+
+// Maximum number of resumption tickets remembered by each side.
+var SessionTicketCache = 4096
+
+// Highest session protocol version to advertise (lower to pin it during rolling upgrades).
+var SessionVersion = 2
+
+// Full session handshakes accepted per second by each listener (0 = unlimited).
+var SessionShakeRate = 0
+
+// Leading zero bits of the client puzzles demanded above the handshake rate (0 = refuse instead).
+var SessionPuzzleBits = 0
+
 // Symmetric cipher for the temporary message encryption.
 var PacketCipher = aes.NewCipher
 
@@ -179,6 +238,9 @@ var BootScan = 100
 // Number of seeded IP addresses to buffer before sleeping.
 var BootSeedSinkBuffer = 32
 
+// Low host bits of IPv6 subnets to scan and probe around the local address.
+var BootIPv6HostBits = 16
+
 // CoreOS etcd server-to-server ports.
 var BootCoreOSPorts = []int{2380, 7001}
 
@@ -218,42 +280,240 @@ var PastryBeatPeriod = 3 * time.Second
 // Number of missed heartbeats after which to consider a node down.
 var PastryKillCount = 3
 
+// Maximum multiple of the heartbeat period a long-stable peer is beaten at (the
+// tolerated silence is stretched alike, slowing down failure detection).
+var PastryBeatStretch = 4
+
+// Number of consecutive loss-free heartbeats after which the interval of a peer
+// is doubled (up to the stretch limit).
+var PastryBeatCalm = 10
+
+// Fraction of the heartbeat period to randomly delay each beat with, avoiding
+// synchronized heartbeat storms in large clusters.
+var PastryBeatJitter = 0.25
+
+// Listener port of the overlay sessions on every interface (0 = random per interface).
+var PastryListenPort = 0
+
+// Whether to accept overlay sessions on global IPv6 interfaces too (these are not
+// bootstrapped, only reachable through advertisement).
+var PastryIPv6 = false
+
+// Extra addresses (host:port) advertised for the node after its listeners, e.g.
+// external NAT mappings of the listener port.
+var PastryAdvertise = []string(nil)
+
+// Whether the node is a WAN bridge, relaying overlay traffic to the nodes its peers
+// cannot reach directly (e.g. at other sites).
+var PastryBridge = false
+
+// Metadata advertised for the node in the state exchanges (e.g. version, zone,
+// roles, capacity class), exposed to the upper layers of the peers.
+var PastryMetadata = map[string]string(nil)
+
+// Maximum total size of the advertised node metadata (keys and values, bytes).
+var PastryMetadataLimit = 1024
+
+// Remote hosts (IP addresses) and node ids (decimal) banned from the overlay.
+var PastryBans = []string(nil)
+
+// Fingerprints (hex SHA-256) of the node keys allowed to join the overlay (empty =
+// any holder of the cluster key).
+var PastryAllowlist = []string(nil)
+
+// Metric selecting between the next hops of upper layer messages (hops, latency
+// or empty for plain prefix routing).
+var PastryMetric = ""
+
 // Maximum time to queue an authenticated session connection before dropping it.
 var PastryAcceptTimeout = time.Second
 
 // Time to wait after session setup for the init packet.
 var PastryInitTimeout = 5 * time.Second
 
+// Time to wait for a reverse dial checking whether an inbound peer is reachable
+// (0 = disabled, all links assumed bidirectional).
+var PastryDialBackTimeout = 3 * time.Second
+
 // Time limit for sending a message before the connection is dropped.
 var PastrySendTimeout = 3 * time.Second
 
 // Messages to buffer to and from the network.
 var PastryNetBuffer = 64
 
+// Payload size (bytes) above which messages are queued as bulk traffic, yielding
+// to the interactive messages on the same peer.
+var PastryBulkThreshold = 16 * 1024
+
+// Maximum number of interactive messages coalesced into a single link frame to
+// the same peer (below two disables batching).
+var PastryBatchLimit = 32
+
+// Link framing version advertised to the peers during the handshake. Batching and
+// fragmentation are only used if both sides support them (set to zero to keep a
+// mixed-version overlay on the legacy one message per frame framing).
+var PastryLinkVersion = 2
+
+// Maximum payload size of an overlay frame, larger messages are fragmented so a
+// single giant payload cannot monopolize a session (0 = unlimited).
+var PastryFrameLimit = 256 * 1024
+
+// Maximum number of fragmented messages under reassembly per link (oldest dropped).
+var PastryFragmentBacklog = 16
+
+// Number of peers listed in a state exchange above which it is compressed.
+var PastryStatePack = 16
+
+// Number of hot destinations whose resolved next hops are cached (0 = disabled).
+var PastryRouteCache = 4096
+
+// Time a busy peer link waits for further interactive messages to coalesce into
+// the same frame before sending it (only when others were already queued).
+var PastryBatchLinger = 200 * time.Microsecond
+
+// Fill ratio of a peer's outbound data queue above which the node is congested.
+var PastryPressureHigh = 0.75
+
+// Fill ratio of a peer's outbound data queue below which the congestion is lifted.
+var PastryPressureLow = 0.25
+
+// Duration for which a backpressure signal holds back the producers of a peer.
+var PastryThrottleSpan = 500 * time.Millisecond
+
+// Fill ratio of a peer's outbound bulk queue above which bulk transit traffic
+// towards it is shed (0 = disabled).
+var PastryShedLevel = 0.9
+
+// Heartbeat scheduling lag above which the node is deemed CPU overloaded, shedding
+// all bulk transit traffic (0 = disabled).
+var PastryShedLag = 250 * time.Millisecond
+
+// Period of forgetting stale latency measurements and re-optimizing the routing
+// table for network proximity.
+var PastryProximityPeriod = time.Minute
+
+// Relative latency gain a candidate must offer to replace a routing table entry.
+var PastryProximityGain = 0.25
+
+// Period of asking a random routing table peer for its matching row, finding
+// better entries in the background (0 = disabled).
+var PastryTunePeriod = 30 * time.Second
+
+// File to persist the overlay peers into for fast restarts (empty = disabled).
+var PastryStateFile = ""
+
+// Secret seed to derive the node key and id from deterministically (empty = random).
+var PastryIdentitySeed = ""
+
+// Period of persisting the overlay peers (also saved on shutdown).
+var PastryStateSave = time.Minute
+
+// Age after which persisted but unseen peers are forgotten instead of re-dialed.
+var PastryStateExpiry = 24 * time.Hour
+
+// Maximum number of peers persisted (most recently seen ones kept).
+var PastryStatePeers = 64
+
+// Minimum time between two partition checks of the same bootstrap-found node.
+var PastryMergeCooldown = time.Minute
+
+// Maximum time a departing node waits for its peers to route around it.
+var PastryLeaveTimeout = time.Second
+
+// Upper layer silence after which a routing table session is torn down (0 = never).
+var PastryIdleTimeout = time.Duration(0)
+
 // Maximum number of authentications allowed concurrently (per half duplex).
 var PastryAuthThreads = 8
 
 // Maximum number of state exchanges allowed concurrently.
 var PastryExchThreads = 128
 
+// Number of contacts to track per Kademlia bucket (also the closest nodes kept).
+// The Kademlia overlay shares the id space and transport settings of Pastry.
+var KademliaBucket = 8
+
 // Heartbeat period to distribute current CPU load and also check liveliness (ms).
 var ScribeBeatPeriod = time.Second
 
 // Number of missed heartbeats after which to consider a node down.
 var ScribeKillCount = 3
 
+// Number of heartbeats between two load report rounds (must be below the kill count).
+var ScribeReportBeats = 1
+
+// Number of heartbeats between two anti-entropy rounds verifying the topic trees.
+var ScribeRepairBeats = 5
+
+// Number of heartbeats between two root re-subscriptions discovering new roots.
+var ScribeMaintainBeats = 1
+
+// Number of nearest nodes the topic roots replicate their state to as hot standbys
+// (default replication factor, tunable at runtime; 0 = disabled).
+var ScribeStandbys = 2
+
+// Maximum number of remote children a node accepts in a topic tree, pushing any
+// further subscribers down to its children (0 = unlimited).
+var ScribeMaxFanout = 0
+
+// Maximum depth of the topic trees, pushing subscribers reaching deeper nodes up
+// towards the root (0 = unlimited; takes precedence over the fan-out).
+var ScribeMaxDepth = 0
+
+// Lifetime of the local topic registrations unless renewed (0 = never expire).
+var ScribeTopicLease = 5 * time.Minute
+
+// Number of recently seen publishes to remember for duplicate suppression.
+var ScribeDedupCache = 4096
+
+// Separator between the levels of hierarchical topic names.
+var ScribeTopicSeparator = "/"
+
 // Application identifier space (bits).
 var ScribeSpace = 32
 
 // Number of messages to buffer for application delivery before dropping.
 var ScribeAppBuffer = 128
 
+// Number of times a balanced message bouncing off an unreachable member is retried
+// to another one before being returned to the sender as undeliverable.
+var ScribeBalanceRetries = 3
+
+// Wire format of the carrier headers sent out (1 = legacy gob structs, 2 = compact
+// varint layout). Both are always accepted, so keep at 1 until a rolling upgrade
+// reaches all the nodes.
+var ScribeWireVersion = 1
+
+// Structured overlay routing the carrier messages (pastry or kademlia).
+var ScribeRouter = "pastry"
+
+// Load balancing strategy of the topics (see balancer.RegisterStrategy).
+var ScribeBalancer = "capacity"
+
+// Locality tag (zone, datacenter) of the node, preferring same-zone members when
+// balancing (empty = no locality preference).
+var ScribeZone = ""
+
+// Headroom difference (fraction) under which same-zone members are preferred.
+var ScribeZoneTolerance = 0.25
+
 // Number of sub-clusters an app cluster or topic is split into.
 var IrisClusterSplits = 5
 
+// Number of carrier trees each topic split is further sharded into (1 = unsharded).
+var IrisTopicShards = 1
+
+// Number of virtual carrier nodes hosted by the process, taking responsibility for
+// a proportional share of the clusters and topics (weighting stronger machines).
+// Each one runs its own bootstrapper, so at most len(BootPorts) are possible.
+var IrisVirtualNodes = 1
+
 // Maximum number of handlers allowed concurrently per Iris application.
 var IrisHandlerThreads = 16
 
+// Maximum number of pending handler invocations per Iris application (0 = unbounded).
+var IrisHandlerQueue = 0
+
 // Maximum time to queue an established tunnel stream before dropping it.
 var IrisTunnelAcceptTimeout = time.Second
 
@@ -263,6 +523,48 @@ var IrisTunnelInitTimeout = time.Second
 // Send and receive window for tunnel ordering and throttling.
 var IrisTunnelBuffer = 256
 
+// Maximum time to re-establish a broken tunnel link before tearing it down.
+var IrisTunnelResumeTimeout = 3 * time.Second
+
+// Delay between consecutive attempts to re-dial a broken tunnel link.
+var IrisTunnelResumeRetry = 100 * time.Millisecond
+
+// Number of consumed tunnel chunks after which to acknowledge them (at most IrisTunnelBuffer).
+var IrisTunnelAckInterval = 16
+
+// Maximum number of events to buffer for a paused subscription before dropping.
+var IrisPauseBuffer = 1024
+
+// Whether to short-circuit traffic between local connections in-process.
+var IrisLocalFastPath = false
+
+// Maximum time to wait for a remote member count query to be answered.
+var IrisMembersTimeout = 3 * time.Second
+
+// Maximum number of concurrently open tunnels per connection (0 = unlimited).
+var IrisTunnelLimit = 1024
+
+// Maximum number of concurrent outbound tunnels per connection into a single
+// cluster (0 = unlimited).
+var IrisTunnelClusterLimit = 0
+
+// Number of recent latency samples retained for connection statistics.
+var IrisStatsSamples = 1024
+
+// Number of most recent request serving times from which a connection's reply
+// latency is reported to the latency adaptive balancers.
+var IrisLatencyWindow = 64
+
+// Maximum time an outbound operation waits for the carrier backpressure to lift
+// before failing as throttled.
+var IrisPressureTimeout = 5 * time.Second
+
+// Period of exporting the overlay topology into the configured file (if any).
+var IrisTopologyPeriod = time.Minute
+
+// Period of refreshing the readiness file from the overlay status (if any).
+var IrisReadyPeriod = time.Second
+
 // Use in case of federated applications.
 var AppParentId = []byte(nil)
 
@@ -283,3 +585,16 @@ var RelayTunnelTimeout = 3 * time.Second
 
 // Block time when trying a tunnel read.
 var RelayTunnelPoll = time.Second
+
+// Period of the TCP keepalive probes detecting crashed bindings, also renewing
+// the liveness of their Iris connections (must stay below the topic lease).
+var RelayKeepalive = 15 * time.Second
+
+// Messages to buffer to and from a federation link.
+var FederationNetBuffer = 256
+
+// Maximum time to queue an accepted federation session before dropping it.
+var FederationAcceptTimeout = time.Second
+
+// Delay between consecutive attempts to re-dial a broken federation link.
+var FederationRedialPeriod = 3 * time.Second
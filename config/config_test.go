@@ -81,8 +81,8 @@ func TestSession(t *testing.T) {
 		t.Errorf("config (session): failed to create requested cipher: %v.", err)
 	}
 	// Ensure a valid MAC hash
-	if SessionHash() == nil {
-		t.Fatalf("config (session): failed to create requested hasher.")
+	if !SessionHash.Available() {
+		t.Fatalf("config (session): requested hash not linked into binary.")
 	}
 }
 
@@ -32,11 +32,16 @@
 //   AES-128: 2248 bits
 //   AES-192: 5912 bits
 //   AES-256: 11920 bits
+//
+// Alternatively the exchange can run over the X25519 elliptic curve (approx AES-
+// 128 strength), with much cheaper exponentiations and 32 byte exponentials. The
+// curve points are carried in the same big integer exponentials.
 package sts
 
 import (
 	"crypto"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rsa"
 	"errors"
 	"hash"
@@ -65,6 +70,7 @@ type Session struct {
 	generator *big.Int
 
 	exponent   *big.Int
+	curve      *ecdh.PrivateKey // Secret scalar if running over X25519 (nil = group)
 	localExp   *big.Int
 	foreignExp *big.Int
 	secret     *big.Int
@@ -110,13 +116,30 @@ func New(random io.Reader, group, generator *big.Int, cipher func([]byte) (ciphe
 	return ses, nil
 }
 
+// Creates a new STS session over the X25519 elliptic curve instead of a cyclic
+// group, ready to initiate or accept key exchanges. The remaining parameters are
+// the same as for New.
+func NewX25519(random io.Reader, cipher func([]byte) (cipher.Block, error), bits int, hash crypto.Hash) (*Session, error) {
+	key, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	ses := new(Session)
+	ses.curve = key
+	ses.hash = hash
+	ses.crypter = cipher
+	ses.keybits = bits
+
+	return ses, nil
+}
+
 // Initiates an STS exchange session, returning the local exponential to connect with.
 func (s *Session) Initiate() (*big.Int, error) {
 	// Sanity check
 	if s.state != created {
 		return nil, errors.New("only a new session can initiate key exchanges")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	s.localExp = s.exponential()
 	s.state = initiated
 	return s.localExp, nil
 }
@@ -128,9 +151,14 @@ func (s *Session) Accept(random io.Reader, key *rsa.PrivateKey, exp *big.Int) (*
 	if s.state != created {
 		return nil, nil, errors.New("only a new session can accept key exchange requests")
 	}
-	s.localExp = new(big.Int).Exp(s.generator, s.exponent, s.group)
+	s.localExp = s.exponential()
 	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
+
+	secret, err := s.agree(exp)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.secret = secret
 
 	token, err := s.genToken(random, key)
 	if err != nil {
@@ -151,8 +179,13 @@ func (s *Session) Verify(random io.Reader, skey *rsa.PrivateKey, pkey *rsa.Publi
 	}
 	// Verify the authorization token
 	s.foreignExp = exp
-	s.secret = new(big.Int).Exp(exp, s.exponent, s.group)
-	err := s.verToken(pkey, token)
+	secret, err := s.agree(exp)
+	if err != nil {
+		return nil, err
+	}
+	s.secret = secret
+
+	err = s.verToken(pkey, token)
 	if err != nil {
 		return nil, err
 	}
@@ -189,6 +222,35 @@ func (s *Session) Secret() ([]byte, error) {
 	return s.secret.Bytes(), nil
 }
 
+// Calculates the local exponential: the generator raised to the secret exponent,
+// or the public point of the secret scalar on the curve.
+func (s *Session) exponential() *big.Int {
+	if s.curve != nil {
+		return new(big.Int).SetBytes(s.curve.PublicKey().Bytes())
+	}
+	return new(big.Int).Exp(s.generator, s.exponent, s.group)
+}
+
+// Calculates the shared secret from the foreign exponential.
+func (s *Session) agree(exp *big.Int) (*big.Int, error) {
+	if s.curve == nil {
+		return new(big.Int).Exp(exp, s.exponent, s.group), nil
+	}
+	// Restore the fixed size encoding of the curve point and multiply it
+	if exp.Sign() < 0 || exp.BitLen() > 8*len(s.curve.PublicKey().Bytes()) {
+		return nil, errors.New("invalid curve point")
+	}
+	point, err := ecdh.X25519().NewPublicKey(exp.FillBytes(make([]byte, len(s.curve.PublicKey().Bytes()))))
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.curve.ECDH(point)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(secret), nil
+}
+
 // Calculates the authorization token: the encrypted RSA signature of the two exponentials (local first!)
 func (s *Session) genToken(random io.Reader, key *rsa.PrivateKey) ([]byte, error) {
 	// Calculate the RSA signature
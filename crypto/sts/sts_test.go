@@ -467,3 +467,43 @@ func TestSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestX25519(t *testing.T) {
+	iniKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	accKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	for i := 0; i < 16; i++ {
+		iniSes, err := NewX25519(rand.Reader, aes.NewCipher, 128, crypto.SHA256)
+		if err != nil {
+			t.Fatalf("test %d: failed to create session: %v", i, err)
+		}
+		accSes, _ := NewX25519(rand.Reader, aes.NewCipher, 128, crypto.SHA256)
+		iniExp, _ := iniSes.Initiate()
+		if iniExp.BitLen() > 256 {
+			t.Errorf("test %d: exponential too long: have %v bits, want at most 256", i, iniExp.BitLen())
+		}
+		accExp, accToken, err := accSes.Accept(rand.Reader, accKey, iniExp)
+		if err != nil {
+			t.Fatalf("test %d: failed to accept incoming exchange: %v", i, err)
+		}
+		iniToken, err := iniSes.Verify(rand.Reader, iniKey, &accKey.PublicKey, accExp, accToken)
+		if err != nil {
+			t.Fatalf("test %d: failed to verify auth token: %v", i, err)
+		}
+		if err := accSes.Finalize(&iniKey.PublicKey, iniToken); err != nil {
+			t.Fatalf("test %d: failed to finalize key exchange: %v", i, err)
+		}
+		iniSecret, _ := iniSes.Secret()
+		accSecret, _ := accSes.Secret()
+		if !bytes.Equal(iniSecret, accSecret) {
+			t.Errorf("test %d: secret mismatch: initiator %v, acceptor %v", i, iniSecret, accSecret)
+		}
+	}
+	// Ensure low order and oversized points are rejected
+	for i, exp := range []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 256)} {
+		ses, _ := NewX25519(rand.Reader, aes.NewCipher, 128, crypto.SHA256)
+		if _, _, err := ses.Accept(rand.Reader, accKey, exp); err == nil {
+			t.Errorf("invalid point %d accepted", i)
+		}
+	}
+}
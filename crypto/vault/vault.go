@@ -0,0 +1,156 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package vault implements the encrypted storage of the persistent node state
+// (e.g. peer caches, routing snapshots), so that files left on disk reveal or
+// accept nothing without the cluster key.
+//
+// The data is sealed with AES-256-GCM under a storage key derived through HKDF
+// from the cluster key, and is prefixed with a format header. A vault may hold
+// several cluster keys: it seals with the first, but opens with any of them, so
+// state written before a cluster key rotation survives it. Files lacking the
+// header (written before the vault was introduced) are returned as they are, and
+// get sealed on the next write.
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/go.crypto/hkdf"
+)
+
+// Returned when data is to be sealed into a vault without any keys.
+var ErrNoKey = errors.New("no storage key")
+
+// Returned when sealed data cannot be opened with any of the vault's keys.
+var ErrCorrupt = errors.New("sealed data corrupt or sealed with another key")
+
+// Format header of the sealed data, also authenticated alongside.
+var magic = []byte("iris.vault.v1\x00")
+
+// Info value of the storage key's HKDF expansion.
+var keyInfo = []byte("iris.crypto.vault")
+
+// Encrypted storage sealing data with the first of its keys.
+type Vault struct {
+	aeads []cipher.AEAD // Authenticated ciphers of the storage keys, sealing one first
+}
+
+// Creates a vault with storage keys derived from the given cluster keys, sealing
+// with the first one (nil keys are skipped).
+func New(keys ...*rsa.PrivateKey) *Vault {
+	v := new(Vault)
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		secret := make([]byte, 32)
+		kdf := hkdf.New(sha256.New, x509.MarshalPKCS1PrivateKey(key), nil, keyInfo)
+		if _, err := io.ReadFull(kdf, secret); err != nil {
+			panic(fmt.Sprintf("failed to derive storage key: %v", err))
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create storage cipher: %v", err))
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create storage AEAD: %v", err))
+		}
+		v.aeads = append(v.aeads, aead)
+	}
+	return v
+}
+
+// Encrypts and authenticates a blob of data with the first storage key.
+func (v *Vault) Seal(data []byte) ([]byte, error) {
+	if len(v.aeads) == 0 {
+		return nil, ErrNoKey
+	}
+	aead := v.aeads[0]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	blob := append(append([]byte{}, magic...), nonce...)
+	return aead.Seal(blob, nonce, data, magic), nil
+}
+
+// Verifies and decrypts a blob sealed with any of the storage keys. Blobs lacking
+// the format header are considered legacy plain data and returned as is.
+func (v *Vault) Open(blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, magic) {
+		return blob, nil
+	}
+	blob = blob[len(magic):]
+	for _, aead := range v.aeads {
+		if len(blob) < aead.NonceSize() {
+			return nil, ErrCorrupt
+		}
+		if data, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], magic); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrCorrupt
+}
+
+// Seals a blob of data and atomically writes it into a file (temporary file and
+// rename, so that concurrent writers and crashes never leave a corrupt one). The
+// file is created owner-only.
+func (v *Vault) WriteFile(path string, data []byte) error {
+	blob, err := v.Seal(data)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Reads a file and opens the sealed data within.
+func (v *Vault) ReadFile(path string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return v.Open(blob)
+}
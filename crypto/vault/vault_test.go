@@ -0,0 +1,94 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that sealed data can only be opened with the keys it was sealed with,
+// including the secondary ones of a rotation.
+func TestSealOpen(t *testing.T) {
+	old, _ := rsa.GenerateKey(rand.Reader, 1024)
+	cur, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	data := []byte("persistent node state")
+	blob, err := New(old).Seal(data)
+	if err != nil {
+		t.Fatalf("failed to seal data: %v.", err)
+	}
+	if bytes.Contains(blob, data) {
+		t.Fatalf("data sealed in the clear.")
+	}
+	// Open with the original key and with it as a secondary
+	for i, v := range []*Vault{New(old), New(cur, old)} {
+		if plain, err := v.Open(blob); err != nil {
+			t.Fatalf("test %d: failed to open sealed data: %v.", i, err)
+		} else if !bytes.Equal(plain, data) {
+			t.Fatalf("test %d: data mismatch: have %q, want %q.", i, plain, data)
+		}
+	}
+	// Foreign keys and tampering must be detected
+	if _, err := New(cur).Open(blob); err != ErrCorrupt {
+		t.Fatalf("foreign key error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	blob[len(blob)-1]++
+	if _, err := New(old).Open(blob); err != ErrCorrupt {
+		t.Fatalf("tampering error mismatch: have %v, want %v.", err, ErrCorrupt)
+	}
+	// Keyless vaults cannot seal, but legacy plain data passes through
+	if _, err := New(nil).Seal(data); err != ErrNoKey {
+		t.Fatalf("keyless seal error mismatch: have %v, want %v.", err, ErrNoKey)
+	}
+	if plain, err := New().Open(data); err != nil || !bytes.Equal(plain, data) {
+		t.Fatalf("legacy data mismatch: have %q/%v, want %q.", plain, err, data)
+	}
+}
+
+// Tests that files are written sealed and owner-only, and read back intact.
+func TestFile(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("failed to create vault directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path, data := filepath.Join(dir, "state"), []byte("persistent node state")
+	if err := New(key).WriteFile(path, data); err != nil {
+		t.Fatalf("failed to write sealed file: %v.", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("failed to stat sealed file: %v.", err)
+	} else if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("file permission mismatch: have %v, want %v.", perm, os.FileMode(0600))
+	}
+	if plain, err := New(key).ReadFile(path); err != nil {
+		t.Fatalf("failed to read sealed file: %v.", err)
+	} else if !bytes.Equal(plain, data) {
+		t.Fatalf("data mismatch: have %q, want %q.", plain, data)
+	}
+}
@@ -0,0 +1,293 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package filter implements a minimal attribute filter language, allowing event
+// subscribers to declare which events they are interested in.
+//
+// An expression is a disjunction (||) of conjunctions (&&) of terms, where each
+// term is either a bare attribute name (present), or an attribute compared to a
+// value with == or !=. Values may be bare words or double quoted strings. The
+// empty expression matches everything.
+//
+//	region == eu && priority != "low" || urgent
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Interface implemented by messages carrying filterable attributes.
+type Attributed interface {
+	Attributes() map[string]string
+}
+
+// Term comparison operator.
+type operator uint8
+
+const (
+	opExists   operator = iota // Attribute is present
+	opEqual                    // Attribute is present and equals the value
+	opNotEqual                 // Attribute is missing or differs from the value
+)
+
+// Single comparison of a filter expression.
+type term struct {
+	key   string
+	op    operator
+	value string
+}
+
+// Parsed filter expression.
+type Filter struct {
+	alts [][]term // Alternative conjunctions of terms (empty = match all)
+	expr string   // Canonical form of the expression
+}
+
+// Parses a filter expression into its matchable form.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	f := new(Filter)
+	if len(tokens) == 0 {
+		return f, nil
+	}
+	// Parse the alternatives of conjunctions
+	conj := []term{}
+	for i := 0; i < len(tokens); {
+		// Parse the next term: an attribute, optionally compared to a value
+		if tokens[i].kind != tokWord {
+			return nil, fmt.Errorf("filter: attribute expected at %q", tokens[i].text)
+		}
+		t := term{key: tokens[i].text, op: opExists}
+		i++
+		if i < len(tokens) && (tokens[i].text == "==" || tokens[i].text == "!=") && tokens[i].kind == tokOper {
+			if tokens[i].text == "==" {
+				t.op = opEqual
+			} else {
+				t.op = opNotEqual
+			}
+			i++
+			if i == len(tokens) || tokens[i].kind == tokOper {
+				return nil, fmt.Errorf("filter: value expected after %q", t.key)
+			}
+			t.value = tokens[i].text
+			i++
+		}
+		conj = append(conj, t)
+
+		// Parse the connective joining the next term
+		if i == len(tokens) {
+			break
+		}
+		switch {
+		case tokens[i].kind == tokOper && tokens[i].text == "&&":
+		case tokens[i].kind == tokOper && tokens[i].text == "||":
+			f.alts, conj = append(f.alts, conj), []term{}
+		default:
+			return nil, fmt.Errorf("filter: connective expected at %q", tokens[i].text)
+		}
+		if i++; i == len(tokens) {
+			return nil, fmt.Errorf("filter: dangling %q", tokens[i-1].text)
+		}
+	}
+	f.alts = append(f.alts, conj)
+	f.expr = f.canonical()
+
+	return f, nil
+}
+
+// Returns the canonical form of the filter expression.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Returns whether the filter accepts everything.
+func (f *Filter) All() bool {
+	return len(f.alts) == 0
+}
+
+// Checks whether a set of attributes is accepted by the filter.
+func (f *Filter) Match(attrs map[string]string) bool {
+	if len(f.alts) == 0 {
+		return true
+	}
+	for _, conj := range f.alts {
+		if matchAll(conj, attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether all terms of a conjunction are satisfied by the attributes.
+func matchAll(conj []term, attrs map[string]string) bool {
+	for _, t := range conj {
+		value, ok := attrs[t.key]
+		switch t.op {
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opEqual:
+			if !ok || value != t.value {
+				return false
+			}
+		case opNotEqual:
+			if ok && value == t.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Assembles the canonical form of the filter, quoting all values.
+func (f *Filter) canonical() string {
+	alts := make([]string, len(f.alts))
+	for i, conj := range f.alts {
+		terms := make([]string, len(conj))
+		for j, t := range conj {
+			switch t.op {
+			case opExists:
+				terms[j] = t.key
+			case opEqual:
+				terms[j] = t.key + " == " + strconv.Quote(t.value)
+			case opNotEqual:
+				terms[j] = t.key + " != " + strconv.Quote(t.value)
+			}
+		}
+		alts[i] = strings.Join(terms, " && ")
+	}
+	return strings.Join(alts, " || ")
+}
+
+// Disjunction of filters, accepting attributes if any of its members does.
+type Set struct {
+	filters map[string]*Filter // Member filters indexed by canonical expression
+}
+
+// Creates an empty filter set, accepting nothing.
+func NewSet() *Set {
+	return &Set{
+		filters: make(map[string]*Filter),
+	}
+}
+
+// Inserts a filter into the set.
+func (s *Set) Add(f *Filter) {
+	s.filters[f.expr] = f
+}
+
+// Inserts all the filters of another set into the current one.
+func (s *Set) Merge(other *Set) {
+	for expr, f := range other.filters {
+		s.filters[expr] = f
+	}
+}
+
+// Checks whether a set of attributes is accepted by any filter of the set.
+func (s *Set) Match(attrs map[string]string) bool {
+	if _, ok := s.filters[""]; ok {
+		return true
+	}
+	for _, f := range s.filters {
+		if f.Match(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the sorted canonical expressions of the set. If any member accepts
+// everything, the set collapses into the single empty expression.
+func (s *Set) Exprs() []string {
+	if _, ok := s.filters[""]; ok {
+		return []string{""}
+	}
+	exprs := make([]string, 0, len(s.filters))
+	for expr := range s.filters {
+		exprs = append(exprs, expr)
+	}
+	sort.Strings(exprs)
+	return exprs
+}
+
+// Token types of the filter expressions.
+type tokenKind uint8
+
+const (
+	tokWord tokenKind = iota // Bare or quoted word
+	tokOper                  // Operator or connective
+)
+
+// Lexical token of a filter expression.
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// Splits a filter expression into its lexical tokens.
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			// Find the closing quote, skipping escaped characters
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("filter: unterminated string at offset %d", i)
+			}
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at offset %d: %v", i, err)
+			}
+			tokens = append(tokens, token{tokWord, value})
+			i = end + 1
+		case i+1 < len(expr) && (expr[i:i+2] == "==" || expr[i:i+2] == "!=" || expr[i:i+2] == "&&" || expr[i:i+2] == "||"):
+			tokens = append(tokens, token{tokOper, expr[i : i+2]})
+			i += 2
+		case isWordChar(c):
+			end := i
+			for end < len(expr) && isWordChar(expr[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokWord, expr[i:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("filter: unexpected character %q at offset %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// Checks whether a character may be part of a bare word.
+func isWordChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.' || c == ':' || c == '/'
+}
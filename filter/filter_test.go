@@ -0,0 +1,122 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr  string
+		attrs map[string]string
+		match bool
+	}{
+		{"", nil, true},
+		{"urgent", map[string]string{"urgent": ""}, true},
+		{"urgent", map[string]string{}, false},
+		{"region == eu", map[string]string{"region": "eu"}, true},
+		{"region == eu", map[string]string{"region": "us"}, false},
+		{"region == eu", map[string]string{}, false},
+		{"region != eu", map[string]string{"region": "us"}, true},
+		{"region != eu", map[string]string{}, true},
+		{"region != eu", map[string]string{"region": "eu"}, false},
+		{`name == "a b \"c\""`, map[string]string{"name": `a b "c"`}, true},
+		{"region == eu && prio != low", map[string]string{"region": "eu", "prio": "high"}, true},
+		{"region == eu && prio != low", map[string]string{"region": "eu", "prio": "low"}, false},
+		{"region == eu && prio != low || urgent", map[string]string{"region": "eu", "prio": "low", "urgent": "1"}, true},
+		{"region == us || region == eu", map[string]string{"region": "eu"}, true},
+		{"region == us || region == eu", map[string]string{"region": "ap"}, false},
+	}
+	for i, tt := range tests {
+		f, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse %q: %v.", i, tt.expr, err)
+		}
+		if match := f.Match(tt.attrs); match != tt.match {
+			t.Fatalf("test %d: match mismatch for %q on %v: have %v, want %v.", i, tt.expr, tt.attrs, match, tt.match)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"==",
+		"region ==",
+		"region == eu &&",
+		"region eu",
+		`region == "eu`,
+		"region = eu",
+		"|| urgent",
+	}
+	for i, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("test %d: invalid expression %q parsed.", i, expr)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	f, err := Parse(`  region==eu&&prio!="low"||   urgent `)
+	if err != nil {
+		t.Fatalf("failed to parse expression: %v.", err)
+	}
+	if expr := f.String(); expr != `region == "eu" && prio != "low" || urgent` {
+		t.Fatalf("canonical form mismatch: have %q.", expr)
+	}
+	// Make sure the canonical form parses back into itself
+	g, err := Parse(f.String())
+	if err != nil {
+		t.Fatalf("failed to parse canonical form: %v.", err)
+	}
+	if g.String() != f.String() {
+		t.Fatalf("canonical round trip mismatch: have %q, want %q.", g.String(), f.String())
+	}
+}
+
+func TestSet(t *testing.T) {
+	eu, _ := Parse("region == eu")
+	us, _ := Parse("region == us")
+	all, _ := Parse("")
+
+	set := NewSet()
+	if set.Match(map[string]string{"region": "eu"}) {
+		t.Fatalf("empty set matched.")
+	}
+	set.Add(eu)
+	set.Add(us)
+	set.Add(eu)
+	if exprs := set.Exprs(); !reflect.DeepEqual(exprs, []string{`region == "eu"`, `region == "us"`}) {
+		t.Fatalf("set expressions mismatch: have %v.", exprs)
+	}
+	if !set.Match(map[string]string{"region": "us"}) || set.Match(map[string]string{"region": "ap"}) {
+		t.Fatalf("set match mismatch.")
+	}
+	// Merging a match-all filter should collapse the set
+	other := NewSet()
+	other.Add(all)
+	set.Merge(other)
+	if exprs := set.Exprs(); !reflect.DeepEqual(exprs, []string{""}) {
+		t.Fatalf("collapsed set expressions mismatch: have %v.", exprs)
+	}
+	if !set.Match(nil) {
+		t.Fatalf("collapsed set rejected attributes.")
+	}
+}
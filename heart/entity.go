@@ -30,6 +30,7 @@ import (
 type entity struct {
 	id   *big.Int // Unique identifier of the entity
 	tick int      // Tick of the last recorded activity
+	kill int      // Missed ticks tolerated before reporting dead (0 = heart default)
 }
 
 // Entity slice implementing sort.Interface.
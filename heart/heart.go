@@ -43,19 +43,35 @@ type Heart struct {
 
 	call Callback // Application callback to notify of events
 
-	quit chan chan error // Quit synchronizer to ensure cleanup
-	lock sync.Mutex      // Lock protecting the state
+	retime chan struct{}   // Notification channel of beat period changes
+	quit   chan chan error // Quit synchronizer to ensure cleanup
+	lock   sync.Mutex      // Lock protecting the state
 }
 
 // Creates and returns a new heartbeat mechanism beating once every beat,
 // reporting entities as dead if not seen in kill beats.
 func New(beat time.Duration, kill int, handler Callback) *Heart {
 	return &Heart{
-		mems: []*entity{},
-		beat: beat,
-		kill: kill,
-		call: handler,
-		quit: make(chan chan error),
+		mems:   []*entity{},
+		beat:   beat,
+		kill:   kill,
+		call:   handler,
+		retime: make(chan struct{}, 1),
+		quit:   make(chan chan error),
+	}
+}
+
+// Updates the beat period and the kill count of a (possibly running) heart.
+// Entity ticks are retained, so the new kill count applies to the current ones.
+func (h *Heart) SetTiming(beat time.Duration, kill int) {
+	h.lock.Lock()
+	h.beat, h.kill = beat, kill
+	h.lock.Unlock()
+
+	// Notify the beater of the new period, unless already pending
+	select {
+	case h.retime <- struct{}{}:
+	default:
 	}
 }
 
@@ -118,11 +134,40 @@ func (h *Heart) Ping(id *big.Int) error {
 	return fmt.Errorf("non-monitored entity")
 }
 
+// Overrides the number of missed ticks tolerated for an entity before reporting
+// it dead (e.g. for entities known to be pinged less often). Zero restores the
+// kill count of the heart.
+func (h *Heart) Tolerate(id *big.Int, kill int) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	idx := h.mems.Search(id)
+	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
+		h.mems[idx].kill = kill
+		return nil
+	}
+	return fmt.Errorf("non-monitored entity")
+}
+
+// Retrieves the number of beat cycles an entity has been silent for.
+func (h *Heart) Missed(id *big.Int) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	idx := h.mems.Search(id)
+	if idx < len(h.mems) && h.mems[idx].id.Cmp(id) == 0 {
+		return h.tick - h.mems[idx].tick, nil
+	}
+	return 0, fmt.Errorf("non-monitored entity")
+}
+
 // Beater function meant to run as a separate go routine to keep pinging each
 // monitored entity and report when some fail to respond within alloted time.
 func (h *Heart) beater() {
 	// Create the ticker to fire the beat events
+	h.lock.Lock()
 	beat := time.NewTicker(h.beat)
+	h.lock.Unlock()
 	defer beat.Stop()
 
 	dead := []*big.Int{}
@@ -133,13 +178,22 @@ func (h *Heart) beater() {
 		case errc = <-h.quit:
 			// Termination requested
 			continue
+		case <-h.retime:
+			// Beat period changed, restart the ticker
+			h.lock.Lock()
+			beat.Reset(h.beat)
+			h.lock.Unlock()
 		case <-beat.C:
 			// Beat cycle: update tick and collect dead entries
 			h.lock.Lock()
 			h.tick++
 			dead = dead[:0]
 			for _, m := range h.mems {
-				if h.tick-m.tick >= h.kill {
+				kill := h.kill
+				if m.kill > 0 {
+					kill = m.kill
+				}
+				if h.tick-m.tick >= kill {
 					dead = append(dead, m.id)
 				}
 			}
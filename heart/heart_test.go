@@ -107,9 +107,18 @@ func TestHeart(t *testing.T) {
 	if err := heart.Unmonitor(alice); err != nil {
 		t.Fatalf("failed to unmonitor alice: %v.", err)
 	}
+	if _, err := heart.Missed(alice); err == nil {
+		t.Fatalf("missed beats reported for unmonitored alice.")
+	}
+	if n, err := heart.Missed(bob); err != nil || n != 2 {
+		t.Fatalf("missed beat mismatch: have %v/%v, want %v/%v.", n, err, 2, nil)
+	}
 	if err := heart.Ping(bob); err != nil {
 		t.Fatalf("failed to ping bob: %v.", err)
 	}
+	if n, err := heart.Missed(bob); err != nil || n != 0 {
+		t.Fatalf("missed beat mismatch: have %v/%v, want %v/%v.", n, err, 0, nil)
+	}
 	time.Sleep(beat)
 	if n := int(atomic.LoadInt32(&call.beat)); n != 4 {
 		t.Fatalf("beat event count mismatch: have %v, want %v", n, 4)
@@ -126,3 +135,62 @@ func TestHeart(t *testing.T) {
 	}
 	call.assertDead(t, 1)
 }
+
+func TestHeartTiming(t *testing.T) {
+	beat := time.Duration(25 * time.Millisecond)
+	call := &testCallback{dead: []*big.Int{}}
+
+	// Start a fast beater and slow it down before the first beat
+	heart := New(beat, 3, call)
+	heart.Start()
+	defer heart.Terminate()
+
+	heart.SetTiming(4*beat, 3)
+	time.Sleep(10*beat + 10*time.Millisecond)
+	if n := int(atomic.LoadInt32(&call.beat)); n != 2 {
+		t.Fatalf("beat event count mismatch: have %v, want %v", n, 2)
+	}
+	// Lower the kill count and check that stale entities are reported
+	if err := heart.Monitor(big.NewInt(314)); err != nil {
+		t.Fatalf("failed to monitor entity: %v.", err)
+	}
+	heart.SetTiming(beat, 1)
+	time.Sleep(beat + 10*time.Millisecond)
+	call.assertDead(t, 1)
+}
+
+func TestHeartTolerate(t *testing.T) {
+	// Some predefined ids
+	alice := big.NewInt(314)
+	bob := big.NewInt(241)
+
+	beat := time.Duration(25 * time.Millisecond)
+	call := &testCallback{dead: []*big.Int{}}
+
+	// Monitor two entities, one of them tolerating more silence
+	heart := New(beat, 1, call)
+	for _, id := range []*big.Int{alice, bob} {
+		if err := heart.Monitor(id); err != nil {
+			t.Fatalf("failed to monitor entity: %v.", err)
+		}
+	}
+	if err := heart.Tolerate(alice, 3); err != nil {
+		t.Fatalf("failed to set tolerance: %v.", err)
+	}
+	if err := heart.Tolerate(big.NewInt(271), 3); err == nil {
+		t.Fatalf("tolerance set for non-monitored entity.")
+	}
+	heart.Start()
+	defer heart.Terminate()
+
+	// Check that only the intolerant entity is reported on the first beat
+	time.Sleep(beat + 10*time.Millisecond)
+	call.assertDead(t, 1)
+
+	// Restore the default tolerance and check that alice is reported too
+	if err := heart.Tolerate(alice, 0); err != nil {
+		t.Fatalf("failed to reset tolerance: %v.", err)
+	}
+	time.Sleep(beat)
+	call.assertDead(t, 3)
+}
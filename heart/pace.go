@@ -0,0 +1,104 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the adaptive beat schedule of a single monitored entity:
+// entities staying loss-free for a while are beaten at doubling intervals (up to
+// a limit), whereas any entity silent beyond its own announced interval is beaten
+// every period again. Each beat should carry the next interval, so the remote
+// side can stretch its failure detection alike.
+
+package heart
+
+import "sync"
+
+// Adaptive beat schedule of a remote entity, in beat periods.
+type Pace struct {
+	stretch int // Interval the entity is beaten at
+	calm    int // Consecutive loss-free beats since the last slow down
+	skip    int // Beat periods left until the next beat is due
+	remote  int // Interval the entity announced to beat the local side at
+
+	calms int // Number of calm beats after which to double the interval
+	limit int // Maximum interval to stretch the beats to
+
+	lock sync.Mutex // Lock protecting the schedule (beater vs. message processors)
+}
+
+// Creates a beat schedule starting at every period, doubling the interval after
+// calms loss-free beats, up to limit periods.
+func NewPace(calms, limit int) *Pace {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Pace{
+		stretch: 1,
+		remote:  1,
+		calms:   calms,
+		limit:   limit,
+	}
+}
+
+// Advances the schedule by one beat period, given the number of periods the
+// entity has been silent for. It reports whether a beat is due and the interval
+// to announce with it. A period of slack is allowed for beat jitter before the
+// remote beats are considered lost.
+func (p *Pace) Tick(missed int) (bool, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.skip > 0 {
+		p.skip--
+		return false, p.stretch
+	}
+	if missed > p.remote+1 {
+		// Remote beats got lost, speed up to detect any failure fast
+		p.stretch, p.calm = 1, 0
+	} else if p.calm++; p.calm >= p.calms && p.stretch < p.limit {
+		// Entity proved stable, slow the beats down
+		p.stretch, p.calm = 2*p.stretch, 0
+		if p.stretch > p.limit {
+			p.stretch = p.limit
+		}
+	}
+	p.skip = p.stretch - 1
+	return true, p.stretch
+}
+
+// Records the beat interval announced by the remote entity, reporting whether it
+// changed (i.e. the silence tolerance needs updating).
+func (p *Pace) Announced(stretch int) bool {
+	if stretch < 1 {
+		stretch = 1
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.remote == stretch {
+		return false
+	}
+	p.remote = stretch
+	return true
+}
+
+// Retrieves the current beat interval towards the entity (beat periods).
+func (p *Pace) Stretch() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.stretch
+}
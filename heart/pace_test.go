@@ -0,0 +1,58 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package heart
+
+import "testing"
+
+// Tests that the beat schedule slows down for calm entities and resets on loss.
+func TestPace(t *testing.T) {
+	pace := NewPace(2, 4)
+
+	// Beat calm twice at every period, then every second
+	for i, due := range []bool{true, true, false, true, false, true} {
+		if have, _ := pace.Tick(0); have != due {
+			t.Fatalf("tick #%d: beat due mismatch: have %v, want %v.", i, have, due)
+		}
+	}
+	// Keep calm until reaching the limit, which must not be exceeded
+	for i := 0; i < 32; i++ {
+		pace.Tick(0)
+	}
+	if stretch := pace.Stretch(); stretch != 4 {
+		t.Fatalf("stretch mismatch: have %v, want %v.", stretch, 4)
+	}
+	// Miss the remote beats and check that the schedule is reset
+	for due := false; !due; {
+		due, _ = pace.Tick(3)
+	}
+	if stretch := pace.Stretch(); stretch != 1 {
+		t.Fatalf("stretch mismatch after loss: have %v, want %v.", stretch, 1)
+	}
+	// Check the announced remote interval tracking
+	if !pace.Announced(4) {
+		t.Fatalf("announced interval change not reported.")
+	}
+	if pace.Announced(4) {
+		t.Fatalf("unchanged announced interval reported.")
+	}
+	// The larger remote interval must tolerate the longer silence
+	if _, stretch := pace.Tick(3); stretch != 1 {
+		t.Fatalf("stretch mismatch within remote interval: have %v, want %v.", stretch, 1)
+	}
+}
@@ -21,6 +21,7 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
@@ -28,13 +29,23 @@ import (
 	"io/ioutil"
 	"log"
 	rng "math/rand"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/scribe"
+	"github.com/project-iris/iris/proto/session"
+	"github.com/project-iris/iris/service/federation"
 	"github.com/project-iris/iris/service/relay"
 )
 
@@ -43,6 +54,57 @@ var devMode = flag.Bool("dev", false, "start in local developer mode (random clu
 var relayPort = flag.Int("port", 55555, "relay endpoint for locally connecting clients")
 var clusterName = flag.String("net", "", "name of the cluster to join or create")
 var rsaKeyPath = flag.String("rsa", "", "path to the RSA private key to use for data security")
+var rsaAltPath = flag.String("rsaalt", "", "path to a secondary RSA key accepted alongside -rsa while rotating the cluster key")
+
+var beatPeriod = flag.Duration("beat", config.ScribeBeatPeriod, "carrier heartbeat period (raise for WAN clusters)")
+var killCount = flag.Int("kill", config.ScribeKillCount, "missed carrier heartbeats before dropping a peer")
+var standbys = flag.Int("standby", config.ScribeStandbys, "hot standby replicas of the topic roots (0 = disabled)")
+var maxFanout = flag.Int("fanout", config.ScribeMaxFanout, "maximum children per node in the topic trees (0 = unlimited)")
+var maxDepth = flag.Int("depth", config.ScribeMaxDepth, "maximum depth of the topic trees (0 = unlimited)")
+var wireVersion = flag.Int("wire", config.ScribeWireVersion, "carrier header wire format to send (1 = legacy, 2 = compact once all nodes upgraded)")
+var router = flag.String("router", config.ScribeRouter, "structured overlay routing the messages (pastry or kademlia, the latter without -base, -leaves and -state)")
+var idSpace = flag.Int("space", config.PastrySpace, "overlay id space in bits (must match across the cluster)")
+var idBase = flag.Int("base", config.PastryBase, "overlay routing digit in bits, trading table size for hops")
+var leafSet = flag.Int("leaves", config.PastryLeaves, "closest overlay nodes to track (shrink for small clusters)")
+var stateFile = flag.String("state", config.PastryStateFile, "file persisting the overlay peers and node id for fast restarts (virtual nodes suffixed by their index)")
+var idSeed = flag.String("seed", config.PastryIdentitySeed, "secret seed to derive a stable overlay node id from (keep private, virtual nodes suffixed by their index)")
+var tlsCert = flag.String("tlscert", "", "PEM certificate of the node issued by the cluster CA, running the overlay sessions over TLS")
+var tlsKey = flag.String("tlskey", "", "PEM private key of the node's TLS certificate")
+var tlsCA = flag.String("tlsca", "", "PEM certificate(s) of the cluster CA to verify the remote nodes with")
+var tlsCRL = flag.String("tlscrl", "", "PEM revocation list(s) of the cluster CA, reloaded periodically to reject revoked nodes")
+var peerPort = flag.Int("peerport", config.PastryListenPort, "overlay listener port on every interface (0 = random)")
+var ipv6 = flag.Bool("ipv6", config.PastryIPv6, "accept overlay sessions on global IPv6 interfaces too")
+var advertise = flag.String("advertise", "", "comma separated extra host:port addresses to advertise (e.g. NAT mappings)")
+var bridge = flag.Bool("bridge", config.PastryBridge, "relay overlay traffic for peers lacking direct connectivity to other sites (WAN bridge)")
+var idleTimeout = flag.Duration("idle", config.PastryIdleTimeout, "silence after which routing table sessions are torn down, re-dialed on demand (0 = never, pastry only)")
+var metric = flag.String("metric", config.PastryMetric, "routing metric of the upper layer messages (hops, latency or empty for plain prefix routing, pastry only)")
+var banList = flag.String("ban", "", "comma separated remote hosts (IP) and node ids (decimal) to refuse overlay sessions with")
+var allowList = flag.String("allow", "", "comma separated node key fingerprints (hex SHA-256, logged at boot) allowed to join the overlay (empty = any holder of the cluster key)")
+var metadata = flag.String("meta", "", "comma separated key=value metadata to advertise to the peers (e.g. zone=eu-1,role=edge)")
+var bwLimit = flag.Int("bwlimit", config.SessionBandwidth, "bandwidth cap of each overlay session's data link in bytes/sec (0 = unlimited)")
+var bwTotal = flag.Int("bwtotal", config.SessionGlobalBandwidth, "bandwidth cap of all overlay sessions together in bytes/sec (0 = unlimited)")
+var keyBits = flag.Int("keybits", config.SessionCipherBits, "AES key size of the overlay session links in bits (128, 192 or 256, must match across the cluster)")
+var x25519 = flag.Bool("x25519", config.StsX25519, "run the overlay session key exchange over the X25519 curve instead of the 2448 bit group (must match across the cluster)")
+var stsBits = flag.Int("stsbits", config.StsCipherBits, "AES key size of the overlay session key exchange in bits (128, 192 or 256, must match across the cluster)")
+var hashName = flag.String("hash", "md5", "hash of the overlay session key derivation and signatures (md5, sha1, sha256, sha384 or sha512, must match across the cluster)")
+var aeadModes = flag.String("aead", strings.Join(config.SessionAEADs, ","), "comma separated AEAD modes of the overlay session links in order of preference (aes-gcm, chacha20-poly1305; empty = AES-CTR and HMAC)")
+var aeadAccel = flag.Bool("aeadhw", config.SessionAEADAccel, "prefer the AEAD mode accelerated by the local CPU (aes-gcm with AES-NI, chacha20-poly1305 without) over the -aead order")
+var compression = flag.String("compress", strings.Join(config.SessionCompression, ","), "comma separated compression codecs of the overlay session links in order of preference (snappy; empty = none)")
+var hmacName = flag.String("hmac", "md5", "hash of the overlay session link MACs (md5, sha1, sha256, sha384 or sha512, must match across the cluster)")
+var protoVersion = flag.Int("protocol", config.SessionVersion, "highest overlay session protocol version to speak (lower to pin during rolling upgrades)")
+var rekeyPeriod = flag.Duration("rekey", config.SessionRekeyPeriod, "lifetime of the overlay session keys before rotating them (0 = never, must be enabled across the cluster)")
+var rekeyBytes = flag.Int("rekeybytes", config.SessionRekeyBytes, "bytes sent with the overlay session keys before rotating them (0 = unlimited)")
+var shakeRate = flag.Int("shakerate", config.SessionShakeRate, "full overlay session handshakes accepted per second, refusing or puzzling the rest (0 = unlimited)")
+var puzzleBits = flag.Int("puzzle", config.SessionPuzzleBits, "difficulty in bits of the client puzzles demanded above -shakerate (0 = refuse instead)")
+var vnodes = flag.Int("vnodes", config.IrisVirtualNodes, "virtual overlay nodes to host (raise on stronger machines)")
+var topoFile = flag.String("topology", "", "file to periodically export the overlay graph into (.dot = Graphviz, else JSON)")
+var readyFile = flag.String("ready", "", "file present only while the overlay is converged and ready (for orchestration readiness probes)")
+
+var fedTopics = flag.String("federate", "", "comma separated topics to mirror with a peer network")
+var fedGroups = flag.String("fedgroups", "", "comma separated application groups of the peer network to proxy locally")
+var fedListen = flag.String("fedlisten", "", "local address to accept the peer network's bridge on")
+var fedDial = flag.String("feddial", "", "remote address of the peer network's bridge")
+var fedKeyPath = flag.String("fedrsa", "", "path to the RSA key shared with the peer bridge (default -rsa)")
 
 var cpuProfile = flag.String("cpuprof", "", "path to CPU profiling results")
 var heapProfile = flag.String("heapprof", "", "path to memory heap profiling results")
@@ -88,6 +150,221 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 		fmt.Fprintf(os.Stderr, "Invalid relay port: have %v, want [1-65535].\n", *relayPort)
 		os.Exit(-1)
 	}
+	// Check the carrier timings
+	if *beatPeriod <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid heartbeat period: have %v, want positive.\n", *beatPeriod)
+		os.Exit(-1)
+	}
+	if *killCount <= config.ScribeReportBeats {
+		fmt.Fprintf(os.Stderr, "Invalid kill count: have %v, want above %v.\n", *killCount, config.ScribeReportBeats)
+		os.Exit(-1)
+	}
+	if *standbys < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid standby replicas: have %v, want non-negative.\n", *standbys)
+		os.Exit(-1)
+	}
+	config.ScribeBeatPeriod, config.ScribeKillCount, config.ScribeStandbys = *beatPeriod, *killCount, *standbys
+
+	// Check the topic tree shape limits
+	if *maxFanout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid tree fan-out: have %v, want non-negative.\n", *maxFanout)
+		os.Exit(-1)
+	}
+	if *maxDepth < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid tree depth: have %v, want non-negative.\n", *maxDepth)
+		os.Exit(-1)
+	}
+	config.ScribeMaxFanout, config.ScribeMaxDepth = *maxFanout, *maxDepth
+
+	// Check the carrier wire format
+	if *wireVersion != 1 && *wireVersion != 2 {
+		fmt.Fprintf(os.Stderr, "Invalid wire format: have %v, want 1 or 2.\n", *wireVersion)
+		os.Exit(-1)
+	}
+	config.ScribeWireVersion = *wireVersion
+
+	// Check the overlay router
+	if *router != scribe.PastryRouter && *router != scribe.KademliaRouter {
+		fmt.Fprintf(os.Stderr, "Invalid overlay router: have %v, want %v or %v.\n", *router, scribe.PastryRouter, scribe.KademliaRouter)
+		os.Exit(-1)
+	}
+	config.ScribeRouter = *router
+
+	// Reject the pastry specific tunables if routing through kademlia
+	if *router == scribe.KademliaRouter {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "base", "leaves", "state":
+				fmt.Fprintf(os.Stderr, "Overlay option -%v not supported by the %v router.\n", f.Name, *router)
+				os.Exit(-1)
+			}
+		})
+	}
+
+	// Check the overlay id space and routing table geometry
+	if bits := config.PastryResolver().Size() * 8; *idSpace <= 0 || *idSpace > bits {
+		fmt.Fprintf(os.Stderr, "Invalid id space: have %v, want [1-%v].\n", *idSpace, bits)
+		os.Exit(-1)
+	}
+	if *idBase <= 0 || *idBase > 16 || *idSpace%*idBase != 0 {
+		fmt.Fprintf(os.Stderr, "Invalid routing base: have %v, want [1-16] dividing the id space.\n", *idBase)
+		os.Exit(-1)
+	}
+	if *leafSet <= 0 || *leafSet%2 != 0 {
+		fmt.Fprintf(os.Stderr, "Invalid leaf set size: have %v, want positive even.\n", *leafSet)
+		os.Exit(-1)
+	}
+	config.PastrySpace, config.PastryBase, config.PastryLeaves = *idSpace, *idBase, *leafSet
+	if *stateFile != "" {
+		if info, err := os.Stat(*stateFile); err == nil && info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Invalid state file: %v is a directory.\n", *stateFile)
+			os.Exit(-1)
+		}
+		if info, err := os.Stat(filepath.Dir(*stateFile)); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Invalid state file: missing directory %v.\n", filepath.Dir(*stateFile))
+			os.Exit(-1)
+		}
+	}
+	config.PastryStateFile = *stateFile
+	config.PastryIdentitySeed = *idSeed
+
+	// Check the number of hosted virtual nodes
+	if *vnodes <= 0 || *vnodes > len(config.BootPorts) {
+		fmt.Fprintf(os.Stderr, "Invalid virtual node count: have %v, want [1-%v] (one bootstrap port each).\n", *vnodes, len(config.BootPorts))
+		os.Exit(-1)
+	}
+	config.IrisVirtualNodes = *vnodes
+
+	// Check the overlay listener and advertised addresses
+	if *peerPort < 0 || *peerPort >= 65536 {
+		fmt.Fprintf(os.Stderr, "Invalid overlay port: have %v, want [0-65535].\n", *peerPort)
+		os.Exit(-1)
+	}
+	if *peerPort != 0 && *vnodes != 1 {
+		fmt.Fprintf(os.Stderr, "Fixed overlay port (-peerport) needs a single virtual node: have %v.\n", *vnodes)
+		os.Exit(-1)
+	}
+	if *advertise != "" {
+		for _, addr := range strings.Split(*advertise, ",") {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid advertised address: have %v, want host:port.\n", addr)
+				os.Exit(-1)
+			}
+			config.PastryAdvertise = append(config.PastryAdvertise, addr)
+		}
+	}
+	config.PastryListenPort, config.PastryIPv6, config.PastryBridge = *peerPort, *ipv6, *bridge
+
+	// Check the idle session timeout
+	if *idleTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid idle timeout: have %v, want non-negative (0 = never).\n", *idleTimeout)
+		os.Exit(-1)
+	}
+	config.PastryIdleTimeout = *idleTimeout
+
+	// Check the session bandwidth caps
+	if *bwLimit < 0 || *bwTotal < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid bandwidth cap: have %v/%v, want non-negative (0 = unlimited).\n", *bwLimit, *bwTotal)
+		os.Exit(-1)
+	}
+	config.SessionBandwidth, config.SessionGlobalBandwidth = *bwLimit, *bwTotal
+
+	// Check the session cipher suite
+	for _, bits := range []int{*keyBits, *stsBits} {
+		if bits != 128 && bits != 192 && bits != 256 {
+			fmt.Fprintf(os.Stderr, "Invalid session key size: have %v, want 128, 192 or 256.\n", bits)
+			os.Exit(-1)
+		}
+	}
+	config.SessionCipherBits, config.StsCipherBits = *keyBits, *stsBits
+	config.StsX25519 = *x25519
+
+	hash, ok := session.Hashes[*hashName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown session hash: %v.\n", *hashName)
+		os.Exit(-1)
+	}
+	config.HkdfHash, config.StsSigHash = hash, hash
+
+	if config.SessionHash, ok = session.Hashes[*hmacName]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown session HMAC hash: %v.\n", *hmacName)
+		os.Exit(-1)
+	}
+	config.SessionAEADs = splitList(*aeadModes)
+	for _, mode := range config.SessionAEADs {
+		if !link.ValidAEAD(mode) {
+			fmt.Fprintf(os.Stderr, "Unknown session AEAD mode: %v.\n", mode)
+			os.Exit(-1)
+		}
+	}
+	config.SessionAEADAccel = *aeadAccel
+
+	config.SessionCompression = splitList(*compression)
+	for _, codec := range config.SessionCompression {
+		if !link.ValidCodec(codec) {
+			fmt.Fprintf(os.Stderr, "Unknown session compression codec: %v.\n", codec)
+			os.Exit(-1)
+		}
+	}
+	if *rekeyPeriod < 0 || *rekeyBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid session rekey limits: have %v/%v, want non-negative (0 = unlimited).\n", *rekeyPeriod, *rekeyBytes)
+		os.Exit(-1)
+	}
+	config.SessionRekeyPeriod, config.SessionRekeyBytes = *rekeyPeriod, *rekeyBytes
+
+	if *shakeRate < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid session handshake rate: have %v, want non-negative (0 = unlimited).\n", *shakeRate)
+		os.Exit(-1)
+	}
+	if *puzzleBits < 0 || *puzzleBits > session.MaxPuzzleBits {
+		fmt.Fprintf(os.Stderr, "Invalid client puzzle difficulty: have %v, want [0-%v].\n", *puzzleBits, session.MaxPuzzleBits)
+		os.Exit(-1)
+	}
+	config.SessionShakeRate, config.SessionPuzzleBits = *shakeRate, *puzzleBits
+
+	if *protoVersion < 0 || *protoVersion > session.Version {
+		fmt.Fprintf(os.Stderr, "Invalid session protocol version: have %v, want [0-%v].\n", *protoVersion, session.Version)
+		os.Exit(-1)
+	}
+	config.SessionVersion = *protoVersion
+
+	// Check the routing metric
+	if _, ok := overlay.Metrics[*metric]; *metric != "" && !ok {
+		fmt.Fprintf(os.Stderr, "Unknown routing metric: have %v, want hops or latency.\n", *metric)
+		os.Exit(-1)
+	}
+	config.PastryMetric = *metric
+
+	// Check the banned peers
+	config.PastryBans = splitList(*banList)
+	if err := overlay.CheckBans(config.PastryBans); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid ban list: %v (want IP addresses or decimal node ids).\n", err)
+		os.Exit(-1)
+	}
+	// Check the allowed node keys
+	config.PastryAllowlist = splitList(*allowList)
+	if err := overlay.CheckAllowlist(config.PastryAllowlist); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid allowlist: %v (want hex SHA-256 key fingerprints).\n", err)
+		os.Exit(-1)
+	}
+
+	// Check the advertised node metadata
+	for _, pair := range splitList(*metadata) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			fmt.Fprintf(os.Stderr, "Invalid metadata entry: have %v, want key=value.\n", pair)
+			os.Exit(-1)
+		}
+		if config.PastryMetadata == nil {
+			config.PastryMetadata = make(map[string]string)
+		}
+		config.PastryMetadata[kv[0]] = kv[1]
+	}
+	if err := overlay.CheckMetadata(config.PastryMetadata); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid metadata: %v (limit %v bytes).\n", err, config.PastryMetadataLimit)
+		os.Exit(-1)
+	}
+
 	// User random cluster id and RSA key in developer mode
 	if *devMode {
 		// Generate a secure RSA key
@@ -115,32 +392,211 @@ func parseFlags() (int, string, *rsa.PrivateKey) {
 			fmt.Fprintf(os.Stderr, "No RSA key specified (-rsa), did you intend developer mode (-dev)?\n")
 			os.Exit(-1)
 		}
-		if rsaData, err := ioutil.ReadFile(*rsaKeyPath); err != nil {
-			fmt.Fprintf(os.Stderr, "Reading RSA key failed: %v.\n", err)
+		key, err := readKey(*rsaKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v.\n", err)
 			os.Exit(-1)
-		} else {
-			// Try processing as PEM format
-			if block, _ := pem.Decode(rsaData); block != nil {
-				if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
-					fmt.Fprintf(os.Stderr, "Parsing RSA key from PEM format failed: %v.\n", err)
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
-			} else {
-				// Give it a shot as simple binary DER
-				if key, err := x509.ParsePKCS1PrivateKey(rsaData); err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse RSA key from both PEM and DER format.\n")
-					os.Exit(-1)
-				} else {
-					rsaKey = key
-				}
+		}
+		rsaKey = key
+
+		// Accept the secondary key too if the cluster key is being rotated
+		if *rsaAltPath != "" {
+			alt, err := readKey(*rsaAltPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v.\n", err)
+				os.Exit(-1)
 			}
+			session.Rotate(rsaKey, alt)
+		}
+	}
+	// Load the TLS credentials of the overlay sessions, if configured
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		cfg, err := readTLS(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v.\n", err)
+			os.Exit(-1)
+		}
+		config.SessionTLS = cfg
+	}
+	if *tlsCRL != "" {
+		if config.SessionTLS == nil {
+			fmt.Fprintf(os.Stderr, "Revocation lists need the TLS transport (-tlscert, -tlskey and -tlsca).\n")
+			os.Exit(-1)
+		}
+		lists, err := readCRL(*tlsCRL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v.\n", err)
+			os.Exit(-1)
+		}
+		session.SetRevocations(lists)
+	}
+	// Check the federation settings
+	if *fedTopics != "" || *fedGroups != "" {
+		if (*fedListen == "") == (*fedDial == "") {
+			fmt.Fprintf(os.Stderr, "Federation needs exactly one of -fedlisten or -feddial.\n")
+			os.Exit(-1)
 		}
 	}
 	return *relayPort, *clusterName, rsaKey
 }
 
+// Reads an RSA private key from either PEM or binary DER format.
+func readKey(path string) (*rsa.PrivateKey, error) {
+	rsaData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading RSA key failed: %v", err)
+	}
+	// Try processing as PEM format
+	if block, _ := pem.Decode(rsaData); block != nil {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing RSA key from PEM format failed: %v", err)
+		}
+		return key, nil
+	}
+	// Give it a shot as simple binary DER
+	key, err := x509.ParsePKCS1PrivateKey(rsaData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse RSA key from both PEM and DER format")
+	}
+	return key, nil
+}
+
+// Assembles the TLS configuration of the overlay sessions from the node's PEM
+// certificate and key, and the cluster CA certificates.
+func readTLS(certPath, keyPath, caPath string) (*tls.Config, error) {
+	if certPath == "" || keyPath == "" || caPath == "" {
+		return nil, fmt.Errorf("TLS needs all of -tlscert, -tlskey and -tlsca")
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Loading TLS certificate failed: %v", err)
+	}
+	caData, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("Reading cluster CA failed: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("No PEM certificates found in cluster CA %v", caPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Reads the PEM encoded certificate revocation lists of the cluster CA.
+func readCRL(path string) ([]*x509.RevocationList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading revocation lists failed: %v", err)
+	}
+	lists := []*x509.RevocationList{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing revocation list failed: %v", err)
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		return nil, fmt.Errorf("No PEM revocation lists found in %v", path)
+	}
+	return lists, nil
+}
+
+// Splits a comma separated flag value into its items (none if empty).
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// Creates a federation bridge mirroring the requested topics and groups with the
+// peer network, either accepting or dialing the peer bridge.
+func bootFederation(overlay *iris.Overlay, name string, key *rsa.PrivateKey) (*federation.Bridge, error) {
+	if *fedKeyPath != "" {
+		fedKey, err := readKey(*fedKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		key = fedKey
+	}
+	bridge, err := federation.New(overlay, name, splitList(*fedTopics), splitList(*fedGroups), key)
+	if err != nil {
+		return nil, err
+	}
+	if *fedListen != "" {
+		addr, err := net.ResolveTCPAddr("tcp", *fedListen)
+		if err == nil {
+			_, err = bridge.Listen(addr)
+		}
+		if err != nil {
+			bridge.Terminate()
+			return nil, err
+		}
+		return bridge, nil
+	}
+	host, port, err := net.SplitHostPort(*fedDial)
+	if err == nil {
+		var num int
+		if num, err = strconv.Atoi(port); err == nil {
+			err = bridge.Dial(host, num)
+		}
+	}
+	if err != nil {
+		bridge.Terminate()
+		return nil, err
+	}
+	return bridge, nil
+}
+
+// Writes the overlay graph as seen by the local nodes into a file, the format
+// selected by its extension (Graphviz DOT for .dot and .gv, JSON otherwise). The
+// file is replaced atomically, so visualization tooling never reads half of it.
+func exportTopology(overlay *iris.Overlay, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	topo := overlay.Topology()
+	switch filepath.Ext(path) {
+	case ".dot", ".gv":
+		err = topo.WriteDOT(tmp)
+	default:
+		err = topo.WriteJSON(tmp)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Creates the readiness file if the overlay is converged with a settled leaf set
+// and nothing pending, or removes it otherwise.
+func reportReadiness(overlay *iris.Overlay, path string) error {
+	if !overlay.Status().Ready {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return ioutil.WriteFile(path, nil, 0644)
+}
+
 func main() {
 	// Extract the command line arguments
 	relayPort, clusterId, rsaKey := parseFlags()
@@ -191,7 +647,49 @@ func main() {
 	if err := rel.Boot(); err != nil {
 		log.Fatalf("main: failed to boot relay: %v.", err)
 	}
+	// Create and boot the federation bridge if requested
+	var bridge *federation.Bridge
+	if *fedTopics != "" || *fedGroups != "" {
+		log.Printf("main: booting federation bridge...")
+		if bridge, err = bootFederation(overlay, clusterId, rsaKey); err != nil {
+			log.Fatalf("main: failed to boot federation bridge: %v.", err)
+		}
+	}
 
+	// Periodically export the overlay topology if requested
+	if *topoFile != "" {
+		go func() {
+			for ; ; time.Sleep(config.IrisTopologyPeriod) {
+				if err := exportTopology(overlay, *topoFile); err != nil {
+					log.Printf("main: failed to export overlay topology: %v.", err)
+				}
+			}
+		}()
+	}
+	// Periodically report the overlay readiness if requested
+	if *readyFile != "" {
+		go func() {
+			for ; ; time.Sleep(config.IrisReadyPeriod) {
+				if err := reportReadiness(overlay, *readyFile); err != nil {
+					log.Printf("main: failed to report overlay readiness: %v.", err)
+				}
+			}
+		}()
+	}
+	// Periodically reload the certificate revocation lists if requested
+	if *tlsCRL != "" {
+		go func() {
+			for {
+				time.Sleep(config.SessionRevocationPeriod)
+				lists, err := readCRL(*tlsCRL)
+				if err != nil {
+					log.Printf("main: failed to reload revocation lists: %v.", err)
+					continue
+				}
+				session.SetRevocations(lists)
+			}
+		}()
+	}
 	// Capture termination signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
@@ -201,6 +699,15 @@ func main() {
 
 	// Wait for termination request, clean up and exit
 	<-quit
+	if *readyFile != "" {
+		os.Remove(*readyFile)
+	}
+	if bridge != nil {
+		log.Printf("main: terminating federation bridge...")
+		if err := bridge.Terminate(); err != nil {
+			log.Printf("main: failed to terminate federation bridge: %v.", err)
+		}
+	}
 	log.Printf("main: terminating relay service...")
 	if err := rel.Terminate(); err != nil {
 		log.Printf("main: failed to terminate relay service: %v.", err)
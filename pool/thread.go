@@ -30,6 +30,7 @@ import (
 )
 
 var ErrTerminating = errors.New("pool terminating")
+var ErrFull = errors.New("pool queue full")
 
 // A task function meant to be started as a go routine.
 type Task func()
@@ -41,6 +42,7 @@ type ThreadPool struct {
 
 	idle  int // Number of idle workers (i.e. not running)
 	total int // Maximum pool worker capacity
+	limit int // Maximum number of pending tasks (0 = unbounded)
 
 	start bool // Whether the pool was already started
 	quit  bool // Whether the pool was already terminated
@@ -51,10 +53,17 @@ type ThreadPool struct {
 
 // Creates a thread pool with the given concurrent thread capacity.
 func NewThreadPool(cap int) *ThreadPool {
+	return NewBoundedThreadPool(cap, 0)
+}
+
+// Creates a thread pool with the given concurrent thread capacity, queueing at
+// most limit pending tasks before rejecting new ones (0 = unbounded).
+func NewBoundedThreadPool(cap int, limit int) *ThreadPool {
 	t := &ThreadPool{
 		tasks: queue.New(),
 		idle:  cap,
 		total: cap,
+		limit: limit,
 	}
 	t.done = sync.NewCond(&t.mutex)
 	return t
@@ -106,17 +115,34 @@ func (t *ThreadPool) Schedule(task Task) error {
 		t.idle--
 		go t.runner(task)
 	} else {
+		// If the pending queue is full, reject the task
+		if t.limit > 0 && t.tasks.Size() >= t.limit {
+			return ErrFull
+		}
 		t.tasks.Push(task)
 	}
 	return nil
 }
 
+// Returns the number of tasks waiting for a free worker.
+func (t *ThreadPool) Pending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.tasks == nil { // Note, tasks is reset on termination
+		return 0
+	}
+	return t.tasks.Size()
+}
+
 // Dumps the waiting tasks from the pool.
 func (t *ThreadPool) Clear() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	t.tasks.Reset()
+	if t.tasks != nil { // Note, tasks is reset on termination
+		t.tasks.Reset()
+	}
 }
 
 // Runs an initial task, fetching new ones until available.
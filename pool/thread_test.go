@@ -228,10 +228,12 @@ func TestTerminate(t *testing.T) {
 		} else if !clear && start != workers*8 {
 			t.Fatalf("task completion mismatch: have %d, want %d.", start, workers*8)
 		}
-		// Ensure that no more tasks can be scheduled
+		// Ensure that no more tasks can be scheduled, but dumping is still safe
 		if err := pool.Schedule(func() {}); err == nil {
 			t.Fatalf("task scheduling succeeded, shouldn't have.")
 		}
+		pool.Clear()
+
 		// Verify whether the pool was cleared or not before termination
 		time.Sleep(20 * time.Millisecond)
 		if start := int(atomic.LoadInt32(&started)); clear && start != workers {
@@ -241,3 +243,33 @@ func TestTerminate(t *testing.T) {
 		}
 	}
 }
+
+// Tests that bounded pools reject tasks beyond the queue limit.
+func TestBounded(t *testing.T) {
+	t.Parallel()
+
+	// Create a pool with a single worker and a short queue, blocking the worker
+	pool := NewBoundedThreadPool(1, 2)
+	pool.Start()
+
+	block := make(chan struct{})
+	if err := pool.Schedule(func() { <-block }); err != nil {
+		t.Fatalf("failed to schedule blocking task: %v.", err)
+	}
+	// Fill up the queue and make sure the next task is rejected
+	for i := 0; i < 2; i++ {
+		if err := pool.Schedule(func() {}); err != nil {
+			t.Fatalf("failed to schedule queued task %d: %v.", i, err)
+		}
+	}
+	if err := pool.Schedule(func() {}); err != ErrFull {
+		t.Fatalf("full queue schedule mismatch: have %v, want %v.", err, ErrFull)
+	}
+	// Release the worker and ensure the queue drains and accepts again
+	close(block)
+	pool.Terminate(false)
+
+	if size := pool.idle; size != 1 {
+		t.Fatalf("idle worker mismatch: have %v, want %v.", size, 1)
+	}
+}
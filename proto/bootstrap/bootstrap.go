@@ -17,7 +17,8 @@
 // between you and the author(s).
 
 // Package bootstrap is responsible for randomly probing and linearly scanning
-// the local network (single interface) for other running instances.
+// the local network (single interface) for other running instances. IPv6 subnets
+// are too large to cover, so only the low bits around the local address are.
 //
 // In every scanning cycle all configured UDP ports are checked (to prevent
 // slowdowns due to large config space).
@@ -37,6 +38,7 @@ import (
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/gobber"
+	"github.com/project-iris/iris/proto/overlay"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -105,7 +107,7 @@ func New(ipnet *net.IPNet, magic []byte, owner *big.Int, endpoint int) (*Bootstr
 	gobber.Init(new(Message))
 
 	// Do some environment dependent IP black magic
-	if detectGoogleComputeEngine() {
+	if ipnet.IP.To4() != nil && detectGoogleComputeEngine() {
 		// Google Compute Engine issues /32 addresses, find real subnet
 		logger.Info("detected GCE, retrieving real netmask")
 		old := ipnet.String()
@@ -161,6 +163,19 @@ func New(ipnet *net.IPNet, magic []byte, owner *big.Int, endpoint int) (*Bootstr
 	return b, b.beats, nil
 }
 
+// Counts the bootstrap ports not yet taken on the local machine, each overlay node
+// needing one for its bootstrapper.
+func Available() int {
+	free := 0
+	for _, port := range config.BootPorts {
+		if sock, err := net.ListenUDP("udp", &net.UDPAddr{Port: port}); err == nil {
+			sock.Close()
+			free++
+		}
+	}
+	return free
+}
+
 // Creates a bootstrap request message to send to potential peers.
 func newBootstrapRequest(magic []byte, owner *big.Int, endpoint int, encoder *gobber.Gobber) []byte {
 	msg := newBootstrapMessage(magic, owner, endpoint)
@@ -343,6 +358,10 @@ func (b *Bootstrapper) acceptor() {
 						if msg.Request {
 							b.sock.WriteToUDP(b.response, from)
 						}
+						// Ignore the beacons of banned peers
+						if overlay.BannedHost(from.IP) || overlay.BannedId(msg.Owner) {
+							continue
+						}
 						// Notify the maintenance routine
 						host := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.Endpoint))
 						if addr, err := net.ResolveTCPAddr("tcp", host); err == nil {
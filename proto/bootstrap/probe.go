@@ -66,8 +66,7 @@ func (s *probeSeeder) run(sink chan *net.IPAddr, phase *uint32) {
 	var err error
 
 	// Split the IP address into subnet and host parts
-	subnetBits, maskBits := s.ipnet.Mask.Size()
-	hostBits := maskBits - subnetBits
+	mask, hostBits := hostSpace(s.ipnet)
 
 	// Make sure the specified IP net can be probed (avoid point-to-point interfaces)
 	if hostBits < 2 {
@@ -79,7 +78,7 @@ func (s *probeSeeder) run(sink chan *net.IPAddr, phase *uint32) {
 		nextIP := rand.Intn(1<<uint(hostBits)-2) + 1
 
 		// Generate the full host address and send it upstream
-		host := s.ipnet.IP.Mask(s.ipnet.Mask)
+		host := s.ipnet.IP.Mask(mask)
 		for i := len(host) - 1; i >= 0; i-- {
 			host[i] |= byte(nextIP & 255)
 			nextIP >>= 8
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/project-iris/iris/config"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -65,12 +66,11 @@ func (s *scanSeeder) run(sink chan *net.IPAddr, phase *uint32) {
 	var err error
 
 	// Split the IP address into subnet and host parts
-	subnetBits, maskBits := s.ipnet.Mask.Size()
-	hostBits := maskBits - subnetBits
+	mask, hostBits := hostSpace(s.ipnet)
 
 	hostIP := 0
 	for i := 0; i < hostBits; i++ {
-		hostIP += int(s.ipnet.IP[len(s.ipnet.IP)-1-i/8]) & (1 << uint(i%8))
+		hostIP |= int(s.ipnet.IP[len(s.ipnet.IP)-1-i/8]>>uint(i%8)&1) << uint(i)
 	}
 	// Make sure the specified IP net can be scanned (avoid point-to-point interfaces)
 	if hostBits < 2 {
@@ -98,7 +98,7 @@ func (s *scanSeeder) run(sink chan *net.IPAddr, phase *uint32) {
 			continue
 		}
 		// Generate the full host address and send it upstream
-		host := s.ipnet.IP.Mask(s.ipnet.Mask)
+		host := s.ipnet.IP.Mask(mask)
 		for i := len(host) - 1; i >= 0; i-- {
 			host[i] |= byte(nextIP & 255)
 			nextIP >>= 8
@@ -119,3 +119,17 @@ func (s *scanSeeder) run(sink chan *net.IPAddr, phase *uint32) {
 	}
 	errc <- err
 }
+
+// Splits an IP network into the mask of the fixed part and the number of host
+// bits to seed. IPv6 subnets are way too large to cover, so only the low bits
+// around the local address are seeded (sequentially assigned addresses).
+func hostSpace(ipnet *net.IPNet) (net.IPMask, int) {
+	subnetBits, maskBits := ipnet.Mask.Size()
+	hostBits := maskBits - subnetBits
+
+	if ipnet.IP.To4() == nil && hostBits > config.BootIPv6HostBits {
+		hostBits = config.BootIPv6HostBits
+		return net.CIDRMask(maskBits-hostBits, maskBits), hostBits
+	}
+	return ipnet.Mask, hostBits
+}
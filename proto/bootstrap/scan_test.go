@@ -23,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/project-iris/iris/config"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -79,6 +80,54 @@ func testScanSeeder(t *testing.T, subnet int, addr *net.IPAddr) {
 	}
 }
 
+// Tests that the scanning ad-hoc seeder only covers the low host bits of IPv6
+// subnets, starting around the local address.
+func TestScanSeederIPv6(t *testing.T) {
+	addr, _ := net.ResolveIPAddr("ip", "fd00::1:2")
+	ipnet := &net.IPNet{
+		IP:   addr.IP,
+		Mask: net.CIDRMask(64, 128),
+	}
+	window := &net.IPNet{
+		IP:   addr.IP.Mask(net.CIDRMask(128-config.BootIPv6HostBits, 128)),
+		Mask: net.CIDRMask(128-config.BootIPv6HostBits, 128),
+	}
+	// Create the scanning seed generator, address sink and boot it
+	seeder := newScanSeeder(ipnet, log15.New("ipnet", ipnet))
+	sink, phase := make(chan *net.IPAddr), uint32(0)
+
+	if err := seeder.Start(sink, &phase); err != nil {
+		t.Fatalf("failed to start seed generator: %v.", err)
+	}
+	// Verify that the scan starts at the local address and spreads outwards
+	want := []string{"fd00::1:2", "fd00::1:3", "fd00::1:1", "fd00::1:4", "fd00::1:5", "fd00::1:6"}
+	for i, exp := range want {
+		select {
+		case addr := <-sink:
+			if addr.String() != exp {
+				t.Fatalf("address #%d mismatch: have %v, want %v.", i, addr, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("failed to retrieve next address")
+		}
+	}
+	// Ensure the scan stays within the low host bits
+	for i := 0; i < 1000; i++ {
+		select {
+		case addr := <-sink:
+			if !window.Contains(addr.IP) {
+				t.Fatalf("out of window address generated: %v.", addr)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("failed to retrieve next address")
+		}
+	}
+	// Terminate the generator
+	if err := seeder.Close(); err != nil {
+		t.Fatalf("failed to terminate seed generator: %v.", err)
+	}
+}
+
 // Tests two particular cases of network configurations where the host space is
 // empty (used during point-to-point connections).
 func TestScanSeederEmpyHostSpace(t *testing.T) {
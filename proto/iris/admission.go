@@ -0,0 +1,143 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the tunnel admission control, limiting the number of concurrently
+// open tunnels to prevent tunnel storms from exhausting local resources.
+
+package iris
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned when a tunnel cannot be admitted due to the configured limits.
+var ErrTooManyTunnels = errors.New("too many tunnels")
+
+// Concurrent tunnel limits of a connection. Zero values mean unlimited.
+type TunnelLimits struct {
+	Total   int  // Maximum number of open tunnels (inbound and outbound)
+	Cluster int  // Maximum number of open outbound tunnels into a single cluster
+	Wait    bool // Whether outbound tunnels queue for a free slot instead of failing
+}
+
+// Bookkeeping of the admitted tunnels.
+type admission struct {
+	limits TunnelLimits   // Currently enforced tunnel limits
+	total  int            // Number of admitted tunnels
+	groups map[string]int // Number of admitted outbound tunnels per cluster
+	free   chan struct{}  // Channel closed (and replaced) when a slot is freed
+	lock   sync.Mutex     // Mutex protecting the admission state
+}
+
+// Creates the tunnel admission bookkeeping with the configured default limits.
+func newAdmission() *admission {
+	return &admission{
+		limits: TunnelLimits{
+			Total:   config.IrisTunnelLimit,
+			Cluster: config.IrisTunnelClusterLimit,
+		},
+		groups: make(map[string]int),
+		free:   make(chan struct{}),
+	}
+}
+
+// Sets the concurrent tunnel limits of the connection. Already open tunnels are
+// not affected, even if they exceed the new limits.
+func (c *Connection) SetTunnelLimits(limits TunnelLimits) {
+	c.admit.lock.Lock()
+	defer c.admit.lock.Unlock()
+
+	c.admit.limits = limits
+}
+
+// Admits a tunnel into the connection (optionally waiting for a free slot until
+// the timeout expires), assigning it an id and tracking it as live. Inbound
+// tunnels are not associated with any cluster.
+func (c *Connection) trackTunnel(tun *Tunnel, timeout time.Duration) error {
+	var expire <-chan time.Time
+	for {
+		// Try to acquire a slot for the tunnel
+		c.admit.lock.Lock()
+		limits := c.admit.limits
+		if (limits.Total == 0 || c.admit.total < limits.Total) &&
+			(limits.Cluster == 0 || tun.group == "" || c.admit.groups[tun.group] < limits.Cluster) {
+			c.admit.total++
+			if tun.group != "" {
+				c.admit.groups[tun.group]++
+			}
+			c.admit.lock.Unlock()
+			break
+		}
+		free := c.admit.free
+		c.admit.lock.Unlock()
+
+		// No slot available, fail or wait for one to be freed
+		if !limits.Wait || tun.group == "" || timeout <= 0 {
+			return ErrTooManyTunnels
+		}
+		if expire == nil {
+			expire = time.After(timeout)
+		}
+		select {
+		case <-free:
+			continue
+		case <-expire:
+			return ErrTooManyTunnels
+		case <-c.term:
+			return ErrTerminating
+		}
+	}
+	// Slot acquired, track the tunnel
+	c.tunLock.Lock()
+	tun.id = c.tunIdx
+	c.tunIdx++
+	c.tunLive[tun.id] = tun
+	c.tunLock.Unlock()
+
+	return nil
+}
+
+// Removes a tunnel from the live list, releasing its admission slot. Returns
+// whether the tunnel was still tracked, preventing simultaneous double closes.
+func (c *Connection) untrackTunnel(tun *Tunnel) bool {
+	c.tunLock.Lock()
+	if _, ok := c.tunLive[tun.id]; !ok {
+		c.tunLock.Unlock()
+		return false
+	}
+	delete(c.tunLive, tun.id)
+	c.tunLock.Unlock()
+
+	// Release the admission slot and wake any waiters
+	c.admit.lock.Lock()
+	c.admit.total--
+	if tun.group != "" {
+		if c.admit.groups[tun.group]--; c.admit.groups[tun.group] == 0 {
+			delete(c.admit.groups, tun.group)
+		}
+	}
+	close(c.admit.free)
+	c.admit.free = make(chan struct{})
+	c.admit.lock.Unlock()
+
+	return true
+}
@@ -0,0 +1,64 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the consistent-hash requests: a caller provided key is hashed to pick
+// the same cluster member for as long as the membership is stable, reshuffling
+// only a minimal portion of the keys on changes. This allows routing requests
+// to the member with the relevant data cached.
+
+package iris
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/config"
+)
+
+// Executes a synchronous request to cluster like Request, but instead of load
+// balancing, the member is picked consistently based on key. An empty key falls
+// back to the plain load balanced request.
+func (c *Connection) RequestKeyed(cluster string, key string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.chainRequest(func(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+		return c.requestFrom(cluster, key, req, timeout, nil)
+	})(cluster, req, timeout)
+}
+
+// Maps an affinity key to one of the cluster splits, so all requests with the
+// same key traverse the same carrier tree.
+func keySplit(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(config.IrisClusterSplits))
+}
+
+// Picks the local connection a keyed request should be delivered to among the
+// live subscribers of a topic.
+func affine(key string, subs []uint64) uint64 {
+	best, score := subs[0], 0.0
+	for i, id := range subs {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, id)
+		if s := balancer.Affinity(key, buf, 1); i == 0 || s > score {
+			best, score = id, s
+		}
+	}
+	return best
+}
@@ -0,0 +1,100 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that keyed requests consistently reach the same member, regardless of
+// which node they are issued from, while spreading different keys.
+func TestKeyedRequests(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes, conns, keys := 3, 2, 16
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	// Boot the iris overlays
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New("keyed-test", key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect a requester and a few members to each node
+	clients := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		client, err := liveNodes[i].Connect("keyed-client", &stateful{0xff})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer client.Close()
+		clients[i] = client
+
+		for j := 0; j < conns; j++ {
+			member, err := liveNodes[i].Connect("keyed-cluster", &stateful{byte(i*conns + j)})
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			defer member.Close()
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	// Issue the same keys from all the nodes and ensure they land on one member
+	served := make(map[byte]struct{})
+	for i := 0; i < keys; i++ {
+		affinity := fmt.Sprintf("key-%d", i)
+
+		var want byte
+		for j := 0; j < 3*nodes; j++ {
+			rep, err := clients[j%nodes].RequestKeyed("keyed-cluster", affinity, []byte{byte(j)}, time.Second)
+			if err != nil {
+				t.Fatalf("key %s: failed to execute keyed request: %v.", affinity, err)
+			}
+			if j == 0 {
+				want = rep[0]
+			} else if rep[0] != want {
+				t.Fatalf("key %s: request served by another member: have %v, want %v.", affinity, rep[0], want)
+			}
+		}
+		served[want] = struct{}{}
+	}
+	if len(served) < 2 {
+		t.Fatalf("keys not spread among the members: have %v, want >= %v.", len(served), 2)
+	}
+}
@@ -67,6 +67,13 @@ func TestBroadcastMultiNodeMultiConn(t *testing.T) {
 	testBroadcast(t, 10, 10, 10)
 }
 
+func TestBroadcastLocalFastPath(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testBroadcast(t, 1, 10, 100)
+}
+
 // Tests multi node multi connection broadcasting.
 func testBroadcast(t *testing.T, nodes, conns, msgs int) {
 	// Configure the test
@@ -151,3 +158,132 @@ func testBroadcast(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Individual confirmed broadcast tests.
+func TestBroadcastConfirmedSingleNode(t *testing.T) {
+	testBroadcastConfirmed(t, 1, 10)
+}
+
+func TestBroadcastConfirmedMultiNode(t *testing.T) {
+	testBroadcastConfirmed(t, 5, 2)
+}
+
+// Tests that confirmed broadcasts gather the acknowledgements of all members.
+func testBroadcastConfirmed(t *testing.T, nodes, conns int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "broadcast-test"
+	cluster := fmt.Sprintf("broadcast-confirm-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to all nodes with a lot of clients
+	liveConns := make([]*Connection, 0, nodes*conns)
+	for _, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			conn, err := node.Connect(cluster, &broadcaster{make(chan []byte, nodes*conns+1)})
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			liveConns = append(liveConns, conn)
+
+			defer func(conn *Connection) {
+				if err := conn.Close(); err != nil {
+					t.Fatalf("failed to close iris connection: %v.", err)
+				}
+			}(conn)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports (TODO, fix this)
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Broadcast from each connection and wait for full quorum
+	for i, conn := range liveConns {
+		receipt, err := conn.BroadcastConfirmed(cluster, []byte{byte(i)}, len(liveConns), time.Second)
+		if err != nil {
+			t.Fatalf("failed to broadcast message: %v.", err)
+		}
+		if !receipt.Quorum || receipt.Acks != len(liveConns) {
+			t.Fatalf("receipt mismatch: have %+v, want %d acks with quorum.", receipt, len(liveConns))
+		}
+	}
+	// Broadcast without a quorum and make sure the full timeout is waited out
+	start := time.Now()
+	receipt, err := liveConns[0].BroadcastConfirmed(cluster, []byte{0}, 0, 250*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to broadcast message: %v.", err)
+	}
+	if receipt.Quorum || receipt.Acks != len(liveConns) {
+		t.Fatalf("receipt mismatch: have %+v, want %d acks without quorum.", receipt, len(liveConns))
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("quorum-less broadcast returned early: %v.", elapsed)
+	}
+}
+
+// Tests that confirmed broadcasts are not acknowledged by crashing handlers.
+func TestBroadcastConfirmedPanic(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a sane and a panicking member
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("broadcast-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handlers := []ConnectionHandler{&broadcaster{make(chan []byte, 1)}, &panicker{}}
+	conns := make([]*Connection, 0, len(handlers))
+	for _, handler := range handlers {
+		conn, err := node.Connect("broadcast-panic-test", handler)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		conns = append(conns, conn)
+
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+	}
+	// Broadcast and make sure only the sane member acknowledged
+	receipt, err := conns[0].BroadcastConfirmed("broadcast-panic-test", []byte{0}, len(conns), 250*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to broadcast message: %v.", err)
+	}
+	if receipt.Quorum || receipt.Acks != 1 {
+		t.Fatalf("receipt mismatch: have %+v, want %d acks without quorum.", receipt, 1)
+	}
+}
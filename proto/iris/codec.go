@@ -0,0 +1,128 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the pluggable payload codecs and the typed messaging helpers built
+// on top of them, sparing applications from hand-encoding every message.
+
+package iris
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"time"
+)
+
+// Payload encoder/decoder to convert between application values and the raw
+// binary messages passed around by Iris.
+type Codec interface {
+	// Encodes an application value into a binary message.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Decodes a binary message into the application value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codec using the Go specific gob encoding. Every message is self contained,
+// so types are retransmitted each time.
+type GobCodec struct{}
+
+// Implements Codec.Marshal.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Implements Codec.Unmarshal.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Codec using the language agnostic JSON encoding.
+type JSONCodec struct{}
+
+// Implements Codec.Marshal.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Implements Codec.Unmarshal.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Sets the codec used by the typed messaging helpers of the connection. Unless
+// set otherwise, a GobCodec is used.
+func (c *Connection) SetCodec(codec Codec) {
+	c.codecLock.Lock()
+	defer c.codecLock.Unlock()
+
+	c.codec = codec
+}
+
+// Retrieves the currently configured codec of the connection.
+func (c *Connection) Codec() Codec {
+	c.codecLock.RLock()
+	defer c.codecLock.RUnlock()
+
+	return c.codec
+}
+
+// Decodes a raw message delivered to a handler into v, using the codec of the
+// connection.
+func (c *Connection) Decode(data []byte, v interface{}) error {
+	return c.Codec().Unmarshal(data, v)
+}
+
+// Encodes msg with the connection codec and broadcasts it to all members of an
+// iris cluster.
+func (c *Connection) BroadcastValue(cluster string, msg interface{}) error {
+	data, err := c.Codec().Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Broadcast(cluster, data)
+}
+
+// Encodes req with the connection codec, executes a synchronous request to
+// cluster and decodes the reply into rep.
+func (c *Connection) RequestValue(cluster string, req interface{}, rep interface{}, timeout time.Duration) error {
+	codec := c.Codec()
+
+	data, err := codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply, err := c.Request(cluster, data, timeout)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(reply, rep)
+}
+
+// Encodes msg with the connection codec and publishes it to topic.
+func (c *Connection) PublishValue(topic string, msg interface{}) error {
+	data, err := c.Codec().Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Publish(topic, data)
+}
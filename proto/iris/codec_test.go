@@ -0,0 +1,100 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Typed payload for the codec tests.
+type codecPayload struct {
+	Name   string
+	Values []int
+	Nested map[string]float64
+}
+
+func TestCodecs(t *testing.T) {
+	orig := &codecPayload{
+		Name:   "codec",
+		Values: []int{3, 1, 4, 1, 5},
+		Nested: map[string]float64{"pi": 3.14, "e": 2.71},
+	}
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		data, err := codec.Marshal(orig)
+		if err != nil {
+			t.Fatalf("%T: failed to marshal payload: %v.", codec, err)
+		}
+		back := new(codecPayload)
+		if err := codec.Unmarshal(data, back); err != nil {
+			t.Fatalf("%T: failed to unmarshal payload: %v.", codec, err)
+		}
+		if !reflect.DeepEqual(orig, back) {
+			t.Fatalf("%T: payload mismatch: have %+v, want %+v.", codec, back, orig)
+		}
+	}
+}
+
+func TestCodecRequest(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect an echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("codec-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("codec-test", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Issue typed requests with all the codecs
+	orig := &codecPayload{Name: "request", Values: []int{2, 7, 1, 8}}
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		conn.SetCodec(codec)
+
+		rep := new(codecPayload)
+		if err := conn.RequestValue("codec-test", orig, rep, time.Second); err != nil {
+			t.Fatalf("%T: failed to execute typed request: %v.", codec, err)
+		}
+		if !reflect.DeepEqual(orig, rep) {
+			t.Fatalf("%T: req/rep mismatch: have %+v, want %+v.", codec, rep, orig)
+		}
+	}
+}
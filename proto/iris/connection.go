@@ -26,14 +26,18 @@ import (
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/filter"
 	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto/scribe"
 )
 
 // Iris specific errors
 var ErrTerminating = errors.New("terminating")
-var ErrTimeout = errors.New("timeout")
+var ErrTimeout error = timeoutError{}
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
+var ErrInvalidLimit = errors.New("invalid reply limit")
+var ErrUnreachable = errors.New("no reachable member")
 
 // Prefixes for multi-clustering.
 var clusterPrefixes []string
@@ -58,8 +62,8 @@ type ConnectionHandler interface {
 	HandleBroadcast(msg []byte)
 
 	// Handles the request, returning the reply that should be forwarded back to
-	// the caller. If the method crashes, nothing is returned and the caller will
-	// eventually time out.
+	// the caller. If the method crashes, the panic is recovered and reported to
+	// the caller as a failure.
 	HandleRequest(req []byte, timeout time.Duration) ([]byte, error)
 
 	// Handles the request to open a direct tunnel.
@@ -72,31 +76,67 @@ type SubscriptionHandler interface {
 	HandleEvent(msg []byte)
 }
 
+// Subscription handler additionally receiving the attributes the events were
+// published with. The plain HandleEvent method of such handlers is never invoked.
+type AttributedHandler interface {
+	HandleEventAttrs(attrs map[string]string, msg []byte)
+}
+
 // Connection through which to interact with other iris clients.
 type Connection struct {
+	// Atomically accessed 64 bit fields first for alignment
+	hedging int64 // Delay after which to duplicate pending requests (0 = disabled)
+
 	// Application layer fields
 	id      uint64            // Auto-incremented connection id
 	cluster string            // Cluster to which the client registers
 	handler ConnectionHandler // Handler for connection events
 	iris    *Overlay          // Interface into the distributed carrier
 
-	reqIdx  uint64                 // Index to assign the next request
-	reqReps map[uint64]chan []byte // Reply channels for active requests
-	reqErrs map[uint64]chan error  // Error channels for active requests
-	reqLock sync.RWMutex           // Mutex to protect the result channel maps
+	codec     Codec        // Payload codec for the typed messaging helpers
+	codecLock sync.RWMutex // Mutex to protect the codec swaps
+
+	reqIdx  uint64                  // Index to assign the next request
+	reqReps map[uint64]chan []byte  // Reply channels for active requests
+	reqErrs map[uint64]chan error   // Error channels for active requests
+	reqSrcs map[uint64]chan *Member // Replier channels for active sticky requests
+	reqClms map[uint64]chan *Member // Claim channels for active hedged requests
+	reqLock sync.RWMutex            // Mutex to protect the result channel maps
+
+	hedgeLive map[hedgeId]bool // Queued hedged requests, flagged if cancelled
+	hedgeLock sync.Mutex       // Mutex to protect the hedged request map
 
-	subLive map[string]SubscriptionHandler // Active subscriptions
-	subLock sync.RWMutex                   // Mutex to protect the subscription map
+	ackIdx  uint64                   // Index to assign the next confirmed broadcast
+	ackLive map[uint64]*bcastReceipt // Receipt trackers of pending confirmed broadcasts
+	ackLock sync.RWMutex             // Mutex to protect the receipt tracker map
+
+	subLive map[string]*Subscription // Active subscriptions
+	subLock sync.RWMutex             // Mutex to protect the subscription map
 
 	tunIdx  uint64             // Index to assign the next tunnel
 	tunLive map[uint64]*Tunnel // Tunnels either live, or being established
 	tunLock sync.RWMutex       // Mutex to protect the tunnel map
+	admit   *admission         // Admission control of the concurrent tunnels
 
 	// Quality of service fields
-	workers *pool.ThreadPool // Concurrent threads handling the connection
-	splitId uint32           // Id of the next prefix for split cluster round-robin
+	workers  *pool.ThreadPool // Concurrent threads handling the connection
+	workLock sync.RWMutex     // Mutex to protect the handler pool swaps
+	splitId  uint32           // Id of the next prefix for split cluster round-robin
+	stats    *statistics      // Messaging statistics of the connection
+
+	limits    *limiter     // Outbound rate limits of the connection
+	limitLock sync.RWMutex // Mutex to protect the rate limit swaps
+
+	panicHandler func(err *PanicError) // Optional callback for recovered handler panics
+	panicLock    sync.RWMutex          // Mutex to protect the panic callback
+
+	metrics     func() map[string]float64 // Optional callback reporting custom load metrics
+	metricsLock sync.RWMutex              // Mutex to protect the metrics callback
+
+	chains *interceptors // Interceptor chains wrapping the messaging operations
 
 	// Bookkeeping fields
+	beat int64           // Time of the owner's last liveness signal (unix nanos, atomic, 0 = untracked)
 	quit chan chan error // Quit channel to synchronize termination
 	term chan struct{}   // Channel to signal termination to blocked go-routines
 }
@@ -114,14 +154,24 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 		cluster: cluster,
 		handler: handler,
 		iris:    o,
+		codec:   GobCodec{},
 
 		reqReps: make(map[uint64]chan []byte),
 		reqErrs: make(map[uint64]chan error),
-		subLive: make(map[string]SubscriptionHandler),
+		reqSrcs: make(map[uint64]chan *Member),
+		reqClms: make(map[uint64]chan *Member),
+		ackLive: make(map[uint64]*bcastReceipt),
+		subLive: make(map[string]*Subscription),
 		tunLive: make(map[uint64]*Tunnel),
+		admit:   newAdmission(),
+
+		hedgeLive: make(map[hedgeId]bool),
 
 		// Quality of service
-		workers: pool.NewThreadPool(config.IrisHandlerThreads),
+		workers: pool.NewBoundedThreadPool(config.IrisHandlerThreads, config.IrisHandlerQueue),
+		stats:   newStatistics(),
+		limits:  newLimiter(new(Limits)),
+		chains:  new(interceptors),
 
 		// Bookkeeping
 		quit: make(chan chan error),
@@ -136,7 +186,7 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 	// Subscribe to the multi-group if the connection is a service
 	if c.cluster != "" {
 		for _, prefix := range clusterPrefixes {
-			if err := c.iris.subscribe(c.id, prefix+cluster); err != nil {
+			if err := c.iris.subscribe(c.id, prefix+cluster, ""); err != nil {
 				return nil, err
 			}
 		}
@@ -149,22 +199,168 @@ func (o *Overlay) Connect(cluster string, handler ConnectionHandler) (*Connectio
 // Broadcasts asynchronously a message to all members of an iris cluster. No
 // guarantees are made that all nodes receive the message (best effort).
 func (c *Connection) Broadcast(cluster string, msg []byte) error {
+	return c.chainSend(&c.chains.outBcast, c.broadcast)(cluster, msg)
+}
+
+// Broadcasts asynchronously a message to all members of an iris cluster, with
+// the interceptors already applied.
+func (c *Connection) broadcast(cluster string, msg []byte) error {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return err
+	}
+	c.stats.add(&c.stats.bcastSent, 1)
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.iris.publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+}
+
+// Broadcasts a message to all members of an iris cluster, blocking until the
+// carrier accepts it for distribution or the timeout expires. Delivery to the
+// individual members is still best effort (see BroadcastConfirmed for receipts).
+func (c *Connection) BroadcastSync(cluster string, msg []byte, timeout time.Duration) error {
+	return c.chainSend(&c.chains.outBcast, func(cluster string, msg []byte) error {
+		return c.broadcastSync(cluster, msg, timeout)
+	})(cluster, msg)
+}
+
+// Broadcasts a message to all members of an iris cluster, blocking until the
+// carrier accepts it, with the interceptors already applied.
+func (c *Connection) broadcastSync(cluster string, msg []byte, timeout time.Duration) error {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return err
+	}
+	c.stats.add(&c.stats.bcastSent, 1)
+
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg))
+	return c.iris.publishSync(clusterPrefixes[prefixIdx]+cluster, c.assembleBroadcast(msg), timeout)
+}
+
+// Delivery summary of a confirmed broadcast.
+type Receipt struct {
+	Acks   int  // Number of cluster members that acknowledged the broadcast
+	Quorum bool // Flag whether the requested quorum was reached in time
+}
+
+// Receipt tracker of a pending confirmed broadcast.
+type bcastReceipt struct {
+	acks   int32         // Number of acknowledgements received
+	notify chan struct{} // Channel signalling the arrival of new acks
+}
+
+// Broadcasts a message to all members of an iris cluster, waiting for receipt
+// acknowledgements from the recipients. The method returns either when quorum
+// members acknowledged the message, or when the timeout is reached. A quorum of
+// zero (or less) waits out the full timeout, gathering all acknowledgements.
+func (c *Connection) BroadcastConfirmed(cluster string, msg []byte, quorum int, timeout time.Duration) (*Receipt, error) {
+	var receipt *Receipt
+	err := c.chainSend(&c.chains.outBcast, func(cluster string, msg []byte) (err error) {
+		receipt, err = c.broadcastConfirmed(cluster, msg, quorum, timeout)
+		return err
+	})(cluster, msg)
+	return receipt, err
+}
+
+// Broadcasts a message to all members of an iris cluster and gathers the receipt
+// acknowledgements, with the interceptors already applied.
+func (c *Connection) broadcastConfirmed(cluster string, msg []byte, quorum int, timeout time.Duration) (*Receipt, error) {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return nil, err
+	}
+	// Create a receipt tracker for the acknowledgements
+	receipt := &bcastReceipt{
+		notify: make(chan struct{}, 1),
+	}
+	c.ackLock.Lock()
+	bcastId := c.ackIdx
+	c.ackIdx++
+	c.ackLive[bcastId] = receipt
+	c.ackLock.Unlock()
+
+	// Make sure the tracker is cleaned up
+	defer func() {
+		c.ackLock.Lock()
+		delete(c.ackLive, bcastId)
+		c.ackLock.Unlock()
+	}()
+	// Send the broadcast
+	c.stats.add(&c.stats.bcastSent, 1)
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	if err := c.iris.publish(clusterPrefixes[prefixIdx]+cluster, c.assembleConfirmedBroadcast(bcastId, msg)); err != nil {
+		return nil, err
+	}
+	// Gather the acknowledgements until quorum, timeout or termination
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-deadline:
+			acks := int(atomic.LoadInt32(&receipt.acks))
+			return &Receipt{Acks: acks, Quorum: quorum > 0 && acks >= quorum}, nil
+		case <-receipt.notify:
+			if acks := int(atomic.LoadInt32(&receipt.acks)); quorum > 0 && acks >= quorum {
+				return &Receipt{Acks: acks, Quorum: true}, nil
+			}
+		}
+	}
 }
 
 // Executes a synchronous request to cluster (load balanced between all active),
 // and returns the received reply, or an error if a timeout is reached.
 func (c *Connection) Request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
-	// Create a reply and error channel for the results
+	return c.chainRequest(c.request)(cluster, req, timeout)
+}
+
+// Executes a synchronous request to cluster, with the interceptors already
+// applied.
+func (c *Connection) request(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.requestFrom(cluster, "", req, timeout, nil)
+}
+
+// Executes a synchronous request to cluster, with the interceptors already
+// applied. If key is non-empty, the request is balanced consistently by it. If
+// member is non-nil, it is filled with the identity of the replier.
+func (c *Connection) requestFrom(cluster string, key string, req []byte, timeout time.Duration, member *Member) ([]byte, error) {
+	if err := c.throttleRequest(len(req)); err != nil {
+		return nil, err
+	}
+	// If hedging is enabled, keep a copy of the request (sending encrypts in place).
+	// Keyed requests are never hedged, a second member would break the affinity.
+	var hedge <-chan time.Time
+	var dup []byte
+
+	if delay := time.Duration(atomic.LoadInt64(&c.hedging)); key == "" && delay > 0 && delay < timeout {
+		dup = make([]byte, len(req))
+		copy(dup, req)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	// Create a reply and error channel for the results (and replier if needed).
+	// Hedged requests also track the claiming members to cancel the loser.
 	repc := make(chan []byte, 1)
-	errc := make(chan error, 1)
+	errc := make(chan error, 2)
 
+	var srcc, clmc chan *Member
+	if member != nil || dup != nil {
+		srcc = make(chan *Member, 1)
+	}
+	if dup != nil {
+		clmc = make(chan *Member, 2)
+	}
 	c.reqLock.Lock()
 	reqId := c.reqIdx
 	c.reqIdx++
 	c.reqReps[reqId] = repc
 	c.reqErrs[reqId] = errc
+	if srcc != nil {
+		c.reqSrcs[reqId] = srcc
+	}
+	if clmc != nil {
+		c.reqClms[reqId] = clmc
+	}
 	c.reqLock.Unlock()
 
 	// Make sure the result channels are cleaned up
@@ -174,28 +370,227 @@ func (c *Connection) Request(cluster string, req []byte, timeout time.Duration)
 		delete(c.reqErrs, reqId)
 		close(repc)
 		close(errc)
+		if srcc != nil {
+			delete(c.reqSrcs, reqId)
+			close(srcc)
+		}
+		if clmc != nil {
+			delete(c.reqClms, reqId)
+			close(clmc)
+		}
 		c.reqLock.Unlock()
 	}()
 	// Send the request
+	c.stats.add(&c.stats.reqSent, 1)
+	start := time.Now()
+
 	prefixIdx := int(reqId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout))
+	if key != "" {
+		prefixIdx = keySplit(key)
+	}
+	c.sendRequest(clusterPrefixes[prefixIdx]+cluster, key, reqId, req, timeout, dup != nil)
+
+	// Retrieve the results, time out or fail if terminating (or all copies failed)
+	var claims []*Member
+	pending := 1
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-deadline:
+			c.stats.add(&c.stats.timeouts, 1)
+			return nil, ErrTimeout
+		case claim := <-clmc:
+			claims = append(claims, claim)
+		case <-hedge:
+			// Hedge delay passed, duplicate the request into the next split, avoiding
+			// the member already serving it if known
+			c.stats.add(&c.stats.reqHedged, 1)
+			prefixIdx = (prefixIdx + 1) % config.IrisClusterSplits
+			var skip *Member
+			if len(claims) > 0 {
+				skip = claims[0]
+			}
+			c.sendHedge(clusterPrefixes[prefixIdx]+cluster, skip, reqId, dup, timeout-time.Since(start))
+			hedge, pending = nil, pending+1
+		case reply := <-repc:
+			c.stats.reqLatency.record(time.Since(start))
+			if srcc != nil {
+				// The replier is always announced before the reply itself
+				src := <-srcc
+				if clmc != nil {
+					c.cancelHedges(reqId, src, claims, clmc)
+				}
+				if member != nil {
+					*member = *src
+					member.cluster = cluster
+				}
+			}
+			return reply, nil
+		case err := <-errc:
+			if pending--; pending > 0 {
+				continue
+			}
+			c.stats.add(&c.stats.reqFailed, 1)
+			c.stats.reqLatency.record(time.Since(start))
+			return nil, err
+		}
+	}
+}
 
-	// Retrieve the results, time out or fail if terminating
-	select {
-	case <-c.term:
-		return nil, ErrTerminating
-	case <-time.After(timeout):
-		return nil, ErrTimeout
-	case reply := <-repc:
-		return reply, nil
-	case err := <-errc:
+// Signals that the owner of the connection (e.g. a remote client attached through
+// a relay) is still alive. Once called, the carrier leases of the connection's
+// subscriptions are only renewed for as long as the signals keep arriving within
+// a topic lease of each other, so an owner that crashed without closing the
+// connection gets its registrations reclaimed. Connections never signalling are
+// deemed alive until closed.
+func (c *Connection) Keepalive() {
+	atomic.StoreInt64(&c.beat, time.Now().UnixNano())
+}
+
+// Reports whether the owner of the connection is still deemed alive.
+func (c *Connection) alive() bool {
+	beat := atomic.LoadInt64(&c.beat)
+	return beat == 0 || config.ScribeTopicLease == 0 || time.Since(time.Unix(0, beat)) < config.ScribeTopicLease
+}
+
+// Sets the delay after which a pending request is duplicated to a second member
+// of the cluster, accepting whichever reply arrives first (the other member is
+// told to drop it if not yet started). The request only fails if both copies
+// do. Hedging trades extra load for lower tail latencies. A zero delay disables
+// hedging.
+func (c *Connection) SetHedging(delay time.Duration) {
+	atomic.StoreInt64(&c.hedging, int64(delay))
+}
+
+// Balances a request to a member of a split cluster, short-circuiting if the fast
+// path is enabled and the balancer picked a local member. Keyed requests always traverse the
+// carrier to consistently reach the same member. Hedged requests are claimed by
+// the member serving them.
+func (c *Connection) sendRequest(split string, key string, reqId uint64, req []byte, timeout time.Duration, hedged bool) {
+	if key != "" {
+		c.iris.scribe.BalanceKeyed(split, key, c.assembleKeyedRequest(reqId, key, req, timeout))
+	} else if local, send := c.iris.pick(split); local != nil {
+		self := c.iris.scribe.Self()
+		if hedged {
+			local.scheduleHedgedRequest(self, c.id, reqId, req, timeout)
+		} else {
+			local.scheduleRequest(self, c.id, reqId, req, timeout)
+		}
+	} else if hedged {
+		send(c.assembleHedgedRequest(reqId, req, timeout))
+	} else {
+		send(c.assembleRequest(reqId, req, timeout))
+	}
+}
+
+// Executes a synchronous scatter-gather request to at most limit members of
+// cluster, and returns the first limit replies, or all arrived ones when the
+// timeout is hit. If the cluster is not larger than the limit, every member is
+// asked, otherwise limit balanced copies are sent (possibly hitting a member more
+// than once). Remote failures count towards the limit, but only the replies are
+// returned. If no reply arrives at all, either the first failure or a timeout is
+// reported.
+func (c *Connection) RequestAll(cluster string, req []byte, timeout time.Duration, limit int) ([][]byte, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	if err := c.throttleRequest(len(req)); err != nil {
 		return nil, err
 	}
+	// Create a reply and error channel for the results, large enough for all
+	repc := make(chan []byte, limit)
+	errc := make(chan error, limit)
+
+	c.reqLock.Lock()
+	reqId := c.reqIdx
+	c.reqIdx++
+	c.reqReps[reqId] = repc
+	c.reqErrs[reqId] = errc
+	c.reqLock.Unlock()
+
+	// Make sure the result channels are cleaned up
+	defer func() {
+		c.reqLock.Lock()
+		delete(c.reqReps, reqId)
+		delete(c.reqErrs, reqId)
+		close(repc)
+		close(errc)
+		c.reqLock.Unlock()
+	}()
+	// Send the request to every member of the cluster if within the limit, or to
+	// limit balanced ones otherwise
+	c.stats.add(&c.stats.reqSent, 1)
+	start := time.Now()
+
+	prefixIdx := int(reqId) % config.IrisClusterSplits
+	if size, err := c.iris.size(clusterPrefixes[prefixIdx] + cluster); err == nil && size > 0 && size <= limit {
+		if err := c.iris.publish(clusterPrefixes[prefixIdx]+cluster, c.assembleRequest(reqId, req, timeout)); err != nil {
+			return nil, err
+		}
+	} else {
+		for i := 0; i < limit; i++ {
+			// Sending encrypts in place, make sure the copies don't share the payload
+			cpy := make([]byte, len(req))
+			copy(cpy, req)
+
+			split := clusterPrefixes[(prefixIdx+i)%config.IrisClusterSplits] + cluster
+			c.sendRequest(split, "", reqId, cpy, timeout-time.Since(start), false)
+		}
+	}
+	// Gather the results until the limit is reached, time out or fail if terminating
+	replies := make([][]byte, 0, limit)
+	var failure error
+
+	deadline := time.After(timeout)
+gather:
+	for done := 0; done < limit; done++ {
+		select {
+		case <-c.term:
+			return nil, ErrTerminating
+		case <-deadline:
+			break gather
+		case reply := <-repc:
+			replies = append(replies, reply)
+		case err := <-errc:
+			c.stats.add(&c.stats.reqFailed, 1)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	c.stats.reqLatency.record(time.Since(start))
+
+	if len(replies) == 0 {
+		if failure != nil {
+			return nil, failure
+		}
+		c.stats.add(&c.stats.timeouts, 1)
+		return nil, ErrTimeout
+	}
+	return replies, nil
 }
 
 // Subscribes to topic, using handler as the callback for arriving events. An
 // error is returned if subscription fails.
+//
+// Topic names are hierarchical, with levels separated by slashes: a subscription
+// to a/b also receives the events published into a/b/c and any other descendant.
 func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error {
+	return c.SubscribeFiltered(topic, handler, "")
+}
+
+// Subscribes to topic, delivering only the events whose attributes match the
+// filter expression (see package filter for the syntax). The filter is also
+// propagated through the carrier, so that non matching events are dropped by
+// the forwarding nodes instead of traversing the last hops.
+func (c *Connection) SubscribeFiltered(topic string, handler SubscriptionHandler, expr string) error {
+	flt, err := filter.Parse(expr)
+	if err != nil {
+		return err
+	}
 	// Make sure there are no double subscriptions and not closing
 	c.subLock.Lock()
 	select {
@@ -207,15 +602,16 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 			c.subLock.Unlock()
 			return ErrSubscribed
 		}
+		sub := newSubscription(c, topic, handler, flt)
 		for _, prefix := range topicPrefixes {
-			c.subLive[prefix+topic] = handler
+			c.subLive[prefix+topic] = sub
 		}
 	}
 	c.subLock.Unlock()
 
 	// Subscribe through the carrier
 	for _, prefix := range topicPrefixes {
-		if err := c.iris.subscribe(c.id, prefix+topic); err != nil {
+		if err := c.iris.subscribe(c.id, prefix+topic, flt.String()); err != nil {
 			return err
 		}
 	}
@@ -225,8 +621,72 @@ func (c *Connection) Subscribe(topic string, handler SubscriptionHandler) error
 // Publishes an event asynchronously to topic. No guarantees are made that all
 // subscribers receive the message.
 func (c *Connection) Publish(topic string, msg []byte) error {
+	return c.PublishAttrs(topic, nil, msg)
+}
+
+// Publishes an event asynchronously to topic, tagged with a set of attributes
+// that subscription filters are evaluated against.
+func (c *Connection) PublishAttrs(topic string, attrs map[string]string, msg []byte) error {
+	return c.chainSend(&c.chains.outPub, func(topic string, msg []byte) error {
+		return c.publish(topic, attrs, msg)
+	})(topic, msg)
+}
+
+// Publishes an attributed event asynchronously to topic, with the interceptors
+// already applied.
+func (c *Connection) publish(topic string, attrs map[string]string, msg []byte) error {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return err
+	}
+	c.stats.add(&c.stats.pubSent, 1)
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.iris.publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(attrs, msg))
+}
+
+// Publishes an event to topic, blocking until the carrier accepts it for
+// distribution or the timeout expires. Delivery to the individual subscribers
+// is still best effort.
+func (c *Connection) PublishSync(topic string, msg []byte, timeout time.Duration) error {
+	return c.chainSend(&c.chains.outPub, func(topic string, msg []byte) error {
+		return c.publishSync(topic, msg, timeout)
+	})(topic, msg)
+}
+
+// Publishes an event to topic, blocking until the carrier accepts it, with the
+// interceptors already applied.
+func (c *Connection) publishSync(topic string, msg []byte, timeout time.Duration) error {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return err
+	}
+	c.stats.add(&c.stats.pubSent, 1)
+
 	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
-	return c.iris.scribe.Publish(topicPrefixes[prefixIdx]+topic, c.assemblePublish(msg))
+	return c.iris.publishSync(topicPrefixes[prefixIdx]+topic, c.assemblePublish(nil, msg), timeout)
+}
+
+// Publishes an event to topic like Publish, but also traces the carrier paths
+// the event traverses, returning those reaching subscribed nodes within window.
+// Meant for diagnostics, as the call always blocks for the whole window.
+func (c *Connection) PublishTraced(topic string, msg []byte, window time.Duration) ([]scribe.Path, error) {
+	var paths []scribe.Path
+	err := c.chainSend(&c.chains.outPub, func(topic string, msg []byte) error {
+		var err error
+		paths, err = c.publishTraced(topic, msg, window)
+		return err
+	})(topic, msg)
+	return paths, err
+}
+
+// Publishes a traced event to topic, with the interceptors already applied.
+func (c *Connection) publishTraced(topic string, msg []byte, window time.Duration) ([]scribe.Path, error) {
+	if err := c.throttlePublish(len(msg)); err != nil {
+		return nil, err
+	}
+	c.stats.add(&c.stats.pubSent, 1)
+
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	return c.iris.publishTraced(topicPrefixes[prefixIdx]+topic, c.assemblePublish(nil, msg), window)
 }
 
 // Unsubscribes from topic, receiving no more event notifications for it.
@@ -243,11 +703,15 @@ func (c *Connection) Unsubscribe(topic string) error {
 			return ErrNotSubscribed
 		}
 	}
+	sub := c.subLive[topicPrefixes[0]+topic]
 	for _, prefix := range topicPrefixes {
 		delete(c.subLive, prefix+topic)
 	}
 	c.subLock.Unlock()
 
+	// Release the dedicated handler pool (async, might be called from a handler)
+	go sub.terminate()
+
 	// Notify the carrier of the removal
 	for _, prefix := range topicPrefixes {
 		if err := c.iris.unsubscribe(c.id, prefix+topic); err != nil {
@@ -272,6 +736,26 @@ func (c *Connection) Tunnel(cluster string, timeout time.Duration) (*Tunnel, err
 	}
 }
 
+// Retrieves the number of members in an iris cluster. The count is eventually
+// consistent: it is aggregated through the carrier heartbeats, so recent joins
+// and departures might not be reflected yet.
+func (c *Connection) Members(cluster string) (int, error) {
+	return c.iris.size(clusterPrefixes[0] + cluster)
+}
+
+// Retrieves the number of subscriptions to a topic. The count is eventually
+// consistent: it is aggregated through the carrier heartbeats, so recent joins
+// and departures might not be reflected yet.
+func (c *Connection) TopicSize(topic string) (int, error) {
+	return c.iris.size(topicPrefixes[0] + topic)
+}
+
+// Retrieves a snapshot of the messaging statistics gathered since the connection
+// was established.
+func (c *Connection) Stats() *Stats {
+	return c.stats.snapshot()
+}
+
 // Closes the service aspect of the connection, but leave the client alive.
 func (c *Connection) Unregister() error {
 	if c.cluster != "" {
@@ -303,19 +787,27 @@ func (c *Connection) Close() error {
 	c.tunLock.Unlock()
 	closing.Wait()
 
-	// Remove all topic subscriptions
+	// Remove all topic subscriptions, terminating any dedicated handler pools
 	c.subLock.Lock()
-	for topic, _ := range c.subLive {
+	subs := make(map[*Subscription]struct{})
+	for topic, sub := range c.subLive {
 		c.iris.unsubscribe(c.id, topic)
+		subs[sub] = struct{}{}
 	}
 	c.subLock.Unlock()
 
+	for sub := range subs {
+		sub.terminate()
+	}
+
 	// Leave the cluster if it was a service connection
 	if err := c.Unregister(); err != nil {
 		return err
 	}
 	// Terminate the worker pool
+	c.workLock.RLock()
 	c.workers.Terminate(true)
+	c.workLock.RUnlock()
 
 	// Drop the connection from the tracked list
 	c.iris.lock.Lock()
@@ -22,9 +22,10 @@ package iris
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
-	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/proto"
@@ -33,6 +34,15 @@ import (
 // Implements proto.iris.ConnectionCallback.HandlePublish. Extracts the data from
 // the Iris envelope and calls the appropriate handler.
 func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message) {
+	// Drop messages already delivered locally through the fast path
+	if msg.Head.Meta.(*header).Local && src.Cmp(o.scribe.Self()) == 0 {
+		return
+	}
+	o.handlePublish(src, topic, msg)
+}
+
+// Delivers a published message to all the local subscribers of topic.
+func (o *Overlay) handlePublish(src *big.Int, topic string, msg *proto.Message) {
 	head := msg.Head.Meta.(*header)
 
 	// Fetch the message recipients
@@ -54,9 +64,14 @@ func (o *Overlay) HandlePublish(src *big.Int, topic string, msg *proto.Message)
 		conn := conns[i] // Closure
 		switch head.Op {
 		case opBcast:
-			conn.workers.Schedule(func() { conn.handleBroadcast(msg.Data) })
+			conn.schedule(func() { conn.handleBroadcast(src, head.Src, head.BcastId, head.BcastAck, msg.Data) })
+		case opReq:
+			// Replies are encrypted in place, make sure handlers don't share the request
+			req := make([]byte, len(msg.Data))
+			copy(req, msg.Data)
+			conn.scheduleRequest(src, head.Src, head.ReqId, req, head.ReqTime)
 		case opPub:
-			conn.workers.Schedule(func() { conn.handlePublish(topic, msg.Data) })
+			conn.scheduleEvent(topic, func() { conn.handlePublish(topic, head.Attrs, msg.Data) })
 		default:
 			log.Printf("iris: invalid publish opcode: %v.", head.Op)
 		}
@@ -76,15 +91,32 @@ func (o *Overlay) HandleBalance(src *big.Int, topic string, msg *proto.Message)
 		log.Printf("iris: non-existent topic: %v.", topic)
 		return
 	}
-	conn := o.conns[subs[rand.Intn(len(subs))]]
+	var conn *Connection
+	if head.ReqKey != "" {
+		conn = o.conns[affine(head.ReqKey, subs)]
+	} else if idx := o.pickMember(subs, head); idx >= 0 {
+		conn = o.conns[subs[idx]]
+	}
 	o.lock.RUnlock()
 
+	// A hedged duplicate only reached the member serving the original, fail it
+	if conn == nil {
+		o.direct(src, &proto.Message{
+			Head: proto.Header{Meta: &header{Op: opRep, Dest: head.Src, ReqId: head.ReqId, ReqFail: true}},
+			Data: []byte(ErrUnreachable.Error()),
+		})
+		return
+	}
 	// Balance to the chose one
 	switch head.Op {
 	case opReq:
-		conn.workers.Schedule(func() { conn.handleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime) })
+		if head.ReqHedge {
+			conn.scheduleHedgedRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime)
+		} else {
+			conn.scheduleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime)
+		}
 	case opTun:
-		conn.workers.Schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
+		conn.schedule(func() { conn.handleTunnelRequest(head.Src, head.TunId, head.TunKey, head.TunAddrs, head.TunTime) })
 	default:
 		log.Printf("iris: invalid balance opcode: %v.", head.Op)
 	}
@@ -100,63 +132,191 @@ func (o *Overlay) HandleDirect(src *big.Int, msg *proto.Message) {
 	conn, ok := o.conns[head.Dest]
 	o.lock.RUnlock()
 	if !ok {
+		// Fail member requests fast, the requester might retry elsewhere
+		if head.Op == opReq {
+			o.direct(src, &proto.Message{
+				Head: proto.Header{Meta: &header{Op: opRep, Dest: head.Src, ReqId: head.ReqId, ReqFail: true}},
+				Data: []byte(ErrMemberGone.Error()),
+			})
+			return
+		}
 		log.Printf("iris: non-existent direct recipient: %v", head.Dest)
 		return
 	}
-	// Pass the message to the connection to handle
+	// Pass the message to the connection to handle (non-blocking, skip the pools)
 	switch head.Op {
+	case opReq:
+		conn.scheduleRequest(src, head.Src, head.ReqId, msg.Data, head.ReqTime)
 	case opRep:
-		conn.workers.Schedule(func() { conn.handleReply(head.ReqId, head.ReqFail, msg.Data) })
+		conn.handleReply(src, head.Src, head.ReqId, head.ReqFail, msg.Data)
+	case opAck:
+		conn.handleBroadcastAck(head.BcastId)
+	case opClaim:
+		conn.handleClaim(src, head.Src, head.ReqId)
+	case opCancel:
+		conn.handleCancel(src, head.Src, head.ReqId)
 	default:
 		log.Printf("iris: invalid direct opcode: %v.", head.Op)
 	}
 }
 
-// Passes the broadcast message up to the application handler.
-func (c *Connection) handleBroadcast(msg []byte) {
-	c.handler.HandleBroadcast(msg)
+// Implements proto.scribe.ConnectionCallback.HandleBounce. Fails the request the
+// undeliverable message belonged to, sparing the requester the timeout.
+func (o *Overlay) HandleBounce(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	// Fetch the original sender
+	o.lock.RLock()
+	conn, ok := o.conns[head.Src]
+	o.lock.RUnlock()
+	if !ok {
+		return
+	}
+	switch head.Op {
+	case opReq:
+		conn.handleReply(o.scribe.Self(), 0, head.ReqId, true, []byte(ErrUnreachable.Error()))
+	default:
+		log.Printf("iris: undeliverable balance: %v.", head.Op)
+	}
+}
+
+// Passes the broadcast message up to the application handler. If the sender
+// requested delivery confirmation, a receipt is sent back after processing, but
+// only if the handler returned normally (a crashed one did not process it).
+func (c *Connection) handleBroadcast(srcNode *big.Int, srcConn uint64, bcastId uint64, confirm bool, msg []byte) {
+	c.stats.add(&c.stats.bcastRecv, 1)
+	perr := c.protect("HandleBroadcast", fmt.Sprintf("%d bytes", len(msg)), func() {
+		c.chainDeliver(&c.chains.inBcast, func(cluster string, msg []byte) {
+			c.handler.HandleBroadcast(msg)
+		})(c.cluster, msg)
+	})
+
+	if confirm && perr == nil {
+		c.iris.direct(srcNode, c.assembleBroadcastAck(srcConn, bcastId))
+	}
+}
+
+// Counts a receipt acknowledgement of a pending confirmed broadcast and notifies
+// the waiting sender. If the broadcast is not pending any more (i.e. finished),
+// the acknowledgement is silently dropped.
+func (c *Connection) handleBroadcastAck(bcastId uint64) {
+	c.ackLock.RLock()
+	receipt, ok := c.ackLive[bcastId]
+	c.ackLock.RUnlock()
+
+	if ok {
+		atomic.AddInt32(&receipt.acks, 1)
+		select {
+		case receipt.notify <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // Passes the request up to the application handler, also specifying the timeout
 // under which the reply must be sent back. Either a reply or a binding side
-// failure is forwarded to the remote node.
+// failure is forwarded to the remote node. Deferred handlers are only invoked
+// here, their reply being sent whenever they answer through the replier.
 func (c *Connection) handleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, msg []byte, timeout time.Duration) {
-	rep, err := c.handler.HandleRequest(msg, timeout)
-	if err == ErrTerminating || err == ErrTimeout {
+	var rep []byte
+	var err error
+
+	start := time.Now()
+	serve := c.handler.HandleRequest
+
+	var replier *Replier
+	if deferred, ok := c.handler.(DeferredHandler); ok {
+		replier = c.newReplier(srcNode, srcConn, reqId, timeout)
+		serve = func(req []byte, timeout time.Duration) ([]byte, error) {
+			deferred.HandleDeferredRequest(req, replier)
+			return nil, ErrDeferred
+		}
+	}
+	meta := fmt.Sprintf("request %d from %v:%d, %d bytes", reqId, srcNode, srcConn, len(msg))
+	if perr := c.protect("HandleRequest", meta, func() { rep, err = c.chainServe(serve)(msg, timeout) }); perr != nil {
+		rep, err = nil, perr
+	}
+	switch {
+	case err == ErrDeferred || err == ErrTerminating:
+		return
+	case err == ErrTimeout:
+		c.stats.add(&c.stats.timeouts, 1)
+		return
+	}
+	// Deferred handler crashed or was short circuited, answer through the replier
+	if replier != nil {
+		replier.send(rep, err)
 		return
 	}
-	c.iris.scribe.Direct(srcNode, c.assembleReply(srcConn, reqId, rep, err))
+	c.sendReply(srcNode, srcConn, reqId, rep, err, start)
+}
+
+// Forwards the reply or failure of a served request to the requester, updating
+// the serving statistics.
+func (c *Connection) sendReply(srcNode *big.Int, srcConn uint64, reqId uint64, rep []byte, err error, start time.Time) {
+	c.stats.serveLatency.record(time.Since(start))
+	if err != nil {
+		c.stats.add(&c.stats.failures, 1)
+	}
+	c.stats.add(&c.stats.reqServed, 1)
+	c.iris.direct(srcNode, c.assembleReply(srcConn, reqId, rep, err))
 }
 
 // Looks up the result channel for the pending request and inserts the reply. If
-// the channel doesn't exist any more the reply is silently dropped.
-func (c *Connection) handleReply(reqId uint64, failed bool, data []byte) {
+// the channel doesn't exist any more or is already full (i.e. scatter-gather
+// limit reached) the reply is silently dropped. Sticky requests are also told
+// the identity of the replier, before the reply itself.
+func (c *Connection) handleReply(srcNode *big.Int, srcConn uint64, reqId uint64, failed bool, data []byte) {
 	c.reqLock.RLock()
 	defer c.reqLock.RUnlock()
 
 	// Interpret the data as either a reply or a failure string
 	if !failed {
+		if srcc, ok := c.reqSrcs[reqId]; ok {
+			select {
+			case srcc <- &Member{node: srcNode, conn: srcConn}:
+			default:
+			}
+		}
 		if repc, ok := c.reqReps[reqId]; ok {
-			repc <- data
+			select {
+			case repc <- data:
+			default:
+			}
 		}
 	} else {
+		err := errors.New(string(data))
+		switch err.Error() {
+		case ErrMemberGone.Error():
+			err = ErrMemberGone
+		case ErrUnreachable.Error():
+			err = ErrUnreachable
+		}
 		if errc, ok := c.reqErrs[reqId]; ok {
-			errc <- errors.New(string(data))
+			select {
+			case errc <- err:
+			default:
+			}
 		}
 	}
 }
 
 // Delivers a topic event to a subscribed handler. If the subscription does not
 // exist the message is silently dropped.
-func (c *Connection) handlePublish(topic string, msg []byte) {
-	// Fetch the handler
+func (c *Connection) handlePublish(topic string, attrs map[string]string, msg []byte) {
+	// Fetch the subscription
 	c.subLock.RLock()
-	handler, ok := c.subLive[topic]
+	sub, ok := c.subLive[topic]
 	c.subLock.RUnlock()
 
-	// Deliver the event
-	if ok {
-		handler.HandleEvent(msg)
+	// Deliver the event (or buffer if paused) if the filter accepts it
+	if ok && sub.filter.Match(attrs) {
+		c.stats.add(&c.stats.pubRecv, 1)
+		c.protect("HandleEvent", fmt.Sprintf("topic %s, %d bytes", sub.Topic(), len(msg)), func() {
+			c.chainDeliver(&c.chains.inPub, func(topic string, msg []byte) {
+				sub.deliver(attrs, msg)
+			})(sub.Topic(), msg)
+		})
 	}
 }
 
@@ -172,21 +332,14 @@ func (c *Connection) handleTunnelRequest(conn uint64, id uint64, key []byte, add
 	if tun, err := c.buildTunnel(conn, id, key, addrs, timeout); err != nil {
 		log.Printf("iris: failed to accept tunnel: %v.", err)
 	} else {
-		c.handler.HandleTunnel(tun)
+		c.protect("HandleTunnel", fmt.Sprintf("tunnel %d from connection %d", id, conn), func() {
+			c.handler.HandleTunnel(tun)
+		})
 	}
 }
 
 // Removes a closing tunnel from the list and returns whether it existed or not.
 // This flag is required to prevent simultaneous double closes.
-func (c *Connection) handleTunnelClose(id uint64) bool {
-	c.tunLock.Lock()
-	defer c.tunLock.Unlock()
-
-	// Make sure the tunnel has not been removed yet
-	if _, ok := c.tunLive[id]; !ok {
-		return false
-	}
-	// Remove the tunnel from the active list
-	delete(c.tunLive, id)
-	return true
+func (c *Connection) handleTunnelClose(tun *Tunnel) bool {
+	return c.untrackTunnel(tun)
 }
@@ -0,0 +1,139 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the request hedging: a stalled request is duplicated to a second
+// member of the cluster. Members claim hedged requests on receipt, so that the
+// duplicate can avoid the member already serving the original, and the loser of
+// the two can be told to drop its copy if it did not start serving it yet.
+
+package iris
+
+import (
+	"math/big"
+	"math/rand"
+	"time"
+
+	"github.com/project-iris/iris/pool"
+)
+
+// Identity of a hedged request queued at a member.
+type hedgeId struct {
+	node string // Iris node of the requester
+	conn uint64 // Connection id of the requester
+	req  uint64 // Request id within the requester
+}
+
+// Sends the hedged duplicate of a request into a split cluster, avoiding the
+// member that claimed the original if known.
+func (c *Connection) sendHedge(split string, skip *Member, reqId uint64, req []byte, timeout time.Duration) {
+	if skip == nil {
+		c.sendRequest(split, "", reqId, req, timeout, true)
+		return
+	}
+	c.iris.scribe.BalanceExcept(split, skip.node, c.assembleHedgeRequest(reqId, skip, req, timeout))
+}
+
+// Tells every member that claimed a hedged request, other than the replier, to
+// drop its copy. Claims arriving in the meantime are collected too.
+func (c *Connection) cancelHedges(reqId uint64, replier *Member, claims []*Member, clmc chan *Member) {
+	for done := false; !done; {
+		select {
+		case claim := <-clmc:
+			claims = append(claims, claim)
+		default:
+			done = true
+		}
+	}
+	for _, claim := range claims {
+		if claim.conn != replier.conn || claim.node.Cmp(replier.node) != 0 {
+			c.iris.direct(claim.node, c.assembleCancel(claim.conn, reqId))
+		}
+	}
+}
+
+// Picks the recipient of a balanced request from the local members of a cluster,
+// avoiding the one the requester asked to skip. The index is -1 if the skipped
+// member is the only local one.
+func (o *Overlay) pickMember(subs []uint64, head *header) int {
+	idx := rand.Intn(len(subs))
+	if head.SkipNode == nil || subs[idx] != head.SkipConn || head.SkipNode.Cmp(o.scribe.Self()) != 0 {
+		return idx
+	}
+	if len(subs) == 1 {
+		return -1
+	}
+	return (idx + 1 + rand.Intn(len(subs)-1)) % len(subs)
+}
+
+// Schedules an inbound hedged request for handling similarly to scheduleRequest,
+// but claims it towards the requester first and keeps track of it until started,
+// so that it can be cancelled if the duplicate gets answered sooner.
+func (c *Connection) scheduleHedgedRequest(srcNode *big.Int, srcConn uint64, reqId uint64, req []byte, timeout time.Duration) {
+	id := hedgeId{srcNode.String(), srcConn, reqId}
+
+	c.hedgeLock.Lock()
+	c.hedgeLive[id] = false
+	c.hedgeLock.Unlock()
+
+	c.iris.direct(srcNode, c.assembleClaim(srcConn, reqId))
+
+	task := func() {
+		c.hedgeLock.Lock()
+		cancelled := c.hedgeLive[id]
+		delete(c.hedgeLive, id)
+		c.hedgeLock.Unlock()
+
+		if !cancelled {
+			c.handleRequest(srcNode, srcConn, reqId, req, timeout)
+		}
+	}
+	if err := c.schedule(task); err == pool.ErrFull {
+		c.hedgeLock.Lock()
+		delete(c.hedgeLive, id)
+		c.hedgeLock.Unlock()
+
+		c.iris.direct(srcNode, c.assembleReply(srcConn, reqId, nil, ErrOverloaded))
+	}
+}
+
+// Notifies a pending hedged request of a member claiming it. If the request is
+// not pending any more, the claim is silently dropped.
+func (c *Connection) handleClaim(srcNode *big.Int, srcConn uint64, reqId uint64) {
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
+
+	if clmc, ok := c.reqClms[reqId]; ok {
+		select {
+		case clmc <- &Member{node: srcNode, conn: srcConn}:
+		default:
+		}
+	}
+}
+
+// Flags a queued hedged request as cancelled, skipping it when its turn comes.
+// Requests already being served (or finished) are not affected.
+func (c *Connection) handleCancel(srcNode *big.Int, srcConn uint64, reqId uint64) {
+	id := hedgeId{srcNode.String(), srcConn, reqId}
+
+	c.hedgeLock.Lock()
+	defer c.hedgeLock.Unlock()
+
+	if _, ok := c.hedgeLive[id]; ok {
+		c.hedgeLive[id] = true
+	}
+}
@@ -0,0 +1,99 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the introspection of the carrier trees backing the clusters and the
+// topics, meant for debugging delivery problems in production.
+
+package iris
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Returned when inspecting a cluster or topic the local node takes no part in.
+var ErrNotParticipating = errors.New("not in topic tree")
+
+// Local node's view of one of the carrier trees backing a cluster or topic. The
+// member counts are eventually consistent, aggregated through the heartbeats.
+type Tree struct {
+	Parent   *big.Int   // Parent node in the tree (nil if the local node is the root)
+	Children []*big.Int // Direct children of the local node in the tree
+	Sizes    []int      // Approximate member counts behind each child (and the parent last)
+	Local    int        // Number of local members in the tree
+	Size     int        // Approximate number of members in the whole tree
+
+	Metrics []map[string]float64 // Summed custom metrics behind each child (and the parent last)
+	Totals  map[string]float64   // Summed custom metrics of the whole tree
+}
+
+// Local node's view of a cluster or topic, which is split into multiple carrier
+// trees. Trees not passing through the local node are nil.
+type TopicInfo struct {
+	Node  *big.Int // Carrier id of the local node
+	Trees []*Tree  // Views of the individual split trees
+}
+
+// Inspects the carrier trees of a topic around the local node, enumerating the
+// neighboring nodes, the approximate member counts and the summed custom metrics
+// behind them.
+func (c *Connection) InspectTopic(topic string) (*TopicInfo, error) {
+	return c.iris.inspect(topicPrefixes, topic)
+}
+
+// Inspects the carrier trees of a cluster around the local node, enumerating the
+// neighboring nodes, the approximate member counts and the summed custom metrics
+// behind them.
+func (c *Connection) InspectCluster(cluster string) (*TopicInfo, error) {
+	return c.iris.inspect(clusterPrefixes, cluster)
+}
+
+// Collects the local views of all the split trees of a cluster or topic.
+func (o *Overlay) inspect(prefixes []string, name string) (*TopicInfo, error) {
+	info := &TopicInfo{
+		Node:  o.scribe.Self(),
+		Trees: make([]*Tree, len(prefixes)),
+	}
+	found := false
+	for i, prefix := range prefixes {
+		snap, err := o.scribe.Inspect(prefix + name)
+		if err == scribe.ErrNotParticipating {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		tree := &Tree{
+			Parent:   snap.Parent,
+			Children: snap.Children,
+			Sizes:    snap.Sizes,
+			Size:     snap.Size,
+			Metrics:  snap.Metrics,
+			Totals:   snap.Totals,
+		}
+		if snap.Local {
+			tree.Local = snap.Weight
+		}
+		info.Trees[i], found = tree, true
+	}
+	if !found {
+		return nil, ErrNotParticipating
+	}
+	return info, nil
+}
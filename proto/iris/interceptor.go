@@ -0,0 +1,156 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the interceptor chains of a connection, allowing cross-cutting
+// concerns (authentication, tracing, metrics, etc.) to wrap the outbound
+// operations and the inbound deliveries without touching every handler.
+
+package iris
+
+import (
+	"sync"
+	"time"
+)
+
+// Outbound request operation, as issued by Connection.Request.
+type RequestFunc func(cluster string, req []byte, timeout time.Duration) ([]byte, error)
+
+// Inbound request handler, as implemented by ConnectionHandler.HandleRequest.
+type ServeFunc func(req []byte, timeout time.Duration) ([]byte, error)
+
+// Outbound message operation: a broadcast into a cluster or a publish into a
+// topic (any of the async, sync or confirmed variants).
+type SendFunc func(target string, msg []byte) error
+
+// Inbound message delivery: a broadcast to the local cluster member or an event
+// to a topic subscription.
+type DeliverFunc func(source string, msg []byte)
+
+// Interceptors wrap the next element of a chain, returning the wrapped version.
+// They may inspect or modify the messages, measure the inner call, or abort the
+// operation altogether by not calling next.
+type RequestInterceptor func(next RequestFunc) RequestFunc
+type ServeInterceptor func(next ServeFunc) ServeFunc
+type SendInterceptor func(next SendFunc) SendFunc
+type DeliverInterceptor func(next DeliverFunc) DeliverFunc
+
+// Interceptor chains registered on a connection.
+type interceptors struct {
+	outReq   []RequestInterceptor // Outbound request interceptors
+	inReq    []ServeInterceptor   // Inbound request interceptors
+	outBcast []SendInterceptor    // Outbound broadcast interceptors
+	inBcast  []DeliverInterceptor // Inbound broadcast interceptors
+	outPub   []SendInterceptor    // Outbound publish interceptors
+	inPub    []DeliverInterceptor // Inbound event interceptors
+
+	lock sync.RWMutex
+}
+
+// Registers an interceptor around the outbound requests (Request). Interceptors
+// are invoked in registration order, the first being the outermost.
+func (c *Connection) OnOutboundRequest(ic RequestInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.outReq = append(c.chains.outReq, ic)
+}
+
+// Registers an interceptor around the inbound requests passed to the handler.
+func (c *Connection) OnInboundRequest(ic ServeInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.inReq = append(c.chains.inReq, ic)
+}
+
+// Registers an interceptor around the outbound broadcasts (all variants).
+func (c *Connection) OnBroadcast(ic SendInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.outBcast = append(c.chains.outBcast, ic)
+}
+
+// Registers an interceptor around the inbound broadcasts passed to the handler.
+func (c *Connection) OnInboundBroadcast(ic DeliverInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.inBcast = append(c.chains.inBcast, ic)
+}
+
+// Registers an interceptor around the outbound publishes (all variants).
+func (c *Connection) OnPublish(ic SendInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.outPub = append(c.chains.outPub, ic)
+}
+
+// Registers an interceptor around the inbound events passed to subscriptions.
+// Events are intercepted upon arrival, even if the subscription is paused.
+func (c *Connection) OnEvent(ic DeliverInterceptor) {
+	c.chains.lock.Lock()
+	defer c.chains.lock.Unlock()
+
+	c.chains.inPub = append(c.chains.inPub, ic)
+}
+
+// Wraps an outbound request operation into the registered interceptors.
+func (c *Connection) chainRequest(op RequestFunc) RequestFunc {
+	c.chains.lock.RLock()
+	defer c.chains.lock.RUnlock()
+
+	for i := len(c.chains.outReq) - 1; i >= 0; i-- {
+		op = c.chains.outReq[i](op)
+	}
+	return op
+}
+
+// Wraps an inbound request handler into the registered interceptors.
+func (c *Connection) chainServe(op ServeFunc) ServeFunc {
+	c.chains.lock.RLock()
+	defer c.chains.lock.RUnlock()
+
+	for i := len(c.chains.inReq) - 1; i >= 0; i-- {
+		op = c.chains.inReq[i](op)
+	}
+	return op
+}
+
+// Wraps an outbound broadcast or publish operation into the given interceptors.
+func (c *Connection) chainSend(chain *[]SendInterceptor, op SendFunc) SendFunc {
+	c.chains.lock.RLock()
+	defer c.chains.lock.RUnlock()
+
+	for i := len(*chain) - 1; i >= 0; i-- {
+		op = (*chain)[i](op)
+	}
+	return op
+}
+
+// Wraps an inbound broadcast or event delivery into the given interceptors.
+func (c *Connection) chainDeliver(chain *[]DeliverInterceptor, op DeliverFunc) DeliverFunc {
+	c.chains.lock.RLock()
+	defer c.chains.lock.RUnlock()
+
+	for i := len(*chain) - 1; i >= 0; i-- {
+		op = (*chain)[i](op)
+	}
+	return op
+}
@@ -0,0 +1,158 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestInterceptors(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a request and a broadcast service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("interceptor-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	reqConn, err := node.Connect("interceptor-req", &requester{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer reqConn.Close()
+
+	bcastHand := &broadcaster{make(chan []byte, 1)}
+	bcastConn, err := node.Connect("interceptor-bcast", bcastHand)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer bcastConn.Close()
+
+	// Tag outbound requests in registration order, and verify them inbound
+	tagger := func(tag byte) RequestInterceptor {
+		return func(next RequestFunc) RequestFunc {
+			return func(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+				return next(cluster, append(req, tag), timeout)
+			}
+		}
+	}
+	reqConn.OnOutboundRequest(tagger(1))
+	reqConn.OnOutboundRequest(tagger(2))
+
+	blocked := errors.New("blocked")
+	reqConn.OnOutboundRequest(func(next RequestFunc) RequestFunc {
+		return func(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+			if cluster == "interceptor-blocked" {
+				return nil, blocked
+			}
+			return next(cluster, req, timeout)
+		}
+	})
+	reqConn.OnInboundRequest(func(next ServeFunc) ServeFunc {
+		return func(req []byte, timeout time.Duration) ([]byte, error) {
+			if !bytes.Equal(req, []byte{0, 1, 2}) {
+				return nil, errors.New("unauthorized")
+			}
+			return next(req, timeout)
+		}
+	})
+	if rep, err := reqConn.Request("interceptor-req", []byte{0}, time.Second); err != nil || !bytes.Equal(rep, []byte{0, 1, 2}) {
+		t.Fatalf("intercepted request mismatch: have %v/%v, want %v/nil.", rep, err, []byte{0, 1, 2})
+	}
+	if _, err := reqConn.Request("interceptor-blocked", []byte{0}, time.Second); err != blocked {
+		t.Fatalf("aborted request mismatch: have %v, want %v.", err, blocked)
+	}
+	// Rewrite outbound broadcasts and count the inbound ones
+	bcastConn.OnBroadcast(func(next SendFunc) SendFunc {
+		return func(cluster string, msg []byte) error {
+			return next(cluster, bytes.ToUpper(msg))
+		}
+	})
+	inbound := 0
+	bcastConn.OnInboundBroadcast(func(next DeliverFunc) DeliverFunc {
+		return func(cluster string, msg []byte) {
+			if cluster == "interceptor-bcast" {
+				inbound++
+			}
+			next(cluster, msg)
+		}
+	})
+	if err := bcastConn.BroadcastSync("interceptor-bcast", []byte("hello"), time.Second); err != nil {
+		t.Fatalf("failed to broadcast: %v.", err)
+	}
+	select {
+	case msg := <-bcastHand.msgs:
+		if string(msg) != "HELLO" || inbound != 1 {
+			t.Fatalf("intercepted broadcast mismatch: have %s/%d, want HELLO/1.", msg, inbound)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("intercepted broadcast not delivered.")
+	}
+	// Drop outbound publishes of a topic and rewrite the inbound events
+	bcastConn.OnPublish(func(next SendFunc) SendFunc {
+		return func(topic string, msg []byte) error {
+			if topic == "interceptor-muted" {
+				return nil
+			}
+			return next(topic, msg)
+		}
+	})
+	bcastConn.OnEvent(func(next DeliverFunc) DeliverFunc {
+		return func(topic string, msg []byte) {
+			next(topic, append([]byte(topic+":"), msg...))
+		}
+	})
+	subHand := &subscriber{make(chan []byte, 2)}
+	for _, topic := range []string{"interceptor-muted", "interceptor-topic"} {
+		if err := bcastConn.Subscribe(topic, subHand); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, topic := range []string{"interceptor-muted", "interceptor-topic"} {
+		if err := bcastConn.Publish(topic, []byte("event")); err != nil {
+			t.Fatalf("failed to publish event: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(subHand.msgs); n != 1 {
+		t.Fatalf("intercepted event count mismatch: have %d, want %d.", n, 1)
+	}
+	if msg := <-subHand.msgs; string(msg) != "interceptor-topic:event" {
+		t.Fatalf("intercepted event mismatch: have %s, want %s.", msg, "interceptor-topic:event")
+	}
+}
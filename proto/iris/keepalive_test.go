@@ -0,0 +1,84 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe"
+)
+
+// Tests that the subscriptions of a connection whose owner stopped signalling
+// liveness are reclaimed by the carrier even if the connection is never closed,
+// whereas connections not tracking liveness keep theirs.
+func TestKeepaliveCrash(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	oldLease := config.ScribeTopicLease
+	config.ScribeTopicLease = time.Second
+	defer func() { config.ScribeTopicLease = oldLease }()
+
+	// Boot a single iris overlay
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("keepalive-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	// Connect a tracked service that crashes (never closed) and an untracked one
+	crashed, err := node.Connect("keepalive-crashed", &requester{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	crashed.Keepalive()
+
+	live, err := node.Connect("keepalive-live", &requester{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := live.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Wait for a few leases to pass and ensure only the crashed one was reclaimed
+	time.Sleep(3 * config.ScribeTopicLease)
+
+	for _, prefix := range clusterPrefixes {
+		if err := node.scribe.Renew(prefix + "keepalive-crashed"); err != scribe.ErrNotParticipating {
+			t.Fatalf("crashed lease renewal mismatch: have %v, want %v.", err, scribe.ErrNotParticipating)
+		}
+		if err := node.scribe.Renew(prefix + "keepalive-live"); err != nil {
+			t.Fatalf("failed to renew live lease: %v.", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the reply latency reporting of the local members, consumed by the
+// latency adaptive balancers to bias requests toward the faster responders.
+
+package iris
+
+import (
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Averages the recent median request serving times of the local members of a
+// carrier topic, or returns zero if none served requests yet.
+func (o *Overlay) latency(topic string) time.Duration {
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.subLive[topic]))
+	for _, id := range o.subLive[topic] {
+		if conn, ok := o.conns[id]; ok {
+			conns = append(conns, conn)
+		}
+	}
+	o.lock.RUnlock()
+
+	total, count := time.Duration(0), 0
+	for _, conn := range conns {
+		if lat := conn.stats.serveLatency.recent(config.IrisLatencyWindow); lat > 0 {
+			total += lat
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
@@ -0,0 +1,149 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the outbound rate limiting of connections, preventing a single
+// misbehaving application from starving the shared overlay links. Outbound
+// carrier traffic is also held back while the local carrier node is congested.
+
+package iris
+
+import (
+	"errors"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/throttle"
+)
+
+// Returned by outbound operations exceeding the rate limits in non-blocking mode.
+var ErrThrottled = errors.New("rate limit exceeded")
+
+// Outbound rate limits of a connection. Zero values mean unlimited.
+type Limits struct {
+	Requests  float64 // Maximum number of requests issued per second
+	Publishes float64 // Maximum number of publishes and broadcasts issued per second
+	Bytes     float64 // Maximum number of payload bytes sent per second (tunnels included)
+	Block     bool    // Whether to block until permitted instead of failing with ErrThrottled
+}
+
+// Set of token buckets enforcing the configured limits.
+type limiter struct {
+	reqs  *throttle.Limiter // Request rate limiter (nil if unlimited)
+	pubs  *throttle.Limiter // Publish and broadcast rate limiter (nil if unlimited)
+	bytes *throttle.Limiter // Outbound bandwidth limiter (nil if unlimited)
+	block bool              // Whether to block or fail when throttled
+}
+
+// Creates the token buckets for a set of limits.
+func newLimiter(limits *Limits) *limiter {
+	l := &limiter{block: limits.Block}
+	if limits.Requests > 0 {
+		l.reqs = throttle.New(limits.Requests, 0)
+	}
+	if limits.Publishes > 0 {
+		l.pubs = throttle.New(limits.Publishes, 0)
+	}
+	if limits.Bytes > 0 {
+		l.bytes = throttle.New(limits.Bytes, 0)
+	}
+	return l
+}
+
+// Sets the outbound rate limits of the connection, replacing any previous ones.
+func (c *Connection) SetLimits(limits Limits) {
+	c.limitLock.Lock()
+	defer c.limitLock.Unlock()
+
+	c.limits = newLimiter(&limits)
+}
+
+// Waits until the local carrier node lifts its backpressure, failing with
+// ErrThrottled if it does not within the configured timeout.
+func (c *Connection) awaitRelief() error {
+	relief := c.iris.scribe.Relief()
+	select {
+	case <-relief:
+		return nil
+	default:
+	}
+	c.stats.add(&c.stats.pressured, 1)
+
+	select {
+	case <-relief:
+		return nil
+	case <-c.term:
+		return ErrTerminating
+	case <-time.After(config.IrisPressureTimeout):
+		return ErrThrottled
+	}
+}
+
+// Enforces the request limits on an outbound request of a given size.
+func (c *Connection) throttleRequest(size int) error {
+	if err := c.awaitRelief(); err != nil {
+		return err
+	}
+	c.limitLock.RLock()
+	l := c.limits
+	c.limitLock.RUnlock()
+
+	return c.throttle(l, l.reqs, size)
+}
+
+// Enforces the publish limits on an outbound publish or broadcast of a given size.
+func (c *Connection) throttlePublish(size int) error {
+	if err := c.awaitRelief(); err != nil {
+		return err
+	}
+	c.limitLock.RLock()
+	l := c.limits
+	c.limitLock.RUnlock()
+
+	return c.throttle(l, l.pubs, size)
+}
+
+// Enforces the bandwidth limits on an outbound tunnel transfer of a given size.
+func (c *Connection) throttleBytes(size int) error {
+	c.limitLock.RLock()
+	l := c.limits
+	c.limitLock.RUnlock()
+
+	return c.throttle(l, nil, size)
+}
+
+// Takes a single token from the operation bucket and size tokens from the byte
+// bucket, either blocking until permitted or failing with ErrThrottled. Tokens
+// are never taken from one bucket if the other denies (or the wait is aborted).
+func (c *Connection) throttle(l *limiter, ops *throttle.Limiter, size int) error {
+	if l.block {
+		if ops != nil && !ops.Wait(1, c.term) {
+			return ErrTerminating
+		}
+		if l.bytes != nil && !l.bytes.Wait(size, c.term) {
+			if ops != nil {
+				ops.Refund(1)
+			}
+			return ErrTerminating
+		}
+		return nil
+	}
+	if !throttle.AllowAll([]*throttle.Limiter{ops, l.bytes}, []int{1, size}) {
+		return ErrThrottled
+	}
+	return nil
+}
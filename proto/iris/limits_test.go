@@ -0,0 +1,94 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestLimits(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect an echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("limits-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("limits-test", &requester{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Limit the request rate in failing mode and make sure excess is rejected
+	conn.SetLimits(Limits{Requests: 10})
+
+	passed, throttled := 0, 0
+	for i := 0; i < 20; i++ {
+		switch _, err := conn.Request("limits-test", []byte{0}, time.Second); err {
+		case nil:
+			passed++
+		case ErrThrottled:
+			throttled++
+		default:
+			t.Fatalf("failed to execute request: %v.", err)
+		}
+	}
+	if passed < 10 || throttled == 0 {
+		t.Fatalf("throttling mismatch: %d passed, %d throttled.", passed, throttled)
+	}
+	// Limit the publish rate in blocking mode and make sure it's paced
+	conn.SetLimits(Limits{Publishes: 100, Block: true})
+
+	start := time.Now()
+	for i := 0; i < 150; i++ {
+		if err := conn.Publish("limits-test-topic", []byte{0}); err != nil {
+			t.Fatalf("failed to publish message: %v.", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Fatalf("publishes finished too fast: have %v, want >= %v.", elapsed, 500*time.Millisecond)
+	}
+	// Remove the limits and make sure nothing's throttled
+	conn.SetLimits(Limits{})
+	for i := 0; i < 20; i++ {
+		if _, err := conn.Request("limits-test", []byte{0}, time.Second); err != nil {
+			t.Fatalf("failed to execute unlimited request: %v.", err)
+		}
+	}
+}
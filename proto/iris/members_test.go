@@ -0,0 +1,140 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Individual membership tests.
+func TestMembersSingleNode(t *testing.T) {
+	testMembers(t, 1, 5)
+}
+
+func TestMembersMultiNode(t *testing.T) {
+	testMembers(t, 5, 2)
+}
+
+// Tests the eventually consistent cluster and topic member counts.
+func testMembers(t *testing.T, nodes, conns int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New("members-test", key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to all nodes and subscribe to a topic with every connection
+	liveConns := []*Connection{}
+	for _, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			conn, err := node.Connect("members-test", &broadcaster{})
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			defer conn.Close()
+
+			if err := conn.Subscribe("members-topic", &subscriber{}); err != nil {
+				t.Fatalf("failed to subscribe to topic: %v.", err)
+			}
+			liveConns = append(liveConns, conn)
+		}
+	}
+	// Wait until the counts converge on all connections
+	check := func(cluster, topic string, members, subs int) {
+		var haveMembers, haveSubs int
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(250 * time.Millisecond) {
+			done := true
+			for _, conn := range liveConns {
+				var err error
+				if haveMembers, err = conn.Members(cluster); err != nil {
+					t.Fatalf("failed to retrieve cluster members: %v.", err)
+				}
+				if haveSubs, err = conn.TopicSize(topic); err != nil {
+					t.Fatalf("failed to retrieve topic size: %v.", err)
+				}
+				if haveMembers != members || haveSubs != subs {
+					done = false
+					break
+				}
+			}
+			if done {
+				return
+			}
+		}
+		t.Fatalf("member counts mismatch: have %v/%v, want %v/%v.", haveMembers, haveSubs, members, subs)
+	}
+	check("members-test", "members-topic", nodes*conns, nodes*conns)
+
+	// Inspect the topic trees and verify the local views
+	for _, conn := range liveConns {
+		info, err := conn.InspectTopic("members-topic")
+		if err != nil {
+			t.Fatalf("failed to inspect topic: %v.", err)
+		}
+		for i, tree := range info.Trees {
+			if tree == nil {
+				t.Fatalf("topic tree %d missing from member node.", i)
+			}
+			if tree.Local != conns {
+				t.Fatalf("local member count mismatch: have %v, want %v.", tree.Local, conns)
+			}
+			neighbors := len(tree.Children)
+			if tree.Parent != nil {
+				neighbors++
+			}
+			if len(tree.Sizes) != neighbors {
+				t.Fatalf("neighbor size count mismatch: have %v, want %v.", len(tree.Sizes), neighbors)
+			}
+		}
+	}
+	if _, err := liveConns[0].InspectTopic("members-topic-missing"); err != ErrNotParticipating {
+		t.Fatalf("missing topic inspection mismatch: have %v, want %v.", err, ErrNotParticipating)
+	}
+	// Unsubscribe a connection and check that the counts follow
+	if err := liveConns[0].Unsubscribe("members-topic"); err != nil {
+		t.Fatalf("failed to unsubscribe from topic: %v.", err)
+	}
+	check("members-test", "members-topic", nodes*conns, nodes*conns-1)
+
+	// Check that unknown groups report zero members
+	check("members-test-missing", "members-topic-missing", 0, 0)
+}
@@ -0,0 +1,66 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the custom load metrics of the connections, which are attached to
+// the carrier load reports and summed up along the cluster and topic trees.
+
+package iris
+
+// Sets a callback reporting custom application metrics (e.g. open database
+// connections, shard count) of the connection. The callback is polled on every
+// load report round and the values are summed up across all the members of the
+// clusters and topics the connection takes part in. A nil callback stops the
+// reporting.
+func (c *Connection) SetMetrics(probe func() map[string]float64) {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+
+	c.metrics = probe
+}
+
+// Queries the custom metrics callback of the connection, if any.
+func (c *Connection) collectMetrics() map[string]float64 {
+	c.metricsLock.RLock()
+	probe := c.metrics
+	c.metricsLock.RUnlock()
+
+	if probe == nil {
+		return nil
+	}
+	return probe()
+}
+
+// Sums up the custom metrics of the local members of a carrier topic.
+func (o *Overlay) metrics(topic string) map[string]float64 {
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.subLive[topic]))
+	for _, id := range o.subLive[topic] {
+		if conn, ok := o.conns[id]; ok {
+			conns = append(conns, conn)
+		}
+	}
+	o.lock.RUnlock()
+
+	sums := make(map[string]float64)
+	for _, conn := range conns {
+		for name, value := range conn.collectMetrics() {
+			sums[name] += value
+		}
+	}
+	return sums
+}
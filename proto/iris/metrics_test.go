@@ -0,0 +1,87 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the custom connection metrics are summed up along the cluster trees.
+func TestMetrics(t *testing.T) {
+	nodes := 3
+
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot the iris overlays and register a metered member on each
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New("metrics-test", key)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(node)
+
+		conn, err := node.Connect("metrics-test", &broadcaster{})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		shards := float64(i + 1)
+		conn.SetMetrics(func() map[string]float64 {
+			return map[string]float64{"shards": shards}
+		})
+		liveConns[i] = conn
+	}
+	// Wait a few report rounds and check the totals from each node's view
+	time.Sleep(2 * time.Second)
+
+	for i, conn := range liveConns {
+		info, err := conn.InspectCluster("metrics-test")
+		if err != nil {
+			t.Fatalf("conn %d: failed to inspect cluster: %v.", i, err)
+		}
+		for j, tree := range info.Trees {
+			if tree == nil {
+				t.Fatalf("conn %d: tree %d missing.", i, j)
+			}
+			if have := tree.Totals["shards"]; have != 6 {
+				t.Fatalf("conn %d: tree %d: metric total mismatch: have %v, want %v.", i, j, have, 6)
+			}
+		}
+	}
+}
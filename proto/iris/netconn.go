@@ -0,0 +1,180 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the net.Conn implementation of the tunnels, allowing stream based
+// protocols to be layered directly on top of them.
+
+package iris
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Make sure tunnels satisfy the standard stream connection interfaces.
+var _ net.Conn = (*Tunnel)(nil)
+var _ io.ReadWriteCloser = (*Tunnel)(nil)
+
+// Timeout error satisfying net.Error, so stream protocols layered on top of
+// tunnels can detect deadline expirations.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Network address of an in-process tunnel endpoint.
+type tunnelAddr struct {
+	conn uint64 // Id of the owning connection
+	tun  uint64 // Id of the tunnel within the connection
+}
+
+// Implements net.Addr.Network.
+func (a *tunnelAddr) Network() string {
+	return "iris"
+}
+
+// Implements net.Addr.String.
+func (a *tunnelAddr) String() string {
+	return fmt.Sprintf("%d/%d", a.conn, a.tun)
+}
+
+// Implements io.Reader. Message boundaries are not preserved, chunks are read
+// as a continuous byte stream. A closed tunnel is reported as io.EOF.
+func (t *Tunnel) Read(p []byte) (int, error) {
+	t.readLock.Lock()
+	defer t.readLock.Unlock()
+
+	// Fetch a new chunk if the leftovers were consumed
+	for len(t.readBuf) == 0 {
+		_, chunk, err := t.recv(&t.readDead)
+		if err == ErrTerminating {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		t.readBuf = chunk
+	}
+	n := copy(p, t.readBuf)
+	t.readBuf = t.readBuf[n:]
+	return n, nil
+}
+
+// Implements io.Writer. The data is copied and sent as a single chunk, since the
+// tunnel encrypts its messages in place.
+func (t *Tunnel) Write(p []byte) (int, error) {
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	if err := t.send(len(chunk), chunk, &t.writeDead); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Implements net.Conn.LocalAddr.
+func (t *Tunnel) LocalAddr() net.Addr {
+	if t.conn != nil {
+		return t.conn.Sock().LocalAddr()
+	}
+	return &tunnelAddr{t.owner.id, t.id}
+}
+
+// Implements net.Conn.RemoteAddr.
+func (t *Tunnel) RemoteAddr() net.Addr {
+	if t.conn != nil {
+		return t.conn.Sock().RemoteAddr()
+	}
+	return &tunnelAddr{t.peer.owner.id, t.peer.id}
+}
+
+// Implements net.Conn.SetDeadline. Reads and writes already blocked are woken
+// to re-evaluate the new deadline.
+func (t *Tunnel) SetDeadline(deadline time.Time) error {
+	t.readDead.set(deadline)
+	t.writeDead.set(deadline)
+	return nil
+}
+
+// Implements net.Conn.SetReadDeadline.
+func (t *Tunnel) SetReadDeadline(deadline time.Time) error {
+	t.readDead.set(deadline)
+	return nil
+}
+
+// Implements net.Conn.SetWriteDeadline.
+func (t *Tunnel) SetWriteDeadline(deadline time.Time) error {
+	t.writeDead.set(deadline)
+	return nil
+}
+
+// Deadline of a tunnel stream direction. Every change closes (and replaces) the
+// notification channel, waking the blocked operations to re-evaluate it.
+type deadline struct {
+	when   time.Time     // Time of expiration (zero = none)
+	notify chan struct{} // Channel closed when the deadline changes
+	lock   sync.Mutex    // Lock protecting the deadline
+}
+
+// Timer firing on a deadline, nil-safe to allow waiting on no deadline at all.
+type deadTimer struct {
+	C     <-chan time.Time
+	timer *time.Timer
+}
+
+// Updates the deadline, waking any operation blocked on the old one.
+func (d *deadline) set(when time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.when = when
+	if d.notify != nil {
+		close(d.notify)
+		d.notify = nil
+	}
+}
+
+// Retrieves a timer firing on the current deadline (never if unset) and the
+// channel notifying of its change. A nil deadline never fires nor changes.
+func (d *deadline) watch() (*deadTimer, <-chan struct{}) {
+	timer := new(deadTimer)
+	if d == nil {
+		return timer, nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.notify == nil {
+		d.notify = make(chan struct{})
+	}
+	if !d.when.IsZero() {
+		timer.timer = time.NewTimer(d.when.Sub(time.Now()))
+		timer.C = timer.timer.C
+	}
+	return timer, d.notify
+}
+
+// Releases the resources of the timer, if any.
+func (t *deadTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
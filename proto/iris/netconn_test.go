@@ -0,0 +1,142 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection handler echoing back tunnel streams.
+type streamer struct{}
+
+func (s *streamer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to stream handler")
+}
+
+func (s *streamer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Request passed to stream handler")
+}
+
+func (s *streamer) HandleTunnel(tun *Tunnel) {
+	io.Copy(tun, tun)
+	tun.Close()
+}
+
+func TestTunnelNetConn(t *testing.T) {
+	testTunnelNetConn(t)
+}
+
+func TestTunnelNetConnLocalFastPath(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testTunnelNetConn(t)
+}
+
+// Tests that tunnels can be used as stream based network connections.
+func testTunnelNetConn(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a stream echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("netconn-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("netconn-test", &streamer{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	tun, err := conn.Tunnel("netconn-test", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	var stream net.Conn = tun
+
+	if stream.LocalAddr() == nil || stream.RemoteAddr() == nil {
+		t.Fatalf("missing tunnel addresses: local %v, remote %v.", stream.LocalAddr(), stream.RemoteAddr())
+	}
+	// Stream some data through and read it back in differently sized pieces
+	orig := []byte("the quick brown fox jumps over the lazy dog")
+	for i := 0; i < 3; i++ {
+		if n, err := stream.Write(orig); err != nil || n != len(orig) {
+			t.Fatalf("failed to write stream: %d, %v.", n, err)
+		}
+	}
+	back := make([]byte, 3*len(orig))
+	if _, err := io.ReadFull(stream, back[:5]); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	}
+	if _, err := io.ReadFull(stream, back[5:]); err != nil {
+		t.Fatalf("failed to read stream: %v.", err)
+	}
+	if !bytes.Equal(back, bytes.Repeat(orig, 3)) {
+		t.Fatalf("stream mismatch: have %q, want %q.", back, bytes.Repeat(orig, 3))
+	}
+	// Make sure read deadlines are honored with network timeout errors
+	stream.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := stream.Read(back); err == nil {
+		t.Fatalf("read succeeded past deadline.")
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("deadline error mismatch: have %v, want network timeout.", err)
+	}
+	// Make sure deadline changes wake up already blocked reads
+	stream.SetReadDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(back)
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	stream.SetReadDeadline(time.Now())
+	select {
+	case err := <-errc:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("deadline error mismatch: have %v, want network timeout.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked read not woken by deadline change.")
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("failed to close stream: %v.", err)
+	}
+}
@@ -23,22 +23,42 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"log"
+	"math/big"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/bootstrap"
+	"github.com/project-iris/iris/proto/overlay"
 	"github.com/project-iris/iris/proto/scribe"
 )
 
+// Local state of a carrier topic, shared and reference counted by all the local
+// connections subscribed to it. Only the first of them joins the carrier topic
+// and only the last one leaves it, so the carrier state (tree links, heartbeats,
+// load reports, leases) is maintained once per node, not once per connection.
+type membership struct {
+	refs    int               // Number of local connections subscribed to the topic
+	filters map[uint64]string // Event filters of the live members (if any)
+
+	joined bool       // Flag whether the carrier topic is currently joined
+	lock   sync.Mutex // Serializes the carrier joins and leaves of the topic
+}
+
 // The overlay implementation, receiving the overlay events and processing
 // them according to the iris protocol.
 type Overlay struct {
-	scribe *scribe.Overlay // Overlay network to route the messages with
+	scribe  *scribe.Overlay   // Overlay network to route the messages with
+	virtual []*scribe.Overlay // Extra virtual nodes sharing the routing and rendezvous load
 
 	autoid uint64                 // Id to assign to the next connection
 	conns  map[uint64]*Connection // Live client connections
 
-	subLive map[string][]uint64     // Live members of each subscribed topic
-	subLock map[string]sync.RWMutex // Locks protecting the individual topics
+	subLive map[string][]uint64    // Live members of each subscribed topic
+	subRefs map[string]*membership // Shared carrier state of each subscribed topic
 
 	tunAddrs []string          // Listener addresses for the tunnel endpoints
 	tunQuits []chan chan error // Quit channels for the tunnel acceptors
@@ -53,19 +73,77 @@ func New(overId string, key *rsa.PrivateKey) *Overlay {
 		autoid:  1, // Zero's a special case with gob, skip it
 		conns:   make(map[uint64]*Connection),
 		subLive: make(map[string][]uint64),
-		subLock: make(map[string]sync.RWMutex),
+		subRefs: make(map[string]*membership),
+	}
+	o.scribe = o.carrier(overId, key)
+	o.scribe.SetLoadProbe(o.backlog)
+	o.scribe.SetMetricsProbe(o.metrics)
+	o.scribe.SetLatencyProbe(o.latency)
+	o.scribe.SetLeaseProbe(o.leased)
+
+	// Host additional virtual nodes to take over a larger share of the id space.
+	// These only route and root carrier trees, all local members join through the
+	// primary node above (hence no member probes on them).
+	for i := 1; i < config.IrisVirtualNodes; i++ {
+		node := o.carrier(overId, key)
+		if config.PastryIdentitySeed != "" {
+			// Each virtual node derives its own identity (before a persisted one is adopted)
+			node.SetIdentitySeed(fmt.Sprintf("%s.%d", config.PastryIdentitySeed, i))
+		}
+		if config.PastryStateFile != "" {
+			// Each virtual node persists its own peers and identity
+			if err := node.SetStateFile(fmt.Sprintf("%s.%d", config.PastryStateFile, i)); err != nil {
+				log.Printf("iris: failed to set virtual node state file: %v.", err)
+			}
+		}
+		o.virtual = append(o.virtual, node)
 	}
-	o.scribe = scribe.New(overId, key, o)
 	return o
 }
 
+// Creates a carrier node with the topic layout of the iris protocol.
+func (o *Overlay) carrier(overId string, key *rsa.PrivateKey) *scribe.Overlay {
+	node := scribe.New(overId, key, o)
+	for _, prefix := range topicPrefixes {
+		node.SetHierarchical(prefix)
+		if err := node.SetSharded(prefix, config.IrisTopicShards); err != nil {
+			log.Printf("iris: failed to shard topics: %v.", err)
+		}
+	}
+	return node
+}
+
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
+	// Make sure tunnel acknowledgements are sent before the send window fills up
+	if config.IrisTunnelAckInterval < 1 || config.IrisTunnelAckInterval > config.IrisTunnelBuffer {
+		return 0, fmt.Errorf("tunnel ack interval %d outside [1, %d]", config.IrisTunnelAckInterval, config.IrisTunnelBuffer)
+	}
+	// Make sure every hosted node can run a bootstrapper
+	if nodes, free := 1+len(o.virtual), bootstrap.Available(); nodes > free {
+		return 0, fmt.Errorf("not enough bootstrap ports for %d virtual nodes: %d free", nodes, free)
+	}
 	// Boot the underlay and wait until it converges
 	peers, err := o.scribe.Boot()
 	if err != nil {
 		return 0, err
 	}
+	// Boot the virtual nodes concurrently into the converged underlay
+	errc := make(chan error, len(o.virtual))
+	for _, node := range o.virtual {
+		go func(node *scribe.Overlay) {
+			_, err := node.Boot()
+			errc <- err
+		}(node)
+	}
+	for i := 0; i < len(o.virtual); i++ {
+		if verr := <-errc; verr != nil && err == nil {
+			err = verr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
 	// Start a tunnel acceptor on each network interface
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -83,8 +161,8 @@ func (o *Overlay) Boot() (int, error) {
 			log.Printf("iris: unknown interface address type for: %v.", addr)
 			continue
 		}
-		// Start the tunnel acceptor on non-localhost IPv4 networks
-		if !ip.IsLoopback() && ip.To4() != nil {
+		// Start the tunnel acceptor on the networks the overlay listens on too
+		if overlay.Listenable(ip) {
 			// Create a quit channel
 			quit := make(chan chan error)
 			o.tunQuits = append(o.tunQuits, quit)
@@ -112,7 +190,12 @@ func (o *Overlay) Shutdown() error {
 			errs = append(errs, err)
 		}
 	}
-	// Terminate the scribe underlay
+	// Terminate the virtual nodes and the scribe underlay
+	for _, node := range o.virtual {
+		if err := node.Shutdown(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if err := o.scribe.Shutdown(); err != nil {
 		errs = append(errs, err)
 	}
@@ -127,39 +210,147 @@ func (o *Overlay) Shutdown() error {
 	}
 }
 
-// Subscribes to a new topic, or adds the current connection to the list of live
-// subscriptions.
-func (o *Overlay) subscribe(id uint64, topic string) error {
-	cascade := false
+// Retrieves the timing parameters of the carrier maintenance.
+func (o *Overlay) Timing() scribe.Timing {
+	return o.scribe.Timing()
+}
+
+// Tunes the timing parameters of the carrier maintenance at runtime, e.g. to
+// relax the heartbeats of clusters spanning wide area networks.
+func (o *Overlay) SetTiming(timing scribe.Timing) error {
+	for _, node := range o.virtual {
+		if err := node.SetTiming(timing); err != nil {
+			return err
+		}
+	}
+	return o.scribe.SetTiming(timing)
+}
+
+// Retrieves the number of standby replicas of the locally rooted carrier trees.
+func (o *Overlay) Replicas() int {
+	return o.scribe.Replicas()
+}
+
+// Sets the number of standby replicas of the locally rooted carrier trees at
+// runtime (see scribe.Overlay.SetReplicas).
+func (o *Overlay) SetReplicas(factor int) error {
+	for _, node := range o.virtual {
+		if err := node.SetReplicas(factor); err != nil {
+			return err
+		}
+	}
+	return o.scribe.SetReplicas(factor)
+}
+
+// Retrieves the carrier ids of all the nodes hosted by the overlay, the primary
+// one (through which the local members join) first, the virtual ones after.
+func (o *Overlay) Nodes() []*big.Int {
+	ids := []*big.Int{o.scribe.Self()}
+	for _, node := range o.virtual {
+		ids = append(ids, node.Self())
+	}
+	return ids
+}
+
+// Exports the overlay graph as seen by all the nodes hosted by the overlay, for
+// cluster-wide topology visualization.
+func (o *Overlay) Topology() *overlay.Topology {
+	snaps := []*overlay.Snapshot{o.scribe.Routing()}
+	for _, node := range o.virtual {
+		snaps = append(snaps, node.Routing())
+	}
+	return overlay.NewTopology(snaps...)
+}
+
+// Reports the convergence status of the primary node, ready only if all the
+// hosted nodes are (suitable for wiring into orchestration readiness probes).
+func (o *Overlay) Status() *overlay.Status {
+	status := o.scribe.Status()
+	for _, node := range o.virtual {
+		s := node.Status()
+		status.Ready = status.Ready && s.Ready
+		status.Pending += s.Pending
+		status.Shedding = status.Shedding || s.Shedding
+		status.Shed += s.Shed
+	}
+	return status
+}
+
+// Traces the overlay route from the primary node towards the node closest to
+// dest, diagnosing misrouting and slow hops.
+func (o *Overlay) TraceRoute(dest *big.Int, timeout time.Duration) ([]*overlay.TraceHop, error) {
+	return o.scribe.TraceRoute(dest, timeout)
+}
+
+// Registers a hook intercepting the messages routed through any of the hosted
+// nodes before their next overlay hop is selected.
+func (o *Overlay) BeforeRoute(hook overlay.RouteHook) {
+	o.scribe.BeforeRoute(hook)
+	for _, node := range o.virtual {
+		node.BeforeRoute(hook)
+	}
+}
+
+// Registers a hook intercepting the messages routed through any of the hosted
+// nodes after their next overlay hop was selected.
+func (o *Overlay) AfterRoute(hook overlay.RouteHook) {
+	o.scribe.AfterRoute(hook)
+	for _, node := range o.virtual {
+		node.AfterRoute(hook)
+	}
+}
+
+// Reports whether a topic still has local subscriptions with live owners, keeping
+// the carrier renewing its lease.
+func (o *Overlay) leased(topic string) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	for _, id := range o.subLive[topic] {
+		if conn, ok := o.conns[id]; ok && conn.alive() {
+			return true
+		}
+	}
+	return false
+}
 
-	// Create a new subscription if non existed (mark as so)
+// Subscribes to a new topic, or adds the current connection to the list of live
+// subscriptions. The filter expression is forwarded to the carrier to prune the
+// events nobody is interested in (empty for no filtering).
+func (o *Overlay) subscribe(id uint64, topic string, filter string) error {
+	// Register the connection, pinning the shared topic state
 	o.lock.Lock()
-	if lock, ok := o.subLock[topic]; !ok {
-		o.subLive[topic] = []uint64{id}
-		o.subLock[topic] = sync.RWMutex{}
-		cascade = true
-	} else {
-		// Lock the existing subscription and add the current connection
-		lock.Lock()
-		o.subLive[topic] = append(o.subLive[topic], id)
-		lock.Unlock()
+	mem, ok := o.subRefs[topic]
+	if !ok {
+		mem = &membership{filters: make(map[uint64]string)}
+		o.subRefs[topic] = mem
 	}
+	mem.refs++
+	mem.filters[id] = filter
+	o.subLive[topic] = append(o.subLive[topic], id)
 	o.lock.Unlock()
 
-	// If a new subscription was requested, do it
-	if cascade {
-		return o.scribe.Subscribe(topic)
+	// Join the carrier topic if no local connection did so yet
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	if !mem.joined {
+		if err := o.scribe.Subscribe(topic); err != nil {
+			return err
+		}
+		mem.joined = true
 	}
+	o.refresh(topic)
 	return nil
 }
 
 // Unsubscribes a client from a topic, removing the scribe subscription too if
 // the last client.
 func (o *Overlay) unsubscribe(id uint64, topic string) error {
-	o.lock.Lock() // Unlocked at 4 separate return points!
+	o.lock.Lock()
 
 	// Look up the subscription to leave
-	lock, ok := o.subLock[topic]
+	mem, ok := o.subRefs[topic]
 	if !ok {
 		// This should *not* happen
 		log.Printf("iris: unsubscribe from non-existent topic: %v.", topic)
@@ -168,7 +359,6 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 		return ErrNotSubscribed
 	}
 	// Remove the subscription
-	lock.Lock()
 	subs := o.subLive[topic]
 	done := false
 	for i, subId := range subs {
@@ -178,9 +368,6 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 			break
 		}
 	}
-	o.subLive[topic] = subs
-	lock.Unlock()
-
 	// Actually check if anything was removed, just in case
 	if !done {
 		log.Printf("iris: remove non-existent subscription: %v:%v.", topic, id)
@@ -188,14 +375,156 @@ func (o *Overlay) unsubscribe(id uint64, topic string) error {
 		o.lock.Unlock()
 		return ErrNotSubscribed
 	}
-	// Dump the topic if all subscriptions are gone
-	if len(subs) == 0 {
+	o.subLive[topic] = subs
+	delete(mem.filters, id)
+	if mem.refs--; mem.refs == 0 {
 		delete(o.subLive, topic)
-		delete(o.subLock, topic)
+	}
+	o.lock.Unlock()
 
-		o.lock.Unlock()
-		return o.scribe.Unsubscribe(topic)
+	// Leave the carrier topic if no local connection remained (or rejoined since)
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	o.lock.RLock()
+	refs := mem.refs
+	o.lock.RUnlock()
+
+	if refs > 0 {
+		o.refresh(topic)
+		return nil
+	}
+	var err error
+	if mem.joined {
+		err = o.scribe.Unsubscribe(topic)
+		mem.joined = false
+	}
+	// Drop the shared state unless a new connection is already waiting to rejoin
+	o.lock.Lock()
+	if mem.refs == 0 {
+		delete(o.subRefs, topic)
 	}
 	o.lock.Unlock()
+
+	return err
+}
+
+// Retrieves the member count of a scribe topic from the carrier.
+func (o *Overlay) size(topic string) (int, error) {
+	count, err := o.scribe.Size(topic, config.IrisMembersTimeout)
+	if err == scribe.ErrTimeout {
+		err = ErrTimeout
+	}
+	return count, err
+}
+
+// Updates the number of local members and their event filters represented in
+// a scribe topic, used to aggregate the topic member counts and prune events.
+func (o *Overlay) refresh(topic string) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	if subs := len(o.subLive[topic]); subs > 0 {
+		filters := make([]string, 0, subs)
+		for _, filter := range o.subRefs[topic].filters {
+			filters = append(filters, filter)
+		}
+		o.scribe.SetWeight(topic, subs)
+		o.scribe.SetFilters(topic, filters)
+	}
+}
+
+// Runs the carrier balancer of a topic, returning a random local connection
+// subscribed to it if the local fast path is enabled and the balancer picked the
+// local node. Otherwise a send function is returned, balancing a message to the
+// member the balancer picked.
+func (o *Overlay) pick(topic string) (*Connection, func(*proto.Message) error) {
+	if !config.IrisLocalFastPath {
+		return nil, func(msg *proto.Message) error { return o.scribe.Balance(topic, msg) }
+	}
+	id, node := o.scribe.Elect(topic)
+	send := func(msg *proto.Message) error { return o.scribe.BalanceTo(id, node, msg) }
+	if node == nil || node.Cmp(o.scribe.Self()) != 0 {
+		return nil, send
+	}
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	subs, ok := o.subLive[topic]
+	if !ok || len(subs) == 0 {
+		return nil, send
+	}
+	return o.conns[subs[rand.Intn(len(subs))]], send
+}
+
+// Publishes a message into a carrier topic. If the local fast path is enabled
+// and local subscribers exist, they are served in-process and the carrier copy
+// is flagged to prevent double delivery.
+func (o *Overlay) publish(topic string, msg *proto.Message) error {
+	o.publishLocal(topic, msg)
+	return o.scribe.Publish(topic, msg)
+}
+
+// Publishes a message into a carrier topic similarly to publish, but blocks until
+// the carrier confirms accepting it, or the timeout expires.
+func (o *Overlay) publishSync(topic string, msg *proto.Message, timeout time.Duration) error {
+	o.publishLocal(topic, msg)
+	if err := o.scribe.PublishConfirmed(topic, msg, timeout); err != nil {
+		if err == scribe.ErrTimeout {
+			return ErrTimeout
+		}
+		return err
+	}
 	return nil
 }
+
+// Publishes a message into a carrier topic similarly to publish, but traces the
+// carrier paths of the copies, collecting them during window.
+func (o *Overlay) publishTraced(topic string, msg *proto.Message, window time.Duration) ([]scribe.Path, error) {
+	o.publishLocal(topic, msg)
+	return o.scribe.PublishTraced(topic, msg, window)
+}
+
+// Serves the local subscribers of a topic (and its ancestors if hierarchical)
+// in-process if the fast path is enabled, flagging the message to prevent double
+// delivery through the carrier.
+func (o *Overlay) publishLocal(topic string, msg *proto.Message) {
+	if config.IrisLocalFastPath {
+		// Collect the topics in the lineage with local subscribers
+		lineage := o.scribe.Lineage(topic)
+		locals := make([]string, 0, len(lineage))
+
+		o.lock.RLock()
+		for _, name := range lineage {
+			if len(o.subLive[name]) > 0 {
+				locals = append(locals, name)
+			}
+		}
+		o.lock.RUnlock()
+
+		if len(locals) > 0 {
+			// Assemble a fresh copy, the carrier will encrypt the original in place
+			head := msg.Head.Meta.(*header)
+			head.Local = true
+
+			plain := &proto.Message{
+				Head: proto.Header{Meta: head},
+				Data: make([]byte, len(msg.Data)),
+			}
+			copy(plain.Data, msg.Data)
+			for _, name := range locals {
+				o.handlePublish(o.scribe.Self(), name, plain)
+			}
+		}
+	}
+}
+
+// Sends a direct message to a carrier node. If the local fast path is enabled
+// and the destination is the local node, the message is delivered in-process.
+func (o *Overlay) direct(dest *big.Int, msg *proto.Message) error {
+	if config.IrisLocalFastPath && dest.Cmp(o.scribe.Self()) == 0 {
+		o.HandleDirect(dest, msg)
+		return nil
+	}
+	return o.scribe.Direct(dest, msg)
+}
@@ -0,0 +1,77 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the isolation of application handler panics, preventing a single
+// faulty handler from taking down the whole node.
+
+package iris
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// Details of a recovered application handler panic.
+type PanicError struct {
+	Handler string      // Name of the handler method that panicked
+	Meta    string      // Metadata about the message being handled
+	Value   interface{} // Value passed to the panic call
+	Stack   []byte      // Stack trace of the panicking go-routine
+}
+
+// Implements error.Error.
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked (%s): %v", p.Handler, p.Meta, p.Value)
+}
+
+// Sets an optional callback to be notified of recovered handler panics. It is
+// invoked synchronously after the panic is logged, so it should return fast.
+func (c *Connection) SetPanicHandler(handler func(err *PanicError)) {
+	c.panicLock.Lock()
+	defer c.panicLock.Unlock()
+
+	c.panicHandler = handler
+}
+
+// Executes an application handler, recovering and reporting any panic. The
+// recovered panic is returned, or nil if the handler finished cleanly.
+func (c *Connection) protect(handler string, meta string, fn func()) (err *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{
+				Handler: handler,
+				Meta:    meta,
+				Value:   r,
+				Stack:   debug.Stack(),
+			}
+			log.Printf("iris: recovered %v.\n%s", err, err.Stack)
+			c.stats.add(&c.stats.panics, 1)
+
+			c.panicLock.RLock()
+			callback := c.panicHandler
+			c.panicLock.RUnlock()
+
+			if callback != nil {
+				callback(err)
+			}
+		}
+	}()
+	fn()
+	return nil
+}
@@ -0,0 +1,98 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection handler panicking on every request.
+type panicker struct{}
+
+func (p *panicker) HandleBroadcast(msg []byte) {
+	panic("broadcast bomb")
+}
+
+func (p *panicker) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("request bomb")
+}
+
+func (p *panicker) HandleTunnel(tun *Tunnel) {
+	panic("tunnel bomb")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a panicking service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("panic-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("panic-test", &panicker{})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	panics := make(chan *PanicError, 2)
+	conn.SetPanicHandler(func(err *PanicError) { panics <- err })
+
+	// Issue a request and make sure the panic is reported back as a failure
+	if _, err := conn.Request("panic-test", []byte{0}, time.Second); err == nil || !strings.Contains(err.Error(), "request bomb") {
+		t.Fatalf("panic failure mismatch: have %v, want request bomb.", err)
+	}
+	// Broadcast and make sure the node survives
+	if err := conn.Broadcast("panic-test", []byte{0}); err != nil {
+		t.Fatalf("failed to broadcast message: %v.", err)
+	}
+	for _, want := range []string{"HandleRequest", "HandleBroadcast"} {
+		select {
+		case err := <-panics:
+			if err.Handler != want || len(err.Stack) == 0 {
+				t.Fatalf("panic report mismatch: have %v, want %v with stack.", err.Handler, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("panic report timeout for %v.", want)
+		}
+	}
+	if n := conn.Stats().HandlerPanics; n != 2 {
+		t.Fatalf("panic count mismatch: have %d, want %d.", n, 2)
+	}
+}
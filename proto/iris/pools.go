@@ -0,0 +1,167 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the handler worker pools of a connection: the connection wide pool
+// invoking the request, broadcast and tunnel handlers, and the optional topic
+// pools invoking the subscription handlers.
+
+package iris
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/pool"
+)
+
+// Returned when a handler pool is configured with invalid parameters.
+var ErrInvalidPool = errors.New("invalid handler pool")
+
+// Returned to requesters when the handler queue of the serving member is full.
+var ErrOverloaded = errors.New("handler queue full")
+
+// Replaces the handler pool of the connection (used for requests, broadcasts
+// and inbound tunnels, as well as events of topics without a dedicated pool)
+// with one running at most workers concurrent handlers and queueing at most
+// queue pending ones (0 = unbounded). Messages arriving to a full queue are
+// dropped, requests are failed with ErrOverloaded.
+func (c *Connection) SetHandlerPool(workers int, queue int) error {
+	if workers <= 0 || queue < 0 {
+		return ErrInvalidPool
+	}
+	fresh := pool.NewBoundedThreadPool(workers, queue)
+	fresh.Start()
+
+	c.workLock.Lock()
+	old := c.workers
+	c.workers = fresh
+	c.workLock.Unlock()
+
+	// Let the old pool drain the already accepted tasks
+	go old.Terminate(false)
+	return nil
+}
+
+// Assigns a dedicated handler pool to the subscription, running at most workers
+// concurrent event handlers and queueing at most queue pending events (0 =
+// unbounded), independent of the connection wide handler pool.
+func (s *Subscription) SetPool(workers int, queue int) error {
+	if workers <= 0 || queue < 0 {
+		return ErrInvalidPool
+	}
+	fresh := pool.NewBoundedThreadPool(workers, queue)
+	fresh.Start()
+
+	s.lock.Lock()
+	old := s.pool
+	s.pool = fresh
+	s.lock.Unlock()
+
+	if old != nil {
+		go old.Terminate(false)
+	}
+	return nil
+}
+
+// Schedules a handler task into the connection wide pool.
+func (c *Connection) schedule(task pool.Task) error {
+	c.workLock.RLock()
+	defer c.workLock.RUnlock()
+
+	err := c.workers.Schedule(task)
+	if err == pool.ErrFull {
+		c.stats.add(&c.stats.rejects, 1)
+	}
+	return err
+}
+
+// Schedules an event handler task into the topic's dedicated pool, or the
+// connection wide one if none was configured.
+func (c *Connection) scheduleEvent(topic string, task pool.Task) error {
+	c.subLock.RLock()
+	sub, ok := c.subLive[topic]
+	c.subLock.RUnlock()
+
+	if ok {
+		sub.lock.Lock()
+		workers := sub.pool
+		sub.lock.Unlock()
+
+		if workers != nil {
+			err := workers.Schedule(task)
+			if err == pool.ErrFull {
+				c.stats.add(&c.stats.rejects, 1)
+			}
+			return err
+		}
+	}
+	return c.schedule(task)
+}
+
+// Schedules an inbound request for handling, failing it back to the requester
+// if the handler queue is full.
+func (c *Connection) scheduleRequest(srcNode *big.Int, srcConn uint64, reqId uint64, req []byte, timeout time.Duration) {
+	task := func() { c.handleRequest(srcNode, srcConn, reqId, req, timeout) }
+	if err := c.schedule(task); err == pool.ErrFull {
+		c.iris.direct(srcNode, c.assembleReply(srcConn, reqId, nil, ErrOverloaded))
+	}
+}
+
+// Counts the handler tasks queued in all the local connections, reported to the
+// carrier as part of the node's resource load.
+func (o *Overlay) backlog() int {
+	o.lock.RLock()
+	conns := make([]*Connection, 0, len(o.conns))
+	for _, conn := range o.conns {
+		conns = append(conns, conn)
+	}
+	o.lock.RUnlock()
+
+	depth := 0
+	for _, conn := range conns {
+		depth += conn.backlog()
+	}
+	return depth
+}
+
+// Counts the handler tasks queued in the connection wide and topic pools.
+func (c *Connection) backlog() int {
+	c.workLock.RLock()
+	depth := c.workers.Pending()
+	c.workLock.RUnlock()
+
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	// Subscriptions are tracked under all their split prefixes, count once
+	seen := make(map[*Subscription]struct{})
+	for _, sub := range c.subLive {
+		if _, ok := seen[sub]; ok {
+			continue
+		}
+		seen[sub] = struct{}{}
+
+		sub.lock.Lock()
+		if sub.pool != nil {
+			depth += sub.pool.Pending()
+		}
+		sub.lock.Unlock()
+	}
+	return depth
+}
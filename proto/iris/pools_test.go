@@ -0,0 +1,154 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection and subscription handler blocking until released.
+type blocker struct {
+	release chan struct{}
+	events  chan []byte
+}
+
+func (b *blocker) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to blocker handler")
+}
+
+func (b *blocker) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	if req[0] == 1 {
+		<-b.release
+	}
+	return req, nil
+}
+
+func (b *blocker) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on blocker handler")
+}
+
+func (b *blocker) HandleEvent(msg []byte) {
+	<-b.release
+	b.events <- msg
+}
+
+func TestHandlerPools(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a blocking service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("pool-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	hand := &blocker{make(chan struct{}), make(chan []byte, 3)}
+	conn, err := node.Connect("pool-test", hand)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Check that invalid pools are rejected
+	if err := conn.SetHandlerPool(0, 1); err != ErrInvalidPool {
+		t.Fatalf("invalid pool mismatch: have %v, want %v.", err, ErrInvalidPool)
+	}
+	// Limit the connection to a single handler with a single queue slot
+	if err := conn.SetHandlerPool(1, 1); err != nil {
+		t.Fatalf("failed to set handler pool: %v.", err)
+	}
+	errs := make(chan error, 3)
+	pend := new(sync.WaitGroup)
+	for i := 0; i < 3; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+			_, err := conn.Request("pool-test", []byte{1}, 3*time.Second)
+			errs <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Exactly one request should be rejected before releasing the others
+	select {
+	case err := <-errs:
+		if err == nil || err.Error() != ErrOverloaded.Error() {
+			t.Fatalf("overload failure mismatch: have %v, want %v.", err, ErrOverloaded)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("overloaded request not rejected.")
+	}
+	if drops := conn.Stats().HandlerDrops; drops != 1 {
+		t.Fatalf("handler drop count mismatch: have %v, want %v.", drops, 1)
+	}
+	hand.release <- struct{}{}
+	hand.release <- struct{}{}
+	pend.Wait()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("queued request failed: %v.", err)
+		}
+	}
+	// Assign a dedicated pool to a topic and block it
+	if err := conn.Subscribe("pool-topic", hand); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	sub, err := conn.Subscription("pool-topic")
+	if err != nil {
+		t.Fatalf("failed to retrieve subscription: %v.", err)
+	}
+	if err := sub.SetPool(1, 1); err != nil {
+		t.Fatalf("failed to set topic pool: %v.", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := conn.Publish("pool-topic", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish event: %v.", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Requests must not be affected by the blocked topic pool
+	if _, err := conn.Request("pool-test", []byte{0}, time.Second); err != nil {
+		t.Fatalf("request blocked by topic pool: %v.", err)
+	}
+	// Release the events and check that the overflowing one was dropped
+	hand.release <- struct{}{}
+	hand.release <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(hand.events); n != 2 {
+		t.Fatalf("delivered event count mismatch: have %v, want %v.", n, 2)
+	}
+	if drops := conn.Stats().HandlerDrops; drops != 2 {
+		t.Fatalf("handler drop count mismatch: have %v, want %v.", drops, 2)
+	}
+}
@@ -22,6 +22,7 @@ package iris
 
 import (
 	"encoding/gob"
+	"math/big"
 	"time"
 
 	"github.com/project-iris/iris/proto"
@@ -31,23 +32,39 @@ import (
 type opcode uint8
 
 const (
-	opBcast opcode = iota // Cluster broadcast
-	opReq                 // Cluster request
-	opRep                 // Cluster reply
-	opPub                 // Topic publish
-	opTun                 // Tunneling request
+	opBcast  opcode = iota // Cluster broadcast
+	opReq                  // Cluster request
+	opRep                  // Cluster reply
+	opPub                  // Topic publish
+	opTun                  // Tunneling request
+	opAck                  // Broadcast receipt acknowledgement
+	opClaim                // Hedged request receipt claimed by a member
+	opCancel               // Hedged request superseded by its duplicate
 )
 
 // Extra headers for the Iris layer.
 type header struct {
 	Op   opcode // Operation code of the message
-	Src  uint64 // Connection id of the sender (requests, tunnel)
+	Src  uint64 // Connection id of the sender (requests, replies, tunnel)
 	Dest uint64 // Connection id of the recipient (direct messages)
 
+	Local bool              // Flag whether the local recipients were already served in-process
+	Attrs map[string]string // Event attributes to evaluate subscription filters against
+
+	// Optional fields for confirmed broadcasts
+	BcastId  uint64 // Broadcast receipt identifier
+	BcastAck bool   // Flag whether the broadcast must be acknowledged
+
 	// Optional fields for requests and replies
-	ReqId   uint64        // Request/response identifier
-	ReqFail bool          // Flag whether a request failed
-	ReqTime time.Duration // Maximum amount of time spendable on the request
+	ReqId    uint64        // Request/response identifier
+	ReqFail  bool          // Flag whether a request failed
+	ReqTime  time.Duration // Maximum amount of time spendable on the request
+	ReqKey   string        // Affinity key of a consistently balanced request
+	ReqHedge bool          // Flag whether the requester hedges, asking the member to claim it
+
+	// Optional fields for hedged duplicates
+	SkipNode *big.Int // Node of the member to avoid (the claimer of the original)
+	SkipConn uint64   // Connection id of the member to avoid
 
 	// Optional fields for tunnels
 	TunId    uint64        // Id of the tunnel being requested
@@ -56,6 +73,11 @@ type header struct {
 	TunTime  time.Duration // Maximum time to establish tunnel
 }
 
+// Implements filter.Attributed, exposing the event attributes to the carrier.
+func (h *header) Attributes() map[string]string {
+	return h.Attrs
+}
+
 // Make sure the header struct is registered with gob.
 func init() {
 	gob.Register(&header{})
@@ -77,26 +99,82 @@ func (c *Connection) assembleBroadcast(msg []byte) *proto.Message {
 	return c.assemblePacket(&header{Op: opBcast}, msg)
 }
 
+// Assembles an application broadcast message requiring delivery confirmation.
+// It consists of the bcast opcode, the sender connection, the locally unique
+// broadcast id, the acknowledgement flag and the payload.
+func (c *Connection) assembleConfirmedBroadcast(bcastId uint64, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opBcast, Src: c.id, BcastId: bcastId, BcastAck: true}, msg)
+}
+
+// Assembles the receipt acknowledgement of a confirmed broadcast. It consists
+// of the ack opcode and the original broadcast's id.
+func (c *Connection) assembleBroadcastAck(dest uint64, bcastId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opAck, Dest: dest, BcastId: bcastId}, nil)
+}
+
 // Assembles an application request message. It consists of the request opcode,
 // the locally unique request id and the payload.
 func (c *Connection) assembleRequest(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
 	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout}, req)
 }
 
+// Assembles an application request message balanced by an affinity key. It
+// consists of the request opcode, the locally unique request id, the key and
+// the payload.
+func (c *Connection) assembleKeyedRequest(reqId uint64, key string, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqKey: key}, req)
+}
+
+// Assembles an application request message that the requester may hedge. It
+// consists of the request opcode, the locally unique request id, the hedge flag
+// and the payload.
+func (c *Connection) assembleHedgedRequest(reqId uint64, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqHedge: true}, req)
+}
+
+// Assembles the hedged duplicate of an application request. It consists of the
+// request opcode, the locally unique request id, the hedge flag, the member to
+// avoid and the payload.
+func (c *Connection) assembleHedgeRequest(reqId uint64, skip *Member, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, ReqId: reqId, ReqTime: timeout, ReqHedge: true, SkipNode: skip.node, SkipConn: skip.conn}, req)
+}
+
+// Assembles the claim of a hedged request, notifying the requester of the member
+// serving it. It consists of the claim opcode, the claimer and requester
+// connections and the request id.
+func (c *Connection) assembleClaim(dest uint64, reqId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opClaim, Src: c.id, Dest: dest, ReqId: reqId}, nil)
+}
+
+// Assembles the cancellation of a hedged request the duplicate of which already
+// got answered. It consists of the cancel opcode, the requester and claimer
+// connections and the request id.
+func (c *Connection) assembleCancel(dest uint64, reqId uint64) *proto.Message {
+	return c.assemblePacket(&header{Op: opCancel, Src: c.id, Dest: dest, ReqId: reqId}, nil)
+}
+
+// Assembles an application request message directed to a specific member. It
+// consists of the request opcode, the recipient connection, the locally unique
+// request id and the payload.
+func (c *Connection) assembleMemberRequest(dest uint64, reqId uint64, req []byte, timeout time.Duration) *proto.Message {
+	return c.assemblePacket(&header{Op: opReq, Src: c.id, Dest: dest, ReqId: reqId, ReqTime: timeout}, req)
+}
+
 // Assembles the reply message to an application request. It consists of the
-// reply opcode, the original request's id and the payload itself.
+// reply opcode, the replier connection, the original request's id and the
+// payload itself.
 func (c *Connection) assembleReply(dest uint64, reqId uint64, rep []byte, err error) *proto.Message {
 	if err == nil {
-		return c.assemblePacket(&header{Op: opRep, Dest: dest, ReqId: reqId}, rep)
+		return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId}, rep)
 	} else {
-		return c.assemblePacket(&header{Op: opRep, Dest: dest, ReqId: reqId, ReqFail: true}, []byte(err.Error()))
+		return c.assemblePacket(&header{Op: opRep, Src: c.id, Dest: dest, ReqId: reqId, ReqFail: true}, []byte(err.Error()))
 	}
 }
 
 // Assembles an event message to be published in a topic. It consists of the
-// publish opcode and the payload.
-func (c *Connection) assemblePublish(msg []byte) *proto.Message {
-	return c.assemblePacket(&header{Op: opPub}, msg)
+// publish opcode, the optional event attributes and the payload.
+func (c *Connection) assemblePublish(attrs map[string]string, msg []byte) *proto.Message {
+	return c.assemblePacket(&header{Op: opPub, Attrs: attrs}, msg)
 }
 
 // Assembles a tunneling request message, consisting of the tunneling opcode,
@@ -155,3 +155,387 @@ func testPubSub(t *testing.T, nodes, conns, msgs int) {
 		}
 	}
 }
+
+// Tests that paused subscriptions buffer events (up to a limit) and flush them
+// when resumed.
+func TestPubSubPauseResume(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	oldBuffer := config.IrisPauseBuffer
+	config.IrisPauseBuffer = 10
+	defer func() { config.IrisPauseBuffer = oldBuffer }()
+
+	// Boot a single iris overlay and subscribe a client to a topic
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	topic := "pubsub-pause-topic"
+	if _, err := conn.Subscription(topic); err != ErrNotSubscribed {
+		t.Fatalf("missing subscription error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	handler := &subscriber{make(chan []byte, 100)}
+	if err := conn.Subscribe(topic, handler); err != nil {
+		t.Fatalf("failed to subscribe to the topic: %v.", err)
+	}
+	sub, err := conn.Subscription(topic)
+	if err != nil {
+		t.Fatalf("failed to retrieve subscription: %v.", err)
+	}
+	// Pause the subscription and overflow the buffer
+	sub.Pause()
+	for i := 0; i < 15; i++ {
+		if err := conn.Publish(topic, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish message: %v.", err)
+		}
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(handler.msgs); n != 0 {
+		t.Fatalf("paused delivery count mismatch: have %d, want %d.", n, 0)
+	}
+	if n := sub.Dropped(); n != 5 {
+		t.Fatalf("dropped event count mismatch: have %d, want %d.", n, 5)
+	}
+	// Resume and ensure the buffered and new events are delivered, the new last
+	sub.Resume()
+	if err := conn.Publish(topic, []byte{0xff}); err != nil {
+		t.Fatalf("failed to publish message: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := len(handler.msgs); n != 11 {
+		t.Fatalf("resumed delivery count mismatch: have %d, want %d.", n, 11)
+	}
+	for i := 0; i < 11; i++ {
+		if msg := <-handler.msgs; (i == 10) != (msg[0] == 0xff) {
+			t.Fatalf("event %d: flush order mismatch: have %d.", i, msg[0])
+		}
+	}
+}
+
+// Tests that events published into a hierarchical topic reach the subscribers
+// of all its ancestors, exactly once.
+func TestPubSubHierarchy(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and subscribe to a few levels of a hierarchy
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	topics := []string{"pubsub-hier", "pubsub-hier/a", "pubsub-hier/a/b", "pubsub-hier/x"}
+	handlers := make([]*subscriber, len(topics))
+	for i, topic := range topics {
+		handlers[i] = &subscriber{make(chan []byte, 100)}
+		if err := conn.Subscribe(topic, handlers[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Publish into a few levels and verify the delivery counts
+	for i := 0; i < 10; i++ {
+		if err := conn.Publish("pubsub-hier/a/b/c", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish message: %v.", err)
+		}
+		if err := conn.Publish("pubsub-hier/a", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish message: %v.", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for i, want := range []int{20, 20, 10, 0} {
+		if have := len(handlers[i].msgs); have != want {
+			t.Fatalf("delivery count mismatch for %s: have %d, want %d.", topics[i], have, want)
+		}
+	}
+}
+
+// Tests that synchronous publishes and broadcasts are confirmed by the carrier.
+func TestPubSubSync(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 3
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	cluster, topic := "pubsub-sync-cluster", "pubsub-sync-topic"
+
+	// Boot the iris overlays and connect a subscribed service to each
+	liveHands := make([]*subscriber, nodes)
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New("pubsub-test", key)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(node)
+
+		conn, err := node.Connect(cluster, &broadcaster{make(chan []byte, nodes)})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		liveConns[i] = conn
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+
+		liveHands[i] = &subscriber{make(chan []byte, nodes)}
+		if err := conn.Subscribe(topic, liveHands[i]); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports (TODO, fix this)
+	time.Sleep(3 * time.Second)
+
+	// Publish and broadcast synchronously from every node
+	for i, conn := range liveConns {
+		if err := conn.PublishSync(topic, []byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to publish synchronously: %v.", err)
+		}
+		if err := conn.BroadcastSync(cluster, []byte{byte(i)}, time.Second); err != nil {
+			t.Fatalf("failed to broadcast synchronously: %v.", err)
+		}
+	}
+	// Publishes to topics without subscribers are still accepted at the rendez-vous point
+	if err := liveConns[0].PublishSync("pubsub-sync-empty", []byte{0}, time.Second); err != nil {
+		t.Fatalf("failed to publish synchronously into empty topic: %v.", err)
+	}
+	// Verify that all the events arrived
+	time.Sleep(250 * time.Millisecond)
+	for i, hand := range liveHands {
+		if n := len(hand.msgs); n != nodes {
+			t.Fatalf("node %d: publish/deliver count mismatch: have %d, want %d.", i, n, nodes)
+		}
+	}
+}
+
+func TestPubSubFiltered(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	cluster, topic := "pubsub-filter-cluster", "pubsub-filter-topic"
+
+	// Boot the iris overlays and subscribe each (but the first) to its own events
+	liveHands := make([]*subscriber, nodes)
+	liveConns := make([]*Connection, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New("pubsub-test", key)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(node)
+
+		conn, err := node.Connect(cluster, &broadcaster{})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		liveConns[i] = conn
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+
+		expr := ""
+		if i > 0 {
+			expr = fmt.Sprintf("node == %d", i)
+		}
+		liveHands[i] = &subscriber{make(chan []byte, nodes*nodes)}
+		if err := conn.SubscribeFiltered(topic, liveHands[i], expr); err != nil {
+			t.Fatalf("failed to subscribe to the topic: %v.", err)
+		}
+	}
+	// Invalid filters should be rejected
+	if err := liveConns[0].SubscribeFiltered(topic+"-invalid", &subscriber{}, "node =="); err == nil {
+		t.Fatalf("invalid filter accepted.")
+	}
+	// Make sure there is a little time to propagate state and reports (TODO, fix this)
+	time.Sleep(3 * time.Second)
+
+	// Publish an event to every node from every node
+	for _, conn := range liveConns {
+		for j := 0; j < nodes; j++ {
+			if err := conn.PublishAttrs(topic, map[string]string{"node": fmt.Sprintf("%d", j)}, []byte{byte(j)}); err != nil {
+				t.Fatalf("failed to publish event: %v.", err)
+			}
+		}
+	}
+	// Verify that only the matching events arrived
+	time.Sleep(500 * time.Millisecond)
+	for i, hand := range liveHands {
+		want := nodes
+		if i == 0 {
+			want = nodes * nodes
+		}
+		if n := len(hand.msgs); n != want {
+			t.Fatalf("node %d: delivered count mismatch: have %d, want %d.", i, n, want)
+		}
+		for i > 0 && len(hand.msgs) > 0 {
+			if msg := <-hand.msgs; int(msg[0]) != i {
+				t.Fatalf("node %d: filtered event mismatch: have %d, want %d.", i, msg[0], i)
+			}
+		}
+	}
+}
+
+// Tests that many local connections share a single carrier subscription, which
+// is joined by the first and left only by the last of them, even when racing.
+func TestPubSubShared(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	topic, conns := "pubsub-shared-topic", 32
+
+	node := New("pubsub-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	// Connect and subscribe a batch of local clients concurrently
+	liveConns := make([]*Connection, conns)
+	liveHands := make([]*subscriber, conns)
+	for i := 0; i < conns; i++ {
+		conn, err := node.Connect("", nil)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		liveConns[i], liveHands[i] = conn, &subscriber{make(chan []byte, 1)}
+	}
+	var pend sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		pend.Add(1)
+		go func(i int) {
+			defer pend.Done()
+			if err := liveConns[i].Subscribe(topic, liveHands[i]); err != nil {
+				t.Errorf("conn %d: failed to subscribe: %v.", i, err)
+			}
+		}(i)
+	}
+	pend.Wait()
+
+	info, err := liveConns[0].InspectTopic(topic)
+	if err != nil {
+		t.Fatalf("failed to inspect topic: %v.", err)
+	}
+	for i, tree := range info.Trees {
+		if tree == nil || tree.Local != conns {
+			t.Fatalf("tree %d: local member mismatch: have %v, want %v.", i, tree, conns)
+		}
+	}
+	// Close all but one of the clients concurrently, racing with resubscriptions
+	for i := 1; i < conns; i++ {
+		pend.Add(1)
+		go func(i int) {
+			defer pend.Done()
+			if err := liveConns[i].Unsubscribe(topic); err != nil {
+				t.Errorf("conn %d: failed to unsubscribe: %v.", i, err)
+			}
+			if err := liveConns[i].Close(); err != nil {
+				t.Errorf("conn %d: failed to close connection: %v.", i, err)
+			}
+		}(i)
+	}
+	pend.Wait()
+
+	if info, err = liveConns[0].InspectTopic(topic); err != nil {
+		t.Fatalf("failed to inspect topic: %v.", err)
+	}
+	for i, tree := range info.Trees {
+		if tree == nil || tree.Local != 1 {
+			t.Fatalf("tree %d: local member mismatch: have %v, want %v.", i, tree, 1)
+		}
+	}
+	// Ensure the remaining client still receives events
+	if err := liveConns[0].PublishSync(topic, []byte{0}, time.Second); err != nil {
+		t.Fatalf("failed to publish: %v.", err)
+	}
+	select {
+	case <-liveHands[0].msgs:
+	case <-time.After(time.Second):
+		t.Fatalf("event not delivered to remaining subscriber.")
+	}
+	// Close the last client and ensure the carrier topic is left
+	if err := liveConns[0].Close(); err != nil {
+		t.Fatalf("failed to close connection: %v.", err)
+	}
+	if _, err := node.inspect(topicPrefixes, topic); err != ErrNotParticipating {
+		t.Fatalf("inspection error mismatch: have %v, want %v.", err, ErrNotParticipating)
+	}
+}
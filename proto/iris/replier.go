@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the deferred request replies, allowing handlers awaiting external
+// resources to release the handler pool and answer later from any go-routine.
+
+package iris
+
+import (
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by a deferred handler invocation in place of the reply, signalling
+// to the inbound request interceptors that the reply will be sent later.
+var ErrDeferred = errors.New("reply deferred")
+
+// Returned when a deferred request is answered more than once.
+var ErrReplied = errors.New("already replied")
+
+// Optional extension of ConnectionHandler: if implemented, inbound requests are
+// passed to HandleDeferredRequest instead of HandleRequest, and the handler may
+// answer them through the replier at any time before its deadline, from any
+// go-routine, without occupying a handler thread in the mean time. The plain
+// HandleRequest method of such handlers is never invoked.
+type DeferredHandler interface {
+	HandleDeferredRequest(req []byte, rep *Replier)
+}
+
+// Reply writer of a single deferred request.
+type Replier struct {
+	conn     *Connection // Connection which received the request
+	srcNode  *big.Int    // Iris node of the requester
+	srcConn  uint64      // Connection id of the requester
+	reqId    uint64      // Request id to reply to
+	start    time.Time   // Arrival time of the request for latency measurement
+	deadline time.Time   // Time after which the requester gave up waiting
+	done     int32       // Flag whether the request was already answered
+}
+
+// Creates a reply writer for an inbound request arrived now.
+func (c *Connection) newReplier(srcNode *big.Int, srcConn uint64, reqId uint64, timeout time.Duration) *Replier {
+	now := time.Now()
+	return &Replier{
+		conn:     c,
+		srcNode:  srcNode,
+		srcConn:  srcConn,
+		reqId:    reqId,
+		start:    now,
+		deadline: now.Add(timeout),
+	}
+}
+
+// Returns the time after which the requester is not waiting for a reply.
+func (r *Replier) Deadline() time.Time {
+	return r.deadline
+}
+
+// Sends the reply back to the requester. Only the first answer is delivered,
+// and only if the deadline has not passed yet.
+func (r *Replier) Reply(rep []byte) error {
+	return r.send(rep, nil)
+}
+
+// Reports a handler side failure back to the requester.
+func (r *Replier) Fail(err error) error {
+	if err == nil {
+		err = errors.New("unknown failure")
+	}
+	return r.send(nil, err)
+}
+
+// Answers the request with either a reply or a failure, exactly once.
+func (r *Replier) send(rep []byte, err error) error {
+	if !atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		return ErrReplied
+	}
+	select {
+	case <-r.conn.term:
+		return ErrTerminating
+	default:
+	}
+	if time.Now().After(r.deadline) {
+		r.conn.stats.add(&r.conn.stats.timeouts, 1)
+		return ErrTimeout
+	}
+	r.conn.sendReply(r.srcNode, r.srcConn, r.reqId, rep, err, r.start)
+	return nil
+}
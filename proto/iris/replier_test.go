@@ -0,0 +1,137 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection handler passing the deferred requests out to the test.
+type deferrer struct {
+	pend chan *Replier
+	reqs chan []byte
+}
+
+func (d *deferrer) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to deferred handler")
+}
+
+func (d *deferrer) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Synchronous request passed to deferred handler")
+}
+
+func (d *deferrer) HandleDeferredRequest(req []byte, rep *Replier) {
+	d.reqs <- req
+	d.pend <- rep
+}
+
+func (d *deferrer) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on deferred handler")
+}
+
+func TestDeferredReplies(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a deferring service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("deferred-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	requests := 10
+	hand := &deferrer{make(chan *Replier, requests), make(chan []byte, requests)}
+	conn, err := node.Connect("deferred-test", hand)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Restrict the handlers to a single thread to ensure deferring releases it
+	if err := conn.SetHandlerPool(1, 0); err != nil {
+		t.Fatalf("failed to set handler pool: %v.", err)
+	}
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func(i int) {
+			rep, err := conn.Request("deferred-test", []byte{byte(i)}, 3*time.Second)
+			if err == nil && !bytes.Equal(rep, []byte{byte(i)}) {
+				err = errors.New("reply mismatch")
+			}
+			errs <- err
+		}(i)
+	}
+	// Wait for all requests to arrive, and answer them in reverse order
+	repliers := make([]*Replier, requests)
+	for i := 0; i < requests; i++ {
+		select {
+		case rep := <-hand.pend:
+			repliers[int((<-hand.reqs)[0])] = rep
+		case <-time.After(time.Second):
+			t.Fatalf("deferred request %d not delivered.", i)
+		}
+	}
+	for i := requests - 1; i >= 0; i-- {
+		if err := repliers[i].Reply([]byte{byte(i)}); err != nil {
+			t.Fatalf("failed to send deferred reply %d: %v.", i, err)
+		}
+	}
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("deferred request failed: %v.", err)
+		}
+	}
+	// Check that duplicate answers are rejected
+	if err := repliers[0].Reply(nil); err != ErrReplied {
+		t.Fatalf("duplicate reply mismatch: have %v, want %v.", err, ErrReplied)
+	}
+	// Check that failures are propagated to the requester
+	go func() {
+		rep := <-hand.pend
+		<-hand.reqs
+		rep.Fail(errors.New("deferred failure"))
+	}()
+	if _, err := conn.Request("deferred-test", []byte{0}, time.Second); err == nil || err.Error() != "deferred failure" {
+		t.Fatalf("deferred failure mismatch: have %v, want %v.", err, "deferred failure")
+	}
+	// Check that late replies are rejected
+	if _, err := conn.Request("deferred-test", []byte{0}, 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("deferred timeout mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	<-hand.reqs
+	if err := (<-hand.pend).Reply(nil); err != ErrTimeout {
+		t.Fatalf("late reply mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+}
@@ -72,6 +72,27 @@ func TestReqRepMultiNodeMultiConn(t *testing.T) {
 	testReqRep(t, 10, 10, 100)
 }
 
+func TestReqRepLocalFastPath(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testReqRep(t, 1, 10, 1000)
+}
+
+func TestReqRepLocalFastPathMultiNode(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testReqRep(t, 3, 1, 100)
+}
+
+func TestReqRepVirtualNodes(t *testing.T) {
+	config.IrisVirtualNodes = 3
+	defer func() { config.IrisVirtualNodes = 1 }()
+
+	testReqRep(t, 3, 2, 100)
+}
+
 // Tests multi node multi connection request/replies.
 func testReqRep(t *testing.T, nodes, conns, reqs int) {
 	// Configure the test
@@ -79,7 +100,7 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 	defer swapConfigs()
 
 	olds := config.BootPorts
-	for i := 0; i < nodes; i++ {
+	for i := 0; i < nodes*config.IrisVirtualNodes; i++ {
 		config.BootPorts = append(config.BootPorts, 65000+i)
 	}
 	defer func() { config.BootPorts = olds }()
@@ -151,12 +172,425 @@ func testReqRep(t *testing.T, nodes, conns, reqs int) {
 
 	// Log some warning if connections didn't get remote requests
 	if nodes > 1 {
+		remote := uint32(0)
 		for i := 0; i < nodes; i++ {
 			for j := 0; j < conns; j++ {
 				if liveHands[i][j].remote == 0 {
 					t.Logf("%v:%v no remote requests received.", i, j)
 				}
+				remote += liveHands[i][j].remote
 			}
 		}
+		// The fast path must not bypass the balancer altogether
+		if config.IrisLocalFastPath && remote == 0 {
+			t.Fatalf("no remote requests served with local fast path.")
+		}
+	}
+}
+
+// Individual scatter-gather tests.
+func TestRequestAllSingleNode(t *testing.T) {
+	testRequestAll(t, 1, 10)
+}
+
+func TestRequestAllMultiNode(t *testing.T) {
+	testRequestAll(t, 5, 2)
+}
+
+func TestRequestAllLocalFastPath(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testRequestAll(t, 1, 10)
+}
+
+// Tests that scatter-gather requests collect the replies of all members, and
+// that the reply limit is respected.
+func testRequestAll(t *testing.T, nodes, conns int) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	overlay := "reqrep-test"
+	cluster := fmt.Sprintf("reqall-test-%d-%d", nodes, conns)
+
+	// Boot the iris overlays
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New(overlay, key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect to all nodes with a lot of clients
+	liveConns := make([]*Connection, 0, nodes*conns)
+	handlers := make([]*requester, 0, nodes*conns)
+	for i, node := range liveNodes {
+		for j := 0; j < conns; j++ {
+			handler := &requester{i, 0}
+			handlers = append(handlers, handler)
+
+			conn, err := node.Connect(cluster, handler)
+			if err != nil {
+				t.Fatalf("failed to connect to the iris overlay: %v.", err)
+			}
+			liveConns = append(liveConns, conn)
+
+			defer func(conn *Connection) {
+				if err := conn.Close(); err != nil {
+					t.Fatalf("failed to close iris connection: %v.", err)
+				}
+			}(conn)
+		}
+	}
+	// Make sure there is a little time to propagate state and reports (TODO, fix this)
+	if nodes > 1 {
+		time.Sleep(3 * time.Second)
+	}
+	// Gather replies from every member
+	members := len(liveConns)
+	for i, conn := range liveConns {
+		orig := []byte{byte(i)}
+		reps, err := conn.RequestAll(cluster, []byte{byte(i)}, time.Second, members)
+		if err != nil {
+			t.Fatalf("failed to send scatter-gather request: %v.", err)
+		}
+		if len(reps) != members {
+			t.Fatalf("reply count mismatch: have %d, want %d.", len(reps), members)
+		}
+		for _, rep := range reps {
+			if bytes.Compare(orig, rep) != 0 {
+				t.Fatalf("req/rep mismatch: have %v, want %v.", rep, orig)
+			}
+		}
+	}
+	// Gather replies from a subset of the members, ensuring no others were asked
+	served := func() (total uint32) {
+		for _, handler := range handlers {
+			total += atomic.LoadUint32(&handler.remote)
+		}
+		return
+	}
+	before := served()
+	if reps, err := liveConns[0].RequestAll(cluster, []byte{0xff}, time.Second, members/2); err != nil {
+		t.Fatalf("failed to send limited scatter-gather request: %v.", err)
+	} else if len(reps) != members/2 {
+		t.Fatalf("limited reply count mismatch: have %d, want %d.", len(reps), members/2)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if asked := int(served() - before); asked != members/2 {
+		t.Fatalf("limited request count mismatch: have %d, want %d.", asked, members/2)
+	}
+	// Make sure invalid limits are rejected
+	if _, err := liveConns[0].RequestAll(cluster, []byte{0}, time.Second, 0); err != ErrInvalidLimit {
+		t.Fatalf("invalid limit error mismatch: have %v, want %v.", err, ErrInvalidLimit)
+	}
+}
+
+// Connection handler for the hedging tests, stalling on the first delivery of
+// each request and replying instantly to any duplicate.
+type hedger struct {
+	seen map[byte]bool
+	lock *sync.Mutex
+}
+
+func (h *hedger) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to hedging handler")
+}
+
+func (h *hedger) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	h.lock.Lock()
+	first := !h.seen[req[0]]
+	h.seen[req[0]] = true
+	h.lock.Unlock()
+
+	if first {
+		time.Sleep(time.Second)
+	}
+	return req, nil
+}
+
+func (h *hedger) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on hedging handler")
+}
+
+// Tests that hedged requests are answered by the duplicate if the original stalls.
+func TestReqRepHedging(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a few stalling services
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handler := &hedger{make(map[byte]bool), new(sync.Mutex)}
+	for i := 0; i < 2; i++ {
+		conn, err := node.Connect("hedging-test", handler)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+	}
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Issue hedged requests and make sure none waits for the stalled original
+	conn.SetHedging(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if rep, err := conn.Request("hedging-test", []byte{byte(i)}, 3*time.Second); err != nil {
+			t.Fatalf("failed to send request: %v.", err)
+		} else if rep[0] != byte(i) {
+			t.Fatalf("req/rep mismatch: have %v, want %v.", rep[0], i)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("hedged request too slow: %v.", elapsed)
+		}
+	}
+	if n := conn.Stats().RequestsHedged; n != 5 {
+		t.Fatalf("hedged request count mismatch: have %d, want %d.", n, 5)
+	}
+}
+
+// Connection handler for the hedged failover tests, failing the first delivery
+// of each request after a while, and slowly serving any duplicate.
+type failover struct {
+	seen  map[byte]int // Deliveries of each request to all the members
+	local map[byte]int // Deliveries of each request to this member
+	lock  *sync.Mutex
+}
+
+func (f *failover) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to failover handler")
+}
+
+func (f *failover) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	f.lock.Lock()
+	f.seen[req[0]]++
+	f.local[req[0]]++
+	first := f.seen[req[0]] == 1
+	f.lock.Unlock()
+
+	if first {
+		time.Sleep(100 * time.Millisecond)
+		return nil, fmt.Errorf("stalled member")
+	}
+	time.Sleep(200 * time.Millisecond)
+	return req, nil
+}
+
+func (f *failover) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on failover handler")
+}
+
+// Tests that hedged duplicates avoid the member serving the original, and that
+// a hedged request only fails if both copies do.
+func TestReqRepHedgingFailover(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect two failing-over services
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	seen, lock := make(map[byte]int), new(sync.Mutex)
+	handlers := []*failover{}
+	for i := 0; i < 2; i++ {
+		handler := &failover{seen, make(map[byte]int), lock}
+		handlers = append(handlers, handler)
+
+		conn, err := node.Connect("failover-test", handler)
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer func(conn *Connection) {
+			if err := conn.Close(); err != nil {
+				t.Fatalf("failed to close iris connection: %v.", err)
+			}
+		}(conn)
+	}
+	conn, err := node.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Issue hedged requests and make sure the failing originals are covered
+	conn.SetHedging(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if rep, err := conn.Request("failover-test", []byte{byte(i)}, 3*time.Second); err != nil {
+			t.Fatalf("failed to send request: %v.", err)
+		} else if rep[0] != byte(i) {
+			t.Fatalf("req/rep mismatch: have %v, want %v.", rep[0], i)
+		}
+	}
+	// Make sure each member served each request at most once
+	lock.Lock()
+	defer lock.Unlock()
+	for i, handler := range handlers {
+		for req, count := range handler.local {
+			if count > 1 {
+				t.Fatalf("member %d: request %d served %d times.", i, req, count)
+			}
+		}
+	}
+}
+
+// Connection handler counting the served requests.
+type counter struct {
+	served uint32
+}
+
+func (c *counter) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to counting handler")
+}
+
+func (c *counter) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	atomic.AddUint32(&c.served, 1)
+	return req, nil
+}
+
+func (c *counter) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on counting handler")
+}
+
+// Tests that cancelled hedged requests are dropped if still queued.
+func TestReqRepHedgingCancel(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	oldThreads := config.IrisHandlerThreads
+	config.IrisHandlerThreads = 1
+	defer func() { config.IrisHandlerThreads = oldThreads }()
+
+	// Boot a single iris overlay and connect a counting service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("reqrep-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handler := new(counter)
+	conn, err := node.Connect("cancel-test", handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Stall the handler pool and queue a few hedged requests behind it
+	release := make(chan struct{})
+	conn.schedule(func() { <-release })
+
+	self := node.scribe.Self()
+	for i := 0; i < 4; i++ {
+		conn.scheduleHedgedRequest(self, 1000, uint64(i), []byte{byte(i)}, time.Second)
+	}
+	// Cancel half of them, release the pool and ensure only the rest are served
+	conn.handleCancel(self, 1000, 0)
+	conn.handleCancel(self, 1000, 2)
+	conn.handleCancel(self, 1001, 1)
+	close(release)
+
+	time.Sleep(100 * time.Millisecond)
+	if served := atomic.LoadUint32(&handler.served); served != 2 {
+		t.Fatalf("served request count mismatch: have %d, want %d.", served, 2)
+	}
+}
+
+// Tests that requests to clusters without reachable members fail fast.
+func TestUnreachableRequests(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a lone iris overlay and connect a requester
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("unreachable-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("unreachable-client", &stateful{0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer conn.Close()
+
+	// Request a non-existent cluster and ensure it fails way before the timeout
+	start := time.Now()
+	if _, err := conn.Request("unreachable-cluster", []byte{0}, 5*time.Second); err != ErrUnreachable {
+		t.Fatalf("unreachable request error mismatch: have %v, want %v.", err, ErrUnreachable)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("unreachable request failed too slowly: have %v, want below %v.", elapsed, time.Second)
 	}
 }
@@ -0,0 +1,358 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the resumption of networked tunnels: the sent data chunks are kept
+// until acknowledged by the remote endpoint, and if the link breaks while both
+// endpoints are still alive, a new link is established in its place and the
+// unacknowledged chunks are replayed over it.
+//
+// Chunks are acknowledged once consumed by the remote application, and at most
+// config.IrisTunnelBuffer may be outstanding (blocking the sender beyond). This
+// bounds the replay buffer, and as the window matches the size of the remote
+// inbox, the receiver never blocks on it and acknowledgements always get through.
+
+package iris
+
+import (
+	"hash/crc32"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/stream"
+)
+
+// Data chunk sent through a tunnel, retained until acknowledged.
+type replayChunk struct {
+	seq  uint64 // Sequence number of the chunk
+	size int    // Size of the original message, or 0 if not the first chunk
+	data []byte // Plaintext copy of the chunk
+}
+
+// Retrieves the current link of the tunnel and the channel signalling its break.
+func (t *Tunnel) link() (*link.Link, chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.conn, t.broken
+}
+
+// Assigns the next sequence number to an outbound chunk and buffers a copy of
+// it for replaying if the link breaks before the remote acknowledges it.
+func (t *Tunnel) buffer(size int, chunk []byte) uint64 {
+	data := make([]byte, len(chunk))
+	copy(data, chunk)
+
+	t.replayLock.Lock()
+	defer t.replayLock.Unlock()
+
+	seq := t.seqOut
+	t.seqOut++
+	t.replay = append(t.replay, &replayChunk{seq: seq, size: size, data: data})
+	return seq
+}
+
+// Removes the last buffered chunk if it could not be queued for sending.
+func (t *Tunnel) unbuffer() {
+	t.replayLock.Lock()
+	defer t.replayLock.Unlock()
+
+	t.seqOut--
+	t.replay = t.replay[:len(t.replay)-1]
+	<-t.window
+}
+
+// Drops all the buffered chunks below the remotely acknowledged count.
+func (t *Tunnel) acknowledge(count uint64) {
+	t.replayLock.Lock()
+	defer t.replayLock.Unlock()
+
+	done := 0
+	for done < len(t.replay) && t.replay[done].seq < count {
+		done++
+	}
+	t.replay = t.replay[done:]
+
+	// Release the window slots of the acknowledged chunks
+	for i := 0; i < done; i++ {
+		<-t.window
+	}
+}
+
+// Counts a data chunk consumed by the application, signalling the acker if the
+// acknowledgement interval was reached.
+func (t *Tunnel) consumed() {
+	if atomic.AddUint64(&t.seqRead, 1)%uint64(config.IrisTunnelAckInterval) == 0 {
+		t.signalAck()
+	}
+}
+
+// Signals the acker to send an acknowledgement. Pending signals are coalesced,
+// since acknowledgements are cumulative.
+func (t *Tunnel) signalAck() {
+	select {
+	case t.ackNow <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the cumulative acknowledgements of the consumed chunks whenever signalled.
+// If the link breaks meanwhile, the acknowledgement is sent again over the new
+// link after resumption.
+func (t *Tunnel) acker() {
+	for {
+		select {
+		case <-t.ackNow:
+		case <-t.term:
+			return
+		}
+		count := atomic.LoadUint64(&t.seqRead)
+		if count == 0 {
+			continue
+		}
+		ack := &proto.Message{
+			Head: proto.Header{
+				Meta: &dataHeader{Ack: count},
+			},
+		}
+		if err := ack.Encrypt(); err != nil {
+			log.Printf("iris: failed to encrypt tunnel acknowledgement: %v.", err)
+			continue
+		}
+		conn, broken := t.link()
+		select {
+		case conn.Send <- ack:
+		case <-broken:
+		case <-t.term:
+			return
+		}
+	}
+}
+
+// Reads the packets of the networked tunnel links, verifying and queueing the
+// data chunks for the application, processing the acknowledgements and resuming
+// the tunnel if the link breaks.
+func (t *Tunnel) receiver() {
+	conn, _ := t.link()
+	closed := false
+
+	for {
+		select {
+		case packet, ok := <-conn.Recv:
+			if ok {
+				if !t.process(conn, packet, &closed) {
+					return
+				}
+				continue
+			}
+			// Link closed, terminate if gracefully, try to resume otherwise
+			if closed {
+				return
+			}
+			select {
+			case <-t.term:
+				return
+			default:
+			}
+			if conn = t.resume(); conn == nil {
+				close(t.inbox)
+				t.Close()
+				return
+			}
+		case fresh := <-t.relink:
+			// Remote already resumed while the local link seemed alive
+			if !t.swap(fresh) {
+				return
+			}
+			conn = fresh
+
+		case <-t.term:
+			return
+		}
+	}
+}
+
+// Processes a single packet arrived through the tunnel link, returning whether
+// the receiver should continue or the tunnel was torn down.
+func (t *Tunnel) process(conn *link.Link, packet *proto.Message, closed *bool) bool {
+	// Decrypt and verify the integrity of the chunk
+	if err := packet.Decrypt(); err != nil {
+		log.Printf("iris: failed to decrypt tunnel packet: %v.", err)
+		t.abort(ErrCorrupted, true)
+		return false
+	}
+	head := packet.Head.Meta.(*dataHeader)
+	switch {
+	case head.Corrupt:
+		t.abort(ErrCorrupted, false)
+		return false
+
+	case crc32.ChecksumIEEE(packet.Data) != head.Checksum:
+		t.abort(ErrCorrupted, true)
+		return false
+
+	case head.Close:
+		// Remote endpoint closed, deliver the pending chunks and terminate
+		*closed = true
+		close(t.inbox)
+
+	case head.Ack > 0:
+		t.acknowledge(head.Ack)
+
+	case head.Seq < t.seqIn:
+		// Duplicate chunk replayed after a resumption, drop
+
+	case head.Seq > t.seqIn:
+		log.Printf("iris: tunnel sequence gap: have %v, want %v.", head.Seq, t.seqIn)
+		t.abort(ErrCorrupted, true)
+		return false
+
+	default:
+		// The remote never exceeds the inbox size unacknowledged, so this won't block
+		select {
+		case t.inbox <- packet:
+		case <-t.term:
+			return false
+		}
+		t.seqIn++
+	}
+	return true
+}
+
+// Flags the current link broken and tries to establish a new one within the
+// resumption timeout: the dialing endpoint redials the remote listeners, while
+// the listening endpoint waits for the remote to do so. Returns the new link or
+// nil if the tunnel could not be resumed.
+func (t *Tunnel) resume() *link.Link {
+	// Release any sender blocked on the broken link
+	t.lock.Lock()
+	close(t.broken)
+	t.lock.Unlock()
+
+	deadline := time.Now().Add(config.IrisTunnelResumeTimeout)
+
+	var conn *link.Link
+	if t.addrs != nil {
+		conn = t.redial(deadline)
+	} else {
+		select {
+		case conn = <-t.relink:
+		case <-t.term:
+		case <-time.After(config.IrisTunnelResumeTimeout):
+		}
+	}
+	if conn == nil || !t.swap(conn) {
+		return nil
+	}
+	return conn
+}
+
+// Repeatedly dials the remote tunnel listeners until a link is re-established,
+// the deadline passes or the tunnel is closed.
+func (t *Tunnel) redial(deadline time.Time) *link.Link {
+	for time.Now().Before(deadline) {
+		for _, addr := range t.addrs {
+			strm, err := stream.Dial(addr, deadline.Sub(time.Now()))
+			if err != nil {
+				continue
+			}
+			conn, err := t.owner.initClientTunnel(strm, t.remote, t.remId, t.secret, deadline, true)
+			if err == nil {
+				return conn
+			}
+			if err := strm.Close(); err != nil {
+				log.Printf("iris: failed to close unresumed tunnel stream: %v.", err)
+			}
+		}
+		select {
+		case <-t.term:
+			return nil
+		case <-time.After(config.IrisTunnelResumeRetry):
+		}
+	}
+	return nil
+}
+
+// Replaces the link of the tunnel with a freshly established one and replays
+// all the unacknowledged chunks through it. Returns false if the tunnel was
+// closed in the mean time.
+func (t *Tunnel) swap(conn *link.Link) bool {
+	// Release any sender blocked on the old link and block new ones
+	t.lock.Lock()
+	select {
+	case <-t.broken:
+	default:
+		close(t.broken)
+	}
+	t.lock.Unlock()
+
+	t.sendLock.Lock()
+
+	t.lock.Lock()
+	select {
+	case <-t.term:
+		t.lock.Unlock()
+		t.sendLock.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	old := t.conn
+	t.conn, t.broken = conn, make(chan struct{})
+	broken := t.broken
+	t.lock.Unlock()
+
+	go old.Close()
+
+	// Acknowledge the consumed chunks anew, the last one may have been lost
+	t.signalAck()
+
+	// Replay the unacknowledged chunks before allowing new sends
+	t.replayLock.Lock()
+	chunks := make([]*replayChunk, len(t.replay))
+	copy(chunks, t.replay)
+	t.replayLock.Unlock()
+
+	go func() {
+		defer t.sendLock.Unlock()
+
+		for _, chunk := range chunks {
+			packet := &proto.Message{
+				Head: proto.Header{
+					Meta: &dataHeader{SizeOrCont: chunk.size, Checksum: crc32.ChecksumIEEE(chunk.data), Seq: chunk.seq},
+				},
+				Data: append([]byte(nil), chunk.data...),
+			}
+			if err := packet.Encrypt(); err != nil {
+				log.Printf("iris: failed to encrypt replayed chunk: %v.", err)
+				return
+			}
+			select {
+			case conn.Send <- packet:
+			case <-broken:
+				return
+			case <-t.term:
+				return
+			}
+		}
+	}()
+	return true
+}
@@ -0,0 +1,225 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the per-connection statistics gathering: a set of atomic counters
+// and a few bounded latency samplers to compute percentiles from.
+
+package iris
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Latency distribution of a set of operations, computed over the most recent
+// config.IrisStatsSamples measurements.
+type Latency struct {
+	Samples int           // Number of samples the percentiles were computed from
+	P50     time.Duration // Median latency
+	P90     time.Duration // 90th percentile latency
+	P99     time.Duration // 99th percentile latency
+	Max     time.Duration // Maximum latency in the sample window
+}
+
+// Point in time snapshot of the messaging statistics of a connection.
+type Stats struct {
+	RequestsSent   uint64 // Number of requests issued through the connection
+	RequestsServed uint64 // Number of requests handled by the connection
+	RequestsFailed uint64 // Number of issued requests failed remotely
+	RequestsHedged uint64 // Number of issued requests duplicated due to hedging
+
+	BroadcastsSent uint64 // Number of broadcasts issued through the connection
+	BroadcastsRecv uint64 // Number of broadcasts delivered to the connection
+	PublishesSent  uint64 // Number of events published through the connection
+	PublishesRecv  uint64 // Number of events delivered to the subscriptions
+
+	TunnelBytesSent uint64 // Number of payload bytes sent through tunnels
+	TunnelBytesRecv uint64 // Number of payload bytes received through tunnels
+
+	Timeouts      uint64 // Number of requests and tunnel operations timed out
+	HandlerErrors uint64 // Number of requests failed by the local handler
+	HandlerPanics uint64 // Number of recovered handler panics
+	HandlerDrops  uint64 // Number of inbound messages rejected by full handler queues
+	Backpressured uint64 // Number of outbound operations held back by carrier congestion
+
+	RequestLatency Latency // Round trip time of the issued requests
+	ServeLatency   Latency // Processing time of the handled requests
+}
+
+// Live statistics counters of a connection. The counters are first in the
+// struct to guarantee 64 bit alignment for the atomic operations.
+type statistics struct {
+	reqSent   uint64
+	reqServed uint64
+	reqFailed uint64
+	reqHedged uint64
+
+	bcastSent uint64
+	bcastRecv uint64
+	pubSent   uint64
+	pubRecv   uint64
+
+	tunSent uint64
+	tunRecv uint64
+
+	timeouts uint64
+	failures uint64
+	panics   uint64
+	rejects  uint64
+
+	pressured uint64
+
+	reqLatency   *sampler // Round trip times of the outbound requests
+	serveLatency *sampler // Handler execution times of the inbound requests
+}
+
+// Creates a new, zeroed out statistics counter set.
+func newStatistics() *statistics {
+	return &statistics{
+		reqLatency:   newSampler(config.IrisStatsSamples),
+		serveLatency: newSampler(config.IrisStatsSamples),
+	}
+}
+
+// Atomically increments a statistics counter by delta.
+func (s *statistics) add(counter *uint64, delta int) {
+	atomic.AddUint64(counter, uint64(delta))
+}
+
+// Collects a consistent-enough snapshot of the current counter values.
+func (s *statistics) snapshot() *Stats {
+	return &Stats{
+		RequestsSent:    atomic.LoadUint64(&s.reqSent),
+		RequestsServed:  atomic.LoadUint64(&s.reqServed),
+		RequestsFailed:  atomic.LoadUint64(&s.reqFailed),
+		RequestsHedged:  atomic.LoadUint64(&s.reqHedged),
+		BroadcastsSent:  atomic.LoadUint64(&s.bcastSent),
+		BroadcastsRecv:  atomic.LoadUint64(&s.bcastRecv),
+		PublishesSent:   atomic.LoadUint64(&s.pubSent),
+		PublishesRecv:   atomic.LoadUint64(&s.pubRecv),
+		TunnelBytesSent: atomic.LoadUint64(&s.tunSent),
+		TunnelBytesRecv: atomic.LoadUint64(&s.tunRecv),
+		Timeouts:        atomic.LoadUint64(&s.timeouts),
+		HandlerErrors:   atomic.LoadUint64(&s.failures),
+		HandlerPanics:   atomic.LoadUint64(&s.panics),
+		HandlerDrops:    atomic.LoadUint64(&s.rejects),
+		Backpressured:   atomic.LoadUint64(&s.pressured),
+		RequestLatency:  s.reqLatency.latency(),
+		ServeLatency:    s.serveLatency.latency(),
+	}
+}
+
+// Bounded ring buffer of latency measurements.
+type sampler struct {
+	samples []time.Duration // Ring buffer of the measured latencies
+	next    int             // Index of the next slot to overwrite
+	full    bool            // Flag whether the ring buffer wrapped already
+	lock    sync.Mutex      // Mutex protecting the ring buffer
+}
+
+// Creates a new latency sampler retaining at most limit measurements.
+func newSampler(limit int) *sampler {
+	if limit < 1 {
+		limit = 1
+	}
+	return &sampler{
+		samples: make([]time.Duration, limit),
+	}
+}
+
+// Inserts a new latency measurement, evicting the oldest if full.
+func (s *sampler) record(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.samples[s.next] = latency
+	s.next++
+	if s.next == len(s.samples) {
+		s.next, s.full = 0, true
+	}
+}
+
+// Computes the latency percentiles of the currently retained measurements.
+func (s *sampler) latency() Latency {
+	// Copy out the retained samples to sort outside of the lock
+	s.lock.Lock()
+	count := s.next
+	if s.full {
+		count = len(s.samples)
+	}
+	sorted := make([]time.Duration, count)
+	copy(sorted, s.samples[:count])
+	s.lock.Unlock()
+
+	if count == 0 {
+		return Latency{}
+	}
+	sort.Sort(durationSlice(sorted))
+
+	return Latency{
+		Samples: count,
+		P50:     percentile(sorted, 50),
+		P90:     percentile(sorted, 90),
+		P99:     percentile(sorted, 99),
+		Max:     sorted[count-1],
+	}
+}
+
+// Computes the median of the most recent count measurements, or zero if none
+// were retained yet.
+func (s *sampler) recent(count int) time.Duration {
+	s.lock.Lock()
+	avail := s.next
+	if s.full {
+		avail = len(s.samples)
+	}
+	if count > avail {
+		count = avail
+	}
+	sorted := make([]time.Duration, count)
+	for i := 0; i < count; i++ {
+		sorted[i] = s.samples[(s.next-1-i+len(s.samples))%len(s.samples)]
+	}
+	s.lock.Unlock()
+
+	if count == 0 {
+		return 0
+	}
+	sort.Sort(durationSlice(sorted))
+	return percentile(sorted, 50)
+}
+
+// Picks the nearest-rank percentile from a non-empty sorted sample set.
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	rank := (pct*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Sortable duration slice.
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
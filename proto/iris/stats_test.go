@@ -0,0 +1,81 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2014 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsSampler(t *testing.T) {
+	// Empty sampler should report an empty distribution
+	s := newSampler(100)
+	if lat := s.latency(); lat != (Latency{}) {
+		t.Fatalf("empty sampler latency mismatch: have %v, want %v.", lat, Latency{})
+	}
+	if lat := s.recent(10); lat != 0 {
+		t.Fatalf("empty sampler recent latency mismatch: have %v, want %v.", lat, 0)
+	}
+	// Fill the sampler with a known distribution and check the percentiles
+	for i := 100; i > 0; i-- {
+		s.record(time.Duration(i) * time.Millisecond)
+	}
+	want := Latency{
+		Samples: 100,
+		P50:     50 * time.Millisecond,
+		P90:     90 * time.Millisecond,
+		P99:     99 * time.Millisecond,
+		Max:     100 * time.Millisecond,
+	}
+	if lat := s.latency(); lat != want {
+		t.Fatalf("full sampler latency mismatch: have %v, want %v.", lat, want)
+	}
+	if lat := s.recent(10); lat != 5*time.Millisecond {
+		t.Fatalf("full sampler recent latency mismatch: have %v, want %v.", lat, 5*time.Millisecond)
+	}
+	// Overwrite the oldest samples and make sure they are evicted
+	for i := 0; i < 50; i++ {
+		s.record(time.Second)
+	}
+	if lat := s.latency(); lat.Samples != 100 || lat.P50 != 50*time.Millisecond || lat.P90 != time.Second {
+		t.Fatalf("wrapped sampler latency mismatch: have %v.", lat)
+	}
+	if lat := s.recent(10); lat != time.Second {
+		t.Fatalf("wrapped sampler recent latency mismatch: have %v, want %v.", lat, time.Second)
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	s := newStatistics()
+	s.add(&s.reqSent, 3)
+	s.add(&s.tunSent, 1024)
+	s.add(&s.tunSent, 1024)
+	s.reqLatency.record(time.Millisecond)
+
+	snap := s.snapshot()
+	if snap.RequestsSent != 3 {
+		t.Fatalf("sent request count mismatch: have %v, want %v.", snap.RequestsSent, 3)
+	}
+	if snap.TunnelBytesSent != 2048 {
+		t.Fatalf("sent tunnel bytes mismatch: have %v, want %v.", snap.TunnelBytesSent, 2048)
+	}
+	if snap.RequestLatency.Samples != 1 || snap.RequestLatency.Max != time.Millisecond {
+		t.Fatalf("request latency mismatch: have %v.", snap.RequestLatency)
+	}
+}
@@ -0,0 +1,122 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the sticky requests: a balanced request can report which cluster
+// member served it, and follow-up requests can be directed to that member to
+// reach the instance holding the relevant state.
+
+package iris
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Returned when a directed request's member is not connected any more.
+var ErrMemberGone = errors.New("member gone")
+
+// Identity of a single cluster member (an Iris connection on a given node).
+type Member struct {
+	cluster string   // Cluster the member was discovered in
+	node    *big.Int // Iris node the member is connected to
+	conn    uint64   // Connection id of the member within its node
+}
+
+// Returns the cluster the member belongs to.
+func (m *Member) Cluster() string {
+	return m.cluster
+}
+
+// Implements fmt.Stringer, formatting the member identity.
+func (m *Member) String() string {
+	return fmt.Sprintf("%s@%v:%d", m.cluster, m.node, m.conn)
+}
+
+// Executes a synchronous request to cluster like Request, also returning the
+// member that served it, which later requests can be directed to.
+func (c *Connection) RequestSticky(cluster string, req []byte, timeout time.Duration) ([]byte, *Member, error) {
+	member := new(Member)
+	rep, err := c.chainRequest(func(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+		return c.requestFrom(cluster, "", req, timeout, member)
+	})(cluster, req, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rep, member, nil
+}
+
+// Executes a synchronous request directed to a specific, previously discovered
+// cluster member instead of balancing it. If the member is not connected any
+// more, ErrMemberGone is returned and the caller may fall back to Request.
+func (c *Connection) RequestMember(member *Member, req []byte, timeout time.Duration) ([]byte, error) {
+	return c.chainRequest(func(cluster string, req []byte, timeout time.Duration) ([]byte, error) {
+		return c.requestMember(member, req, timeout)
+	})(member.cluster, req, timeout)
+}
+
+// Executes a synchronous request directed to a member, with the interceptors
+// already applied.
+func (c *Connection) requestMember(member *Member, req []byte, timeout time.Duration) ([]byte, error) {
+	if err := c.throttleRequest(len(req)); err != nil {
+		return nil, err
+	}
+	// Create a reply and error channel for the results
+	repc := make(chan []byte, 1)
+	errc := make(chan error, 1)
+
+	c.reqLock.Lock()
+	reqId := c.reqIdx
+	c.reqIdx++
+	c.reqReps[reqId] = repc
+	c.reqErrs[reqId] = errc
+	c.reqLock.Unlock()
+
+	// Make sure the result channels are cleaned up
+	defer func() {
+		c.reqLock.Lock()
+		delete(c.reqReps, reqId)
+		delete(c.reqErrs, reqId)
+		close(repc)
+		close(errc)
+		c.reqLock.Unlock()
+	}()
+	// Send the request straight to the member
+	c.stats.add(&c.stats.reqSent, 1)
+	start := time.Now()
+
+	if err := c.iris.direct(member.node, c.assembleMemberRequest(member.conn, reqId, req, timeout)); err != nil {
+		return nil, err
+	}
+	// Retrieve the results, time out or fail if terminating
+	select {
+	case <-c.term:
+		return nil, ErrTerminating
+	case <-time.After(timeout):
+		c.stats.add(&c.stats.timeouts, 1)
+		return nil, ErrTimeout
+	case reply := <-repc:
+		c.stats.reqLatency.record(time.Since(start))
+		return reply, nil
+	case err := <-errc:
+		c.stats.add(&c.stats.reqFailed, 1)
+		c.stats.reqLatency.record(time.Since(start))
+		return nil, err
+	}
+}
@@ -0,0 +1,120 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Connection handler answering requests with its own identifier.
+type stateful struct {
+	id byte
+}
+
+func (s *stateful) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to stateful handler")
+}
+
+func (s *stateful) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return []byte{s.id}, nil
+}
+
+func (s *stateful) HandleTunnel(tun *Tunnel) {
+	panic("Inbound tunnel on stateful handler")
+}
+
+func (s *stateful) HandleDrop(reason error) {
+	panic("Connection dropped on stateful handler")
+}
+
+// Tests that follow-up requests can be directed to the member serving the first.
+func TestStickyRequests(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes, conns := 2, 3
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	// Boot the iris overlays
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	liveNodes := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		liveNodes[i] = New("sticky-test", key)
+		if _, err := liveNodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(liveNodes[i])
+	}
+	// Connect the requester to the first node and the members to the second
+	client, err := liveNodes[0].Connect("sticky-client", &stateful{0xff})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer client.Close()
+
+	members := make([]*Connection, conns)
+	for i := 0; i < conns; i++ {
+		if members[i], err = liveNodes[1].Connect("sticky-cluster", &stateful{byte(i)}); err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	// Discover a member and ensure follow-ups reach it
+	rep, member, err := client.RequestSticky("sticky-cluster", []byte{0}, time.Second)
+	if err != nil {
+		t.Fatalf("failed to execute sticky request: %v.", err)
+	}
+	if member.Cluster() != "sticky-cluster" {
+		t.Fatalf("member cluster mismatch: have %v, want %v.", member.Cluster(), "sticky-cluster")
+	}
+	for i := 0; i < 25; i++ {
+		res, err := client.RequestMember(member, []byte{byte(i)}, time.Second)
+		if err != nil {
+			t.Fatalf("failed to execute member request: %v.", err)
+		}
+		if res[0] != rep[0] {
+			t.Fatalf("member request served by another member: have %v, want %v.", res[0], rep[0])
+		}
+	}
+	// Drop the member and ensure directed requests fail fast
+	for i := 0; i < conns; i++ {
+		if i == int(rep[0]) {
+			members[i].Close()
+		} else {
+			defer members[i].Close()
+		}
+	}
+	if _, err := client.RequestMember(member, []byte{0}, time.Second); err != ErrMemberGone {
+		t.Fatalf("gone member request error mismatch: have %v, want %v.", err, ErrMemberGone)
+	}
+}
@@ -0,0 +1,208 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the live subscription state of a connection, allowing event delivery
+// to be temporarily paused and resumed without leaving the topic.
+
+package iris
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/filter"
+	"github.com/project-iris/iris/pool"
+)
+
+// Topic event buffered while the subscription is paused.
+type event struct {
+	attrs map[string]string // Attributes the event was published with
+	msg   []byte            // Payload of the event
+}
+
+// Live subscription of a connection to a topic.
+type Subscription struct {
+	conn    *Connection         // Connection owning the subscription
+	topic   string              // Topic the subscription belongs to
+	handler SubscriptionHandler // Application handler to deliver events to
+	filter  *filter.Filter      // Event filter to match the attributes against
+
+	paused   bool     // Flag whether event delivery is paused
+	flushing bool     // Flag whether the buffered events are being flushed
+	buffer   []*event // Events buffered while paused (or flushing)
+	dropped  uint64   // Number of events dropped due to a full pause buffer
+
+	pool *pool.ThreadPool // Dedicated handler pool of the topic (nil = connection's)
+
+	lock sync.Mutex // Mutex protecting the pause state
+}
+
+// Creates a new, active subscription to topic.
+func newSubscription(conn *Connection, topic string, handler SubscriptionHandler, filter *filter.Filter) *Subscription {
+	return &Subscription{
+		conn:    conn,
+		topic:   topic,
+		handler: handler,
+		filter:  filter,
+	}
+}
+
+// Retrieves the live subscription of a topic, or ErrNotSubscribed if none.
+func (c *Connection) Subscription(topic string) (*Subscription, error) {
+	c.subLock.RLock()
+	defer c.subLock.RUnlock()
+
+	if sub, ok := c.subLive[topicPrefixes[0]+topic]; ok {
+		return sub, nil
+	}
+	return nil, ErrNotSubscribed
+}
+
+// Returns the name of the subscribed topic.
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Returns the canonical form of the subscription's event filter (empty if none).
+func (s *Subscription) Filter() string {
+	return s.filter.String()
+}
+
+// Pauses event delivery to the handler. Arriving events are buffered up to the
+// config.IrisPauseBuffer limit, after which newer events are dropped.
+func (s *Subscription) Pause() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.paused = true
+}
+
+// Resumes event delivery to the handler, flushing any events buffered while the
+// subscription was paused. The flush runs on the topic's handler pool, holding
+// back newly arriving events until all the buffered ones are delivered.
+func (s *Subscription) Resume() {
+	s.lock.Lock()
+	if !s.paused {
+		s.lock.Unlock()
+		return
+	}
+	s.paused = false
+	if s.flushing || len(s.buffer) == 0 {
+		s.lock.Unlock()
+		return
+	}
+	// Swap out the buffer so events arriving during the flush queue up behind
+	batch := s.buffer
+	s.buffer = nil
+	s.flushing = true
+	s.lock.Unlock()
+
+	// Flush on the handler pool, or inline if it does not accept the task
+	task := func() { s.flush(batch) }
+	if err := s.conn.scheduleEvent(topicPrefixes[0]+s.topic, task); err != nil {
+		task()
+	}
+}
+
+// Delivers a batch of buffered events to the handler one after the other, and
+// then whatever got queued up meanwhile, until either all are flushed or the
+// subscription is paused again.
+func (s *Subscription) flush(batch []*event) {
+	for {
+		for i, evt := range batch {
+			// Requeue the rest in front if paused again mid-flush
+			s.lock.Lock()
+			if s.paused {
+				s.buffer = append(batch[i:], s.buffer...)
+				s.flushing = false
+				s.lock.Unlock()
+				return
+			}
+			s.lock.Unlock()
+
+			s.conn.protect("HandleEvent", fmt.Sprintf("topic %s, %d bytes", s.topic, len(evt.msg)), func() {
+				s.dispatch(evt.attrs, evt.msg)
+			})
+		}
+		s.lock.Lock()
+		if s.paused || len(s.buffer) == 0 {
+			s.flushing = false
+			s.lock.Unlock()
+			return
+		}
+		batch = s.buffer
+		s.buffer = nil
+		s.lock.Unlock()
+	}
+}
+
+// Returns whether the event delivery is currently paused.
+func (s *Subscription) Paused() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.paused
+}
+
+// Returns the number of events dropped due to overflowing the pause buffer.
+func (s *Subscription) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// Delivers an event to the handler, or buffers it if the subscription is paused
+// or still flushing the events buffered during a pause.
+func (s *Subscription) deliver(attrs map[string]string, msg []byte) {
+	s.lock.Lock()
+	if s.paused || s.flushing {
+		if len(s.buffer) < config.IrisPauseBuffer {
+			s.buffer = append(s.buffer, &event{attrs: attrs, msg: msg})
+		} else {
+			s.dropped++
+		}
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	s.dispatch(attrs, msg)
+}
+
+// Hands an event over to the handler, along with its attributes if requested.
+func (s *Subscription) dispatch(attrs map[string]string, msg []byte) {
+	if handler, ok := s.handler.(AttributedHandler); ok {
+		handler.HandleEventAttrs(attrs, msg)
+		return
+	}
+	s.handler.HandleEvent(msg)
+}
+
+// Terminates the dedicated handler pool of the subscription, if any.
+func (s *Subscription) terminate() {
+	s.lock.Lock()
+	workers := s.pool
+	s.pool = nil
+	s.lock.Unlock()
+
+	if workers != nil {
+		workers.Terminate(true)
+	}
+}
@@ -0,0 +1,82 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the carrier traffic statistics of the clusters and topics, meant for
+// finding the hot topics saturating a node.
+
+package iris
+
+import "github.com/project-iris/iris/proto/scribe"
+
+// Local node's carrier statistics of a cluster or topic, aggregated over all of
+// its split trees passing through the local node.
+type TopicStats struct {
+	Events    uint64 // Number of events received by the local node
+	Bytes     uint64 // Total payload size of the received events
+	Forwarded uint64 // Number of event copies forwarded to the children
+	Filtered  uint64 // Number of event copies withheld by subscription filters
+	Delivered uint64 // Number of events delivered to local members
+	Dropped   uint64 // Number of duplicate or undecryptable events dropped
+
+	Members int // Approximate number of members (largest over the split trees)
+	Depth   int // Distance of the local node from the roots (deepest over the split trees)
+}
+
+// Collects the carrier statistics of a topic at the local node, to spot hot
+// topics and the amount of traffic they route through.
+func (c *Connection) TopicStats(topic string) (*TopicStats, error) {
+	return c.iris.traffic(topicPrefixes, topic)
+}
+
+// Collects the carrier statistics of a cluster at the local node, to spot hot
+// clusters and the amount of traffic they route through.
+func (c *Connection) ClusterStats(cluster string) (*TopicStats, error) {
+	return c.iris.traffic(clusterPrefixes, cluster)
+}
+
+// Aggregates the carrier statistics of all the split trees of a cluster or topic.
+func (o *Overlay) traffic(prefixes []string, name string) (*TopicStats, error) {
+	stats := new(TopicStats)
+	found := false
+	for _, prefix := range prefixes {
+		snap, err := o.scribe.Stats(prefix + name)
+		if err == scribe.ErrNotParticipating {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		stats.Events += snap.Events
+		stats.Bytes += snap.Bytes
+		stats.Forwarded += snap.Forwarded
+		stats.Filtered += snap.Filtered
+		stats.Delivered += snap.Delivered
+		stats.Dropped += snap.Dropped
+
+		if snap.Members > stats.Members {
+			stats.Members = snap.Members
+		}
+		if snap.Depth > stats.Depth {
+			stats.Depth = snap.Depth
+		}
+		found = true
+	}
+	if !found {
+		return nil, ErrNotParticipating
+	}
+	return stats, nil
+}
@@ -0,0 +1,107 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the carrier statistics of a topic follow the published events.
+func TestTopicStats(t *testing.T) {
+	nodes, events := 3, 100
+
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot the iris overlays and subscribe to a topic from each
+	liveConns := make([]*Connection, nodes)
+	liveSubs := make([]*subscriber, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New("traffic-test", key)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot iris overlay: %v.", err)
+		}
+		defer func(node *Overlay) {
+			if err := node.Shutdown(); err != nil {
+				t.Fatalf("failed to terminate iris node: %v.", err)
+			}
+		}(node)
+
+		conn, err := node.Connect("traffic-test", &broadcaster{})
+		if err != nil {
+			t.Fatalf("failed to connect to the iris overlay: %v.", err)
+		}
+		defer conn.Close()
+
+		liveSubs[i] = &subscriber{msgs: make(chan []byte, events)}
+		if err := conn.Subscribe("traffic-topic", liveSubs[i]); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+		liveConns[i] = conn
+	}
+	time.Sleep(time.Second)
+
+	// Publish a batch of events and wait for all deliveries
+	for i := 0; i < events; i++ {
+		if err := liveConns[0].Publish("traffic-topic", []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to publish event: %v.", err)
+		}
+	}
+	for i, sub := range liveSubs {
+		for j := 0; j < events; j++ {
+			select {
+			case <-sub.msgs:
+			case <-time.After(time.Second):
+				t.Fatalf("subscriber %d: event %d not delivered.", i, j)
+			}
+		}
+	}
+	// Check the statistics on every node
+	for _, conn := range liveConns {
+		stats, err := conn.TopicStats("traffic-topic")
+		if err != nil {
+			t.Fatalf("failed to collect topic stats: %v.", err)
+		}
+		if stats.Events != uint64(events) || stats.Bytes != uint64(events) {
+			t.Fatalf("event count mismatch: have %v/%v, want %v/%v.", stats.Events, stats.Bytes, events, events)
+		}
+		if stats.Dropped != 0 {
+			t.Fatalf("dropped count mismatch: have %v, want %v.", stats.Dropped, 0)
+		}
+	}
+	if _, err := liveConns[0].ClusterStats("traffic-test"); err != nil {
+		t.Fatalf("failed to collect cluster stats: %v.", err)
+	}
+	if _, err := liveConns[0].TopicStats("traffic-topic-missing"); err != ErrNotParticipating {
+		t.Fatalf("missing topic stats mismatch: have %v, want %v.", err, ErrNotParticipating)
+	}
+}
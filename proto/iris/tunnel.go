@@ -24,11 +24,13 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"log"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
@@ -38,10 +40,14 @@ import (
 	"github.com/project-iris/iris/proto/stream"
 )
 
+// Tunnel specific errors
+var ErrCorrupted = errors.New("tunnel data corrupted")
+
 // The initialization packet when the tunnel is set up.
 type initPacket struct {
 	ConnId uint64 // Id of the Iris client connection requesting the tunnel
 	TunId  uint64 // Id of the tunnel being built
+	Resume bool   // Flag whether the link of an existing tunnel is re-established
 }
 
 // Authorization packet to send over the established encrypted tunnels.
@@ -51,7 +57,12 @@ type authPacket struct {
 
 // Header to attach to data transfer packets.
 type dataHeader struct {
-	SizeOrCont int // Size of the original message, or 0 if not the first chunk
+	SizeOrCont int    // Size of the original message, or 0 if not the first chunk
+	Checksum   uint32 // CRC32 (IEEE) checksum of the plaintext chunk
+	Corrupt    bool   // Flag signalling the remote end detected corruption
+	Seq        uint64 // Sequence number of the chunk to drop replayed duplicates
+	Ack        uint64 // Number of chunks received, if an acknowledgement packet
+	Close      bool   // Flag signalling the graceful close of the remote end
 }
 
 // Make sure the handshake packets are registered with gob.
@@ -117,13 +128,40 @@ func (o *Overlay) tunneler(ip net.IP, live chan struct{}, quit chan chan error)
 type Tunnel struct {
 	id    uint64      // Auto-incremented tunnel identifier
 	owner *Connection // Iris connection through which to communicate
+	group string      // Cluster of an outbound tunnel (admission control)
+
+	conn   *link.Link    // Encrypted data link of the tunnel
+	secret []byte        // Master key from which to derive the link keys
+	broken chan struct{} // Channel closed when the current link breaks
+
+	remote uint64   // Id of the remote connection (dialing endpoint, resumption)
+	remId  uint64   // Id of the remote tunnel (dialing endpoint, resumption)
+	addrs  []string // Listener endpoints of the remote (dialing endpoint, resumption)
+
+	relink  chan *link.Link // Channel to receive re-established links (listening endpoint)
+	seqIn   uint64          // Number of data chunks received (receiver go-routine only)
+	seqOut  uint64          // Sequence number of the next data chunk to send
+	seqRead uint64          // Number of data chunks consumed by the application (atomic)
+	replay  []*replayChunk  // Sent but unacknowledged chunks to replay after resumption
+	window  chan struct{}   // Slots of the unacknowledged chunks, blocking senders when full
+	ackNow  chan struct{}   // Channel to signal a pending acknowledgement to the acker
 
-	conn   *link.Link // Encrypted data link of the tunnel
-	secret []byte     // Master key from which to derive the link keys
+	replayLock sync.Mutex // Lock protecting the replay buffer
+	sendLock   sync.Mutex // Lock serializing the sends with the replays
+
+	peer  *Tunnel             // Opposite endpoint of an in-process tunnel
+	inbox chan *proto.Message // Queue of the received (verified) messages
 
 	initDone chan *link.Link // Channel to receive the reverse tunnel link
 	initStop chan struct{}   // Channel to signal initialization abortion
 
+	readBuf  []byte     // Leftover data of a partially read chunk (net.Conn)
+	readLock sync.Mutex // Lock serializing the stream reads
+
+	readDead  deadline // Deadline for the stream reads (net.Conn)
+	writeDead deadline // Deadline for the stream writes (net.Conn)
+
+	fail error         // Failure that caused the tunnel to be torn down
 	term chan struct{} // Channel to signal termination to blocked go-routines
 	lock sync.Mutex    // Lock protecting the termination flag (init/close race)
 }
@@ -131,21 +169,32 @@ type Tunnel struct {
 // Initiates an outgoing tunnel to a remote cluster, by configuring a local
 // tunnel endpoint and requesting the remote client to connect to it.
 func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tunnel, error) {
+	// Short-circuit the tunnel if the balancer picked a local member
+	prefixIdx := int(atomic.AddUint32(&c.splitId, 1)) % config.IrisClusterSplits
+	local, send := c.iris.pick(clusterPrefixes[prefixIdx] + cluster)
+	if local != nil {
+		return c.initiateLocalTunnel(cluster, local, timeout)
+	}
 	// Create a potential tunnel
-	c.tunLock.Lock()
-	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
 		owner: c,
+		group: cluster,
+
+		broken: make(chan struct{}),
+		relink: make(chan *link.Link),
+		window: make(chan struct{}, config.IrisTunnelBuffer),
+		ackNow: make(chan struct{}, 1),
+		inbox:  make(chan *proto.Message, config.IrisTunnelBuffer),
 
 		initDone: make(chan *link.Link),
 		initStop: make(chan struct{}),
 
 		term: make(chan struct{}),
 	}
-	c.tunIdx++
-	c.tunLive[tunId] = tun
-	c.tunLock.Unlock()
+	if err := c.trackTunnel(tun, timeout); err != nil {
+		return nil, err
+	}
+	tunId := tun.id
 
 	// Create the master encryption key
 	tun.secret = make([]byte, config.StsCipherBits>>3)
@@ -153,8 +202,7 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 		return nil, err
 	}
 	// Send the tunneling request
-	prefixIdx := int(tunId) % config.IrisClusterSplits
-	c.iris.scribe.Balance(clusterPrefixes[prefixIdx]+cluster, c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
+	send(c.assembleTunnelRequest(tunId, tun.secret, c.iris.tunAddrs, timeout))
 
 	// Retrieve the results, time out or terminate
 	var err error
@@ -176,35 +224,78 @@ func (c *Connection) initiateTunnel(cluster string, timeout time.Duration) (*Tun
 			conn.Close()
 			return nil, ErrTerminating
 		default:
-			// Finalize tunnel initiation and return
-			tun.conn, tun.secret, tun.initDone, tun.initStop = conn, nil, nil, nil
+			// Finalize tunnel initiation and return (secret retained for resumption)
+			tun.conn, tun.initDone, tun.initStop = conn, nil, nil
+			go tun.receiver()
+			go tun.acker()
 			return tun, nil
 		}
 	}
 	// Tunneling failed, clean up and report error
-	c.tunLock.Lock()
-	delete(c.tunLive, tunId)
-	c.tunLock.Unlock()
-
+	c.untrackTunnel(tun)
 	return nil, err
 }
 
+// Creates an in-process tunnel pair between two local connections, bypassing
+// the network stack and encryption altogether.
+func (c *Connection) initiateLocalTunnel(cluster string, dest *Connection, timeout time.Duration) (*Tunnel, error) {
+	local := &Tunnel{
+		owner: c,
+		group: cluster,
+		inbox: make(chan *proto.Message, config.IrisTunnelBuffer),
+		term:  make(chan struct{}),
+	}
+	remote := &Tunnel{
+		owner: dest,
+		inbox: make(chan *proto.Message, config.IrisTunnelBuffer),
+		term:  make(chan struct{}),
+	}
+	local.peer, remote.peer = remote, local
+
+	// Track both endpoints in their owning connections
+	if err := c.trackTunnel(local, timeout); err != nil {
+		return nil, err
+	}
+	if err := dest.trackTunnel(remote, 0); err != nil {
+		c.untrackTunnel(local)
+		return nil, err
+	}
+
+	// Hand the remote endpoint to the destination handler
+	handle := func() {
+		dest.protect("HandleTunnel", fmt.Sprintf("local tunnel %d from connection %d", remote.id, c.id), func() {
+			dest.handler.HandleTunnel(remote)
+		})
+	}
+	if err := dest.schedule(handle); err != nil {
+		remote.Close()
+		local.Close()
+		return nil, err
+	}
+	return local, nil
+}
+
 // Accepts an incoming tunneling request from a remote, initializes and stores
 // the new tunnel into the connection state.
 func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []string, timeout time.Duration) (*Tunnel, error) {
 	deadline := time.Now().Add(timeout)
 
 	// Create the local tunnel endpoint
-	c.tunLock.Lock()
-	tunId := c.tunIdx
 	tun := &Tunnel{
-		id:    tunId,
-		owner: c,
-		term:  make(chan struct{}),
+		owner:  c,
+		secret: key,
+		broken: make(chan struct{}),
+		remote: remote,
+		remId:  id,
+		addrs:  addrs,
+		window: make(chan struct{}, config.IrisTunnelBuffer),
+		ackNow: make(chan struct{}, 1),
+		inbox:  make(chan *proto.Message, config.IrisTunnelBuffer),
+		term:   make(chan struct{}),
+	}
+	if err := c.trackTunnel(tun, 0); err != nil {
+		return nil, err
 	}
-	c.tunIdx++
-	c.tunLive[tunId] = tun
-	c.tunLock.Unlock()
 
 	// Dial the remote tunnel listener
 	var err error
@@ -218,7 +309,7 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 	// If no error occurred, initialize the client endpoint
 	if err == nil {
 		var conn *link.Link
-		conn, err = c.initClientTunnel(strm, remote, id, key, deadline)
+		conn, err = c.initClientTunnel(strm, remote, id, key, deadline, false)
 		if err != nil {
 			if err := strm.Close(); err != nil {
 				log.Printf("iris: failed to close uninitialized client tunnel stream: %v.", err)
@@ -232,15 +323,15 @@ func (c *Connection) buildTunnel(remote uint64, id uint64, key []byte, addrs []s
 				err = ErrTerminating
 			default:
 				tun.conn = conn
+				go tun.receiver()
+				go tun.acker()
 			}
 			tun.lock.Unlock()
 		}
 	}
 	// Tunneling failed, clean up and report error
 	if err != nil {
-		c.tunLock.Lock()
-		delete(c.tunLive, tunId)
-		c.tunLock.Unlock()
+		c.untrackTunnel(tun)
 		return nil, err
 	}
 	return tun, nil
@@ -269,6 +360,12 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	if !ok {
 		return errors.New("tunnel not found")
 	}
+	tun.lock.Lock()
+	pending := tun.initDone != nil
+	tun.lock.Unlock()
+	if pending == init.Resume {
+		return errors.New("tunnel state mismatch")
+	}
 	// Create the encrypted link
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
 	hkdf := hkdf.New(hasher, tun.secret, config.HkdfSalt, config.HkdfInfo)
@@ -290,6 +387,19 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	}
 	conn.Start(config.IrisTunnelBuffer)
 
+	// Hand a resumed link over to the tunnel receiver
+	if init.Resume {
+		select {
+		case tun.relink <- conn:
+			return nil
+		case <-tun.term:
+			conn.Close()
+			return nil
+		case <-time.After(config.IrisTunnelInitTimeout):
+			conn.Close()
+			return errors.New("resumption not awaited")
+		}
+	}
 	// Send back the initialized link to the pending tunnel
 	select {
 	case tun.initDone <- conn:
@@ -302,14 +412,15 @@ func (o *Overlay) initServerTunnel(strm *stream.Stream) error {
 	}
 }
 
-// Initializes a stream into an encrypted tunnel link.
-func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, deadline time.Time) (*link.Link, error) {
+// Initializes a stream into an encrypted tunnel link, optionally resuming the
+// already established remote tunnel.
+func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uint64, key []byte, deadline time.Time, resume bool) (*link.Link, error) {
 	// Set a socket deadline for finishing the handshake
 	strm.Sock().SetDeadline(deadline)
 	defer strm.Sock().SetDeadline(time.Time{})
 
 	// Send the unencrypted tunnel id to associate with the remote tunnel
-	init := &initPacket{ConnId: remote, TunId: id}
+	init := &initPacket{ConnId: remote, TunId: id, Resume: resume}
 	if err := strm.Send(init); err != nil {
 		return nil, err
 	}
@@ -340,14 +451,27 @@ func (c *Connection) initClientTunnel(strm *stream.Stream, remote uint64, id uin
 
 // Closes the tunnel connection.
 func (t *Tunnel) Close() error {
-	if t.owner.handleTunnelClose(t.id) {
+	if t.owner.handleTunnelClose(t) {
 		// Synchronize between close and finishing init
 		t.lock.Lock()
 		defer t.lock.Unlock()
 		close(t.term)
 
-		// Handle race between close and init
+		// Handle race between close and init (in-process tunnels need no cleanup)
 		if t.conn != nil {
+			// Notify the remote of the graceful close, unless the link is broken
+			packet := &proto.Message{
+				Head: proto.Header{
+					Meta: &dataHeader{Close: true},
+				},
+			}
+			if err := packet.Encrypt(); err == nil {
+				select {
+				case t.conn.Send <- packet:
+				case <-t.broken:
+				case <-time.After(config.SessionGraceTimeout):
+				}
+			}
 			return t.conn.Close()
 		}
 		return nil
@@ -357,43 +481,232 @@ func (t *Tunnel) Close() error {
 
 // Sends an asynchronous message to the remote pair. Not reentrant (order).
 func (t *Tunnel) Send(size int, chunk []byte) error {
-	// Create and encrypt the message
+	return t.send(size, chunk, nil)
+}
+
+// Sends an asynchronous message to the remote pair, blocking at most until the
+// deadline fires if the send queue is full (nil deadline blocks indefinitely).
+// Deadline changes are picked up by an already blocked send too.
+func (t *Tunnel) send(size int, chunk []byte, dead *deadline) error {
+	// Refuse sending into a failed tunnel
+	if err := t.failure(); err != nil {
+		return err
+	}
+	if err := t.owner.throttleBytes(len(chunk)); err != nil {
+		return err
+	}
+	// Create the message
 	packet := &proto.Message{
 		Head: proto.Header{
-			Meta: &dataHeader{size},
+			Meta: &dataHeader{SizeOrCont: size},
 		},
 		Data: chunk,
 	}
+	// Short-circuit in-process tunnels directly to the peer
+	if t.peer != nil {
+		for {
+			timer, changed := dead.watch()
+			select {
+			case t.peer.inbox <- packet:
+				timer.Stop()
+				t.owner.stats.add(&t.owner.stats.tunSent, len(chunk))
+				return nil
+			case <-t.peer.term:
+				timer.Stop()
+				return errors.New("closed")
+			case <-t.term:
+				timer.Stop()
+				return errors.New("closed")
+			case <-timer.C:
+				return ErrTimeout
+			case <-changed:
+				timer.Stop()
+			}
+		}
+	}
+	// Wait for a free slot in the unacknowledged window (never under the send
+	// lock, since resumption needs it while acknowledgements free the slots)
+	for reserved := false; !reserved; {
+		timer, changed := dead.watch()
+		select {
+		case t.window <- struct{}{}:
+			timer.Stop()
+			reserved = true
+		case <-t.term:
+			timer.Stop()
+			return errors.New("closed")
+		case <-timer.C:
+			return ErrTimeout
+		case <-changed:
+			timer.Stop()
+		}
+	}
+	// Checksum, number and buffer the networked message for resumption
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+
+	head := packet.Head.Meta.(*dataHeader)
+	head.Checksum = crc32.ChecksumIEEE(chunk)
+	head.Seq = t.buffer(size, chunk)
+
 	if err := packet.Encrypt(); err != nil {
+		t.unbuffer()
 		return err
 	}
 	// Queue the message for sending
-	select {
-	case t.conn.Send <- packet:
-		return nil
-	case <-t.term:
-		return errors.New("closed")
+	conn, broken := t.link()
+	for {
+		timer, changed := dead.watch()
+		select {
+		case conn.Send <- packet:
+			timer.Stop()
+			t.owner.stats.add(&t.owner.stats.tunSent, len(chunk))
+			return nil
+		case <-broken:
+			// Link broke, the buffered message is replayed after resumption
+			timer.Stop()
+			select {
+			case <-t.term:
+				return errors.New("closed")
+			default:
+				t.owner.stats.add(&t.owner.stats.tunSent, len(chunk))
+				return nil
+			}
+		case <-t.term:
+			timer.Stop()
+			return errors.New("closed")
+		case <-timer.C:
+			t.unbuffer()
+			return ErrTimeout
+		case <-changed:
+			timer.Stop()
+		}
 	}
 }
 
 // Retrieves a message waiting in the local queue. If none is available, the
 // call blocks until either one arrives or a timeout is reached.
 func (t *Tunnel) Recv(timeout time.Duration) (int, []byte, error) {
-	// Retrieve an encrypted packet from the tunnel link
+	return t.recv(&deadline{when: time.Now().Add(timeout)})
+}
+
+// Retrieves a message waiting in the local queue, blocking until one arrives,
+// the tunnel is closed or the deadline fires (nil deadline never fires).
+// Deadline changes are picked up by an already blocked receive too.
+func (t *Tunnel) recv(dead *deadline) (int, []byte, error) {
+	for {
+		timer, changed := dead.watch()
+
+		var (
+			size  int
+			chunk []byte
+			err   error
+			done  bool
+		)
+		// Short-circuit in-process tunnels directly from the inbox
+		if t.peer != nil {
+			size, chunk, err, done = t.recvLocal(timer, changed)
+		} else {
+			size, chunk, err, done = t.recvRemote(timer, changed)
+		}
+		if done {
+			timer.Stop()
+			return size, chunk, err
+		}
+	}
+}
+
+// Retrieves a verified packet from the tunnel receiver, or reports not done if
+// the deadline changed meanwhile.
+func (t *Tunnel) recvRemote(timer *deadTimer, changed <-chan struct{}) (int, []byte, error, bool) {
 	select {
-	case packet, ok := <-t.conn.Recv:
+	case packet, ok := <-t.inbox:
 		// Terminate the tunnel if closed remotely
 		if !ok {
 			t.Close()
-			return 0, nil, ErrTerminating
+			if err := t.failure(); err != nil {
+				return 0, nil, err, true
+			}
+			return 0, nil, ErrTerminating, true
+		}
+		t.owner.stats.add(&t.owner.stats.tunRecv, len(packet.Data))
+		t.consumed()
+		return packet.Head.Meta.(*dataHeader).SizeOrCont, packet.Data, nil, true
+
+	case <-t.term:
+		if err := t.failure(); err != nil {
+			return 0, nil, err, true
 		}
-		// Decrypt and pass upstream
-		if err := packet.Decrypt(); err != nil {
-			return 0, nil, err
+		return 0, nil, ErrTerminating, true
+
+	case <-timer.C:
+		t.owner.stats.add(&t.owner.stats.timeouts, 1)
+		return 0, nil, ErrTimeout, true
+
+	case <-changed:
+		return 0, nil, nil, false
+	}
+}
+
+// Retrieves a message waiting in the inbox of an in-process tunnel, or reports
+// not done if the deadline changed meanwhile. Any queued messages are still
+// delivered after the peer closed its endpoint.
+func (t *Tunnel) recvLocal(timer *deadTimer, changed <-chan struct{}) (int, []byte, error, bool) {
+	var packet *proto.Message
+	select {
+	case packet = <-t.inbox:
+	case <-t.peer.term:
+		select {
+		case packet = <-t.inbox:
+		default:
+			t.Close()
+			return 0, nil, ErrTerminating, true
 		}
-		return packet.Head.Meta.(*dataHeader).SizeOrCont, packet.Data, nil
+	case <-t.term:
+		return 0, nil, ErrTerminating, true
+	case <-timer.C:
+		t.owner.stats.add(&t.owner.stats.timeouts, 1)
+		return 0, nil, ErrTimeout, true
+	case <-changed:
+		return 0, nil, nil, false
+	}
+	t.owner.stats.add(&t.owner.stats.tunRecv, len(packet.Data))
+	return packet.Head.Meta.(*dataHeader).SizeOrCont, packet.Data, nil, true
+}
 
-	case <-time.After(timeout):
-		return 0, nil, ErrTimeout
+// Tears down a networked tunnel due to a failure, optionally notifying the remote
+// end of the detected data corruption beforehand.
+func (t *Tunnel) abort(err error, notify bool) {
+	t.lock.Lock()
+	if t.fail == nil {
+		t.fail = err
+	}
+	t.lock.Unlock()
+
+	if notify {
+		packet := &proto.Message{
+			Head: proto.Header{
+				Meta: &dataHeader{Corrupt: true},
+			},
+		}
+		if err := packet.Encrypt(); err != nil {
+			log.Printf("iris: failed to encrypt corruption notice: %v.", err)
+		} else {
+			conn, broken := t.link()
+			select {
+			case conn.Send <- packet:
+			case <-broken:
+			case <-t.term:
+			}
+		}
 	}
+	t.Close()
+}
+
+// Retrieves the failure that caused the tunnel to be torn down, if any.
+func (t *Tunnel) failure() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.fail
 }
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
 )
 
 // Connection handler for the tunnel tests.
@@ -81,6 +82,13 @@ func TestTunnelMultiNodeMultiConn(t *testing.T) {
 	testTunnel(t, 5, 5, 5, 100) // ulimit exceeded if too large
 }
 
+func TestTunnelLocalFastPath(t *testing.T) {
+	config.IrisLocalFastPath = true
+	defer func() { config.IrisLocalFastPath = false }()
+
+	testTunnel(t, 1, 10, 10, 1000)
+}
+
 // Tests multi node multi connection tunnel.
 func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 	// Configure the test
@@ -188,3 +196,290 @@ func testTunnel(t *testing.T, nodes, conns, tuns, msgs int) {
 		}
 	}
 }
+
+// Tests that a tunnel survives the break of its underlying link, resuming over
+// a new one without losing or duplicating any data.
+func TestTunnelResumption(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a tunnel echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("tunnel-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("tunnel-resume-test", &tunneler{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	tun, err := conn.Tunnel("tunnel-resume-test", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	// Stream messages through the echo service, breaking the link midway
+	msgs := 1000
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < msgs; i++ {
+			if i == msgs/2 {
+				conn, _ := tun.link()
+				conn.Sock().Close()
+			}
+			if err := tun.Send(2, []byte{byte(i >> 8), byte(i)}); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < msgs; i++ {
+		_, msg, err := tun.Recv(3 * time.Second)
+		if err != nil {
+			t.Fatalf("failed to receive message %d: %v.", i, err)
+		}
+		if have := int(msg[0])<<8 | int(msg[1]); have != i {
+			t.Fatalf("message mismatch: have %v, want %v.", have, i)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to send messages: %v.", err)
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+}
+
+// Connection handler holding inbound tunnels unread until released, then draining
+// them until closed.
+type staller struct {
+	release chan struct{}
+}
+
+func (s *staller) HandleBroadcast(msg []byte) {
+	panic("Broadcast passed to tunnel handler")
+}
+
+func (s *staller) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	panic("Request passed to tunnel handler")
+}
+
+func (s *staller) HandleTunnel(tun *Tunnel) {
+	<-s.release
+	for {
+		if _, _, err := tun.Recv(3 * time.Second); err != nil {
+			break
+		}
+	}
+	tun.Close()
+}
+
+func (s *staller) HandleDrop(reason error) {
+	panic("Connection dropped on tunnel handler")
+}
+
+// Tests that a sender is blocked once the window of unacknowledged chunks fills
+// up, and released as the remote consumes and acknowledges them.
+func TestTunnelBackpressure(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	oldBuffer, oldAck := config.IrisTunnelBuffer, config.IrisTunnelAckInterval
+	config.IrisTunnelBuffer, config.IrisTunnelAckInterval = 32, 4
+	defer func() { config.IrisTunnelBuffer, config.IrisTunnelAckInterval = oldBuffer, oldAck }()
+
+	// Boot a single iris overlay and connect a stalling tunnel service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("tunnel-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	handler := &staller{make(chan struct{})}
+	conn, err := node.Connect("tunnel-stall-test", handler)
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	tun, err := conn.Tunnel("tunnel-stall-test", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	// Fill up the window and ensure further sends block
+	for i := 0; i < config.IrisTunnelBuffer; i++ {
+		if err := tun.Send(1, []byte{byte(i)}); err != nil {
+			t.Fatalf("failed to send message %d: %v.", i, err)
+		}
+	}
+	if err := tun.send(1, []byte{0}, &deadline{when: time.Now().Add(250 * time.Millisecond)}); err != ErrTimeout {
+		t.Fatalf("full window send error mismatch: have %v, want %v.", err, ErrTimeout)
+	}
+	tun.replayLock.Lock()
+	if n := len(tun.replay); n != config.IrisTunnelBuffer {
+		t.Fatalf("replay buffer size mismatch: have %d, want %d.", n, config.IrisTunnelBuffer)
+	}
+	tun.replayLock.Unlock()
+
+	// Release the remote reader and ensure the window drains
+	close(handler.release)
+	for i := 0; i < 4*config.IrisTunnelBuffer; i++ {
+		if err := tun.send(1, []byte{byte(i)}, &deadline{when: time.Now().Add(3 * time.Second)}); err != nil {
+			t.Fatalf("failed to send message %d after release: %v.", i, err)
+		}
+	}
+	if err := tun.Close(); err != nil {
+		t.Fatalf("failed to close tunnel: %v.", err)
+	}
+}
+
+// Tests that corrupted tunnel data is detected and reported to both ends.
+func TestTunnelCorruption(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a tunnel echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("tunnel-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	conn, err := node.Connect("tunnel-corrupt-test", &tunneler{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.Fatalf("failed to close iris connection: %v.", err)
+		}
+	}()
+	// Establish a tunnel and make sure it works
+	tun, err := conn.Tunnel("tunnel-corrupt-test", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	if err := tun.Send(1, []byte{0}); err != nil {
+		t.Fatalf("failed to send message: %v.", err)
+	}
+	if _, _, err := tun.Recv(3 * time.Second); err != nil {
+		t.Fatalf("failed to receive message: %v.", err)
+	}
+	// Inject a chunk with an invalid checksum and wait for the corruption report
+	packet := &proto.Message{
+		Head: proto.Header{
+			Meta: &dataHeader{SizeOrCont: 1, Checksum: 0xdeadbeef},
+		},
+		Data: []byte{0},
+	}
+	if err := packet.Encrypt(); err != nil {
+		t.Fatalf("failed to encrypt corrupt packet: %v.", err)
+	}
+	tun.conn.Send <- packet
+
+	if _, _, err := tun.Recv(3 * time.Second); err != ErrCorrupted {
+		t.Fatalf("corruption report mismatch: have %v, want %v.", err, ErrCorrupted)
+	}
+	if err := tun.Send(1, []byte{0}); err != ErrCorrupted {
+		t.Fatalf("post-corruption send mismatch: have %v, want %v.", err, ErrCorrupted)
+	}
+}
+
+func TestTunnelAdmission(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65000)
+	defer func() { config.BootPorts = olds }()
+
+	// Boot a single iris overlay and connect a tunnel echo service
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New("tunnel-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	src, err := node.Connect("tunnel-admit-src", &tunneler{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer src.Close()
+
+	dst, err := node.Connect("tunnel-admit-dst", &tunneler{0, 0})
+	if err != nil {
+		t.Fatalf("failed to connect to the iris overlay: %v.", err)
+	}
+	defer dst.Close()
+
+	// Limit the source to a single tunnel per cluster and check rejection
+	src.SetTunnelLimits(TunnelLimits{Cluster: 1})
+
+	tun, err := src.Tunnel("tunnel-admit-dst", 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to establish new tunnel: %v.", err)
+	}
+	if _, err := src.Tunnel("tunnel-admit-dst", 3*time.Second); err != ErrTooManyTunnels {
+		t.Fatalf("admission mismatch: have %v, want %v.", err, ErrTooManyTunnels)
+	}
+	// Enable waiting and check that a released slot admits the queued tunnel
+	src.SetTunnelLimits(TunnelLimits{Cluster: 1, Wait: true})
+
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		tun.Close()
+	}()
+	start := time.Now()
+	if tun, err = src.Tunnel("tunnel-admit-dst", 3*time.Second); err != nil {
+		t.Fatalf("failed to establish queued tunnel: %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("queued tunnel admitted too early: have %v, want >= %v.", elapsed, 250*time.Millisecond)
+	}
+	// Check that waiting for a slot times out
+	if _, err := src.Tunnel("tunnel-admit-dst", 250*time.Millisecond); err != ErrTooManyTunnels {
+		t.Fatalf("queued admission mismatch: have %v, want %v.", err, ErrTooManyTunnels)
+	}
+	tun.Close()
+}
@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package iris
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the configured number of virtual nodes is hosted and that they all
+// join the same overlay.
+func TestVirtualNodes(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	config.IrisVirtualNodes = 3
+	defer func() { config.IrisVirtualNodes = 1 }()
+
+	olds := config.BootPorts
+	for i := 0; i < config.IrisVirtualNodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65000+i)
+	}
+	defer func() { config.BootPorts = olds }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot an overlay hosting multiple virtual nodes
+	node := New("virtual-test", key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay: %v.", err)
+	}
+	defer func() {
+		if err := node.Shutdown(); err != nil {
+			t.Fatalf("failed to terminate iris node: %v.", err)
+		}
+	}()
+	time.Sleep(time.Second)
+
+	// Verify that the virtual nodes are distinct and connected to each other
+	ids := node.Nodes()
+	if len(ids) != config.IrisVirtualNodes {
+		t.Fatalf("virtual node count mismatch: have %v, want %v.", len(ids), config.IrisVirtualNodes)
+	}
+	for i := 0; i < len(ids); i++ {
+		for j := i + 1; j < len(ids); j++ {
+			if ids[i].Cmp(ids[j]) == 0 {
+				t.Fatalf("virtual node id collision: %v.", ids[i])
+			}
+		}
+	}
+	if peers := len(node.scribe.Routing().Peers); peers != len(ids)-1 {
+		t.Fatalf("virtual peer count mismatch: have %v, want %v.", peers, len(ids)-1)
+	}
+	// Verify that the exported topology contains all the virtual nodes linked up
+	topo := node.Topology()
+	if len(topo.Nodes) != len(ids) {
+		t.Fatalf("topology node count mismatch: have %v, want %v.", len(topo.Nodes), len(ids))
+	}
+	for _, n := range topo.Nodes {
+		if !n.Local {
+			t.Fatalf("virtual node %v not marked local.", n.Id)
+		}
+	}
+	if links := len(topo.Links); links != len(ids)*(len(ids)-1) {
+		t.Fatalf("topology link count mismatch: have %v, want %v.", links, len(ids)*(len(ids)-1))
+	}
+}
+
+// Tests that hosting more virtual nodes than free bootstrap ports is refused
+// instead of crashing on the missing bootstrappers.
+func TestVirtualNodesPortLimit(t *testing.T) {
+	// Configure the test
+	swapConfigs()
+	defer swapConfigs()
+
+	config.IrisVirtualNodes = len(config.BootPorts) + 1
+	defer func() { config.IrisVirtualNodes = 1 }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	node := New("virtual-test", key)
+	if _, err := node.Boot(); err == nil {
+		node.Shutdown()
+		t.Fatalf("booted more virtual nodes than bootstrap ports.")
+	}
+}
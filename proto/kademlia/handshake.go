@@ -0,0 +1,264 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the kademlia session listener and negotiation. For every
+// network interface a separate bootstrapper and session acceptor is started,
+// each connecting nodes and exchanging their ids and listener addresses.
+
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/bootstrap"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// The initialization packet when the connection is set up.
+type initPacket struct {
+	Id    *big.Int
+	Addrs []string
+	Key   []byte // Public node key the id is bound to
+	Proof []byte // Signature over the session binding with the node key
+}
+
+// Make sure the init packet is registered with gob.
+func init() {
+	gob.Register(&initPacket{})
+}
+
+// Starts up the overlay networking on a specified interface and fans in all the
+// inbound connections into the overlay-global channels.
+func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
+	// Listen for incoming session on the given interface and configured port.
+	port := strconv.Itoa(config.PastryListenPort)
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), port))
+	if err != nil {
+		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
+	}
+	sock, err := session.Listen(addr, o.authKey)
+	if err != nil {
+		panic(fmt.Sprintf("failed to start session listener: %v.", err))
+	}
+	sock.Accept(config.PastryAcceptTimeout)
+
+	// Save the new listener address into the local (sorted) address list
+	o.lock.Lock()
+	o.addrs = append(o.addrs, addr.String())
+	sort.Strings(o.addrs)
+	o.lock.Unlock()
+
+	// Start the bootstrapper on the specified interface (IPv6 ones seeded around the
+	// local address only, tagged to never find any pastry nodes of the same network)
+	boot, discover, err := bootstrap.New(ipnet, []byte("kademlia:"+o.authId), o.nodeId, addr.Port)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
+	}
+	if err := boot.Boot(); err != nil {
+		panic(fmt.Sprintf("failed to boot bootstrapper: %v.", err))
+	}
+	// Process incoming connection until termination is requested
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-quit:
+			// Terminating, close and return
+			continue
+		case node := <-discover:
+			// Discard bootstrap requests, and only react to responses (prevent simultaneous double connecting)
+			if !node.Resp {
+				continue
+			}
+			// If the peer id fits into the routing table, dial and authenticate
+			if o.wanted(node.Peer) {
+				o.authInit.Schedule(func() { o.dial(node.Peer, []*net.TCPAddr{node.Addr}) })
+			}
+		case ses := <-sock.Sink:
+			o.authAccept.Schedule(func() { o.shake(ses, false) })
+		}
+	}
+	// Terminate the bootstrapper and peer listener
+	errv := boot.Terminate()
+	if errv != nil {
+		log.Printf("kademlia: failed to terminate bootstrapper: %v.", errv)
+	}
+	if err := sock.Close(); err != nil {
+		log.Printf("kademlia: failed to terminate session listener: %v.", err)
+		if errv == nil {
+			errv = err
+		}
+	}
+	errc <- errv
+}
+
+// Assembles the advertised addresses of the local node (see overlay.Advertise). The
+// method assumes the overlay lock is held (at least for reading).
+func (o *Overlay) advertised() []string {
+	return overlay.Advertise(o.addrs, o.extAddrs)
+}
+
+// Checks whether a discovered node is worth connecting to: not yet connected or
+// being dialed, and fitting into the local routing table.
+func (o *Overlay) wanted(id *big.Int) bool {
+	o.lock.RLock()
+	_, live := o.livePeers[id.String()]
+	fits := o.routes.fits(id)
+	o.lock.RUnlock()
+
+	if live || !fits {
+		return false
+	}
+	o.eventLock.Lock()
+	defer o.eventLock.Unlock()
+
+	if _, ok := o.dialSet[id.String()]; ok {
+		return false
+	}
+	o.dialSet[id.String()] = struct{}{}
+	return true
+}
+
+// Asynchronously connects to a remote overlay peer and executes handshake. The
+// id is released from the dialing set afterwards, whatever the outcome.
+func (o *Overlay) dial(id *big.Int, addrs []*net.TCPAddr) {
+	defer func() {
+		o.eventLock.Lock()
+		delete(o.dialSet, id.String())
+		o.eventLock.Unlock()
+	}()
+	// Sanity check to make sure self connections are not possible (i.e. malicious bootstrapper)
+	o.lock.RLock()
+	for _, ownAddr := range o.advertised() {
+		for _, peerAddr := range addrs {
+			if peerAddr.String() == ownAddr {
+				o.lock.RUnlock()
+				log.Printf("kademlia: self connection not allowed: %v.", o.nodeId)
+				return
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	// Dial away, trying interfaces one after the other until connection succeeds
+	for _, addr := range addrs {
+		if overlay.BannedHost(addr.IP) {
+			continue
+		}
+		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.authKey); err == nil {
+			o.shake(ses, true)
+			return
+		} else {
+			log.Printf("kademlia: failed to dial remote peer at %v: %v.", addr, err)
+		}
+	}
+}
+
+// Executes a two way overlay handshake where both peers exchange their server
+// addresses and virtual ids. To prevent resource exhaustion, a timeout is
+// attached to the handshake, the violation of which results in a dropped
+// connection. Successful connections are handed over to the manager.
+func (o *Overlay) shake(ses *session.Session, outbound bool) {
+	// Start the message transfers and create the peer
+	ses.Start(config.PastryNetBuffer)
+	p := o.newPeer(ses, outbound)
+
+	// Send an init packet to the remote peer
+	pkt := new(initPacket)
+	pkt.Id = new(big.Int).Set(o.nodeId)
+	pkt.Key = []byte(o.nodeKey.Public().(ed25519.PublicKey))
+	pkt.Proof = overlay.ProveId(o.nodeKey, ses.Binding(), ses.Server())
+
+	o.lock.RLock()
+	pkt.Addrs = o.advertised()
+	o.lock.RUnlock()
+
+	msg := new(proto.Message)
+	msg.Head.Meta = pkt
+	if err := p.send(msg); err != nil {
+		log.Printf("kademlia: failed to send init packet: %v.", err)
+		if err := ses.Close(); err != nil {
+			log.Printf("kademlia: failed to close uninited session: %v.", err)
+		}
+		return
+	}
+	// Wait for an incoming init packet
+	select {
+	case <-time.After(config.PastryInitTimeout):
+		log.Printf("kademlia: session initialization timed out.")
+		if err := ses.Close(); err != nil {
+			log.Printf("kademlia: failed to close unacked session: %v.", err)
+		}
+	case msg, ok := <-p.conn.CtrlLink.Recv:
+		if !ok {
+			log.Printf("kademlia: session closed before init arrived.")
+			if err := ses.Close(); err != nil {
+				log.Printf("kademlia: failed to close dropped session: %v.", err)
+			}
+			return
+		}
+		pkt, ok := msg.Head.Meta.(*initPacket)
+		if !ok {
+			log.Printf("kademlia: invalid init packet: %v.", msg.Head.Meta)
+			if err := ses.Close(); err != nil {
+				log.Printf("kademlia: failed to close invalid session: %v.", err)
+			}
+			return
+		}
+		// Make sure the remote node owns the id it claims
+		if err := overlay.VerifyId(pkt.Id, pkt.Key, pkt.Proof, ses.Binding(), !ses.Server()); err != nil {
+			log.Printf("kademlia: rejecting remote peer %v: %v.", pkt.Id, err)
+			if err := ses.Close(); err != nil {
+				log.Printf("kademlia: failed to close unbound session: %v.", err)
+			}
+			return
+		}
+		// Refuse the session if the remote node key is not allowed to join
+		if !overlay.Allowed(pkt.Key) {
+			log.Printf("kademlia: refusing non-allowlisted peer %v.", pkt.Id)
+			if err := ses.Close(); err != nil {
+				log.Printf("kademlia: failed to close non-allowlisted session: %v.", err)
+			}
+			return
+		}
+		// Refuse the session if the remote host or node is banned
+		if overlay.BannedId(pkt.Id) || overlay.BannedHost(ses.CtrlLink.Sock().RemoteAddr().(*net.TCPAddr).IP) {
+			log.Printf("kademlia: refusing banned peer %v.", pkt.Id)
+			if err := ses.Close(); err != nil {
+				log.Printf("kademlia: failed to close banned session: %v.", err)
+			}
+			return
+		}
+		p.nodeId, p.addrs = pkt.Id, pkt.Addrs
+
+		// Start processing messages right away (the remote side might already be
+		// routing), and let the manager decide whether to keep the connection
+		p.Start()
+		o.join(p)
+	}
+}
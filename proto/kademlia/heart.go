@@ -0,0 +1,121 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the heartbeat mechanism, a beater thread which periodically pings
+// all connected nodes (also adding whether they are considered contacts). The
+// beats are adaptive and jittered the same way as the pastry ones.
+
+package kademlia
+
+import (
+	"log"
+	"math/big"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/heart"
+)
+
+// Heartbeat manager and callback handler for the overlay.
+type heartbeat struct {
+	owner *Overlay
+	heart *heart.Heart
+	beats sync.WaitGroup
+	quit  chan struct{} // Aborts the beats still delayed by jitter
+}
+
+// Creates a new heartbeat mechanism.
+func newHeart(o *Overlay) *heartbeat {
+	h := &heartbeat{
+		owner: o,
+		quit:  make(chan struct{}),
+	}
+	h.heart = heart.New(config.PastryBeatPeriod, config.PastryKillCount, h)
+	return h
+}
+
+// Starts the heartbeats.
+func (h *heartbeat) start() {
+	h.heart.Start()
+}
+
+// Terminates the heartbeat mechanism.
+func (h *heartbeat) terminate() error {
+	err := h.heart.Terminate()
+	close(h.quit)
+	h.beats.Wait()
+	return err
+}
+
+// Periodically sends a heartbeat to all existing connections whose beat is due,
+// tagging them whether they are contacts in the routing table or not.
+func (h *heartbeat) Beat() {
+	h.owner.lock.RLock()
+	defer h.owner.lock.RUnlock()
+
+	for _, p := range h.owner.livePeers {
+		missed, _ := h.heart.Missed(p.nodeId)
+		due, stretch := p.pace.Tick(missed)
+		if !due {
+			continue
+		}
+		// Spread the beats across the period to avoid synchronized storms
+		var delay time.Duration
+		if config.PastryBeatJitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(float64(config.PastryBeatPeriod)*config.PastryBeatJitter) + 1))
+		}
+		h.beats.Add(1)
+		go func(p *peer, active bool, stretch int) {
+			defer h.beats.Done()
+
+			select {
+			case <-h.quit:
+				return
+			case <-time.After(delay):
+			}
+			h.owner.sendBeat(p, !active, stretch)
+		}(p, h.owner.routes.contains(p.nodeId), stretch)
+	}
+}
+
+// Implements heart.Callback.Dead, handling the event of a remote peer missing
+// all its beats. The peers is reported dead and dropped.
+func (h *heartbeat) Dead(id *big.Int) {
+	log.Printf("kademlia: remote peer reported dead: %v.", id)
+
+	h.owner.lock.RLock()
+	dead, ok := h.owner.livePeers[id.String()]
+	h.owner.lock.RUnlock()
+
+	if ok {
+		h.owner.drop(dead)
+	}
+}
+
+// Records the heartbeat interval announced by a remote peer, stretching the time
+// it may stay silent before being reported dead.
+func (o *Overlay) paced(src *peer, stretch int) {
+	if src.pace.Announced(stretch) {
+		if stretch < 1 {
+			stretch = 1
+		}
+		o.heart.heart.Tolerate(src.nodeId, stretch*config.PastryKillCount)
+	}
+}
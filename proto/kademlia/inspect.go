@@ -0,0 +1,83 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing state introspection, reusing the snapshot format of the
+// pastry overlay: the closest contacts stand in for the leaf set and the buckets
+// for the routing table rows.
+
+package kademlia
+
+import (
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Retrieves the measured round trip time and probe loss rate of a connected peer.
+// Kademlia doesn't measure its peers, so nothing is ever reported.
+func (o *Overlay) Proximity(id *big.Int) (time.Duration, float64, bool) {
+	return 0, 0, false
+}
+
+// Captures a snapshot of the local routing state for debugging purposes.
+func (o *Overlay) Inspect() *overlay.Snapshot {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	snap := &overlay.Snapshot{
+		Self:   o.nodeId,
+		Leaves: o.routes.closest(o.nodeId, config.KademliaBucket),
+		Routes: o.routes.copy(),
+		Peers:  make([]*overlay.PeerInfo, 0, len(o.livePeers)),
+		Meta:   overlay.CopyMetadata(o.meta),
+	}
+	for _, p := range o.livePeers {
+		missed, _ := o.heart.heart.Missed(p.nodeId)
+		snap.Peers = append(snap.Peers, &overlay.PeerInfo{
+			Id:      p.nodeId,
+			Addrs:   append([]string{}, p.addrs...),
+			Version: p.conn.Version(),
+			Active:  o.routes.contains(p.nodeId),
+			Passive: atomic.LoadUint32(&p.passive) == 1,
+			Missed:  missed,
+			Beat:    time.Duration(p.pace.Stretch()) * config.PastryBeatPeriod,
+			Queued:  len(p.inter) + len(p.bulk),
+			Dropped: atomic.LoadUint64(&p.dropped),
+			Session: p.conn.Stats(),
+			Meta:    overlay.CopyMetadata(p.metadata()),
+		})
+	}
+	sort.Slice(snap.Peers, func(i, j int) bool {
+		return snap.Peers[i].Id.Cmp(snap.Peers[j].Id) < 0
+	})
+	return snap
+}
+
+// Retrieves the next hop a message addressed to dest would be routed through,
+// and the routing rule that selected it (one of the overlay.Rule* constants). The
+// local node id is returned if the message would be delivered locally.
+func (o *Overlay) Route(dest *big.Int) (*big.Int, string) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.nextHop(dest)
+}
@@ -0,0 +1,52 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the leaf set change notifications (see the overlay package for the
+// details), the closest contacts standing in for the leaf set. The keys owned by
+// the local node are bounded by its closest contact in the XOR metric, so the
+// range shifts whenever that one changes.
+
+package kademlia
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Registers a hook invoked whenever the closest contacts change. Hooks are
+// invoked in registration order on the maintenance thread, after the new
+// contacts are in effect.
+func (o *Overlay) WatchLeaves(hook overlay.LeafHook) {
+	o.watchers.Watch(hook)
+}
+
+// Assembles the change event between two closest contact lists (ordered by
+// distance), nil if they're the same.
+func leafEvent(old, new []*big.Int) *overlay.LeafEvent {
+	event := overlay.DiffLeaves(old, new)
+	if event != nil {
+		switch {
+		case len(old) == 0 || len(new) == 0:
+			event.Shift = len(old) != len(new)
+		default:
+			event.Shift = old[0].Cmp(new[0]) != 0
+		}
+	}
+	return event
+}
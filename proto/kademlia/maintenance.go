@@ -0,0 +1,292 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing table management: one manager go-routine which admits the
+// authenticated connections, merges the contact exchanges of the peers (dialing
+// the new contacts fitting into the buckets) and removes the failed or useless
+// connections, broadcasting the local contacts whenever the table changes.
+
+package kademlia
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Processes the overlay events until termination is requested, after which all
+// the peer connections are gracefully torn down.
+func (o *Overlay) manager() {
+	var pending sync.WaitGroup
+
+	// Wait a longer while for the first connections, a shorter for convergence
+	converged := false
+	stableTime := config.PastryBootTimeout
+
+	var errc chan error
+	for errc == nil {
+		// Block till an event arrives
+		select {
+		case errc = <-o.maintQuit:
+			// Termination requested
+			continue
+		case <-o.eventNotify:
+			// Events arrived, process below
+		case <-time.After(stableTime):
+			// No update arrived for a while, consider converged
+			if !converged {
+				converged = true
+				close(o.stable)
+			}
+			continue
+		}
+		// Swap out the collectors
+		o.eventLock.Lock()
+		joins, exchs, drops := o.joinSet, o.exchSet, o.dropSet
+		o.joinSet, o.exchSet, o.dropSet = []*peer{}, make(map[*peer]*state), make(map[*peer]struct{})
+		o.eventLock.Unlock()
+
+		// If stale notification, loop
+		if len(joins) == 0 && len(exchs) == 0 && len(drops) == 0 {
+			continue
+		}
+		stableTime = config.PastryConvTimeout
+
+		// Update the connection pool and routing table, dialing any new contacts
+		leaves := o.Leaves(config.PastryLeaves)
+
+		lost := o.dropAll(drops, &pending)
+		added, fresh := o.admit(joins, &pending)
+		for _, s := range exchs {
+			o.merge(s)
+		}
+		if lost {
+			o.repair()
+		}
+		// Broadcast the contacts if anything changed, or just greet the new peers
+		peers := fresh
+		if lost || added {
+			o.lock.Lock()
+			o.time++
+			peers = make([]*peer, 0, len(o.livePeers))
+			for _, p := range o.livePeers {
+				peers = append(peers, p)
+			}
+			o.lock.Unlock()
+		}
+		for _, p := range peers {
+			p := p // Copy for closure!
+			o.stateExch.Schedule(func() { o.sendState(p) })
+		}
+		// Notify the upper layers of any neighborhood change
+		if event := leafEvent(leaves, o.Leaves(config.PastryLeaves)); event != nil {
+			o.lock.Lock()
+			o.changeTime = time.Now()
+			o.lock.Unlock()
+
+			o.watchers.Notify(event)
+		}
+	}
+	// Manager is terminating, drop all peer connections
+	o.lock.RLock()
+	for _, p := range o.livePeers {
+		pending.Add(1)
+		go func(p *peer) {
+			defer pending.Done()
+			// Send a kademlia leave to the remote node and wait
+			o.sendClose(p)
+
+			// Wait a while for remote tear-down
+			select {
+			case <-p.drop:
+			case <-time.After(time.Second):
+				log.Printf("kademlia: graceful session close timed out.")
+			}
+			// Success or not, close the session
+			if err := p.Close(); err != nil {
+				log.Printf("kademlia: failed to close peer during termination: %v.", err)
+			}
+		}(p)
+	}
+	o.lock.RUnlock()
+	pending.Wait()
+
+	errc <- nil
+}
+
+// Wakes the manager if blocking.
+func (o *Overlay) notify() {
+	select {
+	case o.eventNotify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
+
+// Inserts an authenticated peer into the admission queue.
+func (o *Overlay) join(p *peer) {
+	o.eventLock.Lock()
+	o.joinSet = append(o.joinSet, p)
+	o.eventLock.Unlock()
+
+	o.notify()
+}
+
+// Inserts a contact exchange into the exchange queue.
+func (o *Overlay) exch(p *peer, s *state) {
+	o.eventLock.Lock()
+	o.exchSet[p] = s
+	o.eventLock.Unlock()
+
+	o.notify()
+}
+
+// Inserts a peer into the drop queue.
+func (o *Overlay) drop(p *peer) {
+	o.eventLock.Lock()
+	o.dropSet[p] = struct{}{}
+	o.eventLock.Unlock()
+
+	o.notify()
+}
+
+// Closes a peer connection in the background (close might block a while).
+func (o *Overlay) dump(p *peer, pending *sync.WaitGroup) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		if err := p.Close(); err != nil {
+			log.Printf("kademlia: failed to close peer connection: %v.", err)
+		}
+	}()
+}
+
+// Drops failed or useless peer connections, removing them from the routing table
+// too. The returned flag reports whether any contacts were lost.
+func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) bool {
+	lost := false
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for d := range peers {
+		o.dump(d, pending)
+
+		id := d.nodeId.String()
+		if p, ok := o.livePeers[id]; ok && p == d {
+			// Delete the peer and stop monitoring it
+			delete(o.livePeers, id)
+			o.heart.heart.Unmonitor(d.nodeId)
+
+			if o.routes.remove(d.nodeId) {
+				lost = true
+			}
+		}
+	}
+	return lost
+}
+
+// Admits authenticated peer connections, keeping only one per remote node: the
+// one dialed by the lower id node (or the newer if both were dialed by the same
+// node). Contacts fitting into their buckets are inserted into the routing table.
+// The method returns whether the table changed and the newly admitted peers.
+func (o *Overlay) admit(peers []*peer, pending *sync.WaitGroup) (bool, []*peer) {
+	added, fresh := false, []*peer{}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, p := range peers {
+		// Filter out duplicate connections
+		old, ok := o.livePeers[p.nodeId.String()]
+		if ok && o.dialer(old).Cmp(o.dialer(p)) < 0 {
+			o.dump(p, pending)
+			continue
+		}
+		if ok {
+			o.dump(old, pending)
+			o.heart.heart.Tolerate(p.nodeId, 0)
+		} else {
+			o.heart.heart.Monitor(p.nodeId)
+		}
+		o.livePeers[p.nodeId.String()] = p
+		fresh = append(fresh, p)
+
+		// Insert into the routing table if there's room
+		if o.routes.insert(p.nodeId) {
+			added = true
+		}
+	}
+	return added, fresh
+}
+
+// Returns the id of the node which dialed a peer connection.
+func (o *Overlay) dialer(p *peer) *big.Int {
+	if p.outbound {
+		return o.nodeId
+	}
+	return p.nodeId
+}
+
+// Merges a contact exchange: any contact fitting into the local routing table is
+// dialed and will be inserted once the connection is admitted.
+func (o *Overlay) merge(s *state) {
+	for sid, addrs := range s.Addrs {
+		id, ok := new(big.Int).SetString(sid, 10)
+		if !ok {
+			log.Printf("kademlia: invalid node id received: %v.", sid)
+			continue
+		}
+		if id.Cmp(o.nodeId) == 0 || !o.wanted(id) {
+			continue
+		}
+		// Collect all the network interfaces and initiate a connection
+		peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+		for _, address := range addrs {
+			if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+				log.Printf("kademlia: failed to resolve address %v: %v.", address, err)
+			} else {
+				peerAddrs = append(peerAddrs, addr)
+			}
+		}
+		o.authInit.Schedule(func() { o.dial(id, peerAddrs) })
+	}
+}
+
+// Repairs the routing table after losing contacts: the connected peers fitting
+// into the buckets are inserted, and all peers are asked for their contacts to
+// find replacements.
+func (o *Overlay) repair() {
+	o.lock.Lock()
+	for _, p := range o.livePeers {
+		o.routes.insert(p.nodeId)
+	}
+	o.lock.Unlock()
+
+	o.lock.RLock()
+	for _, p := range o.livePeers {
+		p := p // Copy for closure!
+		o.stateExch.Schedule(func() { o.sendRepair(p) })
+	}
+	o.lock.RUnlock()
+}
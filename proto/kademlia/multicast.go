@@ -0,0 +1,120 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the prefix multicast: a message is delivered to every node whose id
+// shares a given number of leading bits with a prefix. The message is first
+// routed towards the prefix until it enters the covered region (the XOR closest
+// node is always inside if the region is not empty), after which it is split
+// recursively along the buckets: a node at split depth d passes a copy to a live
+// contact of every covered bucket i >= d, delegating to it the subtree of nodes
+// sharing i+1 bits with it. Each node thus receives the message exactly once.
+
+package kademlia
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/proto"
+)
+
+// Delivers a message to all the nodes whose ids share the first bits with the
+// prefix (all nodes if bits is zero), including the local node if covered. The
+// delivery is best effort, subtrees without live contacts are skipped.
+func (o *Overlay) Multicast(prefix *big.Int, bits int, msg *proto.Message) {
+	// Package into overlay envelope
+	head := &header{
+		Meta: msg.Head.Meta,
+		Op:   opCast,
+		Dest: prefix,
+		Span: bits,
+	}
+	msg.Head.Meta = head
+
+	// Start the dissemination from the local node
+	o.cast(msg)
+}
+
+// Multicast copy to send to a peer, delegating a subtree of the region.
+type castCopy struct {
+	p     *peer
+	depth int
+}
+
+// Either routes a multicast message towards the covered region or, if already
+// inside, splits it among the covered buckets from the message's depth on and
+// delivers it locally.
+func (o *Overlay) cast(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	o.lock.RLock()
+	if prefix(o.nodeId, head.Dest) < head.Span {
+		// Outside the region, route closer
+		next, _ := o.nextHop(head.Dest)
+		p, ok := o.livePeers[next.String()]
+		o.lock.RUnlock()
+
+		// Drop the message if nobody is inside the region
+		if ok {
+			o.send(msg, p)
+		}
+		return
+	}
+	// Inside the region, collect the subtrees to delegate
+	start := head.Depth
+	if start < head.Span {
+		start = head.Span
+	}
+	copies := []castCopy{}
+	for i := start; i < len(o.routes.buckets); i++ {
+		for _, id := range o.routes.buckets[i] {
+			if p, ok := o.livePeers[id.String()]; ok {
+				copies = append(copies, castCopy{p, i + 1})
+				break
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, c := range copies {
+		cp := &proto.Message{
+			Head: proto.Header{
+				Meta: &header{Meta: head.Meta, Op: opCast, Dest: head.Dest, Span: head.Span, Depth: c.depth},
+				Key:  msg.Head.Key,
+				Iv:   msg.Head.Iv,
+			},
+			Data: msg.Data,
+		}
+		if msg.Secure() {
+			cp.KnownSecure()
+		}
+		o.send(cp, c.p)
+	}
+	// Deliver a private copy locally, the application may decrypt in place
+	local := &proto.Message{
+		Head: proto.Header{
+			Meta: head.Meta,
+			Key:  msg.Head.Key,
+			Iv:   msg.Head.Iv,
+		},
+		Data: append([]byte(nil), msg.Data...),
+	}
+	if msg.Secure() {
+		local.KnownSecure()
+	}
+	o.app.Deliver(local, head.Dest)
+}
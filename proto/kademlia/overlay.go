@@ -0,0 +1,290 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package kademlia implements a Kademlia based structured overlay, an alternative
+// to the pastry one: node ids are compared by XOR distance, and the contacts are
+// organized into k-buckets by the length of their common prefix with the local
+// id. Buckets never evict live contacts, so long lived nodes keep the routing
+// stable under heavy churn.
+//
+// Contrary to the original design (iterative lookups), messages are routed
+// recursively, each hop greedily forwarding to its connected peer closest to the
+// destination, so upper layers can intercept them along the path, exactly as
+// with pastry. Note, the overlay shares the id space and transport settings of
+// the pastry overlay, but the two cannot be mixed in the same network.
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/pool"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Callback for events leaving the overlay network.
+type Callback interface {
+	Deliver(msg *proto.Message, key *big.Int)
+	Forward(msg *proto.Message, key *big.Int) bool
+}
+
+// Internal structure for the overlay state information.
+type Overlay struct {
+	app Callback // Upstream application callback
+
+	authId  string          // Iris network id
+	authKey *rsa.PrivateKey // Iris authentication key
+
+	nodeId   *big.Int           // Kademlia node id
+	nodeKey  ed25519.PrivateKey // Node key the node id is bound to
+	addrs    []string           // Listener addresses
+	extAddrs []string           // Extra advertised addresses (e.g. NAT mappings)
+	meta     map[string]string  // Metadata advertised in the state exchanges
+
+	livePeers map[string]*peer // Active connection pool
+	heart     *heartbeat       // Beater for the active peers
+
+	routes     *table    // Contact buckets, modified by the manager only
+	time       uint64    // Version of the local contacts
+	changeTime time.Time // Time of the last closest contact change
+
+	acceptQuit []chan chan error // Quit sync channels for the acceptors
+	maintQuit  chan chan error   // Quit sync channel for the maintenance routine
+
+	authInit   *pool.ThreadPool // Locally initiated authentication pool
+	authAccept *pool.ThreadPool // Remotely initiated authentication pool
+	stateExch  *pool.ThreadPool // Pool for limiting active state exchanges
+
+	joinSet []*peer             // Authenticated peers pending admission
+	exchSet map[*peer]*state    // Contact exchanges pending merging
+	dropSet map[*peer]struct{}  // Peers pending dropping
+	dialSet map[string]struct{} // Contacts currently being dialed
+
+	eventLock   sync.Mutex    // Lock protecting overlay events
+	eventNotify chan struct{} // Notifier for event changes
+
+	hooks    overlay.Hooks    // Routing hooks intercepting the upper layer messages
+	watchers overlay.Watchers // Hooks notified of the closest contact changes
+
+	traces    map[uint64]chan *trace // Pending route traces awaiting their paths
+	traceIdx  uint64                 // Id of the next route trace
+	traceLock sync.Mutex             // Lock protecting the pending traces
+
+	relief chan struct{} // Closed channel, links don't track congestion
+
+	stable chan struct{} // Channel closed once the overlay first converges
+	lock   sync.RWMutex  // Syncer for state mods after booting
+}
+
+// Creates a new overlay structure with all internal state initialized, ready to
+// be booted.
+func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
+	// Generate (or derive from the configured seed) the node key and the overlay id
+	nodeKey, nodeId := overlay.LocalIdentity()
+
+	relief := make(chan struct{})
+	close(relief)
+
+	// Assemble and return the overlay instance
+	o := &Overlay{
+		app: app,
+
+		authId:  id,
+		authKey: key,
+
+		nodeId:   nodeId,
+		nodeKey:  nodeKey,
+		addrs:    []string{},
+		extAddrs: append([]string{}, config.PastryAdvertise...),
+		meta:     overlay.CopyMetadata(config.PastryMetadata),
+
+		livePeers:  make(map[string]*peer),
+		routes:     newTable(nodeId),
+		time:       1,
+		changeTime: time.Now(),
+
+		acceptQuit: []chan chan error{},
+		maintQuit:  make(chan chan error),
+
+		authInit:   pool.NewThreadPool(config.PastryAuthThreads),
+		authAccept: pool.NewThreadPool(config.PastryAuthThreads),
+		stateExch:  pool.NewThreadPool(config.PastryExchThreads),
+
+		joinSet:     []*peer{},
+		exchSet:     make(map[*peer]*state),
+		dropSet:     make(map[*peer]struct{}),
+		dialSet:     make(map[string]struct{}),
+		eventNotify: make(chan struct{}, 1), // Buffer one notification
+
+		traces:   make(map[uint64]chan *trace),
+		traceIdx: 1,
+
+		relief: relief,
+		stable: make(chan struct{}),
+	}
+	o.heart = newHeart(o)
+	return o
+}
+
+// Replaces the node key (and with it the overlay id) with one derived from a
+// secret seed. Must be called before booting.
+func (o *Overlay) SetIdentitySeed(seed string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.nodeKey, o.nodeId = overlay.SeededIdentity(seed)
+	o.routes = newTable(o.nodeId)
+}
+
+// Boots the overlay network: it starts up boostrappers and connection acceptors
+// on all local IPv4 interfaces (and acceptors on the global IPv6 ones if enabled),
+// after which the overlay management is booted.
+// The method returns the number of remote peers after convergence is reached.
+func (o *Overlay) Boot() (int, error) {
+	// Report the node key, needed by the allowlists of the remote nodes
+	log.Printf("kademlia: booting node %v, key fingerprint %s.", o.nodeId, overlay.Fingerprint(o.nodeKey.Public().(ed25519.PublicKey)))
+
+	// Start the individual acceptors
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return 0, err
+	}
+	for _, addr := range addrs {
+		// Workaround for upstream Go issue #5395, construct an IPNet if IPAddr is returned
+		var ipnet *net.IPNet
+		switch addr := addr.(type) {
+		case *net.IPNet:
+			ipnet = addr
+		case *net.IPAddr:
+			log.Printf("kademlia: OS returned no network mask, using defaults...")
+			ipnet = &net.IPNet{
+				IP:   addr.IP,
+				Mask: addr.IP.DefaultMask(),
+			}
+		default:
+			log.Printf("kademlia: unknown interface address type for: %v.", addr)
+			continue
+		}
+		if overlay.Listenable(ipnet.IP) {
+			// Create a quit channel and start the acceptor
+			quit := make(chan chan error)
+			o.acceptQuit = append(o.acceptQuit, quit)
+			go o.acceptor(ipnet, quit)
+		}
+	}
+	// Start the overlay processes
+	go o.manager()
+	o.heart.start()
+
+	o.authInit.Start()
+	o.authAccept.Start()
+	o.stateExch.Start()
+
+	// Wait for convergence and report remote connections
+	<-o.stable
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.routes.size(), nil
+}
+
+// Sends a termination signal to all the go routines part of the overlay.
+func (o *Overlay) Shutdown() error {
+	errs := []error{}
+	errc := make(chan error)
+
+	// Close the peer listeners to prevent new connections
+	for _, quit := range o.acceptQuit {
+		quit <- errc
+	}
+	for i := 0; i < len(o.acceptQuit); i++ {
+		if err := <-errc; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Wait for all pending handshakes to finish
+	o.authAccept.Terminate(false)
+	o.authInit.Terminate(false)
+
+	// Terminate the heartbeat mechanism
+	if err := o.heart.terminate(); err != nil {
+		errs = append(errs, err)
+	}
+	// Wait for all state exchanges to finish
+	o.stateExch.Terminate(true)
+
+	// Terminate the maintainer and all peer connections with it
+	o.maintQuit <- errc
+	if err := <-errc; err != nil {
+		errs = append(errs, err)
+	}
+	// Report the errors and return
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%v", errs)
+	}
+}
+
+// Returns the overlay node's identifier.
+func (o *Overlay) Self() *big.Int {
+	return o.nodeId
+}
+
+// Returns (at most) k remote contacts, nearest to the local node by XOR distance.
+func (o *Overlay) Leaves(k int) []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.routes.closest(o.nodeId, k)
+}
+
+// Calculates the XOR distance between two ids, the metric of the overlay.
+func (o *Overlay) Distance(a, b *big.Int) *big.Int {
+	return Distance(a, b)
+}
+
+// Returns an always closed channel, as the overlay doesn't track congestion.
+func (o *Overlay) Relief() <-chan struct{} {
+	return o.relief
+}
+
+// Sends a message to the closest node to the given destination.
+func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
+	// Package into overlay envelope
+	head := &header{
+		Meta: msg.Head.Meta,
+		Dest: dest,
+	}
+	msg.Head.Meta = head
+
+	// Route it to the closest known node
+	o.route(nil, msg)
+}
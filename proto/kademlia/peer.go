@@ -0,0 +1,251 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the remote peer connections: a session with the inbound message
+// processors routing into the overlay and a blocking, time limited sender.
+//
+// Outbound messages are prioritized like in pastry: control messages (no payload)
+// go through the dedicated control link, payload carrying ones are queued as
+// interactive or bulk based on their size, the former always preempting the
+// latter on the data link.
+
+package kademlia
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/heart"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Peer state information.
+type peer struct {
+	owner *Overlay
+	conn  *session.Session
+
+	// Virtual id and reachable addresses
+	nodeId *big.Int
+	addrs  []string
+
+	// Overlay state infos
+	outbound bool   // Whether the connection was dialed by the local node
+	passive  uint32 // Whether the remote node doesn't keep the local as a contact (atomic)
+	time     uint64 // Version of the last contact exchange merged
+
+	pace  *heart.Pace  // Adaptive heartbeat schedule of the peer
+	info  atomic.Value // Metadata advertised by the peer (map[string]string)
+	frags uint64       // Id counter of the fragmented messages (atomic)
+
+	// Outbound data queues
+	inter   chan *proto.Message // Interactive (small payload) messages
+	bulk    chan *proto.Message // Bulk (large payload) messages
+	sched   chan chan struct{}  // Synchronizes scheduler termination
+	dropped uint64              // Frames dropped on a stuck data link (atomic)
+
+	// Maintenance fields
+	quit chan chan error // Synchronizes peer termination
+	drop chan struct{}   // Channel sync for remote drop on graceful tear-down
+	term bool            // Specifies whether the peer terminated already or not
+	lock sync.Mutex      // Lock to protect the close mechanism
+}
+
+// Creates a new peer instance, ready to begin communicating.
+func (o *Overlay) newPeer(ses *session.Session, outbound bool) *peer {
+	return &peer{
+		owner:    o,
+		conn:     ses,
+		outbound: outbound,
+		pace:     heart.NewPace(config.PastryBeatCalm, config.PastryBeatStretch),
+		inter:    make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:     make(chan *proto.Message, config.PastryNetBuffer),
+		sched:    make(chan chan struct{}),
+		quit:     make(chan chan error),
+		drop:     make(chan struct{}, 2),
+	}
+}
+
+// Starts the inbound message processors and the outbound scheduler.
+func (p *peer) Start() {
+	go p.processor(p.conn.CtrlLink)
+	go p.processor(p.conn.DataLink)
+	go p.scheduler()
+}
+
+// Terminates a peer connection.
+func (p *peer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// If the peer was already closed, return
+	if p.term {
+		return nil
+	}
+	p.term = true
+
+	// Flush the queued messages into the link and gracefully close the session
+	done := make(chan struct{})
+	p.sched <- done
+	<-done
+
+	res := p.conn.Close()
+
+	// Sync the processor terminations and return
+	errc := make(chan error)
+	for i := 0; i < 2; i++ {
+		p.quit <- errc
+		if err := <-errc; res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// Sends a message to the remote peer, system messages on the control link and
+// application ones queued for the data link by priority.
+func (p *peer) send(msg *proto.Message) error {
+	queue := p.inter
+	switch {
+	case len(msg.Data) == 0:
+		queue = p.conn.CtrlLink.Send
+	case len(msg.Data) > config.PastryBulkThreshold:
+		queue = p.bulk
+	}
+	// Split oversized payloads into fragments, queued in order behind each other
+	frames := link.Fragment(msg, atomic.AddUint64(&p.frags, 1), config.PastryFrameLimit)
+	for _, frame := range frames {
+		select {
+		case queue <- frame:
+		case <-time.After(config.PastrySendTimeout):
+			return errors.New("timeout")
+		}
+	}
+	return nil
+}
+
+// Moves the queued data messages into the data link, always preferring the
+// interactive ones over bulk traffic.
+func (p *peer) scheduler() {
+	var done chan struct{}
+	for done == nil {
+		// Forward any pending interactive message first
+		select {
+		case msg := <-p.inter:
+			p.forward(msg)
+			continue
+		default:
+		}
+		// Nothing interactive, wait for whatever comes next
+		select {
+		case done = <-p.sched:
+		case msg := <-p.inter:
+			p.forward(msg)
+		case msg := <-p.bulk:
+			p.forward(msg)
+		}
+	}
+	// Flush the pending messages (still by priority) while the link accepts them,
+	// the link might be already dead, so bound the close by the send timeout
+	timeout := time.NewTimer(config.PastrySendTimeout)
+	defer timeout.Stop()
+
+	lost, expired := uint64(0), false
+	for _, queue := range []chan *proto.Message{p.inter, p.bulk} {
+		for flushed := false; !flushed; {
+			select {
+			case msg := <-queue:
+				if expired {
+					lost++
+					continue
+				}
+				select {
+				case p.conn.DataLink.Send <- msg:
+				case <-timeout.C:
+					lost, expired = lost+1, true
+				}
+			default:
+				flushed = true
+			}
+		}
+	}
+	if lost > 0 {
+		atomic.AddUint64(&p.dropped, lost)
+		log.Printf("kademlia: dropped %d queued messages to %v on close.", lost, p.nodeId)
+	}
+	close(done)
+}
+
+// Forwards a message into the data link, dropping it if the link is stuck.
+func (p *peer) forward(msg *proto.Message) {
+	select {
+	case p.conn.DataLink.Send <- msg:
+	case <-time.After(config.PastrySendTimeout):
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+// Stores the metadata advertised by the peer in a contact exchange, discarding
+// it if oversized.
+func (p *peer) advertise(s *state) {
+	if err := overlay.CheckMetadata(s.Info); err != nil {
+		log.Printf("kademlia: discarding metadata of %v: %v.", p.nodeId, err)
+		return
+	}
+	p.info.Store(s.Info)
+}
+
+// Retrieves the metadata last advertised by the peer (nil if none).
+func (p *peer) metadata() map[string]string {
+	meta, _ := p.info.Load().(map[string]string)
+	return meta
+}
+
+// Accepts inbound messages and routes them into the overlay.
+func (p *peer) processor(link *link.Link) {
+	var errc chan error
+
+	// Retrieve messages until connection is torn down or termination is requested
+	for closed := false; !closed && errc == nil; {
+		select {
+		case errc = <-p.quit:
+			continue
+		case msg, ok := <-link.Recv:
+			if !ok {
+				// Connection went down (gracefully or not, dunno)
+				closed = true
+				continue
+			}
+			p.owner.route(p, msg)
+		}
+	}
+	// Signal the overlay of the connection drop
+	p.drop <- struct{}{}
+	if errc == nil {
+		p.owner.drop(p)
+		errc = <-p.quit
+	}
+	errc <- nil
+}
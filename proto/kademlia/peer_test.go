@@ -0,0 +1,83 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package kademlia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Tests that queued interactive messages preempt the bulk ones on the data link
+// and that everything gets flushed on termination.
+func TestPeerPriorities(t *testing.T) {
+	bulks, inters := 8, 4
+
+	ses := &session.Session{
+		CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+		DataLink: &link.Link{Send: make(chan *proto.Message, bulks+inters)},
+	}
+	p := &peer{
+		conn:  ses,
+		inter: make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+	}
+	// Queue up a burst of bulk traffic followed by a few interactive messages
+	for i := 0; i < bulks; i++ {
+		if err := p.send(&proto.Message{Data: make([]byte, config.PastryBulkThreshold+1)}); err != nil {
+			t.Fatalf("failed to queue bulk message: %v.", err)
+		}
+	}
+	for i := 0; i < inters; i++ {
+		if err := p.send(&proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to queue interactive message: %v.", err)
+		}
+	}
+	if err := p.send(&proto.Message{}); err != nil {
+		t.Fatalf("failed to queue control message: %v.", err)
+	}
+	if n := len(ses.CtrlLink.Send); n != 1 {
+		t.Fatalf("control message count mismatch: have %v, want %v.", n, 1)
+	}
+	// Run the scheduler and terminate it right away, the rest should be flushed
+	go p.scheduler()
+
+	done := make(chan struct{})
+	p.sched <- done
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("scheduler termination timed out.")
+	}
+	// Ensure the interactive messages went out first
+	if n := len(ses.DataLink.Send); n != inters+bulks {
+		t.Fatalf("forwarded message count mismatch: have %v, want %v.", n, inters+bulks)
+	}
+	for i := 0; i < inters+bulks; i++ {
+		msg := <-ses.DataLink.Send
+		if bulk := len(msg.Data) > config.PastryBulkThreshold; bulk != (i >= inters) {
+			t.Fatalf("message %d: bulk flag mismatch: have %v, want %v.", i, bulk, i >= inters)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the wire protocol for the kademlia overlay communication.
+
+package kademlia
+
+import (
+	"encoding/gob"
+	"math/big"
+
+	"github.com/project-iris/iris/proto"
+)
+
+// Kademlia operation code type.
+type opcode uint8
+
+// Kademlia operation types.
+const (
+	opNop      opcode = iota // Application layer message
+	opActive                 // Heartbeat for an active peer
+	opPassive                // Heartbeat for a passive peer
+	opExchange               // Contact exchange
+	opRepair                 // Contact exchange request
+	opClose                  // Leave request
+	opTrace                  // Route trace probe
+	opTraced                 // Route trace path returning to the origin
+	opCast                   // Prefix multicast message
+)
+
+// Contact exchange message.
+type state struct {
+	Addrs   map[string][]string // Known contacts and their network addresses
+	Version uint64              // Version counter to skip old messages
+	Info    map[string]string   // Metadata advertised by the sender
+}
+
+// Extra headers for the overlay.
+type header struct {
+	Meta  interface{} // Additional upper layer headers
+	Op    opcode      // The operation to execute
+	Dest  *big.Int    // Destination id
+	State *state      // Contact exchange
+	Beat  int         // Heartbeat interval of the sender (beat periods, 0 = one)
+	Trace *trace      // Route trace path collected so far
+	Span  int         // Multicast prefix length in bits
+	Depth int         // Multicast split depth (bucket index to start from)
+}
+
+// Make sure the header struct is registered with gob.
+func init() {
+	gob.Register(&header{})
+}
+
+// Simple wrapper around the peer send method, to handle errors by dropping.
+func (o *Overlay) send(msg *proto.Message, p *peer) {
+	if err := p.send(msg); err != nil {
+		o.drop(p)
+	}
+}
+
+// Envelopes a kademlia header into the generic packet container and sends it to
+// its destination via the peer connection.
+func (o *Overlay) sendPacket(dest *peer, head *header) {
+	o.send(&proto.Message{Head: proto.Header{Meta: head}}, dest)
+}
+
+// Assembles an overlay heartbeat message, consisting of the beat opcode and
+// tagged whether the remote node is a contact in the local routing table, also
+// announcing the interval of the next beat.
+func (o *Overlay) sendBeat(dest *peer, passive bool, stretch int) {
+	if passive {
+		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId, Beat: stretch})
+	} else {
+		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId, Beat: stretch})
+	}
+}
+
+// Assembles a contact exchange message, consisting of the exchange opcode, the
+// version of the local routing table and the addresses of all the contacts. The
+// whole table is small enough (bounded by the bucket count and size) to send.
+func (o *Overlay) sendState(dest *peer) {
+	o.lock.RLock()
+	s := &state{
+		Addrs:   map[string][]string{o.nodeId.String(): o.advertised()},
+		Version: o.time,
+		Info:    o.meta,
+	}
+	for _, bucket := range o.routes.buckets {
+		for _, id := range bucket {
+			sid := id.String()
+			if p, ok := o.livePeers[sid]; ok {
+				s.Addrs[sid] = p.addrs
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	o.sendPacket(dest, &header{Op: opExchange, Dest: dest.nodeId, State: s})
+}
+
+// Assembles a contact exchange request, asking the destination to send over its
+// contacts to repair the local routing table.
+func (o *Overlay) sendRepair(dest *peer) {
+	o.sendPacket(dest, &header{Op: opRepair, Dest: dest.nodeId})
+}
+
+// Assembles an overlay leave message, consisting of the close opcode and sends
+// it towards the destination.
+func (o *Overlay) sendClose(dest *peer) {
+	o.sendPacket(dest, &header{Op: opClose, Dest: dest.nodeId})
+}
+
+// Assembles a route trace probe, consisting of the trace opcode, the destination
+// being traced and the path collected so far.
+func (o *Overlay) sendTrace(dest *peer, id *big.Int, t *trace) {
+	o.sendPacket(dest, &header{Op: opTrace, Dest: id, Trace: t})
+}
+
+// Assembles a completed route trace, routed back towards its origin.
+func (o *Overlay) sendTraced(dest *peer, t *trace) {
+	o.sendPacket(dest, &header{Op: opTraced, Dest: t.Origin, Trace: t})
+}
@@ -0,0 +1,201 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the routing logic of the overlay: every hop greedily passes
+// a message to its contact closest (by XOR distance) to the destination,
+// delivering it locally once no contact is closer. Since each node knows at least
+// one contact in every non-empty subtree differing from its own id, each hop at
+// least extends the prefix shared with the destination.
+//
+// Beside the above, it also contains the system event processing logic.
+
+package kademlia
+
+import (
+	"log"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Kademlia routing algorithm.
+func (o *Overlay) route(src *peer, msg *proto.Message) {
+	// Multicast messages are split along the buckets, not routed
+	head := msg.Head.Meta.(*header)
+	if head.Op == opCast {
+		o.cast(msg)
+		return
+	}
+	// System messages are always exchanged between direct peers, process them
+	if head.Op != opNop {
+		o.process(src, head)
+		return
+	}
+	// Run the upper layer messages through the pre-routing hooks
+	var hop *overlay.Hop
+	before, after := o.hooks.Chains()
+	if len(before)+len(after) > 0 {
+		hop = &overlay.Hop{Dest: head.Dest}
+		if src != nil {
+			hop.Src = src.nodeId
+		}
+		if !runHooks(before, msg, hop) {
+			return
+		}
+	}
+	// Find the next hop for upper layer messages and deliver or forward
+	o.lock.RLock()
+	next, rule := o.nextHop(head.Dest)
+	o.lock.RUnlock()
+
+	if hop != nil {
+		hop.Next, hop.Rule = next, rule
+		if !runHooks(after, msg, hop) {
+			return
+		}
+	}
+	// Resolve the hop only now, the post-routing hooks might have been slow
+	o.lock.RLock()
+	p, ok := o.livePeers[next.String()]
+	if !ok && next.Cmp(o.nodeId) != 0 {
+		next, _ = o.nextHop(head.Dest)
+		p, ok = o.livePeers[next.String()]
+	}
+	o.lock.RUnlock()
+
+	if !ok {
+		o.deliver(msg)
+	} else {
+		o.forward(msg, p)
+	}
+}
+
+// Picks the next hop towards a destination, alongside the routing rule that
+// selected it: a directly connected destination is reached straight, otherwise
+// the live contact closest to it. The method assumes the overlay lock is held
+// (at least for reading).
+func (o *Overlay) nextHop(dest *big.Int) (*big.Int, string) {
+	if p, ok := o.livePeers[dest.String()]; ok {
+		return p.nodeId, overlay.RuleDirect
+	}
+	best, dist := o.nodeId, Distance(o.nodeId, dest)
+	for _, bucket := range o.routes.buckets {
+		for _, id := range bucket {
+			if _, ok := o.livePeers[id.String()]; !ok {
+				continue
+			}
+			if d := Distance(id, dest); d.Cmp(dist) < 0 {
+				best, dist = id, d
+			}
+		}
+	}
+	if best == o.nodeId {
+		return best, overlay.RuleLocal
+	}
+	return best, overlay.RuleCloser
+}
+
+// Delivers an upper layer message to the application.
+func (o *Overlay) deliver(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	msg.Head.Meta = head.Meta
+	o.app.Deliver(msg, head.Dest)
+}
+
+// Passes an upper layer message to the application for inspection and forwards
+// it to the next hop if allowed.
+func (o *Overlay) forward(msg *proto.Message, p *peer) {
+	head := msg.Head.Meta.(*header)
+	msg.Head.Meta = head.Meta
+	if o.app.Forward(msg, head.Dest) {
+		head.Meta = msg.Head.Meta
+		msg.Head.Meta = head
+		o.send(msg, p)
+	}
+}
+
+// Processes overlay system messages: heartbeats tag the connection liveness and
+// usefulness (dropping ones unneeded by both sides), contact exchanges are queued
+// for merging, repair requests are answered and leave requests honored. Route
+// traces are the only system messages passed on beyond the direct peer.
+func (o *Overlay) process(src *peer, head *header) {
+	// Notify the heartbeat mechanism that source is alive
+	o.heart.heart.Ping(src.nodeId)
+
+	switch head.Op {
+	case opActive:
+		// Ensure the peer is set to an active state
+		o.paced(src, head.Beat)
+		atomic.StoreUint32(&src.passive, 0)
+
+	case opPassive:
+		// If remote connection reported passive after being already registered as
+		// such locally too, drop the connection.
+		o.paced(src, head.Beat)
+		o.lock.Lock()
+		useless := atomic.SwapUint32(&src.passive, 1) == 1 && !o.routes.contains(src.nodeId)
+		o.lock.Unlock()
+
+		if useless {
+			o.drop(src)
+		}
+	case opExchange:
+		// Contact exchange, store the peer metadata and merge into local if new
+		src.advertise(head.State)
+
+		o.lock.Lock()
+		fresh := head.State.Version > src.time
+		if fresh {
+			src.time = head.State.Version
+		}
+		o.lock.Unlock()
+
+		if fresh {
+			o.exch(src, head.State)
+		}
+	case opRepair:
+		// Respond to any repair requests
+		o.stateExch.Schedule(func() { o.sendState(src) })
+
+	case opClose:
+		// Remote side requested a graceful close
+		o.drop(src)
+
+	case opTrace:
+		// Record the local hop, returning the path to the origin if the trace ends here
+		o.lock.RLock()
+		next := o.traceHop(head.Trace, head.Dest)
+		p, ok := o.livePeers[next.String()]
+		o.lock.RUnlock()
+
+		if next.Cmp(o.nodeId) == 0 {
+			t := head.Trace
+			o.stateExch.Schedule(func() { o.returnTrace(t) })
+		} else if ok {
+			o.sendTrace(p, head.Dest, head.Trace)
+		}
+	case opTraced:
+		// Trace path returning, hand it to the tracer or pass it on towards the origin
+		o.returnTrace(head.Trace)
+
+	default:
+		log.Printf("kademlia: unknown system message: %+v", head)
+	}
+}
@@ -0,0 +1,177 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package kademlia
+
+import (
+	"crypto/x509"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that messages to arbitrary destinations are delivered at the node with
+// the XOR-closest id, even if the buckets are too small to hold every peer.
+func TestRouting(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers, messages := 8, 64
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	apps := make([]*collector, peers)
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		apps[i] = new(collector)
+		nodes[i] = New(appId, key, apps[i])
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Send messages from random nodes to random destinations
+	space := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace))
+	dests := make([]*big.Int, messages)
+	for i := 0; i < messages; i++ {
+		dests[i] = new(big.Int).Rand(rand.New(rand.NewSource(int64(i))), space)
+
+		msg := &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{byte(i)}}
+		msg.Encrypt()
+		nodes[i%peers].Send(dests[i], msg)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// Verify that each message arrived at the closest node
+	delivs := 0
+	for i, app := range apps {
+		app.lock.Lock()
+		for _, dest := range app.delivs {
+			best := nodes[0]
+			for _, node := range nodes[1:] {
+				if Distance(node.Self(), dest).Cmp(Distance(best.Self(), dest)) < 0 {
+					best = node
+				}
+			}
+			if best != nodes[i] {
+				t.Fatalf("message to %v delivered at %v, want %v.", dest, nodes[i].Self(), best.Self())
+			}
+		}
+		delivs += len(app.delivs)
+		app.lock.Unlock()
+	}
+	if delivs != messages {
+		t.Fatalf("delivery count mismatch: have %v, want %v.", delivs, messages)
+	}
+}
+
+// Tests that dropped nodes are removed from the routing state, and their share
+// of the id space is taken over by the remaining ones.
+func TestChurn(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers, leavers := 6, 2
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and tear a few down after convergence
+	apps := make([]*collector, peers)
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		apps[i] = new(collector)
+		nodes[i] = New(appId, key, apps[i])
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	for i := 0; i < leavers; i++ {
+		if err := nodes[i].Shutdown(); err != nil {
+			t.Fatalf("failed to terminate node: %v.", err)
+		}
+	}
+	live := nodes[leavers:]
+	for _, node := range live {
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Verify that no remaining node references the dead ones
+	for i, node := range live {
+		snap := node.Inspect()
+		if len(snap.Peers) != len(live)-1 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, len(snap.Peers), len(live)-1)
+		}
+		for _, dead := range nodes[:leavers] {
+			if node.routes.contains(dead.Self()) {
+				t.Fatalf("node #%d: dead contact %v retained.", i, dead.Self())
+			}
+		}
+	}
+	// Follow the hops towards each dead node's id, expecting to end at the new closest
+	byId := make(map[string]*Overlay)
+	for _, node := range live {
+		byId[node.Self().String()] = node
+	}
+	for _, dead := range nodes[:leavers] {
+		best := live[0]
+		for _, node := range live[1:] {
+			if Distance(node.Self(), dead.Self()).Cmp(Distance(best.Self(), dead.Self())) < 0 {
+				best = node
+			}
+		}
+		for _, src := range live {
+			cur := src
+			for hops := 0; ; hops++ {
+				next, _ := cur.Route(dead.Self())
+				if next.Cmp(cur.Self()) == 0 {
+					break
+				}
+				if cur = byId[next.String()]; cur == nil || hops > len(live) {
+					t.Fatalf("invalid route from %v to %v.", src.Self(), dead.Self())
+				}
+			}
+			if cur != best {
+				t.Fatalf("route from %v to %v ended at %v, want %v.", src.Self(), dead.Self(), cur.Self(), best.Self())
+			}
+		}
+	}
+}
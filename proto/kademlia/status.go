@@ -0,0 +1,56 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the convergence status reporting: the overlay is ready once it booted,
+// has no admissions or contact exchanges pending and its closest contacts (the
+// stand-ins for the leaf set) settled down.
+
+package kademlia
+
+import (
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Reports whether the local overlay considers itself converged, suitable for
+// readiness probes, so no traffic is routed to a node still joining.
+func (o *Overlay) Status() *overlay.Status {
+	o.eventLock.Lock()
+	pending := len(o.joinSet) + len(o.exchSet)
+	o.eventLock.Unlock()
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	status := &overlay.Status{
+		Phase:   overlay.PhaseBooting,
+		Peers:   len(o.livePeers),
+		Leaves:  len(o.routes.closest(o.nodeId, config.PastryLeaves)),
+		Pending: pending,
+		Stable:  time.Since(o.changeTime),
+	}
+	select {
+	case <-o.stable:
+		status.Phase = overlay.PhaseConverged
+	default:
+	}
+	status.Ready = status.Phase == overlay.PhaseConverged && pending == 0 && status.Stable >= config.PastryConvTimeout
+	return status
+}
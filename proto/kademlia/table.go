@@ -0,0 +1,141 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the Kademlia routing table: the XOR metric of the id space and the
+// contact buckets indexed by the common prefix length with the local node.
+
+package kademlia
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Calculates the XOR distance between two ids.
+func Distance(a, b *big.Int) *big.Int {
+	return new(big.Int).Xor(a, b)
+}
+
+// Calculates the length of the common prefix of two ids (the bucket index).
+func prefix(a, b *big.Int) int {
+	for bit := config.PastrySpace - 1; bit >= 0; bit-- {
+		if a.Bit(bit) != b.Bit(bit) {
+			return config.PastrySpace - 1 - bit
+		}
+	}
+	return config.PastrySpace
+}
+
+// Kademlia routing table.
+type table struct {
+	origin  *big.Int     // Id of the local node owning the table
+	buckets [][]*big.Int // Contacts by common prefix length with the origin
+}
+
+// Creates a new empty routing table.
+func newTable(origin *big.Int) *table {
+	return &table{
+		origin:  origin,
+		buckets: make([][]*big.Int, config.PastrySpace),
+	}
+}
+
+// Checks whether a contact is present in the routing table.
+func (t *table) contains(id *big.Int) bool {
+	idx := prefix(t.origin, id)
+	if idx == len(t.buckets) {
+		return false
+	}
+	for _, contact := range t.buckets[idx] {
+		if contact.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a new contact would fit into its (non full) bucket.
+func (t *table) fits(id *big.Int) bool {
+	idx := prefix(t.origin, id)
+	if idx == len(t.buckets) || t.contains(id) {
+		return false
+	}
+	return len(t.buckets[idx]) < config.KademliaBucket
+}
+
+// Inserts a contact into its bucket if there's room for it. Live contacts are
+// never evicted in favor of new ones.
+func (t *table) insert(id *big.Int) bool {
+	if !t.fits(id) {
+		return false
+	}
+	idx := prefix(t.origin, id)
+	t.buckets[idx] = append(t.buckets[idx], id)
+	return true
+}
+
+// Removes a contact from its bucket, returning whether it was present.
+func (t *table) remove(id *big.Int) bool {
+	idx := prefix(t.origin, id)
+	if idx == len(t.buckets) {
+		return false
+	}
+	bucket := t.buckets[idx]
+	for i, contact := range bucket {
+		if contact.Cmp(id) == 0 {
+			t.buckets[idx] = append(bucket[:i:i], bucket[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of contacts in the routing table.
+func (t *table) size() int {
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// Returns (at most) k contacts nearest to the destination by XOR distance.
+func (t *table) closest(dest *big.Int, k int) []*big.Int {
+	ids := make([]*big.Int, 0, t.size())
+	for _, bucket := range t.buckets {
+		ids = append(ids, bucket...)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return Distance(ids[i], dest).Cmp(Distance(ids[j], dest)) < 0
+	})
+	if len(ids) > k {
+		ids = ids[:k]
+	}
+	return ids
+}
+
+// Creates a deep copy of the contact buckets.
+func (t *table) copy() [][]*big.Int {
+	buckets := make([][]*big.Int, len(t.buckets))
+	for i, bucket := range t.buckets {
+		buckets[i] = append([]*big.Int{}, bucket...)
+	}
+	return buckets
+}
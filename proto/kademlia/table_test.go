@@ -0,0 +1,85 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package kademlia
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+func TestPrefix(t *testing.T) {
+	origin := big.NewInt(0)
+	for bit := 0; bit < config.PastrySpace; bit++ {
+		id := new(big.Int).SetBit(new(big.Int), bit, 1)
+		if have, want := prefix(origin, id), config.PastrySpace-1-bit; have != want {
+			t.Fatalf("bit %d: prefix mismatch: have %v, want %v.", bit, have, want)
+		}
+	}
+	if have := prefix(origin, origin); have != config.PastrySpace {
+		t.Fatalf("self prefix mismatch: have %v, want %v.", have, config.PastrySpace)
+	}
+}
+
+func TestTable(t *testing.T) {
+	// Override the bucket size
+	swapConfigs()
+	defer swapConfigs()
+
+	origin := big.NewInt(0)
+	tab := newTable(origin)
+
+	// Fill the top bucket (differing in the highest bit) beyond its capacity
+	top := new(big.Int).SetBit(new(big.Int), config.PastrySpace-1, 1)
+	for i := 0; i < config.KademliaBucket+2; i++ {
+		id := new(big.Int).Add(top, big.NewInt(int64(i)))
+		if have, want := tab.insert(id), i < config.KademliaBucket; have != want {
+			t.Fatalf("contact #%d: insertion mismatch: have %v, want %v.", i, have, want)
+		}
+	}
+	if tab.insert(origin) {
+		t.Fatalf("origin inserted into its own table.")
+	}
+	if tab.insert(top) {
+		t.Fatalf("duplicate contact inserted.")
+	}
+	// Insert a few close contacts and verify the nearest lookups
+	for i := 1; i <= 3; i++ {
+		if !tab.insert(big.NewInt(int64(i))) {
+			t.Fatalf("failed to insert close contact %d.", i)
+		}
+	}
+	if have := tab.size(); have != config.KademliaBucket+3 {
+		t.Fatalf("table size mismatch: have %v, want %v.", have, config.KademliaBucket+3)
+	}
+	near := tab.closest(big.NewInt(2), 3)
+	for i, want := range []int64{2, 3, 1} {
+		if near[i].Int64() != want {
+			t.Fatalf("closest contact #%d mismatch: have %v, want %v.", i, near[i], want)
+		}
+	}
+	// Remove a contact and ensure its slot is freed up
+	if !tab.remove(top) || tab.contains(top) {
+		t.Fatalf("failed to remove contact.")
+	}
+	if !tab.fits(new(big.Int).Add(top, big.NewInt(100))) {
+		t.Fatalf("freed up bucket slot not reusable.")
+	}
+}
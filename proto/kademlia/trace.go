@@ -0,0 +1,127 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the route tracing: a probe is passed hop by hop towards a destination
+// id along the same contacts an upper layer message would take, each node adding
+// itself and the rule selecting the next hop. The node where the probe terminates
+// routes the collected path back to the origin. Kademlia doesn't measure the link
+// latencies, so the hops carry none.
+
+package kademlia
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Route trace probe collecting the path, and also returning it to the origin.
+type trace struct {
+	Id     uint64              // Origin local id of the trace
+	Origin *big.Int            // Overlay id of the node initiating the trace
+	Hops   []*overlay.TraceHop // Path collected so far
+}
+
+// Routes a probe towards the node closest to dest, returning every node along
+// the path (the local one first, the destination last). An error is returned if
+// the next hop is not live or the path doesn't arrive back within the allotted
+// time.
+func (o *Overlay) Trace(dest *big.Int, timeout time.Duration) ([]*overlay.TraceHop, error) {
+	// Register a pending trace to collect the path into
+	res := make(chan *trace, 1)
+
+	o.traceLock.Lock()
+	id := o.traceIdx
+	o.traceIdx++
+	o.traces[id] = res
+	o.traceLock.Unlock()
+
+	defer func() {
+		o.traceLock.Lock()
+		delete(o.traces, id)
+		o.traceLock.Unlock()
+	}()
+	// Record the local hop and pass the probe on if not terminating locally
+	t := &trace{Id: id, Origin: o.nodeId}
+
+	o.lock.RLock()
+	next := o.traceHop(t, dest)
+	p, ok := o.livePeers[next.String()]
+	o.lock.RUnlock()
+
+	if next.Cmp(o.nodeId) == 0 {
+		return t.Hops, nil
+	}
+	if !ok {
+		return nil, overlay.ErrTraceUnroutable
+	}
+	o.sendTrace(p, dest, t)
+
+	// Wait for the path to return or time out
+	select {
+	case t := <-res:
+		return t.Hops, nil
+	case <-time.After(timeout):
+		return nil, overlay.ErrTraceTimeout
+	}
+}
+
+// Appends the local node to a route trace, returning the next hop towards the
+// destination (or the local id if the trace terminates here). The method assumes
+// the overlay lock is held (at least for reading).
+func (o *Overlay) traceHop(t *trace, dest *big.Int) *big.Int {
+	next, rule := o.nextHop(dest)
+	t.Hops = append(t.Hops, &overlay.TraceHop{
+		Id:    o.nodeId,
+		Addrs: o.advertised(),
+		Rule:  rule,
+	})
+	return next
+}
+
+// Routes a completed trace back towards its origin node, handing it over to the
+// waiting tracer once arrived.
+func (o *Overlay) returnTrace(t *trace) {
+	o.lock.RLock()
+	next, _ := o.nextHop(t.Origin)
+	p, ok := o.livePeers[next.String()]
+	o.lock.RUnlock()
+
+	if next.Cmp(o.nodeId) == 0 {
+		o.completeTrace(t)
+	} else if ok {
+		o.sendTraced(p, t)
+	}
+}
+
+// Hands a returned trace over to the tracer waiting for it, if any.
+func (o *Overlay) completeTrace(t *trace) {
+	if t.Origin.Cmp(o.nodeId) != 0 {
+		return
+	}
+	o.traceLock.Lock()
+	defer o.traceLock.Unlock()
+
+	if res, ok := o.traces[t.Id]; ok {
+		select {
+		case res <- t:
+		default:
+		}
+	}
+}
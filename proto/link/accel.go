@@ -0,0 +1,62 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the detection of the hardware crypto acceleration. AES-GCM is only
+// fast (and constant time) if the CPU implements both the AES rounds and the
+// carry-less multiplications of GHASH (AES-NI and PCLMULQDQ on x86, the crypto
+// extensions on ARM64), otherwise the software ChaCha20-Poly1305 outruns it by
+// a wide margin. The BenchmarkFrame* benchmarks measure the difference.
+
+package link
+
+import "golang.org/x/sys/cpu"
+
+// Whether the CPU accelerates both AES and GHASH, making AES-GCM the faster mode.
+var hardwareAES = (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+	(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+	(cpu.S390X.HasAES && cpu.S390X.HasGHASH)
+
+// Reports whether the local CPU runs AES-GCM in hardware.
+func Accelerated() bool {
+	return hardwareAES
+}
+
+// Reorders a list of AEAD modes so the one fastest on the local CPU precedes the
+// other: AES-GCM if accelerated, ChaCha20-Poly1305 otherwise. The list is copied,
+// with any other entries kept in place.
+func Prefer(modes []string) []string {
+	fast, slow := AESGCM, ChaCha20Poly1305
+	if !hardwareAES {
+		fast, slow = slow, fast
+	}
+	res := append([]string{}, modes...)
+
+	f, s := -1, -1
+	for i, mode := range res {
+		switch mode {
+		case fast:
+			f = i
+		case slow:
+			s = i
+		}
+	}
+	if f > s && s >= 0 {
+		res[f], res[s] = res[s], res[f]
+	}
+	return res
+}
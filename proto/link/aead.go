@@ -0,0 +1,109 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the AEAD framing of the links, replacing the CTR stream cipher and the
+// separate HMAC with a single authenticated encryption mode (AES-GCM or ChaCha20-
+// Poly1305). The frame headers are sealed with the payload as additional data, so
+// a frame is still authenticated as a whole while the payload (secured by the
+// upper layers) is not encrypted twice. Every direction numbers its frames, the
+// counter doubling as the nonce, restarting with each fresh key after a rotation.
+
+package link
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEAD modes of the link encryption.
+const (
+	AESGCM           = "aes-gcm"
+	ChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// Checks whether the given AEAD mode is supported by the links.
+func ValidAEAD(mode string) bool {
+	return mode == AESGCM || mode == ChaCha20Poly1305
+}
+
+// Creates a new, full-duplex encrypted link from the negotiated secret's HKDF
+// stream (legacy key schedule), sealing the frames with the given AEAD mode
+// instead of the CTR cipher and HMAC.
+func NewAEAD(conn *stream.Stream, hkdf io.Reader, server bool, mode string) *Link {
+	return newStreamed(conn, hkdf, server, mode)
+}
+
+// Assembles the AEAD cipher of a one way communication channel in the given mode.
+func makeSealer(mode string, keys keyer) cipher.AEAD {
+	// Extract the symmetric key (the AES size is configurable, ChaCha20's fixed)
+	size := config.SessionCipherBits / 8
+	if mode == ChaCha20Poly1305 {
+		size = chacha20poly1305.KeySize
+	}
+	key := keys("key", size)
+
+	// Create the authenticated cipher
+	var aead cipher.AEAD
+	var err error
+	switch mode {
+	case AESGCM:
+		var block cipher.Block
+		if block, err = config.SessionCipher(key); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case ChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(key)
+	default:
+		err = fmt.Errorf("unknown mode %s", mode)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create session AEAD: %v", err))
+	}
+	return aead
+}
+
+// Assembles the nonce of a frame from its counter.
+func nonce(aead cipher.AEAD, count uint64) []byte {
+	buf := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], count)
+	return buf
+}
+
+// Seals the flattened headers in the output buffer, authenticating the payload
+// alongside.
+func (l *Link) seal(data []byte) []byte {
+	sealed := l.outAEAD.Seal(nil, nonce(l.outAEAD, l.outCount), l.outBuffer.Bytes(), data)
+	l.outCount++
+	return sealed
+}
+
+// Opens the sealed headers of a received frame, verifying the payload alongside.
+func (l *Link) open(head, data []byte) ([]byte, error) {
+	plain, err := l.inAEAD.Open(head[:0], nonce(l.inAEAD, l.inCount), head, data)
+	if err != nil {
+		return nil, err
+	}
+	l.inCount++
+	return plain, nil
+}
@@ -0,0 +1,150 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the optional payload compression of the links, saving bandwidth on
+// constrained (e.g. WAN) overlays. Payloads arrive already encrypted by the upper
+// layers, so the sender decrypts a copy with the message key, compresses it and
+// encrypts the result with a fresh key, wrapping the original metadata to flag
+// the transformation. The receiver reverses the steps, passing up a message no
+// different from an uncompressed one.
+//
+// Small payloads and those not shrinking on a sample (e.g. media) are sent as is.
+// Batches and fragments are already framed by the upper layers, so they too pass
+// through untouched.
+
+package link
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Compression codecs of the link payloads.
+const Snappy = "snappy"
+
+// Size of the payload prefix compressed to estimate whether the rest is worth it.
+const compressSample = 4096
+
+// Upper limit of a decompressed payload, guarding against decompression bombs.
+const maxUnpacked = 64 * 1024 * 1024
+
+// Wrapper of the metadata of a compressed message.
+type packedPacket struct {
+	Meta interface{} // Metadata of the original message
+}
+
+// Make sure the packed packet is registered with gob.
+func init() {
+	gob.Register(&packedPacket{})
+}
+
+// Checks whether the given codec is supported by the links.
+func ValidCodec(codec string) bool {
+	return codec == Snappy
+}
+
+// Sets the codec compressing the outbound payloads (empty = none). The inbound
+// ones are decompressed regardless. Must be called before starting the link.
+func (l *Link) Compress(codec string) {
+	l.codec = codec
+}
+
+// Compresses the payload of an outbound message if enabled and worthwhile,
+// returning either the original or a new, compressed message.
+func (l *Link) compress(msg *proto.Message) *proto.Message {
+	// Skip anything not an encrypted standalone message or too small to matter
+	if l.codec == "" || len(msg.Head.Key) == 0 || len(msg.Data) < config.SessionCompressMin {
+		return msg
+	}
+	switch msg.Head.Meta.(type) {
+	case *batchPacket, *fragmentPacket:
+		return msg
+	}
+	// Decrypt a copy of the payload and check whether a sample shrinks enough
+	plain := &proto.Message{
+		Head: msg.Head,
+		Data: append([]byte{}, msg.Data...),
+	}
+	if err := plain.Decrypt(); err != nil {
+		return msg
+	}
+	sample := plain.Data
+	if len(sample) > compressSample {
+		sample = sample[:compressSample]
+	}
+	if !shrunk(len(snappy.Encode(nil, sample)), len(sample)) {
+		return msg
+	}
+	// Compress the whole payload, and encrypt it again if still worthwhile
+	data := snappy.Encode(nil, plain.Data)
+	if !shrunk(len(data), len(plain.Data)) {
+		return msg
+	}
+	packed := &proto.Message{
+		Head: proto.Header{
+			Meta: &packedPacket{Meta: msg.Head.Meta},
+		},
+		Data: data,
+	}
+	if err := packed.Encrypt(); err != nil {
+		return msg
+	}
+	return packed
+}
+
+// Checks whether a compressed size is small enough to be worth the effort.
+func shrunk(packed, plain int) bool {
+	return packed < plain-plain/8
+}
+
+// Restores the original of a compressed inbound message, returning any other
+// message as is.
+func (l *Link) decompress(msg *proto.Message) (*proto.Message, error) {
+	packed, ok := msg.Head.Meta.(*packedPacket)
+	if !ok {
+		return msg, nil
+	}
+	if err := msg.Decrypt(); err != nil {
+		return nil, err
+	}
+	size, err := snappy.DecodedLen(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxUnpacked {
+		return nil, fmt.Errorf("decompressed payload too large: %d > %d", size, maxUnpacked)
+	}
+	data, err := snappy.Decode(nil, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	plain := &proto.Message{
+		Head: proto.Header{
+			Meta: packed.Meta,
+		},
+		Data: data,
+	}
+	if err := plain.Encrypt(); err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
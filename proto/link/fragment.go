@@ -0,0 +1,133 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the fragmentation of oversized messages: the sender splits a message
+// payload into frame sized fragments (the first one carrying the original headers)
+// which are sent through the link like any other message, interleaved with the
+// rest of the traffic. The receiving link reassembles them transparently before
+// passing the message upwards. Fragments lost midway (e.g. frames dropped on a
+// stuck link) discard the partial message, which the upper layers must tolerate
+// like any other loss.
+
+package link
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Link framing version introducing the fragmented messages.
+const FragmentVersion = 2
+
+// Fragment of an oversized message, identified by a sender local id.
+type fragmentPacket struct {
+	Id    uint64       // Sender local id of the fragmented message
+	Index int          // Index of the fragment within the message
+	Count int          // Total number of fragments of the message
+	Head  proto.Header // Headers of the original message (first fragment only)
+}
+
+// Message under reassembly.
+type partial struct {
+	head  proto.Header // Headers of the original message
+	count int          // Total number of fragments expected
+	next  int          // Index of the next fragment expected
+	data  []byte       // Payload reassembled so far
+}
+
+// Make sure the fragment packet is registered with gob.
+func init() {
+	gob.Register(&fragmentPacket{})
+}
+
+// Splits a message into fragments carrying at most size bytes of payload each.
+// Messages fitting into a single fragment are returned as is.
+func Fragment(msg *proto.Message, id uint64, size int) []*proto.Message {
+	if size <= 0 || len(msg.Data) <= size {
+		return []*proto.Message{msg}
+	}
+	count := (len(msg.Data) + size - 1) / size
+
+	frags := make([]*proto.Message, count)
+	for i := 0; i < count; i++ {
+		frag := &fragmentPacket{Id: id, Index: i, Count: count}
+		if i == 0 {
+			frag.Head = msg.Head
+		}
+		end := (i + 1) * size
+		if end > len(msg.Data) {
+			end = len(msg.Data)
+		}
+		frags[i] = &proto.Message{
+			Head: proto.Header{Meta: frag},
+			Data: msg.Data[i*size : end],
+		}
+		if msg.Secure() {
+			frags[i].KnownSecure()
+		}
+	}
+	return frags
+}
+
+// Adds a received message to the reassembly, returning the original message if
+// complete, or nil if more fragments are needed. Non fragments are returned as
+// they are, whereas malformed fragments are reported as errors.
+func (l *Link) reassemble(msg *proto.Message) (*proto.Message, error) {
+	frag, ok := msg.Head.Meta.(*fragmentPacket)
+	if !ok {
+		return msg, nil
+	}
+	if frag.Count < 2 || frag.Index < 0 || frag.Index >= frag.Count {
+		return nil, fmt.Errorf("invalid fragment %d/%d", frag.Index, frag.Count)
+	}
+	// Start a new message on its first fragment, making room if needed
+	part, ok := l.parts[frag.Id]
+	if !ok {
+		if frag.Index != 0 {
+			return nil, nil // Head lost, drop the remainder
+		}
+		if len(l.parts) >= config.PastryFragmentBacklog {
+			oldest := frag.Id
+			for id := range l.parts {
+				if id < oldest {
+					oldest = id
+				}
+			}
+			delete(l.parts, oldest)
+		}
+		part = &partial{head: frag.Head, count: frag.Count}
+		l.parts[frag.Id] = part
+	}
+	// Discard the message if a fragment went missing
+	if frag.Index != part.next || frag.Count != part.count {
+		delete(l.parts, frag.Id)
+		return nil, nil
+	}
+	part.data = append(part.data, msg.Data...)
+	if part.next++; part.next < part.count {
+		return nil, nil
+	}
+	delete(l.parts, frag.Id)
+
+	res := &proto.Message{Head: part.head, Data: part.data}
+	res.KnownSecure()
+	return res, nil
+}
@@ -0,0 +1,145 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the key schedules of the links. The legacy schedule reads the keys of
+// both directions consecutively from a single HKDF stream of the session secret
+// (the server's cipher key, IV and MAC key, then the client's), so every key hangs
+// on the exact amount of material read before it. The labeled schedule instead
+// expands each key on its own, under a label naming the schedule version, the
+// link, the direction and the purpose of the key:
+//
+//   iris.proto.link.v1/<link>/<server|client>/<key|iv|mac|chain>
+//
+// Keys thus never overlap however their sizes change, and new algorithms can
+// be introduced with new purposes (or a new schedule version) without touching
+// the existing ones. The re-keying ratchet is the same for both schedules.
+
+package link
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+
+	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/stream"
+)
+
+// Version prefix of the labeled key schedule.
+const labelPrefix = "iris.proto.link.v1"
+
+// Extracts key material of a given size for a purpose.
+type keyer func(purpose string, size int) []byte
+
+// Crypto primitives of one link direction.
+type halfDuplex struct {
+	cipher cipher.Stream // Stream cipher of the CTR and HMAC framing
+	macer  hash.Hash     // Authenticator of the CTR and HMAC framing
+	aead   cipher.AEAD   // Authenticated cipher of the AEAD framing
+	chain  []byte        // Key chain deriving the next epoch
+}
+
+// Creates a keyer reading the material consecutively from a stream, regardless
+// of the purpose (legacy schedule).
+func streamKeys(stream io.Reader) keyer {
+	return func(purpose string, size int) []byte {
+		key := make([]byte, size)
+		if n, err := io.ReadFull(stream, key); n != size || err != nil {
+			panic(fmt.Sprintf("Failed to extract session %s material: %v", purpose, err))
+		}
+		return key
+	}
+}
+
+// Creates a keyer expanding the material of a link direction from the session
+// secret, each purpose under its own label (labeled schedule).
+func labeledKeys(secret []byte, link, dir string) keyer {
+	return func(purpose string, size int) []byte {
+		info := fmt.Sprintf("%s/%s/%s/%s", labelPrefix, link, dir, purpose)
+		return streamKeys(hkdf.New(config.HkdfHash.New, secret, config.HkdfSalt, []byte(info)))(purpose, size)
+	}
+}
+
+// Creates a new, full-duplex encrypted link from the negotiated secret, keyed by
+// the labeled schedule under the given link name (distinct for every link of a
+// session). The frames are sealed with the given AEAD mode (empty = CTR cipher
+// and HMAC).
+func NewLabeled(conn *stream.Stream, secret []byte, name string, server bool, mode string) *Link {
+	l := newLink(conn, mode)
+
+	var dirs [2]*halfDuplex
+	for i, dir := range []string{"server", "client"} {
+		keys := labeledKeys(secret, name, dir)
+		dirs[i] = l.makeDirection(keys)
+		dirs[i].chain = keys("chain", config.HkdfHash.Size())
+	}
+	l.assign(dirs[0], dirs[1], server)
+	return l
+}
+
+// Creates a new, full-duplex encrypted link keyed by the legacy schedule, seeding
+// the re-keying chains from the initial keys of each direction.
+func newStreamed(conn *stream.Stream, hkdf io.Reader, server bool, mode string) *Link {
+	l := newLink(conn, mode)
+
+	var skeys, ckeys bytes.Buffer
+	sdir := l.makeDirection(streamKeys(io.TeeReader(hkdf, &skeys)))
+	cdir := l.makeDirection(streamKeys(io.TeeReader(hkdf, &ckeys)))
+	sdir.chain, _ = ratchet(skeys.Bytes())
+	cdir.chain, _ = ratchet(ckeys.Bytes())
+
+	l.assign(sdir, cdir, server)
+	return l
+}
+
+// Creates an unkeyed link over a stream, framing in the given mode.
+func newLink(conn *stream.Stream, mode string) *Link {
+	l := &Link{
+		socket: conn,
+		stats:  new(statistics),
+		parts:  make(map[uint64]*partial),
+		mode:   mode,
+	}
+	l.inCoder = gob.NewDecoder(&l.inBuffer)
+	l.outCoder = gob.NewEncoder(&l.outBuffer)
+	return l
+}
+
+// Assembles the crypto primitives of a link direction in the link's mode.
+func (l *Link) makeDirection(keys keyer) *halfDuplex {
+	if l.mode != "" {
+		return &halfDuplex{aead: makeSealer(l.mode, keys)}
+	}
+	stream, mac := makeHalfDuplex(keys)
+	return &halfDuplex{cipher: stream, macer: mac}
+}
+
+// Assigns the server and client directions to the inbound and outbound sides of
+// the link, depending on which end it is.
+func (l *Link) assign(sdir, cdir *halfDuplex, server bool) {
+	in, out := sdir, cdir
+	if server {
+		in, out = cdir, sdir
+	}
+	l.inCipher, l.inMacer, l.inAEAD, l.inChain = in.cipher, in.macer, in.aead, in.chain
+	l.outCipher, l.outMacer, l.outAEAD, l.outChain = out.cipher, out.macer, out.aead, out.chain
+}
@@ -35,15 +35,91 @@ import (
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/throttle"
 )
 
 // Link termination message for graceful tear-down.
 type closePacket struct {
 }
 
-// Make sure the close packet is registered with gob.
+// Link framing version introducing the batched frames. Peers advertising older
+// versions cannot split batches up, so they must be sent the messages one by one.
+const BatchVersion = 1
+
+// Batch of small messages coalesced into a single link frame. The headers are
+// carried in the frame header, whereas the payloads are concatenated into the
+// frame data (already secured, so no need to encrypt them again).
+type batchPacket struct {
+	Heads []proto.Header // Headers of the coalesced messages
+	Sizes []int          // Payload sizes of the coalesced messages
+}
+
+// Approximate per frame overhead (headers and MAC) charged against the bandwidth
+// caps beside the payload.
+const frameOverhead = 64
+
+// Make sure the close and batch packets are registered with gob.
 func init() {
 	gob.Register(&closePacket{})
+	gob.Register(&batchPacket{})
+}
+
+// Coalesces multiple messages into a single one, sent through the link as one
+// frame (one header encryption, MAC and socket flush) and split back up at the
+// remote side. The batch is only secure if all the contained payloads are.
+func Batch(msgs []*proto.Message) *proto.Message {
+	batch := &batchPacket{
+		Heads: make([]proto.Header, len(msgs)),
+		Sizes: make([]int, len(msgs)),
+	}
+	size, secure := 0, true
+	for i, msg := range msgs {
+		batch.Heads[i], batch.Sizes[i] = msg.Head, len(msg.Data)
+		size += len(msg.Data)
+		if !msg.Secure() && len(msg.Data) > 0 {
+			secure = false
+		}
+	}
+	data := make([]byte, 0, size)
+	for _, msg := range msgs {
+		data = append(data, msg.Data...)
+	}
+	frame := &proto.Message{
+		Head: proto.Header{
+			Meta: batch,
+		},
+		Data: data,
+	}
+	if secure {
+		frame.KnownSecure()
+	}
+	return frame
+}
+
+// Splits a received frame into the contained messages: either the frame itself
+// or the coalesced batch of messages.
+func unbatch(frame *proto.Message) ([]*proto.Message, error) {
+	batch, ok := frame.Head.Meta.(*batchPacket)
+	if !ok {
+		return []*proto.Message{frame}, nil
+	}
+	if len(batch.Heads) != len(batch.Sizes) {
+		return nil, fmt.Errorf("batch header/size count mismatch: %d != %d", len(batch.Heads), len(batch.Sizes))
+	}
+	msgs := make([]*proto.Message, len(batch.Heads))
+	for i, offset := 0, 0; i < len(msgs); i++ {
+		size := batch.Sizes[i]
+		if size < 0 || offset+size > len(frame.Data) {
+			return nil, fmt.Errorf("batch payload overflow: %d+%d > %d", offset, size, len(frame.Data))
+		}
+		msgs[i] = &proto.Message{
+			Head: batch.Heads[i],
+			Data: frame.Data[offset : offset+size],
+		}
+		msgs[i].KnownSecure()
+		offset += size
+	}
+	return msgs, nil
 }
 
 // Accomplishes secure and authenticated full duplex communication. Note, only
@@ -58,6 +134,15 @@ type Link struct {
 	inMacer  hash.Hash
 	outMacer hash.Hash
 
+	mode     string      // AEAD mode sealing the frames (empty = CTR and HMAC)
+	inAEAD   cipher.AEAD // Authenticated cipher of the inbound frames
+	outAEAD  cipher.AEAD // Authenticated cipher of the outbound frames
+	inCount  uint64      // Counter (nonce) of the next inbound frame
+	outCount uint64      // Counter (nonce) of the next outbound frame
+
+	inChain  []byte // Key chain deriving the next inbound epoch
+	outChain []byte // Key chain deriving the next outbound epoch
+
 	inBuffer  bytes.Buffer
 	outBuffer bytes.Buffer
 
@@ -67,66 +152,57 @@ type Link struct {
 	inHeadBuf []byte
 	inMacBuf  []byte
 
+	sequenced bool   // Whether the frames carry sequence numbers
+	outSeq    uint64 // Sequence number of the last frame sent
+	inWindow  window // Anti-replay window of the received frames
+
+	stats  *statistics         // Traffic counters of the link
+	limits []*throttle.Limiter // Bandwidth caps enforced by the sender (none = unlimited)
+	codec  string              // Codec compressing the outbound payloads (empty = none)
+	parts  map[uint64]*partial // Fragmented messages under reassembly (receiver only)
+
+	rekeyPeriod time.Duration // Lifetime of the outbound keys (0 = unlimited)
+	rekeyBytes  int           // Volume sent with the outbound keys (0 = unlimited)
+	outEpoch    time.Time     // Start of the current outbound key epoch
+	outBytes    int           // Volume sent in the current outbound key epoch
+
 	Send     chan *proto.Message
 	Recv     chan *proto.Message
 	sendQuit chan chan error
 	recvQuit chan chan error
 }
 
-// Creates a new, full-duplex encrypted link from the negotiated secret. The
-// client is used to decide the key derivation order for the two half-duplex
-// channels (server keys first, client key second).
+// Creates a new, full-duplex encrypted link from the negotiated secret's HKDF
+// stream (legacy key schedule). The client is used to decide the key derivation
+// order for the two half-duplex channels (server keys first, client key second).
 func New(conn *stream.Stream, hkdf io.Reader, server bool) *Link {
-	l := &Link{
-		socket: conn,
-	}
-	// Create the duplex channel
-	sc, sm := makeHalfDuplex(hkdf)
-	cc, cm := makeHalfDuplex(hkdf)
-	if server {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = cc, sc, cm, sm
-	} else {
-		l.inCipher, l.outCipher, l.inMacer, l.outMacer = sc, cc, sm, cm
-	}
-	// Create the gob coders
-	l.inCoder = gob.NewDecoder(&l.inBuffer)
-	l.outCoder = gob.NewEncoder(&l.outBuffer)
-
-	return l
+	return newStreamed(conn, hkdf, server, "")
 }
 
 // Assembles the crypto primitives needed for a one way communication channel:
 // the stream cipher for encryption and the mac for authentication.
-func makeHalfDuplex(hkdf io.Reader) (cipher.Stream, hash.Hash) {
+func makeHalfDuplex(keys keyer) (cipher.Stream, hash.Hash) {
 	// Extract the symmetric key and create the block cipher
-	key := make([]byte, config.SessionCipherBits/8)
-	n, err := io.ReadFull(hkdf, key)
-	if n != len(key) || err != nil {
-		panic(fmt.Sprintf("Failed to extract session key: %v", err))
-	}
-	block, err := config.SessionCipher(key)
+	block, err := config.SessionCipher(keys("key", config.SessionCipherBits/8))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create session cipher: %v", err))
 	}
 	// Extract the IV for the counter mode and create the stream cipher
-	iv := make([]byte, block.BlockSize())
-	n, err = io.ReadFull(hkdf, iv)
-	if n != len(iv) || err != nil {
-		panic(fmt.Sprintf("Failed to extract session IV: %v", err))
-	}
-	stream := cipher.NewCTR(block, iv)
+	stream := cipher.NewCTR(block, keys("iv", block.BlockSize()))
 
 	// Extract the HMAC key and create the session MACer
-	salt := make([]byte, config.SessionHash().Size())
-	n, err = io.ReadFull(hkdf, salt)
-	if n != len(salt) || err != nil {
-		panic(fmt.Sprintf("Failed to extract session mac salt: %v", err))
-	}
-	mac := hmac.New(config.SessionHash, salt)
+	mac := hmac.New(config.SessionHash.New, keys("mac", config.SessionHash.Size()))
 
 	return stream, mac
 }
 
+// Sets the bandwidth caps the sender must keep the outbound frames within. Every
+// limiter is charged for each frame, so caps may be shared among links. Must be
+// called before starting the link.
+func (l *Link) Throttle(limits ...*throttle.Limiter) {
+	l.limits = limits
+}
+
 // Creates the buffer channels and starts the transfer processes.
 func (l *Link) Start(cap int) {
 	// Create the data and quit channels
@@ -134,6 +210,7 @@ func (l *Link) Start(cap int) {
 	l.Recv = make(chan *proto.Message, cap)
 	l.sendQuit = make(chan chan error)
 	l.recvQuit = make(chan chan error)
+	l.outEpoch = time.Now()
 
 	// Start the transfers
 	go l.sender()
@@ -181,10 +258,31 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 		log.Printf("link: unsecured data, send denied.")
 		return errors.New("unsecured data, send denied")
 	}
-	// Flatten and encrypt the headers
+	// Flatten and encrypt the headers (with the sequence number if enabled)
+	if l.sequenced {
+		l.stamp()
+	}
 	if err = l.outCoder.Encode(msg.Head); err != nil {
+		l.outBuffer.Reset()
 		return err
 	}
+	if l.mode != "" {
+		defer l.outBuffer.Reset()
+
+		// Send the sealed headers and the payload authenticated within
+		head := l.seal(msg.Data)
+		if err = l.socket.Send(head); err != nil {
+			return err
+		}
+		if err = l.socket.Send(msg.Data); err != nil {
+			return err
+		}
+		if err = l.socket.Flush(); err != nil {
+			return err
+		}
+		l.stats.sent(len(head) + len(msg.Data))
+		return nil
+	}
 	l.outCipher.XORKeyStream(l.outBuffer.Bytes(), l.outBuffer.Bytes())
 	defer l.outBuffer.Reset()
 
@@ -199,10 +297,15 @@ func (l *Link) SendDirect(msg *proto.Message) error {
 	if err = l.socket.Send(msg.Data); err != nil {
 		return err
 	}
-	if err = l.socket.Send(l.outMacer.Sum(nil)); err != nil {
+	mac := l.outMacer.Sum(nil)
+	if err = l.socket.Send(mac); err != nil {
+		return err
+	}
+	if err = l.socket.Flush(); err != nil {
 		return err
 	}
-	return l.socket.Flush()
+	l.stats.sent(l.outBuffer.Len() + len(msg.Data) + len(mac))
+	return nil
 }
 
 // The actual message receiving logic. Reads a message from the stream, verifies
@@ -219,22 +322,38 @@ func (l *Link) RecvDirect() (*proto.Message, error) {
 	if err = l.socket.Recv(&msg.Data); err != nil {
 		return nil, err
 	}
-	if err = l.socket.Recv(&l.inMacBuf); err != nil {
-		return nil, err
+	head, size := l.inHeadBuf, len(l.inHeadBuf)+len(msg.Data)
+	if l.mode != "" {
+		// Open the sealed headers, verifying the payload too
+		if head, err = l.open(l.inHeadBuf, msg.Data); err != nil {
+			return nil, fmt.Errorf("frame authentication failed: %v", err)
+		}
+	} else {
+		if err = l.socket.Recv(&l.inMacBuf); err != nil {
+			return nil, err
+		}
+		// Verify the message contents (payload + header)
+		l.inMacer.Write(l.inHeadBuf)
+		l.inMacer.Write(msg.Data)
+		if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
+			err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
+			return nil, err
+		}
+		l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
+		size += len(l.inMacBuf)
 	}
-	// Verify the message contents (payload + header)
-	l.inMacer.Write(l.inHeadBuf)
-	l.inMacer.Write(msg.Data)
-	if !bytes.Equal(l.inMacBuf, l.inMacer.Sum(nil)) {
-		err = errors.New(fmt.Sprintf("mac mismatch: have %v, want %v.", l.inMacer.Sum(nil), l.inMacBuf))
-		return nil, err
+	// Extract the package contents, dropping replays
+	if l.sequenced {
+		if head, err = l.verify(head); err != nil {
+			return nil, err
+		}
 	}
-	// Extract the package contents
-	l.inCipher.XORKeyStream(l.inHeadBuf, l.inHeadBuf)
-	l.inBuffer.Write(l.inHeadBuf)
+	l.inBuffer.Write(head)
 	if err = l.inCoder.Decode(&msg.Head); err != nil {
 		return nil, err
 	}
+	l.stats.recv(size)
+
 	// Set the message security knowingly to true
 	msg.KnownSecure()
 	return &msg, nil
@@ -251,7 +370,9 @@ func (l *Link) sender() {
 		case errc = <-l.sendQuit:
 			continue
 		case msg := <-l.Send:
-			errv = l.SendDirect(msg)
+			msg = l.compress(msg)
+			errc = l.pace(msg)
+			errv = l.send(msg)
 		}
 	}
 	// If quit was requested, send all pending messages and close packet
@@ -260,7 +381,7 @@ func (l *Link) sender() {
 		for done := false; !done && errv == nil; {
 			select {
 			case msg := <-l.Send:
-				errv = l.SendDirect(msg)
+				errv = l.send(l.compress(msg))
 			default:
 				done = true
 			}
@@ -280,6 +401,26 @@ func (l *Link) sender() {
 	errc <- errv
 }
 
+// Waits until a frame fits into all the bandwidth caps, returning early if quit
+// is requested meanwhile (pending frames are flushed unthrottled).
+func (l *Link) pace(msg *proto.Message) chan error {
+	size, wait := len(msg.Data)+frameOverhead, time.Duration(0)
+	for _, limit := range l.limits {
+		if w := limit.Reserve(size); w > wait {
+			wait = w
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case errc := <-l.sendQuit:
+		return errc
+	}
+}
+
 // Transfers messages from the session to the upper layers decoding the headers.
 func (l *Link) receiver() {
 	var errc chan error
@@ -293,21 +434,39 @@ func (l *Link) receiver() {
 			errv = err
 			continue
 		}
-		// Check if it's a remote close packet
+		// Check if it's a remote close packet or key rotation
 		if _, ok := msg.Head.Meta.(*closePacket); ok {
 			break
 		}
-		// Transfer upwards, or terminate
-		select {
-		case l.Recv <- msg:
-			// Ok, upstream handled
-		default:
-			// Only check for termination if upstream blocked (i.e. flush pending messages first)
+		if _, ok := msg.Head.Meta.(*rekeyPacket); ok {
+			l.rekeyIn()
+			continue
+		}
+		// Split up any coalesced batch and transfer upwards, or terminate
+		msgs, err := unbatch(msg)
+		if err != nil {
+			errv = err
+			continue
+		}
+		for i := 0; i < len(msgs) && errc == nil && errv == nil; i++ {
+			// Reassemble fragmented messages, passing up only complete ones
+			if msgs[i], errv = l.reassemble(msgs[i]); msgs[i] == nil {
+				continue
+			}
+			if msgs[i], errv = l.decompress(msgs[i]); errv != nil {
+				continue
+			}
 			select {
-			case l.Recv <- msg:
-				// Ok, upstream unblocked
-			case errc = <-l.recvQuit:
-				// Terminating
+			case l.Recv <- msgs[i]:
+				// Ok, upstream handled
+			default:
+				// Only check for termination if upstream blocked (i.e. flush pending messages first)
+				select {
+				case l.Recv <- msgs[i]:
+					// Ok, upstream unblocked
+				case errc = <-l.recvQuit:
+					// Terminating
+				}
 			}
 		}
 	}
@@ -31,6 +31,7 @@ import (
 	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/throttle"
 )
 
 // Tests whether link ciphers are initializes correctly.
@@ -84,6 +85,205 @@ func TestCiphers(t *testing.T) {
 	}
 }
 
+// Tests whether the AEAD link ciphers are initialized correctly and reject any
+// tampering with the payload.
+func TestAEADCiphers(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{AESGCM, ChaCha20Poly1305} {
+		// Generate a secret key for the HKDF and create the two links
+		secret := make([]byte, 16)
+		io.ReadFull(rand.Reader, secret)
+
+		clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+		serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+		client := NewAEAD(nil, clientHKDF, false, mode)
+		server := NewAEAD(nil, serverHKDF, true, mode)
+
+		// Seal random headers on one side and open them on the other
+		head, data := make([]byte, 64), make([]byte, 256)
+		for i := 0; i < 100; i++ {
+			io.ReadFull(rand.Reader, head)
+			io.ReadFull(rand.Reader, data)
+
+			client.outBuffer.Write(head)
+			sealed := client.seal(data)
+			client.outBuffer.Reset()
+
+			plain, err := server.open(sealed, data)
+			if err != nil {
+				t.Fatalf("%s: failed to open frame %d: %v.", mode, i, err)
+			}
+			if !bytes.Equal(plain, head) {
+				t.Fatalf("%s: header mismatch: have %x, want %x.", mode, plain, head)
+			}
+		}
+		// Tamper with the payload and ensure the frame is rejected
+		server.outBuffer.Write(head)
+		sealed := server.seal(data)
+		data[0]++
+		if _, err := client.open(sealed, data); err == nil {
+			t.Fatalf("%s: tampered frame accepted.", mode)
+		}
+	}
+}
+
+// Tests that the labeled key schedule pairs up the two ends of a link, while
+// keeping the keys of different links and directions apart.
+func TestLabeledCiphers(t *testing.T) {
+	t.Parallel()
+
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	for _, mode := range []string{"", AESGCM, ChaCha20Poly1305} {
+		client := NewLabeled(nil, secret, "ctrl", false, mode)
+		server := NewLabeled(nil, secret, "ctrl", true, mode)
+		other := NewLabeled(nil, secret, "data", false, mode)
+
+		// Check that the chains pair up, but differ across directions and links
+		if !bytes.Equal(client.outChain, server.inChain) || !bytes.Equal(client.inChain, server.outChain) {
+			t.Fatalf("%q: key chain mismatch on the link endpoints.", mode)
+		}
+		if bytes.Equal(client.inChain, client.outChain) || bytes.Equal(client.outChain, other.outChain) {
+			t.Fatalf("%q: key chains shared across directions or links.", mode)
+		}
+		// Check that the frame protection matches on the two sides, but not across links
+		head, data := make([]byte, 64), make([]byte, 256)
+		io.ReadFull(rand.Reader, head)
+		io.ReadFull(rand.Reader, data)
+
+		if mode != "" {
+			client.outBuffer.Write(head)
+			sealed := client.seal(data)
+			if plain, err := server.open(append([]byte{}, sealed...), data); err != nil || !bytes.Equal(plain, head) {
+				t.Fatalf("%q: failed to open frame: %v.", mode, err)
+			}
+			if _, err := NewLabeled(nil, secret, "data", true, mode).open(sealed, data); err == nil {
+				t.Fatalf("%q: frame opened by another link.", mode)
+			}
+			continue
+		}
+		clientData, serverData := append([]byte{}, data...), append([]byte{}, data...)
+		client.outCipher.XORKeyStream(clientData, clientData)
+		server.inCipher.XORKeyStream(serverData, serverData)
+		if !bytes.Equal(clientData, serverData) {
+			t.Fatalf("cipher mismatch on the link endpoints.")
+		}
+		client.outMacer.Write(data)
+		server.inMacer.Write(data)
+		other.outMacer.Write(data)
+		if mac := client.outMacer.Sum(nil); !bytes.Equal(mac, server.inMacer.Sum(nil)) || bytes.Equal(mac, other.outMacer.Sum(nil)) {
+			t.Fatalf("macer mismatch on the link endpoints.")
+		}
+	}
+}
+
+// Tests that the AEAD mode accelerated by the local hardware is moved ahead in
+// the preferences, leaving any other order intact.
+func TestPrefer(t *testing.T) {
+	defer func(accel bool) { hardwareAES = accel }(hardwareAES)
+
+	for i, tt := range []struct {
+		accel bool
+		modes []string
+		want  []string
+	}{
+		{true, []string{ChaCha20Poly1305, AESGCM}, []string{AESGCM, ChaCha20Poly1305}},
+		{true, []string{AESGCM, ChaCha20Poly1305}, []string{AESGCM, ChaCha20Poly1305}},
+		{false, []string{AESGCM, ChaCha20Poly1305}, []string{ChaCha20Poly1305, AESGCM}},
+		{false, []string{AESGCM}, []string{AESGCM}},
+		{false, []string{}, []string{}},
+	} {
+		hardwareAES = tt.accel
+		if have := Prefer(tt.modes); fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Fatalf("test %d: preference mismatch: have %v, want %v.", i, have, tt.want)
+		}
+	}
+}
+
+// Benchmarks the frame protection costs of the CTR and HMAC framing and the AEAD
+// modes, gating the hardware based preference of the latter.
+func BenchmarkFrameCTR64Byte(b *testing.B) {
+	benchmarkFrame(b, "", 64)
+}
+
+func BenchmarkFrameCTR1KByte(b *testing.B) {
+	benchmarkFrame(b, "", 1024)
+}
+
+func BenchmarkFrameCTR64KByte(b *testing.B) {
+	benchmarkFrame(b, "", 65536)
+}
+
+func BenchmarkFrameAESGCM64Byte(b *testing.B) {
+	benchmarkFrame(b, AESGCM, 64)
+}
+
+func BenchmarkFrameAESGCM1KByte(b *testing.B) {
+	benchmarkFrame(b, AESGCM, 1024)
+}
+
+func BenchmarkFrameAESGCM64KByte(b *testing.B) {
+	benchmarkFrame(b, AESGCM, 65536)
+}
+
+func BenchmarkFrameChaCha64Byte(b *testing.B) {
+	benchmarkFrame(b, ChaCha20Poly1305, 64)
+}
+
+func BenchmarkFrameChaCha1KByte(b *testing.B) {
+	benchmarkFrame(b, ChaCha20Poly1305, 1024)
+}
+
+func BenchmarkFrameChaCha64KByte(b *testing.B) {
+	benchmarkFrame(b, ChaCha20Poly1305, 65536)
+}
+
+func benchmarkFrame(b *testing.B, mode string, block int) {
+	// Generate a secret key for the HKDF and create the two links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	client, server := New(nil, clientHKDF, false), New(nil, serverHKDF, true)
+	if mode != "" {
+		client, server = NewAEAD(nil, clientHKDF, false, mode), NewAEAD(nil, serverHKDF, true, mode)
+	}
+	// Protect and verify frames of the given payload size on the two sides
+	head, data := make([]byte, 64), make([]byte, block)
+	io.ReadFull(rand.Reader, data)
+
+	b.SetBytes(int64(block))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if mode != "" {
+			client.outBuffer.Write(head)
+			sealed := client.seal(data)
+			client.outBuffer.Reset()
+
+			if _, err := server.open(sealed, data); err != nil {
+				b.Fatalf("failed to open frame: %v.", err)
+			}
+			continue
+		}
+		client.outCipher.XORKeyStream(head, head)
+		client.outMacer.Write(head)
+		client.outMacer.Write(data)
+		mac := client.outMacer.Sum(nil)
+
+		server.inMacer.Write(head)
+		server.inMacer.Write(data)
+		if !bytes.Equal(mac, server.inMacer.Sum(nil)) {
+			b.Fatalf("mac mismatch.")
+		}
+		server.inCipher.XORKeyStream(head, head)
+	}
+}
+
 // Tests the low level send and receive methods.
 func TestDirectSendRecv(t *testing.T) {
 	t.Parallel()
@@ -252,3 +452,495 @@ func TestSendRecv(t *testing.T) {
 		t.Fatalf("failed to close server link: %v.", err)
 	}
 }
+
+// Tests that coalesced message batches are split up at the remote side.
+func TestBatchSendRecv(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the stream based encrypted links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Generate a batch of random messages of varying sizes (empty included)
+	sends := make([]*proto.Message, 16)
+	for i := 0; i < len(sends); i++ {
+		sends[i] = &proto.Message{
+			Head: proto.Header{
+				Meta: make([]byte, 32),
+			},
+			Data: make([]byte, i*8),
+		}
+		io.ReadFull(rand.Reader, sends[i].Head.Meta.([]byte))
+		io.ReadFull(rand.Reader, sends[i].Data)
+		sends[i].Encrypt()
+	}
+	// Send the batch through and check that the messages arrive one by one
+	select {
+	case clientLink.Send <- Batch(sends):
+		// Ok
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("client send timed out")
+	}
+	for i, send := range sends {
+		select {
+		case recv, ok := <-serverLink.Recv:
+			if !ok {
+				t.Fatalf("server link closed prematurely")
+			}
+			if bytes.Compare(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) != 0 || bytes.Compare(send.Data, recv.Data) != 0 {
+				t.Fatalf("message %d: send/receive mismatch: have %+v, want %+v.", i, recv, send)
+			}
+			if bytes.Compare(send.Head.Key, recv.Head.Key) != 0 || bytes.Compare(send.Head.Iv, recv.Head.Iv) != 0 {
+				t.Fatalf("message %d: crypto header mismatch: have %+v, want %+v.", i, recv.Head, send.Head)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("server receive timed out")
+		}
+	}
+	// Ensure that batches with unsecured payloads are denied
+	plain := &proto.Message{Data: []byte("plain text")}
+	if Batch([]*proto.Message{sends[1], plain}).Secure() {
+		t.Fatalf("batch with unsecured payload reported secure.")
+	}
+	// Ensure the links can be successfully torn down
+	go func() {
+		if err := clientLink.Close(); err != nil {
+			t.Errorf("failed to close client link: %v.", err)
+		}
+	}()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that the sender keeps the outbound frames within the bandwidth caps.
+func TestThrottle(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the stream based encrypted links, capping the client side
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	rate := 256 * 1024
+	clientLink.Throttle(throttle.New(float64(rate), 0))
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Send twice the burst through, which should take about one second
+	start := time.Now()
+	for i := 0; i < 16; i++ {
+		msg := &proto.Message{Data: make([]byte, rate/8)}
+		msg.Encrypt()
+		clientLink.Send <- msg
+	}
+	for i := 0; i < 16; i++ {
+		select {
+		case <-serverLink.Recv:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message %d: server receive timed out", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("throttled transfer time mismatch: have %v, want ~1s.", elapsed)
+	}
+	// Ensure the links can be successfully torn down
+	go func() {
+		if err := clientLink.Close(); err != nil {
+			t.Errorf("failed to close client link: %v.", err)
+		}
+	}()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that fragmented messages are reassembled transparently by the receiver,
+// interleaved with other traffic, and incomplete ones are discarded.
+func TestFragmentSendRecv(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the stream based encrypted links
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Fragment two large messages, and interleave them with a small one
+	big := &proto.Message{Head: proto.Header{Meta: []byte{0x01}}, Data: make([]byte, 10000)}
+	io.ReadFull(rand.Reader, big.Data)
+	big.Encrypt()
+
+	lost := &proto.Message{Head: proto.Header{Meta: []byte{0x02}}, Data: make([]byte, 3000)}
+	lost.Encrypt()
+
+	small := &proto.Message{Head: proto.Header{Meta: []byte{0x03}}, Data: []byte{0x04}}
+	small.Encrypt()
+
+	frags := Fragment(big, 1, 1024)
+	if len(frags) != 10 {
+		t.Fatalf("fragment count mismatch: have %v, want %v.", len(frags), 10)
+	}
+	gapped := Fragment(lost, 2, 1024)
+
+	sends := append([]*proto.Message{}, frags[:5]...)
+	sends = append(sends, gapped[0], small, gapped[2])
+	sends = append(sends, frags[5:]...)
+	for _, msg := range sends {
+		select {
+		case clientLink.Send <- msg:
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("client send timed out")
+		}
+	}
+	// Verify that the small message arrives, followed by the reassembled one only
+	for i, want := range []*proto.Message{small, big} {
+		select {
+		case recv := <-serverLink.Recv:
+			if !bytes.Equal(recv.Head.Meta.([]byte), want.Head.Meta.([]byte)) || !bytes.Equal(recv.Data, want.Data) {
+				t.Fatalf("message %d: send/receive mismatch: have %x, want %x.", i, recv.Head.Meta, want.Head.Meta)
+			}
+			if !bytes.Equal(recv.Head.Key, want.Head.Key) || !bytes.Equal(recv.Head.Iv, want.Head.Iv) {
+				t.Fatalf("message %d: crypto header mismatch: have %+v, want %+v.", i, recv.Head, want.Head)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("message %d: server receive timed out", i)
+		}
+	}
+	select {
+	case recv := <-serverLink.Recv:
+		t.Fatalf("incomplete message delivered: %+v.", recv.Head)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Ensure the links can be successfully torn down
+	go func() {
+		if err := clientLink.Close(); err != nil {
+			t.Errorf("failed to close client link: %v.", err)
+		}
+	}()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+}
+
+// Tests that compressible payloads are transparently compressed, whereas small
+// and incompressible ones are sent as is.
+func TestCompressSendRecv(t *testing.T) {
+	t.Parallel()
+
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the stream based encrypted links, compressing the client side
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink := New(clientStrm, clientHKDF, false)
+	serverLink := New(serverStrm, serverHKDF, true)
+
+	clientLink.Compress(Snappy)
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Send a compressible, an incompressible and a small payload
+	random := make([]byte, 8192)
+	io.ReadFull(rand.Reader, random)
+
+	for i, tt := range []struct {
+		data   []byte
+		packed bool
+	}{
+		{bytes.Repeat([]byte("iris "), 2048), true},
+		{random, false},
+		{[]byte("iris iris iris iris"), false},
+	} {
+		send := &proto.Message{
+			Head: proto.Header{
+				Meta: []byte{byte(i)},
+			},
+			Data: append([]byte{}, tt.data...),
+		}
+		send.Encrypt()
+
+		if _, packed := clientLink.compress(send).Head.Meta.(*packedPacket); packed != tt.packed {
+			t.Fatalf("test %d: compression mismatch: have %v, want %v.", i, packed, tt.packed)
+		}
+		select {
+		case clientLink.Send <- send:
+			// Ok
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: send timed out", i)
+		}
+		select {
+		case recv, ok := <-serverLink.Recv:
+			if !ok {
+				t.Fatalf("test %d: link closed prematurely", i)
+			}
+			if !bytes.Equal(recv.Head.Meta.([]byte), []byte{byte(i)}) {
+				t.Fatalf("test %d: metadata mismatch: have %v, want %v.", i, recv.Head.Meta, []byte{byte(i)})
+			}
+			if err := recv.Decrypt(); err != nil {
+				t.Fatalf("test %d: failed to decrypt payload: %v.", i, err)
+			}
+			if !bytes.Equal(recv.Data, tt.data) {
+				t.Fatalf("test %d: payload mismatch.", i)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("test %d: receive timed out", i)
+		}
+	}
+	// Ensure the links can be successfully torn down
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := clientLink.Close(); err != nil {
+			t.Errorf("failed to close client link: %v.", err)
+		}
+	}()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+	<-done
+}
+
+// Tests that links keep streaming while rotating their keys in-band, both with
+// the CTR and HMAC framing and the AEAD modes, accounting for all the traffic.
+func TestRekeySendRecv(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"", AESGCM, ChaCha20Poly1305} {
+		testRekeySendRecv(t, mode)
+	}
+}
+
+func testRekeySendRecv(t *testing.T, mode string) {
+	// Start a stream listener
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to resolve local address: %v.", err)
+	}
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		t.Fatalf("failed to listen for incoming streams: %v.", err)
+	}
+	listener.Accept(10 * time.Millisecond)
+	defer listener.Close()
+
+	// Establish a stream connection to the listener
+	host := fmt.Sprintf("%s:%d", "localhost", addr.Port)
+	clientStrm, err := stream.Dial(host, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to connect to stream listener: %v.", err)
+	}
+	serverStrm := <-listener.Sink
+
+	// Initialize the stream based encrypted links, rotating keys every few frames
+	secret := make([]byte, 16)
+	io.ReadFull(rand.Reader, secret)
+
+	clientHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+	serverHKDF := hkdf.New(sha1.New, secret, []byte("HKDF salt"), []byte("HKDF info"))
+
+	clientLink, serverLink := New(clientStrm, clientHKDF, false), New(serverStrm, serverHKDF, true)
+	if mode != "" {
+		clientLink, serverLink = NewAEAD(clientStrm, clientHKDF, false, mode), NewAEAD(serverStrm, serverHKDF, true, mode)
+	}
+
+	clientLink.Rekey(time.Millisecond, 0)
+	serverLink.Rekey(0, 256)
+	clientChain, serverChain := clientLink.outChain, serverLink.outChain
+
+	clientLink.Start(32)
+	serverLink.Start(32)
+
+	// Pass messages both ways, spanning many key epochs
+	for i := 0; i < 100; i++ {
+		send := &proto.Message{
+			Head: proto.Header{
+				Meta: []byte{byte(i)},
+			},
+			Data: make([]byte, 128),
+		}
+		io.ReadFull(rand.Reader, send.Data)
+		send.Encrypt()
+
+		for _, pair := range [][2]*Link{{clientLink, serverLink}, {serverLink, clientLink}} {
+			select {
+			case pair[0].Send <- send:
+				// Ok
+			case <-time.After(100 * time.Millisecond):
+				t.Fatalf("send timed out")
+			}
+			select {
+			case recv, ok := <-pair[1].Recv:
+				if !ok {
+					t.Fatalf("link closed prematurely")
+				}
+				if !bytes.Equal(send.Head.Meta.([]byte), recv.Head.Meta.([]byte)) || !bytes.Equal(send.Data, recv.Data) {
+					t.Fatalf("send/receive mismatch: have %+v, want %+v.", recv, send)
+				}
+			case <-time.After(100 * time.Millisecond):
+				t.Fatalf("receive timed out")
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Verify that the traffic statistics of the two sides match up
+	for _, pair := range [][2]*Link{{clientLink, serverLink}, {serverLink, clientLink}} {
+		out, in := pair[0].Stats(), pair[1].Stats()
+		if out.FramesOut < 100 || out.FramesOut != in.FramesIn || out.BytesOut != in.BytesIn {
+			t.Fatalf("traffic stats mismatch: have %d frames/%d bytes, want %d frames/%d bytes.", in.FramesIn, in.BytesIn, out.FramesOut, out.BytesOut)
+		}
+		if out.Rekeys == 0 || out.Rekeys != in.Rekeys {
+			t.Fatalf("rekey count mismatch: have %d, want %d.", in.Rekeys, out.Rekeys)
+		}
+	}
+	// Ensure the links can be successfully torn down
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := clientLink.Close(); err != nil {
+			t.Errorf("failed to close client link: %v.", err)
+		}
+	}()
+	if err := serverLink.Close(); err != nil {
+		t.Fatalf("failed to close server link: %v.", err)
+	}
+	<-done
+
+	// Make sure both directions did rotate their keys
+	if bytes.Equal(clientLink.outChain, clientChain) || bytes.Equal(serverLink.outChain, serverChain) {
+		t.Fatalf("link keys not rotated.")
+	}
+}
+
+// Tests that the anti-replay window accepts fresh sequence numbers only.
+func TestReplayWindow(t *testing.T) {
+	t.Parallel()
+
+	w := new(window)
+	steps := []struct {
+		seq uint64
+		ok  bool
+	}{
+		{0, false},           // Never sent
+		{1, true}, {2, true}, // In order
+		{2, false},           // Replayed
+		{5, true}, {4, true}, // Reordered within the window
+		{4, false},                  // Reordered replay
+		{5 + replayWindow, true},    // Window slid forward
+		{5, false},                  // Fell out of the window
+		{6, true},                   // Still within the window
+		{6 + 2*replayWindow, true},  // Window jumped ahead
+		{6 + replayWindow, false},   // Fell out of the window
+		{5 + 2*replayWindow, true},  // Still within the window
+		{5 + 2*replayWindow, false}, // Replayed
+	}
+	for i, step := range steps {
+		if ok := w.accept(step.seq); ok != step.ok {
+			t.Fatalf("step %d, seq %d: acceptance mismatch: have %v, want %v.", i, step.seq, ok, step.ok)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the in-band re-keying of the links. Each direction of a link keeps a
+// chain key alongside its cipher and MAC keys, from which the keys of the next
+// epoch (and the next chain key) are derived through a one-way HKDF ratchet. Once
+// the configured time or byte volume elapses, the sender announces the rotation
+// with a rekey packet (still protected by the old keys) and switches over; the
+// receiver follows suit upon processing the packet. There's no round trip, so the
+// links keep streaming throughout.
+//
+// The epoch keys cannot be reversed into the chain, nor the chain into earlier
+// ones, bounding the exposure of a compromised session key to its own epoch.
+
+package link
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Link key rotation message, switching the sender's direction to the next epoch.
+type rekeyPacket struct {
+}
+
+// Make sure the rekey packet is registered with gob.
+func init() {
+	gob.Register(&rekeyPacket{})
+}
+
+// Info values of the ratchet's HKDF expansions.
+var (
+	chainInfo = []byte("iris.proto.link.rekey.chain")
+	epochInfo = []byte("iris.proto.link.rekey.epoch")
+)
+
+// Advances a key chain by one epoch, returning the next chain key and the key
+// stream to extract the epoch's cipher and MAC keys from.
+func ratchet(chain []byte) ([]byte, io.Reader) {
+	next := make([]byte, config.HkdfHash.Size())
+	if _, err := io.ReadFull(hkdf.New(config.HkdfHash.New, chain, nil, chainInfo), next); err != nil {
+		panic(fmt.Sprintf("Failed to advance key chain: %v", err))
+	}
+	return next, hkdf.New(config.HkdfHash.New, chain, nil, epochInfo)
+}
+
+// Sets the time and byte volume after which the outbound keys are rotated (0 =
+// never). Must be called before starting the link.
+func (l *Link) Rekey(period time.Duration, bytes int) {
+	l.rekeyPeriod, l.rekeyBytes = period, bytes
+}
+
+// Sends a message through the link, rotating the outbound keys first if due.
+func (l *Link) send(msg *proto.Message) error {
+	if (l.rekeyPeriod > 0 && time.Since(l.outEpoch) >= l.rekeyPeriod) || (l.rekeyBytes > 0 && l.outBytes >= l.rekeyBytes) {
+		if err := l.rekeyOut(); err != nil {
+			return err
+		}
+	}
+	l.outBytes += len(msg.Data) + frameOverhead
+	return l.SendDirect(msg)
+}
+
+// Announces the rotation of the outbound keys to the remote side, and switches
+// over to the next epoch.
+func (l *Link) rekeyOut() error {
+	err := l.SendDirect(&proto.Message{
+		Head: proto.Header{
+			Meta: &rekeyPacket{},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var keys io.Reader
+	l.outChain, keys = ratchet(l.outChain)
+	if l.mode != "" {
+		l.outAEAD, l.outCount = makeSealer(l.mode, streamKeys(keys)), 0
+	} else {
+		l.outCipher, l.outMacer = makeHalfDuplex(streamKeys(keys))
+	}
+	l.outEpoch, l.outBytes = time.Now(), 0
+	l.stats.rekeyed()
+	return nil
+}
+
+// Switches the inbound keys over to the next epoch, as announced by the remote
+// side.
+func (l *Link) rekeyIn() {
+	var keys io.Reader
+	l.inChain, keys = ratchet(l.inChain)
+	if l.mode != "" {
+		l.inAEAD, l.inCount = makeSealer(l.mode, streamKeys(keys)), 0
+	} else {
+		l.inCipher, l.inMacer = makeHalfDuplex(streamKeys(keys))
+	}
+	l.stats.rekeyed()
+}
@@ -0,0 +1,94 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the replay protection of the links. Once enabled on both sides, every
+// frame is prefixed with a monotonically increasing sequence number, encrypted and
+// authenticated together with its headers, which the receiver checks against a
+// sliding window of the recently seen ones. Captured frames thus cannot be
+// replayed into the link, independently of the chaining of the MACs (restarted
+// on every key rotation).
+
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Size of the anti-replay window in frames.
+const replayWindow = 64
+
+// Returned when a frame's sequence number was already seen or is too old.
+var ErrReplay = errors.New("replayed frame")
+
+// Sliding window of the recently accepted sequence numbers.
+type window struct {
+	top  uint64 // Highest sequence number accepted
+	seen uint64 // Bitmap of the accepted ones below (and including) top
+}
+
+// Checks whether a sequence number is fresh, marking it seen if so.
+func (w *window) accept(seq uint64) bool {
+	switch {
+	case seq == 0:
+		return false
+	case seq > w.top:
+		if shift := seq - w.top; shift < replayWindow {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.top = seq
+		return true
+	case w.top-seq >= replayWindow:
+		return false
+	default:
+		bit := uint64(1) << (w.top - seq)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
+
+// Enables the sequence numbering of the frames, rejecting replayed ones. Must be
+// called on both sides before any frame is exchanged.
+func (l *Link) Sequence() {
+	l.sequenced = true
+}
+
+// Prefixes the outbound header buffer with the next sequence number.
+func (l *Link) stamp() {
+	var seq [8]byte
+	l.outSeq++
+	binary.BigEndian.PutUint64(seq[:], l.outSeq)
+	l.outBuffer.Write(seq[:])
+}
+
+// Strips the sequence number off a decrypted inbound header, verifying that it's
+// not a replay.
+func (l *Link) verify(head []byte) ([]byte, error) {
+	if len(head) < 8 {
+		return nil, errors.New("missing sequence number")
+	}
+	if !l.inWindow.accept(binary.BigEndian.Uint64(head)) {
+		return nil, ErrReplay
+	}
+	return head[8:], nil
+}
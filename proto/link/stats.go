@@ -0,0 +1,72 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the traffic statistics of the links: a set of atomic counters of the
+// frames and bytes crossing the wire (headers and MACs included) and of the key
+// rotations, readable while the link is running.
+
+package link
+
+import "sync/atomic"
+
+// Point in time snapshot of the traffic statistics of a link.
+type Stats struct {
+	BytesIn   uint64 // Number of bytes received through the link
+	BytesOut  uint64 // Number of bytes sent through the link
+	FramesIn  uint64 // Number of frames received through the link
+	FramesOut uint64 // Number of frames sent through the link
+	Rekeys    uint64 // Number of key rotations, in either direction
+}
+
+// Live traffic counters of a link. Kept separately from the link to guarantee
+// 64 bit alignment for the atomic operations.
+type statistics struct {
+	bytesIn   uint64
+	bytesOut  uint64
+	framesIn  uint64
+	framesOut uint64
+	rekeys    uint64
+}
+
+// Accounts for a frame of the given wire size sent through the link.
+func (s *statistics) sent(size int) {
+	atomic.AddUint64(&s.framesOut, 1)
+	atomic.AddUint64(&s.bytesOut, uint64(size))
+}
+
+// Accounts for a frame of the given wire size received through the link.
+func (s *statistics) recv(size int) {
+	atomic.AddUint64(&s.framesIn, 1)
+	atomic.AddUint64(&s.bytesIn, uint64(size))
+}
+
+// Accounts for a key rotation of either link direction.
+func (s *statistics) rekeyed() {
+	atomic.AddUint64(&s.rekeys, 1)
+}
+
+// Collects a consistent-enough snapshot of the current counter values.
+func (l *Link) Stats() Stats {
+	return Stats{
+		BytesIn:   atomic.LoadUint64(&l.stats.bytesIn),
+		BytesOut:  atomic.LoadUint64(&l.stats.bytesOut),
+		FramesIn:  atomic.LoadUint64(&l.stats.framesIn),
+		FramesOut: atomic.LoadUint64(&l.stats.framesOut),
+		Rekeys:    atomic.LoadUint64(&l.stats.rekeys),
+	}
+}
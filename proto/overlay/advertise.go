@@ -0,0 +1,60 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the address advertisement of multi-homed nodes: a node listens on all
+// its IPv4 (and optionally global IPv6) interfaces, and advertises them together
+// with any configured external addresses (e.g. NAT mappings) in the handshakes
+// and state exchanges. Peers dial the addresses in the advertised order, so the
+// most likely paths are tried first and clusters spanning mixed networks connect
+// over whichever one works.
+
+package overlay
+
+import (
+	"net"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Checks whether overlay sessions should be accepted on a local interface address:
+// non-loopback IPv4 ones always, global IPv6 ones only if enabled.
+func Listenable(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return false
+	}
+	if ip.To4() != nil {
+		return true
+	}
+	return config.PastryIPv6 && ip.IsGlobalUnicast()
+}
+
+// Orders the listener addresses of a node for advertisement: IPv4 ones first,
+// IPv6 ones next and finally the extra (external) addresses.
+func Advertise(listeners []string, extra []string) []string {
+	addrs := make([]string, 0, len(listeners)+len(extra))
+	for _, v6 := range []bool{false, true} {
+		for _, addr := range listeners {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				if ip := net.ParseIP(host); ip != nil && (ip.To4() == nil) == v6 {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return append(addrs, extra...)
+}
@@ -0,0 +1,36 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that the advertised addresses are ordered IPv4 first, IPv6 next and the
+// extra ones last.
+func TestAdvertiseOrder(t *testing.T) {
+	listeners := []string{"10.0.0.1:1", "[2001:db8::1]:2", "192.168.0.1:3"}
+	extra := []string{"nat.example.com:4"}
+
+	want := []string{"10.0.0.1:1", "192.168.0.1:3", "[2001:db8::1]:2", "nat.example.com:4"}
+	if have := Advertise(listeners, extra); !reflect.DeepEqual(have, want) {
+		t.Fatalf("advertised order mismatch: have %v, want %v.", have, want)
+	}
+}
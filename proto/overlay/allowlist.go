@@ -0,0 +1,91 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the node key allowlist: the fingerprints of the node keys permitted to
+// join the overlay, and optionally a callback deciding on the others (e.g. by
+// consulting an inventory service). As node ids are bound to the node keys, and
+// the keys proven during the handshake, a leaked cluster key alone is no longer
+// enough to join: the intruder's node key must also be allowed. With neither a
+// list nor a callback configured, any holder of the cluster key may join.
+
+package overlay
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned if an allowlist entry is not a hex SHA-256 fingerprint.
+var ErrAllowEntry = errors.New("invalid allowlist entry")
+
+// Runtime callback deciding on the node keys missing from the allowlist.
+var allowFunc func(ed25519.PublicKey) bool
+var allowLock sync.RWMutex
+
+// Calculates the fingerprint of a node key: the hex SHA-256 of the public key.
+func Fingerprint(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:])
+}
+
+// Checks that all the configured allowlist entries are well formed.
+func CheckAllowlist(entries []string) error {
+	for _, entry := range entries {
+		if raw, err := hex.DecodeString(entry); err != nil || len(raw) != sha256.Size {
+			return ErrAllowEntry
+		}
+	}
+	return nil
+}
+
+// Sets the callback deciding on the node keys not in the configured allowlist
+// (nil to remove). Existing sessions are not affected, only new ones.
+func SetAllowFunc(fn func(ed25519.PublicKey) bool) {
+	allowLock.Lock()
+	defer allowLock.Unlock()
+
+	allowFunc = fn
+}
+
+// Returns whether a remote node key may join the overlay: it's listed in the
+// allowlist or approved by the callback (or neither is configured).
+func Allowed(pub []byte) bool {
+	allowLock.RLock()
+	fn := allowFunc
+	allowLock.RUnlock()
+
+	if len(config.PastryAllowlist) == 0 && fn == nil {
+		return true
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	fp := Fingerprint(pub)
+	for _, entry := range config.PastryAllowlist {
+		if strings.EqualFold(entry, fp) {
+			return true
+		}
+	}
+	return fn != nil && fn(ed25519.PublicKey(pub))
+}
@@ -0,0 +1,76 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that only the allowlisted or callback approved node keys may join, and
+// that anyone may if neither is configured.
+func TestAllowlist(t *testing.T) {
+	static := config.PastryAllowlist
+	defer func() { config.PastryAllowlist = static }()
+	defer SetAllowFunc(nil)
+
+	listed, _ := NewIdentity()
+	approved, _ := NewIdentity()
+	other, _ := NewIdentity()
+
+	listedPub := listed.Public().(ed25519.PublicKey)
+	approvedPub := approved.Public().(ed25519.PublicKey)
+	otherPub := other.Public().(ed25519.PublicKey)
+
+	// Verify the entry validation
+	if err := CheckAllowlist([]string{Fingerprint(listedPub), strings.ToUpper(Fingerprint(otherPub))}); err != nil {
+		t.Fatalf("valid allowlist entries rejected: %v.", err)
+	}
+	for _, entry := range []string{"", "xyz", Fingerprint(listedPub)[2:]} {
+		if err := CheckAllowlist([]string{entry}); err != ErrAllowEntry {
+			t.Fatalf("invalid allowlist entry %q error mismatch: have %v, want %v.", entry, err, ErrAllowEntry)
+		}
+	}
+	// Without an allowlist, anyone should be allowed
+	config.PastryAllowlist = nil
+	if !Allowed(listedPub) || !Allowed(otherPub) {
+		t.Fatalf("node key refused without allowlist.")
+	}
+	// With an allowlist, only the listed keys should be
+	config.PastryAllowlist = []string{strings.ToUpper(Fingerprint(listedPub))}
+	if !Allowed(listedPub) {
+		t.Fatalf("allowlisted node key refused.")
+	}
+	if Allowed(otherPub) || Allowed(approvedPub) || Allowed(nil) {
+		t.Fatalf("non-allowlisted node key allowed.")
+	}
+	// The callback should approve further keys, also on its own
+	SetAllowFunc(func(pub ed25519.PublicKey) bool {
+		return pub.Equal(approvedPub)
+	})
+	for _, list := range [][]string{config.PastryAllowlist, nil} {
+		config.PastryAllowlist = list
+		if !Allowed(approvedPub) || Allowed(otherPub) {
+			t.Fatalf("callback decision mismatch with allowlist %v.", list)
+		}
+	}
+}
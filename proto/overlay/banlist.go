@@ -0,0 +1,121 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the peer ban list: remote hosts and node ids (misbehaving, retired or
+// compromised nodes) with which the overlays refuse to hold sessions, and whose
+// bootstrap beacons get ignored. The configured bans are permanent, the ones set
+// at runtime may carry an expiration.
+
+package overlay
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned if a ban entry is neither an IP address nor a decimal node id.
+var ErrBanEntry = errors.New("invalid ban entry")
+
+// Runtime bans, mapped from the canonical entry to the expiration (zero = never).
+var bans = make(map[string]time.Time)
+var banLock sync.Mutex
+
+// Converts a ban entry into its canonical form: a flattened IP or node id.
+func canonBan(entry string) (string, error) {
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String(), nil
+	}
+	if id, ok := new(big.Int).SetString(entry, 10); ok && id.Sign() >= 0 {
+		return "#" + id.String(), nil
+	}
+	return "", ErrBanEntry
+}
+
+// Bans a remote host (IP address) or node id (decimal) for the given duration,
+// or indefinitely if zero. Existing sessions are not affected, only new ones.
+func Ban(entry string, ttl time.Duration) error {
+	key, err := canonBan(entry)
+	if err != nil {
+		return err
+	}
+	expiry := time.Time{}
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+	banLock.Lock()
+	bans[key] = expiry
+	banLock.Unlock()
+	return nil
+}
+
+// Lifts a runtime ban, reporting whether one was in force. Configured bans stay.
+func Unban(entry string) bool {
+	key, err := canonBan(entry)
+	if err != nil {
+		return false
+	}
+	banLock.Lock()
+	defer banLock.Unlock()
+
+	expiry, ok := bans[key]
+	delete(bans, key)
+	return ok && (expiry.IsZero() || time.Now().Before(expiry))
+}
+
+// Checks that all the configured ban entries are well formed.
+func CheckBans(entries []string) error {
+	for _, entry := range entries {
+		if _, err := canonBan(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks whether a canonical entry is banned, dropping it if expired.
+func banned(key string) bool {
+	for _, entry := range config.PastryBans {
+		if canon, err := canonBan(entry); err == nil && canon == key {
+			return true
+		}
+	}
+	banLock.Lock()
+	defer banLock.Unlock()
+
+	expiry, ok := bans[key]
+	if ok && !expiry.IsZero() && !time.Now().Before(expiry) {
+		delete(bans, key)
+		return false
+	}
+	return ok
+}
+
+// Returns whether the remote host is banned.
+func BannedHost(ip net.IP) bool {
+	return ip != nil && banned(ip.String())
+}
+
+// Returns whether the remote node id is banned.
+func BannedId(id *big.Int) bool {
+	return id != nil && banned("#"+id.String())
+}
@@ -0,0 +1,80 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that configured and runtime bans are enforced, and that runtime ones can
+// be lifted or expire.
+func TestBanList(t *testing.T) {
+	static := config.PastryBans
+	defer func() { config.PastryBans = static }()
+	config.PastryBans = []string{"10.0.0.1", "42"}
+
+	// Verify the entry validation
+	if err := CheckBans([]string{"10.0.0.1", "::1", "42"}); err != nil {
+		t.Fatalf("valid ban entries rejected: %v.", err)
+	}
+	for _, entry := range []string{"", "host.local", "-1", "0x2a"} {
+		if err := Ban(entry, 0); err != ErrBanEntry {
+			t.Fatalf("invalid ban entry %q error mismatch: have %v, want %v.", entry, err, ErrBanEntry)
+		}
+	}
+	// Verify the configured bans
+	if !BannedHost(net.ParseIP("10.0.0.1")) || !BannedId(big.NewInt(42)) {
+		t.Fatalf("configured bans not enforced.")
+	}
+	if BannedHost(net.ParseIP("10.0.0.2")) || BannedId(big.NewInt(43)) || BannedHost(nil) || BannedId(nil) {
+		t.Fatalf("unbanned entries reported banned.")
+	}
+	if Unban("10.0.0.1") || !BannedHost(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("configured ban lifted at runtime.")
+	}
+	// Verify permanent runtime bans and their lifting
+	if err := Ban("10.0.0.2", 0); err != nil {
+		t.Fatalf("failed to ban host: %v.", err)
+	}
+	if !BannedHost(net.ParseIP("10.0.0.2").To16()) {
+		t.Fatalf("runtime host ban not enforced.")
+	}
+	if !Unban("10.0.0.2") || BannedHost(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("runtime host ban not lifted.")
+	}
+	// Verify expiring runtime bans
+	if err := Ban("43", 50*time.Millisecond); err != nil {
+		t.Fatalf("failed to ban node: %v.", err)
+	}
+	if !BannedId(big.NewInt(43)) {
+		t.Fatalf("runtime node ban not enforced.")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if BannedId(big.NewInt(43)) {
+		t.Fatalf("runtime node ban not expired.")
+	}
+	if Unban("43") {
+		t.Fatalf("expired ban reported lifted.")
+	}
+}
@@ -0,0 +1,88 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing hooks shared by the structured overlays: upper layer
+// messages passing through the local node (originated, forwarded or delivered
+// alike) can be intercepted before and after the routing decision, for traffic
+// accounting, policy enforcement or routing experiments without touching the
+// core router. Overlay system messages are never hooked.
+
+package overlay
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/project-iris/iris/proto"
+)
+
+// Routing details of a message passing through the local node.
+type Hop struct {
+	Src  *big.Int // Overlay id of the previous hop (nil if originated locally)
+	Dest *big.Int // Destination id the message is routed towards
+	Next *big.Int // Selected next hop, the local id if delivering (nil before routing)
+	Rule string   // Rule selecting the next hop (empty before routing)
+}
+
+// Hook invoked on an upper layer message passing through the local node. The
+// message carries the upper layer headers only and may be modified in place.
+// Returning false drops the message.
+type RouteHook func(msg *proto.Message, hop *Hop) bool
+
+// Routing hooks registered on an overlay.
+type Hooks struct {
+	before []RouteHook // Hooks invoked before the routing decision
+	after  []RouteHook // Hooks invoked after the routing decision
+
+	lock sync.RWMutex
+}
+
+// Registers a hook invoked before the routing decision.
+func (h *Hooks) Before(hook RouteHook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.before = append(h.before, hook)
+}
+
+// Registers a hook invoked after the routing decision.
+func (h *Hooks) After(hook RouteHook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.after = append(h.after, hook)
+}
+
+// Retrieves the currently registered hooks of both stages.
+func (h *Hooks) Chains() ([]RouteHook, []RouteHook) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.before, h.after
+}
+
+// Runs a message through a hook chain until one drops it. Returns whether the
+// message survived.
+func Run(chain []RouteHook, msg *proto.Message, hop *Hop) bool {
+	for _, hook := range chain {
+		if !hook(msg, hop) {
+			return false
+		}
+	}
+	return true
+}
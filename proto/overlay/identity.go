@@ -0,0 +1,140 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the cryptographic binding of node ids to node keys: every overlay node
+// generates its own signing key and derives its id from the hash of the public
+// half. During session establishment each side proves the possession of the key
+// behind its claimed id by signing the session binding, so even insiders knowing
+// the cluster secret cannot spoof the id of others (or pick one freely to place
+// themselves around a victim). Signing the binding, unique to each session, also
+// prevents relaying the proof of an honest node from another session, and signing
+// the role of the prover within the session (dialer or acceptor) prevents the
+// remote side from reflecting it back within the same one.
+//
+// The id derivation and the other primitives in this package are shared by all
+// the structured overlays (pastry and kademlia), keeping them interoperable with
+// the carrier and the tooling on top.
+//
+// Since the id is bound to the key, it cannot be supplied freely. Deployments
+// needing stable, reproducible ids may instead derive the key itself from a seed,
+// which must be kept as secret as the key: anyone knowing it can claim the id.
+
+package overlay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned when a remote node's id isn't bound to the key proving it.
+var ErrUnboundId = errors.New("node id not bound to key")
+
+// Domain separation prefix of the signed session bindings (named after pastry,
+// which introduced it, for wire compatibility).
+var proofDomain = []byte("iris.proto.pastry.id.proof")
+
+// Domain separation prefix of the seeds deriving node keys.
+var seedDomain = []byte("iris.proto.overlay.id.seed")
+
+// Generates a new node key, returning it alongside the overlay id bound to it.
+func NewIdentity() (ed25519.PrivateKey, *big.Int) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate node key: %v", err))
+	}
+	return key, BindId(pub)
+}
+
+// Creates the node key of a new node, derived from the configured seed if any or
+// generated randomly otherwise, returning it alongside the overlay id bound to it.
+func LocalIdentity() (ed25519.PrivateKey, *big.Int) {
+	if config.PastryIdentitySeed != "" {
+		return SeededIdentity(config.PastryIdentitySeed)
+	}
+	return NewIdentity()
+}
+
+// Derives a node key deterministically from a secret seed, returning it alongside
+// the overlay id bound to it.
+func SeededIdentity(seed string) (ed25519.PrivateKey, *big.Int) {
+	h := sha256.New()
+	h.Write(seedDomain)
+	io.WriteString(h, seed)
+
+	key := ed25519.NewKeyFromSeed(h.Sum(nil))
+	return key, BindId(key.Public().(ed25519.PublicKey))
+}
+
+// Derives the overlay id bound to a node's public key.
+func BindId(pub ed25519.PublicKey) *big.Int {
+	return Resolve(string(pub))
+}
+
+// Proves the possession of a node key by signing a session binding, along with
+// the role of the prover in the session.
+func ProveId(key ed25519.PrivateKey, binding []byte, server bool) []byte {
+	return ed25519.Sign(key, proofMessage(binding, server))
+}
+
+// Verifies that a remote node's id is derived from its public key, and that the
+// node proved the possession of the private half within the session, from the
+// given role.
+func VerifyId(id *big.Int, pub []byte, proof []byte, binding []byte, server bool) error {
+	if len(pub) != ed25519.PublicKeySize || id == nil || BindId(pub).Cmp(id) != 0 {
+		return ErrUnboundId
+	}
+	if !ed25519.Verify(pub, proofMessage(binding, server), proof) {
+		return ErrUnboundId
+	}
+	return nil
+}
+
+// Assembles the message signed by an identity proof: the domain separator, the
+// role of the prover and the session binding.
+func proofMessage(binding []byte, server bool) []byte {
+	role := byte(0)
+	if server {
+		role = 1
+	}
+	msg := append([]byte{}, proofDomain...)
+	msg = append(msg, role)
+	return append(msg, binding...)
+}
+
+// Converts a string id into an overlay id.
+func Resolve(id string) *big.Int {
+	// Hash the textual id
+	h := config.PastryResolver()
+	io.WriteString(h, id)
+	sum := h.Sum(nil)
+
+	// Extract enough bits, and clear overflows
+	raw := sum[:(config.PastrySpace+7)/8]
+	for i := 0; i < len(raw)*8-config.PastrySpace; i++ {
+		raw[0] &= ^byte(1 << (7 - uint(i)))
+	}
+	// Return the new id
+	return new(big.Int).SetBytes(raw)
+}
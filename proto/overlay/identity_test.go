@@ -0,0 +1,124 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that node ids are bound to the node keys and that the proofs only verify
+// within the session they were made for.
+func TestIdentity(t *testing.T) {
+	key, id := NewIdentity()
+	pub := []byte(key.Public().(ed25519.PublicKey))
+	binding := []byte("session binding")
+
+	proof := ProveId(key, binding, false)
+	if err := VerifyId(id, pub, proof, binding, false); err != nil {
+		t.Fatalf("failed to verify valid identity: %v.", err)
+	}
+	// Verify that spoofed ids, foreign keys, relayed and reflected proofs are all rejected
+	if err := VerifyId(new(big.Int).Add(id, big.NewInt(1)), pub, proof, binding, false); err != ErrUnboundId {
+		t.Fatalf("spoofed id verification mismatch: have %v, want %v.", err, ErrUnboundId)
+	}
+	other, _ := NewIdentity()
+	if err := VerifyId(id, pub, ProveId(other, binding, false), binding, false); err != ErrUnboundId {
+		t.Fatalf("foreign key verification mismatch: have %v, want %v.", err, ErrUnboundId)
+	}
+	if err := VerifyId(id, pub, proof, []byte("other binding"), false); err != ErrUnboundId {
+		t.Fatalf("relayed proof verification mismatch: have %v, want %v.", err, ErrUnboundId)
+	}
+	if err := VerifyId(id, pub, proof, binding, true); err != ErrUnboundId {
+		t.Fatalf("reflected proof verification mismatch: have %v, want %v.", err, ErrUnboundId)
+	}
+}
+
+func TestSeededIdentity(t *testing.T) {
+	key, id := SeededIdentity("seed")
+	pub := []byte(key.Public().(ed25519.PublicKey))
+	if BindId(pub).Cmp(id) != 0 {
+		t.Fatalf("seeded id not bound to key: have %v, want %v.", id, BindId(pub))
+	}
+	// Verify that the derivation is deterministic, but distinct across seeds
+	if _, same := SeededIdentity("seed"); same.Cmp(id) != 0 {
+		t.Fatalf("seeded id mismatch: have %v, want %v.", same, id)
+	}
+	if _, other := SeededIdentity("seed.1"); other.Cmp(id) == 0 {
+		t.Fatalf("distinct seeds derived the same id: %v.", id)
+	}
+	// Verify that the configured seed is picked up by new nodes
+	defer func(seed string) { config.PastryIdentitySeed = seed }(config.PastryIdentitySeed)
+	config.PastryIdentitySeed = "seed"
+	if _, local := LocalIdentity(); local.Cmp(id) != 0 {
+		t.Fatalf("configured id mismatch: have %v, want %v.", local, id)
+	}
+}
+
+type resolveTest struct {
+	hasher func() hash.Hash
+	bitlen int
+	text   string
+	id     []byte
+}
+
+var resolveTests = []resolveTest{
+	// Inter-byte boundaries
+	{md5.New, 8, "", []byte{0xd4}},
+	{md5.New, 16, "", []byte{0xd4, 0x1d}},
+	{md5.New, 24, "", []byte{0xd4, 0x1d, 0x8c}},
+	{md5.New, 8, "string", []byte{0xb4}},
+	{md5.New, 16, "string", []byte{0xb4, 0x5c}},
+	{md5.New, 24, "string", []byte{0xb4, 0x5c, 0xff}},
+
+	// Intra-byte boundaries
+	{md5.New, 1, "", []byte{0x00}},
+	{md5.New, 2, "", []byte{0x00}},
+	{md5.New, 3, "", []byte{0x04}},
+	{md5.New, 4, "", []byte{0x04}},
+	{md5.New, 5, "", []byte{0x14}},
+	{md5.New, 6, "", []byte{0x14}},
+	{md5.New, 7, "", []byte{0x54}},
+
+	// Other hashes
+	{sha1.New, 32, "", []byte{0xda, 0x39, 0xa3, 0xee}},
+	{sha256.New, 32, "", []byte{0xe3, 0xb0, 0xc4, 0x42}},
+}
+
+func TestResolve(t *testing.T) {
+	// Save the previous config values
+	s, h := config.PastrySpace, config.PastryResolver
+	defer func() { config.PastrySpace, config.PastryResolver = s, h }()
+
+	// Run the tests
+	for i, tt := range resolveTests {
+		config.PastrySpace = tt.bitlen
+		config.PastryResolver = tt.hasher
+		if id := Resolve(tt.text); id.Cmp(new(big.Int).SetBytes(tt.id)) != 0 {
+			t.Errorf("test %d: resolution mismatch: have %v, want %v.", i, id.Bytes(), tt.id)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the leaf set change notifications shared by the structured overlays:
+// the upper layers can watch the neighborhood of the local node to migrate their
+// state as soon as the key ownership shifts, instead of discovering it lazily on
+// the next message.
+
+package overlay
+
+import (
+	"math/big"
+	"sync"
+)
+
+// Change of the local leaf set (the closest contacts in kademlia).
+type LeafEvent struct {
+	Joined []*big.Int // Nodes that entered the leaf set
+	Lost   []*big.Int // Nodes that dropped out of the leaf set
+	Leaves []*big.Int // Remote nodes of the new leaf set
+	Shift  bool       // Whether the key range the local node is responsible for changed
+}
+
+// Hook invoked on a leaf set change. Hooks run on the overlay maintenance thread,
+// so they must not block (hand any heavy work off to another goroutine).
+type LeafHook func(event *LeafEvent)
+
+// Leaf set change hooks registered on an overlay.
+type Watchers struct {
+	hooks []LeafHook
+	lock  sync.RWMutex
+}
+
+// Registers a hook invoked on every leaf set change.
+func (w *Watchers) Watch(hook LeafHook) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.hooks = append(w.hooks, hook)
+}
+
+// Invokes all the registered hooks with a leaf set change, in registration order.
+func (w *Watchers) Notify(event *LeafEvent) {
+	w.lock.RLock()
+	hooks := w.hooks
+	w.lock.RUnlock()
+
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
+
+// Assembles the change event between an old and a new leaf set (remote nodes
+// only), returning nil if they contain the same nodes. The key range shift is
+// left to the caller, the ownership rules being overlay specific.
+func DiffLeaves(old, new []*big.Int) *LeafEvent {
+	event := &LeafEvent{Leaves: new}
+	for _, id := range new {
+		if !containsId(old, id) {
+			event.Joined = append(event.Joined, id)
+		}
+	}
+	for _, id := range old {
+		if !containsId(new, id) {
+			event.Lost = append(event.Lost, id)
+		}
+	}
+	if len(event.Joined) == 0 && len(event.Lost) == 0 {
+		return nil
+	}
+	return event
+}
+
+// Checks whether an id is contained within a list.
+func containsId(ids []*big.Int, id *big.Int) bool {
+	for _, old := range ids {
+		if old.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
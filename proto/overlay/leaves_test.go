@@ -0,0 +1,64 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Tests that leaf set diffs report the joined and lost nodes, and that watchers
+// are notified in registration order.
+func TestLeafEvents(t *testing.T) {
+	ids := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+
+	// Verify the leaf set diffs
+	if event := DiffLeaves(ids[:3], []*big.Int{ids[2], ids[0], ids[1]}); event != nil {
+		t.Fatalf("unchanged leaf set reported: %+v.", event)
+	}
+	event := DiffLeaves(ids[:3], ids[1:])
+	if event == nil {
+		t.Fatalf("leaf set change not reported.")
+	}
+	if len(event.Joined) != 1 || event.Joined[0].Cmp(ids[3]) != 0 {
+		t.Fatalf("joined nodes mismatch: have %v, want %v.", event.Joined, ids[3:])
+	}
+	if len(event.Lost) != 1 || event.Lost[0].Cmp(ids[0]) != 0 {
+		t.Fatalf("lost nodes mismatch: have %v, want %v.", event.Lost, ids[:1])
+	}
+	if len(event.Leaves) != 3 {
+		t.Fatalf("new leaf set mismatch: have %v, want %v.", event.Leaves, ids[1:])
+	}
+	// Verify the watcher notifications
+	order := []int{}
+	watchers := new(Watchers)
+	for i := 0; i < 3; i++ {
+		i := i // Copy for closure!
+		watchers.Watch(func(e *LeafEvent) {
+			if e != event {
+				t.Errorf("watcher #%d: event mismatch: have %p, want %p.", i, e, event)
+			}
+			order = append(order, i)
+		})
+	}
+	watchers.Notify(event)
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Fatalf("notification order mismatch: have %v, want %v.", order, []int{0, 1, 2})
+	}
+}
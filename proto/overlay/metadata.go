@@ -0,0 +1,57 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the node metadata advertisement: a small map of arbitrary key/value
+// pairs (version, zone, roles, capacity class) attached by each node to its state
+// exchanges, stored per peer and exposed through the routing snapshots so that
+// balancers and admin tools can make informed decisions.
+
+package overlay
+
+import (
+	"errors"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned if the node metadata exceeds the configured size limit.
+var ErrMetadataLimit = errors.New("metadata size limit exceeded")
+
+// Checks that the node metadata fits into the configured size limit.
+func CheckMetadata(meta map[string]string) error {
+	size := 0
+	for key, val := range meta {
+		size += len(key) + len(val)
+	}
+	if size > config.PastryMetadataLimit {
+		return ErrMetadataLimit
+	}
+	return nil
+}
+
+// Creates a private copy of the node metadata (nil if empty).
+func CopyMetadata(meta map[string]string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(meta))
+	for key, val := range meta {
+		res[key] = val
+	}
+	return res
+}
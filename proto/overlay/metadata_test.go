@@ -0,0 +1,54 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the metadata size limit covers both the keys and the values, and
+// that copies are private.
+func TestMetadata(t *testing.T) {
+	limit := config.PastryMetadataLimit
+	defer func() { config.PastryMetadataLimit = limit }()
+	config.PastryMetadataLimit = 8
+
+	if err := CheckMetadata(nil); err != nil {
+		t.Fatalf("empty metadata rejected: %v.", err)
+	}
+	if err := CheckMetadata(map[string]string{"zone": "eu-1"}); err != nil {
+		t.Fatalf("metadata at the limit rejected: %v.", err)
+	}
+	if err := CheckMetadata(map[string]string{"zone": "eu-12"}); err != ErrMetadataLimit {
+		t.Fatalf("oversized metadata error mismatch: have %v, want %v.", err, ErrMetadataLimit)
+	}
+	// Verify that copies are detached from the original
+	if res := CopyMetadata(map[string]string{}); res != nil {
+		t.Fatalf("empty metadata copy mismatch: have %v, want nil.", res)
+	}
+	meta := map[string]string{"zone": "eu-1"}
+	res := CopyMetadata(meta)
+	meta["zone"] = "us-2"
+	if want := map[string]string{"zone": "eu-1"}; !reflect.DeepEqual(res, want) {
+		t.Fatalf("metadata copy mismatch: have %v, want %v.", res, want)
+	}
+}
@@ -0,0 +1,64 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the pluggable routing metrics shared by the structured overlays: when
+// several known nodes would make prefix progress towards a destination, a metric
+// scores each of them (hop count, measured latency, loss or any mix) and the best
+// one is selected instead of the plain routing table entry.
+
+package overlay
+
+import (
+	"math"
+	"math/big"
+	"time"
+)
+
+// Routing properties of a candidate next hop. Every candidate shares a longer id
+// prefix with the destination than the local node, so routing always converges.
+type Candidate struct {
+	Id      *big.Int      // Overlay id of the candidate
+	Prefix  int           // Id digits shared with the destination
+	Latency time.Duration // Smoothed round trip time to the candidate (0 if unmeasured)
+	Loss    float64       // Smoothed fraction of the latency probes lost [0..1]
+}
+
+// Metric scoring a candidate next hop, the lowest score being selected. Ties are
+// resolved in favor of the routing table entry.
+type Metric func(c *Candidate) float64
+
+// Prefers the candidates sharing the longest prefix with the destination, i.e.
+// the fewest remaining hops.
+func HopMetric(c *Candidate) float64 {
+	return -float64(c.Prefix)
+}
+
+// Prefers the candidates with the lowest measured latency, inflated by their loss
+// rate. Unmeasured candidates are only selected if nothing else is available.
+func LatencyMetric(c *Candidate) float64 {
+	if c.Latency == 0 {
+		return math.Inf(1)
+	}
+	return float64(c.Latency) / (1 - math.Min(c.Loss, 0.99))
+}
+
+// Routing metrics selectable by name (the empty name is plain prefix routing).
+var Metrics = map[string]Metric{
+	"hops":    HopMetric,
+	"latency": LatencyMetric,
+}
@@ -0,0 +1,67 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing state introspection types shared by the structured overlays:
+// a point in time snapshot of the routing state and the connected peers, and the
+// rules a next hop may be selected by.
+
+package overlay
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Routing rules selecting the next hop towards a destination.
+const (
+	RuleDirect = "direct" // Destination is a directly connected peer
+	RuleLeaf   = "leaf"   // Destination falls within the leaf set range
+	RuleTable  = "table"  // Routing table entry sharing a longer prefix
+	RuleCloser = "closer" // Any known node numerically closer than the local one
+	RuleLocal  = "local"  // No better node is known, delivered locally
+)
+
+// Liveness and connection details of a connected remote peer.
+type PeerInfo struct {
+	Id      *big.Int          // Overlay id of the remote peer
+	Addrs   []string          // Advertised listener addresses of the peer
+	Active  bool              // Whether the peer is part of the local routing state
+	Passive bool              // Whether the peer reported the local node unneeded
+	OneWay  bool              // Whether the peer cannot be dialed back (e.g. behind NAT)
+	Version int               // Session protocol version agreed on with the peer
+	Missed  int               // Number of heartbeat cycles the peer has been silent for
+	Beat    time.Duration     // Current heartbeat interval towards the peer
+	Queued  int               // Number of messages waiting in the outbound queues
+	Dropped uint64            // Number of message frames dropped on a stuck link
+	Latency time.Duration     // Smoothed round trip time to the peer (0 if unmeasured)
+	Loss    float64           // Smoothed fraction of the latency probes lost [0..1]
+	Session *session.Stats    // Traffic and crypto statistics of the session with the peer
+	Meta    map[string]string // Metadata advertised by the peer (nil if none)
+}
+
+// Point in time view of the local routing state.
+type Snapshot struct {
+	Self    *big.Int          // Overlay id of the local node
+	Leaves  []*big.Int        // Leaf set, ordered along the ring (including the local node)
+	Routes  [][]*big.Int      // Routing table rows by shared prefix length (nil cells are empty)
+	Peers   []*PeerInfo       // Connected remote peers, ordered by id
+	Dormant []*big.Int        // Routing entries with idle sessions torn down, re-dialed on demand
+	Meta    map[string]string // Metadata advertised by the local node (nil if none)
+}
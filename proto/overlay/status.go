@@ -0,0 +1,45 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the convergence status shared by the structured overlays, reporting
+// whether the local node is ready to take its share of the traffic (e.g. to wire
+// into the readiness probes of an orchestrator).
+
+package overlay
+
+import "time"
+
+// Life cycle phases of an overlay node.
+const (
+	PhaseBooting   = "booting"   // Bootstrapping and joining, not converged yet
+	PhaseConverged = "converged" // Converged at least once, serving the traffic
+	PhaseLeaving   = "leaving"   // Handing its state over to depart gracefully
+)
+
+// Point in time convergence status of the local overlay node.
+type Status struct {
+	Phase   string        // Life cycle phase of the node
+	Ready   bool          // Whether converged with a stable neighborhood and nothing pending
+	Peers   int           // Number of connected remote peers
+	Leaves  int           // Number of remote nodes in the leaf set (closest contacts)
+	Pending int           // Number of state exchanges awaiting merging
+	Stable  time.Duration // Time since the leaf set last changed
+
+	Shedding bool   // Whether the node is overloaded, shedding bulk transit traffic
+	Shed     uint64 // Number of transit messages shed so far
+}
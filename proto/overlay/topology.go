@@ -0,0 +1,199 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the topology export: the routing snapshots of one or more local nodes
+// are merged into a graph of overlay nodes and the links between them, which can
+// be written out as JSON or Graphviz DOT for cluster-wide visualization tooling
+// (e.g. by concatenating the exports of all the nodes).
+
+package overlay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Kinds of links between overlay nodes.
+const (
+	LinkLeaf  = "leaf"  // Remote node is in the local leaf set
+	LinkTable = "table" // Remote node is in the local routing table
+	LinkPeer  = "peer"  // Remote node is connected, but not in the routing state
+)
+
+// A node of the overlay graph.
+type TopologyNode struct {
+	Id    *big.Int          // Overlay id of the node
+	Addrs []string          // Advertised listener addresses (nil if unknown)
+	Local bool              // Whether the node is hosted by the exporting process
+	Meta  map[string]string // Metadata advertised by the node (nil if unknown)
+}
+
+// A directed link between two overlay nodes, from the one whose view it is.
+type TopologyLink struct {
+	From    *big.Int      // Overlay id of the node owning the routing state
+	To      *big.Int      // Overlay id of the node referenced by the routing state
+	Kind    string        // Reason for the link (one of the Link* constants)
+	Latency time.Duration // Smoothed round trip time of the link (0 if unmeasured)
+	Loss    float64       // Smoothed fraction of the latency probes lost on the link
+}
+
+// Overlay graph as seen by the local nodes, ordered by ids.
+type Topology struct {
+	Nodes []*TopologyNode
+	Links []*TopologyLink
+}
+
+// Merges the routing snapshots of the local nodes into an overlay graph.
+func NewTopology(snaps ...*Snapshot) *Topology {
+	nodes := make(map[string]*TopologyNode)
+	node := func(id *big.Int) *TopologyNode {
+		n, ok := nodes[id.String()]
+		if !ok {
+			n = &TopologyNode{Id: id}
+			nodes[id.String()] = n
+		}
+		return n
+	}
+	topo := new(Topology)
+	for _, snap := range snaps {
+		self := node(snap.Self)
+		self.Local, self.Meta = true, snap.Meta
+
+		// Link up the remote nodes referenced by the routing state
+		links := make(map[string]*TopologyLink)
+		link := func(id *big.Int, kind string) {
+			if _, ok := links[id.String()]; !ok && id.Cmp(snap.Self) != 0 {
+				links[id.String()] = &TopologyLink{From: snap.Self, To: node(id).Id, Kind: kind}
+			}
+		}
+		for _, id := range snap.Leaves {
+			link(id, LinkLeaf)
+		}
+		for _, row := range snap.Routes {
+			for _, id := range row {
+				if id != nil {
+					link(id, LinkTable)
+				}
+			}
+		}
+		// Fill in the connection details, linking the extra peers too
+		for _, peer := range snap.Peers {
+			node(peer.Id).Addrs = peer.Addrs
+			if peer.Meta != nil {
+				node(peer.Id).Meta = peer.Meta
+			}
+
+			link(peer.Id, LinkPeer)
+			links[peer.Id.String()].Latency = peer.Latency
+			links[peer.Id.String()].Loss = peer.Loss
+		}
+		for _, l := range links {
+			topo.Links = append(topo.Links, l)
+		}
+	}
+	for _, n := range nodes {
+		topo.Nodes = append(topo.Nodes, n)
+	}
+	sort.Slice(topo.Nodes, func(i, j int) bool {
+		return topo.Nodes[i].Id.Cmp(topo.Nodes[j].Id) < 0
+	})
+	sort.Slice(topo.Links, func(i, j int) bool {
+		if c := topo.Links[i].From.Cmp(topo.Links[j].From); c != 0 {
+			return c < 0
+		}
+		return topo.Links[i].To.Cmp(topo.Links[j].To) < 0
+	})
+	return topo
+}
+
+// Writes the overlay graph as a JSON document. Ids are encoded as decimal strings
+// and latencies as milliseconds, to survive tooling with float-only numbers.
+func (t *Topology) WriteJSON(w io.Writer) error {
+	type jsonNode struct {
+		Id    string            `json:"id"`
+		Addrs []string          `json:"addrs,omitempty"`
+		Local bool              `json:"local,omitempty"`
+		Meta  map[string]string `json:"meta,omitempty"`
+	}
+	type jsonLink struct {
+		From    string  `json:"from"`
+		To      string  `json:"to"`
+		Kind    string  `json:"kind"`
+		Latency float64 `json:"latency,omitempty"`
+		Loss    float64 `json:"loss,omitempty"`
+	}
+	doc := struct {
+		Nodes []jsonNode `json:"nodes"`
+		Links []jsonLink `json:"links"`
+	}{
+		Nodes: make([]jsonNode, 0, len(t.Nodes)),
+		Links: make([]jsonLink, 0, len(t.Links)),
+	}
+	for _, n := range t.Nodes {
+		doc.Nodes = append(doc.Nodes, jsonNode{Id: n.Id.String(), Addrs: n.Addrs, Local: n.Local, Meta: n.Meta})
+	}
+	for _, l := range t.Links {
+		doc.Links = append(doc.Links, jsonLink{
+			From:    l.From.String(),
+			To:      l.To.String(),
+			Kind:    l.Kind,
+			Latency: float64(l.Latency) / float64(time.Millisecond),
+			Loss:    l.Loss,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&doc)
+}
+
+// Writes the overlay graph as a Graphviz DOT digraph, with the local nodes boxed
+// and the links labeled with their latencies. Links outside the routing state
+// are dashed.
+func (t *Topology) WriteDOT(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+
+	fmt.Fprintf(buf, "digraph overlay {\n")
+	for _, n := range t.Nodes {
+		attrs := fmt.Sprintf("label=%q", n.Id.String())
+		if len(n.Addrs) > 0 {
+			attrs = fmt.Sprintf("label=%q", n.Id.String()+"\n"+n.Addrs[0])
+		}
+		if n.Local {
+			attrs += ", shape=box"
+		}
+		fmt.Fprintf(buf, "  %q [%s];\n", n.Id.String(), attrs)
+	}
+	for _, l := range t.Links {
+		attrs := fmt.Sprintf("kind=%q", l.Kind)
+		if l.Latency > 0 {
+			attrs += fmt.Sprintf(", label=\"%.2fms\"", float64(l.Latency)/float64(time.Millisecond))
+		}
+		if l.Kind == LinkPeer {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(buf, "  %q -> %q [%s];\n", l.From.String(), l.To.String(), attrs)
+	}
+	fmt.Fprintf(buf, "}\n")
+
+	return buf.Flush()
+}
@@ -0,0 +1,134 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package overlay
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that routing snapshots are merged into a correct overlay graph and that
+// both export formats carry it.
+func TestTopology(t *testing.T) {
+	ids := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(4)}
+
+	// Two local nodes: one with a leaf, a table entry and an extra peer, the other
+	// with a leaf pointing back to the first one
+	snaps := []*Snapshot{
+		{
+			Self:   ids[0],
+			Leaves: []*big.Int{ids[0], ids[1]},
+			Routes: [][]*big.Int{{nil, ids[2]}},
+			Peers: []*PeerInfo{
+				{Id: ids[1], Addrs: []string{"10.0.0.2:1"}, Latency: time.Millisecond, Loss: 0.25},
+				{Id: ids[2], Addrs: []string{"10.0.0.3:1"}},
+				{Id: ids[3], Addrs: []string{"10.0.0.4:1"}},
+			},
+		},
+		{
+			Self:   ids[1],
+			Leaves: []*big.Int{ids[0], ids[1]},
+			Peers:  []*PeerInfo{{Id: ids[0], Addrs: []string{"10.0.0.1:1"}}},
+		},
+	}
+	topo := NewTopology(snaps...)
+
+	// Verify the nodes and their locality
+	if len(topo.Nodes) != len(ids) {
+		t.Fatalf("node count mismatch: have %v, want %v.", len(topo.Nodes), len(ids))
+	}
+	for i, node := range topo.Nodes {
+		if node.Id.Cmp(ids[i]) != 0 {
+			t.Fatalf("node %d: id mismatch: have %v, want %v.", i, node.Id, ids[i])
+		}
+		if local := i < 2; node.Local != local {
+			t.Fatalf("node %d: locality mismatch: have %v, want %v.", i, node.Local, local)
+		}
+		if len(node.Addrs) != 1 {
+			t.Fatalf("node %d: address count mismatch: have %v, want %v.", i, len(node.Addrs), 1)
+		}
+	}
+	// Verify the links, their kinds, latencies and losses
+	links := []*TopologyLink{
+		{From: ids[0], To: ids[1], Kind: LinkLeaf, Latency: time.Millisecond, Loss: 0.25},
+		{From: ids[0], To: ids[2], Kind: LinkTable},
+		{From: ids[0], To: ids[3], Kind: LinkPeer},
+		{From: ids[1], To: ids[0], Kind: LinkLeaf},
+	}
+	if len(topo.Links) != len(links) {
+		t.Fatalf("link count mismatch: have %v, want %v.", len(topo.Links), len(links))
+	}
+	for i, link := range topo.Links {
+		if link.From.Cmp(links[i].From) != 0 || link.To.Cmp(links[i].To) != 0 {
+			t.Fatalf("link %d: endpoint mismatch: have %v->%v, want %v->%v.", i, link.From, link.To, links[i].From, links[i].To)
+		}
+		if link.Kind != links[i].Kind {
+			t.Fatalf("link %d: kind mismatch: have %v, want %v.", i, link.Kind, links[i].Kind)
+		}
+		if link.Latency != links[i].Latency {
+			t.Fatalf("link %d: latency mismatch: have %v, want %v.", i, link.Latency, links[i].Latency)
+		}
+		if link.Loss != links[i].Loss {
+			t.Fatalf("link %d: loss mismatch: have %v, want %v.", i, link.Loss, links[i].Loss)
+		}
+	}
+	// Verify that the JSON export decodes back into the same graph
+	buf := new(bytes.Buffer)
+	if err := topo.WriteJSON(buf); err != nil {
+		t.Fatalf("failed to export JSON topology: %v.", err)
+	}
+	var doc struct {
+		Nodes []struct{ Id string }
+		Links []struct {
+			From, To string
+			Latency  float64
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to decode JSON topology: %v.", err)
+	}
+	if len(doc.Nodes) != len(ids) || len(doc.Links) != len(links) {
+		t.Fatalf("JSON graph size mismatch: have %v/%v, want %v/%v.", len(doc.Nodes), len(doc.Links), len(ids), len(links))
+	}
+	if doc.Links[0].From != "1" || doc.Links[0].To != "2" || doc.Links[0].Latency != 1 {
+		t.Fatalf("JSON link mismatch: have %+v, want {From:1 To:2 Latency:1}.", doc.Links[0])
+	}
+	// Verify that the DOT export contains all the nodes and links
+	buf.Reset()
+	if err := topo.WriteDOT(buf); err != nil {
+		t.Fatalf("failed to export DOT topology: %v.", err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph overlay {") {
+		t.Fatalf("DOT header missing: %s.", dot)
+	}
+	if have := strings.Count(dot, " -> "); have != len(links) {
+		t.Fatalf("DOT link count mismatch: have %v, want %v.", have, len(links))
+	}
+	if !strings.Contains(dot, `"1" -> "2" [kind="leaf", label="1.00ms"];`) {
+		t.Fatalf("DOT leaf link missing: %s.", dot)
+	}
+	if !strings.Contains(dot, `"1" -> "4" [kind="peer", style=dashed];`) {
+		t.Fatalf("DOT peer link missing: %s.", dot)
+	}
+}
@@ -0,0 +1,44 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the route tracing types shared by the structured overlays: a probe is
+// routed hop by hop towards a destination id exactly like a message would be, each
+// node appending itself and the rule selecting the next hop, after which the path
+// is returned to the tracing node.
+
+package overlay
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+// Returned when a traced path doesn't arrive back in time.
+var ErrTraceTimeout = errors.New("trace timed out")
+
+// Returned when the next hop of a trace is not connected any more.
+var ErrTraceUnroutable = errors.New("trace next hop not live")
+
+// A single node along a traced route.
+type TraceHop struct {
+	Id      *big.Int      // Overlay id of the node on the path
+	Addrs   []string      // Advertised listener addresses of the node
+	Rule    string        // Routing rule selecting the next hop (one of the Rule* constants)
+	Latency time.Duration // Smoothed round trip time to the next hop (0 if last or unmeasured)
+}
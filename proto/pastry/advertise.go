@@ -0,0 +1,51 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the address advertisement of the local node in the handshakes and state
+// exchanges (see the overlay package for the ordering), and the metadata ones of
+// the remote peers.
+
+package pastry
+
+import (
+	"log"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Assembles the advertised addresses of the local node. The method assumes the
+// overlay lock is held (at least for reading).
+func (o *Overlay) advertised() []string {
+	return overlay.Advertise(o.addrs, o.extAddrs)
+}
+
+// Stores the metadata advertised by the peer in a state exchange, discarding it
+// if oversized.
+func (p *peer) advertise(s *state) {
+	if err := overlay.CheckMetadata(s.Info); err != nil {
+		log.Printf("pastry: discarding metadata of %v: %v.", p.nodeId, err)
+		return
+	}
+	p.info.Store(s.Info)
+}
+
+// Retrieves the metadata last advertised by the peer (nil if none).
+func (p *peer) metadata() map[string]string {
+	meta, _ := p.info.Load().(map[string]string)
+	return meta
+}
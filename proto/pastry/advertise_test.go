@@ -0,0 +1,135 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the extra addresses of a node are advertised to its peers, after
+// the listener addresses.
+func TestAdvertise(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create a node advertising an external address, and a plain one
+	extra := "203.0.113.1:55555"
+
+	config.PastryAdvertise = []string{extra}
+	mapped := New(appId, key, new(nopCallback))
+	config.PastryAdvertise = nil
+	plain := New(appId, key, new(nopCallback))
+
+	for _, node := range []*Overlay{mapped, plain} {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Verify that the plain node knows the extra address
+	plain.lock.RLock()
+	p, ok := plain.livePeers[mapped.nodeId.String()]
+	plain.lock.RUnlock()
+	if !ok {
+		t.Fatalf("mapped node not connected.")
+	}
+	mapped.lock.RLock()
+	want := append(append([]string{}, mapped.addrs...), extra)
+	mapped.lock.RUnlock()
+
+	if !reflect.DeepEqual(p.addrs, want) {
+		t.Fatalf("advertised addresses mismatch: have %v, want %v.", p.addrs, want)
+	}
+}
+
+// Tests that the node metadata is advertised to the peers, exposed through the
+// routing snapshots, and oversized ones are discarded.
+func TestMetadata(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create a node advertising some metadata, and a plain one
+	meta := map[string]string{"zone": "eu-1", "role": "edge"}
+
+	config.PastryMetadata = meta
+	tagged := New(appId, key, new(nopCallback))
+	config.PastryMetadata = nil
+	plain := New(appId, key, new(nopCallback))
+
+	for _, node := range []*Overlay{tagged, plain} {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Verify that the snapshots report the metadata of both sides
+	if snap := tagged.Inspect(); !reflect.DeepEqual(snap.Meta, meta) {
+		t.Fatalf("local metadata mismatch: have %v, want %v.", snap.Meta, meta)
+	}
+	snap := plain.Inspect()
+	if len(snap.Peers) != 1 {
+		t.Fatalf("peer count mismatch: have %v, want %v.", len(snap.Peers), 1)
+	}
+	if info := snap.Peers[0]; !reflect.DeepEqual(info.Meta, meta) {
+		t.Fatalf("peer metadata mismatch: have %v, want %v.", info.Meta, meta)
+	}
+	if snap := tagged.Inspect(); len(snap.Peers) != 1 || snap.Peers[0].Meta != nil {
+		t.Fatalf("plain peer metadata mismatch: have %v, want none.", snap.Peers)
+	}
+	// Verify that oversized metadata is discarded
+	plain.lock.RLock()
+	p := plain.livePeers[tagged.nodeId.String()]
+	plain.lock.RUnlock()
+
+	limit := config.PastryMetadataLimit
+	defer func() { config.PastryMetadataLimit = limit }()
+	config.PastryMetadataLimit = 4
+
+	p.advertise(&state{Info: map[string]string{"zone": "us-2"}})
+	if have := p.metadata(); !reflect.DeepEqual(have, meta) {
+		t.Fatalf("oversized metadata stored: have %v, want %v.", have, meta)
+	}
+}
@@ -0,0 +1,111 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the WAN bridging: nodes designated as bridges advertise the fact in
+// their state exchanges. Nodes learned from a bridge that cannot be dialed (e.g.
+// residing at another site without direct connectivity) are kept in the routing
+// state as relayed entries instead of being revoked, and messages routed to them
+// are handed to the bridge, which routes them onwards through its own sessions.
+// This enables hub-and-spoke multi-site topologies, where only the bridges need
+// to reach every site.
+//
+// Relayed entries are not re-advertised (state exchanges list live peers only),
+// so relay chains cannot form. They are revoked once their bridge is dropped, and
+// superseded by direct sessions whenever one gets established.
+
+package pastry
+
+import (
+	"math/big"
+)
+
+// Retrieves the peer to pass a message for the given node to: the node itself if
+// directly connected, or the bridge relaying to it.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) hop(id *big.Int) (*peer, bool) {
+	if p, ok := o.livePeers[id.String()]; ok {
+		return p, true
+	}
+	p, ok := o.relays[id.String()]
+	return p, ok
+}
+
+// Collects the nodes advertised by bridges in a batch of state exchanges, mapped
+// to the bridge that could relay to them.
+func (o *Overlay) bridged(exchs map[*peer]*state) map[string]*peer {
+	via := make(map[string]*peer)
+	for p, s := range exchs {
+		if s.Bridge {
+			for sid := range s.Addrs {
+				via[sid] = p
+			}
+		}
+	}
+	return via
+}
+
+// Relays the unreachable nodes through the bridges that advertised them (if
+// still connected), returning the ones without a bridge, to be revoked.
+func (o *Overlay) relay(downs []*big.Int, via map[string]*peer) []*big.Int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	rest := []*big.Int{}
+	for _, id := range downs {
+		sid := id.String()
+		if p, ok := via[sid]; ok {
+			if live, ok := o.livePeers[p.nodeId.String()]; ok && live == p {
+				o.relays[sid] = p
+				continue
+			}
+		}
+		rest = append(rest, id)
+	}
+	return rest
+}
+
+// Removes the relayed entries of dropped bridges, returning the nodes that are
+// not directly connected either, to be revoked.
+func (o *Overlay) unrelay(drops map[*peer]struct{}) []*big.Int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	downs := []*big.Int{}
+	for sid, p := range o.relays {
+		if _, ok := drops[p]; !ok {
+			continue
+		}
+		delete(o.relays, sid)
+		if _, ok := o.livePeers[sid]; !ok {
+			id, _ := new(big.Int).SetString(sid, 10)
+			downs = append(downs, id)
+		}
+	}
+	return downs
+}
+
+// Checks whether a peer is relaying to any node.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) relaying(id *big.Int) bool {
+	for _, p := range o.relays {
+		if p.nodeId.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
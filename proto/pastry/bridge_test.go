@@ -0,0 +1,70 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Tests that unreachable nodes advertised by a bridge are relayed through it,
+// others revoked, and that the relays are torn down with the bridge.
+func TestBridgeRelay(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+
+	// Connect a bridge and a plain peer, advertising one extra node each
+	bridge := &peer{nodeId: big.NewInt(1)}
+	plain := &peer{nodeId: big.NewInt(2)}
+	o.livePeers[bridge.nodeId.String()] = bridge
+	o.livePeers[plain.nodeId.String()] = plain
+
+	remote, other := big.NewInt(3), big.NewInt(4)
+	exchs := map[*peer]*state{
+		bridge: {Addrs: map[string][]string{remote.String(): nil}, Bridge: true},
+		plain:  {Addrs: map[string][]string{other.String(): nil}},
+	}
+	// Fail to reach both, and verify that only the bridged one is relayed
+	downs := o.relay([]*big.Int{remote, other}, o.bridged(exchs))
+	if len(downs) != 1 || downs[0].Cmp(other) != 0 {
+		t.Fatalf("revoked nodes mismatch: have %v, want [%v].", downs, other)
+	}
+	if p, ok := o.hop(remote); !ok || p != bridge {
+		t.Fatalf("relayed hop mismatch: have %v/%v, want %v.", p, ok, bridge)
+	}
+	if _, ok := o.hop(other); ok {
+		t.Fatalf("unbridged node reachable.")
+	}
+	if !o.active(bridge.nodeId) || o.active(plain.nodeId) {
+		t.Fatalf("bridge activity mismatch: bridge %v, plain %v.", o.active(bridge.nodeId), o.active(plain.nodeId))
+	}
+	// Relayed entries must not be rediscovered for dialing
+	tab := o.routes.copy()
+	tab.leaves = append(tab.leaves, remote, other)
+	if ids := o.discover(tab); len(ids) != 1 || ids[0].Cmp(other) != 0 {
+		t.Fatalf("discovered nodes mismatch: have %v, want [%v].", ids, other)
+	}
+	// Drop the bridge and verify that the relayed node gets revoked
+	downs = o.unrelay(map[*peer]struct{}{bridge: {}})
+	if len(downs) != 1 || downs[0].Cmp(remote) != 0 {
+		t.Fatalf("unrelayed nodes mismatch: have %v, want [%v].", downs, remote)
+	}
+	if _, ok := o.hop(remote); ok {
+		t.Fatalf("relay survived the bridge.")
+	}
+}
@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the next hop cache of the hot destinations: high throughput flows route
+// every message towards the same few ids, so the resolved hops are remembered
+// instead of redoing the leaf set scans and prefix matches each time. A hop is
+// only valid for the routing state it was resolved in, so the whole cache gets
+// flushed whenever the routing table or the connected peers change.
+
+package pastry
+
+import (
+	"math/big"
+	"sync"
+)
+
+// Next hop resolved for a destination, alongside the rule that selected it.
+type cachedHop struct {
+	next *big.Int
+	rule string
+}
+
+// Bounded cache of the resolved next hops, evicting the oldest when full. A nil
+// cache is valid and caches nothing.
+type routeCache struct {
+	hops  map[string]*cachedHop // Next hops indexed by destination
+	order []string              // Ring buffer of the destinations in insertion order
+	next  int                   // Index of the next ring slot to overwrite
+	lock  sync.Mutex            // Mutex protecting the cache
+}
+
+// Creates a new next hop cache remembering at most limit destinations, or nil
+// if caching is disabled.
+func newRouteCache(limit int) *routeCache {
+	if limit < 1 {
+		return nil
+	}
+	return &routeCache{
+		hops:  make(map[string]*cachedHop, limit),
+		order: make([]string, limit),
+	}
+}
+
+// Retrieves the cached next hop of a destination, if any.
+func (c *routeCache) lookup(key string) (*big.Int, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if hop, ok := c.hops[key]; ok {
+		return hop.next, hop.rule, true
+	}
+	return nil, "", false
+}
+
+// Inserts the resolved next hop of a destination into the cache.
+func (c *routeCache) insert(key string, next *big.Int, rule string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.hops[key]; ok {
+		return
+	}
+	// Evict the oldest destination if the ring is full and insert the new one
+	if old := c.order[c.next]; old != "" {
+		delete(c.hops, old)
+	}
+	c.order[c.next] = key
+	c.hops[key] = &cachedHop{next: next, rule: rule}
+	c.next = (c.next + 1) % len(c.order)
+}
+
+// Drops all the cached next hops, invalidated by a routing state change.
+func (c *routeCache) flush() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.hops = make(map[string]*cachedHop, len(c.order))
+	for i := range c.order {
+		c.order[i] = ""
+	}
+	c.next = 0
+}
@@ -0,0 +1,78 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that the next hop cache evicts the oldest destinations when full and
+// drops everything on a flush.
+func TestRouteCache(t *testing.T) {
+	cache := newRouteCache(4)
+	for i := 0; i < 6; i++ {
+		cache.insert(string(rune('a'+i)), big.NewInt(int64(i)), overlay.RuleTable)
+	}
+	for i := 0; i < 6; i++ {
+		next, rule, ok := cache.lookup(string(rune('a' + i)))
+		if ok != (i >= 2) {
+			t.Fatalf("destination #%d: cache presence mismatch: have %v, want %v.", i, ok, i >= 2)
+		}
+		if ok && (next.Int64() != int64(i) || rule != overlay.RuleTable) {
+			t.Fatalf("destination #%d: cached hop mismatch: have %v/%v, want %v/%v.", i, next, rule, i, overlay.RuleTable)
+		}
+	}
+	cache.flush()
+	for i := 0; i < 6; i++ {
+		if _, _, ok := cache.lookup(string(rune('a' + i))); ok {
+			t.Fatalf("destination #%d: cached hop survived flush.", i)
+		}
+	}
+	// Ensure a disabled cache is usable but caches nothing
+	var disabled *routeCache
+	disabled.insert("a", big.NewInt(1), overlay.RuleTable)
+	if _, _, ok := disabled.lookup("a"); ok {
+		t.Fatalf("disabled cache returned a hop.")
+	}
+	disabled.flush()
+}
+
+// Tests that the cached next hops match the resolved ones, and that the weighted
+// decisions are never cached.
+func TestRouteCaching(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+
+	dest := new(big.Int).Add(o.nodeId, big.NewInt(1))
+	next, rule := o.nextHop(dest, false)
+	if want, wantRule := o.resolveHop(dest, false); next.Cmp(want) != 0 || rule != wantRule {
+		t.Fatalf("next hop mismatch: have %v/%v, want %v/%v.", next, rule, want, wantRule)
+	}
+	if _, _, ok := o.hops.lookup("i" + string(dest.Bytes())); !ok {
+		t.Fatalf("resolved next hop not cached.")
+	}
+	// Enable a routing metric and ensure the weighted decisions bypass the cache
+	o.SetMetric(overlay.HopMetric)
+	o.nextHop(dest, true)
+	if _, _, ok := o.hops.lookup("d" + string(dest.Bytes())); ok {
+		t.Fatalf("weighted next hop cached.")
+	}
+}
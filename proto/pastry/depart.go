@@ -0,0 +1,79 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the graceful departure of a node: before tearing down its sessions,
+// the node announces its leave to all connected peers alongside its routing
+// state. The peers route around it right away, repairing their tables from the
+// handed over state instead of waiting for failure detection, and acknowledge
+// once done. The departing node then drains any messages still queued, so that
+// no in-flight forwards are lost by closing the sessions.
+
+package pastry
+
+import (
+	"log"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Announces the departure of the local node to all its peers and waits for them
+// to route around it, after which the outbound queues are drained. The whole
+// procedure is bounded by the configured leave timeout.
+func (o *Overlay) depart() {
+	deadline := time.Now().Add(config.PastryLeaveTimeout)
+
+	// Collect the peers to notify and the routing state to hand over
+	o.lock.Lock()
+	peers := make([]*peer, 0, len(o.livePeers))
+	s := &state{
+		Addrs:   make(map[string][]string),
+		Version: o.time,
+	}
+	for sid, p := range o.livePeers {
+		peers = append(peers, p)
+		if o.active(p.nodeId) {
+			s.Addrs[sid] = p.addrs
+		}
+	}
+	o.left = make(chan *peer, len(peers))
+	left := o.left
+	o.lock.Unlock()
+
+	// Announce the departure and wait for the acknowledgements
+	pending := make(map[*peer]struct{})
+	for _, p := range peers {
+		o.sendLeave(p, s)
+		pending[p] = struct{}{}
+	}
+	for len(pending) > 0 {
+		select {
+		case p := <-left:
+			delete(pending, p)
+		case <-time.After(deadline.Sub(time.Now())):
+			log.Printf("pastry: departure unacknowledged by %d peers.", len(pending))
+			pending = nil
+		}
+	}
+	// Drain the messages still queued towards the peers
+	for _, p := range peers {
+		for len(p.inter)+len(p.bulk) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
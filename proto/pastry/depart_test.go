@@ -0,0 +1,97 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that a departing node is routed around by the remaining ones while its
+// sessions are still open, without waiting for any failure detection.
+func TestDepart(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+	}
+	for _, node := range nodes[1:] {
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Announce the departure of a node, the others acknowledging it
+	gone := nodes[0].Self()
+	start := time.Now()
+	nodes[0].depart()
+	if elapsed := time.Since(start); elapsed >= config.PastryLeaveTimeout {
+		t.Fatalf("departure acknowledgement timed out: have %v, want < %v.", elapsed, config.PastryLeaveTimeout)
+	}
+	// Verify that the departing node is routed around, but still connected
+	for i, node := range nodes[1:] {
+		node.lock.RLock()
+		routes := node.routes.copy()
+		_, live := node.livePeers[gone.String()]
+		node.lock.RUnlock()
+
+		if !live {
+			t.Fatalf("node #%d: departing node disconnected before closing.", i+1)
+		}
+		for _, leaf := range routes.leaves {
+			if leaf.Cmp(gone) == 0 {
+				t.Fatalf("node #%d: departing node still in leaf set.", i+1)
+			}
+		}
+		for _, row := range routes.routes {
+			for _, id := range row {
+				if id != nil && id.Cmp(gone) == 0 {
+					t.Fatalf("node #%d: departing node still in routing table.", i+1)
+				}
+			}
+		}
+	}
+	// Terminate the departing node and make sure the leave was repeatable
+	start = time.Now()
+	if err := nodes[0].Shutdown(); err != nil {
+		t.Fatalf("failed to terminate departing node: %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed >= config.PastryLeaveTimeout {
+		t.Fatalf("termination acknowledgement timed out: have %v, want < %v.", elapsed, config.PastryLeaveTimeout)
+	}
+}
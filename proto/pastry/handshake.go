@@ -23,17 +23,21 @@
 package pastry
 
 import (
+	"crypto/ed25519"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/bootstrap"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/overlay"
 	"github.com/project-iris/iris/proto/session"
 )
 
@@ -41,6 +45,11 @@ import (
 type initPacket struct {
 	Id    *big.Int
 	Addrs []string
+	Key   []byte // Public node key the id is bound to
+	Proof []byte // Signature over the session binding with the node key
+	Link  int    // Link framing version supported (missing on legacy nodes)
+	State int    // State exchange format version supported (missing on legacy nodes)
+	Join  bool   // Whether the sender is still joining (asks for batched rows)
 }
 
 // Make sure the init packet is registered with gob.
@@ -51,8 +60,9 @@ func init() {
 // Starts up the overlay networking on a specified interface and fans in all the
 // inbound connections into the overlay-global channels.
 func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
-	// Listen for incoming session on the given interface and random port.
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), "0"))
+	// Listen for incoming session on the given interface and configured port.
+	port := strconv.Itoa(config.PastryListenPort)
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ipnet.IP.String(), port))
 	if err != nil {
 		panic(fmt.Sprintf("failed to resolve interface (%v): %v.", ipnet.IP, err))
 	}
@@ -68,7 +78,8 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 	sort.Strings(o.addrs)
 	o.lock.Unlock()
 
-	// Start the bootstrapper on the specified interface
+	// Start the bootstrapper on the specified interface (IPv6 ones seeded around
+	// the local address only)
 	boot, discover, err := bootstrap.New(ipnet, []byte(o.authId), o.nodeId, addr.Port)
 	if err != nil {
 		panic(fmt.Sprintf("failed to create bootstrapper: %v.", err))
@@ -88,9 +99,12 @@ func (o *Overlay) acceptor(ipnet *net.IPNet, quit chan chan error) {
 			if !node.Resp {
 				continue
 			}
-			// If the peer id is desirable, dial and authenticate
+			// If the peer id is desirable, dial and authenticate, otherwise ensure
+			// it's not missing from the overlay due to a partition
 			if !o.filter(node.Peer) {
 				o.authInit.Schedule(func() { o.dial([]*net.TCPAddr{node.Addr}) })
+			} else {
+				o.stateExch.Schedule(func() { o.lookup(node.Peer, []string{node.Addr.String()}) })
 			}
 		case ses := <-sock.Sink:
 			// There's a hidden panic possibility here: the listener socket can fail
@@ -157,7 +171,11 @@ func (o *Overlay) filter(id *big.Int) bool {
 // Asynchronously connects to a remote overlay peer and executes handshake.
 func (o *Overlay) dial(addrs []*net.TCPAddr) {
 	// Sanity check to make sure self connections are not possible (i.e. malicious bootstrapper)
-	for _, ownAddr := range o.addrs {
+	o.lock.RLock()
+	ownAddrs := o.advertised()
+	o.lock.RUnlock()
+
+	for _, ownAddr := range ownAddrs {
 		for _, peerAddr := range addrs {
 			if peerAddr.String() == ownAddr {
 				log.Printf("pastry: self connection not allowed: %v.", o.nodeId)
@@ -167,6 +185,9 @@ func (o *Overlay) dial(addrs []*net.TCPAddr) {
 	}
 	// Dial away, trying interfaces one after the other until connection succeeds
 	for _, addr := range addrs {
+		if overlay.BannedHost(addr.IP) {
+			continue
+		}
 		if ses, err := session.Dial(addr.IP.String(), addr.Port, o.authKey); err == nil {
 			o.shake(ses)
 			return
@@ -188,10 +209,14 @@ func (o *Overlay) shake(ses *session.Session) {
 	// Send an init packet to the remote peer
 	pkt := new(initPacket)
 	pkt.Id = new(big.Int).Set(o.nodeId)
+	pkt.Key = []byte(o.nodeKey.Public().(ed25519.PublicKey))
+	pkt.Proof = overlay.ProveId(o.nodeKey, ses.Binding(), ses.Server())
+	pkt.Link = config.PastryLinkVersion
+	pkt.State = packVersion
 
 	o.lock.RLock()
-	pkt.Addrs = make([]string, len(o.addrs))
-	copy(pkt.Addrs, o.addrs)
+	pkt.Addrs = o.advertised()
+	pkt.Join = o.stat != done
 	o.lock.RUnlock()
 
 	msg := new(proto.Message)
@@ -212,9 +237,39 @@ func (o *Overlay) shake(ses *session.Session) {
 		}
 	case msg, ok := <-p.conn.CtrlLink.Recv:
 		if ok {
+			// Make sure the remote node owns the id it claims
 			pkt = msg.Head.Meta.(*initPacket)
+			if err := overlay.VerifyId(pkt.Id, pkt.Key, pkt.Proof, ses.Binding(), !ses.Server()); err != nil {
+				log.Printf("pastry: rejecting remote peer %v: %v.", pkt.Id, err)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close unbound session: %v.", err)
+				}
+				return
+			}
+			// Refuse the session if the remote node key is not allowed to join
+			if !overlay.Allowed(pkt.Key) {
+				log.Printf("pastry: refusing non-allowlisted peer %v.", pkt.Id)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close non-allowlisted session: %v.", err)
+				}
+				return
+			}
+			// Refuse the session if the remote host or node is banned
+			if overlay.BannedId(pkt.Id) || overlay.BannedHost(ses.CtrlLink.Sock().RemoteAddr().(*net.TCPAddr).IP) {
+				log.Printf("pastry: refusing banned peer %v.", pkt.Id)
+				if err := ses.Close(); err != nil {
+					log.Printf("pastry: failed to close banned session: %v.", err)
+				}
+				return
+			}
 			p.nodeId = pkt.Id
 			p.addrs = pkt.Addrs
+			p.batch = config.PastryLinkVersion >= link.BatchVersion && pkt.Link >= link.BatchVersion
+			p.frag = config.PastryLinkVersion >= link.FragmentVersion && pkt.Link >= link.FragmentVersion
+			p.pack = pkt.State >= packVersion
+			if pkt.Join {
+				p.rows = 1
+			}
 
 			// Everything ok, accept connection
 			o.dedup(p)
@@ -228,9 +283,9 @@ func (o *Overlay) shake(ses *session.Session) {
 }
 
 // Filters a new peer connection to ensure there are no duplicates.
-//  - Same network, same direction: keep the lower client
-//  - Same network, diff direction: keep the lower server
-//  - Diff network:                 keep the lower network
+//   - Same network, same direction: keep the lower client
+//   - Same network, diff direction: keep the lower server
+//   - Diff network:                 keep the lower network
 func (o *Overlay) dedup(p *peer) {
 	// Even though p might be a duplicate, parallel dedups might run in an inverse
 	// order at the remote side, thus it might start routing messages before being
@@ -268,8 +323,10 @@ func (o *Overlay) dedup(p *peer) {
 	// If the new connection is accepted, swap out old one if any
 	var stat status
 	if !keepOld {
-		// Swap out the old peer connection
+		// Swap out the old peer connection (waking it if dormant)
 		o.livePeers[p.nodeId.String()] = p
+		delete(o.dormant, p.nodeId.String())
+		o.hops.flush()
 		dump = old
 
 		// Decide whether to send a join request or a state exchange to the new
@@ -289,9 +346,18 @@ func (o *Overlay) dedup(p *peer) {
 		} else if stat == done {
 			o.sendState(p)
 		}
-		// If brand new peer, start monitoring it
+		// Measure the latency to the new peer right away, and check whether the
+		// remote side could be dialed back if it connected to us
+		o.sendProbe(p)
+		if p.conn.Server() && config.PastryDialBackTimeout > 0 {
+			go o.dialBack(p)
+		}
+
+		// If brand new peer, start monitoring it (otherwise reset the beat tolerance)
 		if old == nil {
 			o.heart.heart.Monitor(p.nodeId)
+		} else {
+			o.heart.heart.Tolerate(p.nodeId, 0)
 		}
 	}
 	// Terminate the duplicate if any
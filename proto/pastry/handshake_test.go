@@ -19,11 +19,15 @@
 package pastry
 
 import (
+	"crypto/ed25519"
 	"crypto/x509"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
 )
 
 // Another private key to check security negotiation
@@ -157,3 +161,55 @@ func TestHandshake(t *testing.T) {
 		t.Fatalf("mallory (%v) found in the pool of bob: %v.", mallory.nodeId, bob.livePeers)
 	}
 }
+
+// Tests that nodes with node keys missing from the allowlist cannot join, even
+// though they hold the cluster key.
+func TestAllowlist(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	static := config.PastryAllowlist
+	defer func() { config.PastryAllowlist = static }()
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create two allowlisted nodes and an outsider
+	alice := New(appId, key, new(nopCallback))
+	bob := New(appId, key, new(nopCallback))
+	mallory := New(appId, key, new(nopCallback))
+
+	config.PastryAllowlist = []string{
+		overlay.Fingerprint(alice.nodeKey.Public().(ed25519.PublicKey)),
+		overlay.Fingerprint(bob.nodeKey.Public().(ed25519.PublicKey)),
+	}
+	// Boot the allowlisted nodes and verify that they found each other
+	if _, err := alice.Boot(); err != nil {
+		t.Fatalf("failed to boot alice: %v.", err)
+	}
+	defer alice.Shutdown()
+
+	if _, err := bob.Boot(); err != nil {
+		t.Fatalf("failed to boot bob: %v.", err)
+	}
+	defer bob.Shutdown()
+
+	if _, ok := alice.livePeers[bob.nodeId.String()]; !ok {
+		t.Fatalf("bob (%v) missing from the pool of alice: %v.", bob.nodeId, alice.livePeers)
+	}
+	// Boot the outsider and ensure it hasn't been accepted
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	if _, err := mallory.Boot(); err != nil {
+		t.Fatalf("failed to boot mallory: %v.", err)
+	}
+	defer mallory.Shutdown()
+
+	if len(mallory.livePeers) != 0 {
+		t.Fatalf("invalid pool contents for mallory: %v.", mallory.livePeers)
+	}
+	if _, ok := alice.livePeers[mallory.nodeId.String()]; ok {
+		t.Fatalf("mallory (%v) found in the pool of alice: %v.", mallory.nodeId, alice.livePeers)
+	}
+}
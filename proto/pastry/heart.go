@@ -18,13 +18,19 @@
 
 // Contains the heartbeat mechanism, a beater thread which periodically pings
 // all connected nodes (also adding whether they are considered active).
+//
+// The heartbeats are adaptive (see heart.Pace), each beat carrying the interval
+// of the next one, so the remote side stretches its failure detection alike.
+// Beats are randomly delayed within a fraction of the period to avoid storms.
 
 package pastry
 
 import (
 	"log"
 	"math/big"
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/heart"
@@ -35,6 +41,7 @@ type heartbeat struct {
 	owner *Overlay
 	heart *heart.Heart
 	beats sync.WaitGroup
+	quit  chan struct{} // Aborts the beats still delayed by jitter
 }
 
 // Creates a new heartbeat mechanism.
@@ -42,6 +49,7 @@ func newHeart(o *Overlay) *heartbeat {
 	// Initialize a new heartbeat mechanism
 	h := &heartbeat{
 		owner: o,
+		quit:  make(chan struct{}),
 	}
 	// Insert the internal beater and return
 	h.heart = heart.New(config.PastryBeatPeriod, config.PastryKillCount, h)
@@ -57,22 +65,43 @@ func (h *heartbeat) start() {
 // Terminates the heartbeat mechanism.
 func (h *heartbeat) terminate() error {
 	err := h.heart.Terminate()
+	close(h.quit)
 	h.beats.Wait()
 	return err
 }
 
-// Periodically sends a heartbeat to all existing connections, tagging them
-// whether they are active (i.e. in the routing) table or not.
+// Periodically sends a heartbeat to all existing connections whose beat is due,
+// tagging them whether they are active (i.e. in the routing) table or not. A
+// latency probe is also sent along, keeping the proximity measurements fresh,
+// and the scheduling lag of the beat itself is measured for load shedding.
 func (h *heartbeat) Beat() {
+	h.owner.press.sample(time.Now())
+
 	h.owner.lock.RLock()
 	defer h.owner.lock.RUnlock()
 
 	for _, p := range h.owner.livePeers {
+		due, stretch := h.owner.pace(p)
+		if !due {
+			continue
+		}
+		// Spread the beats across the period to avoid synchronized storms
+		var delay time.Duration
+		if config.PastryBeatJitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(float64(config.PastryBeatPeriod)*config.PastryBeatJitter) + 1))
+		}
 		h.beats.Add(1)
-		go func(p *peer, active bool) {
+		go func(p *peer, active bool, stretch int) {
 			defer h.beats.Done()
-			h.owner.sendBeat(p, !active)
-		}(p, h.owner.active(p.nodeId))
+
+			select {
+			case <-h.quit:
+				return
+			case <-time.After(delay):
+			}
+			h.owner.sendBeat(p, !active, stretch)
+			h.owner.sendProbe(p)
+		}(p, h.owner.active(p.nodeId), stretch)
 	}
 }
 
@@ -89,3 +118,25 @@ func (h *heartbeat) Dead(id *big.Int) {
 		h.owner.drop(dead)
 	}
 }
+
+// Advances the heartbeat schedule of a peer by one beat period, reporting whether
+// a beat is due and the interval to announce with it.
+func (o *Overlay) pace(p *peer) (bool, int) {
+	// One-way links are beaten every period, keeping any NAT mapping alive
+	if p.inbound() {
+		return true, 1
+	}
+	missed, _ := o.heart.heart.Missed(p.nodeId)
+	return p.pace.Tick(missed)
+}
+
+// Records the heartbeat interval announced by a remote peer, stretching the time
+// it may stay silent before being reported dead.
+func (o *Overlay) paced(src *peer, stretch int) {
+	if src.pace.Announced(stretch) {
+		if stretch < 1 {
+			stretch = 1
+		}
+		o.heart.heart.Tolerate(src.nodeId, stretch*config.PastryKillCount)
+	}
+}
@@ -0,0 +1,71 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the heartbeats of stable peers slow down to the stretch limit, with
+// neither side reporting the other dead due to the longer silences.
+func TestAdaptiveBeats(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	oldPeriod, oldCalm, oldStretch := config.PastryBeatPeriod, config.PastryBeatCalm, config.PastryBeatStretch
+	defer func() {
+		config.PastryBeatPeriod, config.PastryBeatCalm, config.PastryBeatStretch = oldPeriod, oldCalm, oldStretch
+	}()
+	config.PastryBeatPeriod, config.PastryBeatCalm, config.PastryBeatStretch = 50*time.Millisecond, 2, 4
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start two nodes and wait for the beats to slow down
+	nodes := make([]*Overlay, 2)
+	for i := 0; i < len(nodes); i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(40 * config.PastryBeatPeriod)
+
+	// Verify that the peers are beaten at the stretch limit, and are still alive
+	for i, node := range nodes {
+		snap := node.Inspect()
+		if len(snap.Peers) != 1 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, len(snap.Peers), 1)
+		}
+		if want := time.Duration(config.PastryBeatStretch) * config.PastryBeatPeriod; snap.Peers[0].Beat != want {
+			t.Fatalf("node #%d: beat interval mismatch: have %v, want %v.", i, snap.Peers[0].Beat, want)
+		}
+	}
+}
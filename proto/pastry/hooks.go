@@ -0,0 +1,52 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing hooks registration (see the overlay package for details).
+
+package pastry
+
+import (
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Registers a hook invoked on every upper layer message before it is routed.
+// Hooks are invoked in registration order, until one drops the message.
+func (o *Overlay) BeforeRoute(hook overlay.RouteHook) {
+	o.hooks.Before(hook)
+}
+
+// Registers a hook invoked on every upper layer message after its next hop was
+// selected, but before it is delivered or forwarded.
+func (o *Overlay) AfterRoute(hook overlay.RouteHook) {
+	o.hooks.After(hook)
+}
+
+// Runs a message through a hook chain, unwrapping the overlay header for the
+// duration. Returns whether the message survived.
+func runHooks(chain []overlay.RouteHook, msg *proto.Message, hop *overlay.Hop) bool {
+	head := msg.Head.Meta.(*header)
+	msg.Head.Meta = head.Meta
+
+	keep := overlay.Run(chain, msg, hop)
+
+	head.Meta = msg.Head.Meta
+	msg.Head.Meta = head
+
+	return keep
+}
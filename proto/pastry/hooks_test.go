@@ -0,0 +1,100 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"bytes"
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that the routing hooks see the upper layer messages with their routing
+// details, and that they can drop them.
+func TestHooks(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot two nodes, collecting the deliveries of the second
+	app := &collector{delivs: []*proto.Message{}}
+	src := New(appId, key, new(nopCallback))
+	dst := New(appId, key, app)
+	for _, node := range []*Overlay{src, dst} {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Drop messages before routing on the sender, inspect them after on the receiver
+	befores, afters, fails := int32(0), int32(0), int32(0)
+	src.BeforeRoute(func(msg *proto.Message, hop *overlay.Hop) bool {
+		atomic.AddInt32(&befores, 1)
+		if hop.Src != nil || hop.Dest.Cmp(dst.nodeId) != 0 || hop.Next != nil {
+			atomic.AddInt32(&fails, 1)
+		}
+		return !bytes.Equal(msg.Head.Meta.([]byte), []byte("drop"))
+	})
+	dst.AfterRoute(func(msg *proto.Message, hop *overlay.Hop) bool {
+		atomic.AddInt32(&afters, 1)
+		if hop.Src.Cmp(src.nodeId) != 0 || hop.Next.Cmp(dst.nodeId) != 0 || hop.Rule != overlay.RuleLeaf {
+			atomic.AddInt32(&fails, 1)
+		}
+		if meta, ok := msg.Head.Meta.([]byte); !ok || !bytes.Equal(meta, []byte("keep")) {
+			atomic.AddInt32(&fails, 1)
+		}
+		return true
+	})
+	for _, meta := range []string{"keep", "drop", "keep"} {
+		msg := &proto.Message{Head: proto.Header{Meta: []byte(meta)}, Data: []byte("data")}
+		msg.Encrypt()
+		src.Send(dst.nodeId, msg)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&befores); n != 3 {
+		t.Fatalf("pre-routing hook invocations mismatch: have %v, want %v.", n, 3)
+	}
+	if n := atomic.LoadInt32(&afters); n != 2 {
+		t.Fatalf("post-routing hook invocations mismatch: have %v, want %v.", n, 2)
+	}
+	if n := atomic.LoadInt32(&fails); n != 0 {
+		t.Fatalf("invalid routing details seen by hooks: %v.", n)
+	}
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	if len(app.delivs) != 2 {
+		t.Fatalf("delivered message count mismatch: have %v, want %v.", len(app.delivs), 2)
+	}
+}
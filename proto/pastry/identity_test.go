@@ -0,0 +1,69 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that nodes claiming ids not bound to their keys are refused by the rest
+// of the overlay.
+func TestIdentitySpoofing(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Create an honest node and one claiming a chosen id
+	honest := New(appId, key, new(nopCallback))
+	spoofer := New(appId, key, new(nopCallback))
+	spoofer.nodeId = new(big.Int).Add(honest.nodeId, big.NewInt(1))
+	spoofer.routes = newRoutingTable(spoofer.nodeId)
+
+	for _, node := range []*Overlay{honest, spoofer} {
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer node.Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Make sure neither side accepted the connection
+	for i, node := range []*Overlay{honest, spoofer} {
+		node.lock.RLock()
+		peers := len(node.livePeers)
+		node.lock.RUnlock()
+
+		if peers != 0 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, peers, 0)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the idle session teardown: in large but sparsely communicating
+// clusters most routing table peers see no upper layer traffic for long periods,
+// yet each holds a live session (sockets, buffers, go-routines and heartbeats).
+// Sessions idle beyond the configured timeout are torn down, but their routing
+// entries are kept as dormant ones (alongside the node addresses), and the
+// sessions are re-dialed on demand once a message is routed through them. The
+// messages are parked meanwhile, and dropped if the node cannot be reached any
+// more, in which case the entry is revoked by the next maintenance round.
+//
+// Only plain routing table sessions are put to sleep: the leaf set keeps the
+// overlay consistent, bridges relay for others and one-way peers cannot be
+// dialed back. Both sides see the same traffic, so the remote side finds the
+// session idle too when torn down, keeping its own entry dormant as well.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Checks whether a peer's session may be put to sleep: unused by the upper layers
+// for the given time and backing a plain routing table entry only.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) sleepy(p *peer, limit time.Duration) bool {
+	if config.PastryIdleTimeout <= 0 || p.inbound() || len(p.addrs) == 0 || p.idle() < limit {
+		return false
+	}
+	for _, leaf := range o.routes.leaves {
+		if p.nodeId.Cmp(leaf) == 0 {
+			return false
+		}
+	}
+	if o.relaying(p.nodeId) {
+		return false
+	}
+	return o.routed(p.nodeId)
+}
+
+// Checks whether a node occupies a routing table slot.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) routed(id *big.Int) bool {
+	pre, col := prefix(o.nodeId, id)
+	if pre >= len(o.routes.routes) {
+		return false
+	}
+	cell := o.routes.routes[pre][col]
+	return cell != nil && cell.Cmp(id) == 0
+}
+
+// Checks whether a routing entry is dormant, waiting to be re-dialed on demand.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) dozing(id *big.Int) bool {
+	_, ok := o.dormant[id.String()]
+	return ok
+}
+
+// Tears down the sessions idle beyond the configured timeout, and forgets the
+// dormant entries evicted from the routing table meanwhile.
+func (o *Overlay) hibernate() {
+	o.lock.Lock()
+	sleepers := []*peer{}
+	for _, p := range o.livePeers {
+		if o.sleepy(p, config.PastryIdleTimeout) {
+			sleepers = append(sleepers, p)
+		}
+	}
+	for sid := range o.dormant {
+		if id, ok := new(big.Int).SetString(sid, 10); !ok || !o.routed(id) {
+			delete(o.dormant, sid)
+		}
+	}
+	o.lock.Unlock()
+
+	for _, p := range sleepers {
+		log.Printf("pastry: putting idle session to %v to sleep.", p.nodeId)
+		o.drop(p)
+	}
+}
+
+// Retains the routing entry of a dropped peer as dormant if its session went
+// idle, so it's re-dialed on demand instead of revoked. The idleness is checked
+// leniently, as the remote side tearing the session down measures it sooner.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) doze(p *peer) {
+	sid := p.nodeId.String()
+	if o.sleepy(p, config.PastryIdleTimeout/2) {
+		o.dormant[sid] = p.addrs
+	} else {
+		delete(o.dormant, sid)
+	}
+}
+
+// Parks a message routed through a dormant entry until its session is re-dialed,
+// starting the dial if not yet in progress. False is returned if the entry isn't
+// dormant, leaving the message to the caller.
+func (o *Overlay) park(msg *proto.Message, id *big.Int) bool {
+	sid := id.String()
+
+	o.lock.RLock()
+	addrs, ok := o.dormant[sid]
+	o.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	o.wakeLock.Lock()
+	defer o.wakeLock.Unlock()
+
+	parked, dialing := o.waking[sid]
+	if len(parked) < config.PastryNetBuffer {
+		parked = append(parked, msg)
+	}
+	o.waking[sid] = parked
+	if !dialing {
+		if err := o.authInit.Schedule(func() { o.wake(id, addrs) }); err != nil {
+			delete(o.waking, sid)
+		}
+	}
+	return true
+}
+
+// Re-dials a dormant entry and flushes the messages parked meanwhile into the
+// new session. If the node is unreachable, the entry is scheduled for repair.
+func (o *Overlay) wake(id *big.Int, addrs []string) {
+	sid := id.String()
+
+	peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+	for _, address := range addrs {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			log.Printf("pastry: failed to resolve address %v: %v.", address, err)
+		} else {
+			peerAddrs = append(peerAddrs, addr)
+		}
+	}
+	o.dial(peerAddrs)
+
+	o.lock.Lock()
+	p, ok := o.livePeers[sid]
+	delete(o.dormant, sid)
+	o.lock.Unlock()
+
+	o.wakeLock.Lock()
+	parked := o.waking[sid]
+	delete(o.waking, sid)
+	o.wakeLock.Unlock()
+
+	if !ok {
+		log.Printf("pastry: failed to wake dormant peer %v, dropping %d messages.", id, len(parked))
+		o.reoptimize()
+		return
+	}
+	for _, msg := range parked {
+		o.send(msg, p)
+	}
+}
@@ -0,0 +1,121 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that only idle routing table sessions are put to sleep, that their
+// entries are kept dormant instead of being rediscovered, and that messages
+// routed through an unreachable dormant entry get it revoked.
+func TestIdleDormancy(t *testing.T) {
+	timeout := config.PastryIdleTimeout
+	defer func() { config.PastryIdleTimeout = timeout }()
+	config.PastryIdleTimeout = time.Minute
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	o := New(appId, key, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+
+	// Connect an idle routing table peer, a busy one and an idle leaf
+	base := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-config.PastryBase))
+	stale := time.Now().Add(-2 * time.Minute).UnixNano()
+
+	idle := &peer{nodeId: base, addrs: []string{"127.0.0.1:1"}, used: stale}
+	busy := &peer{nodeId: new(big.Int).Lsh(base, 1), addrs: []string{"127.0.0.1:1"}, used: time.Now().UnixNano()}
+	leaf := &peer{nodeId: big.NewInt(1), addrs: []string{"127.0.0.1:1"}, used: stale}
+
+	for _, p := range []*peer{idle, busy, leaf} {
+		row, col := prefix(o.nodeId, p.nodeId)
+		o.routes.routes[row][col] = p.nodeId
+		o.livePeers[p.nodeId.String()] = p
+	}
+	o.routes.leaves = append(o.routes.leaves, leaf.nodeId)
+
+	// Only the idle routing table peer should be put to sleep
+	if !o.sleepy(idle, config.PastryIdleTimeout) {
+		t.Fatalf("idle routing peer kept awake.")
+	}
+	if o.sleepy(busy, config.PastryIdleTimeout) {
+		t.Fatalf("busy routing peer put to sleep.")
+	}
+	if o.sleepy(leaf, config.PastryIdleTimeout) {
+		t.Fatalf("idle leaf put to sleep.")
+	}
+	// Drop the sessions and verify that only the idle entry stays dormant
+	for _, p := range []*peer{idle, busy, leaf} {
+		delete(o.livePeers, p.nodeId.String())
+		o.doze(p)
+	}
+	if !o.dozing(idle.nodeId) || o.dozing(busy.nodeId) || o.dozing(leaf.nodeId) {
+		t.Fatalf("dormancy mismatch: idle %v, busy %v, leaf %v.", o.dozing(idle.nodeId), o.dozing(busy.nodeId), o.dozing(leaf.nodeId))
+	}
+	if ids := o.discover(o.routes); len(ids) != 2 || ids[0].Cmp(leaf.nodeId) != 0 || ids[1].Cmp(busy.nodeId) != 0 {
+		t.Fatalf("discovered nodes mismatch: have %v, want [%v %v].", ids, leaf.nodeId, busy.nodeId)
+	}
+	if snap := o.Inspect(); len(snap.Dormant) != 1 || snap.Dormant[0].Cmp(idle.nodeId) != 0 {
+		t.Fatalf("dormant snapshot mismatch: have %v, want [%v].", snap.Dormant, idle.nodeId)
+	}
+	// Route a message through the dormant entry, failing to wake it
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	o.authInit.Start()
+	defer o.authInit.Terminate(true)
+
+	if o.park(&proto.Message{Data: []byte{0x01}}, busy.nodeId) {
+		t.Fatalf("message parked for a non-dormant entry.")
+	}
+	if !o.park(&proto.Message{Data: []byte{0x01}}, idle.nodeId) {
+		t.Fatalf("message not parked for the dormant entry.")
+	}
+	select {
+	case <-o.eventNotify:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("routing table repair not requested.")
+	}
+	if o.dozing(idle.nodeId) {
+		t.Fatalf("unreachable dormant entry retained.")
+	}
+	o.wakeLock.Lock()
+	parked := len(o.waking)
+	o.wakeLock.Unlock()
+	if parked != 0 {
+		t.Fatalf("parked messages retained: have %v, want 0.", parked)
+	}
+	// Dormant entries evicted from the routing table should be forgotten
+	o.dormant[busy.nodeId.String()] = busy.addrs
+	row, col := prefix(o.nodeId, busy.nodeId)
+	o.routes.routes[row][col] = nil
+	o.hibernate()
+	if o.dozing(busy.nodeId) {
+		t.Fatalf("evicted dormant entry retained.")
+	}
+}
@@ -0,0 +1,90 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the routing state introspection: a structured snapshot of the leaf
+// set, the routing table and the connected peers, alongside a way to query the
+// hop a destination would be routed through (and why). Note, the simplified
+// Pastry has no neighbor set, so the peer list stands in for it.
+
+package pastry
+
+import (
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Captures a snapshot of the local routing state for debugging purposes.
+func (o *Overlay) Inspect() *overlay.Snapshot {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	routes := o.routes.copy()
+	snap := &overlay.Snapshot{
+		Self:   o.nodeId,
+		Leaves: routes.leaves,
+		Routes: routes.routes,
+		Peers:  make([]*overlay.PeerInfo, 0, len(o.livePeers)),
+		Meta:   overlay.CopyMetadata(o.meta),
+	}
+	for _, p := range o.livePeers {
+		missed, _ := o.heart.heart.Missed(p.nodeId)
+		rtt, _ := o.proxim.latency(p.nodeId)
+		snap.Peers = append(snap.Peers, &overlay.PeerInfo{
+			Id:      p.nodeId,
+			Addrs:   append([]string{}, p.addrs...),
+			Version: p.conn.Version(),
+			Active:  o.active(p.nodeId),
+			Passive: atomic.LoadUint32(&p.passive) == 1,
+			OneWay:  p.inbound(),
+			Missed:  missed,
+			Beat:    time.Duration(p.pace.Stretch()) * config.PastryBeatPeriod,
+			Queued:  len(p.inter) + len(p.bulk),
+			Dropped: atomic.LoadUint64(&p.dropped),
+			Latency: rtt,
+			Loss:    o.proxim.lost(p.nodeId),
+			Session: p.conn.Stats(),
+			Meta:    overlay.CopyMetadata(p.metadata()),
+		})
+	}
+	sort.Slice(snap.Peers, func(i, j int) bool {
+		return snap.Peers[i].Id.Cmp(snap.Peers[j].Id) < 0
+	})
+	for sid := range o.dormant {
+		id, _ := new(big.Int).SetString(sid, 10)
+		snap.Dormant = append(snap.Dormant, id)
+	}
+	sort.Slice(snap.Dormant, func(i, j int) bool {
+		return snap.Dormant[i].Cmp(snap.Dormant[j]) < 0
+	})
+	return snap
+}
+
+// Retrieves the next hop a message addressed to dest would be routed through,
+// and the routing rule that selected it (one of the Rule* constants). The local
+// node id is returned if the message would be delivered locally.
+func (o *Overlay) Route(dest *big.Int) (*big.Int, string) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.nextHop(dest, true)
+}
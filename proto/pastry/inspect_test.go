@@ -0,0 +1,101 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that the routing state snapshot reflects a small converged overlay and
+// that next hop queries report the routing decisions.
+func TestInspect(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers := 3
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Verify the routing state of each node
+	for i, node := range nodes {
+		snap := node.Inspect()
+		if snap.Self.Cmp(node.Self()) != 0 {
+			t.Fatalf("node #%d: self id mismatch: have %v, want %v.", i, snap.Self, node.Self())
+		}
+		self := false
+		for _, leaf := range snap.Leaves {
+			self = self || leaf.Cmp(node.Self()) == 0
+		}
+		if !self {
+			t.Fatalf("node #%d: self missing from leaf set: %v.", i, snap.Leaves)
+		}
+		if len(snap.Routes) != config.PastrySpace/config.PastryBase {
+			t.Fatalf("node #%d: routing table rows mismatch: have %v, want %v.", i, len(snap.Routes), config.PastrySpace/config.PastryBase)
+		}
+		if len(snap.Peers) != peers-1 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, len(snap.Peers), peers-1)
+		}
+		for j, peer := range snap.Peers {
+			if !peer.Active {
+				t.Fatalf("node #%d, peer #%d: leaf peer not active.", i, j)
+			}
+			if peer.Missed > config.PastryKillCount {
+				t.Fatalf("node #%d, peer #%d: missed beats above kill limit: have %v, want <= %v.", i, j, peer.Missed, config.PastryKillCount)
+			}
+			if len(peer.Addrs) == 0 {
+				t.Fatalf("node #%d, peer #%d: no listener addresses.", i, j)
+			}
+		}
+		// Verify the next hops towards self and the other nodes
+		if next, rule := node.Route(node.Self()); next.Cmp(node.Self()) != 0 || rule != overlay.RuleLeaf {
+			t.Fatalf("node #%d: self route mismatch: have %v/%v, want %v/%v.", i, next, rule, node.Self(), overlay.RuleLeaf)
+		}
+		for j, dest := range nodes {
+			if i == j {
+				continue
+			}
+			if next, rule := node.Route(dest.Self()); next.Cmp(dest.Self()) != 0 || rule != overlay.RuleDirect {
+				t.Fatalf("node #%d: route to #%d mismatch: have %v/%v, want %v/%v.", i, j, next, rule, dest.Self(), overlay.RuleDirect)
+			}
+		}
+	}
+}
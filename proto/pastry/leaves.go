@@ -0,0 +1,84 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the leaf set change notifications (see the overlay package for the
+// details). The local node is responsible for the keys up to half way towards
+// its immediate ring neighbors, so the range shifts whenever one of those two
+// changes.
+
+package pastry
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Registers a hook invoked whenever the leaf set changes. Hooks are invoked in
+// registration order on the maintenance thread, after the new routing state is
+// in effect.
+func (o *Overlay) WatchLeaves(hook overlay.LeafHook) {
+	o.watchers.Watch(hook)
+}
+
+// Assembles the change event between two leaf sets, nil if they're the same.
+func (o *Overlay) leafEvent(old, new []*big.Int) *overlay.LeafEvent {
+	event := overlay.DiffLeaves(o.remotes(old), o.remotes(new))
+	if event != nil {
+		oldPred, oldSucc := o.adjacent(old)
+		newPred, newSucc := o.adjacent(new)
+		event.Shift = !sameId(oldPred, newPred) || !sameId(oldSucc, newSucc)
+	}
+	return event
+}
+
+// Filters the local node out of a leaf set.
+func (o *Overlay) remotes(leaves []*big.Int) []*big.Int {
+	ids := make([]*big.Int, 0, len(leaves))
+	for _, id := range leaves {
+		if id.Cmp(o.nodeId) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Retrieves the immediate ring neighbors of the local node from a (circularly
+// sorted) leaf set, nil if missing on a side.
+func (o *Overlay) adjacent(leaves []*big.Int) (*big.Int, *big.Int) {
+	var pred, succ *big.Int
+	for i, id := range leaves {
+		if id.Cmp(o.nodeId) == 0 {
+			if i > 0 {
+				pred = leaves[i-1]
+			}
+			if i < len(leaves)-1 {
+				succ = leaves[i+1]
+			}
+		}
+	}
+	return pred, succ
+}
+
+// Checks whether two (possibly nil) ids are the same.
+func sameId(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
@@ -0,0 +1,76 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that a node joining the overlay is reported to the leaf set watchers of
+// the existing node, shifting its key range.
+func TestLeafEvents(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot a lone node, watching its leaf set
+	events := make(chan *overlay.LeafEvent, 16)
+
+	first := New(appId, key, new(nopCallback))
+	first.WatchLeaves(func(event *overlay.LeafEvent) { events <- event })
+	if _, err := first.Boot(); err != nil {
+		t.Fatalf("failed to boot first node: %v.", err)
+	}
+	defer first.Shutdown()
+
+	// Boot a second node and wait for its arrival to be reported
+	second := New(appId, key, new(nopCallback))
+	if _, err := second.Boot(); err != nil {
+		t.Fatalf("failed to boot second node: %v.", err)
+	}
+	defer second.Shutdown()
+
+	select {
+	case event := <-events:
+		if len(event.Joined) != 1 || event.Joined[0].Cmp(second.Self()) != 0 {
+			t.Fatalf("joined nodes mismatch: have %v, want [%v].", event.Joined, second.Self())
+		}
+		if len(event.Lost) != 0 {
+			t.Fatalf("lost nodes reported: %v.", event.Lost)
+		}
+		if !event.Shift {
+			t.Fatalf("key range shift not reported.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("leaf set change not reported.")
+	}
+}
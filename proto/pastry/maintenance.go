@@ -30,6 +30,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/pool"
@@ -50,10 +51,39 @@ func (o *Overlay) manager() {
 	addrs := make(map[string][]string)
 	exchs := make(map[*peer]*state)
 	drops := make(map[*peer]struct{})
-
-	// Mark the overlay as unstable
-	stable := false
-	stableTime := config.PastryBootTimeout
+	lefts := make(map[*peer]struct{})
+	var offers []*state
+
+	// Departing peers to route around, flagged whether acknowledged already
+	departing := make(map[*peer]bool)
+
+	// Mark the overlay as unconverged (periodic ticks don't postpone convergence)
+	converged := false
+	stabilize := time.NewTimer(config.PastryBootTimeout)
+	defer stabilize.Stop()
+
+	// Periodically re-optimize the routing table for network proximity
+	reopt := time.NewTicker(config.PastryProximityPeriod)
+	defer reopt.Stop()
+
+	// Periodically ask for better routing table entries (unless disabled)
+	var tune <-chan time.Time
+	if config.PastryTunePeriod > 0 {
+		ticker := time.NewTicker(config.PastryTunePeriod)
+		defer ticker.Stop()
+		tune = ticker.C
+	}
+	// Periodically persist the peers for fast restarts
+	save := time.NewTicker(config.PastryStateSave)
+	defer save.Stop()
+
+	// Periodically tear down the idle sessions (unless disabled)
+	var idle <-chan time.Time
+	if config.PastryIdleTimeout > 0 {
+		ticker := time.NewTicker(config.PastryIdleTimeout / 2)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
 
 	var errc chan error
 	for errc == nil {
@@ -73,6 +103,12 @@ func (o *Overlay) manager() {
 		if len(drops) > 0 {
 			drops = make(map[*peer]struct{})
 		}
+		if len(lefts) > 0 {
+			lefts = make(map[*peer]struct{})
+		}
+		offers = nil
+		opt := false
+
 		// Block till an event arrives
 		select {
 		case errc = <-o.maintQuit:
@@ -83,35 +119,75 @@ func (o *Overlay) manager() {
 			o.eventLock.Lock()
 			o.exchSet, exchs = exchs, o.exchSet
 			o.dropSet, drops = drops, o.dropSet
+			o.leftSet, lefts = lefts, o.leftSet
+			o.offerSet, offers = nil, o.offerSet
+			o.optReq, opt = false, o.optReq
 			o.eventLock.Unlock()
 
 			// If stale notification, loop
-			if len(exchs) == 0 && len(drops) == 0 {
+			if len(exchs) == 0 && len(drops) == 0 && len(lefts) == 0 && len(offers) == 0 && !opt {
 				continue
 			}
-		case <-time.After(stableTime):
-			// No update arrived for a while, consider stable
-			if !stable {
-				stable = true
-				o.stable.Done()
+		case <-tune:
+			// Ask a random routing table peer for its row and wait for the next event
+			o.tune()
+			continue
+		case <-save.C:
+			// Persist the current peers and wait for the next event
+			o.persist()
+			continue
+		case <-idle:
+			// Put the idle sessions to sleep and wait for their drops
+			o.hibernate()
+			continue
+		case <-reopt.C:
+			// Forget the measurements of departed nodes and re-optimize
+			o.lock.RLock()
+			o.proxim.forget(o.livePeers)
+			o.lock.RUnlock()
+		case <-stabilize.C:
+			// No update arrived for a while, consider converged
+			if !converged {
+				converged = true
+				close(o.stable)
 			}
 			continue
 		}
-		// Mark overlay as unstable and set a reduced convergence time
-		if stable {
-			stable = false
-			o.stable.Add(1)
+		// Restart a reduced convergence time
+		if !stabilize.Stop() {
+			select {
+			case <-stabilize.C:
+			default:
+			}
 		}
-		stableTime = config.PastryConvTimeout
+		stabilize.Reset(config.PastryConvTimeout)
 
 		// Merge all state exchanges into the temporary routing table and drop unneeded nodes
 		for _, s := range exchs {
 			o.merge(routes, addrs, s)
 		}
+		for _, s := range offers {
+			o.merge(routes, addrs, s)
+		}
 		o.dropAll(drops, &pending)
+		if downs := o.unrelay(drops); len(downs) > 0 {
+			o.revoke(routes, downs)
+		}
 
-		// Check the new table for discovered peers and dial each
-		if peers := o.discover(routes); len(peers) > 0 {
+		// Track the departing peers until their sessions are torn down
+		for p := range lefts {
+			departing[p] = false
+		}
+		for p := range drops {
+			delete(departing, p)
+		}
+
+		// Hand table slots to closer peers and collect unmeasured competitors
+		o.optimize(routes)
+		probes := o.candidates(routes, addrs)
+
+		// Check the new table for discovered peers (and probe candidates) and dial each
+		if peers := append(o.discover(routes), probes...); len(peers) > 0 {
 			for _, id := range peers {
 				// Collect all the network interfaces
 				peerAddrs := make([]*net.TCPAddr, 0, len(addrs[id.String()]))
@@ -135,15 +211,28 @@ func (o *Overlay) manager() {
 			// Wait till all outbound connections either complete or timeout
 			pending.Wait()
 
-			// Do another round of discovery to find broken links and revert/remove those entries
+			// Do another round of discovery to find broken links and relay/remove those entries
 			if downs := o.discover(routes); len(downs) > 0 {
-				o.revoke(routes, downs)
+				o.revoke(routes, o.relay(downs, o.bridged(exchs)))
 			}
 		}
+		// Route around the departing peers (state merges might have re-added them)
+		if len(departing) > 0 {
+			ids := make([]*big.Int, 0, len(departing))
+			for p := range departing {
+				ids = append(ids, p.nodeId)
+			}
+			o.revoke(routes, ids)
+		}
 		// Swap and broadcast if anything changed
 		if ch, rep := o.changed(routes); ch {
 			o.lock.Lock()
+			event := o.leafEvent(o.routes.leaves, routes.leaves)
+			if event != nil {
+				o.leafTime = time.Now()
+			}
 			o.routes, routes = routes, nil
+			o.hops.flush()
 			o.time++
 			o.stat = done
 			o.lock.Unlock()
@@ -156,10 +245,23 @@ func (o *Overlay) manager() {
 				if rep {
 					o.stateExch.Schedule(func() { o.sendRepair(p) })
 				} else {
-					o.stateExch.Schedule(func() { o.sendState(p) })
+					atomic.StoreUint32(&p.queued, 0) // Pending exchange cleared above
+					o.queueState(p)
 				}
 			}
 			o.lock.RUnlock()
+
+			// Notify the upper layers of any neighborhood change
+			if event != nil {
+				o.watchers.Notify(event)
+			}
+		}
+		// Acknowledge the departures now that the routing state excludes them
+		for p, acked := range departing {
+			if !acked {
+				departing[p] = true
+				go o.sendLeft(p)
+			}
 		}
 	}
 	// Manager is terminating, drop all peer connections (not synced, no mods allowed)
@@ -219,6 +321,24 @@ func (o *Overlay) drop(p *peer) {
 	}
 }
 
+// Inserts a departing peer into the leave queue, alongside its routing state to
+// repair from.
+func (o *Overlay) leave(p *peer, s *state) {
+	// Insert the departure and the state exchange
+	o.eventLock.Lock()
+	o.leftSet[p] = struct{}{}
+	o.exchSet[p] = s
+	o.eventLock.Unlock()
+
+	// Wake the manager if blocking
+	select {
+	case o.eventNotify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
+
 // Drops an active peer connection due to either a failure or uselessness.
 func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
 	// Make sure there's actually something to remove
@@ -255,8 +375,10 @@ func (o *Overlay) dropAll(peers map[*peer]struct{}, pending *sync.WaitGroup) {
 	for d, _ := range peers {
 		id := d.nodeId.String()
 		if p, ok := o.livePeers[id]; ok && p == d {
-			// Delete the peer and stop monitoring it
+			// Delete the peer (keeping its entry if dormant) and stop monitoring it
 			delete(o.livePeers, id)
+			o.doze(d)
+			o.hops.flush()
 			o.heart.heart.Unmonitor(d.nodeId)
 		}
 	}
@@ -313,7 +435,8 @@ func (o *Overlay) mergeLeaves(a, b []*big.Int) []*big.Int {
 	return res[min:max]
 }
 
-// Searches a potential routing table for nodes not yet connected.
+// Searches a potential routing table for nodes not yet connected (nor relayed or
+// dormant).
 func (o *Overlay) discover(t *table) []*big.Int {
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -321,7 +444,7 @@ func (o *Overlay) discover(t *table) []*big.Int {
 	ids := []*big.Int{}
 	for _, id := range t.leaves {
 		if id.Cmp(o.nodeId) != 0 {
-			if _, ok := o.livePeers[id.String()]; !ok {
+			if _, ok := o.hop(id); !ok {
 				ids = append(ids, id)
 			}
 		}
@@ -329,7 +452,7 @@ func (o *Overlay) discover(t *table) []*big.Int {
 	for _, row := range t.routes {
 		for _, id := range row {
 			if id != nil {
-				if _, ok := o.livePeers[id.String()]; !ok {
+				if _, ok := o.hop(id); !ok && !o.dozing(id) {
 					ids = append(ids, id)
 				}
 			}
@@ -339,16 +462,20 @@ func (o *Overlay) discover(t *table) []*big.Int {
 	return ids[:sortext.Unique(sortext.BigIntSlice(ids))]
 }
 
-// Revokes the list of unreachable peers from routing table t.
+// Revokes the list of unreachable (or departing) peers from routing table t.
 func (o *Overlay) revoke(t *table, down []*big.Int) {
 	downs := sortext.BigIntSlice(down)
 	downs.Sort()
 
+	revoked := func(id *big.Int) bool {
+		idx := downs.Search(id)
+		return idx < len(downs) && downs[idx].Cmp(id) == 0
+	}
+
 	// Clean up the leaf set
 	intact := true
 	for i := 0; i < len(t.leaves); i++ {
-		idx := downs.Search(t.leaves[i])
-		if idx < len(downs) && downs[idx].Cmp(t.leaves[i]) == 0 {
+		if revoked(t.leaves[i]) {
 			t.leaves[i] = t.leaves[len(t.leaves)-1]
 			t.leaves = t.leaves[:len(t.leaves)-1]
 			intact = false
@@ -360,7 +487,9 @@ func (o *Overlay) revoke(t *table, down []*big.Int) {
 		o.lock.RLock()
 		all := make([]*big.Int, 0, len(o.livePeers))
 		for _, p := range o.livePeers {
-			all = append(all, p.nodeId)
+			if !revoked(p.nodeId) {
+				all = append(all, p.nodeId)
+			}
 		}
 		o.lock.RUnlock()
 		t.leaves = o.mergeLeaves(t.leaves, all)
@@ -369,14 +498,18 @@ func (o *Overlay) revoke(t *table, down []*big.Int) {
 	for r, row := range t.routes {
 		for c, id := range row {
 			if id != nil {
-				if idx := downs.Search(id); idx < len(downs) && downs[idx].Cmp(id) == 0 {
-					// Try and fix routing entry from connection pool
+				if revoked(id) {
+					// Try and fix routing entry from connection pool (closest in network terms)
 					t.routes[r][c] = nil
 					o.lock.RLock()
 					for _, p := range o.livePeers {
+						if revoked(p.nodeId) {
+							continue
+						}
 						if pre, dig := prefix(o.nodeId, p.nodeId); pre == r && dig == c {
-							t.routes[r][c] = p.nodeId
-							break
+							if best := t.routes[r][c]; best == nil || o.proxim.closer(p.nodeId, best) {
+								t.routes[r][c] = p.nodeId
+							}
 						}
 					}
 					o.lock.RUnlock()
@@ -446,5 +579,6 @@ func (o *Overlay) active(id *big.Int) bool {
 			}
 		}
 	}
-	return false
+	// Check whether id is a bridge relaying to routing entries
+	return o.relaying(id)
 }
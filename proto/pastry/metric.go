@@ -0,0 +1,79 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the pluggable routing metric support (see the overlay package for the
+// metric details). Only upper layer messages are routed by the metric, overlay
+// system messages always follow the routing table to keep the joins precise.
+
+package pastry
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Sets the metric selecting between the next hop candidates of upper layer
+// messages, or restores plain prefix routing if nil.
+func (o *Overlay) SetMetric(metric overlay.Metric) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.metric = metric
+}
+
+// Selects the next hop towards a destination with the configured metric out of
+// all known nodes sharing a longer prefix with it than the local node (which has
+// a prefix length of pre). The routing table entry, if any, is scored first and
+// thus wins ties. The method assumes the overlay lock is held for reading.
+func (o *Overlay) weigh(dest *big.Int, pre, col int) *big.Int {
+	var best *big.Int
+	score := 0.0
+
+	seen := make(map[string]struct{})
+	check := func(id *big.Int) {
+		if id == nil || id.Cmp(o.nodeId) == 0 {
+			return
+		}
+		if _, ok := seen[id.String()]; ok {
+			return
+		}
+		seen[id.String()] = struct{}{}
+
+		row, _ := prefix(id, dest)
+		if row <= pre {
+			return
+		}
+		if _, ok := o.hop(id); !ok {
+			return
+		}
+		cand := &overlay.Candidate{Id: id, Prefix: row, Loss: o.proxim.lost(id)}
+		cand.Latency, _ = o.proxim.latency(id)
+		if s := o.metric(cand); best == nil || s < score {
+			best, score = id, s
+		}
+	}
+	check(o.routes.routes[pre][col])
+	for _, leaf := range o.routes.leaves {
+		check(leaf)
+	}
+	for _, p := range o.livePeers {
+		check(p.nodeId)
+	}
+	return best
+}
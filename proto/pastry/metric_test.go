@@ -0,0 +1,79 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that the routing metrics select between the next hop candidates of upper
+// layer messages, leaving the system messages on the routing table.
+func TestMetric(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+
+	// Create a destination, a table entry and two alternatives: a deeper one and
+	// an unrelated one making no prefix progress
+	digit := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-config.PastryBase))
+	sub := new(big.Int).Rsh(digit, uint(config.PastryBase))
+
+	dest := new(big.Int).Add(digit, new(big.Int).Add(sub, big.NewInt(7)))
+	slot := new(big.Int).Add(digit, big.NewInt(1))
+	deep := new(big.Int).Add(digit, new(big.Int).Add(sub, big.NewInt(1)))
+	other := new(big.Int).Lsh(digit, 1)
+
+	row, col := prefix(o.nodeId, dest)
+	o.routes.routes[row][col] = slot
+	for _, id := range []*big.Int{slot, deep, other} {
+		o.livePeers[id.String()] = &peer{nodeId: id}
+	}
+	// Without a metric, the routing table entry should be selected
+	if next, rule := o.nextHop(dest, true); next.Cmp(slot) != 0 || rule != overlay.RuleTable {
+		t.Fatalf("prefix routing mismatch: have %v/%v, want %v/%v.", next, rule, slot, overlay.RuleTable)
+	}
+	// The hop metric should prefer the deeper candidate, only for upper layer messages
+	o.SetMetric(overlay.HopMetric)
+	if next, _ := o.nextHop(dest, true); next.Cmp(deep) != 0 {
+		t.Fatalf("hop metric mismatch: have %v, want %v.", next, deep)
+	}
+	if next, _ := o.nextHop(dest, false); next.Cmp(slot) != 0 {
+		t.Fatalf("system message weighed: have %v, want %v.", next, slot)
+	}
+	// The latency metric should keep the table entry until something faster is measured
+	o.SetMetric(overlay.LatencyMetric)
+	if next, _ := o.nextHop(dest, true); next.Cmp(slot) != 0 {
+		t.Fatalf("unmeasured latency mismatch: have %v, want %v.", next, slot)
+	}
+	o.proxim.observe(slot, 20*time.Millisecond)
+	o.proxim.observe(deep, 50*time.Millisecond)
+	o.proxim.observe(other, time.Millisecond)
+	if next, _ := o.nextHop(dest, true); next.Cmp(slot) != 0 {
+		t.Fatalf("latency metric mismatch: have %v, want %v.", next, slot)
+	}
+	o.proxim.rtts[deep.String()] = 5 * time.Millisecond
+	if next, _ := o.nextHop(dest, true); next.Cmp(deep) != 0 {
+		t.Fatalf("faster candidate rejected: have %v, want %v.", next, deep)
+	}
+}
@@ -0,0 +1,146 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the prefix multicast: a message is delivered to every node whose id
+// shares a given number of leading bits with a prefix. The message is first
+// routed towards the prefix until it enters the covered region, after which it
+// is split recursively along the routing table: a node at split level l passes
+// a copy to each covered entry of the rows l and below, delegating to it the
+// subtree of nodes sharing one more digit (level r+1 for row r). Each node thus
+// receives the message exactly once, provided the routing tables are complete.
+
+package pastry
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Delivers a message to all the nodes whose ids share the first bits with the
+// prefix (all nodes if bits is zero), including the local node if covered. The
+// delivery is best effort, nodes missing from the routing tables are skipped.
+func (o *Overlay) Multicast(prefix *big.Int, bits int, msg *proto.Message) {
+	// Package into overlay envelope
+	head := &header{
+		Meta: msg.Head.Meta,
+		Op:   opCast,
+		Dest: prefix,
+		Span: bits,
+	}
+	msg.Head.Meta = head
+
+	// Start the dissemination from the local node
+	o.cast(msg)
+}
+
+// Checks whether an id shares the first bits with the multicast prefix.
+func covered(pre *big.Int, bits int, id *big.Int) bool {
+	for bit := config.PastrySpace - 1; bit >= config.PastrySpace-bits && bit >= 0; bit-- {
+		if pre.Bit(bit) != id.Bit(bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// Multicast copy to send to a peer, delegating a subtree of the region.
+type castCopy struct {
+	id    *big.Int
+	p     *peer // Peer to send the copy to (nil if dormant, parked until woken)
+	level int
+}
+
+// Either routes a multicast message towards the covered region or, if already
+// inside, splits it among the covered routing table entries below the message's
+// level and delivers it locally.
+func (o *Overlay) cast(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+
+	o.lock.RLock()
+	if !covered(head.Dest, head.Span, o.nodeId) {
+		// Outside the region, route closer (or into it through the leaves)
+		next, _ := o.nextHop(head.Dest, false)
+		if next.Cmp(o.nodeId) == 0 {
+			for _, leaf := range o.routes.leaves {
+				if covered(head.Dest, head.Span, leaf) {
+					next = leaf
+					break
+				}
+			}
+		}
+		p, ok := o.hop(next)
+		o.lock.RUnlock()
+
+		// Drop the message if nobody is inside the region
+		if ok {
+			o.send(msg, p)
+		} else {
+			o.park(msg, next)
+		}
+		return
+	}
+	// Inside the region, collect the subtrees to delegate
+	copies := []castCopy{}
+	for r := head.Row; r < len(o.routes.routes); r++ {
+		for _, id := range o.routes.routes[r] {
+			if id == nil || !covered(head.Dest, head.Span, id) {
+				continue
+			}
+			if p, ok := o.livePeers[id.String()]; ok {
+				copies = append(copies, castCopy{id, p, r + 1})
+			} else if o.dozing(id) {
+				copies = append(copies, castCopy{id, nil, r + 1})
+			}
+		}
+	}
+	o.lock.RUnlock()
+
+	for _, c := range copies {
+		cp := &proto.Message{
+			Head: proto.Header{
+				Meta: &header{Meta: head.Meta, Op: opCast, Dest: head.Dest, Row: c.level, Span: head.Span},
+				Key:  msg.Head.Key,
+				Iv:   msg.Head.Iv,
+			},
+			Data: msg.Data,
+		}
+		if msg.Secure() {
+			cp.KnownSecure()
+		}
+		if c.p != nil {
+			o.send(cp, c.p)
+		} else {
+			o.park(cp, c.id)
+		}
+	}
+	// Deliver a private copy locally, the application may decrypt in place
+	local := &proto.Message{
+		Head: proto.Header{
+			Meta: head.Meta,
+			Key:  msg.Head.Key,
+			Iv:   msg.Head.Iv,
+		},
+		Data: append([]byte(nil), msg.Data...),
+	}
+	if msg.Secure() {
+		local.KnownSecure()
+	}
+	o.app.Deliver(local, head.Dest)
+}
@@ -0,0 +1,102 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that prefix multicasts reach every covered node exactly once, and none
+// of the others, regardless of the node they are started from.
+func TestMulticast(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	space, base, leaves := config.PastrySpace, config.PastryBase, config.PastryLeaves
+	defer func() { config.PastrySpace, config.PastryBase, config.PastryLeaves = space, base, leaves }()
+	config.PastrySpace, config.PastryBase, config.PastryLeaves = 20, 2, 2
+
+	peers := 8
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	apps := make([]*collector, peers)
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		apps[i] = &collector{delivs: []*proto.Message{}}
+		nodes[i] = New(appId, key, apps[i])
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Multicast from every node to the whole overlay and a prefix of the first
+	pre := nodes[0].Self()
+	for _, bits := range []int{0, 1, 3} {
+		for _, app := range apps {
+			app.lock.Lock()
+			app.delivs = app.delivs[:0]
+			app.lock.Unlock()
+		}
+		data := []byte{0x01, 0x02, byte(bits)}
+		for _, node := range nodes {
+			msg := &proto.Message{Head: proto.Header{Meta: []byte{0x99}}, Data: append([]byte(nil), data...)}
+			msg.Encrypt()
+			node.Multicast(pre, bits, msg)
+		}
+		time.Sleep(250 * time.Millisecond)
+
+		// Verify that exactly the covered nodes received every multicast intact
+		for i, app := range apps {
+			want := 0
+			if covered(pre, bits, nodes[i].Self()) {
+				want = peers
+			}
+			app.lock.Lock()
+			if len(app.delivs) != want {
+				t.Fatalf("bits %d, node #%d: delivery count mismatch: have %v, want %v.", bits, i, len(app.delivs), want)
+			}
+			for _, msg := range app.delivs {
+				if err := msg.Decrypt(); err != nil {
+					t.Fatalf("bits %d, node #%d: failed to decrypt message: %v.", bits, i, err)
+				}
+				if !bytes.Equal(msg.Data, data) {
+					t.Fatalf("bits %d, node #%d: payload mismatch: have %x, want %x.", bits, i, msg.Data, data)
+				}
+			}
+			app.lock.Unlock()
+		}
+	}
+}
@@ -21,18 +21,20 @@
 package pastry
 
 import (
-	"crypto/rand"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/pool"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
 )
 
 // Different status types in which the node can be.
@@ -57,15 +59,22 @@ type Overlay struct {
 	authId  string          // Iris network id
 	authKey *rsa.PrivateKey // Iris authentication key
 
-	nodeId *big.Int // Pastry peer id
-	addrs  []string // Listener addresses
+	nodeId   *big.Int           // Pastry peer id
+	nodeKey  ed25519.PrivateKey // Node key the peer id is bound to
+	addrs    []string           // Listener addresses
+	extAddrs []string           // Extra advertised addresses (e.g. NAT mappings)
+	meta     map[string]string  // Metadata advertised in the state exchanges
+	bridge   bool               // Whether to advertise as a bridge for unreachable nodes
 
-	livePeers map[string]*peer // Active connection pool
-	heart     *heartbeat       // Beater for the active peers
+	livePeers map[string]*peer    // Active connection pool
+	relays    map[string]*peer    // Routing entries reachable only through a bridge
+	dormant   map[string][]string // Routing entries with idle sessions torn down, mapped to their addresses
+	heart     *heartbeat          // Beater for the active peers
 
-	routes *table
-	time   uint64
-	stat   status
+	routes   *table
+	time     uint64
+	stat     status
+	leafTime time.Time // Time of the last leaf set change
 
 	acceptQuit []chan chan error // Quit sync channels for the acceptors
 	maintQuit  chan chan error   // Quit sync channel for the maintenance routine
@@ -74,25 +83,46 @@ type Overlay struct {
 	authAccept *pool.ThreadPool // Remotely initiated authentication pool
 	stateExch  *pool.ThreadPool // Pool for limiting active state exchanges
 
-	exchSet map[*peer]*state   // State exchanges pending merging
-	dropSet map[*peer]struct{} // Peers pending dropping
+	exchSet  map[*peer]*state   // State exchanges pending merging
+	dropSet  map[*peer]struct{} // Peers pending dropping
+	leftSet  map[*peer]struct{} // Peers announcing their departure
+	offerSet []*state           // Routing table rows offered by tuning peers
+	optReq   bool               // Routing table re-optimization pending
+
+	proxim *proximity  // Latency measurements for proximity neighbor selection
+	press  *pressure   // Backpressure state of the outbound peer queues
+	hops   *routeCache // Next hops of the hot destinations (nil if disabled)
+
+	merges    map[string]time.Time // Last partition check of bootstrap-found nodes
+	mergeLock sync.Mutex           // Lock protecting the partition checks
+
+	stateFile string // File persisting the peers for fast restarts (empty = disabled)
+
+	traces    map[uint64]chan *trace // Pending route traces awaiting their paths
+	traceIdx  uint64                 // Id of the next route trace
+	traceLock sync.Mutex             // Lock protecting the pending traces
+
+	waking   map[string][]*proto.Message // Messages parked until their dormant next hop is re-dialed
+	wakeLock sync.Mutex                  // Lock protecting the parked messages
+
+	left chan *peer // Departure acknowledgements of the peers (nil if not leaving)
+
+	hooks    overlay.Hooks    // Routing hooks intercepting the upper layer messages
+	watchers overlay.Watchers // Hooks notified of the leaf set changes
+	metric   overlay.Metric   // Metric selecting between the next hop candidates (nil = prefix routing)
 
 	eventLock   sync.Mutex    // Lock protecting overlay events
 	eventNotify chan struct{} // Notifier for event changes
 
-	stable sync.WaitGroup // Syncer for reaching convergence
-	lock   sync.RWMutex   // Syncer for state mods after booting
+	stable chan struct{} // Channel closed once the overlay first converges
+	lock   sync.RWMutex  // Syncer for state mods after booting
 }
 
 // Creates a new overlay structure with all internal state initialized, ready to
 // be booted.
 func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
-	// Generate the random node id for this overlay peer
-	peerId := make([]byte, config.PastrySpace/8)
-	if n, err := io.ReadFull(rand.Reader, peerId); n < len(peerId) || err != nil {
-		panic(fmt.Sprintf("failed to generate node id: %v", err))
-	}
-	nodeId := new(big.Int).SetBytes(peerId)
+	// Generate (or derive from the configured seed) the node key and the overlay id
+	nodeKey, nodeId := overlay.LocalIdentity()
 
 	// Assemble and return the overlay instance
 	o := &Overlay{
@@ -101,12 +131,19 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 		authId:  id,
 		authKey: key,
 
-		nodeId: nodeId,
-		addrs:  []string{},
+		nodeId:   nodeId,
+		nodeKey:  nodeKey,
+		addrs:    []string{},
+		extAddrs: append([]string{}, config.PastryAdvertise...),
+		meta:     overlay.CopyMetadata(config.PastryMetadata),
+		bridge:   config.PastryBridge,
 
 		livePeers: make(map[string]*peer),
+		relays:    make(map[string]*peer),
+		dormant:   make(map[string][]string),
 		routes:    newRoutingTable(nodeId),
 		time:      1,
+		leafTime:  time.Now(),
 
 		acceptQuit: []chan chan error{},
 		maintQuit:  make(chan chan error),
@@ -117,16 +154,34 @@ func New(id string, key *rsa.PrivateKey, app Callback) *Overlay {
 
 		exchSet:     make(map[*peer]*state),
 		dropSet:     make(map[*peer]struct{}),
+		leftSet:     make(map[*peer]struct{}),
 		eventNotify: make(chan struct{}, 1), // Buffer one notification
+		stable:      make(chan struct{}),
+
+		proxim: newProximity(),
+		hops:   newRouteCache(config.PastryRouteCache),
+		metric: overlay.Metrics[config.PastryMetric],
+		merges: make(map[string]time.Time),
+
+		traces: make(map[uint64]chan *trace),
+		waking: make(map[string][]*proto.Message),
+	}
+	if err := o.SetStateFile(config.PastryStateFile); err != nil {
+		log.Printf("pastry: failed to restore node identity: %v.", err)
 	}
 	o.heart = newHeart(o)
+	o.press = newPressure(o.sendThrottles)
 	return o
 }
 
 // Boots the overlay network: it starts up boostrappers and connection acceptors
-// on all local IPv4 interfaces, after which the overlay management is booted.
+// on all local IPv4 interfaces (and acceptors on the global IPv6 ones if enabled),
+// after which the overlay management is booted.
 // The method returns the number of remote peers after convergence is reached.
 func (o *Overlay) Boot() (int, error) {
+	// Report the node key, needed by the allowlists of the remote nodes
+	log.Printf("pastry: booting node %v, key fingerprint %s.", o.nodeId, overlay.Fingerprint(o.nodeKey.Public().(ed25519.PublicKey)))
+
 	// Start the individual acceptors
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -149,7 +204,7 @@ func (o *Overlay) Boot() (int, error) {
 			continue
 		}
 
-		if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+		if overlay.Listenable(ipnet.IP) {
 			// Create a quit channel and start the acceptor
 			quit := make(chan chan error)
 			o.acceptQuit = append(o.acceptQuit, quit)
@@ -157,7 +212,6 @@ func (o *Overlay) Boot() (int, error) {
 		}
 	}
 	// Start the overlay processes
-	o.stable.Add(1)
 	go o.manager()
 	o.heart.start()
 
@@ -165,8 +219,11 @@ func (o *Overlay) Boot() (int, error) {
 	o.authAccept.Start()
 	o.stateExch.Start()
 
+	// Dial any peers persisted by a previous run, not waiting for the bootstrappers
+	o.restore()
+
 	// Wait for convergence and report remote connections
-	o.stable.Wait()
+	<-o.stable
 
 	o.lock.RLock()
 	defer o.lock.RUnlock()
@@ -202,9 +259,15 @@ func (o *Overlay) Shutdown() error {
 	if err := o.heart.terminate(); err != nil {
 		errs = append(errs, err)
 	}
+	// Have the peers route around the local node before closing the sessions
+	o.depart()
+
 	// Wait for all state exchanges to finish
 	o.stateExch.Terminate(true)
 
+	// Persist the peers for the next run
+	o.persist()
+
 	// Terminate the maintainer and all peer connections with it
 	o.maintQuit <- errc
 	if err := <-errc; err != nil {
@@ -226,6 +289,32 @@ func (o *Overlay) Self() *big.Int {
 	return o.nodeId
 }
 
+// Returns (at most) k remote nodes from the leaf set, nearest to the local one.
+func (o *Overlay) Leaves(k int) []*big.Int {
+	o.lock.RLock()
+	leaves := make([]*big.Int, 0, len(o.routes.leaves))
+	for _, id := range o.routes.leaves {
+		if id.Cmp(o.nodeId) != 0 {
+			leaves = append(leaves, id)
+		}
+	}
+	o.lock.RUnlock()
+
+	sort.Slice(leaves, func(i, j int) bool {
+		return Distance(o.nodeId, leaves[i]).Cmp(Distance(o.nodeId, leaves[j])) < 0
+	})
+	if len(leaves) > k {
+		leaves = leaves[:k]
+	}
+	return leaves
+}
+
+// Calculates the absolute distance between two ids on the circular id space, the
+// metric of the overlay.
+func (o *Overlay) Distance(a, b *big.Int) *big.Int {
+	return Distance(a, b)
+}
+
 // Sends a message to the closest node to the given destination.
 func (o *Overlay) Send(dest *big.Int, msg *proto.Message) {
 	// Package into overlay envelope
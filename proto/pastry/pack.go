@@ -0,0 +1,93 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the batched state exchanges: joining nodes are sent all the routing
+// table rows up to the common prefix in a single exchange (instead of learning
+// them row by row through a storm of small messages), large peer lists are gob
+// encoded and compressed, and state exchanges queued for the same peer coalesce
+// into one carrying the latest routing state.
+
+package pastry
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/project-iris/iris/config"
+)
+
+// State exchange format version supporting compressed peer lists.
+const packVersion = 1
+
+// Compresses the peer address list of a state exchange into its packed form.
+func (s *state) pack() error {
+	buf := new(bytes.Buffer)
+	zip, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(zip).Encode(s.Addrs); err != nil {
+		return err
+	}
+	if err := zip.Close(); err != nil {
+		return err
+	}
+	s.Addrs, s.Pack = nil, buf.Bytes()
+	return nil
+}
+
+// Decompresses the packed peer address list of a state exchange, rejecting it if
+// it would inflate beyond the frame limit.
+func (s *state) unpack() error {
+	zip := flate.NewReader(bytes.NewReader(s.Pack))
+	defer zip.Close()
+
+	blob, err := ioutil.ReadAll(io.LimitReader(zip, int64(config.PastryFrameLimit)+1))
+	if err != nil {
+		return err
+	}
+	if len(blob) > config.PastryFrameLimit {
+		return fmt.Errorf("packed state exceeds %v bytes", config.PastryFrameLimit)
+	}
+	addrs := make(map[string][]string)
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&addrs); err != nil {
+		return err
+	}
+	s.Addrs, s.Pack = addrs, nil
+	return nil
+}
+
+// Schedules a state exchange towards a peer, unless one is already pending (the
+// pending one will carry the latest state anyway).
+func (o *Overlay) queueState(p *peer) {
+	if !atomic.CompareAndSwapUint32(&p.queued, 0, 1) {
+		return
+	}
+	err := o.stateExch.Schedule(func() {
+		atomic.StoreUint32(&p.queued, 0)
+		o.sendState(p)
+	})
+	if err != nil {
+		atomic.StoreUint32(&p.queued, 0)
+	}
+}
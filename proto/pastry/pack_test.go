@@ -0,0 +1,154 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that peer lists survive packing, and that malformed or oversized packed
+// states are rejected.
+func TestStatePack(t *testing.T) {
+	addrs := map[string][]string{
+		"1": {"10.0.0.1:1", "10.0.0.1:2"},
+		"2": {"10.0.0.2:1"},
+		"3": nil,
+	}
+	s := &state{Addrs: make(map[string][]string)}
+	for id, a := range addrs {
+		s.Addrs[id] = a
+	}
+	if err := s.pack(); err != nil {
+		t.Fatalf("failed to pack state: %v.", err)
+	}
+	if s.Addrs != nil || len(s.Pack) == 0 {
+		t.Fatalf("packed state mismatch: have %v addresses, %v bytes packed.", len(s.Addrs), len(s.Pack))
+	}
+	packed := append([]byte(nil), s.Pack...)
+	if err := s.unpack(); err != nil {
+		t.Fatalf("failed to unpack state: %v.", err)
+	}
+	if s.Pack != nil || len(s.Addrs) != len(addrs) {
+		t.Fatalf("unpacked state mismatch: have %v addresses, %v bytes packed.", len(s.Addrs), len(s.Pack))
+	}
+	for id, a := range addrs {
+		if len(a) > 0 && !reflect.DeepEqual(s.Addrs[id], a) {
+			t.Fatalf("peer %v addresses mismatch: have %v, want %v.", id, s.Addrs[id], a)
+		}
+	}
+	// Corrupt and oversized packs must be rejected
+	if err := (&state{Pack: []byte{0xff, 0x00, 0xff}}).unpack(); err == nil {
+		t.Fatalf("corrupt pack accepted.")
+	}
+	limit := config.PastryFrameLimit
+	defer func() { config.PastryFrameLimit = limit }()
+	config.PastryFrameLimit = 8
+
+	if err := (&state{Pack: packed}).unpack(); err == nil {
+		t.Fatalf("oversized pack accepted.")
+	}
+}
+
+// Tests that an overlay exchanging batched and packed states converges into a
+// consistent routing state.
+func TestStateBatching(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	space, base, leaves, pack := config.PastrySpace, config.PastryBase, config.PastryLeaves, config.PastryStatePack
+	defer func() {
+		config.PastrySpace, config.PastryBase, config.PastryLeaves, config.PastryStatePack = space, base, leaves, pack
+	}()
+	config.PastrySpace, config.PastryBase, config.PastryLeaves, config.PastryStatePack = 20, 2, 2, 1
+
+	peers := 8
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	nodes := make([]*Overlay, peers)
+	index := make(map[string]*Overlay)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+		index[nodes[i].nodeId.String()] = nodes[i]
+	}
+	time.Sleep(time.Second)
+
+	// Verify that every node reaches every other along the routing tables
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = traverse(nodes, index); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("routing state inconsistent: %v.", err)
+	}
+	// Make sure the nodes actually packed their exchanges
+	for i, node := range nodes {
+		node.lock.RLock()
+		for _, p := range node.livePeers {
+			if !p.pack {
+				t.Fatalf("node #%d: peer %v not packing.", i, p.nodeId)
+			}
+		}
+		node.lock.RUnlock()
+	}
+}
+
+// Walks the routing tables from every node to every other one, reporting the
+// first destination that cannot be reached.
+func traverse(nodes []*Overlay, index map[string]*Overlay) error {
+	for i, src := range nodes {
+		for _, dst := range nodes {
+			cur, hops := src, 0
+			for ; cur != dst && hops < len(nodes); hops++ {
+				cur.lock.RLock()
+				next, _ := cur.nextHop(dst.nodeId, false)
+				cur.lock.RUnlock()
+
+				if cur = index[next.String()]; cur == nil {
+					return fmt.Errorf("node #%d: unknown hop towards %v: %v", i, dst.nodeId, next)
+				}
+			}
+			if cur != dst {
+				return fmt.Errorf("node #%d: destination %v unreachable in %v hops", i, dst.nodeId, hops)
+			}
+		}
+	}
+	return nil
+}
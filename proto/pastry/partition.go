@@ -0,0 +1,118 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the partition detection and merging. Nodes found by the bootstrapper
+// but deemed unneeded in the local routing table are looked up via the overlay:
+// in a connected overlay the lookup reaches the node itself (its id being the
+// destination), whereas if it ends at any other node, that is the closest one
+// in its own overlay, without knowing of the looked up node. The two are thus
+// in disjoint halves of a partitioned network. The closest node dials the
+// foreign one, and the ensuing state exchanges reconcile the routing state of
+// the two halves, whilst the topic trees are merged by the upper layer's root
+// handovers as the leaf sets change.
+
+package pastry
+
+import (
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Checks whether a bootstrap-found node is part of the local overlay, routing a
+// merge request towards it if not connected directly. Checks of the same node
+// are rate limited to one per cooldown period.
+func (o *Overlay) lookup(id *big.Int, addrs []string) {
+	o.lock.RLock()
+	if o.stat != done || id.Cmp(o.nodeId) == 0 {
+		o.lock.RUnlock()
+		return
+	}
+	if _, ok := o.livePeers[id.String()]; ok {
+		o.lock.RUnlock()
+		return
+	}
+	if !o.cooled(id) {
+		o.lock.RUnlock()
+		return
+	}
+	// If the local node is the closest, check for partition, otherwise route
+	next, _ := o.nextHop(id, false)
+	if next.Cmp(o.nodeId) == 0 {
+		o.heal(id, addrs)
+		o.lock.RUnlock()
+		return
+	}
+	p, ok := o.livePeers[next.String()]
+	o.lock.RUnlock()
+
+	if ok {
+		o.sendMerge(p, id, addrs)
+	}
+}
+
+// Checks whether the cooldown period of a node's partition check passed, also
+// marking it as checked now if so. Stale entries are pruned along the way.
+func (o *Overlay) cooled(id *big.Int) bool {
+	o.mergeLock.Lock()
+	defer o.mergeLock.Unlock()
+
+	now := time.Now()
+	for sid, last := range o.merges {
+		if now.Sub(last) >= config.PastryMergeCooldown {
+			delete(o.merges, sid)
+		}
+	}
+	if _, ok := o.merges[id.String()]; ok {
+		return false
+	}
+	o.merges[id.String()] = now
+	return true
+}
+
+// Processes a merge request arriving at the closest node to the looked up id: if
+// the node itself is unknown, a partition is detected and the node dialed, the
+// handshake and state exchanges merging the two overlays.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) heal(id *big.Int, addrs []string) {
+	// Bail out if the lookup reached the node itself (connected overlay), or if
+	// the local node is only a middle hop towards it
+	if id.Cmp(o.nodeId) == 0 {
+		return
+	}
+	if next, _ := o.nextHop(id, false); next.Cmp(o.nodeId) != 0 {
+		return
+	}
+	if _, ok := o.livePeers[id.String()]; ok {
+		return
+	}
+	log.Printf("pastry: partition detected, merging with %v.", id)
+
+	peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+	for _, a := range addrs {
+		if addr, err := net.ResolveTCPAddr("tcp", a); err != nil {
+			log.Printf("pastry: failed to resolve address %v: %v.", a, err)
+		} else {
+			peerAddrs = append(peerAddrs, addr)
+		}
+	}
+	o.authInit.Schedule(func() { o.dial(peerAddrs) })
+}
@@ -0,0 +1,85 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that two overlays unaware of each other (simulated by distinct network
+// ids, hiding them from each other's bootstrappers) are merged after a node of
+// one is looked up through the other.
+func TestPartitionMerge(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	halves, size := 2, 2
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < halves*size; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Boot the two halves of the partitioned network
+	nodes := make([][]*Overlay, halves)
+	for i := 0; i < halves; i++ {
+		for j := 0; j < size; j++ {
+			node := New(fmt.Sprintf("%s.%d", appId, i), key, new(nopCallback))
+			if _, err := node.Boot(); err != nil {
+				t.Fatalf("failed to boot node: %v.", err)
+			}
+			defer node.Shutdown()
+			nodes[i] = append(nodes[i], node)
+		}
+	}
+	time.Sleep(time.Second)
+
+	for i := 0; i < halves; i++ {
+		for j, node := range nodes[i] {
+			if peers := len(node.Inspect().Peers); peers != size-1 {
+				t.Fatalf("half #%d, node #%d: partitioned peer count mismatch: have %v, want %v.", i, j, peers, size-1)
+			}
+		}
+	}
+	// Look up a node of the second half through the first and wait for the merge
+	foreign := nodes[1][0]
+	foreign.lock.RLock()
+	addrs := append([]string{}, foreign.addrs...)
+	foreign.lock.RUnlock()
+
+	nodes[0][0].lookup(foreign.nodeId, addrs)
+	time.Sleep(2 * time.Second)
+
+	for i := 0; i < halves; i++ {
+		for j, node := range nodes[i] {
+			if peers := len(node.Inspect().Peers); peers != halves*size-1 {
+				t.Fatalf("half #%d, node #%d: merged peer count mismatch: have %v, want %v.", i, j, peers, halves*size-1)
+			}
+		}
+	}
+}
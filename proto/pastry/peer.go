@@ -18,19 +18,31 @@
 
 // Contains the peer connection state information and the related maintenance
 // operations.
+//
+// Outbound messages are scheduled in three priority classes: control messages
+// (no payload: heartbeats, reports, tree maintenance) go through the dedicated
+// control link, whereas payload carrying ones are queued as interactive or bulk
+// based on their size, the former always preempting the latter on the data
+// link. Bulk messages may thus be overtaken by interactive ones.
+//
+// Interactive messages queued up behind each other are coalesced into a single
+// link frame to cut the per-message crypto and syscall costs of chatty traffic.
 
 package pastry
 
 import (
 	"errors"
+	"log"
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/project-iris/iris/proto/link"
 
 	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/heart"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/session"
 )
@@ -52,7 +64,26 @@ type peer struct {
 
 	// Overlay state infos
 	time    uint64
-	passive bool
+	passive uint32       // Whether the link was reported passive (atomic, routing holds a read lock only)
+	pace    *heart.Pace  // Adaptive heartbeat schedule of the peer
+	info    atomic.Value // Metadata advertised by the peer (map[string]string)
+	pack    bool         // Whether the remote side unpacks compressed state exchanges
+	rows    uint32       // Batched rows for a joining peer: 0 = none, 1 = due, 2 = sent (atomic)
+	queued  uint32       // Whether a state exchange is already scheduled (atomic)
+	oneway  uint32       // Whether the peer cannot be dialed back, e.g. behind NAT (atomic)
+	used    int64        // Time of the last upper layer message either way (unix nanos, atomic)
+
+	// Outbound data queues
+	batch bool                // Whether the remote side splits batched frames
+	frag  bool                // Whether the remote side reassembles fragments
+	frags uint64              // Id counter of the fragmented messages (atomic)
+	inter chan *proto.Message // Interactive (small payload) messages
+	bulk  chan *proto.Message // Bulk (large payload) messages
+	sched chan chan struct{}  // Synchronizes scheduler termination
+
+	dropped uint64 // Frames dropped on a stuck data link (atomic)
+
+	press *pressure // Congestion tracker of the local node (nil if detached)
 
 	// Maintenance fields
 	quit chan chan error // Synchronizes peer termination
@@ -73,16 +104,25 @@ func (o *Overlay) newPeer(ses *session.Session) *peer {
 		lhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
 		rhost: ses.CtrlLink.Sock().LocalAddr().(*net.TCPAddr).IP.String(),
 
+		// Start beating every period until the link proves stable
+		pace: heart.NewPace(config.PastryBeatCalm, config.PastryBeatStretch),
+		used: time.Now().UnixNano(),
+
 		// Transport and maintenance channels
-		quit: make(chan chan error),
-		drop: make(chan struct{}, 2),
+		inter: make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+		press: o.press,
+		quit:  make(chan chan error),
+		drop:  make(chan struct{}, 2),
 	}
 }
 
-// Starts the inbound message processor and router.
+// Starts the inbound message processors and the outbound scheduler.
 func (p *peer) Start() {
 	go p.processor(p.conn.CtrlLink)
 	go p.processor(p.conn.DataLink)
+	go p.scheduler()
 }
 
 // Terminates a peer connection.
@@ -96,8 +136,13 @@ func (p *peer) Close() error {
 	}
 	p.term = true
 
-	// Gracefully close the peer session, flushing pending messages
+	// Flush the queued messages into the link and gracefully close the session
+	done := make(chan struct{})
+	p.sched <- done
+	<-done
+
 	res := p.conn.Close()
+	p.press.release(p)
 
 	// Sync the processor terminations and return
 	errc := make(chan error)
@@ -112,17 +157,166 @@ func (p *peer) Close() error {
 
 // Sends a message to the remote peer.
 func (p *peer) send(msg *proto.Message) error {
-	// Select the outbound channel based on message contents
-	link := p.conn.DataLink
-	if len(msg.Data) == 0 {
-		link = p.conn.CtrlLink
+	// Select the outbound queue based on message contents
+	queue := p.inter
+	switch {
+	case len(msg.Data) == 0:
+		queue = p.conn.CtrlLink.Send
+	case len(msg.Data) > config.PastryBulkThreshold:
+		queue = p.bulk
 	}
-	// Send the message on the selected channel
+	if queue != p.conn.CtrlLink.Send {
+		p.touch()
+	}
+	// Split oversized payloads into fragments, queued in order behind each other
+	frames := []*proto.Message{msg}
+	if limit := config.PastryFrameLimit; p.frag && limit > 0 && len(msg.Data) > limit {
+		frames = link.Fragment(msg, atomic.AddUint64(&p.frags, 1), limit)
+	}
+	// Send the message on the selected queue
+	for _, frame := range frames {
+		select {
+		case queue <- frame:
+			if queue != p.conn.CtrlLink.Send {
+				p.press.update(p)
+			}
+		case <-time.After(config.PastrySendTimeout):
+			return errors.New("timeout")
+		}
+	}
+	return nil
+}
+
+// Marks the peer as recently used by the upper layers, postponing its idle
+// teardown.
+func (p *peer) touch() {
+	atomic.StoreInt64(&p.used, time.Now().UnixNano())
+}
+
+// Retrieves the time elapsed since the upper layers last used the peer.
+func (p *peer) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.used)))
+}
+
+// Moves the queued data messages into the data link, always preferring the
+// interactive ones over bulk traffic.
+func (p *peer) scheduler() {
+	var done chan struct{}
+	for done == nil {
+		// Forward any pending interactive message first
+		select {
+		case msg := <-p.inter:
+			for _, frame := range p.coalesce(msg) {
+				p.forward(frame)
+			}
+			continue
+		default:
+		}
+		// Nothing interactive, wait for whatever comes next
+		select {
+		case done = <-p.sched:
+			continue
+		case msg := <-p.inter:
+			for _, frame := range p.coalesce(msg) {
+				p.forward(frame)
+			}
+		case msg := <-p.bulk:
+			p.forward(msg)
+		}
+	}
+	// Flush the pending messages (still by priority) while the link accepts them,
+	// the link might be already dead, so bound the close by the send timeout
+	timeout := time.NewTimer(config.PastrySendTimeout)
+	defer timeout.Stop()
+
+	lost, expired := uint64(0), false
+	for _, queue := range []chan *proto.Message{p.inter, p.bulk} {
+		for flushed := false; !flushed; {
+			select {
+			case msg := <-queue:
+				if expired {
+					lost++
+					continue
+				}
+				select {
+				case p.conn.DataLink.Send <- msg:
+				case <-timeout.C:
+					lost, expired = lost+1, true
+				}
+			default:
+				flushed = true
+			}
+		}
+	}
+	if lost > 0 {
+		atomic.AddUint64(&p.dropped, lost)
+		log.Printf("pastry: dropped %d queued messages to %v on close.", lost, p.nodeId)
+	}
+	close(done)
+}
+
+// Coalesces an interactive message with the ones queued up behind it into a
+// single link frame. If the link is busy (others were already queued), a short
+// while is lingered for further messages to arrive before sending the batch.
+// Only secured messages are batched (a single unsecured one would get the whole
+// frame rejected by the link), anything else ends the batch and is sent after
+// it. Peers not supporting batched frames are sent the messages one by one.
+func (p *peer) coalesce(msg *proto.Message) []*proto.Message {
+	if config.PastryBatchLimit < 2 || !p.batch || !msg.Secure() {
+		return []*proto.Message{msg}
+	}
+	batch := []*proto.Message{msg}
+
+	var tail *proto.Message
+	var linger <-chan time.Time
+	for tail == nil && len(batch) < config.PastryBatchLimit {
+		// Gather any message already queued
+		var next *proto.Message
+		select {
+		case next = <-p.inter:
+		default:
+		}
+		// Queue drained, linger only if traffic is chatty
+		if next == nil {
+			if len(batch) == 1 || config.PastryBatchLinger <= 0 {
+				break
+			}
+			if linger == nil {
+				linger = time.After(config.PastryBatchLinger)
+			}
+			select {
+			case next = <-p.inter:
+			case <-linger:
+			}
+			if next == nil {
+				break
+			}
+		}
+		if next.Secure() {
+			batch = append(batch, next)
+		} else {
+			tail = next
+		}
+	}
+	frames := []*proto.Message{msg}
+	if len(batch) > 1 {
+		frames[0] = link.Batch(batch)
+	}
+	if tail != nil {
+		frames = append(frames, tail)
+	}
+	return frames
+}
+
+// Forwards a scheduled message into the data link, dropping it if the link is
+// stuck (counted, surfaced through the routing snapshots).
+func (p *peer) forward(msg *proto.Message) {
+	defer p.press.update(p)
+
 	select {
-	case link.Send <- msg:
-		return nil
+	case p.conn.DataLink.Send <- msg:
 	case <-time.After(config.PastrySendTimeout):
-		return errors.New("timeout")
+		atomic.AddUint64(&p.dropped, 1)
 	}
 }
 
@@ -144,6 +338,9 @@ func (p *peer) processor(link *link.Link) {
 				continue
 			}
 			// Route the control message
+			if len(msg.Data) > 0 {
+				p.touch()
+			}
 			p.owner.route(p, msg)
 		}
 	}
@@ -0,0 +1,318 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/link"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Tests that queued interactive messages preempt the bulk ones on the data link
+// and that everything gets flushed on termination.
+func TestPeerPriorities(t *testing.T) {
+	// Disable batching to see the individual messages
+	old := config.PastryBatchLimit
+	config.PastryBatchLimit = 1
+	defer func() { config.PastryBatchLimit = old }()
+
+	bulks, inters := 8, 4
+
+	ses := &session.Session{
+		CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+		DataLink: &link.Link{Send: make(chan *proto.Message, bulks+inters)},
+	}
+	p := &peer{
+		conn:  ses,
+		inter: make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+	}
+	// Queue up a burst of bulk traffic followed by a few interactive messages
+	for i := 0; i < bulks; i++ {
+		if err := p.send(&proto.Message{Data: make([]byte, config.PastryBulkThreshold+1)}); err != nil {
+			t.Fatalf("failed to queue bulk message: %v.", err)
+		}
+	}
+	for i := 0; i < inters; i++ {
+		if err := p.send(&proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to queue interactive message: %v.", err)
+		}
+	}
+	if err := p.send(&proto.Message{}); err != nil {
+		t.Fatalf("failed to queue control message: %v.", err)
+	}
+	if n := len(ses.CtrlLink.Send); n != 1 {
+		t.Fatalf("control message count mismatch: have %v, want %v.", n, 1)
+	}
+	// Run the scheduler and terminate it right away, the rest should be flushed
+	go p.scheduler()
+
+	done := make(chan struct{})
+	p.sched <- done
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("scheduler termination timed out.")
+	}
+	// Ensure the interactive messages went out first
+	if n := len(ses.DataLink.Send); n != inters+bulks {
+		t.Fatalf("forwarded message count mismatch: have %v, want %v.", n, inters+bulks)
+	}
+	for i := 0; i < inters+bulks; i++ {
+		msg := <-ses.DataLink.Send
+		if bulk := len(msg.Data) > config.PastryBulkThreshold; bulk != (i >= inters) {
+			t.Fatalf("message %d: bulk flag mismatch: have %v, want %v.", i, bulk, i >= inters)
+		}
+	}
+}
+
+// Tests that a stuck data link neither blocks the scheduler termination for long
+// nor loses messages silently.
+func TestPeerStuckFlush(t *testing.T) {
+	// Disable batching and shorten the send timeout to speed the test up
+	batch, timeout := config.PastryBatchLimit, config.PastrySendTimeout
+	config.PastryBatchLimit, config.PastrySendTimeout = 1, 50*time.Millisecond
+	defer func() { config.PastryBatchLimit, config.PastrySendTimeout = batch, timeout }()
+
+	msgs := 8
+
+	ses := &session.Session{
+		CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+		DataLink: &link.Link{Send: make(chan *proto.Message, 1)},
+	}
+	p := &peer{
+		conn:  ses,
+		inter: make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+	}
+	for i := 0; i < msgs; i++ {
+		if err := p.send(&proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to queue message: %v.", err)
+		}
+	}
+	// Run the scheduler against the stuck link and terminate it
+	go p.scheduler()
+
+	done := make(chan struct{})
+	p.sched <- done
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("scheduler termination timed out.")
+	}
+	// Everything not fitting into the link must be accounted for
+	if sent, dropped := len(ses.DataLink.Send), int(atomic.LoadUint64(&p.dropped)); sent+dropped != msgs {
+		t.Fatalf("message accounting mismatch: sent %v + dropped %v, want %v.", sent, dropped, msgs)
+	}
+}
+
+// Tests that queued up interactive messages are coalesced into batch frames, and
+// that lone messages are forwarded as is.
+func TestPeerBatching(t *testing.T) {
+	inters := 2*config.PastryBatchLimit + 1
+
+	ses := &session.Session{
+		CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+		DataLink: &link.Link{Send: make(chan *proto.Message, inters)},
+	}
+	p := &peer{
+		conn:  ses,
+		batch: true,
+		inter: make(chan *proto.Message, inters),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+	}
+	// Queue up a burst of interactive messages and schedule them
+	for i := 0; i < inters; i++ {
+		msg := &proto.Message{Data: []byte{byte(i)}}
+		msg.KnownSecure()
+		if err := p.send(msg); err != nil {
+			t.Fatalf("failed to queue interactive message: %v.", err)
+		}
+	}
+	go p.scheduler()
+
+	// Ensure they were coalesced into full batches (the remainder too)
+	for i := 0; i < 3; i++ {
+		select {
+		case frame := <-ses.DataLink.Send:
+			if !frame.Secure() {
+				t.Fatalf("frame %d: security mismatch: have %v, want %v.", i, false, true)
+			}
+			want := config.PastryBatchLimit
+			if i == 2 {
+				want = 1
+			}
+			if size := len(frame.Data); size != want {
+				t.Fatalf("frame %d: batched payload mismatch: have %v, want %v.", i, size, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d: forwarding timed out.", i)
+		}
+	}
+	// Ensure a lone message is not batched
+	if err := p.send(&proto.Message{Data: []byte{0}}); err != nil {
+		t.Fatalf("failed to queue interactive message: %v.", err)
+	}
+	select {
+	case msg := <-ses.DataLink.Send:
+		if len(msg.Data) != 1 || msg.Head.Meta != nil {
+			t.Fatalf("lone message mismatch: have %+v, want %+v.", msg, proto.Message{Data: []byte{0}})
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("lone message forwarding timed out.")
+	}
+	done := make(chan struct{})
+	p.sched <- done
+	<-done
+}
+
+// Tests that unsecured messages are never batched (they would get the frame
+// rejected), and that peers not supporting batches are sent single messages.
+func TestPeerBatchingGated(t *testing.T) {
+	for _, batch := range []bool{true, false} {
+		ses := &session.Session{
+			CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+			DataLink: &link.Link{Send: make(chan *proto.Message, 8)},
+		}
+		p := &peer{
+			conn:  ses,
+			batch: batch,
+			inter: make(chan *proto.Message, 8),
+			bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+			sched: make(chan chan struct{}),
+		}
+		// Queue up secured messages with an unsecured one in between
+		for i := 0; i < 5; i++ {
+			msg := &proto.Message{Data: []byte{byte(i)}}
+			if i != 2 {
+				msg.KnownSecure()
+			}
+			if err := p.send(msg); err != nil {
+				t.Fatalf("batch %v: failed to queue interactive message: %v.", batch, err)
+			}
+		}
+		go p.scheduler()
+
+		// Ensure the frames follow the queue order, batching only where allowed
+		sizes := []int{2, 1, 2}
+		if !batch {
+			sizes = []int{1, 1, 1, 1, 1}
+		}
+		next := 0
+		for i, size := range sizes {
+			select {
+			case frame := <-ses.DataLink.Send:
+				if len(frame.Data) != size {
+					t.Fatalf("batch %v, frame %d: payload mismatch: have %v, want %v.", batch, i, len(frame.Data), size)
+				}
+				if batched := frame.Head.Meta != nil; batched != (size > 1) {
+					t.Fatalf("batch %v, frame %d: batching mismatch: have %v, want %v.", batch, i, batched, size > 1)
+				}
+				for _, b := range frame.Data {
+					if int(b) != next {
+						t.Fatalf("batch %v, frame %d: order mismatch: have %v, want %v.", batch, i, b, next)
+					}
+					next++
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("batch %v, frame %d: forwarding timed out.", batch, i)
+			}
+		}
+		done := make(chan struct{})
+		p.sched <- done
+		<-done
+	}
+}
+
+// Tests that filling up a peer's data queue congests the node, signals the peers
+// to slow down, and that draining it relieves the node again. Remote throttle
+// requests should hold the node back temporarily.
+func TestPeerPressure(t *testing.T) {
+	signals := make(chan struct{}, 16)
+	press := newPressure(func() { signals <- struct{}{} })
+
+	ses := &session.Session{
+		CtrlLink: &link.Link{Send: make(chan *proto.Message, 1)},
+		DataLink: &link.Link{Send: make(chan *proto.Message, config.PastryNetBuffer)},
+	}
+	p := &peer{
+		conn:  ses,
+		inter: make(chan *proto.Message, config.PastryNetBuffer),
+		bulk:  make(chan *proto.Message, config.PastryNetBuffer),
+		sched: make(chan chan struct{}),
+		press: press,
+	}
+	// Fill the queue up to the high watermark and check for congestion
+	high := int(config.PastryPressureHigh * float64(config.PastryNetBuffer))
+	for i := 0; i < high; i++ {
+		select {
+		case <-press.relief:
+		default:
+			t.Fatalf("congested before reaching the watermark at %d.", i)
+		}
+		if err := p.send(&proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to queue message: %v.", err)
+		}
+	}
+	select {
+	case <-press.relief:
+		t.Fatalf("not congested at the high watermark.")
+	default:
+	}
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatalf("throttle signal not sent.")
+	}
+	// Drain the queue through the scheduler and check for relief
+	go p.scheduler()
+	select {
+	case <-press.relief:
+	case <-time.After(time.Second):
+		t.Fatalf("congestion not relieved.")
+	}
+	done := make(chan struct{})
+	p.sched <- done
+	<-done
+
+	// Ensure remote backpressure requests hold the node back until they expire
+	old := config.PastryThrottleSpan
+	config.PastryThrottleSpan = 100 * time.Millisecond
+	defer func() { config.PastryThrottleSpan = old }()
+
+	press.throttle()
+	select {
+	case <-press.relief:
+		t.Fatalf("not pressured after throttle request.")
+	default:
+	}
+	select {
+	case <-press.relief:
+	case <-time.After(time.Second):
+		t.Fatalf("throttle request not expired.")
+	}
+}
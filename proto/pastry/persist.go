@@ -0,0 +1,233 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the persistence of the converged overlay state: the peers of the
+// leaf set and routing table are periodically saved to disk alongside their
+// network addresses and last-seen times (and also on shutdown), so that a
+// restarting node can dial them straight away, rejoining within seconds instead
+// of waiting for the bootstrappers to find the network. Peers dropping out of
+// the routing state are retained until they expire, and only the ones passing
+// the handshake (i.e. alive) make it back into the routing table. The node key
+// is persisted too, so that the restarted node keeps its id (and with it its
+// place in the overlay). The state is sealed with the cluster key, so the node
+// key never touches the disk in the clear.
+
+package pastry
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/crypto/vault"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Overlay state persisted between runs.
+type persisted struct {
+	Key   []byte              // Node key the overlay id is bound to
+	Peers map[string][]string // Routing state peers and their listener addresses
+	Seen  map[string]int64    // Last time the peers were seen live (unix nanos, missing on legacy files)
+}
+
+// Replaces the node key (and with it the overlay id) with one derived from a
+// secret seed. A key persisted in the state file set afterwards still takes
+// precedence. Must be called before booting.
+func (o *Overlay) SetIdentitySeed(seed string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.nodeKey, o.nodeId = overlay.SeededIdentity(seed)
+	o.routes = newRoutingTable(o.nodeId)
+	o.hops.flush()
+}
+
+// Sets the file persisting the overlay state, adopting the node key (and with it
+// the overlay id) saved by a previous run, or saving the current one for the next
+// if none was yet. Must be called before booting.
+func (o *Overlay) SetStateFile(path string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.stateFile = path
+	if path == "" {
+		return nil
+	}
+	state, err := load(o.vault(), path)
+	switch {
+	case err == nil && len(state.Key) == ed25519.PrivateKeySize:
+		o.nodeKey = ed25519.PrivateKey(state.Key)
+		o.nodeId = overlay.BindId(o.nodeKey.Public().(ed25519.PublicKey))
+		o.routes = newRoutingTable(o.nodeId)
+		o.hops.flush()
+		return nil
+	case err == nil:
+		state.Key = o.nodeKey
+		return save(o.vault(), path, state)
+	case os.IsNotExist(err):
+		return save(o.vault(), path, &persisted{Key: o.nodeKey})
+	default:
+		return err
+	}
+}
+
+// Saves the peers of the current routing state into the configured state file,
+// logging any failures. Empty routing states don't overwrite previous saves.
+func (o *Overlay) persist() {
+	if o.stateFile == "" {
+		return
+	}
+	now := time.Now()
+
+	o.lock.RLock()
+	state := &persisted{
+		Key:   o.nodeKey,
+		Peers: make(map[string][]string),
+		Seen:  make(map[string]int64),
+	}
+	for sid, p := range o.livePeers {
+		if o.active(p.nodeId) {
+			state.Peers[sid] = append([]string{}, p.addrs...)
+			state.Seen[sid] = now.UnixNano()
+		}
+	}
+	o.lock.RUnlock()
+
+	if len(state.Peers) == 0 {
+		return
+	}
+	// Retain the recently seen peers of previous saves as warm start candidates
+	if old, err := load(o.vault(), o.stateFile); err == nil {
+		for sid, addrs := range old.Peers {
+			_, live := state.Peers[sid]
+			_, seen := old.Seen[sid]
+			if !live && seen && sid != o.nodeId.String() && old.fresh(sid, now) {
+				state.Peers[sid], state.Seen[sid] = addrs, old.Seen[sid]
+			}
+		}
+	}
+	state.trim(config.PastryStatePeers)
+
+	if err := save(o.vault(), o.stateFile, state); err != nil {
+		log.Printf("pastry: failed to persist overlay state: %v.", err)
+	}
+}
+
+// Dials the unexpired peers persisted by a previous run, if any, the most recently
+// seen ones first. Dead peers simply fail the dial and never enter the routing.
+func (o *Overlay) restore() {
+	if o.stateFile == "" {
+		return
+	}
+	state, err := load(o.vault(), o.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("pastry: failed to load overlay state: %v.", err)
+		}
+		return
+	}
+	now := time.Now()
+	state.trim(config.PastryStatePeers)
+	for _, sid := range state.order() {
+		if id, ok := new(big.Int).SetString(sid, 10); !ok || id.Cmp(o.nodeId) == 0 || !state.fresh(sid, now) {
+			continue
+		}
+		addrs := state.Peers[sid]
+		peerAddrs := make([]*net.TCPAddr, 0, len(addrs))
+		for _, a := range addrs {
+			if addr, err := net.ResolveTCPAddr("tcp", a); err != nil {
+				log.Printf("pastry: failed to resolve address %v: %v.", a, err)
+			} else {
+				peerAddrs = append(peerAddrs, addr)
+			}
+		}
+		o.authInit.Schedule(func() { o.dial(peerAddrs) })
+	}
+}
+
+// Checks whether a persisted peer was seen recently enough to be dialed. Peers
+// of legacy state files without last-seen times are considered fresh.
+func (s *persisted) fresh(sid string, now time.Time) bool {
+	seen, ok := s.Seen[sid]
+	return !ok || now.Sub(time.Unix(0, seen)) < config.PastryStateExpiry
+}
+
+// Orders the persisted peers by their last-seen times, most recent first.
+func (s *persisted) order() []string {
+	ids := make([]string, 0, len(s.Peers))
+	for sid := range s.Peers {
+		ids = append(ids, sid)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if s.Seen[ids[i]] != s.Seen[ids[j]] {
+			return s.Seen[ids[i]] > s.Seen[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Drops the least recently seen peers beyond the given limit.
+func (s *persisted) trim(limit int) {
+	if ids := s.order(); len(ids) > limit {
+		for _, sid := range ids[limit:] {
+			delete(s.Peers, sid)
+			delete(s.Seen, sid)
+		}
+	}
+}
+
+// Creates the vault sealing the persisted state with the cluster key, opening it
+// with the secondary key too during a rotation.
+func (o *Overlay) vault() *vault.Vault {
+	if o.authKey == nil {
+		return vault.New()
+	}
+	return vault.New(session.ClusterKeys(o.authKey)...)
+}
+
+// Seals a persisted overlay state into a file, replaced atomically so concurrent
+// savers and crashes never leave a corrupt state.
+func save(v *vault.Vault, path string, state *persisted) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return err
+	}
+	return v.WriteFile(path, buf.Bytes())
+}
+
+// Reads a persisted overlay state from a sealed (or legacy plain) file.
+func load(v *vault.Vault, path string) (*persisted, error) {
+	data, err := v.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := new(persisted)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,213 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that the peers are persisted on shutdown and that a restarted node dials
+// them directly, without the help of the bootstrappers.
+func TestPersistRestart(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	dir, err := ioutil.TempDir("", "pastry-state")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Boot a persisting node and a plain one, and wait for convergence
+	file := config.PastryStateFile
+	defer func() { config.PastryStateFile = file }()
+
+	config.PastryStateFile = filepath.Join(dir, "state")
+	saver := New(appId, key, new(nopCallback))
+	config.PastryStateFile = ""
+
+	if _, err := saver.Boot(); err != nil {
+		t.Fatalf("failed to boot persisting node: %v.", err)
+	}
+	peer := New(appId, key, new(nopCallback))
+	if _, err := peer.Boot(); err != nil {
+		t.Fatalf("failed to boot peer node: %v.", err)
+	}
+	defer peer.Shutdown()
+	time.Sleep(time.Second)
+
+	// Terminate the persisting node and verify the saved state
+	if err := saver.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate persisting node: %v.", err)
+	}
+	state, err := load(saver.vault(), filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("failed to load persisted state: %v.", err)
+	}
+	if _, ok := state.Peers[peer.nodeId.String()]; !ok || len(state.Peers) != 1 {
+		t.Fatalf("persisted peers mismatch: have %v, want %v.", state.Peers, peer.nodeId)
+	}
+	if !bytes.Equal(state.Key, saver.nodeKey) {
+		t.Fatalf("persisted node key mismatch.")
+	}
+	// Restart into a different network id (invisible to the bootstrappers) and
+	// ensure the persisted peer is reconnected
+	config.PastryStateFile = filepath.Join(dir, "state")
+	restart := New(appId+".restart", key, new(nopCallback))
+	config.PastryStateFile = ""
+
+	if restart.nodeId.Cmp(saver.nodeId) != 0 {
+		t.Fatalf("restarted node id mismatch: have %v, want %v.", restart.nodeId, saver.nodeId)
+	}
+	if peers, err := restart.Boot(); err != nil {
+		t.Fatalf("failed to boot restarted node: %v.", err)
+	} else if peers != 1 {
+		t.Fatalf("restarted peer count mismatch: have %v, want %v.", peers, 1)
+	}
+	defer restart.Shutdown()
+}
+
+// Tests that separate state files keep separate node identities, each adopted
+// again when reopened.
+func TestPersistIdentity(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	dir, err := ioutil.TempDir("", "pastry-state")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create two nodes persisting into different files
+	first, second := New(appId, key, new(nopCallback)), New(appId, key, new(nopCallback))
+	if err := first.SetStateFile(filepath.Join(dir, "state")); err != nil {
+		t.Fatalf("failed to set first state file: %v.", err)
+	}
+	if err := second.SetStateFile(filepath.Join(dir, "state.1")); err != nil {
+		t.Fatalf("failed to set second state file: %v.", err)
+	}
+	if first.nodeId.Cmp(second.nodeId) == 0 {
+		t.Fatalf("separate state files share node id: %v.", first.nodeId)
+	}
+	// Reopen the files in swapped order and ensure the identities follow them
+	swapped := New(appId, key, new(nopCallback))
+	if err := swapped.SetStateFile(filepath.Join(dir, "state.1")); err != nil {
+		t.Fatalf("failed to reopen second state file: %v.", err)
+	}
+	if swapped.nodeId.Cmp(second.nodeId) != 0 {
+		t.Fatalf("reopened node id mismatch: have %v, want %v.", swapped.nodeId, second.nodeId)
+	}
+	if err := swapped.SetStateFile(filepath.Join(dir, "state")); err != nil {
+		t.Fatalf("failed to reopen first state file: %v.", err)
+	}
+	if swapped.nodeId.Cmp(first.nodeId) != 0 {
+		t.Fatalf("reopened node id mismatch: have %v, want %v.", swapped.nodeId, first.nodeId)
+	}
+	// Ensure the node key is sealed, and cannot be adopted with another cluster key
+	data, err := ioutil.ReadFile(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("failed to read state file: %v.", err)
+	}
+	if bytes.Contains(data, first.nodeKey) {
+		t.Fatalf("node key persisted in the clear.")
+	}
+	bad, _ := x509.ParsePKCS1PrivateKey(privKeyDerBad)
+	if err := New(appId, bad, new(nopCallback)).SetStateFile(filepath.Join(dir, "state")); err == nil {
+		t.Fatalf("state file opened with a foreign cluster key.")
+	}
+}
+
+// Tests that persisted peers are retained until they expire, and that the most
+// recently seen ones are kept when trimming.
+func TestPersistWarmStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pastry-state")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v.", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	o := New(appId, key, new(nopCallback))
+	if err := o.SetStateFile(filepath.Join(dir, "state")); err != nil {
+		t.Fatalf("failed to set state file: %v.", err)
+	}
+	// Save a few peers from a previous run: a recent, an expired and a legacy one
+	now := time.Now()
+	old := &persisted{
+		Key: o.nodeKey,
+		Peers: map[string][]string{
+			"1": {"10.0.0.1:1"},
+			"2": {"10.0.0.2:1"},
+			"3": {"10.0.0.3:1"},
+		},
+		Seen: map[string]int64{
+			"1": now.Add(-time.Hour).UnixNano(),
+			"2": now.Add(-2 * config.PastryStateExpiry).UnixNano(),
+		},
+	}
+	if err := save(o.vault(), filepath.Join(dir, "state"), old); err != nil {
+		t.Fatalf("failed to save previous state: %v.", err)
+	}
+	if ids := old.order(); len(ids) != 3 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("peer order mismatch: have %v, want [1 2 3].", ids)
+	}
+	if !old.fresh("1", now) || old.fresh("2", now) || !old.fresh("3", now) {
+		t.Fatalf("peer freshness mismatch.")
+	}
+	// Persist a live routing state and verify that only the recent peer is retained
+	live := big.NewInt(4)
+	o.routes.leaves = append(o.routes.leaves, live)
+	o.livePeers[live.String()] = &peer{nodeId: live, addrs: []string{"10.0.0.4:1"}}
+	o.persist()
+
+	state, err := load(o.vault(), filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("failed to load persisted state: %v.", err)
+	}
+	if len(state.Peers) != 2 || state.Peers["1"] == nil || state.Peers["4"] == nil {
+		t.Fatalf("persisted peers mismatch: have %v, want [1 4].", state.Peers)
+	}
+	if seen := time.Unix(0, state.Seen["4"]); seen.Before(now) {
+		t.Fatalf("live peer last-seen mismatch: have %v, want after %v.", seen, now)
+	}
+	// Trimming should keep the most recently seen peers
+	state.trim(1)
+	if len(state.Peers) != 1 || state.Peers["4"] == nil || len(state.Seen) != 1 {
+		t.Fatalf("trimmed peers mismatch: have %v, want [4].", state.Peers)
+	}
+}
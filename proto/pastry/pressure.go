@@ -0,0 +1,220 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the backpressure signaling: peers whose outbound data queues fill up
+// beyond a threshold mark the local node congested, which in turn asks all its
+// peers (the upstream senders) to hold back their producers for a while. The
+// signals expire on their own, so they are repeated while congested.
+//
+// Past that, the node sheds load: bulk messages in transit (routed through, not
+// originated by the local node) are dropped while the node is overloaded, i.e.
+// its heartbeats are scheduled late (CPU saturated) or the bulk queue towards the
+// next hop is nearly full. Interactive transit traffic is merely deferred behind
+// the queues, so an overloaded node degrades predictably instead of collapsing.
+
+package pastry
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Backpressure state of the local node.
+type pressure struct {
+	congested map[*peer]struct{} // Peers with their outbound queues over the threshold
+	throttled time.Time          // Time until a remote peer requested backpressure
+	expiry    *time.Timer        // Timer lifting the remote backpressure request
+
+	relief   chan struct{} // Channel closed while the node is not under pressure
+	relieved bool          // Whether the relief channel is closed
+	signaled time.Time     // Time of the last throttle signal sent out
+	signal   func()        // Callback to ask the peers to slow down
+
+	beat       time.Time // Time of the last heartbeat, measuring the scheduling lag
+	overloaded bool      // Whether the heartbeats are scheduled too late
+	shed       uint64    // Number of transit messages shed (atomic)
+
+	lock sync.Mutex
+}
+
+// Creates a new, relieved backpressure tracker.
+func newPressure(signal func()) *pressure {
+	relief := make(chan struct{})
+	close(relief)
+
+	return &pressure{
+		congested: make(map[*peer]struct{}),
+		relief:    relief,
+		relieved:  true,
+		signal:    signal,
+	}
+}
+
+// Re-evaluates the congestion of a peer's outbound data queues, with hysteresis
+// between the high and low watermarks. Trackerless peers are ignored.
+func (pr *pressure) update(p *peer) {
+	if pr == nil {
+		return
+	}
+	fill := len(p.inter)
+	if len(p.bulk) > fill {
+		fill = len(p.bulk)
+	}
+	ratio := float64(fill) / float64(config.PastryNetBuffer)
+
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	_, was := pr.congested[p]
+	switch {
+	case !was && ratio >= config.PastryPressureHigh:
+		pr.congested[p] = struct{}{}
+	case was && ratio <= config.PastryPressureLow:
+		delete(pr.congested, p)
+	}
+	pr.refresh()
+
+	// Keep throttling the peers while congested
+	if len(pr.congested) > 0 && time.Since(pr.signaled) > config.PastryThrottleSpan/2 {
+		pr.signaled = time.Now()
+		go pr.signal()
+	}
+}
+
+// Removes a peer from the congested set, e.g. when its connection is torn down.
+func (pr *pressure) release(p *peer) {
+	if pr == nil {
+		return
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	delete(pr.congested, p)
+	pr.refresh()
+}
+
+// Registers a backpressure request from a remote peer, holding back the local
+// producers for the configured span.
+func (pr *pressure) throttle() {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	pr.throttled = time.Now().Add(config.PastryThrottleSpan)
+	if pr.expiry == nil {
+		pr.expiry = time.AfterFunc(config.PastryThrottleSpan, pr.expire)
+	} else {
+		pr.expiry.Reset(config.PastryThrottleSpan)
+	}
+	pr.refresh()
+}
+
+// Re-evaluates the pressure after a remote backpressure request expired.
+func (pr *pressure) expire() {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	pr.refresh()
+}
+
+// Measures the scheduling lag of a heartbeat, marking the node overloaded (and
+// throttling the peers) if it's above the threshold.
+func (pr *pressure) sample(now time.Time) {
+	if pr == nil {
+		return
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	lag := time.Duration(0)
+	if !pr.beat.IsZero() {
+		lag = now.Sub(pr.beat) - config.PastryBeatPeriod
+	}
+	pr.beat = now
+
+	overloaded := config.PastryShedLag > 0 && lag >= config.PastryShedLag
+	if overloaded && !pr.overloaded {
+		log.Printf("pastry: heartbeat lagging %v, shedding bulk transit traffic.", lag)
+	}
+	pr.overloaded = overloaded
+	pr.refresh()
+
+	if overloaded && time.Since(pr.signaled) > config.PastryThrottleSpan/2 {
+		pr.signaled = time.Now()
+		go pr.signal()
+	}
+}
+
+// Checks whether a bulk transit message towards a peer should be shed, counting
+// it if so.
+func (pr *pressure) shedding(p *peer) bool {
+	if pr == nil {
+		return false
+	}
+	pr.lock.Lock()
+	shed := pr.overloaded
+	pr.lock.Unlock()
+
+	if !shed && config.PastryShedLevel > 0 {
+		shed = float64(len(p.bulk)) >= config.PastryShedLevel*float64(config.PastryNetBuffer)
+	}
+	if shed {
+		atomic.AddUint64(&pr.shed, 1)
+	}
+	return shed
+}
+
+// Opens or closes the relief channel according to the current pressure. The
+// lock is assumed held.
+func (pr *pressure) refresh() {
+	pressured := len(pr.congested) > 0 || pr.overloaded || time.Now().Before(pr.throttled)
+	switch {
+	case pressured && pr.relieved:
+		pr.relief, pr.relieved = make(chan struct{}), false
+	case !pressured && !pr.relieved:
+		close(pr.relief)
+		pr.relieved = true
+	}
+}
+
+// Returns a channel which is closed once neither the local node is congested or
+// overloaded, nor any of its peers requested backpressure (or already closed if
+// so).
+func (o *Overlay) Relief() <-chan struct{} {
+	o.press.lock.Lock()
+	defer o.press.lock.Unlock()
+
+	return o.press.relief
+}
+
+// Asks all the connected peers to slow down their data traffic.
+func (o *Overlay) sendThrottles() {
+	o.lock.RLock()
+	peers := make([]*peer, 0, len(o.livePeers))
+	for _, p := range o.livePeers {
+		peers = append(peers, p)
+	}
+	o.lock.RUnlock()
+
+	for _, p := range peers {
+		o.sendThrottle(p)
+	}
+}
@@ -0,0 +1,77 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that lagging heartbeats and nearly full bulk queues make the node shed
+// transit traffic and hold back the producers, until the overload subsides.
+func TestLoadShedding(t *testing.T) {
+	signals := make(chan struct{}, 16)
+	pr := newPressure(func() { signals <- struct{}{} })
+
+	p := &peer{bulk: make(chan *proto.Message, config.PastryNetBuffer)}
+
+	// Punctual heartbeats should not shed anything
+	now := time.Now()
+	pr.sample(now)
+	pr.sample(now.Add(config.PastryBeatPeriod))
+	if pr.shedding(p) {
+		t.Fatalf("punctual node shedding.")
+	}
+	// A lagging heartbeat should trigger shedding and backpressure
+	now = now.Add(config.PastryBeatPeriod)
+	pr.sample(now.Add(config.PastryBeatPeriod + config.PastryShedLag))
+	if !pr.shedding(p) {
+		t.Fatalf("overloaded node not shedding.")
+	}
+	select {
+	case <-pr.relief:
+		t.Fatalf("overloaded node relieved.")
+	default:
+	}
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatalf("overloaded node didn't throttle its peers.")
+	}
+	// Recovering should lift the shedding
+	now = now.Add(config.PastryBeatPeriod + config.PastryShedLag)
+	pr.sample(now.Add(config.PastryBeatPeriod))
+	if pr.shedding(p) {
+		t.Fatalf("recovered node shedding.")
+	}
+	// A nearly full bulk queue should shed the traffic towards it
+	for float64(len(p.bulk)) < config.PastryShedLevel*float64(config.PastryNetBuffer) {
+		p.bulk <- new(proto.Message)
+	}
+	if !pr.shedding(p) {
+		t.Fatalf("full bulk queue not shed.")
+	}
+	if shed := atomic.LoadUint64(&pr.shed); shed != 2 {
+		t.Fatalf("shed message count mismatch: have %v, want %v.", shed, 2)
+	}
+}
@@ -22,8 +22,12 @@ package pastry
 
 import (
 	"encoding/gob"
+	"log"
 	"math/big"
+	"sync/atomic"
+	"time"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
 )
 
@@ -32,19 +36,33 @@ type opcode uint8
 
 // Pastry operation types.
 const (
-	opNop     opcode = iota // Application layer message
-	opJoin                  // Join request
-	opRepair                // Routing table repair request
-	opActive                // Heartbeat for an active peer
-	opPassive               // Heartbeat for a passive peer
-	opExchage               // Pastry state exchange
-	opClose                 // Leave request
+	opNop      opcode = iota // Application layer message
+	opJoin                   // Join request
+	opRepair                 // Routing table repair request
+	opActive                 // Heartbeat for an active peer
+	opPassive                // Heartbeat for a passive peer
+	opExchage                // Pastry state exchange
+	opClose                  // Leave request
+	opThrottle               // Backpressure request
+	opProbe                  // Latency measurement request
+	opProbed                 // Latency measurement reply
+	opMerge                  // Partition check and merge request
+	opTrace                  // Route trace probe
+	opTraced                 // Route trace path returning to the origin
+	opLeave                  // Departure announcement
+	opLeft                   // Departure acknowledgement
+	opRow                    // Routing table row request (background optimization)
+	opRowed                  // Routing table row reply
+	opCast                   // Prefix multicast message
 )
 
 // Routing state exchange message.
 type state struct {
 	Addrs   map[string][]string // Known peers and their network addresses
 	Version uint64              // Version counter to skip old messages
+	Info    map[string]string   // Metadata advertised by the sender
+	Bridge  bool                // Whether the sender relays to the listed nodes
+	Pack    []byte              // Compressed peer addresses, replacing Addrs (batched exchanges)
 }
 
 // Extra headers for the overlay.
@@ -53,6 +71,11 @@ type header struct {
 	Op    opcode      // The operation to execute
 	Dest  *big.Int    // Destination id
 	State *state      // Routing table state exchange
+	Stamp int64       // Latency probe timestamp (nanoseconds)
+	Beat  int         // Heartbeat interval of the sender (beat periods, 0 = one)
+	Trace *trace      // Route trace path collected so far
+	Row   int         // Routing table row requested (background optimization) or multicast split level
+	Span  int         // Multicast prefix length in bits
 }
 
 // Make sure the header struct is registered with gob.
@@ -85,7 +108,8 @@ func (o *Overlay) sendPacket(dest *peer, head *header) {
 // network addresses, sending it towards the destination node.
 func (o *Overlay) sendJoin(dest *peer) {
 	state := &state{
-		Addrs: map[string][]string{o.nodeId.String(): o.addrs},
+		Addrs: map[string][]string{o.nodeId.String(): o.advertised()},
+		Info:  o.meta,
 	}
 	o.sendPacket(dest, &header{Op: opJoin, Dest: o.nodeId, State: state})
 }
@@ -96,51 +120,132 @@ func (o *Overlay) sendRepair(dest *peer) {
 	o.sendPacket(dest, &header{Op: opRepair, Dest: o.nodeId})
 }
 
+// Assembles a routing table row request, asking the destination node for its
+// entries of the given row.
+func (o *Overlay) sendRow(dest *peer, row int) {
+	o.sendPacket(dest, &header{Op: opRow, Dest: dest.nodeId, Row: row})
+}
+
+// Assembles a routing table row reply, sending the requested row of the local
+// routing table back to the tuning node.
+func (o *Overlay) sendRowed(dest *peer, row int) {
+	o.sendPacket(dest, &header{Op: opRowed, Dest: dest.nodeId, State: o.rowState(row)})
+}
+
 // Assembles an overlay heartbeat message, consisting of the beat opcode and
 // tagged whether the connection is an active route entry or not, sending it
-// towards the destination node.
-func (o *Overlay) sendBeat(dest *peer, passive bool) {
+// towards the destination node alongside the interval of the next beat.
+func (o *Overlay) sendBeat(dest *peer, passive bool, stretch int) {
 	if passive {
-		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId})
+		o.sendPacket(dest, &header{Op: opPassive, Dest: dest.nodeId, Beat: stretch})
 	} else {
-		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId})
+		o.sendPacket(dest, &header{Op: opActive, Dest: dest.nodeId, Beat: stretch})
+	}
+}
+
+// Assembles an overlay throttle message, consisting of the throttle opcode,
+// asking the destination node to hold back its producers for a while.
+func (o *Overlay) sendThrottle(dest *peer) {
+	o.sendPacket(dest, &header{Op: opThrottle, Dest: dest.nodeId})
+}
+
+// Assembles an overlay latency probe, consisting of the probe opcode and the
+// local send time, which the destination node echoes back.
+func (o *Overlay) sendProbe(dest *peer) {
+	o.proxim.probe(dest.nodeId)
+	o.sendPacket(dest, &header{Op: opProbe, Dest: dest.nodeId, Stamp: time.Now().UnixNano()})
+}
+
+// Assembles an overlay latency probe reply, echoing the received timestamp back
+// to the probing node.
+func (o *Overlay) sendProbed(dest *peer, stamp int64) {
+	o.sendPacket(dest, &header{Op: opProbed, Dest: dest.nodeId, Stamp: stamp})
+}
+
+// Assembles an overlay merge request, consisting of the merge opcode and the
+// network addresses of a node found outside the overlay, sending it towards the
+// node's id.
+func (o *Overlay) sendMerge(dest *peer, id *big.Int, addrs []string) {
+	state := &state{
+		Addrs: map[string][]string{id.String(): addrs},
 	}
+	o.sendPacket(dest, &header{Op: opMerge, Dest: id, State: state})
+}
+
+// Assembles an overlay route trace probe, consisting of the trace opcode and the
+// path collected so far, sending it towards the traced destination.
+func (o *Overlay) sendTrace(dest *peer, id *big.Int, t *trace) {
+	o.sendPacket(dest, &header{Op: opTrace, Dest: id, Trace: t})
+}
+
+// Assembles an overlay route trace reply, consisting of the traced opcode and
+// the full path, sending it back towards the origin of the trace.
+func (o *Overlay) sendTraced(dest *peer, t *trace) {
+	o.sendPacket(dest, &header{Op: opTraced, Dest: t.Origin, Trace: t})
 }
 
 // Assembles an overlay state message, consisting of the exchange opcode, the
 // current version of the routing table and the peer addresses deemed needed,
-// sending it towards the destination.
+// sending it towards the destination. Joining peers are sent all the rows up to
+// the common prefix once, and large peer lists are compressed if supported.
 func (o *Overlay) sendState(dest *peer) {
 	o.lock.RLock()
 
 	s := &state{
 		Addrs:   make(map[string][]string),
 		Version: o.time,
+		Info:    o.meta,
+		Bridge:  o.bridge,
 	}
 
 	// Serialize our own addresses, the leaf set and common row
-	s.Addrs[o.nodeId.String()] = o.addrs
+	s.Addrs[o.nodeId.String()] = o.advertised()
 	for _, id := range o.routes.leaves {
 		sid := id.String()
-		if node, ok := o.livePeers[sid]; ok {
+		if node, ok := o.livePeers[sid]; ok && !node.inbound() {
 			s.Addrs[sid] = node.addrs
 		}
 	}
 	idx, _ := prefix(o.nodeId, dest.nodeId)
-	for _, id := range o.routes.routes[idx] {
-		if id != nil {
-			sid := id.String()
-			if node, ok := o.livePeers[sid]; ok {
-				s.Addrs[sid] = node.addrs
+	rows := o.routes.routes[idx : idx+1]
+	if atomic.CompareAndSwapUint32(&dest.rows, 1, 2) {
+		rows = o.routes.routes[:idx+1]
+	}
+	for _, row := range rows {
+		for _, id := range row {
+			if id != nil {
+				sid := id.String()
+				if node, ok := o.livePeers[sid]; ok && !node.inbound() {
+					s.Addrs[sid] = node.addrs
+				}
 			}
 		}
 	}
 	o.lock.RUnlock()
 
+	// Compress the peer list if large enough and the remote side supports it
+	if dest.pack && len(s.Addrs) >= config.PastryStatePack {
+		if err := s.pack(); err != nil {
+			log.Printf("pastry: failed to pack state exchange: %v.", err)
+		}
+	}
+
 	// Send the state exchange
 	o.sendPacket(dest, &header{Op: opExchage, Dest: dest.nodeId, State: s})
 }
 
+// Assembles an overlay departure announcement, consisting of the leave opcode
+// and the routing state of the departing node, sending it towards a peer.
+func (o *Overlay) sendLeave(dest *peer, s *state) {
+	o.sendPacket(dest, &header{Op: opLeave, Dest: dest.nodeId, State: s})
+}
+
+// Assembles an overlay departure acknowledgement, consisting of the left opcode,
+// notifying a departing peer that it's not routed through any more.
+func (o *Overlay) sendLeft(dest *peer) {
+	o.sendPacket(dest, &header{Op: opLeft, Dest: dest.nodeId})
+}
+
 // Assembles an overlay leave message, consisting of the close opcode and sends
 // it towards the destination.
 func (o *Overlay) sendClose(dest *peer) {
@@ -0,0 +1,242 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the proximity neighbor selection (PNS): round trip times and probe loss
+// rates are measured to every connected peer (periodically, alongside the heart-
+// beats, also exposed to the upper layers), and nodes
+// learned through state exchanges that compete for an already occupied routing
+// table slot are dialed just to be measured. Slots are then handed to the node
+// closest in network terms, so that hops traverse nearby machines. Measurements
+// of disconnected nodes are forgotten periodically, re-optimizing the table.
+
+package pastry
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Latency measurements of the remote nodes.
+type proximity struct {
+	rtts  map[string]time.Duration // Smoothed round trip times of measured nodes
+	loss  map[string]float64       // Smoothed probe loss rates of measured nodes
+	pend  map[string]struct{}      // Nodes with a latency probe in flight
+	tried map[string]struct{}      // Candidates already dialed for measurement
+	lock  sync.Mutex
+}
+
+// Creates a new, empty latency tracker.
+func newProximity() *proximity {
+	return &proximity{
+		rtts:  make(map[string]time.Duration),
+		loss:  make(map[string]float64),
+		pend:  make(map[string]struct{}),
+		tried: make(map[string]struct{}),
+	}
+}
+
+// Registers a latency probe sent to a node, counting the previous one lost if it
+// is still unanswered.
+func (p *proximity) probe(id *big.Int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sid := id.String()
+	if _, ok := p.pend[sid]; ok {
+		p.loss[sid] += (1 - p.loss[sid]) / 8
+	}
+	p.pend[sid] = struct{}{}
+}
+
+// Folds a new round trip time sample into the smoothed estimate of a node, also
+// counting the probe as delivered.
+func (p *proximity) observe(id *big.Int, rtt time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sid := id.String()
+	if old, ok := p.rtts[sid]; ok {
+		rtt = old + (rtt-old)/8
+	}
+	p.rtts[sid] = rtt
+
+	if _, ok := p.pend[sid]; ok {
+		delete(p.pend, sid)
+		p.loss[sid] -= p.loss[sid] / 8
+	}
+}
+
+// Retrieves the smoothed round trip time of a node, if measured already.
+func (p *proximity) latency(id *big.Int) (time.Duration, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rtt, ok := p.rtts[id.String()]
+	return rtt, ok
+}
+
+// Retrieves the smoothed probe loss rate of a node (zero if none lost yet).
+func (p *proximity) lost(id *big.Int) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.loss[id.String()]
+}
+
+// Checks whether a candidate node needs to be dialed for measurement, marking it
+// as tried if so (preventing repeated dials until the next forget).
+func (p *proximity) attempt(id *big.Int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sid := id.String()
+	if _, ok := p.rtts[sid]; ok {
+		return false
+	}
+	if _, ok := p.tried[sid]; ok {
+		return false
+	}
+	p.tried[sid] = struct{}{}
+	return true
+}
+
+// Forgets the measurements of all nodes not connected any more, and resets the
+// tried candidates, allowing them to be measured anew.
+func (p *proximity) forget(live map[string]*peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for id, _ := range p.rtts {
+		if _, ok := live[id]; !ok {
+			delete(p.rtts, id)
+		}
+	}
+	for id, _ := range p.loss {
+		if _, ok := live[id]; !ok {
+			delete(p.loss, id)
+		}
+	}
+	for id, _ := range p.pend {
+		if _, ok := live[id]; !ok {
+			delete(p.pend, id)
+		}
+	}
+	p.tried = make(map[string]struct{})
+}
+
+// Checks whether node a is closer in network terms than node b by a margin large
+// enough to warrant replacing b in the routing table.
+func (p *proximity) closer(a, b *big.Int) bool {
+	rttA, okA := p.latency(a)
+	rttB, okB := p.latency(b)
+	if !okA || !okB {
+		return false
+	}
+	return float64(rttA) < float64(rttB)*(1-config.PastryProximityGain)
+}
+
+// Processes a latency probe reply, updating the measurements of the remote peer.
+// If the peer is not part of the routing state yet (i.e. a candidate dialed for
+// measurement), a routing table re-optimization is requested.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) measured(src *peer, stamp int64) {
+	o.proxim.observe(src.nodeId, time.Since(time.Unix(0, stamp)))
+	if !o.active(src.nodeId) {
+		o.lock.RUnlock()
+		o.reoptimize()
+		o.lock.RLock()
+	}
+}
+
+// Requests the manager to re-optimize the routing table for network proximity.
+func (o *Overlay) reoptimize() {
+	o.eventLock.Lock()
+	o.optReq = true
+	o.eventLock.Unlock()
+
+	// Wake the manager if blocking
+	select {
+	case o.eventNotify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
+
+// Collects the nodes learned through state exchanges, which compete for a slot
+// already occupied in routing table t, but were never measured yet.
+func (o *Overlay) candidates(t *table, addrs map[string][]string) []*big.Int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	ids := []*big.Int{}
+	for sid, _ := range addrs {
+		if _, ok := o.livePeers[sid]; ok {
+			continue
+		}
+		id, ok := new(big.Int).SetString(sid, 10)
+		if !ok || id.Cmp(o.nodeId) == 0 {
+			continue
+		}
+		row, col := prefix(o.nodeId, id)
+		if old := t.routes[row][col]; old != nil && old.Cmp(id) != 0 && o.proxim.attempt(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Hands the routing table slots of t over to connected peers measured to be
+// substantially closer in network terms than the current entries, bidirectional
+// links always winning over one-way ones.
+func (o *Overlay) optimize(t *table) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	for _, p := range o.livePeers {
+		row, col := prefix(o.nodeId, p.nodeId)
+		if old := t.routes[row][col]; old != nil && old.Cmp(p.nodeId) != 0 {
+			// Prefer bidirectional links, falling back to proximity among equals
+			oneway := false
+			if q, ok := o.livePeers[old.String()]; ok {
+				oneway = q.inbound()
+			}
+			switch {
+			case p.inbound() && !oneway:
+				continue
+			case !p.inbound() && oneway:
+				t.routes[row][col] = p.nodeId
+			case o.proxim.closer(p.nodeId, old):
+				t.routes[row][col] = p.nodeId
+			}
+		}
+	}
+}
+
+// Retrieves the measured round trip time and probe loss rate of a connected peer,
+// consumed by the upper layers (e.g. balancers) and monitoring.
+func (o *Overlay) Proximity(id *big.Int) (time.Duration, float64, bool) {
+	rtt, ok := o.proxim.latency(id)
+	if !ok {
+		return 0, 0, false
+	}
+	return rtt, o.proxim.lost(id), true
+}
@@ -0,0 +1,173 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that routing table slots are only handed over to candidates measured to
+// be substantially closer than the current entries.
+func TestProximitySelection(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+
+	// Create a few nodes competing for the same routing table slot
+	base := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-config.PastryBase))
+	cur := new(big.Int).Add(base, big.NewInt(1))
+	near := new(big.Int).Add(base, big.NewInt(2))
+	far := new(big.Int).Add(base, big.NewInt(3))
+
+	row, col := prefix(o.nodeId, cur)
+	for _, id := range []*big.Int{near, far} {
+		if r, c := prefix(o.nodeId, id); r != row || c != col {
+			t.Fatalf("slot mismatch: have %v/%v, want %v/%v.", r, c, row, col)
+		}
+	}
+	routes := o.routes.copy()
+	routes.routes[row][col] = cur
+	for _, id := range []*big.Int{cur, near, far} {
+		o.livePeers[id.String()] = &peer{nodeId: id}
+	}
+	// Unmeasured and marginally closer candidates must not replace the entry
+	o.proxim.observe(cur, 10*time.Millisecond)
+	o.optimize(routes)
+	if routes.routes[row][col] != cur {
+		t.Fatalf("unmeasured candidate selected: have %v, want %v.", routes.routes[row][col], cur)
+	}
+	o.proxim.observe(far, 9*time.Millisecond)
+	o.optimize(routes)
+	if routes.routes[row][col] != cur {
+		t.Fatalf("marginal candidate selected: have %v, want %v.", routes.routes[row][col], cur)
+	}
+	// A substantially closer candidate must take over the slot
+	o.proxim.observe(near, 2*time.Millisecond)
+	o.optimize(routes)
+	if routes.routes[row][col] != near {
+		t.Fatalf("closer candidate rejected: have %v, want %v.", routes.routes[row][col], near)
+	}
+	// Only unmeasured competitors of occupied slots should be probed, once
+	other := new(big.Int).Add(base, big.NewInt(4))
+	addrs := map[string][]string{cur.String(): nil, other.String(): nil}
+	if ids := o.candidates(routes, addrs); len(ids) != 1 || ids[0].Cmp(other) != 0 {
+		t.Fatalf("probe candidates mismatch: have %v, want %v.", ids, []*big.Int{other})
+	}
+	if ids := o.candidates(routes, addrs); len(ids) != 0 {
+		t.Fatalf("candidate probed twice: have %v, want none.", ids)
+	}
+	// Forgetting should drop the departed nodes and allow probing again
+	delete(o.livePeers, far.String())
+	o.proxim.forget(o.livePeers)
+	if _, ok := o.proxim.latency(far); ok {
+		t.Fatalf("departed node measurement retained.")
+	}
+	if _, ok := o.proxim.latency(near); !ok {
+		t.Fatalf("connected node measurement lost.")
+	}
+	if ids := o.candidates(routes, addrs); len(ids) != 1 {
+		t.Fatalf("probe candidates mismatch after forget: have %v, want %v.", len(ids), 1)
+	}
+}
+
+// Tests that the latencies to the connected peers get measured, and the traffic
+// of their sessions accounted for.
+func TestProximityMeasure(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers := 3
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Verify that all peers have been measured
+	for i, node := range nodes {
+		snap := node.Inspect()
+		if len(snap.Peers) != peers-1 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, len(snap.Peers), peers-1)
+		}
+		for _, p := range snap.Peers {
+			if p.Latency <= 0 {
+				t.Fatalf("node #%d: peer %v unmeasured.", i, p.Id)
+			}
+			if rtt, loss, ok := node.Proximity(p.Id); !ok || rtt <= 0 || loss < 0 || loss > 1 {
+				t.Fatalf("node #%d: peer %v proximity invalid: have %v/%v/%v.", i, p.Id, rtt, loss, ok)
+			}
+			if p.Session == nil || p.Session.FramesIn == 0 || p.Session.BytesOut == 0 {
+				t.Fatalf("node #%d: peer %v session traffic unaccounted: have %+v.", i, p.Id, p.Session)
+			}
+		}
+	}
+}
+
+// Tests that unanswered latency probes are counted as lost, and that answered
+// ones decay the loss rate again.
+func TestProximityLoss(t *testing.T) {
+	prox := newProximity()
+	id := big.NewInt(1)
+
+	// Answered probes should not be counted as lost
+	prox.probe(id)
+	prox.observe(id, time.Millisecond)
+	if loss := prox.lost(id); loss != 0 {
+		t.Fatalf("loss mismatch after answered probe: have %v, want 0.", loss)
+	}
+	// Consecutive unanswered probes should raise the loss rate
+	prox.probe(id)
+	prox.probe(id)
+	prox.probe(id)
+	high := prox.lost(id)
+	if high <= 0 || high >= 1 {
+		t.Fatalf("loss mismatch after lost probes: have %v, want in (0, 1).", high)
+	}
+	// A late reply should lower it again, but only once per probe
+	prox.observe(id, time.Millisecond)
+	prox.observe(id, time.Millisecond)
+	if loss := prox.lost(id); loss >= high || loss != high-high/8 {
+		t.Fatalf("loss mismatch after answered probe: have %v, want %v.", loss, high-high/8)
+	}
+	// Forgetting a disconnected node should drop its loss rate too
+	prox.forget(map[string]*peer{})
+	if loss := prox.lost(id); loss != 0 {
+		t.Fatalf("loss mismatch after forget: have %v, want 0.", loss)
+	}
+}
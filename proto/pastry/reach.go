@@ -0,0 +1,59 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the asymmetric reachability detection: nodes behind a NAT or firewall
+// can dial out, but cannot be dialed back. Whenever a remote peer connects, the
+// local node tries to reach its advertised listeners, and if none answer, marks
+// the link as one-way. Such peers are not re-advertised in the state exchanges
+// (nobody else could dial them, they connect out by themselves once learning of
+// the others), lose routing table slots to bidirectional competitors, and are
+// beaten every period, keeping their NAT mappings fresh instead of stretching the
+// silence until the link drops and flaps.
+
+package pastry
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Checks whether an inbound peer's advertised listeners can be reached, marking
+// the link one-way if none of them answer.
+func (o *Overlay) dialBack(p *peer) {
+	for _, address := range p.addrs {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil || overlay.BannedHost(addr.IP) {
+			continue
+		}
+		if conn, err := net.DialTimeout("tcp", addr.String(), config.PastryDialBackTimeout); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	log.Printf("pastry: peer %v unreachable from here, marking link one-way.", p.nodeId)
+	atomic.StoreUint32(&p.oneway, 1)
+}
+
+// Checks whether the remote peer can only be reached through its own session.
+func (p *peer) inbound() bool {
+	return atomic.LoadUint32(&p.oneway) == 1
+}
@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that peers with unreachable listeners are marked one-way, and that
+// reachable ones are not.
+func TestDialBack(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+
+	// Open a listener to dial back into, and find a closed port for the failure
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v.", err)
+	}
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v.", err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	// Verify the reachability detection
+	open := &peer{nodeId: big.NewInt(1), addrs: []string{unreachable, listener.Addr().String()}}
+	o.dialBack(open)
+	if open.inbound() {
+		t.Fatalf("reachable peer marked one-way.")
+	}
+	hidden := &peer{nodeId: big.NewInt(2), addrs: []string{unreachable}}
+	o.dialBack(hidden)
+	if !hidden.inbound() {
+		t.Fatalf("unreachable peer not marked one-way.")
+	}
+}
+
+// Tests that one-way links lose routing table slots to bidirectional ones, are
+// not re-advertised, and are beaten every period.
+func TestOneWayPreference(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+
+	// Create two nodes competing for the same routing table slot, the closer one-way
+	base := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-config.PastryBase))
+	twoway := new(big.Int).Add(base, big.NewInt(1))
+	oneway := new(big.Int).Add(base, big.NewInt(2))
+
+	row, col := prefix(o.nodeId, twoway)
+	routes := o.routes.copy()
+	routes.routes[row][col] = twoway
+
+	o.livePeers[twoway.String()] = &peer{nodeId: twoway, addrs: []string{"10.0.0.1:1"}}
+	o.livePeers[oneway.String()] = &peer{nodeId: oneway, addrs: []string{"10.0.0.2:1"}, oneway: 1}
+
+	o.proxim.observe(twoway, 10*time.Millisecond)
+	o.proxim.observe(oneway, time.Millisecond)
+	o.optimize(routes)
+	if routes.routes[row][col] != twoway {
+		t.Fatalf("one-way link preferred: have %v, want %v.", routes.routes[row][col], twoway)
+	}
+	// A bidirectional competitor should take over from a one-way entry regardless
+	routes.routes[row][col] = oneway
+	o.proxim.observe(twoway, 100*time.Millisecond)
+	o.optimize(routes)
+	if routes.routes[row][col] != twoway {
+		t.Fatalf("bidirectional link rejected: have %v, want %v.", routes.routes[row][col], twoway)
+	}
+	// Ensure the one-way peer is not advertised to others
+	o.routes = routes
+	routes.routes[row][col+1] = oneway
+	if s := o.rowState(row); len(s.Addrs[oneway.String()]) != 0 || len(s.Addrs[twoway.String()]) == 0 {
+		t.Fatalf("advertised peers mismatch: have %v.", s.Addrs)
+	}
+	// Ensure the one-way link is beaten every period
+	for i := 0; i < 2*config.PastryBeatCalm+2; i++ {
+		if due, stretch := o.pace(o.livePeers[oneway.String()]); !due || stretch != 1 {
+			t.Fatalf("beat #%d: pace mismatch: have %v/%v, want %v/%v.", i, due, stretch, true, 1)
+		}
+	}
+}
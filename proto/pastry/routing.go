@@ -18,7 +18,9 @@
 
 // This file contains the routing logic in the overlay network, which currently
 // is a simplified version of Pastry: the leafset and routing table is the same,
-// but no proximity metric is taken into consideration.
+// with the table slots filled by proximity neighbor selection, but there is no
+// neighborhood set. Upper layer messages for directly connected peers are sent
+// straight to them, bypassing the routing.
 //
 // Beside the above, it also contains the system event processing logic.
 
@@ -28,18 +30,92 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"sync/atomic"
 
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
 )
 
 // Pastry routing algorithm.
 func (o *Overlay) route(src *peer, msg *proto.Message) {
+	// Multicast messages are split along the routing table, not routed
+	head := msg.Head.Meta.(*header)
+	if head.Op == opCast {
+		o.cast(msg)
+		return
+	}
+	// Run the upper layer messages through the pre-routing hooks
+	var hop *overlay.Hop
+	before, after := o.hooks.Chains()
+	if head.Op == opNop && len(before)+len(after) > 0 {
+		hop = &overlay.Hop{Dest: head.Dest}
+		if src != nil {
+			hop.Src = src.nodeId
+		}
+		if !runHooks(before, msg, hop) {
+			return
+		}
+	}
 	// Sync the routing table
 	o.lock.RLock() // Note, unlock is in deliver and forward!!!
 
-	// Extract some vars for easier access
+	next, rule := o.nextHop(head.Dest, head.Op == opNop)
+	if hop != nil {
+		// Run the post-routing hooks outside the lock, might be slow
+		o.lock.RUnlock()
+		hop.Next, hop.Rule = next, rule
+		if !runHooks(after, msg, hop) {
+			return
+		}
+		o.lock.RLock()
+
+		// The routing state might have changed meanwhile, re-route if the hop died
+		if _, ok := o.hop(next); !ok && o.nodeId.Cmp(next) != 0 {
+			next, _ = o.nextHop(head.Dest, true)
+		}
+	}
+	// Deliver locally if self is the next hop, otherwise forward
+	if o.nodeId.Cmp(next) == 0 {
+		o.deliver(src, msg)
+	} else {
+		o.forward(src, msg, next)
+	}
+}
+
+// Picks the next hop towards a destination, alongside the rule that selected it,
+// reusing the cached decision of hot destinations. Weighted decisions depend on
+// the live measurements, so those are never cached. The method assumes the overlay
+// lock is held (at least for reading).
+func (o *Overlay) nextHop(dest *big.Int, direct bool) (*big.Int, string) {
+	if direct && o.metric != nil {
+		return o.resolveHop(dest, direct)
+	}
+	key := "i" + string(dest.Bytes())
+	if direct {
+		key = "d" + string(dest.Bytes())
+	}
+	if next, rule, ok := o.hops.lookup(key); ok {
+		return next, rule
+	}
+	next, rule := o.resolveHop(dest, direct)
+	o.hops.insert(key, next, rule)
+	return next, rule
+}
+
+// Resolves the next hop towards a destination from the routing state, alongside
+// the rule that selected it. The method assumes the overlay lock is held (at
+// least for reading).
+func (o *Overlay) resolveHop(dest *big.Int, direct bool) (*big.Int, string) {
 	tab := o.routes
-	dest := msg.Head.Meta.(*header).Dest
+
+	// Shortcut upper layer messages addressed precisely to a connected peer (e.g.
+	// replies to the node a request arrived from), skipping any middle hops
+	if direct {
+		if _, ok := o.livePeers[dest.String()]; ok {
+			return dest, overlay.RuleDirect
+		}
+	}
 
 	// Check the leaf set for direct delivery
 	// TODO: corner cases with if only handful of nodes?
@@ -52,40 +128,37 @@ func (o *Overlay) route(src *peer, msg *proto.Message) {
 				best, dist = leaf, d
 			}
 		}
-		// If self, deliver, otherwise forward
-		if o.nodeId.Cmp(best) == 0 {
-			o.deliver(src, msg)
-		} else {
-			o.forward(src, msg, best)
-		}
-		return
+		return best, overlay.RuleLeaf
 	}
-	// Check the routing table for indirect delivery
+	// Check the routing table for indirect delivery, weighing the alternatives
+	// of upper layer messages if a routing metric is configured
 	pre, col := prefix(o.nodeId, dest)
+	if direct && o.metric != nil {
+		if best := o.weigh(dest, pre, col); best != nil {
+			return best, overlay.RuleTable
+		}
+	}
 	if best := tab.routes[pre][col]; best != nil {
-		o.forward(src, msg, best)
-		return
+		return best, overlay.RuleTable
 	}
 	// Route to anybody closer than the local node
 	dist := Distance(o.nodeId, dest)
 	for _, peer := range tab.leaves {
 		if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-			o.forward(src, msg, peer)
-			return
+			return peer, overlay.RuleCloser
 		}
 	}
 	for _, row := range tab.routes {
 		for _, peer := range row {
 			if peer != nil {
 				if p, _ := prefix(peer, dest); p >= pre && Distance(peer, dest).Cmp(dist) < 0 {
-					o.forward(src, msg, peer)
-					return
+					return peer, overlay.RuleCloser
 				}
 			}
 		}
 	}
 	// Well, shit. Deliver locally and hope for the best.
-	o.deliver(src, msg)
+	return o.nodeId, overlay.RuleLocal
 }
 
 // Delivers a message to the application layer or processes it if a system message.
@@ -109,11 +182,13 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 	if head.Op != opNop {
 		// Overlay system message, process and forward
 		o.process(src, head)
-		p, ok := o.livePeers[id.String()]
+		p, ok := o.hop(id)
 		o.lock.RUnlock()
 
 		if ok {
 			o.send(msg, p)
+		} else {
+			o.park(msg, id)
 		}
 		return
 	}
@@ -122,16 +197,22 @@ func (o *Overlay) forward(src *peer, msg *proto.Message, id *big.Int) {
 	msg.Head.Meta = head.Meta
 	allow := o.app.Forward(msg, head.Dest)
 
-	// Forwarding was allowed, repack headers and send
+	// Forwarding was allowed, repack headers and send (shedding bulk transit
+	// traffic if overloaded)
 	if allow {
 		o.lock.RLock()
-		p, ok := o.livePeers[id.String()]
+		p, ok := o.hop(id)
 		o.lock.RUnlock()
 
+		if ok && src != nil && len(msg.Data) > config.PastryBulkThreshold && o.press.shedding(p) {
+			return
+		}
+		head.Meta = msg.Head.Meta
+		msg.Head.Meta = head
 		if ok {
-			head.Meta = msg.Head.Meta
-			msg.Head.Meta = head
 			o.send(msg, p)
+		} else {
+			o.park(msg, id)
 		}
 	}
 }
@@ -144,7 +225,13 @@ func (o *Overlay) process(src *peer, head *header) {
 	// Notify the heartbeat mechanism that source is alive
 	o.heart.heart.Ping(src.nodeId)
 
-	// Extract the remote id and state
+	// Extract the remote id and state, inflating batched peer lists
+	if head.State != nil && head.State.Pack != nil {
+		if err := head.State.unpack(); err != nil {
+			log.Printf("pastry: dropping invalid packed state from %v: %v.", src.nodeId, err)
+			return
+		}
+	}
 	remId, remState := head.Dest.String(), head.State
 
 	switch head.Op {
@@ -168,27 +255,30 @@ func (o *Overlay) process(src *peer, head *header) {
 		} else {
 			// Handshake should have already sent state, unless local isn't joined either
 			if o.stat != done {
-				o.stateExch.Schedule(func() { o.sendState(p) })
+				o.queueState(p)
 			}
 		}
 	case opRepair:
 		// Respond to any repair requests
-		o.stateExch.Schedule(func() { o.sendState(src) })
+		o.queueState(src)
 
 	case opActive:
 		// Ensure the peer is set to an active state
-		src.passive = false
+		o.paced(src, head.Beat)
+		atomic.StoreUint32(&src.passive, 0)
 
 	case opPassive:
 		// If remote connection reported passive after being already registered as
 		// such locally too, drop the connection.
-		if src.passive && !o.active(src.nodeId) {
+		o.paced(src, head.Beat)
+		if atomic.LoadUint32(&src.passive) == 1 && !o.active(src.nodeId) {
 			o.lock.RUnlock()
 			o.drop(src)
 			o.lock.RLock()
 		}
 	case opExchage:
-		// State update, merge into local if new
+		// State update, store the peer metadata and merge into local if new
+		src.advertise(remState)
 		if remState.Version > src.time {
 			src.time = remState.Version
 
@@ -203,6 +293,61 @@ func (o *Overlay) process(src *peer, head *header) {
 		o.drop(src)
 		o.lock.RLock()
 
+	case opThrottle:
+		// Remote side is congested, hold back the local producers
+		o.press.throttle()
+
+	case opProbe:
+		// Echo latency probes straight back to the measuring node
+		o.stateExch.Schedule(func() { o.sendProbed(src, head.Stamp) })
+
+	case opProbed:
+		// Probe returned, update the proximity measurements
+		o.measured(src, head.Stamp)
+
+	case opMerge:
+		// Partition check, merge if the destination is missing from the overlay
+		o.heal(head.Dest, remState.Addrs[remId])
+
+	case opTrace:
+		// Record the local hop, returning the path to the origin if the trace ends here
+		if next := o.traceHop(head.Trace, head.Dest); next.Cmp(o.nodeId) == 0 {
+			t := head.Trace
+			o.stateExch.Schedule(func() { o.returnTrace(t) })
+		}
+	case opTraced:
+		// Trace path returned, hand it to the tracer if it originated locally
+		if head.Dest.Cmp(o.nodeId) == 0 {
+			o.completeTrace(head.Trace)
+		}
+	case opLeave:
+		// Remote side is departing, route around it and merge in its neighbors
+		o.lock.RUnlock()
+		o.leave(src, remState)
+		o.lock.RLock()
+
+	case opLeft:
+		// Departure acknowledged, the remote side doesn't route through us any more
+		if o.left != nil {
+			select {
+			case o.left <- src:
+			default:
+			}
+		}
+
+	case opRow:
+		// Routing table row requested, send it back to the tuning node
+		row := head.Row
+		o.stateExch.Schedule(func() { o.sendRowed(src, row) })
+
+	case opRowed:
+		// Row arrived, merge it in if new nodes are listed (fill slots, find closer peers)
+		if o.unknown(remState) {
+			o.lock.RUnlock()
+			o.offer(remState)
+			o.lock.RLock()
+		}
+
 	default:
 		log.Printf("pastry: unknown system message: %+v", head)
 	}
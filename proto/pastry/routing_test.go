@@ -206,6 +206,84 @@ func TestRouting(t *testing.T) {
 	}
 }
 
+// Overlay callback app counting the forward requests and deliveries.
+type hopCounter struct {
+	hops   int32
+	delivs int32
+}
+
+func (h *hopCounter) Deliver(msg *proto.Message, key *big.Int) {
+	atomic.AddInt32(&h.delivs, 1)
+}
+
+func (h *hopCounter) Forward(msg *proto.Message, key *big.Int) bool {
+	atomic.AddInt32(&h.hops, 1)
+	return true
+}
+
+// Tests that messages addressed to directly connected peers are sent to them in
+// a single hop, without traversing the routing table.
+func TestDirectRouting(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers := 8
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	apps := make([]*hopCounter, peers)
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		apps[i] = new(hopCounter)
+		nodes[i] = New(appId, key, apps[i])
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Send a message between every pair of connected nodes, ensuring no middle hops
+	for i, src := range nodes {
+		for j, dst := range nodes {
+			src.lock.RLock()
+			_, ok := src.livePeers[dst.nodeId.String()]
+			src.lock.RUnlock()
+			if !ok {
+				continue
+			}
+			for _, app := range apps {
+				atomic.StoreInt32(&app.hops, 0)
+			}
+			delivs := atomic.LoadInt32(&apps[j].delivs)
+
+			msg := &proto.Message{Head: proto.Header{Meta: []byte{0x00}}, Data: []byte{0x00}}
+			msg.Encrypt()
+			src.Send(dst.nodeId, msg)
+			time.Sleep(50 * time.Millisecond)
+
+			if n := atomic.LoadInt32(&apps[j].delivs); n != delivs+1 {
+				t.Fatalf("%d -> %d: delivery count mismatch: have %v, want %v.", i, j, n, delivs+1)
+			}
+			hops := int32(0)
+			for _, app := range apps {
+				hops += atomic.LoadInt32(&app.hops)
+			}
+			if hops != 1 {
+				t.Fatalf("%d -> %d: forward count mismatch: have %v, want %v.", i, j, hops, 1)
+			}
+		}
+	}
+}
+
 func BenchmarkLatency1Byte(b *testing.B) {
 	benchmarkLatency(b, 1)
 }
@@ -394,3 +472,64 @@ func benchmarkThroughput(b *testing.B, block int) {
 	<-wait.quit
 	b.StopTimer()
 }
+
+// Tests that a network running with a non-default id space, routing base and
+// leaf set size still delivers every message.
+func TestRoutingGeometry(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	space, base, leaves := config.PastrySpace, config.PastryBase, config.PastryLeaves
+	defer func() { config.PastrySpace, config.PastryBase, config.PastryLeaves = space, base, leaves }()
+	config.PastrySpace, config.PastryBase, config.PastryLeaves = 20, 2, 2
+
+	nodeCount := 6
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < nodeCount; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Parse encryption key
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and ensure the routing state matches the geometry
+	apps := []*collector{}
+	nodes := []*Overlay{}
+	for i := 0; i < nodeCount; i++ {
+		apps = append(apps, &collector{delivs: []*proto.Message{}})
+		nodes = append(nodes, New(appId, key, apps[i]))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	for i, node := range nodes {
+		node.lock.RLock()
+		rows, cols := len(node.routes.routes), len(node.routes.routes[0])
+		node.lock.RUnlock()
+		if rows != 10 || cols != 4 {
+			t.Fatalf("node #%d: routing table size mismatch: have %vx%v, want %vx%v.", i, rows, cols, 10, 4)
+		}
+	}
+	// Route a message from each node to every other and verify delivery
+	for _, src := range nodes {
+		for _, dst := range nodes {
+			msg := &proto.Message{Data: []byte(src.nodeId.String() + dst.nodeId.String())}
+			msg.Encrypt()
+			src.Send(dst.nodeId, msg)
+		}
+	}
+	time.Sleep(time.Second)
+	for i := 0; i < nodeCount; i++ {
+		apps[i].lock.RLock()
+		if len(apps[i].delivs) != nodeCount {
+			t.Fatalf("app #%v: message count mismatch: have %v, want %v.", i, len(apps[i].delivs), nodeCount)
+		}
+		apps[i].lock.RUnlock()
+	}
+}
@@ -23,15 +23,26 @@
 package pastry
 
 import (
-	"io"
 	"math/big"
 
 	"github.com/project-iris/iris/config"
 )
 
-var modulo = new(big.Int).SetBit(new(big.Int), config.PastrySpace, 1)
-var posmid = new(big.Int).Rsh(modulo, 1)
-var negmid = new(big.Int).Mul(posmid, big.NewInt(-1))
+// Size of the circular id space. Derived on demand, since the number of bits
+// may be reconfigured at startup, after package initialization.
+func modulo() *big.Int {
+	return new(big.Int).SetBit(new(big.Int), config.PastrySpace, 1)
+}
+
+// Largest positive delta on the circular id space.
+func posmid() *big.Int {
+	return new(big.Int).Rsh(modulo(), 1)
+}
+
+// Largest negative delta on the circular id space.
+func negmid() *big.Int {
+	return new(big.Int).Neg(posmid())
+}
 
 // Special id slice implementing sort.Interface.
 type idSlice struct {
@@ -59,11 +70,14 @@ func (p idSlice) Swap(i, j int) {
 // Calculates the signed distance between two ids on the circular ID space
 func delta(a, b *big.Int) *big.Int {
 	d := new(big.Int).Sub(b, a)
+	mod := modulo()
+	pos := new(big.Int).Rsh(mod, 1)
+	neg := new(big.Int).Neg(pos)
 	switch {
-	case posmid.Cmp(d) < 0:
-		d.Sub(d, modulo)
-	case negmid.Cmp(d) > 0:
-		d.Add(d, modulo)
+	case pos.Cmp(d) < 0:
+		d.Sub(d, mod)
+	case neg.Cmp(d) > 0:
+		d.Add(d, mod)
 	}
 	return d
 }
@@ -88,19 +102,3 @@ func prefix(a, b *big.Int) (int, int) {
 	}
 	return p, int(d)
 }
-
-// Converts a string id into an overlay id.
-func Resolve(id string) *big.Int {
-	// Hash the textual id
-	h := config.PastryResolver()
-	io.WriteString(h, id)
-	sum := h.Sum(nil)
-
-	// Extract enough bits, and clear overflows
-	raw := sum[:(config.PastrySpace+7)/8]
-	for i := 0; i < len(raw)*8-config.PastrySpace; i++ {
-		raw[0] &= ^byte(1 << (7 - uint(i)))
-	}
-	// Return the new id
-	return new(big.Int).SetBytes(raw)
-}
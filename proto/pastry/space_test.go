@@ -19,10 +19,6 @@
 package pastry
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"hash"
 	"math/big"
 	"testing"
 
@@ -55,18 +51,18 @@ var spaceTests = []spaceTest{
 	{big.NewInt(262144), big.NewInt(65536), big.NewInt(-196608), big.NewInt(196608), config.PastrySpace/config.PastryBase - 5, 1},
 
 	// Circular wrapping
-	{new(big.Int).Sub(modulo, one), big.NewInt(0), big.NewInt(1), big.NewInt(1), 0, 0},
-	{big.NewInt(0), new(big.Int).Sub(modulo, one), big.NewInt(-1), big.NewInt(1), 0, 15},
-	{new(big.Int).Sub(modulo, one), big.NewInt(1), big.NewInt(2), big.NewInt(2), 0, 0},
-	{big.NewInt(1), new(big.Int).Sub(modulo, one), big.NewInt(-2), big.NewInt(2), 0, 15},
+	{new(big.Int).Sub(modulo(), one), big.NewInt(0), big.NewInt(1), big.NewInt(1), 0, 0},
+	{big.NewInt(0), new(big.Int).Sub(modulo(), one), big.NewInt(-1), big.NewInt(1), 0, 15},
+	{new(big.Int).Sub(modulo(), one), big.NewInt(1), big.NewInt(2), big.NewInt(2), 0, 0},
+	{big.NewInt(1), new(big.Int).Sub(modulo(), one), big.NewInt(-2), big.NewInt(2), 0, 15},
 
 	// Half splits
-	{big.NewInt(0), posmid, posmid, posmid, 0, 8},
-	{posmid, big.NewInt(0), negmid, posmid, 0, 0},
-	{big.NewInt(0), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), 0, 7},
-	{new(big.Int).Sub(posmid, one), big.NewInt(0), new(big.Int).Add(negmid, one), new(big.Int).Sub(posmid, one), 0, 0},
-	{big.NewInt(0), new(big.Int).Add(posmid, one), new(big.Int).Add(negmid, one), new(big.Int).Sub(posmid, one), 0, 8},
-	{new(big.Int).Add(posmid, one), big.NewInt(0), new(big.Int).Sub(posmid, one), new(big.Int).Sub(posmid, one), 0, 0},
+	{big.NewInt(0), posmid(), posmid(), posmid(), 0, 8},
+	{posmid(), big.NewInt(0), negmid(), posmid(), 0, 0},
+	{big.NewInt(0), new(big.Int).Sub(posmid(), one), new(big.Int).Sub(posmid(), one), new(big.Int).Sub(posmid(), one), 0, 7},
+	{new(big.Int).Sub(posmid(), one), big.NewInt(0), new(big.Int).Add(negmid(), one), new(big.Int).Sub(posmid(), one), 0, 0},
+	{big.NewInt(0), new(big.Int).Add(posmid(), one), new(big.Int).Add(negmid(), one), new(big.Int).Sub(posmid(), one), 0, 8},
+	{new(big.Int).Add(posmid(), one), big.NewInt(0), new(big.Int).Sub(posmid(), one), new(big.Int).Sub(posmid(), one), 0, 0},
 }
 
 func TestSpace(t *testing.T) {
@@ -83,47 +79,29 @@ func TestSpace(t *testing.T) {
 	}
 }
 
-type resolveTest struct {
-	hasher func() hash.Hash
-	bitlen int
-	text   string
-	id     []byte
-}
-
-var resolveTests = []resolveTest{
-	// Inter-byte boundaries
-	{md5.New, 8, "", []byte{0xd4}},
-	{md5.New, 16, "", []byte{0xd4, 0x1d}},
-	{md5.New, 24, "", []byte{0xd4, 0x1d, 0x8c}},
-	{md5.New, 8, "string", []byte{0xb4}},
-	{md5.New, 16, "string", []byte{0xb4, 0x5c}},
-	{md5.New, 24, "string", []byte{0xb4, 0x5c, 0xff}},
-
-	// Intra-byte boundaries
-	{md5.New, 1, "", []byte{0x00}},
-	{md5.New, 2, "", []byte{0x00}},
-	{md5.New, 3, "", []byte{0x04}},
-	{md5.New, 4, "", []byte{0x04}},
-	{md5.New, 5, "", []byte{0x14}},
-	{md5.New, 6, "", []byte{0x14}},
-	{md5.New, 7, "", []byte{0x54}},
-
-	// Other hashes
-	{sha1.New, 32, "", []byte{0xda, 0x39, 0xa3, 0xee}},
-	{sha256.New, 32, "", []byte{0xe3, 0xb0, 0xc4, 0x42}},
-}
-
-func TestResolve(t *testing.T) {
+// Tests that the id space arithmetic follows a geometry reconfigured after the
+// package was initialized (12 bit space with 3 bit digits).
+func TestSpaceReconfig(t *testing.T) {
 	// Save the previous config values
-	s, h := config.PastrySpace, config.PastryResolver
-	defer func() { config.PastrySpace, config.PastryResolver = s, h }()
+	s, b := config.PastrySpace, config.PastryBase
+	defer func() { config.PastrySpace, config.PastryBase = s, b }()
+
+	config.PastrySpace, config.PastryBase = 12, 3
 
-	// Run the tests
-	for i, tt := range resolveTests {
-		config.PastrySpace = tt.bitlen
-		config.PastryResolver = tt.hasher
-		if id := Resolve(tt.text); id.Cmp(new(big.Int).SetBytes(tt.id)) != 0 {
-			t.Errorf("test %d: resolution mismatch: have %v, want %v.", i, id.Bytes(), tt.id)
+	// Check wrap-around at the new modulo and the new digit layout
+	if d := delta(big.NewInt(4095), big.NewInt(1)); d.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("delta mismatch: have %v, want %v.", d, 2)
+	}
+	if d := Distance(big.NewInt(0), big.NewInt(2048)); d.Cmp(big.NewInt(2048)) != 0 {
+		t.Fatalf("distance mismatch: have %v, want %v.", d, 2048)
+	}
+	if p, d := prefix(big.NewInt(0), big.NewInt(0x0c0)); p != 1 || d != 3 {
+		t.Fatalf("prefix/digit mismatch: have %v/%v, want %v/%v.", p, d, 1, 3)
+	}
+	// Check that generated node ids fit into the space
+	for i := 0; i < 16; i++ {
+		if id := New(appId, nil, new(nopCallback)).nodeId; id.BitLen() > config.PastrySpace {
+			t.Fatalf("node id out of space: have %v bits, want at most %v.", id.BitLen(), config.PastrySpace)
 		}
 	}
 }
@@ -0,0 +1,65 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the convergence status reporting: the overlay is ready once it booted,
+// has no state exchanges pending merging and its leaf set settled down.
+
+package pastry
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Reports whether the local overlay considers itself converged, suitable for
+// readiness probes, so no traffic is routed to a node still joining.
+func (o *Overlay) Status() *overlay.Status {
+	o.eventLock.Lock()
+	pending := len(o.exchSet) + len(o.offerSet)
+	o.eventLock.Unlock()
+
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	status := &overlay.Status{
+		Phase:   overlay.PhaseBooting,
+		Peers:   len(o.livePeers),
+		Leaves:  len(o.routes.leaves) - 1,
+		Pending: pending,
+		Stable:  time.Since(o.leafTime),
+	}
+	select {
+	case <-o.stable:
+		status.Phase = overlay.PhaseConverged
+	default:
+	}
+	if o.left != nil {
+		status.Phase = overlay.PhaseLeaving
+	}
+	status.Ready = status.Phase == overlay.PhaseConverged && pending == 0 && status.Stable >= config.PastryConvTimeout
+
+	o.press.lock.Lock()
+	status.Shedding = o.press.overloaded
+	o.press.lock.Unlock()
+	status.Shed = atomic.LoadUint64(&o.press.shed)
+
+	return status
+}
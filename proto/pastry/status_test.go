@@ -0,0 +1,90 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that the convergence status reports a joining node as not ready and a
+// settled one as ready, and flags the departure on shutdown.
+func TestStatus(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	peers := 3
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Ensure a fresh node is not ready
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+	}
+	if status := nodes[0].Status(); status.Phase != overlay.PhaseBooting || status.Ready {
+		t.Fatalf("fresh node status mismatch: have %v/%v, want %v/%v.", status.Phase, status.Ready, overlay.PhaseBooting, false)
+	}
+	// Boot the nodes and wait for them to settle
+	for i := 0; i < peers; i++ {
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		if i > 0 {
+			defer nodes[i].Shutdown()
+		}
+	}
+	for i, node := range nodes {
+		if status := node.Status(); status.Phase != overlay.PhaseConverged {
+			t.Fatalf("node #%d: phase mismatch: have %v, want %v.", i, status.Phase, overlay.PhaseConverged)
+		}
+	}
+	time.Sleep(config.PastryConvTimeout + time.Second)
+
+	for i, node := range nodes {
+		status := node.Status()
+		if !status.Ready {
+			t.Fatalf("node #%d: settled node not ready: %+v.", i, status)
+		}
+		if status.Peers != peers-1 {
+			t.Fatalf("node #%d: peer count mismatch: have %v, want %v.", i, status.Peers, peers-1)
+		}
+		if status.Leaves < 1 || status.Leaves > peers-1 {
+			t.Fatalf("node #%d: leaf count mismatch: have %v, want [1, %v].", i, status.Leaves, peers-1)
+		}
+	}
+	// Depart with one of the nodes and ensure it's reported
+	if err := nodes[0].Shutdown(); err != nil {
+		t.Fatalf("failed to shut down node: %v.", err)
+	}
+	if status := nodes[0].Status(); status.Phase != overlay.PhaseLeaving || status.Ready {
+		t.Fatalf("departed node status mismatch: have %v/%v, want %v/%v.", status.Phase, status.Ready, overlay.PhaseLeaving, false)
+	}
+}
@@ -0,0 +1,115 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that route traces return the full path between any two nodes, starting
+// at the tracer and ending at the destination.
+func TestTrace(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	space, base, leaves := config.PastrySpace, config.PastryBase, config.PastryLeaves
+	defer func() { config.PastrySpace, config.PastryBase, config.PastryLeaves = space, base, leaves }()
+	config.PastrySpace, config.PastryBase, config.PastryLeaves = 20, 2, 2
+
+	peers := 6
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	for i := 0; i < peers; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	// Start handful of nodes and wait for convergence
+	nodes := make([]*Overlay, peers)
+	for i := 0; i < peers; i++ {
+		nodes[i] = New(appId, key, new(nopCallback))
+		if _, err := nodes[i].Boot(); err != nil {
+			t.Fatalf("failed to boot node: %v.", err)
+		}
+		defer nodes[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	// Trace the route from each node to every other and verify the paths
+	ids := make(map[string]*Overlay)
+	for _, node := range nodes {
+		ids[node.Self().String()] = node
+	}
+	for i, src := range nodes {
+		for j, dst := range nodes {
+			path, err := src.Trace(dst.Self(), time.Second)
+			if err != nil {
+				t.Fatalf("trace #%d -> #%d: failed to trace route: %v.", i, j, err)
+			}
+			if len(path) == 0 || path[0].Id.Cmp(src.Self()) != 0 {
+				t.Fatalf("trace #%d -> #%d: path doesn't start at source: %v.", i, j, path)
+			}
+			if last := path[len(path)-1]; last.Id.Cmp(dst.Self()) != 0 {
+				t.Fatalf("trace #%d -> #%d: path end mismatch: have %v, want %v.", i, j, last.Id, dst.Self())
+			}
+			if i == j && len(path) != 1 {
+				t.Fatalf("trace #%d -> #%d: self path length mismatch: have %v, want %v.", i, j, len(path), 1)
+			}
+			for k, hop := range path {
+				node, ok := ids[hop.Id.String()]
+				if !ok {
+					t.Fatalf("trace #%d -> #%d, hop #%d: unknown node %v.", i, j, k, hop.Id)
+				}
+				if len(hop.Addrs) != len(node.addrs) {
+					t.Fatalf("trace #%d -> #%d, hop #%d: address count mismatch: have %v, want %v.", i, j, k, len(hop.Addrs), len(node.addrs))
+				}
+				if k > 0 && hop.Id.Cmp(path[k-1].Id) == 0 {
+					t.Fatalf("trace #%d -> #%d, hop #%d: repeated node %v.", i, j, k, hop.Id)
+				}
+			}
+		}
+	}
+	// Make sure traces fail fast if the next hop is not live any more
+	src, dst := nodes[0], nodes[1]
+	next, _ := src.Route(dst.Self())
+
+	src.lock.Lock()
+	p := src.livePeers[next.String()]
+	delete(src.livePeers, next.String())
+	src.lock.Unlock()
+
+	start := time.Now()
+	if _, err := src.Trace(dst.Self(), time.Second); err != overlay.ErrTraceUnroutable {
+		t.Fatalf("unroutable trace error mismatch: have %v, want %v.", err, overlay.ErrTraceUnroutable)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("unroutable trace didn't fail fast: took %v.", elapsed)
+	}
+	src.lock.Lock()
+	src.livePeers[next.String()] = p
+	src.lock.Unlock()
+}
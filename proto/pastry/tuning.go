@@ -0,0 +1,117 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the background routing table optimization: a random routing table
+// peer is periodically asked for its entries of the row shared with the local
+// node. These are all valid entries of the same local row too, so the reply is
+// merged as a routing state: empty slots get filled straight away, whereas the
+// competitors of occupied ones are measured and swapped in by the proximity
+// neighbor selection if substantially closer. The table hence keeps improving
+// after the join instead of being frozen at join-time quality.
+
+package pastry
+
+import "math/rand"
+
+// Picks a random routing table entry and the row it occupies, to ask for better
+// candidates of that row. Returns nil if the routing table is empty.
+func (o *Overlay) tuneTarget() (*peer, int) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	type entry struct {
+		p   *peer
+		row int
+	}
+	entries := []entry{}
+	for row, ids := range o.routes.routes {
+		for _, id := range ids {
+			if id == nil {
+				continue
+			}
+			if p, ok := o.livePeers[id.String()]; ok {
+				entries = append(entries, entry{p, row})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, 0
+	}
+	pick := entries[rand.Intn(len(entries))]
+	return pick.p, pick.row
+}
+
+// Asks a random routing table peer for its entries of the row shared with the
+// local node.
+func (o *Overlay) tune() {
+	if p, row := o.tuneTarget(); p != nil {
+		o.stateExch.Schedule(func() { o.sendRow(p, row) })
+	}
+}
+
+// Assembles the routing state of a single row of the local routing table (and
+// the local addresses), as requested by a tuning remote peer.
+func (o *Overlay) rowState(row int) *state {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	s := &state{
+		Addrs:   map[string][]string{o.nodeId.String(): o.advertised()},
+		Version: o.time,
+	}
+	if row < 0 || row >= len(o.routes.routes) {
+		return s
+	}
+	for _, id := range o.routes.routes[row] {
+		if id == nil {
+			continue
+		}
+		if p, ok := o.livePeers[id.String()]; ok && !p.inbound() {
+			s.Addrs[id.String()] = p.addrs
+		}
+	}
+	return s
+}
+
+// Checks whether a routing table row received from a tuning peer contains any
+// nodes not connected yet, worth merging.
+// Take care, this is called while locked (don't double lock).
+func (o *Overlay) unknown(s *state) bool {
+	for sid := range s.Addrs {
+		if _, ok := o.livePeers[sid]; !ok && sid != o.nodeId.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues the routing table row received from a tuning peer for merging. Unlike
+// state exchanges, rows are not versioned: the same row may be asked repeatedly.
+func (o *Overlay) offer(s *state) {
+	o.eventLock.Lock()
+	o.offerSet = append(o.offerSet, s)
+	o.eventLock.Unlock()
+
+	// Wake the manager if blocking
+	select {
+	case o.eventNotify <- struct{}{}:
+		// Notification sent
+	default:
+		// Notification already pending
+	}
+}
@@ -0,0 +1,80 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package pastry
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Tests that tuning targets live routing table entries, and that the requested
+// rows contain exactly the live entries of that row.
+func TestTuning(t *testing.T) {
+	o := New(appId, nil, new(nopCallback))
+	o.nodeId = big.NewInt(0)
+	o.routes = newRoutingTable(o.nodeId)
+
+	// Empty routing tables have nothing to tune
+	if p, _ := o.tuneTarget(); p != nil {
+		t.Fatalf("tuning target found in empty table: %v.", p.nodeId)
+	}
+	// Place a live and a dead entry into different rows
+	live := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-config.PastryBase))
+	dead := new(big.Int).Lsh(big.NewInt(1), uint(config.PastrySpace-2*config.PastryBase))
+
+	liveRow, liveCol := prefix(o.nodeId, live)
+	deadRow, deadCol := prefix(o.nodeId, dead)
+	if liveRow == deadRow {
+		t.Fatalf("entries share row %d.", liveRow)
+	}
+	o.routes.routes[liveRow][liveCol] = live
+	o.routes.routes[deadRow][deadCol] = dead
+	o.livePeers[live.String()] = &peer{nodeId: live, addrs: []string{"127.0.0.1:1"}}
+
+	for i := 0; i < 10; i++ {
+		if p, row := o.tuneTarget(); p == nil || p.nodeId.Cmp(live) != 0 || row != liveRow {
+			t.Fatalf("tuning target mismatch: have %v/%v, want %v/%v.", p, row, live, liveRow)
+		}
+	}
+	// Rows must contain the local and the live row entries only
+	s := o.rowState(liveRow)
+	if len(s.Addrs) != 2 {
+		t.Fatalf("row size mismatch: have %v, want %v.", len(s.Addrs), 2)
+	}
+	if _, ok := s.Addrs[o.nodeId.String()]; !ok {
+		t.Fatalf("local addresses missing from row.")
+	}
+	if addrs, ok := s.Addrs[live.String()]; !ok || len(addrs) != 1 {
+		t.Fatalf("live entry missing from row: have %v.", s.Addrs)
+	}
+	// Rows of connected peers only should not be merged
+	if o.unknown(s) {
+		t.Fatalf("connected row reported unknown.")
+	}
+	if s.Addrs[dead.String()] = nil; !o.unknown(s) {
+		t.Fatalf("unconnected row reported known.")
+	}
+	for _, row := range []int{deadRow, -1, len(o.routes.routes)} {
+		if s := o.rowState(row); len(s.Addrs) != 1 {
+			t.Fatalf("row %d size mismatch: have %v, want %v.", row, len(s.Addrs), 1)
+		}
+	}
+}
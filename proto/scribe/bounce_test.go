@@ -0,0 +1,126 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that balanced messages bouncing off unreachable members are retried to
+// other ones, and returned to the sender once out of retries.
+func TestBalanceBounce(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, subscribing only one
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+		bounce:  []*proto.Message{},
+	}
+	live := []*Overlay{}
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	member, sender := live[0], live[1]
+	if err := member.Subscribe(topicId); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	// Balance a message through the member to a non-existent target
+	dead := new(big.Int).Add(member.Self(), big.NewInt(1))
+	bounce := func() {
+		msg := &proto.Message{Data: []byte{0x42}}
+		if err := msg.Encrypt(); err != nil {
+			t.Fatalf("failed to encrypt message: %v.", err)
+		}
+		sender.sendDataPacket(dead, &header{Op: opBalance, Topic: overlay.Resolve(topicId), Prev: member.Self()}, msg)
+		time.Sleep(250 * time.Millisecond)
+	}
+	bounce()
+
+	coll.lock.Lock()
+	if n := len(coll.balance); n != 1 {
+		t.Fatalf("retried balance mismatch: have %v, want %v.", n, 1)
+	}
+	if n := len(coll.bounce); n != 0 {
+		t.Fatalf("undeliverable balance mismatch: have %v, want %v.", n, 0)
+	}
+	coll.lock.Unlock()
+
+	// Disable retries and ensure the message is returned to the sender
+	oldr := config.ScribeBalanceRetries
+	config.ScribeBalanceRetries = 0
+	defer func() { config.ScribeBalanceRetries = oldr }()
+
+	bounce()
+
+	coll.lock.Lock()
+	if n := len(coll.balance); n != 1 {
+		t.Fatalf("retried balance mismatch: have %v, want %v.", n, 1)
+	}
+	if n := len(coll.bounce); n != 1 {
+		t.Fatalf("undeliverable balance mismatch: have %v, want %v.", n, 1)
+	}
+	coll.lock.Unlock()
+
+	// Balance into a topic without members and ensure it's returned to the sender
+	if err := sender.Balance("unknown.test", &proto.Message{Data: []byte{0x42}}); err != nil {
+		t.Fatalf("failed to balance message: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.bounce); n != 2 {
+		t.Fatalf("undeliverable balance mismatch: have %v, want %v.", n, 2)
+	}
+}
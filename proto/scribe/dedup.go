@@ -0,0 +1,64 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the duplicate suppression cache of the carrier, remembering
+// the ids of the recently seen publishes to drop copies arriving again due to a
+// tree repair or retransmission, instead of delivering them twice.
+
+package scribe
+
+import (
+	"sync"
+)
+
+// Bounded set of recently seen message ids, evicting the oldest when full.
+type dedup struct {
+	seen  map[string]struct{} // Set of message ids currently remembered
+	order []string            // Ring buffer of the ids in arrival order
+	next  int                 // Index of the next ring slot to overwrite
+	lock  sync.Mutex          // Mutex protecting the cache
+}
+
+// Creates a new duplicate suppression cache remembering at most limit ids.
+func newDedup(limit int) *dedup {
+	if limit < 1 {
+		limit = 1
+	}
+	return &dedup{
+		seen:  make(map[string]struct{}, limit),
+		order: make([]string, limit),
+	}
+}
+
+// Inserts a message id into the cache, returning whether it was already seen.
+func (d *dedup) check(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+	// Evict the oldest id if the ring is full and insert the new one
+	if old := d.order[d.next]; old != "" {
+		delete(d.seen, old)
+	}
+	d.order[d.next] = id
+	d.seen[id] = struct{}{}
+	d.next = (d.next + 1) % len(d.order)
+	return false
+}
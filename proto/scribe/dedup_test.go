@@ -0,0 +1,116 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests the eviction logic of the duplicate suppression cache.
+func TestDedupCache(t *testing.T) {
+	cache := newDedup(4)
+	for i := 0; i < 4; i++ {
+		if cache.check(fmt.Sprintf("%d", i)) {
+			t.Fatalf("fresh id %d reported as seen.", i)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if !cache.check(fmt.Sprintf("%d", i)) {
+			t.Fatalf("remembered id %d reported as fresh.", i)
+		}
+	}
+	// Overflow the cache and ensure the oldest got evicted
+	if cache.check("4") {
+		t.Fatalf("fresh id 4 reported as seen.")
+	}
+	if cache.check("0") {
+		t.Fatalf("evicted id 0 reported as seen.")
+	}
+	if !cache.check("3") {
+		t.Fatalf("remembered id 3 reported as fresh.")
+	}
+}
+
+// Tests that duplicated publishes are delivered only once to the subscribers.
+func TestDedup(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish every event twice with the same id, as a retransmission would
+	id := overlay.Resolve(topicId)
+	for i := 0; i < pubs; i++ {
+		for j := 0; j < 2; j++ {
+			msg := &proto.Message{Data: []byte{byte(i)}}
+			if err := msg.Encrypt(); err != nil {
+				t.Fatalf("failed to encrypt message: %v.", err)
+			}
+			live[0].sendDataPacket(id, &header{Op: opPublish, Id: uint64(i + 1), Topic: id}, msg)
+		}
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != pubs*nodes {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, pubs*nodes)
+	}
+}
@@ -0,0 +1,158 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the graceful departure of a carrier node: before the overlay
+// is torn down, the node hands its positions in the topic trees over to its tree
+// neighbors. Inner nodes pass their children up to their own parent, whereas
+// roots pass them to the leaf set node next closest to the topic, which takes
+// over the rendez-vous role. Either way the children are adopted straight away,
+// and the standbys of the local roots released, so the rest of the cluster does
+// not mistake a planned departure for a crash.
+
+package scribe
+
+import (
+	"log"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe/topic"
+)
+
+// Hands the tree positions of the local node over to its neighbors and releases
+// its standbys. Local subscriptions are expected to be already removed.
+func (o *Overlay) depart() {
+	self := o.router.Self()
+	leaves := o.router.Leaves(config.PastryLeaves)
+
+	// Collect the heirs of the subtrees and the standbys to release
+	heirs := make(map[string]*big.Int)
+	states := make(map[string]*standby)
+	releases := make(map[string][]*big.Int)
+
+	o.lock.RLock()
+	for sid, top := range o.topics {
+		snap := top.Snapshot()
+
+		children := []*big.Int{}
+		for _, id := range snap.Children {
+			if id.Cmp(self) != 0 {
+				children = append(children, id)
+			}
+		}
+		if len(children) == 0 {
+			continue
+		}
+		// Inner nodes hand over to the parent, roots to the next closest node
+		if snap.Parent != nil {
+			heirs[sid], states[sid] = snap.Parent, &standby{Children: children}
+			continue
+		}
+		var heir, dist *big.Int
+		for _, id := range leaves {
+			if d := o.router.Distance(id, top.Self()); heir == nil || d.Cmp(dist) < 0 {
+				heir, dist = id, d
+			}
+		}
+		if heir != nil {
+			heirs[sid], states[sid] = heir, &standby{Root: self, Seq: o.beats, Children: children}
+		}
+	}
+	for sid, ids := range o.replicas {
+		releases[sid] = ids
+	}
+	seq := o.beats
+	o.lock.RUnlock()
+
+	// Send out the handovers and the standby releases
+	for sid, heir := range heirs {
+		topicId, _ := new(big.Int).SetString(sid, 10)
+		log.Printf("scribe: %v departing, handing topic %v over to %v.", self, topicId, heir)
+		o.sendDepart(heir, topicId, states[sid])
+	}
+	for sid, ids := range releases {
+		topicId, _ := new(big.Int).SetString(sid, 10)
+		for _, id := range ids {
+			o.sendStandby(id, topicId, &standby{Root: self, Seq: seq, Release: true})
+		}
+	}
+}
+
+// Takes over the tree position of a departing node, adopting its children. If
+// the departing node was an inner one, the local node is its parent and simply
+// replaces it; if it was the root, the local node becomes the new root, breaking
+// away from any previous parent of its own.
+func (o *Overlay) handleDepart(src *big.Int, topicId *big.Int, state *standby) error {
+	self := o.router.Self()
+	sid := topicId.String()
+
+	orphans := []*big.Int{}
+	for _, id := range state.Children {
+		if id.Cmp(self) != 0 {
+			orphans = append(orphans, id)
+		}
+	}
+	o.lock.Lock()
+	top, ok := o.topics[sid]
+	if !ok && state.Root != nil && len(orphans) > 0 {
+		top, ok = topic.New(topicId, self), true
+		o.topics[sid] = top
+	}
+	o.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if state.Root == nil {
+		// Departing child, drop it in favor of its own children
+		if !top.Child(src) {
+			log.Printf("scribe: %v declining departure of %v from topic %v: not a child.", self, src, topicId)
+			return nil
+		}
+		if err := top.Unsubscribe(src); err != nil {
+			return err
+		}
+		if err := o.unmonitor(topicId, src); err != nil {
+			return err
+		}
+	} else if parent := top.Parent(); parent != nil {
+		// Departing root, become the new one (leaving any other parent)
+		if err := o.unmonitor(topicId, parent); err != nil {
+			return err
+		}
+		top.Reown(nil)
+		if parent.Cmp(src) != 0 {
+			go o.sendUnsubscribe(parent, topicId)
+		}
+	}
+	log.Printf("scribe: %v taking over topic %v from departing node %v.", self, topicId, src)
+	for _, id := range orphans {
+		if top.Child(id) {
+			continue
+		}
+		if err := top.Subscribe(id); err != nil {
+			log.Printf("scribe: failed to adopt orphan: %v.", err)
+			continue
+		}
+		if err := o.monitor(topicId, id); err != nil {
+			log.Printf("scribe: failed to monitor orphan: %v.", err)
+		}
+		go o.sendAdopt(id, topicId, src)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that a departing topic root hands the tree over to its successor before
+// shutting down, without the survivors having to detect its failure.
+func TestDepart(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes (no standbys)
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make(map[string]*Overlay)
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		if err := node.SetReplicas(0); err != nil {
+			t.Fatalf("failed to disable standbys: %v.", err)
+		}
+		live[node.Self().String()] = node
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+	if !converged(t, live) {
+		t.Fatalf("topic tree failed to converge.")
+	}
+	// Gracefully terminate the root, the tree must recover before any failure detection
+	var root *Overlay
+	for _, node := range live {
+		if snap, _ := node.Inspect(topicId); snap != nil && snap.Parent == nil {
+			root = node
+		}
+	}
+	delete(live, root.Self().String())
+	if err := root.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate root node: %v.", err)
+	}
+	deadline := time.Now().Add(config.ScribeBeatPeriod)
+	for !converged(t, live) {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic tree failed to recover within a heartbeat.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Make sure events reach all the surviving members
+	for _, node := range live {
+		for i := 0; i < pubs; i++ {
+			if err := node.Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			}
+		}
+		break
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != pubs*(nodes-1) {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, pubs*(nodes-1))
+	}
+}
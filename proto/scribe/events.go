@@ -27,6 +27,15 @@
 //    this middle node initiates a brand new subscription. If it is delivered,
 //    hopefully the topic root was reached and subscription cascading stops.
 //
+//  - Redirect:
+//    If fan-out or depth limits are configured, tree nodes already having the
+//    maximum number of children push new subscribers down to their lightest
+//    child, whereas nodes at the maximum depth push them up to their parent.
+//    The adopting node answers with a redirect-flagged report, which lets the
+//    subscriber accept it as parent even if farther from the topic than itself.
+//    With a depth limit, only nodes attached to the tree capture subscriptions
+//    in flight, as the others cannot know the depth their subscribers get.
+//
 //  - Subscription removal:
 //    If all children nodes removed their subscription, and no local clients are
 //    subscribed to a specific topic, the topic itself is removed and the parent
@@ -42,20 +51,89 @@
 //    the entry point. To prevent message duplication, each publish is either in
 //    a virgin or non-virgin state, depending on whether it entered the tree. If
 //    an event is virgin, it can be caught by any member node and processed, but
-//    non-virgin nodes must use precise addressing.
+//    non-virgin nodes must use precise addressing. Each publish also carries a
+//    sender unique id, which carrier nodes remember for a while to drop copies
+//    duplicated by tree repairs or retransmissions.
 //
 //  - Balance:
 //    It is essentially the same as publish, with the only difference that the
-//    message is send forward on only one edge of the multi-cast tree.
+//    message is send forward on only one edge of the multi-cast tree. Keyed
+//    balances are never caught midway: they are routed to the root and descend
+//    the tree along the edges with the highest rendezvous score of the key, so
+//    the same key consistently reaches the same member while the tree is stable.
+//
+//  - Bounce:
+//    Balanced messages reaching a node other than their precise destination (a
+//    dead member) or a node without the topic (a departed member) are bounced
+//    back to the balancer that picked the target, which retries another one,
+//    excluding the unreachable target. After the configured number of retries
+//    (or if there was no tree to balance in at all), the message is returned to
+//    its sender as undeliverable, failing it fast instead of by a timeout.
+//
+//  - Cascade:
+//    Topics under a hierarchical prefix form a tree of names (a/b/c), where the
+//    subscribers of an ancestor receive the events of all its descendants. The
+//    node where a virgin publish enters the tree (or the rendez-vous point) sends
+//    a fresh virgin copy towards the parent topic, which cascades in turn.
+//
+//  - Confirm:
+//    If the publisher requested a confirmation, the node where a virgin publish
+//    enters the topic tree (or the rendez-vous point if none) sends back a
+//    precise confirmation message. Forwarded copies never confirm again.
+//
+//  - Trace:
+//    If the publisher requested a path trace, every node routing or delivering
+//    a copy of the publish appends itself and its local time to the carried hop
+//    list. Nodes delivering the event to a local member send the accumulated
+//    path back precisely to the publisher.
 //
 //  - Report:
 //    These are used to distribute load reports between members of a multi-cast
 //    tree. Since members know about each other, reports use precise addressing.
+//    Each report also carries the number of members reachable through the
+//    reporter, which neighbors sum up to count the whole tree, and the union of
+//    their event filters, used to prune publishes no member behind is
+//    interested in, as well as the sums of the custom application metrics the
+//    members behind attached.
+//
+//  - Query:
+//    Member count queries are routed towards the topic rendez-vous point, and
+//    answered precisely by the first node of the topic tree they reach (or the
+//    rendez-vous point with zero members if no tree exists).
+//
+//  - Verify / Repair:
+//    Every few heartbeats each node sends its tree neighbors a digest of the
+//    topics in which it considers them its parent or child. Links the recipient
+//    disagrees with are answered with a repair message: orphaned children get
+//    re-grafted via a fresh subscription, stale children are dropped. This
+//    catches inconsistencies heartbeats alone cannot (e.g. parent cycles).
+//
+//  - Standby / Adopt:
+//    Every topic root replicates its direct children to the nearest few nodes
+//    of its leaf set each report round, which monitor the root in turn. If it
+//    dies, the first standby noticing adopts the orphaned children directly,
+//    which accept only if still orphaned (else decline by unsubscribing). Roots
+//    losing their role (or standbys) release them explicitly.
+//
+//  - Handover:
+//    When a node closer to a topic joins the leaf set of its root, the root
+//    pushes a snapshot of its tree state (member counts, filters, loads) to the
+//    newcomer, which subscribes the old root as its child right away. Events
+//    routed to the new rendez-vous point are thus delivered without waiting for
+//    the periodic root re-subscriptions to merge the trees.
+//
+//  - Depart:
+//    Before shutting down, a node hands each of its subtrees over: an inner node
+//    to its parent, a root to the next closest node of its leaf set. The heir
+//    adopts the children right away (becoming the new root if needed), and the
+//    departing root releases its standbys, so no failover is triggered.
 //
 //  - Direct:
 //    As the name suggests, direct messages have a precise destination. Only the
 //    true recipient must handle it. Delivery to a non-precise destination means
 //    either the destination terminated, or pastry's mis-delivered (churn?).
+//    Recipients connected to the sender (e.g. the origin of a balanced request
+//    being replied to) are reached in a single hop, bypassing the routing.
 
 package scribe
 
@@ -64,28 +142,45 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	"sync/atomic"
 
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/filter"
 	"github.com/project-iris/iris/proto"
-	"github.com/project-iris/iris/proto/pastry"
 	"github.com/project-iris/iris/proto/scribe/topic"
 )
 
 // Implements the pastry.Callback.Deliver method.
 func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
+	if err := unpack(msg); err != nil {
+		log.Printf("scribe: dropping undecodable delivery: %v.", err)
+		return
+	}
 	head := msg.Head.Meta.(*header)
+	o.traceHop(head)
+
 	switch head.Op {
 	case opSubscribe:
 		// Topic roots will get self-subscribe messages, discard them
-		if head.Sender.Cmp(o.pastry.Self()) == 0 {
+		if head.Sender.Cmp(o.router.Self()) == 0 {
 			return
 		}
-		if err := o.handleSubscribe(head.Sender, key); err != nil {
-			log.Printf("scribe: %v failed to handle delivered subscription %v to %v: %v.", o.pastry.Self(), head.Sender, key, err)
+		if _, err := o.handleSubscribe(head.Sender, key, false); err != nil {
+			log.Printf("scribe: %v failed to handle delivered subscription %v to %v: %v.", o.router.Self(), head.Sender, key, err)
+		}
+	case opRedirect:
+		// Redirects are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: subscription redirect delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		if err := o.handleRedirect(head.Joiner, head.Topic); err != nil {
+			log.Printf("scribe: %v failed to handle redirected subscription %v to %v: %v.", o.router.Self(), head.Joiner, head.Topic, err)
 		}
 	case opUnsubscribe:
 		// Drop all unsubscriptions not intended directly for the current node
-		if o.pastry.Self().Cmp(key) != 0 {
-			log.Printf("scribe: unsubscription delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: unsubscription delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
 			return
 		}
 		if err := o.handleUnsubscribe(head.Sender, head.Topic); err != nil {
@@ -93,37 +188,127 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 		}
 	case opPublish:
 		// Non-virgin publishes must be delivered precisely
-		if head.Prev != nil && o.pastry.Self().Cmp(key) != 0 {
-			log.Printf("scribe: non-virgin publish at wrong destination (churn?): have %v, want %v.", key, o.pastry.Self())
+		if head.Prev != nil && o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: non-virgin publish at wrong destination (churn?): have %v, want %v.", key, o.router.Self())
 			return
 		}
+		// Virgin publishes reached the rendez-vous point, confirm if requested
+		// and cascade into the parent topic if hierarchical
+		if head.Prev == nil {
+			o.confirm(head)
+			o.cascade(msg)
+		}
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); !hand || err != nil {
 			// Simple race condition between unsubscribe and publish, left in for debug
-			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.pastry.Self(), hand, err)
+			log.Printf("scribe: %v failed to handle delivered publish (churn?): %v %v.", o.router.Self(), hand, err)
 		}
 	case opBalance:
-		// Non-virgin balances must be delivered precisely
-		if head.Prev != nil && o.pastry.Self().Cmp(key) != 0 {
-			log.Printf("scribe: non-virgin balance at wrong destination (churn?): have %v, want %v.", key, o.pastry.Self())
+		// Non-virgin balances must be delivered precisely, bounce if the target's gone
+		if head.Prev != nil && o.router.Self().Cmp(key) != 0 {
+			o.bounce(msg, key)
 			return
 		}
-		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); !hand || err != nil {
-			// Simple race condition between unsubscribe and balance, left in for debug
+		hand, err := o.handleBalance(msg, head.Topic, head.Prev)
+		if err != nil {
 			log.Printf("scribe: failed to handle delivered balance: %v %v.", hand, err)
+		} else if !hand {
+			// Simple race condition between unsubscribe and balance, retry elsewhere
+			o.bounce(msg, o.router.Self())
 		}
+	case opBounce:
+		// Bounces are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: balance bounce delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleBounce(msg)
 	case opReport:
 		// Load reports are always addresses precisely, drop any other
-		if o.pastry.Self().Cmp(key) != 0 {
-			log.Printf("scribe: load report delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: load report delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
 			return
 		}
 		if err := o.handleReport(head.Sender, head.Report); err != nil {
 			log.Printf("scribe: failed to handle remote load report: %v.", err)
 		}
+	case opConfirm:
+		// Confirmations are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: publish confirmation delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleConfirm(head.Confirm)
+	case opTrace:
+		// Traces are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: publish trace delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleTrace(head.Trace, head.Hops)
+	case opQuery:
+		// Queries reaching the rendez-vous point are answered in all cases
+		o.handleQuery(head.Sender, head.Topic, head.Query)
+	case opCount:
+		// Counts are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: member count delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleCount(head.Query, head.Count)
+	case opVerify:
+		// Digests are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: tree digest delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleVerify(head.Sender, head.Digest)
+	case opRepair:
+		// Repairs are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: tree repair delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		o.handleRepair(head.Sender, head.Digest)
+	case opStandby:
+		// Root replicas are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: root replica delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		if err := o.handleStandby(head.Sender, head.Topic, head.Standby); err != nil {
+			log.Printf("scribe: failed to handle root replica: %v.", err)
+		}
+	case opAdopt:
+		// Adoptions are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: adoption delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		if err := o.handleAdopt(head.Sender, head.Topic, head.Standby.Root); err != nil {
+			log.Printf("scribe: failed to handle adoption: %v.", err)
+		}
+	case opHandover:
+		// Handovers are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: topic handover delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		if err := o.handleHandover(head.Sender, head.Topic, head.Report); err != nil {
+			log.Printf("scribe: failed to handle topic handover: %v.", err)
+		}
+	case opDepart:
+		// Departures are always addressed precisely, drop any other
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: tree departure delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
+			return
+		}
+		if err := o.handleDepart(head.Sender, head.Topic, head.Standby); err != nil {
+			log.Printf("scribe: failed to handle tree departure: %v.", err)
+		}
 	case opDirect:
 		// Direct messages are always precise
-		if o.pastry.Self().Cmp(key) != 0 {
-			log.Printf("scribe: direct message delivered to wrong node (churn?): have %v, want %v.", key, o.pastry.Self())
+		if o.router.Self().Cmp(key) != 0 {
+			log.Printf("scribe: direct message delivered to wrong node (churn?): have %v, want %v.", key, o.router.Self())
 			return
 		}
 		if err := o.handleDirect(msg); err != nil {
@@ -134,39 +319,86 @@ func (o *Overlay) Deliver(msg *proto.Message, key *big.Int) {
 	}
 }
 
-// Implements the pastry.Callback.Forward method.
+// Implements the pastry.Callback.Forward method, restoring the carrier headers
+// from their wire format for processing and packing them back if forwarded.
 func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
+	if err := unpack(msg); err != nil {
+		log.Printf("scribe: dropping undecodable forward: %v.", err)
+		return false
+	}
+	if !o.forward(msg, key) {
+		return false
+	}
+	pack(msg)
+	return true
+}
+
+// Processes a message passing through the local node, returning whether pastry
+// should forward it further.
+func (o *Overlay) forward(msg *proto.Message, key *big.Int) bool {
 	head := msg.Head.Meta.(*header)
+	o.traceHop(head)
 
 	// If subscription event, process locally and re-initiate
 	if head.Op == opSubscribe {
 		// Pastry always asks permission to forward, even local messages (bug? ugly maybe)
 		// If the local node is the originator, just forward the message as is
-		if head.Sender.Cmp(o.pastry.Self()) == 0 {
+		if head.Sender.Cmp(o.router.Self()) == 0 {
+			return true
+		}
+		// If the local node cannot vouch for the tree shape, pass the subscription on
+		if !o.capturable(key) {
 			return true
 		}
 		// Integrate the subscription locally
-		if err := o.handleSubscribe(head.Sender, key); err != nil {
+		hand, err := o.handleSubscribe(head.Sender, key, false)
+		if err != nil {
 			// A failure most probably means double subscription caused by a race
 			// between parent discovery and parent response. Discard to prevent the
 			// node being registered into multiple subtrees.
-			log.Printf("scribe: %v failed to handle forwarding subscription %v to %v: %v.", o.pastry.Self(), head.Sender, key, err)
+			log.Printf("scribe: %v failed to handle forwarding subscription %v to %v: %v.", o.router.Self(), head.Sender, key, err)
+			return false
+		}
+		// If redirected within the (saturated) tree, stop the cascade
+		if !hand {
 			return false
 		}
 		// Integrated, cascade the subscription with the local node
-		head.Sender = o.pastry.Self()
+		head.Sender = o.router.Self()
 		return true
 	}
 	// Catch virgin publish messages and only blindly forward if cannot handle
 	if head.Op == opPublish && head.Prev == nil {
+		// Strip the confirmation request to prevent tree copies from confirming
+		confId := head.Confirm
+		head.Confirm = 0
+
 		if hand, err := o.handlePublish(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding publish: %v %v.", hand, err)
 		} else {
+			// Confirm and cascade if the publish entered the tree, otherwise restore the request
+			head.Confirm = confId
+			if hand {
+				o.confirm(head)
+				o.cascade(msg)
+			}
 			return !hand
 		}
+		head.Confirm = confId
+	}
+	// Catch member count queries and answer if the topic tree was reached
+	if head.Op == opQuery {
+		o.lock.RLock()
+		_, ok := o.topics[head.Topic.String()]
+		o.lock.RUnlock()
+
+		if ok {
+			o.handleQuery(head.Sender, head.Topic, head.Query)
+			return false
+		}
 	}
 	// Catch virgin balance messages and only blindly forward if cannot handle
-	if head.Op == opBalance && head.Prev == nil {
+	if head.Op == opBalance && head.Prev == nil && head.Key == "" {
 		if hand, err := o.handleBalance(msg, head.Topic, head.Prev); err != nil {
 			log.Printf("scribe: failed to handle forwarding balance: %v %v.", hand, err)
 		} else {
@@ -176,8 +408,11 @@ func (o *Overlay) Forward(msg *proto.Message, key *big.Int) bool {
 	return true
 }
 
-// Handles the subscription event to a topic.
-func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
+// Handles the subscription event to a topic, returning whether it was integrated
+// locally or redirected to another tree node due to the fan-out or depth limits.
+// If the subscription itself was redirected here, the subscriber is notified to
+// accept the local node as parent even if farther from the topic than itself.
+func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int, redirected bool) (bool, error) {
 	// Generate the textual topic id
 	sid := topicId.String()
 
@@ -185,27 +420,49 @@ func (o *Overlay) handleSubscribe(nodeId, topicId *big.Int) error {
 	o.lock.Lock()
 	top, ok := o.topics[sid]
 	if !ok {
-		top = topic.New(topicId, o.pastry.Self())
+		top = topic.New(topicId, o.router.Self())
 		o.topics[sid] = top
 	}
 	o.lock.Unlock()
 
+	// A subscription from the own parent means a cycle formed, break it up
+	if parent := top.Parent(); parent != nil && parent.Cmp(nodeId) == 0 {
+		if err := o.unmonitor(topicId, parent); err != nil {
+			return false, err
+		}
+		top.Reown(nil)
+	}
+	// If the local node cannot take more children, redirect within the tree
+	if dest := o.redirect(top, nodeId); dest != nil {
+		o.sendRedirect(dest, topicId, nodeId)
+		return false, nil
+	}
 	// Subscribe node to the topic
 	if err := top.Subscribe(nodeId); err != nil {
-		return err
+		return false, err
 	}
 	// If a remote node, start monitoring is and respond with an empty report (fast parent discovery)
-	if nodeId.Cmp(o.pastry.Self()) != 0 {
+	if nodeId.Cmp(o.router.Self()) != 0 {
 		if err := o.monitor(topicId, nodeId); err != nil {
-			return err
+			return false, err
 		}
 		rep := &report{
-			Tops: []*big.Int{topicId},
-			Caps: []int{1},
+			Tops:  []*big.Int{topicId},
+			Caps:  []int{1},
+			Sizes: top.GenerateSizes([]*big.Int{nodeId}),
+			Filts: top.GenerateFilters([]*big.Int{nodeId}),
+			Loads: top.GenerateLoads([]*big.Int{nodeId}),
+			Zones: top.GenerateZones([]*big.Int{nodeId}),
+			Lats:  top.GenerateLatencies([]*big.Int{nodeId}),
+
+			Depths:  top.GenerateDepths([]*big.Int{nodeId}),
+			Metrics: top.GenerateMetrics([]*big.Int{nodeId}),
+
+			Redirect: redirected,
 		}
 		o.sendReport(nodeId, rep)
 	}
-	return nil
+	return true, nil
 }
 
 // Handles the unsubscription event from a topic.
@@ -223,7 +480,7 @@ func (o *Overlay) handleUnsubscribe(nodeId, topicId *big.Int) error {
 	if err := top.Unsubscribe(nodeId); err != nil {
 		return err
 	}
-	if nodeId.Cmp(o.pastry.Self()) != 0 {
+	if nodeId.Cmp(o.router.Self()) != 0 {
 		if err := o.unmonitor(topicId, nodeId); err != nil {
 			return err
 		}
@@ -259,22 +516,43 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 	if prevHop != nil && !top.Neighbor(prevHop) {
 		return true, fmt.Errorf("non-neighbor direct publish: %v", prevHop)
 	}
-	// Extract the message headers
+	// Extract the message headers and drop already seen copies (repair, retransmit)
 	head := msg.Head.Meta.(*header)
+	traffic := top.Traffic()
+	if head.Id != 0 && o.dups.check(fmt.Sprintf("%v/%v/%d", sid, head.Sender, head.Id)) {
+		atomic.AddUint64(&traffic.Dropped, 1)
+		return true, nil
+	}
+	atomic.AddUint64(&traffic.Events, 1)
+	atomic.AddUint64(&traffic.Bytes, uint64(len(msg.Data)))
 
+	// Extract the event attributes to filter on, if any
+	var attrs map[string]string
+	if meta, ok := head.Meta.(filter.Attributed); ok {
+		attrs = meta.Attributes()
+	}
 	// Get the batch of nodes to broadcast to
 	nodes, local := top.Broadcast(prevHop), false
-	owner := o.pastry.Self()
+	owner := o.router.Self()
 	for _, id := range nodes {
 		if id.Cmp(owner) != 0 {
+			// Skip subtrees without interested members
+			if !top.Accepts(id, attrs) {
+				atomic.AddUint64(&traffic.Filtered, 1)
+				continue
+			}
 			// Create a copy since overlay will modify headers
 			cpy := new(proto.Message)
 			*cpy = *msg
 			cpy.Head.Meta = head.copy()
 
 			o.fwdPublish(id, cpy)
-		} else {
+			atomic.AddUint64(&traffic.Forwarded, 1)
+		} else if top.AcceptsLocal(attrs) {
 			local = true
+		} else {
+			// Skip decrypting events no local member is interested in
+			atomic.AddUint64(&traffic.Filtered, 1)
 		}
 	}
 	// If local subscription is present, decrypt and deliver
@@ -290,8 +568,13 @@ func (o *Overlay) handlePublish(msg *proto.Message, topicId *big.Int, prevHop *b
 		// Decrypt the message and deliver upstream
 		if err := plain.Decrypt(); err != nil {
 			// Cannot decrypt, report handled and also the error
+			atomic.AddUint64(&traffic.Dropped, 1)
 			return true, err
 		}
+		atomic.AddUint64(&traffic.Delivered, 1)
+		if head.Trace != 0 {
+			o.sendTrace(head.Sender, head.Trace, head.Hops)
+		}
 		o.app.HandlePublish(head.Sender, topName, plain)
 	}
 	return true, nil
@@ -310,13 +593,25 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 		// No error, but not handled either
 		return false, nil
 	}
-	// Fetch the recipient and either forward or deliver
-	node, err := top.Balance(prevHop)
+	// Fetch the recipient (consistently if keyed) and either forward or deliver
+	var node *big.Int
+	var err error
+	if key := msg.Head.Meta.(*header).Key; key != "" {
+		node, err = top.Affine(key, prevHop)
+	} else {
+		node, err = top.Balance(prevHop)
+	}
 	if err != nil {
 		return true, err
 	}
+	// If the pick is the member to avoid, retry excluding it (kept if it's alone)
+	if skip := msg.Head.Meta.(*header).Skip; skip != nil && node.Cmp(skip) == 0 {
+		if alt, err := top.Balance(skip); err == nil {
+			node = alt
+		}
+	}
 	// If it's a remote node, forward
-	if node.Cmp(o.pastry.Self()) != 0 {
+	if node.Cmp(o.router.Self()) != 0 {
 		o.fwdBalance(node, msg)
 		return true, nil
 	}
@@ -331,6 +626,25 @@ func (o *Overlay) handleBalance(msg *proto.Message, topicId *big.Int, prevHop *b
 	return true, nil
 }
 
+// Retries a balanced message that could not be delivered to its target through
+// the balancer that picked it, or returns it to the sender if out of retries (or
+// if it was never balanced inside a topic tree in the first place).
+func (o *Overlay) bounce(msg *proto.Message, target *big.Int) {
+	head := msg.Head.Meta.(*header)
+	if head.Prev != nil && head.Prev.Cmp(target) != 0 && head.Bounces < config.ScribeBalanceRetries {
+		o.fwdBounce(head.Prev, target, msg)
+		return
+	}
+	o.sendBounce(msg)
+}
+
+// Handles an undeliverable balance returned to the local node, notifying the
+// upper layer (the payload is left encrypted, only the headers are of use).
+func (o *Overlay) handleBounce(msg *proto.Message) {
+	msg.Head.Meta = msg.Head.Meta.(*header).Meta
+	o.app.HandleBounce(msg)
+}
+
 // Handles the receiving of a direct message and delivers the contents upstream.
 func (o *Overlay) handleDirect(msg *proto.Message) error {
 	// Remove all scribe headers and decrypt contents
@@ -344,6 +658,59 @@ func (o *Overlay) handleDirect(msg *proto.Message) error {
 	return nil
 }
 
+// Sends back a publish confirmation if one was requested, clearing the request
+// to prevent multiple confirmations for the same message.
+func (o *Overlay) confirm(head *header) {
+	if head.Confirm != 0 {
+		o.sendConfirm(head.Sender, head.Confirm)
+		head.Confirm = 0
+	}
+}
+
+// Handles the confirmation of a publish, notifying the pending sender if still
+// waiting. Otherwise the confirmation is silently dropped.
+func (o *Overlay) handleConfirm(confId uint64) {
+	o.lock.RLock()
+	done, ok := o.confLive[confId]
+	o.lock.RUnlock()
+
+	if ok {
+		select {
+		case done <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Handles a member count query by answering the local view of the topic size,
+// or zero if the topic does not exist.
+func (o *Overlay) handleQuery(src *big.Int, topicId *big.Int, queryId uint64) {
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+
+	count := 0
+	if ok {
+		count = top.Size()
+	}
+	o.sendCount(src, queryId, count)
+}
+
+// Handles the answer of a member count query, notifying the pending querier if
+// still waiting. Otherwise the answer is silently dropped.
+func (o *Overlay) handleCount(queryId uint64, count int) {
+	o.lock.RLock()
+	done, ok := o.queryLive[queryId]
+	o.lock.RUnlock()
+
+	if ok {
+		select {
+		case done <- count:
+		default:
+		}
+	}
+}
+
 // Handles a remote member report, possibly assigning a new parent to the topic.
 func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 	// Error collector
@@ -367,10 +734,11 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 				errs = append(errs, fmt.Errorf("failed to process report: %v.", err))
 				continue
 			}
-			// Make sure the node is closer than oneself. Prevents a race condition
-			// between a child drop due to heart timeout and a late beat (report).
-			if pastry.Distance(o.pastry.Self(), id).Cmp(pastry.Distance(src, id)) < 0 {
-				errs = append(errs, fmt.Errorf("parent assignment denied: %v closer to %v than %v.", o.pastry.Self(), id, src))
+			// Make sure the node is closer than oneself (unless it adopted a redirected
+			// subscription). Prevents a race condition between a child drop due to
+			// heart timeout and a late beat (report).
+			if !rep.Redirect && o.router.Distance(o.router.Self(), id).Cmp(o.router.Distance(src, id)) < 0 {
+				errs = append(errs, fmt.Errorf("parent assignment denied: %v closer to %v than %v.", o.router.Self(), id, src))
 				continue
 			}
 			// Assign a new parent node and reown
@@ -385,12 +753,54 @@ func (o *Overlay) handleReport(src *big.Int, rep *report) error {
 				errs = append(errs, fmt.Errorf("failed to process parent report: %v.", err))
 				continue
 			}
+			if i < len(rep.Sizes) {
+				top.ProcessSize(src, rep.Sizes[i])
+			}
+			if i < len(rep.Filts) {
+				top.ProcessFilters(src, rep.Filts[i])
+			}
+			if i < len(rep.Loads) {
+				top.ProcessLoad(src, rep.Loads[i])
+			}
+			if i < len(rep.Zones) {
+				top.ProcessZone(src, rep.Zones[i])
+			}
+			if i < len(rep.Lats) {
+				top.ProcessLatency(src, o.linkLatency(src, rep.Lats[i]))
+			}
+			if i < len(rep.Depths) {
+				top.ProcessDepth(src, rep.Depths[i])
+			}
+			if i < len(rep.Metrics) {
+				top.ProcessMetrics(src, rep.Metrics[i])
+			}
 		} else {
-			// Report processed correctly, update the heart
+			// Report processed correctly, update the heart and member count
 			if err := o.ping(id, src); err != nil {
 				errs = append(errs, fmt.Errorf("failed to ping node: %v.", err))
 				continue
 			}
+			if i < len(rep.Sizes) {
+				top.ProcessSize(src, rep.Sizes[i])
+			}
+			if i < len(rep.Filts) {
+				top.ProcessFilters(src, rep.Filts[i])
+			}
+			if i < len(rep.Loads) {
+				top.ProcessLoad(src, rep.Loads[i])
+			}
+			if i < len(rep.Zones) {
+				top.ProcessZone(src, rep.Zones[i])
+			}
+			if i < len(rep.Lats) {
+				top.ProcessLatency(src, o.linkLatency(src, rep.Lats[i]))
+			}
+			if i < len(rep.Depths) {
+				top.ProcessDepth(src, rep.Depths[i])
+			}
+			if i < len(rep.Metrics) {
+				top.ProcessMetrics(src, rep.Metrics[i])
+			}
 		}
 	}
 	// Return any errors
@@ -0,0 +1,84 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the shaping of the topic trees according to the configured
+// fan-out and depth limits: subscribers are redirected down the tree from nodes
+// with too many children, and up the tree from nodes too deep to adopt them.
+
+package scribe
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe/topic"
+)
+
+// Decides whether a subscriber should be adopted by another node of the topic
+// tree instead of the local one, returning the node to redirect to or nil if the
+// local node should accept it. The depth limit takes precedence: if pushing the
+// subscriber down would breach it, the fan-out limit is exceeded instead.
+func (o *Overlay) redirect(top *topic.Topic, nodeId *big.Int) *big.Int {
+	// Local members and existing children are always accepted
+	if nodeId.Cmp(o.router.Self()) == 0 || top.Child(nodeId) {
+		return nil
+	}
+	depth := top.Depth()
+
+	// If the local node is too deep to have children, push up to the parent
+	if config.ScribeMaxDepth > 0 && depth >= config.ScribeMaxDepth {
+		return top.Parent()
+	}
+	// If the local node has too many children, push down if depth allows
+	if config.ScribeMaxFanout > 0 && top.Fanout() >= config.ScribeMaxFanout {
+		if config.ScribeMaxDepth == 0 || depth+2 <= config.ScribeMaxDepth {
+			return top.Lightest()
+		}
+	}
+	return nil
+}
+
+// Returns whether the local node may capture a subscription in flight. With a
+// depth limit, only nodes attached to the tree know their depth, so others pass
+// the subscriptions on instead of adopting subscribers at an unknown depth.
+func (o *Overlay) capturable(topicId *big.Int) bool {
+	if config.ScribeMaxDepth == 0 {
+		return true
+	}
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+
+	return ok && top.Parent() != nil
+}
+
+// Handles a subscription redirected to the local node by a tree neighbor. If the
+// local node left the topic tree in the mean time, it re-grafts itself.
+func (o *Overlay) handleRedirect(nodeId, topicId *big.Int) error {
+	o.lock.RLock()
+	_, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+
+	if _, err := o.handleSubscribe(nodeId, topicId, true); err != nil {
+		return err
+	}
+	if !ok {
+		o.sendSubscribe(topicId)
+	}
+	return nil
+}
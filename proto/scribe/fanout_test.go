@@ -0,0 +1,146 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that nodes with the maximum number of children push new subscribers
+// down the topic tree.
+func TestFanoutLimit(t *testing.T) {
+	olds := config.ScribeMaxFanout
+	config.ScribeMaxFanout = 2
+	defer func() { config.ScribeMaxFanout = olds }()
+
+	live := testShapedTree(t, 8, 10)
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for _, node := range live {
+		if snap, err := node.Inspect(topicId); err != nil {
+			t.Fatalf("failed to inspect topic: %v.", err)
+		} else if len(snap.Children) > config.ScribeMaxFanout {
+			t.Fatalf("fan-out limit exceeded: have %v, want at most %v.", len(snap.Children), config.ScribeMaxFanout)
+		}
+	}
+}
+
+// Tests that nodes at the maximum depth push new subscribers up the topic tree,
+// even if that breaches the fan-out limit.
+func TestDepthLimit(t *testing.T) {
+	oldf, oldd := config.ScribeMaxFanout, config.ScribeMaxDepth
+	config.ScribeMaxFanout, config.ScribeMaxDepth = 2, 1
+	defer func() { config.ScribeMaxFanout, config.ScribeMaxDepth = oldf, oldd }()
+
+	live := testShapedTree(t, 8, 10)
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for _, node := range live {
+		depth := 0
+		for cur := node; ; depth++ {
+			snap, err := cur.Inspect(topicId)
+			if err != nil {
+				t.Fatalf("failed to inspect topic: %v.", err)
+			}
+			if snap.Parent == nil {
+				break
+			}
+			cur = live[snap.Parent.String()]
+		}
+		if depth > config.ScribeMaxDepth {
+			t.Fatalf("depth limit exceeded: have %v, want at most %v.", depth, config.ScribeMaxDepth)
+		}
+	}
+}
+
+// Boots a number of scribe nodes, subscribes them one by one (giving the tree
+// time to report the shape) and checks that events reach all of them.
+func testShapedTree(t *testing.T, nodes int, pubs int) map[string]*Overlay {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make(map[string]*Overlay)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live[node.Self().String()] = node
+	}
+	time.Sleep(time.Second)
+
+	// Subscribe the nodes one after the other and wait for convergence
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+		time.Sleep(2 * config.ScribeBeatPeriod)
+	}
+	deadline := time.Now().Add(time.Duration(4*config.ScribeKillCount) * config.ScribeBeatPeriod)
+	for !converged(t, live) {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic tree failed to converge.")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Make sure events reach all the members
+	for _, node := range live {
+		for i := 0; i < pubs; i++ {
+			if err := node.Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			}
+		}
+		break
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != pubs*nodes {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, pubs*nodes)
+	}
+	return live
+}
@@ -0,0 +1,135 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the rendez-vous handover of the topics to joining nodes:
+// whenever the overlay reports new leaves (and every heartbeat as a fallback) the
+// roots check whether a node closer to their topics joined the leaf set, and if
+// so, push the tree state over to it directly. The newcomer
+// becomes the root with the old one as its child, closing the delivery gap until
+// the periodic root re-subscriptions would have merged the trees.
+
+package scribe
+
+import (
+	"log"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Hands the locally rooted topics over as soon as nodes join the leaf set, not
+// waiting for the next heartbeat. The hook runs on the overlay maintenance thread,
+// so the handover itself is done asynchronously.
+func (o *Overlay) leavesChanged(event *overlay.LeafEvent) {
+	if len(event.Joined) == 0 {
+		return
+	}
+	go func() {
+		leaves := o.router.Leaves(config.PastryLeaves)
+
+		o.lock.RLock()
+		defer o.lock.RUnlock()
+
+		o.handover(leaves)
+	}()
+}
+
+// Hands the locally rooted topics over to the nodes that joined the leaf set
+// since the last check, if any of them became the closest to the topic. The
+// caller is expected to hold at least a read lock on the overlay.
+func (o *Overlay) handover(leaves []*big.Int) {
+	o.leafLock.Lock()
+	defer o.leafLock.Unlock()
+
+	self := o.router.Self()
+
+	// Collect the newly joined nodes, bailing out if there are none
+	joined := []*big.Int{}
+	for _, id := range leaves {
+		if !contains(o.leafset, id) {
+			joined = append(joined, id)
+		}
+	}
+	o.leafset = leaves
+	if len(joined) == 0 {
+		return
+	}
+	for _, top := range o.topics {
+		if top.Parent() != nil {
+			continue
+		}
+		// Find the node closest to the topic, skip unless a newcomer
+		best, dist := self, o.router.Distance(self, top.Self())
+		for _, id := range leaves {
+			if d := o.router.Distance(id, top.Self()); d.Cmp(dist) < 0 {
+				best, dist = id, d
+			}
+		}
+		if !contains(joined, best) {
+			continue
+		}
+		log.Printf("scribe: %v handing topic %v over to joined node %v.", self, top.Self(), best)
+
+		ids := []*big.Int{best}
+		rep := &report{
+			Tops:    []*big.Int{top.Self()},
+			Caps:    []int{top.Capacity()},
+			Sizes:   top.GenerateSizes(ids),
+			Filts:   top.GenerateFilters(ids),
+			Loads:   top.GenerateLoads(ids),
+			Zones:   top.GenerateZones(ids),
+			Lats:    top.GenerateLatencies(ids),
+			Depths:  top.GenerateDepths(ids),
+			Metrics: top.GenerateMetrics(ids),
+		}
+		go o.sendHandover(best, top.Self(), rep)
+	}
+}
+
+// Takes over the rendez-vous role of a topic from its previous root, adopting it
+// as a child and seeding its subtree state from the pushed snapshot. Handovers
+// are declined if the local node is not closer to the topic, or if it is already
+// grafted into the tree elsewhere (the root re-subscriptions will merge them).
+func (o *Overlay) handleHandover(src *big.Int, topicId *big.Int, rep *report) error {
+	self := o.router.Self()
+	if o.router.Distance(self, topicId).Cmp(o.router.Distance(src, topicId)) >= 0 {
+		log.Printf("scribe: %v declining handover of topic %v: %v is closer.", self, topicId, src)
+		return nil
+	}
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+
+	if ok {
+		if top.Child(src) {
+			return o.handleReport(src, rep)
+		}
+		if parent := top.Parent(); parent != nil && parent.Cmp(src) != 0 {
+			log.Printf("scribe: %v declining handover of topic %v: already grafted below %v.", self, topicId, parent)
+			return nil
+		}
+	}
+	// Adopt the previous root (breaking up any link to it as the parent), and
+	// seed the subtree state unless it was redirected elsewhere
+	hand, err := o.handleSubscribe(src, topicId, false)
+	if err != nil || !hand {
+		return err
+	}
+	return o.handleReport(src, rep)
+}
@@ -0,0 +1,112 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Tests that a topic root hands its tree over to a closer joining node right
+// away, without waiting for the periodic root re-subscriptions.
+func TestHandover(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < 2; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Create the old root and the joining node, disabling the re-subscriptions
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	root, joiner := New(overId, key, coll), New(overId, key, coll)
+	for _, node := range []*Overlay{root, joiner} {
+		timing := node.Timing()
+		timing.Maintain = 1000
+		if err := node.SetTiming(timing); err != nil {
+			t.Fatalf("failed to disable root re-subscriptions: %v.", err)
+		}
+	}
+	// Pick a topic the joining node will be closer to
+	topic := ""
+	for i := 0; ; i++ {
+		topic = fmt.Sprintf("handover-%d", i)
+		id := overlay.Resolve(topic)
+		if pastry.Distance(joiner.Self(), id).Cmp(pastry.Distance(root.Self(), id)) < 0 {
+			break
+		}
+	}
+	// Subscribe the lone node, and join the closer one afterwards
+	if _, err := root.Boot(); err != nil {
+		t.Fatalf("failed to boot scribe node: %v.", err)
+	}
+	defer root.Shutdown()
+
+	if err := root.Subscribe(topic); err != nil {
+		t.Fatalf("failed to subscribe to topic: %v.", err)
+	}
+	time.Sleep(time.Second)
+
+	if _, err := joiner.Boot(); err != nil {
+		t.Fatalf("failed to boot scribe node: %v.", err)
+	}
+	defer joiner.Shutdown()
+	time.Sleep(time.Second)
+
+	// Verify that the tree was handed over and events are delivered
+	if snap, err := joiner.Inspect(topic); err != nil {
+		t.Fatalf("handed over topic missing: %v.", err)
+	} else if snap.Parent != nil || len(snap.Children) != 1 || snap.Children[0].Cmp(root.Self()) != 0 {
+		t.Fatalf("new root links mismatch: have parent %v, children %v; want none, [%v].", snap.Parent, snap.Children, root.Self())
+	} else if snap.Size != 1 {
+		t.Fatalf("new root member count mismatch: have %v, want %v.", snap.Size, 1)
+	}
+	if snap, err := root.Inspect(topic); err != nil {
+		t.Fatalf("old root lost the topic: %v.", err)
+	} else if snap.Parent == nil || snap.Parent.Cmp(joiner.Self()) != 0 {
+		t.Fatalf("old root parent mismatch: have %v, want %v.", snap.Parent, joiner.Self())
+	}
+	if err := joiner.Publish(topic, &proto.Message{Data: []byte{0x00}}); err != nil {
+		t.Fatalf("failed to publish into topic: %v.", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != 1 {
+		t.Fatalf("delivered event mismatch: have %v, want %v.", n, 1)
+	}
+}
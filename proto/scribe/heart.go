@@ -24,14 +24,28 @@ package scribe
 import (
 	"log"
 	"math/big"
+	"time"
 
+	"github.com/project-iris/iris/balancer"
 	"github.com/project-iris/iris/config"
 )
 
 // Load report between two carrier nodes.
 type report struct {
-	Tops []*big.Int // Topics shared between two carrier nodes
-	Caps []int      // Capacity reports related to the topics above
+	Tops  []*big.Int // Topics shared between two carrier nodes
+	Caps  []int      // Capacity reports related to the topics above
+	Sizes []int      // Member counts behind the reporter for the topics above
+	Filts [][]string // Event filters of the members behind the reporter
+
+	Loads []balancer.Load // Resource usage of the least loaded member behind the reporter
+	Zones []string        // Common zone of the members behind the reporter (empty if mixed)
+	Lats  []time.Duration // Reply latency of the fastest member behind the reporter
+
+	Depths []int // Distance of the reporter from the topic roots
+
+	Metrics []map[string]float64 // Summed custom metrics of the members behind the reporter
+
+	Redirect bool // Flag whether the reporter adopted a redirected subscription of the recipient
 }
 
 // Adds the node within the topic to the list of monitored entities.
@@ -52,28 +66,77 @@ func (o *Overlay) ping(topic *big.Int, node *big.Int) error {
 	return o.heart.Ping(id)
 }
 
-// Implements the heart.Callback.Beat method. At each heartbeat, the load stats
-// of all the topics are gathered, mapped to destination nodes and sent out. In
-// addition, each root topic sends a subscription message to discover newly
-// added roots.
+// Implements the heart.Callback.Beat method. Every few heartbeats (as set by
+// the carrier timing), the load stats of all the topics are gathered, mapped to
+// destination nodes and sent out (along with the root replicas to the standby
+// nodes), each root topic sends a subscription message to discover newly added
+// roots and the tree links are verified with neighbors. Local registrations are
+// renewed or dropped on every beat, depending on their liveness, and the roots
+// are handed over to any closer node that joined.
 func (o *Overlay) Beat() {
+	// Renew the live topics and reclaim the abandoned ones (upper layer and
+	// unsubscribing lock internally)
+	o.renewLeases()
+	o.expireLeases()
+
+	// Refresh the custom metrics and latencies of the local members (upper layer
+	// locks too)
+	o.collectMetrics()
+
+	// Query the local message backlog, the standbys and the leaf set before
+	// locking (lower and upper layers lock too)
+	depth := 0
+	if probe := o.loadProbe(); probe != nil {
+		depth = probe()
+	}
+	leaves := o.router.Leaves(o.Replicas())
+	peers := o.router.Leaves(config.PastryLeaves)
+
 	o.lock.RLock()
 	defer o.lock.RUnlock()
 
-	// Collect and assemble load reports
+	o.beats++
+	o.handover(peers)
+	if o.beats%o.timing.Report == 0 {
+		o.distributeReports(depth)
+		o.replicate(leaves)
+	}
+	if o.beats%o.timing.Repair == 0 {
+		o.verifyLinks()
+	}
+	if o.beats%o.timing.Maintain == 0 {
+		o.resubscribeRoots()
+	}
+}
+
+// Collects, assembles and distributes the load reports of all the topics. The
+// overlay lock is assumed read locked.
+func (o *Overlay) distributeReports(depth int) {
 	reports := make(map[string]*report)
 	for _, top := range o.topics {
 		ids, caps := top.GenerateReports()
+		sizes, filts := top.GenerateSizes(ids), top.GenerateFilters(ids)
+		loads, zones := top.GenerateLoads(ids), top.GenerateZones(ids)
+		depths, metrics := top.GenerateDepths(ids), top.GenerateMetrics(ids)
+		lats := top.GenerateLatencies(ids)
 		for i, id := range ids {
 			sid := id.String()
 			rep, ok := reports[id.String()]
 			if !ok {
-				rep = &report{[]*big.Int{}, []int{}}
+				rep = &report{[]*big.Int{}, []int{}, []int{}, [][]string{}, []balancer.Load{}, []string{}, []time.Duration{}, []int{}, []map[string]float64{}, false}
 				reports[sid] = rep
 			}
 			rep.Tops = append(rep.Tops, top.Self())
 			rep.Caps = append(rep.Caps, caps[i])
+			rep.Sizes = append(rep.Sizes, sizes[i])
+			rep.Filts = append(rep.Filts, filts[i])
+			rep.Loads = append(rep.Loads, loads[i])
+			rep.Zones = append(rep.Zones, zones[i])
+			rep.Lats = append(rep.Lats, lats[i])
+			rep.Depths = append(rep.Depths, depths[i])
+			rep.Metrics = append(rep.Metrics, metrics[i])
 		}
+		top.SetQueue(depth)
 		top.Cycle()
 	}
 	// Distribute the load reports to the remote carriers
@@ -84,7 +147,23 @@ func (o *Overlay) Beat() {
 			panic("failed to extract node id.")
 		}
 	}
-	// Subscribe all root topics
+}
+
+// Cross checks the tree links with the neighbors. The overlay lock is assumed
+// read locked.
+func (o *Overlay) verifyLinks() {
+	for sid, dig := range o.generateDigests() {
+		if id, ok := new(big.Int).SetString(sid, 10); ok {
+			go o.sendVerify(id, dig)
+		} else {
+			panic("failed to extract node id.")
+		}
+	}
+}
+
+// Subscribes all root topics to discover newly added roots. The overlay lock is
+// assumed read locked.
+func (o *Overlay) resubscribeRoots() {
 	for _, top := range o.topics {
 		if top.Parent() == nil {
 			go o.sendSubscribe(top.Self())
@@ -95,11 +174,24 @@ func (o *Overlay) Beat() {
 // Implements the heat.Callback.Dead method, monitoring the death events of
 // topic member nodes.
 func (o *Overlay) Dead(id *big.Int) {
+	// Dead topic roots are handled by the standby mechanism
+	flag := standbyFlag()
+	if id.Cmp(flag) >= 0 {
+		if err := o.heart.Unmonitor(id); err != nil {
+			log.Printf("scribe: failed to unmonitor dead root: %v.", err)
+		}
+		id = new(big.Int).Sub(id, flag)
+		topic := new(big.Int).Rsh(id, uint(config.PastrySpace))
+		root := new(big.Int).Sub(id, new(big.Int).Lsh(topic, uint(config.PastrySpace)))
+
+		o.takeover(topic, root)
+		return
+	}
 	// Split the id into topic and node parts
 	topic := new(big.Int).Rsh(id, uint(config.PastrySpace))
 	node := new(big.Int).Sub(id, new(big.Int).Lsh(topic, uint(config.PastrySpace)))
 
-	log.Printf("scribe: %v topic member death report: %v.", o.pastry.Self(), node)
+	log.Printf("scribe: %v topic member death report: %v.", o.router.Self(), node)
 
 	o.lock.RLock()
 	top, ok := o.topics[topic.String()]
@@ -0,0 +1,115 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the hierarchical topic support: topics registered under a
+// hierarchical root prefix are organized into a tree of names, where events
+// published into a topic cascade up into all of its ancestors. Each level is a
+// separate carrier tree, so subscribers only ever join the level they need.
+
+package scribe
+
+import (
+	"strings"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Registers a topic name prefix under which topics are hierarchical: events
+// published into prefix+"a/b/c" also reach the subscribers of prefix+"a/b" and
+// prefix+"a". The prefix itself is never part of the hierarchy.
+func (o *Overlay) SetHierarchical(prefix string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, root := range o.roots {
+		if root == prefix {
+			return
+		}
+	}
+	o.roots = append(o.roots, prefix)
+}
+
+// Returns the topic and all its ancestors (closest first) that a publish into
+// topic is delivered to.
+func (o *Overlay) Lineage(topic string) []string {
+	lineage := []string{topic}
+	for parent, ok := o.ancestor(topic); ok; parent, ok = o.ancestor(parent) {
+		lineage = append(lineage, parent)
+	}
+	return lineage
+}
+
+// Returns the parent of a topic in the name hierarchy, or false if the topic
+// is flat or a top level one.
+func (o *Overlay) ancestor(topic string) (string, bool) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	// Find the longest hierarchical root of the topic
+	root := -1
+	for _, prefix := range o.roots {
+		if len(prefix) > root && strings.HasPrefix(topic, prefix) {
+			root = len(prefix)
+		}
+	}
+	if root < 0 {
+		return "", false
+	}
+	// Strip the last level off the topic, if any
+	idx := strings.LastIndex(topic[root:], config.ScribeTopicSeparator)
+	if idx <= 0 {
+		return "", false
+	}
+	return topic[:root+idx], true
+}
+
+// Returns the hierarchical name to attach to a publish into topic, or the empty
+// string if no ancestors need to be reached.
+func (o *Overlay) scope(topic string) string {
+	if _, ok := o.ancestor(topic); ok {
+		return topic
+	}
+	return ""
+}
+
+// Cascades a virgin publish that entered its topic tree (or reached the topic
+// rendez-vous point) up into the parent topic, if hierarchical. The original
+// sender is retained to allow upper layers to detect locally served events.
+func (o *Overlay) cascade(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	if head.Name == "" {
+		return
+	}
+	parent, ok := o.ancestor(head.Name)
+	if !ok {
+		return
+	}
+	// Assemble a fresh virgin publish towards the parent topic (or its shards)
+	for _, id := range o.resolveAll(parent) {
+		up := head.copy()
+		up.Topic, up.Prev, up.Confirm = id, nil, 0
+		up.Name = o.scope(parent)
+
+		cpy := new(proto.Message)
+		*cpy = *msg
+		cpy.Head.Meta = up
+
+		go o.send(up.Topic, cpy)
+	}
+}
@@ -0,0 +1,133 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Scribe callback counting the published events per topic.
+type counter struct {
+	events map[string]int
+	lock   sync.Mutex
+}
+
+func (c *counter) HandlePublish(sender *big.Int, topic string, msg *proto.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.events[topic]++
+}
+
+func (c *counter) HandleBalance(sender *big.Int, topic string, msg *proto.Message) {}
+func (c *counter) HandleDirect(sender *big.Int, msg *proto.Message)                {}
+func (c *counter) HandleBounce(msg *proto.Message)                                 {}
+
+// Tests whether the topic name hierarchy is resolved correctly.
+func TestLineage(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+	node := New(overId, key, &counter{})
+	node.SetHierarchical("h#")
+
+	tests := []struct {
+		topic   string
+		lineage []string
+	}{
+		{"flat/topic", []string{"flat/topic"}},
+		{"h#a", []string{"h#a"}},
+		{"h#a/b/c", []string{"h#a/b/c", "h#a/b", "h#a"}},
+		{"h#/a", []string{"h#/a"}},
+	}
+	for i, tt := range tests {
+		lineage := node.Lineage(tt.topic)
+		if len(lineage) != len(tt.lineage) {
+			t.Fatalf("test %d: lineage mismatch: have %v, want %v.", i, lineage, tt.lineage)
+		}
+		for j, name := range tt.lineage {
+			if lineage[j] != name {
+				t.Fatalf("test %d: lineage mismatch: have %v, want %v.", i, lineage, tt.lineage)
+			}
+		}
+	}
+}
+
+// Tests whether events published into a topic reach the ancestor subscribers.
+func TestHierarchy(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	topics := []string{"h#a", "h#a/b", "h#a/b/c", "h#a/x"}
+	nodes := len(topics) + 1
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, one subscriber per topic
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &counter{events: make(map[string]int)}
+	live := make([]*Overlay, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		node.SetHierarchical("h#")
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+	for i, topic := range topics {
+		if err := live[i].Subscribe(topic); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish into the deepest topic from the non-subscribed node
+	for i := 0; i < pubs; i++ {
+		if err := live[nodes-1].Publish("h#a/b/c", &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to publish into topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+
+	wants := map[string]int{"h#a": pubs, "h#a/b": pubs, "h#a/b/c": pubs, "h#a/x": 0}
+	for topic, want := range wants {
+		if have := coll.events[topic]; have != want {
+			t.Fatalf("event count mismatch for %s: have %v, want %v.", topic, have, want)
+		}
+	}
+}
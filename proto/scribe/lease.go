@@ -0,0 +1,113 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the topic registration leases, reclaiming the subscriptions
+// of the local clients that vanished without unsubscribing. Leases are renewed
+// by the carrier heartbeats for as long as the upper layer reports the topics as
+// live, so a crashed client's registration is pruned within one lease duration.
+
+package scribe
+
+import (
+	"log"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Extends the lease of a local topic registration by the configured duration.
+func (o *Overlay) Renew(topic string) error {
+	sid := o.resolve(topic).String()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, ok := o.leases[sid]; !ok {
+		return ErrNotParticipating
+	}
+	o.leases[sid] = time.Now().Add(config.ScribeTopicLease)
+	return nil
+}
+
+// Sets a probe reporting whether a topic still has live local members, in which
+// case its lease is renewed on every carrier heartbeat.
+func (o *Overlay) SetLeaseProbe(probe func(topic string) bool) {
+	o.probeLock.Lock()
+	defer o.probeLock.Unlock()
+
+	o.lease = probe
+}
+
+// Retrieves the upper layer lease probe, if any.
+func (o *Overlay) leaseProbe() func(topic string) bool {
+	o.probeLock.RLock()
+	defer o.probeLock.RUnlock()
+
+	return o.lease
+}
+
+// Queries the upper layer for the liveness of the local topic registrations and
+// extends the leases of the live ones. The probe is called without the overlay
+// lock held, as the upper layer locks too.
+func (o *Overlay) renewLeases() {
+	probe := o.leaseProbe()
+	if probe == nil || config.ScribeTopicLease == 0 {
+		return
+	}
+	// Snapshot the leased registrations
+	o.lock.RLock()
+	topics := make([]string, 0, len(o.leases))
+	for sid := range o.leases {
+		topics = append(topics, o.names[sid])
+	}
+	o.lock.RUnlock()
+
+	// Renew the live ones, ignoring any unsubscribed meanwhile
+	for _, topic := range topics {
+		if probe(topic) {
+			o.Renew(topic)
+		}
+	}
+}
+
+// Unsubscribes all the local topic registrations whose lease ran out without
+// being renewed. Leasing is disabled if the configured lifetime is zero.
+func (o *Overlay) expireLeases() {
+	if config.ScribeTopicLease == 0 {
+		return
+	}
+	// Collect the expired topics
+	now := time.Now()
+	expired := []string{}
+
+	o.lock.RLock()
+	for sid, expiry := range o.leases {
+		if now.After(expiry) {
+			expired = append(expired, o.names[sid])
+		}
+	}
+	o.lock.RUnlock()
+
+	// Drop the local registrations, reclaiming the tree state
+	for _, topic := range expired {
+		log.Printf("scribe: topic %s lease expired, unsubscribing.", topic)
+		if err := o.Unsubscribe(topic); err != nil {
+			log.Printf("scribe: failed to unsubscribe expired topic: %v.", err)
+		}
+	}
+}
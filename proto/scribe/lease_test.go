@@ -0,0 +1,144 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that abandoned topic registrations are expired and reclaimed, whereas
+// the renewed ones are retained.
+func TestLease(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	oldLease := config.ScribeTopicLease
+	config.ScribeTopicLease = time.Second
+	defer func() { config.ScribeTopicLease = oldLease }()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	config.BootPorts = append(config.BootPorts, 65500)
+
+	// Load the private key and start up a single scribe node
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	node := New(overId, key, coll)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot scribe node: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Subscribe to two topics, but renew only one of them
+	kept, dropped := "lease-kept", "lease-dropped"
+	for _, topic := range []string{kept, dropped} {
+		if err := node.Subscribe(topic); err != nil {
+			t.Fatalf("failed to subscribe to topic %s: %v.", topic, err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		time.Sleep(config.ScribeTopicLease / 4)
+		if err := node.Renew(kept); err != nil {
+			t.Fatalf("failed to renew topic lease: %v.", err)
+		}
+	}
+	// Verify that only the renewed topic survived
+	node.lock.RLock()
+	_, keptOk := node.topics[overlay.Resolve(kept).String()]
+	_, droppedOk := node.topics[overlay.Resolve(dropped).String()]
+	node.lock.RUnlock()
+
+	if !keptOk {
+		t.Fatalf("renewed topic expired.")
+	}
+	if droppedOk {
+		t.Fatalf("abandoned topic not reclaimed.")
+	}
+	if err := node.Renew(dropped); err != ErrNotParticipating {
+		t.Fatalf("expired lease renewal error mismatch: have %v, want %v.", err, ErrNotParticipating)
+	}
+}
+
+// Tests that the carrier heartbeats renew the leases of the topics reported live
+// by the upper layer probe, reclaiming the rest.
+func TestLeaseProbe(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	oldLease := config.ScribeTopicLease
+	config.ScribeTopicLease = time.Second
+	defer func() { config.ScribeTopicLease = oldLease }()
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+	config.BootPorts = append(config.BootPorts, 65500)
+
+	// Load the private key and start up a single scribe node
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	node := New(overId, key, coll)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot scribe node: %v.", err)
+	}
+	defer node.Shutdown()
+
+	// Subscribe to two topics, but report only one of them as live
+	kept, dropped := "lease-kept", "lease-dropped"
+	node.SetLeaseProbe(func(topic string) bool { return topic == kept })
+
+	for _, topic := range []string{kept, dropped} {
+		if err := node.Subscribe(topic); err != nil {
+			t.Fatalf("failed to subscribe to topic %s: %v.", topic, err)
+		}
+	}
+	time.Sleep(2 * config.ScribeTopicLease)
+
+	// Verify that only the live topic survived
+	node.lock.RLock()
+	_, keptOk := node.topics[overlay.Resolve(kept).String()]
+	_, droppedOk := node.topics[overlay.Resolve(dropped).String()]
+	node.lock.RUnlock()
+
+	if !keptOk {
+		t.Fatalf("live topic expired.")
+	}
+	if droppedOk {
+		t.Fatalf("abandoned topic not reclaimed.")
+	}
+}
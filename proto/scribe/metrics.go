@@ -0,0 +1,114 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the collection of the custom application metrics and the
+// reply latencies of the local topic members, which are attached to the periodic
+// load reports. The reported latencies of directly connected nodes are extended
+// with the measured network round trips towards them.
+
+package scribe
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto/scribe/topic"
+)
+
+// Sets a probe reporting the custom metrics of the local members of a topic,
+// attached to the load reports and summed up along the topic trees.
+func (o *Overlay) SetMetricsProbe(probe func(topic string) map[string]float64) {
+	o.probeLock.Lock()
+	defer o.probeLock.Unlock()
+
+	o.metrics = probe
+}
+
+// Retrieves the upper layer metrics probe, if any.
+func (o *Overlay) metricsProbe() func(topic string) map[string]float64 {
+	o.probeLock.RLock()
+	defer o.probeLock.RUnlock()
+
+	return o.metrics
+}
+
+// Sets a probe reporting the reply latency of the local members of a topic,
+// consumed by the latency adaptive balancers along the topic trees.
+func (o *Overlay) SetLatencyProbe(probe func(topic string) time.Duration) {
+	o.probeLock.Lock()
+	defer o.probeLock.Unlock()
+
+	o.latency = probe
+}
+
+// Retrieves the upper layer latency probe, if any.
+func (o *Overlay) latencyProbe() func(topic string) time.Duration {
+	o.probeLock.RLock()
+	defer o.probeLock.RUnlock()
+
+	return o.latency
+}
+
+// Queries the upper layer for the custom metrics and reply latencies of the
+// locally registered topics and updates them in the topic trees. The probes are
+// called without the overlay lock held, as the upper layer locks too.
+func (o *Overlay) collectMetrics() {
+	metrics, latency := o.metricsProbe(), o.latencyProbe()
+	if metrics == nil && latency == nil {
+		return
+	}
+	// Snapshot the local registrations
+	tops := make(map[string]*topic.Topic)
+
+	o.lock.RLock()
+	for sid, name := range o.names {
+		if top, ok := o.topics[sid]; ok {
+			tops[name] = top
+		}
+	}
+	o.lock.RUnlock()
+
+	// Probe and update each of them
+	for name, top := range tops {
+		if metrics != nil {
+			top.SetMetrics(metrics(name))
+		}
+		if latency != nil {
+			top.SetLatency(latency(name))
+		}
+	}
+}
+
+// Retrieves the measured round trip time and probe loss rate of a directly
+// connected overlay peer, if available (pastry only).
+func (o *Overlay) Proximity(id *big.Int) (time.Duration, float64, bool) {
+	return o.router.Proximity(id)
+}
+
+// Extends the reply latency reported by a node with the measured network round
+// trip towards it (inflated by the probe loss), so the latency adaptive balancers
+// account for the links too. Missing reports and unmeasured links are left as is.
+func (o *Overlay) linkLatency(id *big.Int, latency time.Duration) time.Duration {
+	if latency <= 0 {
+		return latency
+	}
+	if rtt, loss, ok := o.router.Proximity(id); ok {
+		latency = time.Duration(float64(latency+rtt) * (1 + loss))
+	}
+	return latency
+}
@@ -23,25 +23,30 @@ package scribe
 import (
 	"crypto/rsa"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/heart"
 	"github.com/project-iris/iris/proto"
-	"github.com/project-iris/iris/proto/pastry"
+	"github.com/project-iris/iris/proto/overlay"
 	"github.com/project-iris/iris/proto/scribe/topic"
 )
 
 // Custom topic error messages
 var ErrSubscribed = errors.New("already subscribed")
+var ErrTimeout = errors.New("confirmation timeout")
+var ErrNotParticipating = errors.New("not in topic tree")
 
 // Callback for events leaving the overlay network.
 type Callback interface {
 	HandlePublish(sender *big.Int, topic string, msg *proto.Message)
 	HandleBalance(sender *big.Int, topic string, msg *proto.Message)
 	HandleDirect(sender *big.Int, msg *proto.Message)
+	HandleBounce(msg *proto.Message)
 }
 
 // The overlay implementation, receiving the overlay events and processing
@@ -49,12 +54,46 @@ type Callback interface {
 type Overlay struct {
 	app Callback // Upstream application callback
 
-	pastry *pastry.Overlay // Overlay network to route the messages
-	heart  *heart.Heart    // Heartbeat mechanism
+	router Router       // Overlay network to route the messages
+	broken error        // Failure creating the router, reported on boot
+	heart  *heart.Heart // Heartbeat mechanism
 
 	topics map[string]*topic.Topic // Topics active in the local node
 	names  map[string]string       // Mapping from topic id to its textual name
 
+	confIdx  uint64                   // Id of the next publish confirmation
+	confLive map[uint64]chan struct{} // Pending publish confirmations
+
+	queryIdx  uint64              // Id of the next member count query
+	queryLive map[uint64]chan int // Pending member count queries
+
+	traceIdx  uint64            // Id of the next publish path trace
+	traceLive map[uint64][]Path // Paths collected by the pending traces
+
+	pubIdx uint64 // Id of the last publish sent (atomic, take care)
+	dups   *dedup // Recently seen publishes to suppress duplicates of
+
+	probe     func() int                            // Upper layer probe of the queued message count
+	metrics   func(topic string) map[string]float64 // Upper layer probe of the custom member metrics
+	latency   func(topic string) time.Duration      // Upper layer probe of the member reply latencies
+	lease     func(topic string) bool               // Upper layer probe of the live local registrations
+	probeLock sync.RWMutex                          // Mutex protecting the upper layer probes
+
+	timing Timing // Timing parameters of the carrier maintenance
+	beats  int    // Heartbeats since the overlay started (beat thread only)
+
+	roots  []string       // Name prefixes under which topics are hierarchical
+	shards map[string]int // Name prefixes under which topics are sharded, with the shard counts
+
+	standbys map[string]*standby   // Root states replicated to the local node
+	replicas map[string][]*big.Int // Standby nodes of the local roots (beat thread only)
+	factor   int                   // Number of standby replicas of the local roots
+
+	leafset  []*big.Int // Leaf set seen on the previous handover check
+	leafLock sync.Mutex // Mutex serializing the handover checks
+
+	leases map[string]time.Time // Expiration times of the local topic registrations
+
 	lock sync.RWMutex
 }
 
@@ -65,21 +104,47 @@ func New(overId string, key *rsa.PrivateKey, app Callback) *Overlay {
 		app:    app,
 		topics: make(map[string]*topic.Topic),
 		names:  make(map[string]string),
+
+		confIdx:  1, // Zero is reserved for unconfirmed publishes
+		confLive: make(map[uint64]chan struct{}),
+
+		queryLive: make(map[uint64]chan int),
+
+		traceIdx:  1, // Zero is reserved for untraced publishes
+		traceLive: make(map[uint64][]Path),
+
+		dups: newDedup(config.ScribeDedupCache),
+
+		shards: make(map[string]int),
+
+		standbys: make(map[string]*standby),
+		replicas: make(map[string][]*big.Int),
+		factor:   config.ScribeStandbys,
+
+		leases: make(map[string]time.Time),
+
+		timing: defaultTiming(),
+	}
+	o.router, o.broken = newRouter(config.ScribeRouter, overId, key, o)
+	if o.broken == nil {
+		o.router.WatchLeaves(o.leavesChanged)
 	}
-	o.pastry = pastry.New(overId, key, o)
-	o.heart = heart.New(config.ScribeBeatPeriod, config.ScribeKillCount, o)
+	o.heart = heart.New(o.timing.Beat, o.timing.Kill, o)
 	return o
 }
 
 // Boots the overlay, returning the number of remote peers.
 func (o *Overlay) Boot() (int, error) {
-	log.Printf("scribe: booting with id %v.", o.pastry.Self())
+	if o.broken != nil {
+		return 0, fmt.Errorf("failed to create %s router: %v", config.ScribeRouter, o.broken)
+	}
+	log.Printf("scribe: booting with id %v.", o.router.Self())
 
 	// Start the heartbeat first since convergence can last long
 	o.heart.Start()
 
 	// Boot the overlay and wait until it converges
-	peers, err := o.pastry.Boot()
+	peers, err := o.router.Boot()
 	if err != nil {
 		return 0, err
 	}
@@ -88,69 +153,360 @@ func (o *Overlay) Boot() (int, error) {
 
 // Terminates the overlay and all lower layer network primitives.
 func (o *Overlay) Shutdown() error {
+	if o.broken != nil {
+		return o.broken
+	}
 	// Unsubscribe from all left-over topics
 	o.lock.RLock()
+	ids := make([]*big.Int, 0, len(o.names))
 	for id, topic := range o.names {
 		log.Printf("scribe: removing left-over topic %v.", topic)
 		sid, _ := new(big.Int).SetString(id, 10)
-		go o.handleUnsubscribe(o.pastry.Self(), sid)
+		ids = append(ids, sid)
 	}
 	o.lock.RUnlock()
 
+	for _, id := range ids {
+		if err := o.handleUnsubscribe(o.router.Self(), id); err != nil {
+			log.Printf("scribe: failed to remove left-over topic: %v.", err)
+		}
+	}
+	// Hand the tree positions over to the neighbors before leaving
+	o.depart()
+
 	// Terminate the heartbeat mechanism and shut down pastry
 	o.heart.Terminate()
-	return o.pastry.Shutdown()
+	return o.router.Shutdown()
+}
+
+// Returns the overlay node id of the local scribe instance.
+func (o *Overlay) Self() *big.Int {
+	return o.router.Self()
+}
+
+// Returns a channel which is closed once the local carrier node is not congested
+// (or already closed if it isn't).
+func (o *Overlay) Relief() <-chan struct{} {
+	return o.router.Relief()
+}
+
+// Captures a snapshot of the underlying overlay routing state for debugging.
+func (o *Overlay) Routing() *overlay.Snapshot {
+	return o.router.Inspect()
+}
+
+// Reports whether the underlying overlay considers itself converged, ready to
+// take its share of the traffic.
+func (o *Overlay) Status() *overlay.Status {
+	return o.router.Status()
+}
+
+// Traces the overlay route towards the node closest to dest for debugging (see
+// the Trace method of the routers).
+func (o *Overlay) TraceRoute(dest *big.Int, timeout time.Duration) ([]*overlay.TraceHop, error) {
+	return o.router.Trace(dest, timeout)
+}
+
+// Registers a hook intercepting the carrier messages passing through the local
+// node before their next overlay hop is selected.
+func (o *Overlay) BeforeRoute(hook overlay.RouteHook) {
+	o.router.BeforeRoute(hook)
+}
+
+// Registers a hook intercepting the carrier messages passing through the local
+// node after their next overlay hop was selected.
+func (o *Overlay) AfterRoute(hook overlay.RouteHook) {
+	o.router.AfterRoute(hook)
 }
 
-// Subscribes to the specified scribe topic.
+// Subscribes to the specified scribe topic. The registration is leased for the
+// configured duration, after which it expires unless renewed (either explicitly
+// or by the carrier heartbeats through the lease probe).
 func (o *Overlay) Subscribe(topic string) error {
-	// Resolve the topic id
-	id := pastry.Resolve(topic)
+	// Resolve the topic (shard) id
+	id := o.resolve(topic)
 	sid := id.String()
 
-	// Make sure we can map the id back to the textual name
-	o.lock.RLock()
-	_, ok := o.names[sid]
-	o.lock.RUnlock()
-	if !ok {
-		o.lock.Lock()
-		o.names[sid] = topic
-		o.lock.Unlock()
-	}
+	// Make sure we can map the id back to the textual name and start the lease
+	o.lock.Lock()
+	o.names[sid] = topic
+	o.leases[sid] = time.Now().Add(config.ScribeTopicLease)
+	o.lock.Unlock()
+
 	// Subscribe the local node to the topic
-	return o.handleSubscribe(o.pastry.Self(), id)
+	_, err := o.handleSubscribe(o.router.Self(), id, false)
+	return err
 }
 
 // Removes the subscription from topic.
 func (o *Overlay) Unsubscribe(topic string) error {
-	// Resolve the topic id
-	id := pastry.Resolve(topic)
+	// Resolve the topic (shard) id
+	id := o.resolve(topic)
 	sid := id.String()
 
-	// Remove the topic name mapping
+	// Remove the topic name mapping and the lease
 	o.lock.Lock()
 	delete(o.names, sid)
+	delete(o.leases, sid)
 	o.lock.Unlock()
 
 	// Remove the scribe subscription
-	return o.handleUnsubscribe(o.pastry.Self(), id)
+	return o.handleUnsubscribe(o.router.Self(), id)
+}
+
+// Sets the number of local members the node represents in a subscribed topic,
+// used when aggregating the topic member counts. Unknown topics are ignored.
+func (o *Overlay) SetWeight(topic string, weight int) {
+	o.lock.RLock()
+	top, ok := o.topics[o.resolve(topic).String()]
+	o.lock.RUnlock()
+
+	if ok {
+		top.SetWeight(weight)
+	}
+}
+
+// Sets a probe reporting the number of messages queued in the upper layers for
+// processing, attached to the resource load reports of the local members.
+func (o *Overlay) SetLoadProbe(probe func() int) {
+	o.probeLock.Lock()
+	defer o.probeLock.Unlock()
+
+	o.probe = probe
 }
 
-// Publishes a message into topic to be broadcast to everyone.
+// Retrieves the upper layer load probe, if any.
+func (o *Overlay) loadProbe() func() int {
+	o.probeLock.RLock()
+	defer o.probeLock.RUnlock()
+
+	return o.probe
+}
+
+// Sets the event filter expressions of the local members of a subscribed topic.
+// Neighbors of the topic tree are informed, so that they can stop forwarding
+// events none of the local members are interested in. Unknown topics are ignored.
+func (o *Overlay) SetFilters(topic string, exprs []string) {
+	o.lock.RLock()
+	top, ok := o.topics[o.resolve(topic).String()]
+	o.lock.RUnlock()
+
+	if ok {
+		top.SetFilters(exprs)
+	}
+}
+
+// Captures the local node's view of a topic tree, if the tree passes through it
+// (either due to local members or forwarding for others).
+func (o *Overlay) Inspect(topic string) (*topic.Snapshot, error) {
+	o.lock.RLock()
+	top, ok := o.topics[o.resolve(topic).String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		return nil, ErrNotParticipating
+	}
+	return top.Snapshot(), nil
+}
+
+// Collects the carrier statistics of a topic at the local node, if the topic
+// tree passes through it.
+func (o *Overlay) Stats(topic string) (*topic.Stats, error) {
+	o.lock.RLock()
+	top, ok := o.topics[o.resolve(topic).String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		return nil, ErrNotParticipating
+	}
+	return top.Stats(), nil
+}
+
+// Collects the carrier statistics of all the topics passing through the local
+// node, keyed by topic name if subscribed locally, or by the topic id otherwise.
+func (o *Overlay) AllStats() map[string]*topic.Stats {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	stats := make(map[string]*topic.Stats, len(o.topics))
+	for sid, top := range o.topics {
+		if name, ok := o.names[sid]; ok {
+			stats[name] = top.Stats()
+		} else {
+			stats[sid] = top.Stats()
+		}
+	}
+	return stats
+}
+
+// Retrieves the (eventually consistent) number of members in a topic. If the
+// local node is part of the topic tree, the count is answered locally, else a
+// query is sent towards the topic to be answered by the first tree node on the
+// path (or the rendez-vous point if none). Sharded topics sum up their shards.
+func (o *Overlay) Size(topic string, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	total := 0
+	for _, id := range o.resolveAll(topic) {
+		count, err := o.size(id, deadline.Sub(time.Now()))
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Retrieves the number of members in a single carrier tree.
+func (o *Overlay) size(id *big.Int, timeout time.Duration) (int, error) {
+	// Answer locally if the topic tree passes through the node
+	o.lock.RLock()
+	top, ok := o.topics[id.String()]
+	o.lock.RUnlock()
+	if ok {
+		return top.Size(), nil
+	}
+	// Create the answer channel
+	done := make(chan int, 1)
+
+	o.lock.Lock()
+	queryId := o.queryIdx
+	o.queryIdx++
+	o.queryLive[queryId] = done
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		delete(o.queryLive, queryId)
+		o.lock.Unlock()
+	}()
+	// Send the query and wait for the answer
+	o.sendQuery(id, queryId)
+
+	select {
+	case count := <-done:
+		return count, nil
+	case <-time.After(timeout):
+		return 0, ErrTimeout
+	}
+}
+
+// Publishes a message into topic to be broadcast to everyone. If the topic is
+// hierarchical, the subscribers of all its ancestors receive it too. If sharded,
+// the message is published into every shard.
 func (o *Overlay) Publish(topic string, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendPublish(pastry.Resolve(topic), msg)
+	ids := o.resolveAll(topic)
+	for i, msg := range split(msg, len(ids)) {
+		o.sendPublish(ids[i], o.scope(topic), msg)
+	}
+	return nil
+}
+
+// Publishes a message into topic to be broadcast to everyone, waiting until the
+// carrier accepts it: either the topic tree or its rendez-vous point is reached
+// (in every shard, if sharded). Note, this does not guarantee delivery to the
+// individual subscribers.
+func (o *Overlay) PublishConfirmed(topic string, msg *proto.Message, timeout time.Duration) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	// Create the confirmation channel
+	ids := o.resolveAll(topic)
+	done := make(chan struct{}, len(ids))
+
+	o.lock.Lock()
+	confId := o.confIdx
+	o.confIdx++
+	o.confLive[confId] = done
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		delete(o.confLive, confId)
+		o.lock.Unlock()
+	}()
+	// Send the publish and wait for the confirmations
+	for i, msg := range split(msg, len(ids)) {
+		o.sendConfirmedPublish(ids[i], o.scope(topic), confId, msg)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for i := 0; i < len(ids); i++ {
+		select {
+		case <-done:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
 	return nil
 }
 
-// Balances a message to one of the subscribed nodes.
+// Balances a message to one of the subscribed nodes (of a random shard, if the
+// topic is sharded).
 func (o *Overlay) Balance(topic string, msg *proto.Message) error {
 	if err := msg.Encrypt(); err != nil {
 		return err
 	}
-	o.sendBalance(pastry.Resolve(topic), msg)
+	o.sendBalance(o.resolveAny(topic, ""), msg)
+	return nil
+}
+
+// Balances a message to one of the subscribed nodes similarly to Balance, but
+// avoids the skip node wherever another member can be picked instead.
+func (o *Overlay) BalanceExcept(topic string, skip *big.Int, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendSkipBalance(o.resolveAny(topic, ""), skip, msg)
+	return nil
+}
+
+// Runs the balancer of a topic on the local node ahead of balancing a message,
+// returning the picked shard and member node (nil if the local node is outside
+// the topic tree, leaving the choice to the carrier). Balancing the message via
+// BalanceTo keeps the decision.
+func (o *Overlay) Elect(topic string) (*big.Int, *big.Int) {
+	id := o.resolveAny(topic, "")
+
+	o.lock.RLock()
+	top, ok := o.topics[id.String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		return id, nil
+	}
+	node, err := top.Balance(nil)
+	if err != nil {
+		return id, nil
+	}
+	return id, node
+}
+
+// Balances a message into a topic shard through the member node elected for it
+// (see Elect), or through the carrier if none was.
+func (o *Overlay) BalanceTo(topicId *big.Int, node *big.Int, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	if node == nil || node.Cmp(o.router.Self()) == 0 {
+		o.sendBalance(topicId, msg)
+	} else {
+		o.sendDataPacket(node, &header{Op: opBalance, Topic: topicId, Prev: o.router.Self()}, msg)
+	}
+	return nil
+}
+
+// Balances a message to one of the subscribed nodes, consistently picking the
+// same one for the same key while the topic membership is stable.
+func (o *Overlay) BalanceKeyed(topic string, key string, msg *proto.Message) error {
+	if err := msg.Encrypt(); err != nil {
+		return err
+	}
+	o.sendKeyedBalance(o.resolveAny(topic, key), key, msg)
 	return nil
 }
 
@@ -33,6 +33,7 @@ type collector struct {
 	publish []*proto.Message
 	balance []*proto.Message
 	direct  []*proto.Message
+	bounce  []*proto.Message
 	lock    sync.Mutex
 }
 
@@ -57,6 +58,13 @@ func (c *collector) HandleDirect(sender *big.Int, msg *proto.Message) {
 	c.direct = append(c.direct, msg)
 }
 
+func (c *collector) HandleBounce(msg *proto.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.bounce = append(c.bounce, msg)
+}
+
 // Tests whether topic publishing work as expected.
 func TestPublish(t *testing.T) {
 	// Override the overlay configuration
@@ -313,7 +321,7 @@ func TestDirect(t *testing.T) {
 				msg := &proto.Message{
 					Data: []byte{byte(i)},
 				}
-				if err := node.Direct(origin.pastry.Self(), msg); err != nil {
+				if err := node.Direct(origin.router.Self(), msg); err != nil {
 					t.Fatalf("failed to send direct message: %v.", err)
 				}
 			}
@@ -335,7 +343,7 @@ func TestDirect(t *testing.T) {
 				msg := &proto.Message{
 					Data: []byte{byte(i)},
 				}
-				if err := live[i].Direct(origin.pastry.Self(), msg); err != nil {
+				if err := live[i].Direct(origin.router.Self(), msg); err != nil {
 					t.Fatalf("failed to send direct message: %v.", err)
 				}
 			}
@@ -23,6 +23,7 @@ package scribe
 import (
 	"encoding/gob"
 	"math/big"
+	"sync/atomic"
 
 	"github.com/project-iris/iris/proto"
 )
@@ -38,6 +39,18 @@ const (
 	opBalance                   // Topic balance
 	opReport                    // Load report
 	opDirect                    // Direct send
+	opConfirm                   // Publish acceptance confirmation
+	opQuery                     // Topic member count query
+	opCount                     // Topic member count answer
+	opVerify                    // Tree link digest (anti-entropy)
+	opRepair                    // Disputed tree links
+	opStandby                   // Replicated topic root state
+	opAdopt                     // Orphan adoption by a standby root
+	opTrace                     // Publish path trace
+	opRedirect                  // Subscription redirected within a topic tree
+	opBounce                    // Undeliverable balance returned to the sender
+	opHandover                  // Topic state pushed to a closer rendez-vous point
+	opDepart                    // Tree position handed over by a departing node
 )
 
 // Extra headers for the scribe.
@@ -48,15 +61,37 @@ type header struct {
 	Sender *big.Int    // Origin overlay node
 
 	// Operation dependent fields
-	Topic  *big.Int // Topic id used during unsubscribing, broadcasting and balancing
-	Prev   *big.Int // Previous hop inside topic to prevent optimize routes
-	Report *report  // CPU load/capacity report
+	Id      uint64   // Sender unique id of a publish to suppress duplicates with (0 = none)
+	Topic   *big.Int // Topic id used during unsubscribing, broadcasting and balancing
+	Prev    *big.Int // Previous hop inside topic to prevent optimize routes
+	Key     string   // Affinity key of a consistently balanced message (empty = load based)
+	Bounces int      // Number of times a balanced message bounced off unreachable members
+	Skip    *big.Int // Member node a balanced message should avoid if others exist (nil = none)
+	Report  *report  // CPU load/capacity report
+
+	Confirm uint64 // Id of the publish confirmation requested by the sender (0 = none)
+	Trace   uint64 // Id of the publish path trace requested by the sender (0 = none)
+	Hops    []Hop  // Nodes traversed so far by a traced publish
+	Name    string // Hierarchical topic name of a publish to cascade upwards (empty = flat)
+
+	Query uint64 // Id of the member count query requested by the sender
+	Count int    // Member count answered to a query
+
+	Digest *digest // Tree links to verify or repair
+
+	Standby *standby // Replicated topic root state (or the dead root for adoptions, the orphans for departures)
+
+	Joiner *big.Int // Subscriber redirected within a topic tree
 }
 
-// Creates a copy of the header needed by the broadcast.
+// Creates a copy of the header needed by the broadcast. The traced hops are
+// duplicated too, as each copy extends its own path.
 func (h *header) copy() *header {
 	cpy := new(header)
 	*cpy = *h
+	if h.Hops != nil {
+		cpy.Hops = append([]Hop(nil), h.Hops...)
+	}
 	return cpy
 }
 
@@ -65,11 +100,18 @@ func init() {
 	gob.Register(&header{})
 }
 
+// Packs the carrier headers into the configured wire format and sends the message
+// to its destination via the overlay transport.
+func (o *Overlay) send(dest *big.Int, msg *proto.Message) {
+	pack(msg)
+	o.router.Send(dest, msg)
+}
+
 // Envelopes a scribe header into the generic packet container and sends it to
 // its destination via the overlay transport.
 func (o *Overlay) sendPacket(dest *big.Int, head *header) {
 	// Add the origin node
-	head.Sender = o.pastry.Self()
+	head.Sender = o.router.Self()
 
 	// Assemble and send the final message
 	msg := &proto.Message{
@@ -77,26 +119,26 @@ func (o *Overlay) sendPacket(dest *big.Int, head *header) {
 			Meta: head,
 		},
 	}
-	o.pastry.Send(dest, msg)
+	o.send(dest, msg)
 }
 
 // Envelopes a scribe header into an existing packet container and sends it to
 // its destination via the overlay transport.
 func (o *Overlay) sendDataPacket(dest *big.Int, head *header, msg *proto.Message) {
 	// Add the origin node and envelope the original meta
-	head.Sender = o.pastry.Self()
+	head.Sender = o.router.Self()
 	head.Meta = msg.Head.Meta
 
 	// Insert the new header and fire away
 	msg.Head.Meta = head
-	o.pastry.Send(dest, msg)
+	o.send(dest, msg)
 }
 
 // Forwards a scribe message to a new destination, leaving the original message
 // intact, except inserting the local node as the previous hop.
 func (o *Overlay) fwdDataPacket(dest *big.Int, msg *proto.Message) {
-	msg.Head.Meta.(*header).Prev = o.pastry.Self()
-	o.pastry.Send(dest, msg)
+	msg.Head.Meta.(*header).Prev = o.router.Self()
+	o.send(dest, msg)
 }
 
 // Assembles a subscription message, consisting of the subscribe opcode and send
@@ -105,6 +147,13 @@ func (o *Overlay) sendSubscribe(topicId *big.Int) {
 	o.sendPacket(topicId, &header{Op: opSubscribe})
 }
 
+// Assembles a subscription redirect message, consisting of the redirect opcode,
+// the topic and the subscriber to integrate. The message is sent precisely to
+// the tree node chosen to adopt the subscriber instead of the local one.
+func (o *Overlay) sendRedirect(dest *big.Int, topicId *big.Int, joiner *big.Int) {
+	o.sendPacket(dest, &header{Op: opRedirect, Topic: topicId, Joiner: joiner})
+}
+
 // Assembles an unsubscription message, consisting of the unsubscribe opcode
 // and desired topic to drop. The message is sent to the parent node in the
 // topic subtree.
@@ -112,10 +161,49 @@ func (o *Overlay) sendUnsubscribe(parentId *big.Int, topicId *big.Int) {
 	o.sendPacket(parentId, &header{Op: opUnsubscribe, Topic: topicId})
 }
 
-// Assembles a topic publish message, consisting of the publish opcode, and the
-// destination topic (to allow catching publishes in flight).
-func (o *Overlay) sendPublish(topicId *big.Int, msg *proto.Message) {
-	o.sendDataPacket(topicId, &header{Op: opPublish, Topic: topicId}, msg)
+// Assembles a topic publish message, consisting of the publish opcode, the
+// locally unique publish id, the destination topic (to allow catching publishes
+// in flight) and the optional hierarchical topic name to cascade along.
+func (o *Overlay) sendPublish(topicId *big.Int, name string, msg *proto.Message) {
+	pubId := atomic.AddUint64(&o.pubIdx, 1)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Id: pubId, Topic: topicId, Name: name}, msg)
+}
+
+// Assembles a confirmation publish message, consisting of the publish opcode,
+// the locally unique publish id, the destination topic, the optional hierarchical
+// topic name to cascade along and the confirmation id requested back.
+func (o *Overlay) sendConfirmedPublish(topicId *big.Int, name string, confId uint64, msg *proto.Message) {
+	pubId := atomic.AddUint64(&o.pubIdx, 1)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Id: pubId, Topic: topicId, Name: name, Confirm: confId}, msg)
+}
+
+// Assembles a traced publish message, consisting of the publish opcode, the
+// locally unique publish id, the destination topic, the optional hierarchical
+// topic name to cascade along and the trace id requested back.
+func (o *Overlay) sendTracedPublish(topicId *big.Int, name string, traceId uint64, msg *proto.Message) {
+	pubId := atomic.AddUint64(&o.pubIdx, 1)
+	o.sendDataPacket(topicId, &header{Op: opPublish, Id: pubId, Topic: topicId, Name: name, Trace: traceId, Hops: []Hop{}}, msg)
+}
+
+// Assembles a publish path trace message and sends it to the original sender.
+func (o *Overlay) sendTrace(nodeId *big.Int, traceId uint64, hops []Hop) {
+	o.sendPacket(nodeId, &header{Op: opTrace, Trace: traceId, Hops: hops})
+}
+
+// Assembles a publish confirmation message and sends it to the original sender.
+func (o *Overlay) sendConfirm(nodeId *big.Int, confId uint64) {
+	o.sendPacket(nodeId, &header{Op: opConfirm, Confirm: confId})
+}
+
+// Assembles a member count query, consisting of the query opcode, the topic to
+// count (to allow catching queries in flight) and the query id requested back.
+func (o *Overlay) sendQuery(topicId *big.Int, queryId uint64) {
+	o.sendPacket(topicId, &header{Op: opQuery, Topic: topicId, Query: queryId})
+}
+
+// Assembles a member count answer and sends it to the original querier.
+func (o *Overlay) sendCount(nodeId *big.Int, queryId uint64, count int) {
+	o.sendPacket(nodeId, &header{Op: opCount, Query: queryId, Count: count})
 }
 
 // Reroutes a publish message to a new destination to traverse the topic tree
@@ -131,6 +219,36 @@ func (o *Overlay) sendBalance(topicId *big.Int, msg *proto.Message) {
 	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId}, msg)
 }
 
+// Bounces an undeliverable balance message back to the balancer that picked the
+// unreachable target, inserting the target as the previous hop to exclude it.
+func (o *Overlay) fwdBounce(balancer *big.Int, target *big.Int, msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	head.Prev, head.Bounces = target, head.Bounces+1
+	o.send(balancer, msg)
+}
+
+// Returns an undeliverable balance message to its original sender, consisting
+// of the bounce opcode and the original headers and payload.
+func (o *Overlay) sendBounce(msg *proto.Message) {
+	head := msg.Head.Meta.(*header)
+	head.Op = opBounce
+	o.send(head.Sender, msg)
+}
+
+// Assembles a topic balance message avoiding a member node, consisting of the
+// balance opcode, the originating application, the destination topic and the
+// node to skip if possible.
+func (o *Overlay) sendSkipBalance(topicId *big.Int, skip *big.Int, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Skip: skip}, msg)
+}
+
+// Assembles a keyed topic balance message, consisting of the balance opcode,
+// the originating application, the destination topic and the affinity key to
+// pick the recipient member by.
+func (o *Overlay) sendKeyedBalance(topicId *big.Int, key string, msg *proto.Message) {
+	o.sendDataPacket(topicId, &header{Op: opBalance, Topic: topicId, Key: key}, msg)
+}
+
 // Reroutes a balanced message to a new destination to traverse the topic tree
 // directly instead of going up till he root and back down.
 func (o *Overlay) fwdBalance(dest *big.Int, msg *proto.Message) {
@@ -142,6 +260,41 @@ func (o *Overlay) sendReport(nodeId *big.Int, rep *report) {
 	o.sendPacket(nodeId, &header{Op: opReport, Report: rep})
 }
 
+// Assembles a tree link digest message and sends it to a neighbor to verify.
+func (o *Overlay) sendVerify(nodeId *big.Int, dig *digest) {
+	o.sendPacket(nodeId, &header{Op: opVerify, Digest: dig})
+}
+
+// Assembles a tree repair message with the disputed links and sends it back to
+// the neighbor that requested verification.
+func (o *Overlay) sendRepair(nodeId *big.Int, dig *digest) {
+	o.sendPacket(nodeId, &header{Op: opRepair, Digest: dig})
+}
+
+// Assembles a topic root replication message and sends it to a standby node.
+func (o *Overlay) sendStandby(nodeId *big.Int, topicId *big.Int, state *standby) {
+	o.sendPacket(nodeId, &header{Op: opStandby, Topic: topicId, Standby: state})
+}
+
+// Assembles a handover message, consisting of the handover opcode, the topic and
+// the tree state snapshot of the previous root, and sends it to the new one.
+func (o *Overlay) sendHandover(nodeId *big.Int, topicId *big.Int, rep *report) {
+	o.sendPacket(nodeId, &header{Op: opHandover, Topic: topicId, Report: rep})
+}
+
+// Assembles a departure message, consisting of the depart opcode, the topic and
+// the children of the departing node (and itself as the root if so), and sends
+// it to the node taking over its tree position.
+func (o *Overlay) sendDepart(nodeId *big.Int, topicId *big.Int, state *standby) {
+	o.sendPacket(nodeId, &header{Op: opDepart, Topic: topicId, Standby: state})
+}
+
+// Assembles an adoption message, consisting of the adopt opcode, the orphaned
+// topic and the dead root, and sends it to an orphaned child.
+func (o *Overlay) sendAdopt(nodeId *big.Int, topicId *big.Int, root *big.Int) {
+	o.sendPacket(nodeId, &header{Op: opAdopt, Topic: topicId, Standby: &standby{Root: root}})
+}
+
 // Sends out a message directed to a specific node.
 func (o *Overlay) sendDirect(dest *big.Int, msg *proto.Message) {
 	o.sendDataPacket(dest, &header{Op: opDirect}, msg)
@@ -0,0 +1,135 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the anti-entropy mechanism of the topic trees: neighbors
+// periodically exchange digests of the links they believe to have with each
+// other, and any disagreement is repaired by re-grafting orphaned subtrees or
+// dropping stale children. Heartbeats only detect dead links, so without this
+// a subtree whose parent silently lost track of it (or a parent cycle formed by
+// racing reports during churn) could go on living without receiving anything.
+
+package scribe
+
+import (
+	"log"
+	"math/big"
+)
+
+// Tree link digest between two carrier nodes. When sent for verification, it
+// lists all the links the sender believes in; when sent back as a repair, only
+// the disputed ones.
+type digest struct {
+	Parents  []*big.Int // Topics in which the sender is a child of the recipient
+	Children []*big.Int // Topics in which the sender is the parent of the recipient
+}
+
+// Assembles the tree link digests of all the topics, mapped to the neighbors.
+// The caller is expected to hold at least a read lock on the overlay.
+func (o *Overlay) generateDigests() map[string]*digest {
+	digests := make(map[string]*digest)
+	fetch := func(id *big.Int) *digest {
+		dig, ok := digests[id.String()]
+		if !ok {
+			dig = &digest{[]*big.Int{}, []*big.Int{}}
+			digests[id.String()] = dig
+		}
+		return dig
+	}
+	for _, top := range o.topics {
+		snap := top.Snapshot()
+		if snap.Parent != nil {
+			dig := fetch(snap.Parent)
+			dig.Parents = append(dig.Parents, top.Self())
+		}
+		for _, child := range snap.Children {
+			dig := fetch(child)
+			dig.Children = append(dig.Children, top.Self())
+		}
+	}
+	return digests
+}
+
+// Cross checks a remote node's tree link digest with the local topics, sending
+// back any links the local node does not agree with.
+func (o *Overlay) handleVerify(src *big.Int, dig *digest) {
+	disputed := &digest{[]*big.Int{}, []*big.Int{}}
+
+	// Remote considers the local node its parent, make sure it's tracked as a child
+	for _, id := range dig.Parents {
+		o.lock.RLock()
+		top, ok := o.topics[id.String()]
+		o.lock.RUnlock()
+
+		if !ok || !top.Child(src) {
+			disputed.Parents = append(disputed.Parents, id)
+		}
+	}
+	// Remote considers the local node its child, make sure it's not someone else's.
+	// Parentless topics are left alone, they'll adopt the remote on its next report.
+	for _, id := range dig.Children {
+		o.lock.RLock()
+		top, ok := o.topics[id.String()]
+		o.lock.RUnlock()
+
+		if !ok {
+			disputed.Children = append(disputed.Children, id)
+		} else if parent := top.Parent(); parent != nil && parent.Cmp(src) != 0 {
+			disputed.Children = append(disputed.Children, id)
+		}
+	}
+	if len(disputed.Parents) > 0 || len(disputed.Children) > 0 {
+		o.sendRepair(src, disputed)
+	}
+}
+
+// Repairs the tree links disputed by a remote node: topics orphaned by their
+// parent are re-grafted into the tree and stale children are dropped.
+func (o *Overlay) handleRepair(src *big.Int, dig *digest) {
+	for _, id := range dig.Parents {
+		o.lock.RLock()
+		top, ok := o.topics[id.String()]
+		o.lock.RUnlock()
+
+		// Make sure the link still exists (might have been repaired since)
+		if !ok {
+			continue
+		}
+		if parent := top.Parent(); parent == nil || parent.Cmp(src) != 0 {
+			continue
+		}
+		log.Printf("scribe: %v orphaned by parent %v in topic %v, re-grafting.", o.router.Self(), src, id)
+		if err := o.unmonitor(id, src); err != nil {
+			log.Printf("scribe: failed to unmonitor stale parent: %v.", err)
+		}
+		top.Reown(nil)
+		go o.sendSubscribe(id)
+	}
+	for _, id := range dig.Children {
+		o.lock.RLock()
+		top, ok := o.topics[id.String()]
+		o.lock.RUnlock()
+
+		if !ok || !top.Child(src) {
+			continue
+		}
+		log.Printf("scribe: %v dropping stale child %v from topic %v.", o.router.Self(), src, id)
+		if err := o.handleUnsubscribe(src, id); err != nil {
+			log.Printf("scribe: failed to unsubscribe stale child: %v.", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests whether a parent cycle (undetectable by heartbeats) gets repaired.
+func TestRepair(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make(map[string]*Overlay)
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live[node.Self().String()] = node
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Find a parent-child link and corrupt it into a cycle
+	id := overlay.Resolve(topicId)
+	var child, parent *Overlay
+	for _, node := range live {
+		snap, err := node.Inspect(topicId)
+		if err != nil {
+			t.Fatalf("failed to inspect topic: %v.", err)
+		}
+		if snap.Parent != nil {
+			child, parent = node, live[snap.Parent.String()]
+			break
+		}
+	}
+	if child == nil || parent == nil {
+		t.Fatalf("failed to find parent-child link in the topic tree.")
+	}
+	parent.lock.RLock()
+	top := parent.topics[id.String()]
+	parent.lock.RUnlock()
+
+	if grand := top.Parent(); grand != nil {
+		parent.unmonitor(id, grand)
+	}
+	if err := top.Unsubscribe(child.Self()); err != nil {
+		t.Fatalf("failed to drop child: %v.", err)
+	}
+	top.Reown(child.Self())
+
+	// Wait for the anti-entropy rounds to converge the tree to a single root
+	deadline := time.Now().Add(5 * time.Duration(config.ScribeRepairBeats) * config.ScribeBeatPeriod)
+	for !converged(t, live) {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic tree failed to converge.")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Make sure events reach all the members
+	for _, node := range live {
+		for i := 0; i < pubs; i++ {
+			if err := node.Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			}
+		}
+		break
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != pubs*nodes {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, pubs*nodes)
+	}
+}
+
+// Checks whether the topic tree has consistent parent-child links and every
+// node reaches the single root.
+func converged(t *testing.T, live map[string]*Overlay) bool {
+	roots := make(map[string]struct{})
+	for _, node := range live {
+		cur := node
+		for hops := 0; ; hops++ {
+			if hops > len(live) {
+				return false
+			}
+			snap, err := cur.Inspect(topicId)
+			if err != nil {
+				t.Fatalf("failed to inspect topic: %v.", err)
+			}
+			if snap.Parent == nil {
+				break
+			}
+			parent, ok := live[snap.Parent.String()]
+			if !ok {
+				return false
+			}
+			if up, err := parent.Inspect(topicId); err != nil || !contains(up.Children, cur.Self()) {
+				return false
+			}
+			cur = parent
+		}
+		roots[cur.Self().String()] = struct{}{}
+	}
+	return len(roots) == 1
+}
@@ -0,0 +1,107 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the abstraction of the structured overlay the carrier runs
+// on top of, and the selection of its implementation by name. Proximity neighbor
+// selection, partition merging, state persistence, one-way link detection and the
+// graceful departure are pastry only, kademlia relying on the redundancy of its
+// buckets instead.
+
+package scribe
+
+import (
+	"crypto/rsa"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/kademlia"
+	"github.com/project-iris/iris/proto/overlay"
+	"github.com/project-iris/iris/proto/pastry"
+)
+
+// Names of the built in structured overlays.
+const (
+	PastryRouter   = "pastry"
+	KademliaRouter = "kademlia"
+)
+
+// Returned when the carrier is configured with an unknown overlay.
+var ErrUnknownRouter = errors.New("unknown overlay router")
+
+// Returned when the configured overlay cannot persist its state.
+var ErrNotPersistent = errors.New("overlay router state not persistent")
+
+// Structured overlay routing the carrier messages towards the nodes closest to
+// their destinations, calling back the carrier (Deliver and Forward) on the
+// final and intermediate hops respectively.
+type Router interface {
+	Boot() (int, error) // Boots the overlay, returning the number of remote peers
+	Shutdown() error    // Tears down the overlay and all its connections
+
+	Self() *big.Int                         // Returns the overlay id of the local node
+	Leaves(k int) []*big.Int                // Returns (at most) k remote nodes nearest to the local one
+	Distance(a, b *big.Int) *big.Int        // Measures the closeness of two ids in the overlay metric
+	Send(dest *big.Int, msg *proto.Message) // Routes a message towards the node closest to dest
+	Relief() <-chan struct{}                // Returns a channel closed while not congested
+	Inspect() *overlay.Snapshot             // Captures a snapshot of the routing state
+	Status() *overlay.Status                // Reports the convergence status of the local node
+
+	Trace(dest *big.Int, timeout time.Duration) ([]*overlay.TraceHop, error) // Collects the path towards dest
+	Multicast(prefix *big.Int, bits int, msg *proto.Message)                 // Delivers a message to all nodes sharing the prefix bits
+	BeforeRoute(hook overlay.RouteHook)                                      // Intercepts the messages before routing
+	AfterRoute(hook overlay.RouteHook)                                       // Intercepts the messages after routing
+	Proximity(id *big.Int) (time.Duration, float64, bool)                    // Measured round trip time and loss to a connected peer
+	WatchLeaves(hook overlay.LeafHook)                                       // Notifies of the leaf set changes
+	SetIdentitySeed(seed string)                                             // Derives the node key and id from a secret seed
+}
+
+// Structured overlay able to persist its state and node identity across restarts.
+type persistentRouter interface {
+	SetStateFile(path string) error // Adopts the identity saved in path, persisting into it
+}
+
+// Creates a new structured overlay of the named implementation, routing the
+// messages into the local carrier.
+func newRouter(name string, overId string, key *rsa.PrivateKey, o *Overlay) (Router, error) {
+	switch name {
+	case PastryRouter:
+		return pastry.New(overId, key, o), nil
+	case KademliaRouter:
+		return kademlia.New(overId, key, o), nil
+	default:
+		return nil, ErrUnknownRouter
+	}
+}
+
+// Replaces the node identity with one derived from a secret seed, yielding the
+// same overlay id across restarts and reinstalls. Must be called before booting.
+func (o *Overlay) SetIdentitySeed(seed string) {
+	o.router.SetIdentitySeed(seed)
+}
+
+// Sets the file persisting the routing state and the node identity across
+// restarts, adopting the identity saved by a previous run. Must be called
+// before booting.
+func (o *Overlay) SetStateFile(path string) error {
+	if router, ok := o.router.(persistentRouter); ok {
+		return router.SetStateFile(path)
+	}
+	return ErrNotPersistent
+}
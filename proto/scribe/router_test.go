@@ -0,0 +1,116 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/kademlia"
+)
+
+// Tests that the configured overlay is used for routing, and that an unknown one
+// fails the boot.
+func TestRouterSelection(t *testing.T) {
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	olds := config.ScribeRouter
+	defer func() { config.ScribeRouter = olds }()
+
+	config.ScribeRouter = KademliaRouter
+	if _, ok := New(overId, key, nil).router.(*kademlia.Overlay); !ok {
+		t.Fatalf("kademlia router not selected.")
+	}
+	config.ScribeRouter = "unknown"
+	if _, err := New(overId, key, nil).Boot(); err == nil {
+		t.Fatalf("booted with unknown router.")
+	}
+}
+
+// Tests that topics work on top of the kademlia overlay too.
+func TestKademliaRouter(t *testing.T) {
+	// Override the overlay configuration and select kademlia
+	swapConfigs()
+	defer swapConfigs()
+
+	olds := config.ScribeRouter
+	defer func() { config.ScribeRouter = olds }()
+	config.ScribeRouter = KademliaRouter
+
+	nodes, events := 5, 10
+
+	// Make sure there are enough ports to use
+	oldPorts := config.BootPorts
+	defer func() { config.BootPorts = oldPorts }()
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Start a handful of nodes and subscribe everyone
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	colls := make([]*collector, nodes)
+	overs := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		colls[i] = &collector{
+			publish: []*proto.Message{},
+			balance: []*proto.Message{},
+			direct:  []*proto.Message{},
+		}
+		overs[i] = New(overId, key, colls[i])
+		if _, err := overs[i].Boot(); err != nil {
+			t.Fatalf("failed to boot nodes: %v.", err)
+		}
+		defer overs[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	for i := 0; i < nodes; i++ {
+		if err := overs[i].Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Publish and balance a few events, verifying the deliveries
+	for i := 0; i < events; i++ {
+		if err := overs[i%nodes].Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to publish into topic: %v.", err)
+		}
+		if err := overs[i%nodes].Balance(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to balance into topic: %v.", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	balanced := 0
+	for i, coll := range colls {
+		coll.lock.Lock()
+		if n := len(coll.publish); n != events {
+			t.Fatalf("node #%d: delivered event mismatch: have %v, want %v.", i, n, events)
+		}
+		balanced += len(coll.balance)
+		coll.lock.Unlock()
+	}
+	if balanced != events {
+		t.Fatalf("balanced event mismatch: have %v, want %v.", balanced, events)
+	}
+}
@@ -0,0 +1,127 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the sharding of very large topics: topics registered under
+// a sharded prefix are split into multiple carrier trees, each rooted at a
+// different overlay node. Every node subscribes to a single shard (picked by its
+// own id), whereas publishes are fanned out into all of them, so no rendez-vous
+// point has to hold (and feed) the whole membership.
+
+package scribe
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Returned when setting a non-positive shard count.
+var ErrInvalidShards = errors.New("invalid shard count")
+
+// Registers a topic name prefix under which topics are split into the given
+// number of shards (1 disables sharding). All the nodes must agree on the shard
+// counts, and they must be set before subscribing to any affected topic.
+func (o *Overlay) SetSharded(prefix string, shards int) error {
+	if shards < 1 {
+		return ErrInvalidShards
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if shards == 1 {
+		delete(o.shards, prefix)
+	} else {
+		o.shards[prefix] = shards
+	}
+	return nil
+}
+
+// Returns the number of shards a topic is split into, as set by the longest
+// sharded prefix of the topic name.
+func (o *Overlay) shardCount(topic string) int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	root, count := -1, 1
+	for prefix, shards := range o.shards {
+		if len(prefix) > root && strings.HasPrefix(topic, prefix) {
+			root, count = len(prefix), shards
+		}
+	}
+	return count
+}
+
+// Resolves the id of the topic shard the local node subscribes to.
+func (o *Overlay) resolve(topic string) *big.Int {
+	count := o.shardCount(topic)
+	if count == 1 {
+		return overlay.Resolve(topic)
+	}
+	idx := new(big.Int).Mod(o.router.Self(), big.NewInt(int64(count)))
+	return overlay.Resolve(shardName(topic, int(idx.Int64())))
+}
+
+// Resolves the ids of all the shards of a topic.
+func (o *Overlay) resolveAll(topic string) []*big.Int {
+	count := o.shardCount(topic)
+	if count == 1 {
+		return []*big.Int{overlay.Resolve(topic)}
+	}
+	ids := make([]*big.Int, count)
+	for i := 0; i < count; i++ {
+		ids[i] = overlay.Resolve(shardName(topic, i))
+	}
+	return ids
+}
+
+// Resolves the id of the shard a balanced message should be sent into: the one
+// picked by the affinity key if set (to keep the choice consistent), or a random
+// one otherwise.
+func (o *Overlay) resolveAny(topic string, key string) *big.Int {
+	ids := o.resolveAll(topic)
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	if key != "" {
+		idx := new(big.Int).Mod(overlay.Resolve(key), big.NewInt(int64(len(ids))))
+		return ids[idx.Int64()]
+	}
+	return ids[rand.Intn(len(ids))]
+}
+
+// Assembles the carrier name of a single topic shard.
+func shardName(topic string, idx int) string {
+	return fmt.Sprintf("%s#%d", topic, idx)
+}
+
+// Creates a separate envelope of a message for each of the given number of
+// shards (the payload is shared), since sending modifies the headers.
+func split(msg *proto.Message, count int) []*proto.Message {
+	msgs := []*proto.Message{msg}
+	for i := 1; i < count; i++ {
+		cpy := new(proto.Message)
+		*cpy = *msg
+		msgs = append(msgs, cpy)
+	}
+	return msgs
+}
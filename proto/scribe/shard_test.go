@@ -0,0 +1,101 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that a sharded topic spreads its members over multiple carrier trees,
+// while still delivering each publish to every member exactly once.
+func TestShardedTopic(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	originals, nodes, shards, events := 8, 8, 3, 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < originals; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Start a handful of nodes, shard the topic and subscribe everyone
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	colls := make([]*collector, nodes)
+	overs := make([]*Overlay, nodes)
+	for i := 0; i < nodes; i++ {
+		colls[i] = &collector{
+			publish: []*proto.Message{},
+			balance: []*proto.Message{},
+			direct:  []*proto.Message{},
+		}
+		overs[i] = New(overId, key, colls[i])
+		if err := overs[i].SetSharded(topicId, shards); err != nil {
+			t.Fatalf("failed to shard topic: %v.", err)
+		}
+		if _, err := overs[i].Boot(); err != nil {
+			t.Fatalf("failed to boot nodes: %v.", err)
+		}
+		defer overs[i].Shutdown()
+	}
+	time.Sleep(time.Second)
+
+	used := make(map[string]struct{})
+	for i := 0; i < nodes; i++ {
+		if err := overs[i].Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+		used[overs[i].resolve(topicId).String()] = struct{}{}
+	}
+	if len(used) < 2 {
+		t.Fatalf("shard spread mismatch: have %v, want at least %v.", len(used), 2)
+	}
+	time.Sleep(3 * time.Second)
+
+	// Verify that the member counts of all the shards are summed up
+	if size, err := overs[0].Size(topicId, time.Second); err != nil {
+		t.Fatalf("failed to retrieve topic size: %v.", err)
+	} else if size != nodes {
+		t.Fatalf("topic size mismatch: have %v, want %v.", size, nodes)
+	}
+	// Publish a few events and verify exactly once delivery everywhere
+	for i := 0; i < events; i++ {
+		if err := overs[i%nodes].Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+			t.Fatalf("failed to publish into topic: %v.", err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for i, coll := range colls {
+		coll.lock.Lock()
+		if n := len(coll.publish); n != events {
+			t.Fatalf("node #%d: delivered event mismatch: have %v, want %v.", i, n, events)
+		}
+		coll.lock.Unlock()
+	}
+}
@@ -0,0 +1,265 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the hot standby mechanism of the topic rendez-vous points:
+// every topic root periodically replicates its direct children to the nearest
+// few overlay nodes, which monitor the root in turn. If the root dies, the first
+// standby to notice adopts the orphaned children right away, instead of them
+// having to rebuild the tree from scratch via fresh subscriptions. The usual
+// root re-subscriptions then merge the standby into the closest root if needed.
+//
+// The standbys are re-elected every report round from the current leaf set, so
+// the replicas follow the overlay membership changes automatically.
+
+package scribe
+
+import (
+	"errors"
+	"log"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/scribe/topic"
+)
+
+// Returned when setting a negative replication factor.
+var ErrInvalidReplicas = errors.New("invalid replication factor")
+
+// Replicated rendez-vous state of a topic root.
+type standby struct {
+	Root     *big.Int   // Topic root the state belongs to
+	Seq      int        // Heartbeat of the root the state was captured at
+	Children []*big.Int // Direct children of the root in the topic tree
+	Release  bool       // Flag whether the standby role is revoked
+}
+
+// Heartbeat id flag separating the standby monitors from the tree links. Not a
+// package variable, as the id space may be reconfigured at startup.
+func standbyFlag() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(2*config.PastrySpace))
+}
+
+// Adds the root of a topic to the monitored entities as a standby.
+func (o *Overlay) monitorRoot(topic *big.Int, root *big.Int) error {
+	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), root)
+	return o.heart.Monitor(id.Add(id, standbyFlag()))
+}
+
+// Removes the standby monitoring of a topic root.
+func (o *Overlay) unmonitorRoot(topic *big.Int, root *big.Int) error {
+	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), root)
+	return o.heart.Unmonitor(id.Add(id, standbyFlag()))
+}
+
+// Updates the last ping time of a monitored topic root.
+func (o *Overlay) pingRoot(topic *big.Int, root *big.Int) error {
+	id := new(big.Int).Add(new(big.Int).Lsh(topic, uint(config.PastrySpace)), root)
+	return o.heart.Ping(id.Add(id, standbyFlag()))
+}
+
+// Retrieves the number of standby replicas of the locally rooted topics.
+func (o *Overlay) Replicas() int {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.factor
+}
+
+// Sets the number of standby replicas of the locally rooted topics, trading
+// memory and bandwidth for faster failover. It takes effect from the next report
+// round, seeding the new standbys and releasing the surplus ones. Zero disables
+// the hot standbys altogether.
+func (o *Overlay) SetReplicas(factor int) error {
+	if factor < 0 {
+		return ErrInvalidReplicas
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.factor = factor
+	return nil
+}
+
+// Replicates the state of all the locally rooted topics to the given standby
+// nodes, revoking the role of any previous standby not among them anymore. The
+// caller is expected to hold at least a read lock on the overlay.
+func (o *Overlay) replicate(leaves []*big.Int) {
+	self := o.router.Self()
+
+	replicas := make(map[string][]*big.Int)
+	for sid, top := range o.topics {
+		if top.Parent() != nil || len(leaves) == 0 {
+			continue
+		}
+		state := &standby{
+			Root:     self,
+			Seq:      o.beats,
+			Children: top.Snapshot().Children,
+		}
+		for _, id := range leaves {
+			go o.sendStandby(id, top.Self(), state)
+		}
+		replicas[sid] = leaves
+	}
+	for sid, ids := range o.replicas {
+		topicId, _ := new(big.Int).SetString(sid, 10)
+		for _, id := range ids {
+			if !contains(replicas[sid], id) {
+				go o.sendStandby(id, topicId, &standby{Root: self, Seq: o.beats, Release: true})
+			}
+		}
+	}
+	o.replicas = replicas
+}
+
+// Checks whether an id is contained within a list.
+func contains(ids []*big.Int, id *big.Int) bool {
+	for _, cur := range ids {
+		if cur.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores (or releases) the replicated state of a topic root, monitoring it for
+// failures. Released states are retained to discard stale replicas arriving out
+// of order, which would otherwise resurrect a monitor nobody pings.
+func (o *Overlay) handleStandby(src *big.Int, topicId *big.Int, state *standby) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	sid := topicId.String()
+	old, ok := o.standbys[sid]
+	if ok && old.Root.Cmp(src) == 0 {
+		if state.Seq < old.Seq {
+			return nil
+		}
+		o.standbys[sid] = state
+		switch {
+		case old.Release && state.Release:
+			return nil
+		case old.Release:
+			return o.monitorRoot(topicId, src)
+		case state.Release:
+			return o.unmonitorRoot(topicId, src)
+		default:
+			return o.pingRoot(topicId, src)
+		}
+	}
+	// New root (or changed without release, e.g. merged roots), swap the monitor
+	if state.Release {
+		return nil
+	}
+	if ok && !old.Release {
+		if err := o.unmonitorRoot(topicId, old.Root); err != nil {
+			log.Printf("scribe: failed to unmonitor replaced root: %v.", err)
+		}
+	}
+	o.standbys[sid] = state
+	return o.monitorRoot(topicId, src)
+}
+
+// Takes over the rendez-vous role of a dead topic root, adopting its orphaned
+// children.
+func (o *Overlay) takeover(topicId *big.Int, root *big.Int) {
+	self := o.router.Self()
+	sid := topicId.String()
+
+	o.lock.Lock()
+	state, ok := o.standbys[sid]
+	if !ok || state.Release || state.Root.Cmp(root) != 0 {
+		o.lock.Unlock()
+		return
+	}
+	delete(o.standbys, sid)
+
+	orphans := []*big.Int{}
+	for _, id := range state.Children {
+		if id.Cmp(self) != 0 {
+			orphans = append(orphans, id)
+		}
+	}
+	top, ok := o.topics[sid]
+	if !ok {
+		if len(orphans) == 0 {
+			o.lock.Unlock()
+			return
+		}
+		top = topic.New(topicId, self)
+		o.topics[sid] = top
+	}
+	o.lock.Unlock()
+
+	// Only take over if not grafted elsewhere, adoptions could form cycles otherwise
+	if parent := top.Parent(); parent != nil {
+		if parent.Cmp(root) != 0 {
+			log.Printf("scribe: %v standby of topic %v already grafted below %v.", self, topicId, parent)
+			return
+		}
+		if err := o.unmonitor(topicId, parent); err != nil {
+			log.Printf("scribe: failed to unmonitor dead root: %v.", err)
+		}
+		top.Reown(nil)
+	}
+	log.Printf("scribe: %v taking over topic %v from dead root %v.", self, topicId, root)
+	for _, id := range orphans {
+		if top.Child(id) {
+			continue
+		}
+		if err := top.Subscribe(id); err != nil {
+			log.Printf("scribe: failed to adopt orphan: %v.", err)
+			continue
+		}
+		if err := o.monitor(topicId, id); err != nil {
+			log.Printf("scribe: failed to monitor orphan: %v.", err)
+		}
+		go o.sendAdopt(id, topicId, root)
+	}
+}
+
+// Accepts the adoption by a standby if the local node is still orphaned by the
+// dead root, or declines it via an unsubscription otherwise.
+func (o *Overlay) handleAdopt(src *big.Int, topicId *big.Int, root *big.Int) error {
+	o.lock.RLock()
+	top, ok := o.topics[topicId.String()]
+	o.lock.RUnlock()
+
+	if !ok {
+		go o.sendUnsubscribe(src, topicId)
+		return nil
+	}
+	parent := top.Parent()
+	if parent != nil && parent.Cmp(src) == 0 {
+		return nil
+	}
+	if parent != nil && parent.Cmp(root) != 0 {
+		go o.sendUnsubscribe(src, topicId)
+		return nil
+	}
+	if parent != nil {
+		if err := o.unmonitor(topicId, parent); err != nil {
+			return err
+		}
+	}
+	if err := o.monitor(topicId, src); err != nil {
+		return err
+	}
+	top.Reown(src)
+	return nil
+}
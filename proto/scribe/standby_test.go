@@ -0,0 +1,217 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that topic roots replicate their state to the standbys and that the
+// tree recovers when the root dies.
+func TestStandby(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 6
+	pubs := 10
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make(map[string]*Overlay)
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live[node.Self().String()] = node
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Find the topic root and check that its standbys hold the replicas
+	var root *Overlay
+	for _, node := range live {
+		if snap, err := node.Inspect(topicId); err != nil {
+			t.Fatalf("failed to inspect topic: %v.", err)
+		} else if snap.Parent == nil {
+			root = node
+		}
+	}
+	if !converged(t, live) {
+		t.Fatalf("topic tree failed to converge.")
+	}
+	id := overlay.Resolve(topicId).String()
+	standbys := root.router.Leaves(config.ScribeStandbys)
+	if len(standbys) != config.ScribeStandbys {
+		t.Fatalf("standby count mismatch: have %v, want %v.", len(standbys), config.ScribeStandbys)
+	}
+	for _, sb := range standbys {
+		node := live[sb.String()]
+
+		node.lock.RLock()
+		state, ok := node.standbys[id]
+		node.lock.RUnlock()
+
+		if !ok {
+			t.Fatalf("standby %v: missing root replica.", sb)
+		}
+		if state.Root.Cmp(root.Self()) != 0 {
+			t.Fatalf("standby %v: replica root mismatch: have %v, want %v.", sb, state.Root, root.Self())
+		}
+		if snap, _ := root.Inspect(topicId); len(state.Children) != len(snap.Children) {
+			t.Fatalf("standby %v: replica children mismatch: have %v, want %v.", sb, state.Children, snap.Children)
+		}
+	}
+	// Kill the root and wait for the survivors to reassemble the tree
+	delete(live, root.Self().String())
+	if err := root.Shutdown(); err != nil {
+		t.Fatalf("failed to terminate root node: %v.", err)
+	}
+	deadline := time.Now().Add(time.Duration(4*config.ScribeKillCount) * config.ScribeBeatPeriod)
+	for time.Sleep(100 * time.Millisecond); !converged(t, live); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic tree failed to recover.")
+		}
+	}
+	// Make sure events reach all the surviving members
+	for _, node := range live {
+		for i := 0; i < pubs; i++ {
+			if err := node.Publish(topicId, &proto.Message{Data: []byte{byte(i)}}); err != nil {
+				t.Fatalf("failed to publish into topic: %v.", err)
+			}
+		}
+		break
+	}
+	time.Sleep(time.Second)
+
+	coll.lock.Lock()
+	defer coll.lock.Unlock()
+	if n := len(coll.publish); n != pubs*(nodes-1) {
+		t.Fatalf("arrive event mismatch: have %v, want %v.", n, pubs*(nodes-1))
+	}
+}
+
+// Tests that changing the replication factor seeds new standbys and releases the
+// surplus ones.
+func TestStandbyReplicas(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := make(map[string]*Overlay)
+	defer func() {
+		for _, node := range live {
+			node.Shutdown()
+		}
+	}()
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		live[node.Self().String()] = node
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+	if !converged(t, live) {
+		t.Fatalf("topic tree failed to converge.")
+	}
+	// Find the topic root and tune its replication factor
+	var root *Overlay
+	for _, node := range live {
+		if snap, _ := node.Inspect(topicId); snap != nil && snap.Parent == nil {
+			root = node
+		}
+	}
+	if err := root.SetReplicas(-1); err != ErrInvalidReplicas {
+		t.Fatalf("negative factor error mismatch: have %v, want %v.", err, ErrInvalidReplicas)
+	}
+	id := overlay.Resolve(topicId).String()
+	for _, factor := range []int{nodes, 1, 0} {
+		if err := root.SetReplicas(factor); err != nil {
+			t.Fatalf("failed to set replication factor: %v.", err)
+		}
+		time.Sleep(4 * config.ScribeBeatPeriod)
+
+		held := 0
+		for _, node := range live {
+			node.lock.RLock()
+			if state, ok := node.standbys[id]; ok && !state.Release && state.Root.Cmp(root.Self()) == 0 {
+				held++
+			}
+			node.lock.RUnlock()
+		}
+		// Only the leaf set can hold replicas, capping the factor
+		if want := len(root.router.Leaves(factor)); held != want {
+			t.Fatalf("factor %d: replica count mismatch: have %v, want %v.", factor, held, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the timing parameters of the carrier maintenance, which may be tuned
+// at runtime to match the latencies of the deployment (LAN vs. WAN).
+
+package scribe
+
+import (
+	"errors"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Returned when setting timings that would make the live nodes seem dead.
+var ErrInvalidTiming = errors.New("invalid carrier timing")
+
+// Timing parameters of the carrier maintenance. Everything but the beat period
+// is measured in heartbeats.
+type Timing struct {
+	Beat     time.Duration // Heartbeat period of the carrier
+	Kill     int           // Missed heartbeats after which a neighbor is considered down
+	Report   int           // Heartbeats between two load report rounds
+	Repair   int           // Heartbeats between two anti-entropy rounds
+	Maintain int           // Heartbeats between two root re-subscriptions
+}
+
+// Assembles the default timing parameters from the global configs.
+func defaultTiming() Timing {
+	return Timing{
+		Beat:     config.ScribeBeatPeriod,
+		Kill:     config.ScribeKillCount,
+		Report:   config.ScribeReportBeats,
+		Repair:   config.ScribeRepairBeats,
+		Maintain: config.ScribeMaintainBeats,
+	}
+}
+
+// Retrieves the current timing parameters of the carrier.
+func (o *Overlay) Timing() Timing {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.timing
+}
+
+// Updates the timing parameters of the carrier, taking effect from the next
+// heartbeat. Since the load reports double as liveness pings, the kill count
+// must exceed the report interval.
+func (o *Overlay) SetTiming(timing Timing) error {
+	if timing.Beat <= 0 || timing.Report < 1 || timing.Repair < 1 || timing.Maintain < 1 {
+		return ErrInvalidTiming
+	}
+	if timing.Kill <= timing.Report {
+		return ErrInvalidTiming
+	}
+	o.lock.Lock()
+	o.timing = timing
+	o.lock.Unlock()
+
+	o.heart.SetTiming(timing.Beat, timing.Kill)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that the carrier timings can be tuned at runtime without disrupting the
+// topic trees, and that unsafe timings are rejected.
+func TestTiming(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 4
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the subscribed scribe nodes
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := []*Overlay{}
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+	for _, node := range live {
+		if err := node.Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	// Check that unsafe timings are rejected
+	timing := live[0].Timing()
+	if timing.Beat != config.ScribeBeatPeriod || timing.Kill != config.ScribeKillCount {
+		t.Fatalf("default timing mismatch: have %v, want beat %v, kill %v.", timing, config.ScribeBeatPeriod, config.ScribeKillCount)
+	}
+	unsafe := timing
+	unsafe.Report = unsafe.Kill
+	if err := live[0].SetTiming(unsafe); err != ErrInvalidTiming {
+		t.Fatalf("unsafe timing error mismatch: have %v, want %v.", err, ErrInvalidTiming)
+	}
+	// Tighten the beats but report only every other one, checking the tree survives
+	timing.Beat, timing.Report, timing.Kill = timing.Beat/2, 2, 4
+	for _, node := range live {
+		if err := node.SetTiming(timing); err != nil {
+			t.Fatalf("failed to set timing: %v.", err)
+		}
+	}
+	time.Sleep(time.Duration(3*timing.Kill) * timing.Beat)
+
+	for i, node := range live {
+		if size, err := node.Size(topicId, time.Second); err != nil {
+			t.Fatalf("node %d: failed to retrieve topic size: %v.", i, err)
+		} else if size != nodes {
+			t.Fatalf("node %d: topic size mismatch: have %v, want %v.", i, size, nodes)
+		}
+	}
+}
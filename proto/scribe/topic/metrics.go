@@ -0,0 +1,106 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the aggregation of the custom application metrics attached
+// to the load reports: each node reports to every neighbor the sums of the
+// metrics of all the members reachable through it without traversing that
+// neighbor, similarly to the member counts.
+
+package topic
+
+import (
+	"math/big"
+
+	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/ext/sortext"
+)
+
+// Sets the custom metrics of the local members in the topic.
+func (t *Topic) SetMetrics(metrics map[string]float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.own = metrics
+}
+
+// Returns the metrics to report to each of the given neighbors, namely the sums
+// of the metrics of the members reachable through the local node without
+// traversing the neighbor itself.
+func (t *Topic) GenerateMetrics(ids []*big.Int) []map[string]float64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	metrics := make([]map[string]float64, len(ids))
+	for i, id := range ids {
+		sums := make(map[string]float64)
+		if t.local() {
+			accumulate(sums, t.own)
+		}
+		for sid, reported := range t.metrics {
+			if sid != id.String() {
+				accumulate(sums, reported)
+			}
+		}
+		metrics[i] = sums
+	}
+	return metrics
+}
+
+// Sets the metrics reported by a neighbor for its side of the tree, forwarding
+// them to the balancer if consumed.
+func (t *Topic) ProcessMetrics(id *big.Int, metrics map[string]float64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sid := id.String()
+	if _, ok := t.members[sid]; !ok {
+		return ErrNotSubscribed
+	}
+	t.metrics[sid] = metrics
+	if aware, ok := t.load.(balancer.MetricsAware); ok {
+		return aware.UpdateMetrics(id, metrics)
+	}
+	return nil
+}
+
+// Sums up the metrics of the local members and those reported by the neighbors.
+// The caller is expected to hold at least a read lock.
+func (t *Topic) totals() map[string]float64 {
+	sums := make(map[string]float64)
+	if t.local() {
+		accumulate(sums, t.own)
+	}
+	for _, reported := range t.metrics {
+		accumulate(sums, reported)
+	}
+	return sums
+}
+
+// Returns whether the local node has members in the topic. The caller is
+// expected to hold at least a read lock.
+func (t *Topic) local() bool {
+	idx := sortext.SearchBigInts(t.nodes, t.owner)
+	return idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0
+}
+
+// Adds the metrics of src into the sums of dst.
+func accumulate(dst, src map[string]float64) {
+	for name, value := range src {
+		dst[name] += value
+	}
+}
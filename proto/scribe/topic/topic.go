@@ -22,13 +22,17 @@ package topic
 
 import (
 	"errors"
+	"log"
 	"math"
 	"math/big"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/ext/sortext"
+	"github.com/project-iris/iris/filter"
 	"github.com/project-iris/iris/system"
 )
 
@@ -36,6 +40,37 @@ import (
 var ErrSubscribed = errors.New("already subscribed")
 var ErrNotSubscribed = errors.New("not subscribed")
 
+// Point in time view of the local node's position in a topic tree.
+type Snapshot struct {
+	Parent   *big.Int   // Parent node in the topic tree (nil if the local node is the root)
+	Children []*big.Int // Remote children of the local node in the topic tree
+	Local    bool       // Whether the local node has members subscribed
+	Weight   int        // Number of local members represented by the local node
+	Size     int        // Approximate number of members in the whole topic tree
+	Sizes    []int      // Approximate member counts behind each child (and the parent last)
+
+	Metrics []map[string]float64 // Summed custom metrics behind each child (and the parent last)
+	Totals  map[string]float64   // Summed custom metrics of the whole topic tree
+}
+
+// Traffic counters of a topic at the local node, updated atomically by the
+// carrier as events pass through.
+type Counters struct {
+	Events    uint64 // Events passing through the local node
+	Bytes     uint64 // Payload bytes of the events passing through
+	Forwarded uint64 // Event copies forwarded to the tree neighbors
+	Filtered  uint64 // Event copies pruned by the filters of the neighbors
+	Delivered uint64 // Events delivered to the local members
+	Dropped   uint64 // Events dropped as duplicates or undecryptable
+}
+
+// Point in time carrier statistics of a topic at the local node.
+type Stats struct {
+	Counters     // Traffic counters since the local node joined the topic tree
+	Members  int // Approximate number of members in the whole topic tree
+	Depth    int // Distance of the local node from the topic root
+}
+
 // The maintenance data related to a single topic.
 type Topic struct {
 	id      *big.Int            // Unique id of the topic
@@ -44,21 +79,50 @@ type Topic struct {
 	nodes   []*big.Int          // Remote children in the topic tree (+local if subbed)
 	members map[string]struct{} // Membership set to allow fast lookups
 
-	load *balancer.Balancer // Balancer to load-distribute messages
-	msgs int32              // Number of messages balanced to locals (atomic, take care)
+	load    balancer.Balancer // Balancer to load-distribute messages
+	msgs    int32             // Number of messages balanced to locals (atomic, take care)
+	queue   int               // Number of messages queued at the local members
+	latency time.Duration     // Reply latency of the local members
+
+	weight int            // Number of local members represented by the local node
+	sizes  map[string]int // Member counts reported by the neighbors for their side of the tree
+
+	locals  *filter.Set            // Event filters of the local members
+	filters map[string]*filter.Set // Event filters reported by the neighbors for their side of the tree
+
+	own     map[string]float64            // Custom metrics of the local members
+	metrics map[string]map[string]float64 // Custom metrics reported by the neighbors for their side of the tree
+
+	depth   int       // Distance from the topic root, as reported by the parent
+	traffic *Counters // Traffic counters of the topic (atomic, take care)
 
 	lock sync.RWMutex
 }
 
-// Creates a new topic with no subscriptions.
+// Creates a new topic with no subscriptions, balancing with the configured
+// strategy (or the capacity based one if it's not registered).
 func New(id, owner *big.Int) *Topic {
 	// log.Printf("%v topic created: %v", owner, id)
+	load, err := balancer.NewStrategy(config.ScribeBalancer)
+	if err != nil {
+		log.Printf("scribe: failed to create %s balancer, using capacity: %v.", config.ScribeBalancer, err)
+		load = balancer.New()
+	}
+	if local, ok := load.(balancer.LocalityAware); ok {
+		local.SetZone(config.ScribeZone, config.ScribeZoneTolerance)
+	}
 	return &Topic{
 		id:      id,
 		owner:   owner,
 		nodes:   []*big.Int{},
 		members: make(map[string]struct{}),
-		load:    balancer.New(),
+		load:    load,
+		weight:  1,
+		sizes:   make(map[string]int),
+		locals:  newUnfiltered(),
+		filters: make(map[string]*filter.Set),
+		metrics: make(map[string]map[string]float64),
+		traffic: new(Counters),
 	}
 }
 
@@ -86,7 +150,13 @@ func (t *Topic) Reown(parent *big.Int) {
 	if t.parent != nil {
 		t.load.Unregister(t.parent)
 		delete(t.members, t.parent.String())
+		delete(t.sizes, t.parent.String())
+		delete(t.filters, t.parent.String())
+		delete(t.metrics, t.parent.String())
 	}
+	// Depth is unknown until the new parent reports (zero if root)
+	t.depth = 0
+
 	// Initialize and save the new parent if any
 	if parent != nil {
 		t.load.Register(parent)
@@ -122,8 +192,11 @@ func (t *Topic) Subscribe(id *big.Int) error {
 
 	// log.Printf("%v:%v: subbed, state: %v.", t.owner, t.id, t.nodes)
 
-	// Start load balancing to it too
+	// Start load balancing to it too (local members are in the local zone)
 	t.load.Register(id)
+	if local, ok := t.load.(balancer.LocalityAware); ok && id.Cmp(t.owner) == 0 {
+		local.UpdateZone(id, config.ScribeZone)
+	}
 	return nil
 }
 
@@ -145,6 +218,9 @@ func (t *Topic) Unsubscribe(id *big.Int) error {
 	t.nodes = t.nodes[:last]
 	sortext.BigInts(t.nodes)
 	delete(t.members, id.String())
+	delete(t.sizes, id.String())
+	delete(t.filters, id.String())
+	delete(t.metrics, id.String())
 
 	// log.Printf("%v:%v: remed, state: %v.", t.owner, t.id, t.nodes)
 
@@ -162,6 +238,54 @@ func (t *Topic) Neighbor(id *big.Int) bool {
 	return ok
 }
 
+// Returns whether a remote node is a child of the current one in the topic tree.
+func (t *Topic) Child(id *big.Int) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	idx := sortext.SearchBigInts(t.nodes, id)
+	return idx < len(t.nodes) && id.Cmp(t.nodes[idx]) == 0 && id.Cmp(t.owner) != 0
+}
+
+// Returns the number of remote children of the local node in the topic tree.
+func (t *Topic) Fanout() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.local() {
+		return len(t.nodes) - 1
+	}
+	return len(t.nodes)
+}
+
+// Returns the remote child with the fewest members behind it (as reported), or
+// nil if the local node has no remote children.
+func (t *Topic) Lightest() *big.Int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var best *big.Int
+	size := 0
+	for _, id := range t.nodes {
+		if id.Cmp(t.owner) == 0 {
+			continue
+		}
+		if s := t.sizes[id.String()]; best == nil || s < size {
+			best, size = id, s
+		}
+	}
+	return best
+}
+
+// Returns the distance of the local node from the topic root, as reported by
+// the parent (zero if root or not yet reported).
+func (t *Topic) Depth() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.depth
+}
+
 // Returns the list of nodes that a broadcast message should be sent to. An
 // optional ex node can be specified to exclude it from the list.
 func (t *Topic) Broadcast(ex *big.Int) []*big.Int {
@@ -209,6 +333,41 @@ func (t *Topic) Balance(ex *big.Int) (*big.Int, error) {
 	return id, nil
 }
 
+// Returns the node id to which a message with the given affinity key should be
+// sent, consistently picking the same one while the subtree is stable. The nodes
+// are weighted by the member counts behind them to spread the keys evenly among
+// the members. An optional ex node can be specified to prevent descending there.
+func (t *Topic) Affine(key string, ex *big.Int) (*big.Int, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var best *big.Int
+	score := math.Inf(-1)
+	for _, id := range t.nodes {
+		if ex != nil && id.Cmp(ex) == 0 {
+			continue
+		}
+		// Weigh by the member counts, assuming one until reported
+		weight := t.weight
+		if id.Cmp(t.owner) != 0 {
+			if weight = t.sizes[id.String()]; weight < 1 {
+				weight = 1
+			}
+		}
+		if s := balancer.Affinity(key, id.Bytes(), weight); best == nil || s > score {
+			best, score = id, s
+		}
+	}
+	if best == nil {
+		return nil, ErrNotSubscribed
+	}
+	// If the target is the local node, increment the task counter
+	if best.Cmp(t.owner) == 0 {
+		atomic.AddInt32(&t.msgs, 1)
+	}
+	return best, nil
+}
+
 // Returns the list of nodes to report to, and the report for each.
 func (t *Topic) GenerateReports() ([]*big.Int, []int) {
 	t.lock.RLock()
@@ -236,13 +395,144 @@ func (t *Topic) GenerateReports() ([]*big.Int, []int) {
 	return ids, caps
 }
 
+// Returns the total load capacity of the local subtree, reported to nodes not
+// yet linked into the topic tree (e.g. a new rendez-vous point).
+func (t *Topic) Capacity() int {
+	return t.load.Capacity(nil)
+}
+
 // Sets the load capacity for a source node in the balancer.
 func (t *Topic) ProcessReport(id *big.Int, cap int) error {
 	return t.load.Update(id, cap)
 }
 
+// Returns the resource loads to report to each of the given nodes, or zero loads
+// if the balancing strategy does not consume them.
+func (t *Topic) GenerateLoads(ids []*big.Int) []balancer.Load {
+	loads := make([]balancer.Load, len(ids))
+	if aware, ok := t.load.(balancer.LoadAware); ok {
+		for i, id := range ids {
+			loads[i] = aware.Load(id)
+		}
+	}
+	return loads
+}
+
+// Sets the resource load for a source node in the balancer, if consumed.
+func (t *Topic) ProcessLoad(id *big.Int, load balancer.Load) error {
+	if aware, ok := t.load.(balancer.LoadAware); ok {
+		return aware.UpdateLoad(id, load)
+	}
+	return nil
+}
+
+// Returns the reply latencies to report to each of the given nodes, or zeroes if
+// the balancing strategy does not consume them.
+func (t *Topic) GenerateLatencies(ids []*big.Int) []time.Duration {
+	lats := make([]time.Duration, len(ids))
+	if aware, ok := t.load.(balancer.LatencyAware); ok {
+		for i, id := range ids {
+			lats[i] = aware.Latency(id)
+		}
+	}
+	return lats
+}
+
+// Sets the reply latency for a source node in the balancer, if consumed.
+func (t *Topic) ProcessLatency(id *big.Int, latency time.Duration) error {
+	if aware, ok := t.load.(balancer.LatencyAware); ok {
+		return aware.UpdateLatency(id, latency)
+	}
+	return nil
+}
+
+// Returns the zones to report to each of the given nodes: the common zone of the
+// members behind the local node, or empty if they span multiple zones.
+func (t *Topic) GenerateZones(ids []*big.Int) []string {
+	zones := make([]string, len(ids))
+	if local, ok := t.load.(balancer.LocalityAware); ok {
+		for i, id := range ids {
+			zones[i] = local.Zone(id)
+		}
+	}
+	return zones
+}
+
+// Sets the reported zone of a source node in the balancer, if consumed.
+func (t *Topic) ProcessZone(id *big.Int, zone string) error {
+	if local, ok := t.load.(balancer.LocalityAware); ok {
+		return local.UpdateZone(id, zone)
+	}
+	return nil
+}
+
+// Returns the depths to report to each of the given nodes, namely the distance
+// of the local node from the topic root (only consumed by the children).
+func (t *Topic) GenerateDepths(ids []*big.Int) []int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	depths := make([]int, len(ids))
+	for i := range ids {
+		depths[i] = t.depth
+	}
+	return depths
+}
+
+// Sets the local depth based on the one reported by a node, if it's the parent.
+func (t *Topic) ProcessDepth(id *big.Int, depth int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.parent != nil && t.parent.Cmp(id) == 0 {
+		t.depth = depth + 1
+	}
+}
+
+// Returns the live traffic counters of the topic, to be updated atomically.
+func (t *Topic) Traffic() *Counters {
+	return t.traffic
+}
+
+// Collects the carrier statistics of the topic at the local node.
+func (t *Topic) Stats() *Stats {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return &Stats{
+		Counters: Counters{
+			Events:    atomic.LoadUint64(&t.traffic.Events),
+			Bytes:     atomic.LoadUint64(&t.traffic.Bytes),
+			Forwarded: atomic.LoadUint64(&t.traffic.Forwarded),
+			Filtered:  atomic.LoadUint64(&t.traffic.Filtered),
+			Delivered: atomic.LoadUint64(&t.traffic.Delivered),
+			Dropped:   atomic.LoadUint64(&t.traffic.Dropped),
+		},
+		Members: t.size(),
+		Depth:   t.depth,
+	}
+}
+
+// Sets the number of messages queued at the local members, reported as part of
+// the local resource load at the next cycle.
+func (t *Topic) SetQueue(depth int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.queue = depth
+}
+
+// Sets the reply latency of the local members, folded into the balancer at the
+// next cycle.
+func (t *Topic) SetLatency(latency time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.latency = latency
+}
+
 // If local subscriptions are alive in the topic, updates the balancer according
-// to the messages processed since the last beat.
+// to the messages processed since the last beat and the local resource usage.
 func (t *Topic) Cycle() {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
@@ -255,7 +545,211 @@ func (t *Topic) Cycle() {
 		cap = math.Min(math.MaxInt32, cap)
 
 		t.load.Update(t.owner, int(cap))
+
+		if aware, ok := t.load.(balancer.LoadAware); ok {
+			aware.UpdateLoad(t.owner, balancer.Load{
+				CPU:    system.CpuUsage(),
+				Memory: system.MemoryUsage(),
+				Queue:  t.queue,
+			})
+		}
+		if aware, ok := t.load.(balancer.LatencyAware); ok {
+			aware.UpdateLatency(t.owner, t.latency)
+		}
 	}
 	// Reset counters for next beat
 	atomic.StoreInt32(&t.msgs, 0)
 }
+
+// Sets the number of local members the local node represents in the topic.
+func (t *Topic) SetWeight(weight int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.weight = weight
+}
+
+// Returns the (eventually consistent) number of members in the whole topic
+// tree, as seen from the local node.
+func (t *Topic) Size() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.size()
+}
+
+// Captures the local view of the topic tree for introspection purposes.
+func (t *Topic) Snapshot() *Snapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	snap := &Snapshot{
+		Children: []*big.Int{},
+		Size:     t.size(),
+		Sizes:    []int{},
+		Metrics:  []map[string]float64{},
+		Totals:   t.totals(),
+	}
+	for _, id := range t.nodes {
+		if id.Cmp(t.owner) == 0 {
+			snap.Local, snap.Weight = true, t.weight
+			continue
+		}
+		snap.Children = append(snap.Children, id)
+		snap.Sizes = append(snap.Sizes, t.sizes[id.String()])
+		snap.Metrics = append(snap.Metrics, t.metrics[id.String()])
+	}
+	if t.parent != nil {
+		snap.Parent = t.parent
+		snap.Sizes = append(snap.Sizes, t.sizes[t.parent.String()])
+		snap.Metrics = append(snap.Metrics, t.metrics[t.parent.String()])
+	}
+	return snap
+}
+
+// Sums up the local weight and the member counts reported by the neighbors.
+// The caller is expected to hold at least a read lock.
+func (t *Topic) size() int {
+	size := 0
+	for _, count := range t.sizes {
+		size += count
+	}
+	idx := sortext.SearchBigInts(t.nodes, t.owner)
+	if idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0 {
+		size += t.weight
+	}
+	return size
+}
+
+// Returns the member counts to report to each of the given neighbors, namely
+// the number of members reachable through the local node without traversing
+// the neighbor itself.
+func (t *Topic) GenerateSizes(ids []*big.Int) []int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	total := t.size()
+	sizes := make([]int, len(ids))
+	for i, id := range ids {
+		sizes[i] = total - t.sizes[id.String()]
+	}
+	return sizes
+}
+
+// Sets the member count reported by a neighbor for its side of the tree.
+func (t *Topic) ProcessSize(id *big.Int, size int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sid := id.String()
+	if _, ok := t.members[sid]; !ok {
+		return ErrNotSubscribed
+	}
+	t.sizes[sid] = size
+	return nil
+}
+
+// Creates a filter set accepting all events.
+func newUnfiltered() *filter.Set {
+	all, _ := filter.Parse("")
+
+	set := filter.NewSet()
+	set.Add(all)
+	return set
+}
+
+// Sets the event filter expressions of the local members. Invalid expressions
+// are treated as accepting everything.
+func (t *Topic) SetFilters(exprs []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.locals = parseSet(exprs)
+}
+
+// Returns the filter expressions to report to each of the given neighbors,
+// namely the union of the filters of the members reachable through the local
+// node without traversing the neighbor itself.
+func (t *Topic) GenerateFilters(ids []*big.Int) [][]string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	// Check whether the local node has local members
+	idx := sortext.SearchBigInts(t.nodes, t.owner)
+	local := idx < len(t.nodes) && t.owner.Cmp(t.nodes[idx]) == 0
+
+	exprs := make([][]string, len(ids))
+	for i, id := range ids {
+		union := filter.NewSet()
+		if local {
+			union.Merge(t.locals)
+		}
+		for _, node := range t.nodes {
+			if node.Cmp(t.owner) != 0 && node.Cmp(id) != 0 {
+				union.Merge(t.reported(node))
+			}
+		}
+		if t.parent != nil && t.parent.Cmp(id) != 0 {
+			union.Merge(t.reported(t.parent))
+		}
+		exprs[i] = union.Exprs()
+	}
+	return exprs
+}
+
+// Returns the filters reported by a neighbor, accepting everything if none was
+// reported yet. The caller is expected to hold at least a read lock.
+func (t *Topic) reported(id *big.Int) *filter.Set {
+	if set, ok := t.filters[id.String()]; ok {
+		return set
+	}
+	return newUnfiltered()
+}
+
+// Sets the filter expressions reported by a neighbor for its side of the tree.
+func (t *Topic) ProcessFilters(id *big.Int, exprs []string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sid := id.String()
+	if _, ok := t.members[sid]; !ok {
+		return ErrNotSubscribed
+	}
+	t.filters[sid] = parseSet(exprs)
+	return nil
+}
+
+// Checks whether a neighbor's side of the tree is interested in an event with
+// the given attributes. Neighbors without reported filters accept everything.
+func (t *Topic) Accepts(id *big.Int, attrs map[string]string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if set, ok := t.filters[id.String()]; ok {
+		return set.Match(attrs)
+	}
+	return true
+}
+
+// Checks whether any of the local members is interested in an event with the
+// given attributes.
+func (t *Topic) AcceptsLocal(attrs map[string]string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.locals.Match(attrs)
+}
+
+// Parses a list of filter expressions into a filter set. Invalid expressions
+// accept everything to never lose events.
+func parseSet(exprs []string) *filter.Set {
+	set := filter.NewSet()
+	for _, expr := range exprs {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			f, _ = filter.Parse("")
+		}
+		set.Add(f)
+	}
+	return set
+}
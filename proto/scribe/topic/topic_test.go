@@ -19,9 +19,13 @@
 package topic
 
 import (
+	"fmt"
 	"math/big"
 	"testing"
+	"time"
 
+	"github.com/project-iris/iris/balancer"
+	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/ext/sortext"
 )
 
@@ -129,4 +133,238 @@ func TestTopic(t *testing.T) {
 			t.Fatalf("capacity %d mismatch: have %v, want %v", i, cap, total-10*(i+1))
 		}
 	}
+	// Check member count aggregation
+	top.SetWeight(3)
+	if size := top.Size(); size != 3 {
+		t.Fatalf("local size mismatch: have %v, want %v.", size, 3)
+	}
+	members := 3
+	for i, id := range nodes {
+		if err := top.ProcessSize(id, i+1); err != nil {
+			t.Fatalf("failed to process size report: %v.", err)
+		}
+		members += i + 1
+	}
+	if size := top.Size(); size != members {
+		t.Fatalf("total size mismatch: have %v, want %v.", size, members)
+	}
+	for i, size := range top.GenerateSizes(nodes) {
+		if size != members-(i+1) {
+			t.Fatalf("size report %d mismatch: have %v, want %v.", i, size, members-(i+1))
+		}
+	}
+	if err := top.ProcessSize(big.NewInt(271), 1); err != ErrNotSubscribed {
+		t.Fatalf("untracked size report mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	// Check filter aggregation
+	top.SetFilters([]string{"region == eu"})
+	if !top.AcceptsLocal(map[string]string{"region": "eu"}) {
+		t.Fatalf("local members rejected matching event.")
+	}
+	if top.AcceptsLocal(map[string]string{"region": "us"}) {
+		t.Fatalf("local members accepted mismatching event.")
+	}
+	for i, id := range nodes {
+		if !top.Accepts(id, nil) {
+			t.Fatalf("unreported neighbor %d rejected event.", i)
+		}
+		if err := top.ProcessFilters(id, []string{fmt.Sprintf("node == %d", i)}); err != nil {
+			t.Fatalf("failed to process filter report: %v.", err)
+		}
+	}
+	for i, id := range nodes {
+		if !top.Accepts(id, map[string]string{"node": fmt.Sprintf("%d", i)}) {
+			t.Fatalf("neighbor %d rejected matching event.", i)
+		}
+		if top.Accepts(id, map[string]string{"node": fmt.Sprintf("%d", i+1)}) {
+			t.Fatalf("neighbor %d accepted mismatching event.", i)
+		}
+	}
+	for i, exprs := range top.GenerateFilters(nodes) {
+		if len(exprs) != len(nodes) {
+			t.Fatalf("filter report %d size mismatch: have %v, want %v.", i, len(exprs), len(nodes))
+		}
+		for _, expr := range exprs {
+			if expr == fmt.Sprintf("node == \"%d\"", i) {
+				t.Fatalf("filter report %d contains own filter: %v.", i, exprs)
+			}
+		}
+	}
+}
+
+func TestLoads(t *testing.T) {
+	// Create a topic balancing based on resource loads
+	old := config.ScribeBalancer
+	config.ScribeBalancer = balancer.LeastLoadedStrategy
+	defer func() { config.ScribeBalancer = old }()
+
+	top := New(big.NewInt(314), big.NewInt(141))
+	busy, idle := big.NewInt(1), big.NewInt(2)
+	top.Subscribe(busy)
+	top.Subscribe(idle)
+
+	// Feed some load reports and check that they are propagated
+	if err := top.ProcessLoad(busy, balancer.Load{CPU: 0.9}); err != nil {
+		t.Fatalf("failed to process busy load: %v.", err)
+	}
+	if err := top.ProcessLoad(idle, balancer.Load{CPU: 0.1}); err != nil {
+		t.Fatalf("failed to process idle load: %v.", err)
+	}
+	loads := top.GenerateLoads([]*big.Int{busy, idle})
+	if loads[0].CPU != 0.1 || loads[1].CPU != 0.9 {
+		t.Fatalf("generated load mismatch: have %v, want %v.", loads, []balancer.Load{{CPU: 0.1}, {CPU: 0.9}})
+	}
+	// Check that the capacity strategy ignores the loads
+	config.ScribeBalancer = balancer.CapacityStrategy
+	plain := New(big.NewInt(314), big.NewInt(141))
+	plain.Subscribe(busy)
+	if err := plain.ProcessLoad(busy, balancer.Load{CPU: 0.9}); err != nil {
+		t.Fatalf("failed to ignore load: %v.", err)
+	}
+	if loads := plain.GenerateLoads([]*big.Int{busy}); loads[0] != (balancer.Load{}) {
+		t.Fatalf("ignored load mismatch: have %v, want %v.", loads[0], balancer.Load{})
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	// Create a topic balancing based on reply latencies
+	old := config.ScribeBalancer
+	config.ScribeBalancer = balancer.LatencyStrategy
+	defer func() { config.ScribeBalancer = old }()
+
+	top := New(big.NewInt(314), big.NewInt(141))
+	slow, fast := big.NewInt(1), big.NewInt(2)
+	top.Subscribe(slow)
+	top.Subscribe(fast)
+
+	// Feed some latency reports and check that they are propagated
+	if err := top.ProcessLatency(slow, 40*time.Millisecond); err != nil {
+		t.Fatalf("failed to process slow latency: %v.", err)
+	}
+	if err := top.ProcessLatency(fast, 10*time.Millisecond); err != nil {
+		t.Fatalf("failed to process fast latency: %v.", err)
+	}
+	lats := top.GenerateLatencies([]*big.Int{slow, fast})
+	if lats[0] != 10*time.Millisecond || lats[1] != 40*time.Millisecond {
+		t.Fatalf("generated latency mismatch: have %v, want %v.", lats, []time.Duration{10 * time.Millisecond, 40 * time.Millisecond})
+	}
+	// Check that the capacity strategy ignores the latencies
+	config.ScribeBalancer = balancer.CapacityStrategy
+	plain := New(big.NewInt(314), big.NewInt(141))
+	plain.Subscribe(slow)
+	if err := plain.ProcessLatency(slow, 40*time.Millisecond); err != nil {
+		t.Fatalf("failed to ignore latency: %v.", err)
+	}
+	if lats := plain.GenerateLatencies([]*big.Int{slow}); lats[0] != 0 {
+		t.Fatalf("ignored latency mismatch: have %v, want %v.", lats[0], 0)
+	}
+}
+
+func TestStats(t *testing.T) {
+	top := New(big.NewInt(314), big.NewInt(141))
+	parent, child := big.NewInt(1), big.NewInt(2)
+	top.Subscribe(child)
+
+	// Depth reports from non-parents should be ignored
+	top.ProcessDepth(child, 3)
+	if depth := top.Stats().Depth; depth != 0 {
+		t.Fatalf("root depth mismatch: have %v, want %v.", depth, 0)
+	}
+	top.Reown(parent)
+	top.ProcessDepth(parent, 3)
+	if depth := top.Stats().Depth; depth != 4 {
+		t.Fatalf("child depth mismatch: have %v, want %v.", depth, 4)
+	}
+	if depths := top.GenerateDepths([]*big.Int{child}); depths[0] != 4 {
+		t.Fatalf("generated depth mismatch: have %v, want %v.", depths[0], 4)
+	}
+	// Reowning should reset the depth until the new parent reports
+	top.Reown(nil)
+	if depth := top.Stats().Depth; depth != 0 {
+		t.Fatalf("reset depth mismatch: have %v, want %v.", depth, 0)
+	}
+	// Check that the traffic counters are reflected
+	top.Traffic().Events, top.Traffic().Dropped = 10, 2
+	if stats := top.Stats(); stats.Events != 10 || stats.Dropped != 2 {
+		t.Fatalf("traffic counter mismatch: have %v/%v, want %v/%v.", stats.Events, stats.Dropped, 10, 2)
+	}
+}
+
+func TestAffine(t *testing.T) {
+	// Create a topic with a local member and a few remote children
+	owner := big.NewInt(141)
+	top := New(big.NewInt(314), owner)
+	top.Subscribe(owner)
+	children := []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(3)}
+	for _, child := range children {
+		top.Subscribe(child)
+		top.ProcessSize(child, 2)
+	}
+	// Ensure keys are consistently mapped and the excluded node is skipped
+	picks := make(map[string]*big.Int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		id, err := top.Affine(key, children[0])
+		if err != nil {
+			t.Fatalf("failed to pick affine node: %v.", err)
+		}
+		if id.Cmp(children[0]) == 0 {
+			t.Fatalf("excluded node picked for key %s.", key)
+		}
+		if again, _ := top.Affine(key, children[0]); again.Cmp(id) != 0 {
+			t.Fatalf("key %s: unstable pick: have %v, want %v.", key, again, id)
+		}
+		picks[key] = id
+	}
+	// Drop a child and ensure only its keys are remapped
+	top.Unsubscribe(children[1])
+	for key, id := range picks {
+		if id.Cmp(children[1]) == 0 {
+			continue
+		}
+		if pick, _ := top.Affine(key, children[0]); pick.Cmp(id) != 0 {
+			t.Fatalf("key %s: moved from retained node: have %v, want %v.", key, pick, id)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// Create a topic with a local member and two remote neighbors
+	owner, parent, child := big.NewInt(141), big.NewInt(1), big.NewInt(2)
+	top := New(big.NewInt(314), owner)
+	top.Subscribe(owner)
+	top.Subscribe(child)
+	top.Reown(parent)
+
+	top.SetMetrics(map[string]float64{"conns": 1})
+	if err := top.ProcessMetrics(parent, map[string]float64{"conns": 2, "shards": 3}); err != nil {
+		t.Fatalf("failed to process parent metrics: %v.", err)
+	}
+	if err := top.ProcessMetrics(child, map[string]float64{"conns": 4}); err != nil {
+		t.Fatalf("failed to process child metrics: %v.", err)
+	}
+	if err := top.ProcessMetrics(big.NewInt(3), map[string]float64{"conns": 8}); err != ErrNotSubscribed {
+		t.Fatalf("stranger metrics error mismatch: have %v, want %v.", err, ErrNotSubscribed)
+	}
+	// Check that each neighbor is reported the sums excluding its own side
+	metrics := top.GenerateMetrics([]*big.Int{parent, child})
+	if metrics[0]["conns"] != 5 || metrics[0]["shards"] != 0 {
+		t.Fatalf("parent report mismatch: have %v, want %v.", metrics[0], map[string]float64{"conns": 5})
+	}
+	if metrics[1]["conns"] != 3 || metrics[1]["shards"] != 3 {
+		t.Fatalf("child report mismatch: have %v, want %v.", metrics[1], map[string]float64{"conns": 3, "shards": 3})
+	}
+	// Check that the snapshot aligns the metrics with the neighbors
+	snap := top.Snapshot()
+	if len(snap.Metrics) != 2 || snap.Metrics[0]["conns"] != 4 || snap.Metrics[1]["conns"] != 2 {
+		t.Fatalf("snapshot metrics mismatch: have %v, want %v.", snap.Metrics, []map[string]float64{{"conns": 4}, {"conns": 2, "shards": 3}})
+	}
+	if snap.Totals["conns"] != 7 || snap.Totals["shards"] != 3 {
+		t.Fatalf("snapshot totals mismatch: have %v, want %v.", snap.Totals, map[string]float64{"conns": 7, "shards": 3})
+	}
+	// Dropping a neighbor should drop its metrics too
+	top.Unsubscribe(child)
+	if totals := top.Snapshot().Totals; totals["conns"] != 3 {
+		t.Fatalf("totals after drop mismatch: have %v, want %v.", totals, map[string]float64{"conns": 3, "shards": 3})
+	}
 }
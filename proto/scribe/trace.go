@@ -0,0 +1,94 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the publish path tracing: an opt-in flag making every node
+// a publish passes through record itself, with the recorded paths returned to
+// the publisher for diagnosing the overlay routes and tree hops.
+
+package scribe
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/project-iris/iris/proto"
+)
+
+// Single step of a traced publish path.
+type Hop struct {
+	Node *big.Int  // Overlay node the publish passed through
+	Time time.Time // Local time of the node when the publish arrived
+}
+
+// Nodes a traced publish traversed from the publisher until a delivering node.
+type Path []Hop
+
+// Publishes a message into topic like Publish, but also traces the paths the
+// copies take through the overlay. Every path reaching a node with local members
+// is reported back, and those collected during the window are returned.
+func (o *Overlay) PublishTraced(topic string, msg *proto.Message, window time.Duration) ([]Path, error) {
+	if err := msg.Encrypt(); err != nil {
+		return nil, err
+	}
+	// Create the trace collector
+	o.lock.Lock()
+	traceId := o.traceIdx
+	o.traceIdx++
+	o.traceLive[traceId] = []Path{}
+	o.lock.Unlock()
+
+	// Send the publish (into every shard) and gather the paths until the window
+	// expires
+	ids := o.resolveAll(topic)
+	for i, msg := range split(msg, len(ids)) {
+		o.sendTracedPublish(ids[i], o.scope(topic), traceId, msg)
+	}
+	time.Sleep(window)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	paths := o.traceLive[traceId]
+	delete(o.traceLive, traceId)
+	return paths, nil
+}
+
+// Appends the local node to the path of a traced publish. Since pastry consults
+// the local node before sending out the forwarded copies too, repeated entries
+// are collapsed.
+func (o *Overlay) traceHop(head *header) {
+	if head.Op != opPublish || head.Trace == 0 {
+		return
+	}
+	self := o.router.Self()
+	if n := len(head.Hops); n > 0 && head.Hops[n-1].Node.Cmp(self) == 0 {
+		return
+	}
+	head.Hops = append(head.Hops, Hop{Node: self, Time: time.Now()})
+}
+
+// Handles a path trace of a publish, storing it if the publisher is still
+// collecting. Otherwise the trace is silently dropped.
+func (o *Overlay) handleTrace(traceId uint64, hops []Hop) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if paths, ok := o.traceLive[traceId]; ok {
+		o.traceLive[traceId] = append(paths, Path(hops))
+	}
+}
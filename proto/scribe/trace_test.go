@@ -0,0 +1,104 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Tests that traced publishes report the paths to every delivering node.
+func TestTrace(t *testing.T) {
+	// Override the overlay configuration
+	swapConfigs()
+	defer swapConfigs()
+
+	nodes := 5
+
+	// Make sure there are enough ports to use
+	olds := config.BootPorts
+	defer func() { config.BootPorts = olds }()
+
+	for i := 0; i < nodes; i++ {
+		config.BootPorts = append(config.BootPorts, 65500+i)
+	}
+	// Load the private key and start up the scribe nodes, subscribing every other
+	key, _ := x509.ParsePKCS1PrivateKey(privKeyDer)
+
+	coll := &collector{
+		publish: []*proto.Message{},
+		balance: []*proto.Message{},
+		direct:  []*proto.Message{},
+	}
+	live := []*Overlay{}
+	for i := 0; i < nodes; i++ {
+		node := New(overId, key, coll)
+		if _, err := node.Boot(); err != nil {
+			t.Fatalf("failed to boot scribe node: %v.", err)
+		}
+		defer node.Shutdown()
+		live = append(live, node)
+	}
+	time.Sleep(time.Second)
+
+	subs := make(map[string]bool)
+	for i := 0; i < nodes; i += 2 {
+		if err := live[i].Subscribe(topicId); err != nil {
+			t.Fatalf("failed to subscribe to topic: %v.", err)
+		}
+		subs[live[i].Self().String()] = false
+	}
+	time.Sleep(time.Second)
+
+	// Publish a traced event from a non-member and verify the paths
+	publisher := live[1]
+	paths, err := publisher.PublishTraced(topicId, &proto.Message{Data: []byte{0x01}}, time.Second)
+	if err != nil {
+		t.Fatalf("failed to publish traced event: %v.", err)
+	}
+	if len(paths) != len(subs) {
+		t.Fatalf("trace count mismatch: have %v, want %v.", len(paths), len(subs))
+	}
+	for i, path := range paths {
+		if len(path) == 0 {
+			t.Fatalf("path %d: empty trace.", i)
+		}
+		if first := path[0].Node; first.Cmp(publisher.Self()) != 0 {
+			t.Fatalf("path %d: origin mismatch: have %v, want %v.", i, first, publisher.Self())
+		}
+		last := path[len(path)-1].Node.String()
+		if seen, ok := subs[last]; !ok || seen {
+			t.Fatalf("path %d: unexpected or duplicate delivering node: %v.", i, last)
+		}
+		subs[last] = true
+
+		for j := 1; j < len(path); j++ {
+			if path[j].Node.Cmp(path[j-1].Node) == 0 {
+				t.Fatalf("path %d: repeated hop at %d: %v.", i, j, path[j].Node)
+			}
+			if path[j].Time.Before(path[j-1].Time) {
+				t.Fatalf("path %d: hop %d time went backwards: %v < %v.", i, j, path[j].Time, path[j-1].Time)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the compact wire format of the carrier headers. The scalar fields and
+// node ids are packed into a versioned varint layout, whereas the upper layer
+// headers and the rarely used composite fields are left to the gob stream.
+
+package scribe
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math/big"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+)
+
+// Layout version of the packed header fields.
+const compactVersion = 2
+
+// Returned when a packed header cannot be parsed.
+var errMalformedHeader = errors.New("malformed carrier header")
+
+// Returned when a packed header uses a layout newer than the local node knows.
+var errUnknownLayout = errors.New("unknown carrier header layout")
+
+// Presence flags of the optional packed fields.
+const (
+	hasSender uint64 = 1 << iota
+	hasId
+	hasTopic
+	hasPrev
+	hasKey
+	hasBounces
+	hasConfirm
+	hasTrace
+	hasName
+	hasQuery
+	hasCount
+	hasJoiner
+	hasSkip
+)
+
+// Wire envelope of a compacted carrier header.
+type compact struct {
+	Meta interface{} // Additional upper layer headers
+	Pack []byte      // Layout version, opcode, presence flags and the set fields
+
+	Report  *report  // CPU load/capacity report
+	Hops    []Hop    // Nodes traversed so far by a traced publish
+	Digest  *digest  // Tree links to verify or repair
+	Standby *standby // Replicated topic root state
+}
+
+// Make sure the compact header is registered with gob (short name, as it is
+// sent along with every carrier message).
+func init() {
+	gob.RegisterName("scribe/2", &compact{})
+}
+
+// Replaces the carrier header of a message with its compact wire form, unless
+// the legacy format is requested (or the header was already stripped).
+func pack(msg *proto.Message) {
+	if config.ScribeWireVersion < compactVersion {
+		return
+	}
+	if head, ok := msg.Head.Meta.(*header); ok {
+		msg.Head.Meta = head.compact()
+	}
+}
+
+// Restores the carrier header of a message from its compact wire form, if the
+// sender used it.
+func unpack(msg *proto.Message) error {
+	if wire, ok := msg.Head.Meta.(*compact); ok {
+		head, err := wire.header()
+		if err != nil {
+			return err
+		}
+		msg.Head.Meta = head
+	}
+	return nil
+}
+
+// Assembles the compact wire form of a carrier header.
+func (h *header) compact() *compact {
+	// Append the set fields, flagging them as present
+	var flags uint64
+	field := make([]byte, 0, 64)
+	putId := func(flag uint64, id *big.Int) {
+		if id != nil {
+			flags |= flag
+			field = putBytes(field, id.Bytes())
+		}
+	}
+	putUint := func(flag uint64, v uint64) {
+		if v != 0 {
+			flags |= flag
+			field = putUvarint(field, v)
+		}
+	}
+	putInt := func(flag uint64, v int) {
+		if v != 0 {
+			flags |= flag
+			field = putVarint(field, int64(v))
+		}
+	}
+	putString := func(flag uint64, s string) {
+		if s != "" {
+			flags |= flag
+			field = putBytes(field, []byte(s))
+		}
+	}
+	putId(hasSender, h.Sender)
+	putUint(hasId, h.Id)
+	putId(hasTopic, h.Topic)
+	putId(hasPrev, h.Prev)
+	putString(hasKey, h.Key)
+	putInt(hasBounces, h.Bounces)
+	putUint(hasConfirm, h.Confirm)
+	putUint(hasTrace, h.Trace)
+	putString(hasName, h.Name)
+	putUint(hasQuery, h.Query)
+	putInt(hasCount, h.Count)
+	putId(hasJoiner, h.Joiner)
+	putId(hasSkip, h.Skip)
+
+	// Prefix the fields with the layout version, opcode and presence flags
+	buf := putUvarint([]byte{compactVersion, byte(h.Op)}, flags)
+	buf = append(buf, field...)
+
+	return &compact{
+		Meta:    h.Meta,
+		Pack:    buf,
+		Report:  h.Report,
+		Hops:    h.Hops,
+		Digest:  h.Digest,
+		Standby: h.Standby,
+	}
+}
+
+// Restores the carrier header from its compact wire form.
+func (c *compact) header() (*header, error) {
+	if len(c.Pack) < 2 {
+		return nil, errMalformedHeader
+	}
+	if c.Pack[0] != compactVersion {
+		return nil, errUnknownLayout
+	}
+	h := &header{
+		Meta:    c.Meta,
+		Op:      opcode(c.Pack[1]),
+		Report:  c.Report,
+		Hops:    c.Hops,
+		Digest:  c.Digest,
+		Standby: c.Standby,
+	}
+	buf := c.Pack[2:]
+	flags, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errMalformedHeader
+	}
+	buf = buf[n:]
+
+	// Parse the present fields in layout order, bailing out on the first failure
+	var err error
+	getId := func(flag uint64) *big.Int {
+		if err != nil || flags&flag == 0 {
+			return nil
+		}
+		var raw []byte
+		if raw, buf, err = getBytes(buf); err != nil {
+			return nil
+		}
+		return new(big.Int).SetBytes(raw)
+	}
+	getUint := func(flag uint64) uint64 {
+		if err != nil || flags&flag == 0 {
+			return 0
+		}
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			err = errMalformedHeader
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+	getInt := func(flag uint64) int {
+		if err != nil || flags&flag == 0 {
+			return 0
+		}
+		v, n := binary.Varint(buf)
+		if n <= 0 {
+			err = errMalformedHeader
+			return 0
+		}
+		buf = buf[n:]
+		return int(v)
+	}
+	getString := func(flag uint64) string {
+		if err != nil || flags&flag == 0 {
+			return ""
+		}
+		var raw []byte
+		if raw, buf, err = getBytes(buf); err != nil {
+			return ""
+		}
+		return string(raw)
+	}
+	h.Sender = getId(hasSender)
+	h.Id = getUint(hasId)
+	h.Topic = getId(hasTopic)
+	h.Prev = getId(hasPrev)
+	h.Key = getString(hasKey)
+	h.Bounces = getInt(hasBounces)
+	h.Confirm = getUint(hasConfirm)
+	h.Trace = getUint(hasTrace)
+	h.Name = getString(hasName)
+	h.Query = getUint(hasQuery)
+	h.Count = getInt(hasCount)
+	h.Joiner = getId(hasJoiner)
+	h.Skip = getId(hasSkip)
+
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != 0 {
+		return nil, errMalformedHeader
+	}
+	return h, nil
+}
+
+// Appends an unsigned varint to a packed buffer.
+func putUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], v)]...)
+}
+
+// Appends a signed varint to a packed buffer.
+func putVarint(buf []byte, v int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutVarint(scratch[:], v)]...)
+}
+
+// Appends a length prefixed byte slice to a packed buffer.
+func putBytes(buf []byte, data []byte) []byte {
+	buf = putUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// Splits a length prefixed byte slice off the front of a packed buffer.
+func getBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, errMalformedHeader
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], nil
+}
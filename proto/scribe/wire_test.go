@@ -0,0 +1,132 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package scribe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/overlay"
+)
+
+// Tests that carrier headers survive the compact wire format, both directly and
+// mixed with legacy headers on the same gob stream.
+func TestCompactHeader(t *testing.T) {
+	heads := []*header{
+		{Op: opSubscribe, Sender: big.NewInt(314)},
+		{Op: opPublish, Sender: overlay.Resolve("sender"), Id: 1 << 40, Topic: overlay.Resolve("topic"), Name: "a/b", Confirm: 7, Trace: 9, Hops: []Hop{{Node: big.NewInt(1)}}},
+		{Op: opBalance, Sender: big.NewInt(1), Topic: big.NewInt(2), Prev: big.NewInt(0), Key: "affinity", Bounces: 2, Skip: big.NewInt(3)},
+		{Op: opCount, Sender: big.NewInt(1), Query: 3, Count: -1},
+		{Op: opRedirect, Sender: big.NewInt(1), Topic: big.NewInt(2), Joiner: big.NewInt(3)},
+		{Op: opReport, Sender: big.NewInt(1), Report: &report{Tops: []*big.Int{big.NewInt(5)}, Caps: []int{10}}},
+	}
+	for i, head := range heads {
+		have, err := head.compact().header()
+		if err != nil {
+			t.Fatalf("header %d: failed to restore compact header: %v.", i, err)
+		}
+		if !sameHeader(have, head) {
+			t.Fatalf("header %d: restored header mismatch: have %+v, want %+v.", i, have, head)
+		}
+	}
+	// Stream the headers in both wire formats and ensure they decode the same
+	buf := new(bytes.Buffer)
+	enc, dec := gob.NewEncoder(buf), gob.NewDecoder(buf)
+	for i, head := range heads {
+		for _, meta := range []interface{}{head, head.compact()} {
+			if err := enc.Encode(&proto.Message{Head: proto.Header{Meta: meta}}); err != nil {
+				t.Fatalf("header %d: failed to encode message: %v.", i, err)
+			}
+			msg := new(proto.Message)
+			if err := dec.Decode(msg); err != nil {
+				t.Fatalf("header %d: failed to decode message: %v.", i, err)
+			}
+			if err := unpack(msg); err != nil {
+				t.Fatalf("header %d: failed to unpack message: %v.", i, err)
+			}
+			if have := msg.Head.Meta.(*header); !sameHeader(have, head) {
+				t.Fatalf("header %d: streamed header mismatch: have %+v, want %+v.", i, have, head)
+			}
+		}
+	}
+}
+
+// Tests that the compact format reduces the per message overhead of the tiny
+// events dominating the pub/sub traffic.
+func TestCompactOverhead(t *testing.T) {
+	head := &header{Op: opPublish, Sender: overlay.Resolve("sender"), Id: 12345, Topic: overlay.Resolve("topic"), Prev: overlay.Resolve("prev")}
+
+	sizes := []int{}
+	for _, meta := range []interface{}{head, head.compact()} {
+		// Skip the type definitions sent once per stream
+		buf := new(bytes.Buffer)
+		enc := gob.NewEncoder(buf)
+		if err := enc.Encode(&proto.Message{Head: proto.Header{Meta: meta}}); err != nil {
+			t.Fatalf("failed to encode message: %v.", err)
+		}
+		buf.Reset()
+		if err := enc.Encode(&proto.Message{Head: proto.Header{Meta: meta}}); err != nil {
+			t.Fatalf("failed to encode message: %v.", err)
+		}
+		sizes = append(sizes, buf.Len())
+	}
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("compact header not smaller: have %d, legacy %d.", sizes[1], sizes[0])
+	}
+}
+
+// Tests that corrupt or unknown compact layouts are rejected.
+func TestCompactInvalid(t *testing.T) {
+	packed := (&header{Op: opPublish, Sender: big.NewInt(1), Topic: big.NewInt(2)}).compact()
+
+	truncated := *packed
+	truncated.Pack = packed.Pack[:len(packed.Pack)-1]
+	if _, err := truncated.header(); err != errMalformedHeader {
+		t.Fatalf("truncated layout error mismatch: have %v, want %v.", err, errMalformedHeader)
+	}
+	trailing := *packed
+	trailing.Pack = append(append([]byte{}, packed.Pack...), 0)
+	if _, err := trailing.header(); err != errMalformedHeader {
+		t.Fatalf("trailing layout error mismatch: have %v, want %v.", err, errMalformedHeader)
+	}
+	future := *packed
+	future.Pack = append([]byte{compactVersion + 1}, packed.Pack[1:]...)
+	if _, err := future.header(); err != errUnknownLayout {
+		t.Fatalf("future layout error mismatch: have %v, want %v.", err, errUnknownLayout)
+	}
+}
+
+// Compares two carrier headers field by field, treating the ids by value.
+func sameHeader(a, b *header) bool {
+	ids := [][2]*big.Int{{a.Sender, b.Sender}, {a.Topic, b.Topic}, {a.Prev, b.Prev}, {a.Joiner, b.Joiner}, {a.Skip, b.Skip}}
+	for _, pair := range ids {
+		if (pair[0] == nil) != (pair[1] == nil) || (pair[0] != nil && pair[0].Cmp(pair[1]) != 0) {
+			return false
+		}
+	}
+	ca, cb := *a, *b
+	ca.Sender, ca.Topic, ca.Prev, ca.Joiner, ca.Skip = nil, nil, nil, nil, nil
+	cb.Sender, cb.Topic, cb.Prev, cb.Joiner, cb.Skip = nil, nil, nil, nil, nil
+	ca.Report, ca.Hops, cb.Report, cb.Hops = nil, nil, nil, nil
+	return reflect.DeepEqual(ca, cb) && (a.Report == nil) == (b.Report == nil) && len(a.Hops) == len(b.Hops)
+}
@@ -21,6 +21,7 @@ package session
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 	"math/big"
 	rng "math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -35,26 +37,63 @@ import (
 	"github.com/project-iris/iris/crypto/sts"
 	"github.com/project-iris/iris/proto"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/throttle"
 )
 
 // Session handshake request multiplexer to choose between the authenticated
-// control channel handshake or the secondary data channel handshake.
+// control channel handshake (full or resumed) or the secondary data channel
+// handshake.
 type initRequest struct {
-	Auth *authRequest
-	Link *linkRequest
+	Auth   *authRequest
+	Link   *linkRequest
+	Resume *resumeRequest
 }
 
 // Authenticated connection request message. Contains the originators ID for
-// key lookup and the client exponential.
+// key lookup, the client exponential (nil if authenticated by TLS), the client's
+// cipher suite, whether it supports the replay protection of the frames, the
+// highest protocol version it speaks, its AEAD modes and compression codecs in
+// order of preference, the fingerprints of its cluster keys (primary first) and
+// whether it solves client puzzles.
 type authRequest struct {
-	Exp *big.Int
+	Exp     *big.Int
+	Suite   string
+	Replay  bool
+	Version int
+	AEADs   []string
+	Keys    [][]byte
+	Codecs  []string
+	Puzzles bool
 }
 
 // Authentication challenge message. Contains the server exponential and the
-// server side auth token (both verification and challenge at the same time).
+// server side auth token (both verification and challenge at the same time), as
+// well as the server's cipher suite (alone if mismatching the client's) and
+// whether it supports the replay protection of the frames and the resumption,
+// the highest protocol version it speaks, the AEAD mode and compression codec it
+// picked and the fingerprint of the cluster key it authenticated with. Above the
+// handshake rate, only a client puzzle is sent instead, or the refusal flagged.
 type authChallenge struct {
-	Exp   *big.Int
-	Token []byte
+	Exp     *big.Int
+	Token   []byte
+	Suite   string
+	Replay  bool
+	Tickets bool
+	Version int
+	AEAD    string
+	Key     []byte
+	Codec   string
+	Puzzle  *puzzle
+	Busy    bool
+}
+
+// Optional protocol features agreed on during the handshake.
+type features struct {
+	replay  bool   // Frames carry sequence numbers, rejecting replays
+	tickets bool   // Server remembers the session for resumption
+	version int    // Highest protocol version spoken by both sides
+	aead    string // AEAD mode sealing the link frames (empty = CTR and HMAC)
+	codec   string // Codec compressing the link payloads (empty = none)
 }
 
 // Authentication challenge response message. Contains the client side token.
@@ -80,9 +119,16 @@ type Listener struct {
 	pendLock sync.RWMutex                  // Lock to protect the pending map
 	pendWait sync.WaitGroup                // Counter to prevent closing the session sink prematurely
 
-	socket *stream.Listener // Stream listener socket to accept connections on
-	key    *rsa.PrivateKey  // Private RSA key to authenticate with
-	quit   chan chan error  // Termination synchronization channel
+	socket  *stream.Listener  // Stream listener socket to accept connections on
+	keys    []*rsa.PrivateKey // Cluster keys to authenticate with (primary first)
+	tls     *tls.Config       // TLS configuration replacing the STS handshake (nil = STS)
+	suite   string            // Cipher suite the remote nodes must match
+	tickets *ticketCache      // Resumption tickets of the recent sessions (nil = disabled)
+	shakes  *throttle.Limiter // Rate limiter of the full handshakes (nil = unlimited)
+	version int               // Highest protocol version advertised to the remote nodes
+	aeads   []string          // AEAD modes accepted from the remote nodes
+	codecs  []string          // Compression codecs accepted from the remote nodes
+	quit    chan chan error   // Termination synchronization channel
 }
 
 // Starts a TCP listener to accept incoming sessions, returning the socket ready
@@ -94,13 +140,23 @@ func Listen(addr *net.TCPAddr, key *rsa.PrivateKey) (*Listener, error) {
 		return nil, err
 	}
 	// Assemble and return the session listener
-	return &Listener{
-		Sink:   make(chan *Session),
-		pends:  make(map[int64]chan *stream.Stream),
-		socket: sock,
-		key:    key,
-		quit:   make(chan chan error),
-	}, nil
+	l := &Listener{
+		Sink:    make(chan *Session),
+		pends:   make(map[int64]chan *stream.Stream),
+		socket:  sock,
+		keys:    ClusterKeys(key),
+		tls:     config.SessionTLS,
+		suite:   localSuite(),
+		version: localVersion(),
+		aeads:   localAEADs(),
+		codecs:  localCodecs(),
+		shakes:  shakeLimiter(),
+		quit:    make(chan chan error),
+	}
+	if l.tls == nil && config.SessionTicketLifetime > 0 {
+		l.tickets = newTicketCache(config.SessionTicketCache)
+	}
+	return l, nil
 }
 
 // Starts the session connection accepter, with a maximum timeout to wait for an
@@ -157,11 +213,32 @@ func (l *Listener) accepter(timeout time.Duration) {
 func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	// Make sure the authentication is synced with the sink
 	defer l.pendWait.Done()
+	start := time.Now()
 
 	// Set an overall time limit for the handshake to complete
 	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
 
+	// Wrap the stream into TLS if configured, authenticating the remote certificate
+	// (rate limited up front, the certificate exchange being the expensive part)
+	var conn *tls.Conn
+	if l.tls != nil {
+		if l.shakes != nil && !l.shakes.Allow(1) {
+			log.Printf("session: refusing remote stream: %v.", ErrThrottled)
+			if err := strm.Close(); err != nil {
+				log.Printf("session: failed to close refused stream: %v.", err)
+			}
+			return
+		}
+		var err error
+		if conn, err = secure(strm, l.tls, true); err != nil {
+			log.Printf("session: failed to secure remote stream: %v.", err)
+			if err = strm.Close(); err != nil {
+				log.Printf("session: failed to close unsecured stream: %v.", err)
+			}
+			return
+		}
+	}
 	// Fetch the session request and multiplex on the contents
 	req := new(initRequest)
 	if err := strm.Recv(req); err != nil {
@@ -173,8 +250,14 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	}
 	switch {
 	case req.Auth != nil:
-		// Authenticate and clean up if unsuccessful
-		secret, err := l.serverAuth(strm, req.Auth)
+		// Authenticate (unless TLS already did) and clean up if unsuccessful
+		var secret []byte
+		var err error
+		if conn != nil {
+			secret, err = l.serverTLSAuth(strm, conn, req.Auth)
+		} else {
+			secret, err = l.serverAuth(strm, req.Auth)
+		}
 		if err != nil {
 			log.Printf("session: failed to authenticate remote stream: %v.", err)
 			if err = strm.Close(); err != nil {
@@ -182,25 +265,32 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 			}
 			return
 		}
-		// Create the session and link a data channel to it
-		sess := newSession(strm, secret, true)
-		if err = l.serverLink(sess); err != nil {
-			log.Printf("session: failed to retrieve data link: %v.", err)
+		feats := features{
+			replay:  req.Auth.Replay,
+			version: agree(l.version, req.Auth.Version),
+			aead:    pickMode(l.aeads, req.Auth.AEADs),
+			codec:   pickMode(l.codecs, req.Auth.Codecs),
+		}
+		l.establish(strm, secret, feats, start, timeout)
+
+	case req.Resume != nil && conn == nil:
+		// Resume a recent session and clean up if unsuccessful
+		secret, err := l.serverResume(strm, req.Resume)
+		if err != nil {
+			log.Printf("session: failed to resume remote session: %v.", err)
 			if err = strm.Close(); err != nil {
-				log.Printf("session: failed to close unlinked stream: %v.", err)
+				log.Printf("session: failed to close unresumed stream: %v.", err)
 			}
 			return
 		}
-		// Session setup complete, send upstream
-		select {
-		case l.Sink <- sess:
-			// Ok
-		case <-time.After(timeout):
-			log.Printf("session: established session not handled in %v, dropping.", timeout)
-			if err = sess.Close(); err != nil {
-				log.Printf("session: failed to close established session: %v.", err)
-			}
+		feats := features{
+			replay:  req.Resume.Replay,
+			version: agree(l.version, req.Resume.Version),
+			aead:    pickMode(l.aeads, req.Resume.AEADs),
+			codec:   pickMode(l.codecs, req.Resume.Codecs),
 		}
+		l.establish(strm, secret, feats, start, timeout)
+
 	case req.Link != nil:
 		// Extract the temporary session id and link this stream to it
 		l.pendLock.Lock()
@@ -221,92 +311,255 @@ func (l *Listener) serverHandle(strm *stream.Stream, timeout time.Duration) {
 	}
 }
 
-// Connects to a remote node and negotiates a session.
+// Creates the session of an authenticated control stream, links a data channel to
+// it and sends it upstream, remembering it for resumption if enabled.
+func (l *Listener) establish(strm *stream.Stream, secret []byte, feats features, start time.Time, timeout time.Duration) {
+	// Create the session and link a data channel to it
+	sess := newSession(strm, secret, true, feats)
+	if err := l.serverLink(sess); err != nil {
+		log.Printf("session: failed to retrieve data link: %v.", err)
+		if err = strm.Close(); err != nil {
+			log.Printf("session: failed to close unlinked stream: %v.", err)
+		}
+		return
+	}
+	sess.shake = time.Since(start)
+
+	if l.tickets != nil {
+		tick := newTicket(secret)
+		l.tickets.store(string(tick.id), tick)
+	}
+	// Session setup complete, send upstream
+	select {
+	case l.Sink <- sess:
+		// Ok
+	case <-time.After(timeout):
+		log.Printf("session: established session not handled in %v, dropping.", timeout)
+		if err := sess.Close(); err != nil {
+			log.Printf("session: failed to close established session: %v.", err)
+		}
+	}
+}
+
+// Connects to a remote node and negotiates a session, resuming a recent one with
+// the same node if possible (skipping the asymmetric handshake).
 func Dial(host string, port int, key *rsa.PrivateKey) (*Session, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	slot := ticketSlot(addr, key)
+	cfg := config.SessionTLS
+
+	if tick := clientTickets.take(slot); tick != nil && cfg == nil {
+		sess, err := dial(addr, slot, cfg, func(strm *stream.Stream) ([]byte, features, error) {
+			return clientResume(strm, tick)
+		})
+		if err == nil {
+			return sess, nil
+		}
+		log.Printf("session: failed to resume session, falling back to full handshake: %v.", err)
+	}
+	return dial(addr, slot, cfg, func(strm *stream.Stream) ([]byte, features, error) {
+		if cfg != nil {
+			return clientTLSAuth(strm, cfg)
+		}
+		return clientAuth(strm, key)
+	})
+}
+
+// Connects to a remote node and sets up a session, authenticated by the given
+// handshake, remembering any resumption ticket in the given slot.
+func dial(addr, slot string, cfg *tls.Config, auth func(*stream.Stream) ([]byte, features, error)) (*Session, error) {
+	start := time.Now()
+
 	// Open the stream connection
-	addr := fmt.Sprintf("%s:%d", host, port)
 	strm, err := stream.Dial(addr, config.SessionDialTimeout)
 	if err != nil {
 		return nil, err
 	}
 	// Set up the authenticated session
-	secret, err := clientAuth(strm, key)
+	secret, feats, err := auth(strm)
 	if err != nil {
 		log.Printf("session: failed to authenticate connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unauthenticated connection: %v.", err)
 		}
+		return nil, err
 	}
 	// Link a new data connection to it
-	sess := newSession(strm, secret, false)
-	if err = clientLink(sess); err != nil {
+	sess := newSession(strm, secret, false, feats)
+	if err = clientLink(sess, cfg); err != nil {
 		log.Printf("session: failed to link data connection: %v.", err)
 		if err := strm.Close(); err != nil {
 			log.Printf("session: failed to close unlinked connection: %v.", err)
 		}
 		return nil, err
 	}
+	sess.shake = time.Since(start)
+
+	if feats.tickets && config.SessionTicketLifetime > 0 {
+		clientTickets.store(slot, newTicket(secret))
+	}
 	return sess, nil
 }
 
-// Client side of the STS session negotiation.
-func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, error) {
+// Creates a new STS session over the configured cyclic group or elliptic curve.
+func newSTS() (*sts.Session, error) {
+	if config.StsX25519 {
+		return sts.NewX25519(rand.Reader, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	}
+	return sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+}
+
+// Client side of the STS session negotiation, returning the agreed secret and
+// the optional features supported by the server.
+func clientAuth(strm *stream.Stream, key *rsa.PrivateKey) ([]byte, features, error) {
 	// Set an overall time limit for the handshake to complete
 	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
 	defer strm.Sock().SetDeadline(time.Time{})
+	suite, aeads, codecs, keys := localSuite(), localAEADs(), localCodecs(), ClusterKeys(key)
 
 	// Create a new empty session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator, config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	stsSess, err := newSTS()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new session: %v", err)
+		return nil, features{}, fmt.Errorf("failed to create new session: %v", err)
 	}
 	// Initiate a key exchange, send the exponential
 	exp, err := stsSess.Initiate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to initiate key exchange: %v", err)
+		return nil, features{}, fmt.Errorf("failed to initiate key exchange: %v", err)
 	}
 	req := &initRequest{
-		Auth: &authRequest{exp},
+		Auth: &authRequest{exp, suite, true, localVersion(), aeads, fingerprints(keys), codecs, true},
 	}
 	if err = strm.Send(req); err != nil {
-		return nil, fmt.Errorf("failed to send auth request: %v", err)
+		return nil, features{}, fmt.Errorf("failed to send auth request: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth request: %v", err)
+		return nil, features{}, fmt.Errorf("failed to flush auth request: %v", err)
 	}
 	// Receive the foreign exponential and auth token and if verifies, send own auth
 	chall := new(authChallenge)
 	if err = strm.Recv(chall); err != nil {
-		return nil, fmt.Errorf("failed to receive auth challenge: %v", err)
+		return nil, features{}, fmt.Errorf("failed to receive auth challenge: %v", err)
+	}
+	// Solve any puzzle demanded by a server above its handshake rate first
+	if chall.Puzzle != nil {
+		if err = answer(strm, chall.Puzzle); err != nil {
+			return nil, features{}, err
+		}
+		chall = new(authChallenge)
+		if err = strm.Recv(chall); err != nil {
+			return nil, features{}, fmt.Errorf("failed to receive auth challenge: %v", err)
+		}
+	}
+	if chall.Busy {
+		return nil, features{}, ErrThrottled
+	}
+	if err = matchSuite(suite, chall.Suite); err != nil {
+		return nil, features{}, err
+	}
+	if err = checkMode(aeads, chall.AEAD); err != nil {
+		return nil, features{}, err
+	}
+	if err = checkMode(codecs, chall.Codec); err != nil {
+		return nil, features{}, err
+	}
+	// Authenticate with the cluster key picked by the server (primary if unnamed)
+	if chall.Exp == nil {
+		return nil, features{}, ErrKeyMismatch
+	}
+	if len(chall.Key) > 0 {
+		if key = pickKey(keys, [][]byte{chall.Key}); key == nil {
+			return nil, features{}, fmt.Errorf("%v: unoffered key %x", ErrKeyMismatch, chall.Key)
+		}
 	}
 	token, err := stsSess.Verify(rand.Reader, key, &key.PublicKey, chall.Exp, chall.Token)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify acceptor auth token: %v", err)
+		return nil, features{}, fmt.Errorf("failed to verify acceptor auth token: %v", err)
 	}
 	if err = strm.Send(authResponse{token}); err != nil {
-		return nil, fmt.Errorf("failed to send auth response: %v", err)
+		return nil, features{}, fmt.Errorf("failed to send auth response: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush auth response: %v", err)
+		return nil, features{}, fmt.Errorf("failed to flush auth response: %v", err)
 	}
-	return stsSess.Secret()
+	secret, err := stsSess.Secret()
+	return secret, features{chall.Replay, chall.Tickets, agree(localVersion(), chall.Version), chall.AEAD, chall.Codec}, err
+}
+
+// Client side of the TLS session negotiation: the certificates are verified by
+// the TLS handshake, after which the session is requested within.
+func clientTLSAuth(strm *stream.Stream, cfg *tls.Config) ([]byte, features, error) {
+	// Set an overall time limit for the handshake to complete
+	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+	defer strm.Sock().SetDeadline(time.Time{})
+	suite, aeads, codecs := localSuite(), localAEADs(), localCodecs()
+
+	conn, err := secure(strm, cfg, false)
+	if err != nil {
+		return nil, features{}, fmt.Errorf("failed to secure connection: %v", err)
+	}
+	if err = strm.Send(&initRequest{Auth: &authRequest{Suite: suite, Replay: true, Version: localVersion(), AEADs: aeads, Codecs: codecs}}); err != nil {
+		return nil, features{}, fmt.Errorf("failed to send auth request: %v", err)
+	}
+	if err = strm.Flush(); err != nil {
+		return nil, features{}, fmt.Errorf("failed to flush auth request: %v", err)
+	}
+	// Make sure the server agrees on the cipher suite
+	chall := new(authChallenge)
+	if err = strm.Recv(chall); err != nil {
+		return nil, features{}, fmt.Errorf("failed to receive auth challenge: %v", err)
+	}
+	if err = matchSuite(suite, chall.Suite); err != nil {
+		return nil, features{}, err
+	}
+	if err = checkMode(aeads, chall.AEAD); err != nil {
+		return nil, features{}, err
+	}
+	if err = checkMode(codecs, chall.Codec); err != nil {
+		return nil, features{}, err
+	}
+	secret, err := tlsSecret(conn)
+	return secret, features{chall.Replay, chall.Tickets, agree(localVersion(), chall.Version), chall.AEAD, chall.Codec}, err
 }
 
 // Executes the server side authentication and returns either the agreed secret
 // session key or the a failure reason.
 func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, error) {
+	// Reject the exchange outright if the cipher suites mismatch
+	if err := matchSuite(l.suite, req.Suite); err != nil {
+		return nil, l.reject(strm, err)
+	}
+	// Pick the cluster key to authenticate with, rejecting strangers
+	key := pickKey(l.keys, req.Keys)
+	if key == nil {
+		return nil, l.reject(strm, ErrKeyMismatch)
+	}
+	// Hold back floods before any expensive operation (puzzling capable clients)
+	if err := l.admit(strm, req.Puzzles); err != nil {
+		return nil, l.reject(strm, err)
+	}
 	// Create a new STS session
-	stsSess, err := sts.New(rand.Reader, config.StsGroup, config.StsGenerator,
-		config.StsCipher, config.StsCipherBits, config.StsSigHash)
+	stsSess, err := newSTS()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create STS session: %v", err)
 	}
 	// Accept the incoming key exchange request and send back own exp + auth token
-	exp, token, err := stsSess.Accept(rand.Reader, l.key, req.Exp)
+	exp, token, err := stsSess.Accept(rand.Reader, key, req.Exp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to accept incoming exchange: %v", err)
 	}
-	if err = strm.Send(authChallenge{exp, token}); err != nil {
+	chall := authChallenge{
+		Exp:     exp,
+		Token:   token,
+		Suite:   l.suite,
+		Replay:  true,
+		Tickets: l.tickets != nil,
+		Version: l.version,
+		AEAD:    pickMode(l.aeads, req.AEADs),
+		Key:     fingerprint(key),
+		Codec:   pickMode(l.codecs, req.Codecs),
+	}
+	if err = strm.Send(chall); err != nil {
 		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
 	}
 	if err = strm.Flush(); err != nil {
@@ -317,12 +570,45 @@ func (l *Listener) serverAuth(strm *stream.Stream, req *authRequest) ([]byte, er
 	if err = strm.Recv(resp); err != nil {
 		return nil, fmt.Errorf("failed to decode auth response: %v", err)
 	}
-	if err = stsSess.Finalize(&l.key.PublicKey, resp.Token); err != nil {
+	if err = stsSess.Finalize(&key.PublicKey, resp.Token); err != nil {
 		return nil, fmt.Errorf("failed to finalize exchange: %v", err)
 	}
 	return stsSess.Secret()
 }
 
+// Executes the server side of a TLS authenticated session request, the remote
+// certificate being already verified: agrees on the cipher suite and returns the
+// secret session key exported from TLS.
+func (l *Listener) serverTLSAuth(strm *stream.Stream, conn *tls.Conn, req *authRequest) ([]byte, error) {
+	if err := matchSuite(l.suite, req.Suite); err != nil {
+		return nil, l.reject(strm, err)
+	}
+	chall := authChallenge{
+		Suite:   l.suite,
+		Replay:  true,
+		Version: l.version,
+		AEAD:    pickMode(l.aeads, req.AEADs),
+		Codec:   pickMode(l.codecs, req.Codecs),
+	}
+	if err := strm.Send(chall); err != nil {
+		return nil, fmt.Errorf("failed to encode auth challenge: %v", err)
+	}
+	if err := strm.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush auth challenge: %v", err)
+	}
+	return tlsSecret(conn)
+}
+
+// Notifies the client of a failed negotiation (cipher suite or cluster key
+// mismatch, or exceeded handshake rate) by sending back only the local suite and
+// whether throttled, returning the original failure.
+func (l *Listener) reject(strm *stream.Stream, err error) error {
+	if strm.Send(authChallenge{Suite: l.suite, Busy: err == ErrThrottled}) == nil {
+		strm.Flush()
+	}
+	return err
+}
+
 // Initializes a data channel linking process, waiting for the data stream to be
 // assigned.
 func (l *Listener) serverLink(sess *Session) error {
@@ -352,7 +638,7 @@ func (l *Listener) serverLink(sess *Session) error {
 	// Wait for the data link or time out
 	select {
 	case strm := <-data:
-		sess.init(strm, true)
+		sess.init(strm)
 	case <-time.After(config.SessionLinkTimeout):
 		return errors.New("link timeout")
 	}
@@ -377,7 +663,7 @@ func (l *Listener) serverLink(sess *Session) error {
 }
 
 // Initiates a data channel link to the specified control channel.
-func clientLink(sess *Session) error {
+func clientLink(sess *Session, cfg *tls.Config) error {
 	// Wait for the server to specify the session id
 	msg, err := sess.CtrlLink.RecvDirect()
 	if err != nil {
@@ -389,6 +675,15 @@ func clientLink(sess *Session) error {
 	if err != nil {
 		return fmt.Errorf("failed to establish data link: %v", err)
 	}
+	if cfg != nil {
+		strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+		_, err = secure(strm, cfg, false)
+		strm.Sock().SetDeadline(time.Time{})
+		if err != nil {
+			strm.Close()
+			return fmt.Errorf("failed to secure data link: %v", err)
+		}
+	}
 	// Send the temporary id back on the data stream
 	req := &initRequest{
 		Link: &linkRequest{msg.Head.Meta.(*linkRequest).Id},
@@ -402,7 +697,7 @@ func clientLink(sess *Session) error {
 		return fmt.Errorf("failed to flush link request: %v", err)
 	}
 	// Finalize the session with the data stream
-	sess.init(strm, false)
+	sess.init(strm)
 
 	// Send the data link authentication
 	auth := &proto.Message{
@@ -19,11 +19,18 @@
 package session
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/stream"
 )
 
 // Tests whether the session handshake works.
@@ -49,6 +56,14 @@ func TestHandshake(t *testing.T) {
 		// Make sure the server also gets back a live session
 		select {
 		case server := <-sock.Sink:
+			// Verify that the setup has been accounted for on both sides
+			cs, ss := client.Stats(), server.Stats()
+			if cs.Handshake <= 0 || ss.Handshake <= 0 {
+				t.Fatalf("handshake time mismatch: client %v, server %v.", cs.Handshake, ss.Handshake)
+			}
+			if cs.FramesOut == 0 || cs.FramesOut != ss.FramesIn || cs.BytesIn != ss.BytesOut {
+				t.Fatalf("traffic stats mismatch: client %+v, server %+v.", cs.Stats, ss.Stats)
+			}
 			// Close the two sessions
 			if err := client.Close(); err != nil {
 				t.Fatalf("failed to close client session: %v.", err)
@@ -122,3 +137,434 @@ func BenchmarkHandshake(b *testing.B) {
 		b.Fatalf("failed to terminate session listener: %v.", err)
 	}
 }
+
+// Tests that sessions between nodes of mismatching cipher suites fail clearly.
+func TestSuiteMismatch(t *testing.T) {
+	// Make sure the defaults interoperate with nodes predating the negotiation
+	if suite := localSuite(); suite != legacySuite {
+		t.Fatalf("default suite mismatch: have %v, want %v.", suite, legacySuite)
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	// Dial with a larger link key and make sure the mismatch is reported
+	defer func(bits int) { config.SessionCipherBits = bits }(config.SessionCipherBits)
+	config.SessionCipherBits = 256
+
+	sess, err := Dial("localhost", addr.Port, key)
+	if err == nil {
+		sess.Close()
+		t.Fatalf("mismatching suite accepted.")
+	}
+	if !strings.Contains(err.Error(), ErrSuiteMismatch.Error()) {
+		t.Fatalf("mismatch error mismatch: have %v, want %v.", err, ErrSuiteMismatch)
+	}
+}
+
+// Tests that reconnecting to a recently seen node resumes the session instead of
+// running a full handshake, but only once and only for the same cluster key.
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect with a full handshake to obtain a ticket
+	client, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	client.Close()
+	(<-sock.Sink).Close()
+
+	// A node dialing with a foreign key must not inherit the ticket
+	if client, err := Dial("localhost", addr.Port, other); err == nil {
+		client.Close()
+		t.Fatalf("foreign key inherited the resumption ticket.")
+	}
+	// Resume with the ticket, and verify that it cannot be replayed
+	remote := net.JoinHostPort("localhost", strconv.Itoa(addr.Port))
+	slot := ticketSlot(remote, key)
+
+	tick := clientTickets.take(slot)
+	if tick == nil {
+		t.Fatalf("resumption ticket missing.")
+	}
+	for i, pass := range []bool{true, false} {
+		client, err := dial(remote, slot, nil, func(strm *stream.Stream) ([]byte, features, error) {
+			return clientResume(strm, tick)
+		})
+		if (err == nil) != pass {
+			t.Fatalf("resume %d: result mismatch: have %v, want pass %v.", i, err, pass)
+		}
+		if err != nil {
+			break
+		}
+		server := <-sock.Sink
+		if !bytes.Equal(client.Binding(), server.Binding()) {
+			t.Fatalf("resume %d: session binding mismatch: have %x, want %x.", i, server.Binding(), client.Binding())
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// Tests that sessions run at the highest protocol version both sides speak.
+func TestVersion(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	defer func(version int) { config.SessionVersion = version }(config.SessionVersion)
+	for _, version := range []int{Version, LabeledVersion - 1, 0} {
+		config.SessionVersion = version
+
+		client, err := Dial("localhost", addr.Port, key)
+		if err != nil {
+			t.Fatalf("version %d: failed to connect to the server: %v.", version, err)
+		}
+		server := <-sock.Sink
+		if client.Version() != version || server.Version() != version {
+			t.Fatalf("version %d: agreed version mismatch: client %d, server %d.", version, client.Version(), server.Version())
+		}
+		// Make sure the links are keyed by the same schedule on both sides
+		client.Start(1)
+		server.Start(1)
+
+		msg := &proto.Message{Head: proto.Header{Meta: []byte{byte(version)}}, Data: []byte{1, 2, 3}}
+		msg.Encrypt()
+		client.DataLink.Send <- msg
+		select {
+		case recv := <-server.DataLink.Recv:
+			if !bytes.Equal(recv.Data, msg.Data) {
+				t.Fatalf("version %d: data mismatch: have %v, want %v.", version, recv.Data, msg.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("version %d: message not delivered.", version)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client.Close()
+		}()
+		server.Close()
+		<-done
+	}
+}
+
+// Tests that the AEAD mode of the links is the client's most preferred one also
+// accepted by the server, falling back to CTR and HMAC if they share none.
+func TestAEAD(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	defer func(modes []string, accel bool) {
+		config.SessionAEADs, config.SessionAEADAccel = modes, accel
+	}(config.SessionAEADs, config.SessionAEADAccel)
+	config.SessionAEADAccel = false
+
+	for i, tt := range []struct {
+		server []string
+		client []string
+		mode   string
+	}{
+		{[]string{"aes-gcm", "chacha20-poly1305"}, []string{"chacha20-poly1305", "aes-gcm"}, "chacha20-poly1305"},
+		{[]string{"aes-gcm"}, []string{"chacha20-poly1305", "aes-gcm"}, "aes-gcm"},
+		{[]string{"aes-gcm"}, nil, ""},
+		{nil, []string{"aes-gcm"}, ""},
+	} {
+		config.SessionAEADs = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		config.SessionAEADs = tt.client
+		client, err := Dial("localhost", addr.Port, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		server := <-sock.Sink
+		if client.aead != tt.mode || server.aead != tt.mode {
+			t.Fatalf("test %d: AEAD mode mismatch: client %q, server %q, want %q.", i, client.aead, server.aead, tt.mode)
+		}
+		// Make sure the links actually work in the agreed mode
+		client.Start(1)
+		server.Start(1)
+
+		msg := &proto.Message{Head: proto.Header{Meta: []byte{byte(i)}}, Data: []byte{1, 2, 3}}
+		msg.Encrypt()
+		client.DataLink.Send <- msg
+		select {
+		case recv := <-server.DataLink.Recv:
+			if !bytes.Equal(recv.Data, msg.Data) {
+				t.Fatalf("test %d: data mismatch: have %v, want %v.", i, recv.Data, msg.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: message not delivered.", i)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client.Close()
+		}()
+		server.Close()
+		<-done
+		sock.Close()
+	}
+}
+
+// Tests that the payload compression codec is only enabled if both sides of the
+// session support it.
+func TestCompression(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	defer func(codecs []string) { config.SessionCompression = codecs }(config.SessionCompression)
+	for i, tt := range []struct {
+		server []string
+		client []string
+		codec  string
+	}{
+		{[]string{"snappy"}, []string{"snappy"}, "snappy"},
+		{[]string{"snappy"}, nil, ""},
+		{nil, []string{"snappy"}, ""},
+	} {
+		config.SessionCompression = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		config.SessionCompression = tt.client
+		client, err := Dial("localhost", addr.Port, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		server := <-sock.Sink
+		if client.codec != tt.codec || server.codec != tt.codec {
+			t.Fatalf("test %d: codec mismatch: client %q, server %q, want %q.", i, client.codec, server.codec, tt.codec)
+		}
+		// Make sure compressible payloads get through intact
+		client.Start(1)
+		server.Start(1)
+
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		msg := &proto.Message{Head: proto.Header{Meta: []byte{byte(i)}}, Data: append([]byte{}, data...)}
+		msg.Encrypt()
+		client.DataLink.Send <- msg
+		select {
+		case recv := <-server.DataLink.Recv:
+			if err := recv.Decrypt(); err != nil {
+				t.Fatalf("test %d: failed to decrypt payload: %v.", i, err)
+			}
+			if !bytes.Equal(recv.Data, data) {
+				t.Fatalf("test %d: data mismatch.", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: message not delivered.", i)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client.Close()
+		}()
+		server.Close()
+		<-done
+		sock.Close()
+	}
+}
+
+// Tests that sessions can be established with either of the two cluster keys
+// during a rotation, but not without any shared key.
+func TestRotation(t *testing.T) {
+	t.Parallel()
+
+	old, _ := rsa.GenerateKey(rand.Reader, 1024)
+	cur, _ := rsa.GenerateKey(rand.Reader, 1024)
+	next, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	// Promote the current key on one side, and introduce the next on the other
+	Rotate(cur, old)
+	defer Rotate(cur, nil)
+	Rotate(next, old)
+	defer Rotate(next, nil)
+
+	for i, tt := range []struct {
+		server *rsa.PrivateKey
+		client *rsa.PrivateKey
+	}{
+		{old, cur},  // Rotating client dialing a legacy node
+		{cur, old},  // Legacy client dialing a rotating node
+		{cur, next}, // Both rotating, sharing only the secondary
+		{next, old},
+	} {
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, tt.server)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		client, err := Dial("localhost", addr.Port, tt.client)
+		if err != nil {
+			t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+		}
+		client.Close()
+		(<-sock.Sink).Close()
+		sock.Close()
+	}
+	// Ensure that nodes without a shared key cannot connect
+	Rotate(cur, nil)
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	sock, err := Listen(addr, cur)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	if client, err := Dial("localhost", addr.Port, old); err == nil {
+		client.Close()
+		t.Fatalf("session established without a shared key.")
+	} else if !strings.Contains(err.Error(), ErrKeyMismatch.Error()) {
+		t.Fatalf("key error mismatch: have %v, want %v.", err, ErrKeyMismatch)
+	}
+}
+
+// Tests that sessions can be negotiated over the X25519 key exchange, and that
+// nodes on mismatching exchanges are rejected.
+func TestX25519(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	defer func(curve bool) { config.StsX25519 = curve }(config.StsX25519)
+	for i, tt := range []struct {
+		server bool
+		client bool
+	}{
+		{true, true},
+		{false, true},
+		{true, false},
+	} {
+		config.StsX25519 = tt.server
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		config.StsX25519 = tt.client
+		client, err := Dial("localhost", addr.Port, key)
+		if tt.server == tt.client {
+			if err != nil {
+				t.Fatalf("test %d: failed to connect to the server: %v.", i, err)
+			}
+			server := <-sock.Sink
+			if !bytes.Equal(client.Binding(), server.Binding()) {
+				t.Fatalf("test %d: session binding mismatch: have %x, want %x.", i, server.Binding(), client.Binding())
+			}
+			client.Close()
+			server.Close()
+		} else if err == nil || !strings.Contains(err.Error(), ErrSuiteMismatch.Error()) {
+			t.Fatalf("test %d: mismatch error mismatch: have %v, want %v.", i, err, ErrSuiteMismatch)
+		}
+		sock.Close()
+	}
+}
+
+// Tests that full handshakes above the rate limit are refused, or puzzled if the
+// puzzles are enabled, whereas resumptions are let through regardless.
+func TestShakeRate(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	defer func(rate, bits int) {
+		config.SessionShakeRate, config.SessionPuzzleBits = rate, bits
+	}(config.SessionShakeRate, config.SessionPuzzleBits)
+	config.SessionShakeRate = 1
+
+	for i, bits := range []int{0, 8} {
+		config.SessionPuzzleBits = bits
+
+		addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+		sock, err := Listen(addr, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to start the session listener: %v.", i, err)
+		}
+		sock.Accept(100 * time.Millisecond)
+
+		// Run full handshakes, the second one exceeding the rate
+		remote := net.JoinHostPort("localhost", strconv.Itoa(addr.Port))
+		slot := ticketSlot(remote, key)
+		for j := 0; j < 2; j++ {
+			client, err := dial(remote, slot, nil, func(strm *stream.Stream) ([]byte, features, error) {
+				return clientAuth(strm, key)
+			})
+			if j == 0 || bits > 0 {
+				if err != nil {
+					t.Fatalf("test %d, shake %d: failed to connect to the server: %v.", i, j, err)
+				}
+				client.Close()
+				(<-sock.Sink).Close()
+			} else if err != ErrThrottled {
+				t.Fatalf("test %d, shake %d: throttle error mismatch: have %v, want %v.", i, j, err, ErrThrottled)
+			}
+		}
+		// Resume with the ticket of the first session, bypassing the rate limit
+		client, err := Dial("localhost", addr.Port, key)
+		if err != nil {
+			t.Fatalf("test %d: failed to resume session: %v.", i, err)
+		}
+		client.Close()
+		(<-sock.Sink).Close()
+
+		sock.Close()
+	}
+}
+
+// Tests that client puzzles are solved to the demanded difficulty, and that the
+// overly hard ones are refused.
+func TestPuzzle(t *testing.T) {
+	chall := &puzzle{Cookie: []byte("iris.puzzle.test"), Bits: 12}
+	nonce, err := chall.solve()
+	if err != nil {
+		t.Fatalf("failed to solve puzzle: %v.", err)
+	}
+	if !chall.verify(nonce) {
+		t.Fatalf("puzzle solution rejected: %v.", nonce)
+	}
+	chall.Bits = 32
+	if chall.verify(nonce) {
+		t.Fatalf("puzzle solution accepted for harder difficulty: %v.", nonce)
+	}
+	if _, err := chall.solve(); err == nil {
+		t.Fatalf("overly hard puzzle accepted.")
+	}
+}
@@ -0,0 +1,154 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the handshake flood protection: the full session handshakes cost the
+// accepting side expensive asymmetric operations, so a spray of initiations could
+// exhaust its CPU. The rate of accepted full handshakes is thus capped by a token
+// bucket per listener. Above the rate, clients supporting them are handed a client
+// puzzle instead of the auth challenge (a random cookie, to be hashed with a nonce
+// into a given number of leading zero bits), shifting the cost of the exchange
+// onto the initiator, whereas legacy clients are refused until the rate recovers.
+//
+// Resumptions and data link attachments are cheap, thus never limited. In TLS
+// mode the certificate exchange precedes the session request, so every inbound
+// stream counts against the rate and no puzzles can be handed out.
+
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/throttle"
+)
+
+// Highest puzzle difficulty a client is willing to solve (leading zero bits).
+const MaxPuzzleBits = 24
+
+// Returned when the remote side refuses the handshake due to its rate limit.
+var ErrThrottled = errors.New("handshake rate exceeded")
+
+// Returned when a client puzzle is demanded harder than willing to solve, or is
+// answered incorrectly.
+var ErrPuzzle = errors.New("client puzzle unsolved")
+
+// Client puzzle handed out in place of the auth challenge above the handshake
+// rate: a nonce needs to be found, which hashed after the cookie yields at least
+// the given number of leading zero bits.
+type puzzle struct {
+	Cookie []byte
+	Bits   int
+}
+
+// Client puzzle answer message, sent back on the same stream.
+type puzzleAnswer struct {
+	Nonce uint64
+}
+
+// Creates the handshake rate limiter of a listener (nil if unlimited).
+func shakeLimiter() *throttle.Limiter {
+	if rate := config.SessionShakeRate; rate > 0 {
+		return throttle.New(float64(rate), 0)
+	}
+	return nil
+}
+
+// Checks whether a nonce solves the puzzle, buf being a scratch space holding the
+// cookie with room for the nonce after it.
+func (p *puzzle) solves(buf []byte, nonce uint64) bool {
+	binary.BigEndian.PutUint64(buf[len(p.Cookie):], nonce)
+	sum := sha256.Sum256(buf)
+	for i := 0; i < p.Bits; i++ {
+		if sum[i/8]&(0x80>>uint(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Verifies an answer to the puzzle.
+func (p *puzzle) verify(nonce uint64) bool {
+	buf := append(append([]byte{}, p.Cookie...), make([]byte, 8)...)
+	return p.solves(buf, nonce)
+}
+
+// Finds a nonce solving the puzzle by brute force, refusing overly hard ones.
+func (p *puzzle) solve() (uint64, error) {
+	if p.Bits < 0 || p.Bits > MaxPuzzleBits {
+		return 0, fmt.Errorf("%v: difficulty %d bits", ErrPuzzle, p.Bits)
+	}
+	buf := append(append([]byte{}, p.Cookie...), make([]byte, 8)...)
+	for nonce := uint64(0); ; nonce++ {
+		if p.solves(buf, nonce) {
+			return nonce, nil
+		}
+	}
+}
+
+// Admits a full handshake if within the rate limit, otherwise demands a solved
+// puzzle from clients supporting them, refusing the rest.
+func (l *Listener) admit(strm *stream.Stream, solver bool) error {
+	if l.shakes == nil || l.shakes.Allow(1) {
+		return nil
+	}
+	bits := config.SessionPuzzleBits
+	if bits <= 0 || !solver {
+		return ErrThrottled
+	}
+	// Hand out a fresh puzzle and verify the answer
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		return fmt.Errorf("failed to generate puzzle: %v", err)
+	}
+	chall := &puzzle{cookie, bits}
+	if err := strm.Send(authChallenge{Suite: l.suite, Puzzle: chall}); err != nil {
+		return fmt.Errorf("failed to send puzzle: %v", err)
+	}
+	if err := strm.Flush(); err != nil {
+		return fmt.Errorf("failed to flush puzzle: %v", err)
+	}
+	ans := new(puzzleAnswer)
+	if err := strm.Recv(ans); err != nil {
+		return fmt.Errorf("failed to receive puzzle answer: %v", err)
+	}
+	if !chall.verify(ans.Nonce) {
+		return ErrPuzzle
+	}
+	return nil
+}
+
+// Solves a puzzle handed out by the server in place of the auth challenge and
+// sends back the answer.
+func answer(strm *stream.Stream, chall *puzzle) error {
+	nonce, err := chall.solve()
+	if err != nil {
+		return err
+	}
+	if err = strm.Send(puzzleAnswer{nonce}); err != nil {
+		return fmt.Errorf("failed to send puzzle answer: %v", err)
+	}
+	if err = strm.Flush(); err != nil {
+		return fmt.Errorf("failed to flush puzzle answer: %v", err)
+	}
+	return nil
+}
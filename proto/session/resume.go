@@ -0,0 +1,260 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the resumption of recent sessions, letting a node reconnecting to a
+// known peer skip the asymmetric STS handshake (sparing the CPU of both during the
+// reconnect storms following network blips). After every session set up, both
+// sides derive a ticket from its secret: an id and a resumption secret. The dialer
+// remembers it by the remote address, the acceptor by the id. On reconnect the
+// dialer presents the id and a fresh nonce, the acceptor answers with its own, and
+// both derive the new session secret from the resumption secret and the nonces,
+// so only the holders of the ticket can run the links.
+//
+// Tickets are single use and expire after the configured lifetime; any failure
+// to resume falls back to a full handshake. TLS sessions rely on the resumption
+// of TLS itself instead.
+
+package session
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.crypto/hkdf"
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/stream"
+)
+
+// Session resumption request message. Contains the ticket id, the client nonce,
+// the client's cipher suite, whether it supports the replay protection, the
+// highest protocol version it speaks and its AEAD modes and compression codecs
+// in order of preference.
+type resumeRequest struct {
+	Ticket  []byte
+	Nonce   []byte
+	Suite   string
+	Replay  bool
+	Version int
+	AEADs   []string
+	Codecs  []string
+}
+
+// Session resumption reply message. Contains whether the ticket was accepted, the
+// server nonce, the highest protocol version the server speaks and the AEAD mode
+// and compression codec it picked.
+type resumeReply struct {
+	Ok      bool
+	Nonce   []byte
+	Version int
+	AEAD    string
+	Codec   string
+}
+
+// Size of the ticket ids, resumption secrets and nonces.
+const ticketSize = 32
+
+// Returned when the acceptor doesn't know (or no longer accepts) a ticket.
+var ErrTicketRejected = errors.New("resumption ticket rejected")
+
+// Info values of the ticket and resumed secret HKDF expansions.
+var (
+	ticketInfo = []byte("iris.proto.session.hkdf.ticket")
+	resumeInfo = []byte("iris.proto.session.hkdf.resume")
+)
+
+// Resumption tickets remembered by the dialer, keyed by remote address and the
+// cluster key authenticating the original session.
+var clientTickets = newTicketCache(config.SessionTicketCache)
+
+// Assembles the client cache key of the tickets, binding them to the cluster key
+// too, so that a node dialing with another key never inherits the authentication.
+func ticketSlot(addr string, key *rsa.PrivateKey) string {
+	return fmt.Sprintf("%s/%x", addr, fingerprint(key))
+}
+
+// Resumption ticket of an established session.
+type ticket struct {
+	id     []byte    // Public identifier presented by the dialer
+	secret []byte    // Resumption secret known only to the two endpoints
+	expiry time.Time // Time after which the ticket is no longer accepted
+}
+
+// Derives the resumption ticket of a session from its secret.
+func newTicket(secret []byte) *ticket {
+	kdf := hkdf.New(config.HkdfHash.New, secret, config.HkdfSalt, ticketInfo)
+
+	tick := &ticket{
+		id:     make([]byte, ticketSize),
+		secret: make([]byte, ticketSize),
+		expiry: time.Now().Add(config.SessionTicketLifetime),
+	}
+	if _, err := io.ReadFull(kdf, tick.id); err != nil {
+		panic(fmt.Sprintf("failed to derive ticket id: %v", err))
+	}
+	if _, err := io.ReadFull(kdf, tick.secret); err != nil {
+		panic(fmt.Sprintf("failed to derive resumption secret: %v", err))
+	}
+	return tick
+}
+
+// Derives the secret of a resumed session from the ticket and the two nonces.
+func (t *ticket) resume(client, server []byte) []byte {
+	salt := append(append([]byte{}, client...), server...)
+	secret := make([]byte, ticketSize)
+	if _, err := io.ReadFull(hkdf.New(config.HkdfHash.New, t.secret, salt, resumeInfo), secret); err != nil {
+		panic(fmt.Sprintf("failed to derive resumed secret: %v", err))
+	}
+	return secret
+}
+
+// Bounded store of the resumption tickets, evicting the oldest when full.
+type ticketCache struct {
+	limit   int                // Maximum number of tickets remembered
+	tickets map[string]*ticket // Live tickets by key
+	order   []string           // Insertion order of the keys for eviction
+	lock    sync.Mutex         // Lock protecting the store
+}
+
+// Creates a ticket store of the given capacity.
+func newTicketCache(limit int) *ticketCache {
+	return &ticketCache{
+		limit:   limit,
+		tickets: make(map[string]*ticket),
+	}
+}
+
+// Remembers a ticket under a key, replacing any previous one.
+func (c *ticketCache) store(key string, tick *ticket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.tickets[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.tickets[key] = tick
+
+	// Evict the oldest tickets if over the limit (consumed ones just get popped)
+	for len(c.tickets) > c.limit && len(c.order) > 0 {
+		delete(c.tickets, c.order[0])
+		c.order = c.order[1:]
+	}
+	// Drop the consumed keys from the order too if they pile up
+	if len(c.order) > 2*c.limit {
+		live := make([]string, 0, len(c.tickets))
+		for _, key := range c.order {
+			if _, ok := c.tickets[key]; ok {
+				live = append(live, key)
+			}
+		}
+		c.order = live
+	}
+}
+
+// Consumes the ticket under a key, returning nil if missing or expired.
+func (c *ticketCache) take(key string) *ticket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	tick, ok := c.tickets[key]
+	if !ok {
+		return nil
+	}
+	delete(c.tickets, key)
+	if time.Now().After(tick.expiry) {
+		return nil
+	}
+	return tick
+}
+
+// Client side of the session resumption, returning the resumed secret and the
+// optional features supported by the server.
+func clientResume(strm *stream.Stream, tick *ticket) ([]byte, features, error) {
+	// Set an overall time limit for the handshake to complete
+	strm.Sock().SetDeadline(time.Now().Add(config.SessionShakeTimeout))
+	defer strm.Sock().SetDeadline(time.Time{})
+
+	nonce := make([]byte, ticketSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, features{}, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	aeads, codecs := localAEADs(), localCodecs()
+	req := &initRequest{
+		Resume: &resumeRequest{tick.id, nonce, localSuite(), true, localVersion(), aeads, codecs},
+	}
+	if err := strm.Send(req); err != nil {
+		return nil, features{}, fmt.Errorf("failed to send resume request: %v", err)
+	}
+	if err := strm.Flush(); err != nil {
+		return nil, features{}, fmt.Errorf("failed to flush resume request: %v", err)
+	}
+	reply := new(resumeReply)
+	if err := strm.Recv(reply); err != nil {
+		return nil, features{}, fmt.Errorf("failed to receive resume reply: %v", err)
+	}
+	if !reply.Ok || len(reply.Nonce) != ticketSize {
+		return nil, features{}, ErrTicketRejected
+	}
+	if err := checkMode(aeads, reply.AEAD); err != nil {
+		return nil, features{}, err
+	}
+	if err := checkMode(codecs, reply.Codec); err != nil {
+		return nil, features{}, err
+	}
+	return tick.resume(nonce, reply.Nonce), features{true, true, agree(localVersion(), reply.Version), reply.AEAD, reply.Codec}, nil
+}
+
+// Executes the server side of the session resumption, returning the resumed
+// secret or the failure reason (after notifying the client).
+func (l *Listener) serverResume(strm *stream.Stream, req *resumeRequest) ([]byte, error) {
+	// Make sure the ticket is valid
+	var tick *ticket
+	if l.tickets != nil {
+		tick = l.tickets.take(string(req.Ticket))
+	}
+	err := matchSuite(l.suite, req.Suite)
+	switch {
+	case err != nil:
+	case tick == nil:
+		err = ErrTicketRejected
+	case len(req.Nonce) != ticketSize:
+		err = errors.New("invalid resume nonce")
+	}
+	if err != nil {
+		if strm.Send(resumeReply{}) == nil {
+			strm.Flush()
+		}
+		return nil, err
+	}
+	// Accept the resumption and derive the new secret
+	nonce := make([]byte, ticketSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	if err := strm.Send(resumeReply{true, nonce, l.version, pickMode(l.aeads, req.AEADs), pickMode(l.codecs, req.Codecs)}); err != nil {
+		return nil, fmt.Errorf("failed to encode resume reply: %v", err)
+	}
+	if err := strm.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush resume reply: %v", err)
+	}
+	return tick.resume(req.Nonce, nonce), nil
+}
@@ -0,0 +1,74 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the revocation checking of the TLS session certificates. The cluster
+// CA publishes certificate revocation lists, which are loaded (and periodically
+// reloaded) into the session package; every TLS handshake then rejects chains
+// containing a certificate revoked by its issuer. Lists not signed by the issuer
+// of a certificate are ignored for it, so a foreign list cannot revoke anything.
+//
+// Revocation is enforced on new sessions only, established ones run until torn
+// down. TLS sessions are never resumed through tickets, so a revoked node cannot
+// sneak back in that way either.
+
+package session
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"sync"
+)
+
+// Returned when a certificate of the remote chain has been revoked.
+var ErrRevoked = errors.New("certificate revoked")
+
+// Revocation lists to check the remote certificate chains against.
+var revocations struct {
+	lists []*x509.RevocationList
+	lock  sync.RWMutex
+}
+
+// Replaces the certificate revocation lists checked by the TLS handshakes.
+func SetRevocations(lists []*x509.RevocationList) {
+	revocations.lock.Lock()
+	defer revocations.lock.Unlock()
+
+	revocations.lists = lists
+}
+
+// Checks whether any certificate of a verified chain was revoked by its issuer.
+func revoked(chain []*x509.Certificate) bool {
+	revocations.lock.RLock()
+	defer revocations.lock.RUnlock()
+
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, list := range revocations.lists {
+			if !bytes.Equal(list.RawIssuer, issuer.RawSubject) || list.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, entry := range list.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the live rotation of the cluster key. Besides its primary key, a node
+// may hold a secondary one (the old or the new key, depending on the phase) that
+// it also accepts sessions with. The dialer offers the fingerprints of its keys
+// (primary first), and the acceptor authenticates with the first one it holds,
+// telling the dialer which one it picked. Nodes predating the rotation offer no
+// fingerprints, and are answered with the primary key.
+//
+// A rotation is thus carried out with rolling restarts: first every node gets the
+// new key as secondary, then it is promoted to primary (the old one demoted to
+// secondary), and lastly the old key is dropped. Secondaries are registered per
+// primary key, so unrelated sessions (e.g. federation) are not affected.
+
+package session
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+// Returned when the two sides of a session share no cluster key.
+var ErrKeyMismatch = errors.New("no shared cluster key")
+
+// Calculates the fingerprint of a cluster key, identifying it in the handshakes.
+func fingerprint(key *rsa.PrivateKey) []byte {
+	hash := sha256.Sum256(key.PublicKey.N.Bytes())
+	return hash[:]
+}
+
+// Secondary keys accepted during rotations, indexed by the primary fingerprints.
+var rotations struct {
+	keys map[string]*rsa.PrivateKey
+	lock sync.RWMutex
+}
+
+// Sets the secondary key accepted alongside a primary one during a rotation (nil
+// to end it). Affects the sessions dialed and listeners started afterwards.
+func Rotate(primary, secondary *rsa.PrivateKey) {
+	rotations.lock.Lock()
+	defer rotations.lock.Unlock()
+
+	id := string(fingerprint(primary))
+	if secondary == nil || secondary.PublicKey.N.Cmp(primary.PublicKey.N) == 0 {
+		delete(rotations.keys, id)
+		return
+	}
+	if rotations.keys == nil {
+		rotations.keys = make(map[string]*rsa.PrivateKey)
+	}
+	rotations.keys[id] = secondary
+}
+
+// Lists the cluster keys to authenticate with, the primary first, followed by its
+// secondary during a rotation. Also used to open state sealed with either of them.
+func ClusterKeys(primary *rsa.PrivateKey) []*rsa.PrivateKey {
+	rotations.lock.RLock()
+	defer rotations.lock.RUnlock()
+
+	keys := []*rsa.PrivateKey{primary}
+	if alt, ok := rotations.keys[string(fingerprint(primary))]; ok {
+		keys = append(keys, alt)
+	}
+	return keys
+}
+
+// Lists the fingerprints of a set of cluster keys.
+func fingerprints(keys []*rsa.PrivateKey) [][]byte {
+	prints := make([][]byte, len(keys))
+	for i, key := range keys {
+		prints[i] = fingerprint(key)
+	}
+	return prints
+}
+
+// Picks the first of the remote preferences among the local keys, or the primary
+// if the remote side offered none (predating the rotation). Returns nil if there
+// is no shared key.
+func pickKey(local []*rsa.PrivateKey, remote [][]byte) *rsa.PrivateKey {
+	if len(remote) == 0 {
+		return local[0]
+	}
+	for _, fp := range remote {
+		for _, key := range local {
+			if bytes.Equal(fp, fingerprint(key)) {
+				return key
+			}
+		}
+	}
+	return nil
+}
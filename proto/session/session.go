@@ -17,22 +17,40 @@
 // between you and the author(s).
 
 // Package session implements an encrypted data stream, authenticated through
-// the station-to-station key exchange.
+// the station-to-station key exchange or TLS with cluster issued certificates.
 package session
 
 import (
+	"fmt"
 	"hash"
 	"io"
+	"sync"
+	"time"
 
 	"code.google.com/p/go.crypto/hkdf"
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/proto/link"
 	"github.com/project-iris/iris/proto/stream"
+	"github.com/project-iris/iris/throttle"
 )
 
+// Bandwidth cap shared by the data links of all sessions (nil if unlimited).
+var global struct {
+	limit *throttle.Limiter
+	lock  sync.Mutex
+}
+
 // Accomplishes secure and authenticated full duplex communication.
 type Session struct {
-	kdf io.Reader // Key derivation function to expand the master key
+	kdf     io.Reader     // Key derivation function to expand the master key (legacy schedule)
+	secret  []byte        // Master key to expand the link keys from (labeled schedule)
+	binding []byte        // Session unique value known only to the two endpoints
+	server  bool          // Whether the local endpoint accepted the session
+	replay  bool          // Whether the links reject replayed frames (both sides support it)
+	version int           // Protocol version agreed on with the remote side
+	aead    string        // AEAD mode sealing the link frames (empty = CTR and HMAC)
+	codec   string        // Codec compressing the link payloads (empty = none)
+	shake   time.Duration // Time taken to connect, authenticate and link the session
 
 	CtrlLink *link.Link // Network connection for high priority control messages
 	DataLink *link.Link // Network connection for low priority data messages
@@ -40,25 +58,110 @@ type Session struct {
 
 // Creates a new, double link session for authenticated data transfer. The
 // initiator is used to decide the key derivation order for the channels.
-func newSession(conn *stream.Stream, secret []byte, server bool) *Session {
+func newSession(conn *stream.Stream, secret []byte, server bool, feats features) *Session {
 	// Create the key derivation function
 	hasher := func() hash.Hash { return config.HkdfHash.New() }
-	hkdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
+	kdf := hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfInfo)
 
+	// Derive the session binding independently of the link keys
+	binding := make([]byte, config.HkdfHash.Size())
+	if _, err := io.ReadFull(hkdf.New(hasher, secret, config.HkdfSalt, config.HkdfBindInfo), binding); err != nil {
+		panic(fmt.Sprintf("failed to derive session binding: %v", err))
+	}
 	// Create the encrypted control link
-	return &Session{
-		kdf:      hkdf,
-		CtrlLink: link.New(conn, hkdf, server),
+	sess := &Session{
+		kdf:     kdf,
+		secret:  secret,
+		binding: binding,
+		server:  server,
+		replay:  feats.replay,
+		version: feats.version,
+		aead:    feats.aead,
+		codec:   feats.codec,
+	}
+	sess.CtrlLink = sess.newLink(conn, "ctrl")
+	if feats.replay {
+		sess.CtrlLink.Sequence()
+	}
+	return sess
+}
+
+// Retrieves a value unique to the session and known only to its two endpoints,
+// allowing upper layers to bind their own authentications to the session (i.e.
+// so they cannot be relayed from another one).
+func (s *Session) Binding() []byte {
+	return s.binding
+}
+
+// Returns whether the local endpoint accepted (as opposed to dialed) the session,
+// allowing upper layers to tell apart the two sides of their authentications.
+func (s *Session) Server() bool {
+	return s.server
+}
+
+// Returns the highest protocol version spoken by both endpoints (0 if the remote
+// side predates the negotiation), allowing upper layers to roll out wire format
+// changes gradually: new formats are used only towards peers already speaking them.
+func (s *Session) Version() int {
+	return s.version
+}
+
+// Traffic and crypto statistics of a session, summed over its two links.
+type Stats struct {
+	link.Stats
+
+	Handshake time.Duration // Time taken to connect, authenticate and link the session
+}
+
+// Collects the traffic statistics of the session's links, allowing operators to
+// attribute bandwidth to the individual remote peers.
+func (s *Session) Stats() *Stats {
+	ctrl, data := s.CtrlLink.Stats(), s.DataLink.Stats()
+	return &Stats{
+		Stats: link.Stats{
+			BytesIn:   ctrl.BytesIn + data.BytesIn,
+			BytesOut:  ctrl.BytesOut + data.BytesOut,
+			FramesIn:  ctrl.FramesIn + data.FramesIn,
+			FramesOut: ctrl.FramesOut + data.FramesOut,
+			Rekeys:    ctrl.Rekeys + data.Rekeys,
+		},
+		Handshake: s.shake,
 	}
 }
 
 // Finalizes a session by creating the secondary data link.
-func (s *Session) init(conn *stream.Stream, server bool) {
-	s.DataLink = link.New(conn, s.kdf, server)
+func (s *Session) init(conn *stream.Stream) {
+	s.DataLink = s.newLink(conn, "data")
+	if s.replay {
+		s.DataLink.Sequence()
+	}
+}
+
+// Creates an encrypted link over a stream, keyed by the labeled schedule under
+// the given name if the remote side speaks it (or the legacy one otherwise), and
+// sealing the frames in the agreed AEAD mode if any.
+func (s *Session) newLink(conn *stream.Stream, name string) *link.Link {
+	switch {
+	case s.version >= LabeledVersion:
+		return link.NewLabeled(conn, s.secret, name, s.server, s.aead)
+	case s.aead != "":
+		return link.NewAEAD(conn, s.kdf, s.server, s.aead)
+	default:
+		return link.New(conn, s.kdf, s.server)
+	}
 }
 
-// Starts the session data transfers on the control and data channels.
+// Starts the session data transfers on the control and data channels. The data
+// link is throttled to the configured bandwidth caps, whereas the control link is
+// exempt to keep heartbeats flowing. Both links rotate their keys as configured
+// and compress their payloads with the agreed codec.
 func (s *Session) Start(cap int) {
+	s.DataLink.Throttle(limits()...)
+	s.CtrlLink.Rekey(config.SessionRekeyPeriod, config.SessionRekeyBytes)
+	s.DataLink.Rekey(config.SessionRekeyPeriod, config.SessionRekeyBytes)
+	s.CtrlLink.Compress(s.codec)
+	s.DataLink.Compress(s.codec)
+
 	s.CtrlLink.Start(cap)
 	s.DataLink.Start(cap)
 }
@@ -71,3 +174,21 @@ func (s *Session) Close() error {
 	}
 	return res
 }
+
+// Assembles the bandwidth caps of a new session's data link: a private one for
+// the session and the one shared globally, if configured.
+func limits() []*throttle.Limiter {
+	res := []*throttle.Limiter{}
+	if rate := config.SessionBandwidth; rate > 0 {
+		res = append(res, throttle.New(float64(rate), 0))
+	}
+	if rate := config.SessionGlobalBandwidth; rate > 0 {
+		global.lock.Lock()
+		if global.limit == nil || global.limit.Rate() != float64(rate) {
+			global.limit = throttle.New(float64(rate), 0)
+		}
+		res = append(res, global.limit)
+		global.lock.Unlock()
+	}
+	return res
+}
@@ -50,6 +50,16 @@ func TestForward(t *testing.T) {
 	}
 	server := <-sock.Sink
 
+	// Make sure both ends derived the same session binding
+	if len(client.Binding()) == 0 || !bytes.Equal(client.Binding(), server.Binding()) {
+		t.Fatalf("session binding mismatch: have %x, want %x.", server.Binding(), client.Binding())
+	}
+	if client.Server() || !server.Server() {
+		t.Fatalf("session role mismatch: client %v, server %v.", client.Server(), server.Server())
+	}
+	if !client.replay || !server.replay {
+		t.Fatalf("replay protection not agreed: client %v, server %v.", client.replay, server.replay)
+	}
 	// Initiate the message transfers
 	client.Start(2)
 	server.Start(2)
@@ -0,0 +1,136 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the description and negotiation of the cryptographic suite of the
+// sessions: the key sizes of the link cipher and of the STS token encryption,
+// the STS exchange group (finite field or X25519), the link HMAC hash, the STS
+// signature hash, the HKDF hash and the support for the in-band key rotation
+// (whose thresholds may differ). These are all configurable, but must match
+// across the cluster, so the two sides exchange their suites during the
+// handshake, failing clearly on any mismatch instead of on a garbled link later.
+//
+// The AEAD mode sealing the link frames and the payload compression codec are
+// negotiated instead: the client offers its modes in order of preference and the
+// server picks the first it accepts too, falling back to the CTR cipher and HMAC
+// of the suite (or no compression) if none, or if the remote node predates them.
+
+package session
+
+import (
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/link"
+)
+
+// Hashes selectable for the session crypto, by name.
+var Hashes = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// Suite of the nodes predating the negotiation (sending none).
+const legacySuite = "aes128/hmac-MD5/sts-aes128-MD5/hkdf-MD5"
+
+// Returned when the remote side of a session is configured with another suite.
+var ErrSuiteMismatch = errors.New("cipher suite mismatch")
+
+// Describes the locally configured cryptographic suite of the sessions.
+func localSuite() string {
+	sts := "sts"
+	if config.StsX25519 {
+		sts = "sts-x25519"
+	}
+	suite := fmt.Sprintf("aes%d/hmac-%v/%s-aes%d-%v/hkdf-%v", config.SessionCipherBits, config.SessionHash,
+		sts, config.StsCipherBits, config.StsSigHash, config.HkdfHash)
+	if config.SessionRekeyPeriod > 0 || config.SessionRekeyBytes > 0 {
+		suite += "/rekey"
+	}
+	return suite
+}
+
+// Checks that the suite of a remote node matches the local one.
+func matchSuite(local, remote string) error {
+	if remote == "" {
+		remote = legacySuite
+	}
+	if remote != local {
+		return fmt.Errorf("%v: local %s, remote %s", ErrSuiteMismatch, local, remote)
+	}
+	return nil
+}
+
+// Lists the locally enabled AEAD modes of the links, in order of preference (the
+// one accelerated by the local hardware first, if so configured).
+func localAEADs() []string {
+	modes := []string{}
+	for _, mode := range config.SessionAEADs {
+		if link.ValidAEAD(mode) {
+			modes = append(modes, mode)
+		}
+	}
+	if config.SessionAEADAccel {
+		modes = link.Prefer(modes)
+	}
+	return modes
+}
+
+// Lists the locally enabled compression codecs of the links, in order of preference.
+func localCodecs() []string {
+	codecs := []string{}
+	for _, codec := range config.SessionCompression {
+		if link.ValidCodec(codec) {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// Picks a negotiated mode of a session (AEAD or codec): the first of the client's
+// preferences enabled locally too, or none if they share no mode.
+func pickMode(local, remote []string) string {
+	for _, mode := range remote {
+		for _, accept := range local {
+			if mode == accept {
+				return mode
+			}
+		}
+	}
+	return ""
+}
+
+// Checks that a mode picked by the server was offered by the client.
+func checkMode(offer []string, pick string) error {
+	if pick == "" {
+		return nil
+	}
+	for _, mode := range offer {
+		if mode == pick {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: unoffered mode %s", ErrSuiteMismatch, pick)
+}
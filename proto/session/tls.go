@@ -0,0 +1,103 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the TLS transport of the sessions, replacing the STS handshake for
+// deployments mandating audited TLS stacks. Both the control and data streams are
+// wrapped in mutually authenticated TLS (1.2 or newer), each side presenting a
+// certificate issued by the cluster CA. Nodes are dialed by address, so only the
+// certificate chains are verified (against the revocation lists of the CA too),
+// not the host names within.
+//
+// The session secret keying the link framing is exported from the TLS master
+// secret, keeping the links (and the session binding the overlay identities are
+// proven over) unchanged atop the TLS records.
+
+package session
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/stream"
+)
+
+// Size of the session secret exported from the TLS master secret.
+const tlsSecretSize = 32
+
+// Returned when the remote side of a TLS session presented no certificate.
+var ErrNoCertificate = errors.New("no peer certificate")
+
+// Runs the TLS handshake over a freshly opened stream, layering the encrypted
+// transport onto it for all subsequent traffic.
+func secure(strm *stream.Stream, base *tls.Config, server bool) (*tls.Conn, error) {
+	cfg := base.Clone()
+	if cfg.MinVersion < tls.VersionTLS12 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.VerifyConnection = verifyChain(cfg.RootCAs)
+
+	var conn *tls.Conn
+	if server {
+		cfg.ClientAuth = tls.RequireAnyClientCert // Chain verified above
+		conn = tls.Server(strm.Sock(), cfg)
+	} else {
+		cfg.InsecureSkipVerify = true // Chain verified above, host names ignored
+		conn = tls.Client(strm.Sock(), cfg)
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	strm.Wrap(conn)
+	return conn, nil
+}
+
+// Creates a TLS connection verifier checking that the remote certificate chains
+// up to one of the cluster CAs, without any revoked links.
+func verifyChain(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrNoCertificate
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		chains, err := state.PeerCertificates[0].Verify(opts)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			if revoked(chain) {
+				return ErrRevoked
+			}
+		}
+		return nil
+	}
+}
+
+// Exports the session secret from the master secret of a TLS connection.
+func tlsSecret(conn *tls.Conn) ([]byte, error) {
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(config.SessionTLSLabel, nil, tlsSecretSize)
+}
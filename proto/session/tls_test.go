@@ -0,0 +1,178 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package session
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+)
+
+// Issues a certificate signed by the given CA (self signed if nil), returning it
+// alongside its private key.
+func issue(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate certificate key: %v.", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v.", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Tests that sessions can be established over TLS with certificates issued by the
+// cluster CA, and that foreign certificates are rejected.
+func TestTLS(t *testing.T) {
+	// Issue the cluster CA, two nodes and a foreign one
+	ca, rogue := issue(t, "cluster", nil), issue(t, "rogue", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server := &tls.Config{Certificates: []tls.Certificate{issue(t, "server", &ca)}, RootCAs: pool}
+	client := &tls.Config{Certificates: []tls.Certificate{issue(t, "client", &ca)}, RootCAs: pool}
+	foreign := &tls.Config{Certificates: []tls.Certificate{issue(t, "foreign", &rogue)}, RootCAs: pool}
+
+	defer func(cfg *tls.Config) { config.SessionTLS = cfg }(config.SessionTLS)
+	config.SessionTLS = server
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	// Connect with a cluster issued certificate and verify the session
+	config.SessionTLS = client
+	cs, err := Dial("localhost", addr.Port, key)
+	if err != nil {
+		t.Fatalf("failed to connect to the server: %v.", err)
+	}
+	defer cs.Close()
+
+	select {
+	case ss := <-sock.Sink:
+		defer ss.Close()
+		if len(cs.Binding()) == 0 || !bytes.Equal(cs.Binding(), ss.Binding()) {
+			t.Fatalf("session binding mismatch: have %x, want %x.", ss.Binding(), cs.Binding())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server-side handshake timed out.")
+	}
+	// Connect with a foreign certificate and verify the rejection
+	config.SessionTLS = foreign
+	if sess, err := Dial("localhost", addr.Port, key); err == nil {
+		sess.Close()
+		t.Fatalf("foreign certificate accepted.")
+	}
+}
+
+// Tests that certificates revoked by the cluster CA are rejected, whereas lists
+// signed by foreign authorities are ignored.
+func TestRevocation(t *testing.T) {
+	ca, rogue := issue(t, "cluster", nil), issue(t, "rogue", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	cert := issue(t, "client", &ca)
+	server := &tls.Config{Certificates: []tls.Certificate{issue(t, "server", &ca)}, RootCAs: pool}
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}
+
+	defer func(cfg *tls.Config) { config.SessionTLS = cfg }(config.SessionTLS)
+	config.SessionTLS = server
+
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:0")
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	sock, err := Listen(addr, key)
+	if err != nil {
+		t.Fatalf("failed to start the session listener: %v.", err)
+	}
+	sock.Accept(100 * time.Millisecond)
+	defer sock.Close()
+
+	// Create revocation lists for the client certificate, by the CA and a rogue
+	revoke := func(issuer *tls.Certificate) *x509.RevocationList {
+		tmpl := &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-time.Hour),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: cert.Leaf.SerialNumber, RevocationTime: time.Now()}},
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, tmpl, issuer.Leaf, issuer.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatalf("failed to create revocation list: %v.", err)
+		}
+		list, _ := x509.ParseRevocationList(der)
+		return list
+	}
+	defer SetRevocations(nil)
+
+	config.SessionTLS = client
+	for i, tt := range []struct {
+		lists []*x509.RevocationList
+		pass  bool
+	}{
+		{[]*x509.RevocationList{revoke(&ca)}, false},
+		{[]*x509.RevocationList{revoke(&rogue)}, true},
+		{nil, true},
+	} {
+		SetRevocations(tt.lists)
+
+		sess, err := Dial("localhost", addr.Port, key)
+		if (err == nil) != tt.pass {
+			t.Fatalf("test %d: dial result mismatch: have %v, want pass %v.", i, err, tt.pass)
+		}
+		if err == nil {
+			sess.Close()
+			(<-sock.Sink).Close()
+		}
+	}
+}
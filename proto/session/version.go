@@ -0,0 +1,56 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Contains the protocol version negotiation of the sessions. Both sides advertise
+// the highest version they speak during the handshake (nodes predating it count
+// as version 0) and the session runs at the lower of the two, letting upper layers
+// roll wire format changes through a live cluster: the new formats are only used
+// towards peers already upgraded, the rest still served the old ones.
+//
+// Version history:
+//   1 - Version negotiation (frame replay protection and resumption are flagged
+//       separately, being optional)
+//   2 - Labeled key schedule of the links, expanding every key separately from
+//       the session secret instead of reading them off a single HKDF stream
+
+package session
+
+import "github.com/project-iris/iris/config"
+
+// Highest session protocol version implemented by this node.
+const Version = 2
+
+// Protocol version introducing the labeled key schedule of the links.
+const LabeledVersion = 2
+
+// Returns the protocol version advertised by the local node: the configured one,
+// capped by the implemented one.
+func localVersion() int {
+	if config.SessionVersion < Version {
+		return config.SessionVersion
+	}
+	return Version
+}
+
+// Agrees on the protocol version of a session: the highest one both sides speak.
+func agree(local, remote int) int {
+	if remote < local {
+		return remote
+	}
+	return local
+}
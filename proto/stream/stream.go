@@ -145,6 +145,17 @@ func Dial(address string, timeout time.Duration) (*Stream, error) {
 	}
 }
 
+// Layers a transport (e.g. TLS) over the raw network connection, passing all the
+// subsequent traffic through it. Must be called before any data is exchanged.
+func (s *Stream) Wrap(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	s.buffers = bufio.NewReadWriter(reader, writer)
+	s.encoder = gob.NewEncoder(writer)
+	s.decoder = gob.NewDecoder(reader)
+}
+
 // Retrieves the raw connection object if special manipulations are needed.
 func (s *Stream) Sock() *net.TCPConn {
 	return s.socket
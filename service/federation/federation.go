@@ -0,0 +1,463 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package federation implements a bridge between two independent Iris networks,
+// mirroring a configured set of topics and application groups between them over
+// an authenticated link.
+//
+// Both sides of a federation run a bridge attached to their local carrier, one
+// of them listening for and the other dialing the authenticated session (both
+// must hold the same federation key). Events published locally into a mirrored
+// topic are forwarded (along with their attributes) to the remote bridge, which
+// republishes them into its own network, tagged with its name to prevent echoing
+// them back. Bridges may be chained, but the federated networks must not form a
+// cycle.
+//
+// Application groups served by the peer network are made reachable locally by
+// the bridge joining them as a proxy member: the broadcasts and requests it is
+// handed are forwarded to the peer bridge, which issues them into its own network
+// and relays the replies back. A group may be proxied on one side only, and
+// tunnels are not mirrored.
+package federation
+
+import (
+	"crypto/rsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto"
+	"github.com/project-iris/iris/proto/iris"
+	"github.com/project-iris/iris/proto/session"
+)
+
+// Event attribute marking the bridge that mirrored an event into the network.
+const Attribute = "iris.federation"
+
+// Returned when the bridge already listens or dials.
+var ErrBooted = errors.New("already booted")
+
+// Returned to proxied requests if the peer bridge cannot be reached.
+var ErrUnreachable = errors.New("peer bridge unreachable")
+
+// Federation envelope of a mirrored event, broadcast, request or reply.
+type envelope struct {
+	Topic string            // Topic the event was published into (events)
+	Attrs map[string]string // Attributes the event was published with (events)
+
+	Group   string        // Application group targeted (broadcasts and requests)
+	ReqId   uint64        // Id of a proxied request (0 = broadcast)
+	Timeout time.Duration // Time the requester is still waiting (requests)
+	Reply   bool          // Flag whether the message answers a proxied request
+	Error   string        // Failure of the proxied request (replies)
+}
+
+// Make sure the envelope is registered with gob.
+func init() {
+	gob.Register(&envelope{})
+}
+
+// Bridge mirroring a set of topics between the local Iris network and a remote
+// one, through an authenticated session with the peer bridge.
+type Bridge struct {
+	name   string              // Name of the bridge, tagging the mirrored events
+	topics map[string]struct{} // Topics mirrored between the networks
+	groups map[string]struct{} // Application groups of the peer network proxied locally
+	key    *rsa.PrivateKey     // Federation key shared by the two bridges
+
+	conn    *iris.Connection   // Interface into the local network
+	proxies []*iris.Connection // Proxy members of the peer's application groups
+
+	reqIdx  uint64                   // Auto-incremented id of the proxied requests
+	reqLive map[uint64]*iris.Replier // Repliers of the requests awaiting a peer reply
+	reqLock sync.Mutex               // Mutex protecting the proxied requests
+
+	link *session.Session // Live session to the peer bridge (nil if down)
+	lock sync.RWMutex     // Mutex protecting the session
+
+	booted bool            // Flag whether the bridge already listens or dials
+	quit   chan chan error // Quit channel to synchronize bridge termination
+}
+
+// Creates a new federation bridge attached to the local carrier, subscribing to
+// the mirrored topics and joining the proxied application groups, but without
+// linking to the peer bridge yet.
+func New(overlay *iris.Overlay, name string, topics []string, groups []string, key *rsa.PrivateKey) (*Bridge, error) {
+	conn, err := overlay.Connect("", nil)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bridge{
+		name:    name,
+		topics:  make(map[string]struct{}),
+		groups:  make(map[string]struct{}),
+		key:     key,
+		conn:    conn,
+		reqIdx:  1, // Zero is reserved for broadcasts
+		reqLive: make(map[uint64]*iris.Replier),
+		quit:    make(chan chan error),
+	}
+	// Subscribe to the mirrored topics, skipping the events mirrored by this bridge
+	filter := fmt.Sprintf("%s != %s", Attribute, strconv.Quote(name))
+	for _, topic := range topics {
+		b.topics[topic] = struct{}{}
+		if err := conn.SubscribeFiltered(topic, &mirror{bridge: b, topic: topic}, filter); err != nil {
+			b.leave()
+			return nil, err
+		}
+	}
+	// Join the proxied application groups
+	for _, group := range groups {
+		b.groups[group] = struct{}{}
+		proxy, err := overlay.Connect(group, &proxy{bridge: b, group: group})
+		if err != nil {
+			b.leave()
+			return nil, err
+		}
+		b.proxies = append(b.proxies, proxy)
+	}
+	return b, nil
+}
+
+// Starts accepting the peer bridge on the given local address, returning the
+// address actually bound (useful for auto-ports).
+func (b *Bridge) Listen(addr *net.TCPAddr) (*net.TCPAddr, error) {
+	if b.booted {
+		return nil, ErrBooted
+	}
+	sock, err := session.Listen(addr, b.key)
+	if err != nil {
+		return nil, err
+	}
+	sock.Accept(config.FederationAcceptTimeout)
+
+	b.booted = true
+	go b.acceptor(sock)
+	return addr, nil
+}
+
+// Starts dialing the peer bridge at the given remote address, re-dialing it
+// whenever the link breaks until the bridge is terminated.
+func (b *Bridge) Dial(host string, port int) error {
+	if b.booted {
+		return ErrBooted
+	}
+	b.booted = true
+	go b.dialer(host, port)
+	return nil
+}
+
+// Tears down the link to the peer bridge and leaves the local network.
+func (b *Bridge) Terminate() error {
+	var res error
+	if b.booted {
+		errc := make(chan error)
+		b.quit <- errc
+		res = <-errc
+	}
+	if err := b.leave(); res == nil {
+		res = err
+	}
+	return res
+}
+
+// Leaves the local network, closing the proxy members and the bridge connection.
+func (b *Bridge) leave() error {
+	var res error
+	for _, proxy := range b.proxies {
+		if err := proxy.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	if err := b.conn.Close(); err != nil && res == nil {
+		res = err
+	}
+	return res
+}
+
+// Accepts inbound sessions from the peer bridge until termination, serving
+// always the most recent one.
+func (b *Bridge) acceptor(sock *session.Listener) {
+	var errc chan error
+	for errc == nil {
+		select {
+		case errc = <-b.quit:
+			continue
+		case ses := <-sock.Sink:
+			b.serve(ses)
+		}
+	}
+	b.sever()
+	errc <- sock.Close()
+}
+
+// Connects to the peer bridge, re-dialing periodically while the link is down,
+// until termination.
+func (b *Bridge) dialer(host string, port int) {
+	var errc chan error
+	for errc == nil {
+		// Establish a link if none is live
+		b.lock.RLock()
+		live := b.link != nil
+		b.lock.RUnlock()
+
+		if !live {
+			if ses, err := session.Dial(host, port, b.key); err != nil {
+				log.Printf("federation: failed to dial peer bridge at %s:%d: %v.", host, port, err)
+			} else {
+				b.serve(ses)
+			}
+		}
+		// Wait a bit before checking again, or terminate
+		select {
+		case errc = <-b.quit:
+		case <-time.After(config.FederationRedialPeriod):
+		}
+	}
+	b.sever()
+	errc <- nil
+}
+
+// Starts serving a newly established session, replacing any previous link.
+func (b *Bridge) serve(ses *session.Session) {
+	ses.Start(config.FederationNetBuffer)
+
+	b.lock.Lock()
+	old := b.link
+	b.link = ses
+	b.lock.Unlock()
+
+	if old != nil {
+		if err := old.Close(); err != nil {
+			log.Printf("federation: failed to close replaced link: %v.", err)
+		}
+	}
+	go b.receiver(ses)
+}
+
+// Closes the live link to the peer bridge, if any.
+func (b *Bridge) sever() {
+	b.lock.Lock()
+	ses := b.link
+	b.link = nil
+	b.lock.Unlock()
+
+	if ses != nil {
+		if err := ses.Close(); err != nil {
+			log.Printf("federation: failed to close link: %v.", err)
+		}
+	}
+}
+
+// Processes the messages arriving from the peer bridge until the link breaks:
+// events are republished, broadcasts and requests issued into the local network
+// and replies handed back to the proxied requesters.
+func (b *Bridge) receiver(ses *session.Session) {
+	for msg := range ses.DataLink.Recv {
+		env, ok := msg.Head.Meta.(*envelope)
+		if !ok {
+			log.Printf("federation: unknown message from peer bridge: %v.", msg.Head.Meta)
+			continue
+		}
+		if err := msg.Decrypt(); err != nil {
+			log.Printf("federation: failed to decrypt mirrored message: %v.", err)
+			continue
+		}
+		switch {
+		case env.Reply:
+			b.reply(env, msg.Data)
+		case env.Group != "":
+			b.issue(env, msg.Data)
+		default:
+			b.republish(env, msg.Data)
+		}
+	}
+	// Link broke, drop it unless already replaced
+	b.lock.Lock()
+	if b.link == ses {
+		b.link = nil
+	}
+	b.lock.Unlock()
+}
+
+// Republishes an event mirrored by the peer bridge, tagged with the local name.
+func (b *Bridge) republish(env *envelope, event []byte) {
+	// Only republish topics mirrored on this side too
+	if _, ok := b.topics[env.Topic]; !ok {
+		return
+	}
+	attrs := map[string]string{Attribute: b.name}
+	for key, val := range env.Attrs {
+		if key != Attribute {
+			attrs[key] = val
+		}
+	}
+	if err := b.conn.PublishAttrs(env.Topic, attrs, event); err != nil {
+		log.Printf("federation: failed to republish mirrored event: %v.", err)
+	}
+}
+
+// Issues a broadcast or request proxied by the peer bridge into the local group,
+// sending back the outcome of requests.
+func (b *Bridge) issue(env *envelope, data []byte) {
+	// Refuse groups proxied here too, they would bounce between the bridges
+	if _, ok := b.groups[env.Group]; ok {
+		log.Printf("federation: group %s proxied on both sides, dropping.", env.Group)
+		if env.ReqId != 0 {
+			b.send(&envelope{ReqId: env.ReqId, Reply: true, Error: "group proxied on both sides"}, nil)
+		}
+		return
+	}
+	if env.ReqId == 0 {
+		if err := b.conn.Broadcast(env.Group, data); err != nil {
+			log.Printf("federation: failed to issue proxied broadcast: %v.", err)
+		}
+		return
+	}
+	go func() {
+		rep, err := b.conn.Request(env.Group, data, env.Timeout)
+
+		res := &envelope{ReqId: env.ReqId, Reply: true}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		b.send(res, rep)
+	}()
+}
+
+// Hands the reply of a proxied request back to the local requester.
+func (b *Bridge) reply(env *envelope, rep []byte) {
+	b.reqLock.Lock()
+	replier, ok := b.reqLive[env.ReqId]
+	delete(b.reqLive, env.ReqId)
+	b.reqLock.Unlock()
+
+	if !ok {
+		return // Timed out meanwhile
+	}
+	if env.Error != "" {
+		replier.Fail(errors.New(env.Error))
+	} else {
+		replier.Reply(rep)
+	}
+}
+
+// Forwards a request of a proxied group to the peer bridge, answering it once
+// the peer replies (or failing it right away if the peer is unreachable).
+func (b *Bridge) request(group string, req []byte, rep *iris.Replier) {
+	timeout := rep.Deadline().Sub(time.Now())
+
+	b.reqLock.Lock()
+	id := b.reqIdx
+	b.reqIdx++
+	b.reqLive[id] = rep
+	b.reqLock.Unlock()
+
+	if !b.send(&envelope{Group: group, ReqId: id, Timeout: timeout}, req) {
+		b.reqLock.Lock()
+		delete(b.reqLive, id)
+		b.reqLock.Unlock()
+
+		rep.Fail(ErrUnreachable)
+		return
+	}
+	// Forget the request if the peer never answers
+	time.AfterFunc(timeout, func() {
+		b.reqLock.Lock()
+		delete(b.reqLive, id)
+		b.reqLock.Unlock()
+	})
+}
+
+// Sends a message to the peer bridge, reporting whether it was queued. Messages
+// are dropped if the link is down or congested (best effort, same as publishing).
+func (b *Bridge) send(env *envelope, data []byte) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.link == nil {
+		return false
+	}
+	msg := &proto.Message{
+		Head: proto.Header{Meta: env},
+		Data: make([]byte, len(data)),
+	}
+	copy(msg.Data, data)
+	if err := msg.Encrypt(); err != nil {
+		log.Printf("federation: failed to encrypt mirrored message: %v.", err)
+		return false
+	}
+	select {
+	case b.link.DataLink.Send <- msg:
+		return true
+	default:
+		log.Printf("federation: link congested, dropping message (topic %q, group %q).", env.Topic, env.Group)
+		return false
+	}
+}
+
+// Subscription handler forwarding the events of a mirrored topic.
+type mirror struct {
+	bridge *Bridge // Bridge to forward the events through
+	topic  string  // Topic the events belong to
+}
+
+// Implements iris.SubscriptionHandler.HandleEvent, forwarding the event.
+func (m *mirror) HandleEvent(event []byte) {
+	m.HandleEventAttrs(nil, event)
+}
+
+// Implements iris.AttributedHandler.HandleEventAttrs, forwarding the event along
+// with its attributes.
+func (m *mirror) HandleEventAttrs(attrs map[string]string, event []byte) {
+	m.bridge.send(&envelope{Topic: m.topic, Attrs: attrs}, event)
+}
+
+// Connection handler proxying an application group of the peer network.
+type proxy struct {
+	bridge *Bridge // Bridge to forward the messages through
+	group  string  // Application group proxied
+}
+
+// Implements iris.ConnectionHandler.HandleBroadcast, forwarding the broadcast.
+func (p *proxy) HandleBroadcast(msg []byte) {
+	p.bridge.send(&envelope{Group: p.group}, msg)
+}
+
+// Implements iris.ConnectionHandler.HandleRequest. Never invoked, the requests
+// are deferred until the peer network answers.
+func (p *proxy) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return nil, errors.New("deferred request served synchronously")
+}
+
+// Implements iris.DeferredHandler.HandleDeferredRequest, forwarding the request.
+func (p *proxy) HandleDeferredRequest(req []byte, rep *iris.Replier) {
+	p.bridge.request(p.group, req, rep)
+}
+
+// Implements iris.ConnectionHandler.HandleTunnel, refusing the tunnel (tunnels
+// are not mirrored).
+func (p *proxy) HandleTunnel(tun *iris.Tunnel) {
+	tun.Close()
+}
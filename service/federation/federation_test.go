@@ -0,0 +1,215 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package federation
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/project-iris/iris/config"
+	"github.com/project-iris/iris/proto/iris"
+)
+
+// Subscription handler collecting the received events.
+type collector struct {
+	events chan []byte
+}
+
+func (c *collector) HandleEvent(event []byte) {
+	c.events <- event
+}
+
+// Connection handler of an application group, collecting the broadcasts and
+// echoing back the requests.
+type server struct {
+	bcasts chan []byte
+}
+
+func (s *server) HandleBroadcast(msg []byte) {
+	s.bcasts <- msg
+}
+
+func (s *server) HandleRequest(req []byte, timeout time.Duration) ([]byte, error) {
+	return append([]byte("echo-"), req...), nil
+}
+
+func (s *server) HandleTunnel(tun *iris.Tunnel) {
+	tun.Close()
+}
+
+// Boots a single node Iris network with the given overlay id.
+func boot(t *testing.T, id string, key *rsa.PrivateKey) *iris.Overlay {
+	node := iris.New(id, key)
+	if _, err := node.Boot(); err != nil {
+		t.Fatalf("failed to boot iris overlay %s: %v.", id, err)
+	}
+	return node
+}
+
+// Checks that exactly the given events arrive at a collector.
+func expect(t *testing.T, name string, coll *collector, events ...string) {
+	for _, want := range events {
+		select {
+		case have := <-coll.events:
+			if string(have) != want {
+				t.Fatalf("%s: event mismatch: have %s, want %s.", name, have, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: event %s not delivered.", name, want)
+		}
+	}
+	select {
+	case have := <-coll.events:
+		t.Fatalf("%s: unexpected event: %s.", name, have)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+func TestFederation(t *testing.T) {
+	// Configure the test
+	oldBoot, oldConv := config.PastryBootTimeout, config.PastryConvTimeout
+	config.PastryBootTimeout, config.PastryConvTimeout = 500*time.Millisecond, 250*time.Millisecond
+	defer func() { config.PastryBootTimeout, config.PastryConvTimeout = oldBoot, oldConv }()
+
+	olds := config.BootPorts
+	config.BootPorts = append(config.BootPorts, 65400)
+	defer func() { config.BootPorts = olds }()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate federation key: %v.", err)
+	}
+	// Boot two independent networks and bridge a topic between them
+	east, west := boot(t, "federation-east", key), boot(t, "federation-west", key)
+	defer east.Shutdown()
+	defer west.Shutdown()
+
+	eastBridge, err := New(east, "east", []string{"mirrored"}, nil, key)
+	if err != nil {
+		t.Fatalf("failed to create east bridge: %v.", err)
+	}
+	defer eastBridge.Terminate()
+
+	westBridge, err := New(west, "west", []string{"mirrored"}, []string{"service"}, key)
+	if err != nil {
+		t.Fatalf("failed to create west bridge: %v.", err)
+	}
+	defer westBridge.Terminate()
+
+	addr, err := eastBridge.Listen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen for peer bridge: %v.", err)
+	}
+	if err := westBridge.Dial(addr.IP.String(), addr.Port); err != nil {
+		t.Fatalf("failed to dial peer bridge: %v.", err)
+	}
+	// Subscribe an application on both sides, to the mirrored and a local topic
+	eastConn, err := east.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to east network: %v.", err)
+	}
+	defer eastConn.Close()
+
+	westConn, err := west.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to west network: %v.", err)
+	}
+	defer westConn.Close()
+
+	eastColl, westColl := &collector{make(chan []byte, 8)}, &collector{make(chan []byte, 8)}
+	localColl := &collector{make(chan []byte, 8)}
+	if err := eastConn.Subscribe("mirrored", eastColl); err != nil {
+		t.Fatalf("failed to subscribe east application: %v.", err)
+	}
+	if err := westConn.Subscribe("mirrored", westColl); err != nil {
+		t.Fatalf("failed to subscribe west application: %v.", err)
+	}
+	if err := westConn.Subscribe("local", localColl); err != nil {
+		t.Fatalf("failed to subscribe west application: %v.", err)
+	}
+	filterConn, err := west.Connect("", nil)
+	if err != nil {
+		t.Fatalf("failed to connect to west network: %v.", err)
+	}
+	defer filterConn.Close()
+
+	filterColl := &collector{make(chan []byte, 8)}
+	if err := filterConn.SubscribeFiltered("mirrored", filterColl, `region == "east"`); err != nil {
+		t.Fatalf("failed to subscribe filtered west application: %v.", err)
+	}
+	// Serve an application group in the east network only
+	service := &server{make(chan []byte, 8)}
+	serviceConn, err := east.Connect("service", service)
+	if err != nil {
+		t.Fatalf("failed to connect east service: %v.", err)
+	}
+	defer serviceConn.Close()
+
+	time.Sleep(time.Second)
+
+	// Publish from both sides and ensure events cross exactly once
+	if err := eastConn.Publish("mirrored", []byte("from-east")); err != nil {
+		t.Fatalf("failed to publish east event: %v.", err)
+	}
+	expect(t, "west", westColl, "from-east")
+	expect(t, "east", eastColl, "from-east")
+
+	if err := westConn.Publish("mirrored", []byte("from-west")); err != nil {
+		t.Fatalf("failed to publish west event: %v.", err)
+	}
+	expect(t, "east", eastColl, "from-west")
+	expect(t, "west", westColl, "from-west")
+
+	// Ensure non mirrored topics stay local
+	if err := eastConn.Publish("local", []byte("private")); err != nil {
+		t.Fatalf("failed to publish local event: %v.", err)
+	}
+	expect(t, "local", localColl)
+
+	// Ensure event attributes are mirrored too
+	if err := eastConn.PublishAttrs("mirrored", map[string]string{"region": "east"}, []byte("tagged")); err != nil {
+		t.Fatalf("failed to publish attributed event: %v.", err)
+	}
+	expect(t, "filtered", filterColl, "tagged")
+	expect(t, "west", westColl, "tagged")
+	expect(t, "east", eastColl, "tagged")
+
+	// Ensure the application group of the east network is reachable from the west
+	rep, err := westConn.Request("service", []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatalf("failed to request proxied group: %v.", err)
+	}
+	if string(rep) != "echo-ping" {
+		t.Fatalf("proxied reply mismatch: have %s, want %s.", rep, "echo-ping")
+	}
+	if err := westConn.Broadcast("service", []byte("hello")); err != nil {
+		t.Fatalf("failed to broadcast to proxied group: %v.", err)
+	}
+	select {
+	case msg := <-service.bcasts:
+		if string(msg) != "hello" {
+			t.Fatalf("proxied broadcast mismatch: have %s, want %s.", msg, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("proxied broadcast not delivered.")
+	}
+}
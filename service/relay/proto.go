@@ -614,6 +614,9 @@ func (r *relay) process() {
 			}
 		}
 	}
+	// Stop the keepalives, the binding is gone even if closing the connection stalls
+	close(r.gone)
+
 	// If an error occurred, force stop execution
 	if err != nil {
 		r.workers.Terminate(true)
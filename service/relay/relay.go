@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/project-iris/iris/config"
 	"github.com/project-iris/iris/pool"
@@ -57,6 +58,7 @@ type relay struct {
 	workers *pool.ThreadPool // Concurrent threads handling the connection
 
 	// Bookkeeping fields
+	gone chan struct{}   // Channel signalling the binding's socket dying
 	done chan *relay     // Channel on which to signal termination
 	quit chan chan error // Quit channel to synchronize relay termination
 	term chan struct{}   // Channel to signal termination to blocked go-routines
@@ -80,6 +82,7 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 		workers: pool.NewThreadPool(config.RelayHandlerThreads),
 
 		// Misc
+		gone: make(chan struct{}),
 		done: r.done,
 		quit: make(chan chan error),
 		term: make(chan struct{}),
@@ -125,9 +128,33 @@ func (r *Relay) acceptRelay(sock net.Conn) (*relay, error) {
 	// Start accepting messages and return
 	rel.workers.Start()
 	go rel.process()
+	go rel.keepalive()
 	return rel, nil
 }
 
+// Probes the binding's socket for liveness and renews the Iris connection's
+// liveness for as long as the socket stays up, so a binding that crashed gets its
+// subscriptions reclaimed even if the relay cannot close the connection.
+func (r *relay) keepalive() {
+	if tcp, ok := r.sock.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(config.RelayKeepalive)
+	}
+	r.iris.Keepalive()
+
+	tick := time.NewTicker(config.RelayKeepalive)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-r.gone:
+			return
+		case <-tick.C:
+			r.iris.Keepalive()
+		}
+	}
+}
+
 // Forcefully drops the relay connection. Used during irrecoverable errors.
 func (r *relay) drop() {
 	r.sock.Close()
@@ -0,0 +1,54 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the memory measurements for Mac OS X.
+
+package system
+
+/*
+#include <mach/mach_init.h>
+#include <mach/mach_host.h>
+#include <mach/vm_statistics.h>
+
+static inline float MemoryLoad() {
+	vm_statistics_data_t vmInfo;
+	mach_msg_type_number_t infoCount = HOST_VM_INFO_COUNT;
+	if (host_statistics(mach_host_self(), HOST_VM_INFO, (host_info_t)&vmInfo, &infoCount) != KERN_SUCCESS) {
+		return -1;
+	}
+	natural_t used = vmInfo.active_count + vmInfo.wire_count;
+	natural_t total = used + vmInfo.inactive_count + vmInfo.free_count;
+	return (float)used / (float)total;
+}
+*/
+import "C"
+import "fmt"
+
+// Gathers memory statistics and fills the global memory stat variable.
+func gatherMemInfo() {
+	// Collect the current usage info
+	load := float32(C.MemoryLoad())
+	if load < 0 {
+		panic(fmt.Errorf("failed to gather memory usage info"))
+	}
+	// Update the global state
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	mem.usage = load
+}
@@ -0,0 +1,75 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// This file contains the memory measurements for Linux and related OSes.
+
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Gathers memory statistics and fills the global memory stat variable.
+func gatherMemInfo() {
+	// Open the memory info file
+	inf, err := os.Open("/proc/meminfo")
+	if err != nil {
+		panic(err)
+	}
+	defer inf.Close()
+
+	// Collect the total and available memory counters (kB)
+	var total, avail, free, buffers, cached int64
+	in := bufio.NewScanner(inf)
+	for in.Scan() {
+		fields := strings.Fields(in.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var value int64
+		fmt.Sscan(fields[1], &value)
+
+		switch fields[0] {
+		case "MemTotal:":
+			total = value
+		case "MemAvailable:":
+			avail = value
+		case "MemFree:":
+			free = value
+		case "Buffers:":
+			buffers = value
+		case "Cached:":
+			cached = value
+		}
+	}
+	// Older kernels don't report the available memory, approximate it
+	if avail == 0 {
+		avail = free + buffers + cached
+	}
+	if total == 0 {
+		return
+	}
+	// Update the global state
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	mem.usage = float32(total-avail) / float32(total)
+}
@@ -36,6 +36,16 @@ type cpuInfo struct {
 // Singleton CPU status file.
 var cpu cpuInfo
 
+// Memory usage infos.
+type memInfo struct {
+	usage float32
+
+	lock sync.RWMutex
+}
+
+// Singleton memory status file.
+var mem memInfo
+
 // Returns the CPU usage since the last measurement cycle.
 func CpuUsage() float32 {
 	cpu.lock.RLock()
@@ -43,10 +53,18 @@ func CpuUsage() float32 {
 	return cpu.usage
 }
 
+// Returns the fraction of the system memory in use at the last measurement.
+func MemoryUsage() float32 {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+	return mem.usage
+}
+
 // Init function to start the measurements
 func init() {
 	// Make sure state is initialized to something
 	gatherCpuInfo()
+	gatherMemInfo()
 	time.Sleep(100 * time.Millisecond)
 	gatherCpuInfo()
 
@@ -56,6 +74,7 @@ func init() {
 		for {
 			<-tick
 			gatherCpuInfo()
+			gatherMemInfo()
 		}
 	}()
 }
@@ -0,0 +1,164 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+// Package throttle implements a token bucket rate limiter, refilling at a fixed
+// rate up to a maximum burst size.
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiter.
+type Limiter struct {
+	rate   float64   // Number of tokens added per second
+	burst  float64   // Maximum number of tokens the bucket can hold
+	tokens float64   // Number of currently available tokens (negative if in debt)
+	last   time.Time // Time instance of the last token refill
+	lock   sync.Mutex
+}
+
+// Creates a new rate limiter refilling at rate tokens per second, holding at
+// most burst tokens. The bucket starts out full. A non positive burst defaults
+// to the rate (i.e. one second worth of tokens).
+func New(rate float64, burst float64) *Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Returns the token refill rate of the limiter.
+func (l *Limiter) Rate() float64 {
+	return l.rate
+}
+
+// Takes n tokens from the bucket if available, returning whether it succeeded.
+// Requests larger than the burst size are allowed when the bucket is full.
+func (l *Limiter) Allow(n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill()
+	if l.tokens >= l.cost(n) {
+		l.tokens -= float64(n)
+		return true
+	}
+	return false
+}
+
+// Takes n tokens from the bucket unconditionally, returning the time the caller
+// needs to wait before the taken tokens would have been available.
+func (l *Limiter) Reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill()
+	wait := time.Duration(0)
+	if missing := l.cost(n) - l.tokens; missing > 0 {
+		wait = time.Duration(missing / l.rate * float64(time.Second))
+	}
+	l.tokens -= float64(n)
+	return wait
+}
+
+// Takes n tokens from the bucket, blocking until they are available or until
+// quit is signalled. Returns whether the tokens were acquired (aborted waits get
+// their reservation refunded).
+func (l *Limiter) Wait(n int, quit <-chan struct{}) bool {
+	wait := l.Reserve(n)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-quit:
+		l.Refund(n)
+		return false
+	}
+}
+
+// Returns n previously taken tokens to the bucket, used when the operation they
+// were taken for got aborted.
+func (l *Limiter) Refund(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill()
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Takes ns[i] tokens from each of the limiters, but only if all of them have
+// enough available, returning whether it succeeded. Nil limiters are skipped.
+// The buckets are locked in the given order, which concurrent callers must keep.
+func AllowAll(lims []*Limiter, ns []int) bool {
+	held := make([]*Limiter, 0, len(lims))
+	defer func() {
+		for _, l := range held {
+			l.lock.Unlock()
+		}
+	}()
+	// Check every bucket before taking anything
+	for i, l := range lims {
+		if l == nil {
+			continue
+		}
+		l.lock.Lock()
+		held = append(held, l)
+
+		l.refill()
+		if l.tokens < l.cost(ns[i]) {
+			return false
+		}
+	}
+	for i, l := range lims {
+		if l != nil {
+			l.tokens -= float64(ns[i])
+		}
+	}
+	return true
+}
+
+// Calculates the number of tokens needed to be present for n to be taken. This
+// is capped at the burst size to allow oversized requests through.
+func (l *Limiter) cost(n int) float64 {
+	if cost := float64(n); cost < l.burst {
+		return cost
+	}
+	return l.burst
+}
+
+// Refills the bucket based on the time elapsed since the last refill.
+func (l *Limiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
@@ -0,0 +1,116 @@
+// Iris - Decentralized cloud messaging
+// Copyright (c) 2013 Project Iris. All rights reserved.
+//
+// Community license: for open source projects and services, Iris is free to use,
+// redistribute and/or modify under the terms of the GNU Affero General Public
+// License as published by the Free Software Foundation, either version 3, or (at
+// your option) any later version.
+//
+// Evaluation license: you are free to privately evaluate Iris without adhering
+// to either of the community or commercial licenses for as long as you like,
+// however you are not permitted to publicly release any software or service
+// built on top of it without a valid license.
+//
+// Commercial license: for commercial and/or closed source projects and services,
+// the Iris cloud messaging system may be used in accordance with the terms and
+// conditions contained in an individually negotiated signed written agreement
+// between you and the author(s).
+
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	lim := New(100, 10)
+
+	// Drain the full bucket and make sure further requests are denied
+	for i := 0; i < 10; i++ {
+		if !lim.Allow(1) {
+			t.Fatalf("token %d denied from full bucket.", i)
+		}
+	}
+	if lim.Allow(1) {
+		t.Fatalf("token allowed from empty bucket.")
+	}
+	// Wait for a partial refill and check again
+	time.Sleep(50 * time.Millisecond)
+	if !lim.Allow(1) {
+		t.Fatalf("token denied after refill.")
+	}
+}
+
+func TestAllowOversized(t *testing.T) {
+	lim := New(100, 10)
+
+	// Oversized requests should pass on a full bucket, putting it into debt
+	if !lim.Allow(50) {
+		t.Fatalf("oversized request denied from full bucket.")
+	}
+	if lim.Allow(1) {
+		t.Fatalf("token allowed from indebted bucket.")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	lim := New(100, 10)
+
+	if wait := lim.Reserve(10); wait != 0 {
+		t.Fatalf("reservation from full bucket delayed: %v.", wait)
+	}
+	// The next reservation should wait for 10 tokens to refill (~100ms)
+	if wait := lim.Reserve(10); wait < 90*time.Millisecond || wait > 100*time.Millisecond {
+		t.Fatalf("reservation delay mismatch: have %v, want ~%v.", wait, 100*time.Millisecond)
+	}
+}
+
+func TestWait(t *testing.T) {
+	lim := New(100, 1)
+
+	// Make sure waits are paced according to the rate
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if !lim.Wait(1, nil) {
+			t.Fatalf("wait %d aborted.", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("waits finished too fast: have %v, want >= %v.", elapsed, 100*time.Millisecond)
+	}
+	// Make sure waits can be interrupted
+	quit := make(chan struct{})
+	close(quit)
+
+	lim.Reserve(100)
+	if lim.Wait(1, quit) {
+		t.Fatalf("wait succeeded despite quit signal.")
+	}
+	// Make sure the aborted wait was refunded
+	if wait := lim.Reserve(0); wait < 950*time.Millisecond || wait > time.Second {
+		t.Fatalf("refunded debt mismatch: have %v, want ~%v.", wait, time.Second)
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	ops, bytes := New(100, 10), New(100, 10)
+
+	// Drain the byte bucket and make sure the op bucket is left untouched
+	if !AllowAll([]*Limiter{ops, bytes}, []int{1, 10}) {
+		t.Fatalf("tokens denied from full buckets.")
+	}
+	for i := 0; i < 5; i++ {
+		if AllowAll([]*Limiter{ops, bytes}, []int{1, 10}) {
+			t.Fatalf("tokens allowed from empty byte bucket.")
+		}
+	}
+	for i := 0; i < 9; i++ {
+		if !AllowAll([]*Limiter{ops, nil}, []int{1, 10}) {
+			t.Fatalf("token %d denied from op bucket.", i)
+		}
+	}
+	if ops.Allow(1) {
+		t.Fatalf("token allowed from empty op bucket.")
+	}
+}